@@ -0,0 +1,150 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/zioncoin/go/clients/equator"
+)
+
+// CheckAccount causes the custodian to check its own Zioncoin account
+// at the given interval.
+// If the account is gone (e.g. merged away),
+// the custodian's key can no longer sign its payments,
+// or its signers or thresholds differ from those first seen,
+// the custodian is unhealthy
+// and submits no peg-outs, tranche payments, or sweeps
+// until a later check finds the account as it was.
+// Peg-ins and exports are still recorded meanwhile.
+// A deliberate change to the account's signers
+// requires restarting the custodian.
+func CheckAccount(interval time.Duration) Option {
+	return func(c *Custodian) {
+		c.accountCheckInterval = interval
+	}
+}
+
+// accountComponent is the health component of the custodian account check.
+const accountComponent = "custodian account"
+
+// accountSigners is the signing configuration of an account:
+// the weight of each of its signers, keyed by signer key,
+// and its thresholds.
+type accountSigners struct {
+	weights    map[string]int32
+	thresholds equator.AccountThresholds
+}
+
+func signersOf(account equator.Account) *accountSigners {
+	s := &accountSigners{
+		weights:    make(map[string]int32),
+		thresholds: account.Thresholds,
+	}
+	for _, signer := range account.Signers {
+		key := signer.Key
+		if key == "" {
+			// Reported by older Horizon servers.
+			key = signer.PublicKey
+		}
+		s.weights[key] = signer.Weight
+	}
+	return s
+}
+
+func (s *accountSigners) equal(other *accountSigners) bool {
+	if s.thresholds != other.thresholds || len(s.weights) != len(other.weights) {
+		return false
+	}
+	for key, weight := range s.weights {
+		if w, ok := other.weights[key]; !ok || w != weight {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *accountSigners) String() string {
+	return fmt.Sprintf("signers %v, thresholds %d/%d/%d", s.weights, s.thresholds.LowThreshold, s.thresholds.MedThreshold, s.thresholds.HighThreshold)
+}
+
+// Runs as a goroutine until ctx is canceled.
+func (c *Custodian) watchAccount(ctx context.Context) {
+	defer log.Print("watchAccount exiting")
+
+	ticker := time.NewTicker(c.accountCheckInterval)
+	defer ticker.Stop()
+	for {
+		err := c.checkAccount()
+		if err != nil {
+			// The account's state is unknown, so submissions are left as they are.
+			log.Printf("checking custodian account: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAccount loads the custodian account,
+// halting the custodian's submissions if it is unusable or reconfigured
+// and resuming them once it is as it was (see CheckAccount).
+// The account's signing configuration at the first check is the expected one.
+// An error loading the account changes nothing.
+func (c *Custodian) checkAccount() error {
+	addr := c.AccountID.Address()
+	account, err := c.hclient.LoadAccount(addr)
+	if isNotFound(err) {
+		c.haltSubmissions(fmt.Errorf("account %s not found on the Zioncoin network; it may have been merged", addr))
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "loading account %s", addr)
+	}
+	signers := signersOf(account)
+	// The custodian's payments need the medium threshold.
+	if weight := signers.weights[addr]; weight <= 0 || weight < int32(signers.thresholds.MedThreshold) {
+		c.haltSubmissions(fmt.Errorf("custodian key has weight %d, short of the medium threshold %d", weight, signers.thresholds.MedThreshold))
+		return nil
+	}
+	if c.accountSigners == nil {
+		c.accountSigners = signers
+	} else if !signers.equal(c.accountSigners) {
+		c.haltSubmissions(fmt.Errorf("account reconfigured from %s to %s", c.accountSigners, signers))
+		return nil
+	}
+	c.resumeSubmissions()
+	return nil
+}
+
+// haltSubmissions stops the custodian's submissions from its account,
+// marking it unhealthy with reason.
+func (c *Custodian) haltSubmissions(reason error) {
+	if atomic.CompareAndSwapInt32(&c.accountHalted, 0, 1) {
+		log.Printf("halting submissions: %s", reason)
+	}
+	c.health.setUnhealthy(accountComponent, reason)
+}
+
+// resumeSubmissions resumes the submissions stopped by haltSubmissions.
+func (c *Custodian) resumeSubmissions() {
+	if atomic.CompareAndSwapInt32(&c.accountHalted, 1, 0) {
+		log.Print("resuming submissions")
+		c.exports.Broadcast()
+	}
+	c.health.setHealthy(accountComponent)
+}
+
+// submissionsHalted reports whether the custodian must not submit peg-outs,
+// tranche payments, or sweeps:
+// while peg-outs are paused (see PausePegOuts),
+// its account is unusable (see CheckAccount),
+// or it is shutting down (see Shutdown).
+func (c *Custodian) submissionsHalted() bool {
+	return c.pegOutsPaused() || atomic.LoadInt32(&c.accountHalted) != 0 || atomic.LoadInt32(&c.draining) != 0
+}
@@ -0,0 +1,140 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestCheckAccount(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		addr := c.AccountID.Address()
+		account := &equator.Account{
+			Signers:    []equator.Signer{{Key: addr, Weight: 1, Type: "ed25519_public_key"}},
+			Thresholds: equator.AccountThresholds{MedThreshold: 1},
+		}
+		account.AccountID = addr
+		// The custodian account is reported not found while it is nil.
+		var (
+			accountMu sync.Mutex
+			served    = account
+		)
+		setAccount := func(a *equator.Account) {
+			accountMu.Lock()
+			served = a
+			accountMu.Unlock()
+		}
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		hclient.loadAccount = func(accountID string) (equator.Account, error) {
+			if accountID != addr {
+				return hclient.ClientInterface.LoadAccount(accountID)
+			}
+			accountMu.Lock()
+			defer accountMu.Unlock()
+			if served == nil {
+				return equator.Account{}, notFound()
+			}
+			return *served, nil
+		}
+		c.hclient = hclient
+
+		healthy := func() (bool, string) {
+			w := httptest.NewRecorder()
+			c.Health(w, httptest.NewRequest("GET", "/health", nil))
+			return w.Code == http.StatusOK, w.Body.String()
+		}
+		check := func(wantHealthy bool, wantProblem string) {
+			t.Helper()
+			err := c.checkAccount()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, body := healthy()
+			if ok != wantHealthy || c.submissionsHalted() == wantHealthy {
+				t.Fatalf("got healthy %t, submissions halted %t (%s), want healthy %t", ok, c.submissionsHalted(), body, wantHealthy)
+			}
+			if !strings.Contains(body, wantProblem) {
+				t.Errorf("got health %q, want it to mention %q", body, wantProblem)
+			}
+		}
+		check(true, "ok")
+
+		// The account is merged away.
+		setAccount(nil)
+		check(false, "not found")
+
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		txid := []byte("halted")
+		insertTestExport(t, db, txid, lumenXDR, 1000, exporter.Address())
+
+		ctx, cancel := context.WithCancel(ctx)
+		pegouts := make(chan pegOut)
+		done := make(chan struct{})
+		go func() {
+			c.pegOutFromExports(ctx, pegouts)
+			close(done)
+		}()
+		defer func() {
+			cancel()
+			for range pegouts {
+			}
+			<-done
+		}()
+		for i := 0; i < 3; i++ {
+			c.exports.Broadcast()
+			time.Sleep(50 * time.Millisecond)
+		}
+		var state pegOutState
+		err = db.QueryRow("SELECT pegged_out FROM exports WHERE txid=$1", txid).Scan(&state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != pegOutNotYet || atomic.LoadInt32(&hclient.submitted) != 0 {
+			t.Fatalf("got export in state %d after %d submissions while halted, want state %d and none", state, atomic.LoadInt32(&hclient.submitted), pegOutNotYet)
+		}
+
+		// Once the account is back, the export is pegged out.
+		setAccount(account)
+		check(true, "ok")
+		select {
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for peg-out")
+		case p := <-pegouts:
+			if string(p.TxID) != "halted" || p.State != pegOutOK {
+				t.Errorf("got peg-out of export %q in state %d, want halted in state %d", p.TxID, p.State, pegOutOK)
+			}
+		}
+
+		// A signer added out from under the custodian halts it too.
+		reconfigured := *account
+		reconfigured.Signers = append([]equator.Signer{{Key: exporter.Address(), Weight: 1, Type: "ed25519_public_key"}}, account.Signers...)
+		setAccount(&reconfigured)
+		check(false, "reconfigured")
+
+		// So does the custodian key losing its weight.
+		weakened := *account
+		weakened.Thresholds.MedThreshold = 2
+		setAccount(&weakened)
+		check(false, "medium threshold")
+	})
+}
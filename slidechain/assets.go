@@ -0,0 +1,204 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interzioncoin/slingshot/slidechain/net"
+	"github.com/zioncoin/go/amount"
+	"github.com/zioncoin/go/xdr"
+)
+
+// AssetInfo describes an asset that a custodian supports
+// (see SupportedAssets).
+// All amounts are in the asset's smallest unit (stroops, for lumens).
+type AssetInfo struct {
+	// Asset is the asset's string form,
+	// as in the keys of PegOutFees.
+	Asset  string `json:"asset"`
+	Code   string `json:"code,omitempty"`
+	Issuer string `json:"issuer,omitempty"`
+
+	// Balance is the custodian account's balance of the asset,
+	// and Available what is left of it to pay new peg-outs,
+	// after what the custodian owes to exports awaiting peg-out
+	// and, for lumens, its account's minimum balance.
+	Balance   int64 `json:"balance"`
+	Available int64 `json:"available"`
+
+	// Issued reports that the custodian issues the asset,
+	// so it pays the asset out without regard to its balance.
+	Issued bool `json:"issued,omitempty"`
+
+	// MinPayout and MaxPayout bound the amount, net of the fee,
+	// that one export of the asset is pegged out,
+	// as set by the asset's FeePolicy.
+	// A zero MaxPayout is no bound.
+	MinPayout int64 `json:"min_payout"`
+	MaxPayout int64 `json:"max_payout,omitempty"`
+
+	// PegOut reports whether the custodian can currently peg out the asset.
+	// If it cannot, Problem says why.
+	PegOut  bool   `json:"pegout"`
+	Problem string `json:"problem,omitempty"`
+}
+
+// SupportedAssets returns the assets that the custodian accepts and pays out:
+// lumens, the assets to which its account holds trustlines,
+// and the assets with fee policies (see PegOutFees).
+// Each is reported with the custodian's balance of it,
+// the bounds of its fee policy,
+// and whether it can currently be pegged out,
+// so that a client can check an asset before pegging it in.
+// The assets are sorted by their string forms.
+func (c *Custodian) SupportedAssets(ctx context.Context) ([]AssetInfo, error) {
+	account, err := c.hclient.LoadAccount(c.AccountID.Address())
+	if err != nil {
+		return nil, errors.Wrap(err, "loading custodian account")
+	}
+	obligations, err := c.pegOutObligations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		infos = make(map[string]*AssetInfo)
+		held  = make(map[string]bool)
+	)
+	for _, balance := range account.Balances {
+		asset, err := balanceAsset(balance)
+		if err != nil {
+			return nil, err
+		}
+		info, err := c.newAssetInfo(asset)
+		if err != nil {
+			return nil, err
+		}
+		info.Balance, err = amount.ParseInt64(balance.Balance)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing custodian balance %s of %s", balance.Balance, info.Asset)
+		}
+		assetXDR, err := asset.MarshalBinary()
+		if err != nil {
+			return nil, errors.Wrap(err, "marshaling asset xdr")
+		}
+		info.Available = info.Balance - obligations[string(assetXDR)]
+		if asset.Type == xdr.AssetTypeAssetTypeNative {
+			info.Available -= c.minBalance(account)
+		}
+		if info.Available < 0 {
+			info.Available = 0
+		}
+		infos[info.Asset] = info
+		held[info.Asset] = true
+	}
+	for key := range c.fees {
+		if infos[key] != nil {
+			continue
+		}
+		asset, err := parseAsset(key)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing asset of fee policy")
+		}
+		info, err := c.newAssetInfo(asset)
+		if err != nil {
+			return nil, err
+		}
+		infos[info.Asset] = info
+	}
+
+	var halted string
+	switch {
+	case c.observer:
+		halted = "custodian is an observer"
+	case c.submissionsHalted():
+		halted = "peg-outs are halted"
+	}
+	assets := make([]AssetInfo, 0, len(infos))
+	for _, info := range infos {
+		minPayout := info.MinPayout
+		if minPayout < 1 {
+			minPayout = 1
+		}
+		switch {
+		case halted != "":
+			info.Problem = halted
+		case info.Issued:
+		case !held[info.Asset]:
+			info.Problem = "custodian account has no trustline to the asset"
+		case info.Available < minPayout:
+			info.Problem = fmt.Sprintf("available balance %d is below the minimum payout of %d", info.Available, minPayout)
+		}
+		info.PegOut = info.Problem == ""
+		assets = append(assets, *info)
+	}
+	sort.Slice(assets, func(i, j int) bool { return assets[i].Asset < assets[j].Asset })
+	return assets, nil
+}
+
+// newAssetInfo returns the AssetInfo of asset
+// with its code, issuer, and fee policy bounds filled in.
+func (c *Custodian) newAssetInfo(asset xdr.Asset) (*AssetInfo, error) {
+	var typ, code, issuer string
+	err := asset.Extract(&typ, &code, &issuer)
+	if err != nil {
+		return nil, errors.Wrapf(err, "extracting asset %s", asset.String())
+	}
+	policy := c.feePolicy(asset)
+	return &AssetInfo{
+		Asset:     asset.String(),
+		Code:      code,
+		Issuer:    issuer,
+		Issued:    issuer == c.AccountID.Address(),
+		MinPayout: policy.MinPayout,
+		MaxPayout: policy.MaxPayout,
+	}, nil
+}
+
+// parseAsset parses the string form of an asset,
+// as in the keys of PegOutFees.
+func parseAsset(s string) (xdr.Asset, error) {
+	if s == "native" {
+		return xdr.NewAsset(xdr.AssetTypeAssetTypeNative, nil)
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) != 3 {
+		return xdr.Asset{}, fmt.Errorf("asset %q is neither native nor type/code/issuer", s)
+	}
+	var (
+		asset  xdr.Asset
+		issuer xdr.AccountId
+	)
+	err := issuer.SetAddress(parts[2])
+	if err != nil {
+		return xdr.Asset{}, errors.Wrapf(err, "parsing issuer of asset %q", s)
+	}
+	err = asset.SetCredit(parts[1], issuer)
+	if err != nil {
+		return xdr.Asset{}, errors.Wrapf(err, "parsing asset %q", s)
+	}
+	if asset.String() != s {
+		return xdr.Asset{}, fmt.Errorf("asset %q has the wrong type for its code", s)
+	}
+	return asset, nil
+}
+
+// Assets responds with the custodian's SupportedAssets as JSON.
+func (c *Custodian) Assets(w http.ResponseWriter, req *http.Request) {
+	assets, err := c.SupportedAssets(req.Context())
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "listing supported assets: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(assets)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+		return
+	}
+}
@@ -0,0 +1,114 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/interzioncoin/starlight/worizon/xlm"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestSupportedAssets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accounts := make(map[string]equator.Account)
+		hclient := &fakeClient{ClientInterface: c.hclient, loadAccount: loadAccountsFrom(accounts)}
+		c.hclient = hclient
+		// The custodian holds 1000 lumens and trusts USD, of which it holds none.
+		var account equator.Account
+		account.AccountID = c.AccountID.Address()
+		account = withTrustline(account)
+		native := equator.Balance{Balance: "1000.0000000"}
+		native.Type = "native"
+		account.Balances = append(account.Balances, native)
+		accounts[c.AccountID.Address()] = account
+
+		var (
+			usd    = "credit_alphanum4/USD/" + importTestAccountID
+			eur    = "credit_alphanum4/EUR/" + importTestAccountID
+			issued = "credit_alphanum4/ZIO/" + c.AccountID.Address()
+		)
+		c.fees = map[string]FeePolicy{
+			"native": {MinPayout: int64(10 * xlm.Lumen)},
+			usd:      {MinPayout: 5, MaxPayout: 1000},
+			eur:      {MinPayout: 5},
+			issued:   {MaxPayout: 1000},
+		}
+		// The custodian owes 600 lumens to a pending export.
+		insertTestExport(t, db, []byte("pending"), lumenXDR, int64(600*xlm.Lumen), exporter.Address())
+
+		want := []AssetInfo{
+			{Asset: eur, Code: "EUR", Issuer: importTestAccountID, MinPayout: 5, Problem: "custodian account has no trustline to the asset"},
+			{Asset: usd, Code: "USD", Issuer: importTestAccountID, MinPayout: 5, MaxPayout: 1000, Problem: "available balance 0 is below the minimum payout of 5"},
+			{Asset: issued, Code: "ZIO", Issuer: c.AccountID.Address(), Issued: true, MaxPayout: 1000, PegOut: true},
+			{Asset: "native", Balance: int64(1000 * xlm.Lumen), Available: int64(400*xlm.Lumen) - 3*DefaultBaseReserve, MinPayout: int64(10 * xlm.Lumen), PegOut: true},
+		}
+		got, err := c.SupportedAssets(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got assets\n%+v\nwant\n%+v", got, want)
+		}
+
+		w := httptest.NewRecorder()
+		c.Assets(w, httptest.NewRequest("GET", "/assets", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d from /assets: %s", w.Code, w.Body.String())
+		}
+		var served []AssetInfo
+		err = json.Unmarshal(w.Body.Bytes(), &served)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(served, want) {
+			t.Errorf("got assets\n%+v\nfrom /assets, want\n%+v", served, want)
+		}
+
+		// While submissions are halted, nothing can be pegged out.
+		atomic.StoreInt32(&c.accountHalted, 1)
+		got, err = c.SupportedAssets(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range got {
+			if info.PegOut || info.Problem != "peg-outs are halted" {
+				t.Errorf("got %s pegout %t (%s) while halted", info.Asset, info.PegOut, info.Problem)
+			}
+		}
+	})
+}
+
+func TestFeePolicyMaxPayout(t *testing.T) {
+	policy := FeePolicy{Flat: 10, MaxPayout: 1000}
+	payout, fee, err := policy.Payout(1010)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payout != 1000 || fee != 10 {
+		t.Errorf("got payout %d and fee %d, want 1000 and 10", payout, fee)
+	}
+	_, _, err = policy.Payout(1011)
+	if err == nil {
+		t.Error("got no error for a payout above the maximum")
+	}
+}
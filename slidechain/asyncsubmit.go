@@ -0,0 +1,297 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	i10rnet "github.com/interzioncoin/starlight/net"
+	b "github.com/zioncoin/go/build"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/xdr"
+)
+
+// AsyncPegOuts causes the custodian to submit peg-out txs asynchronously,
+// with Horizon accepting each one without waiting for it to be applied.
+// An accepted peg-out is pending until its tx appears
+// in the custodian account's tx stream,
+// when it is confirmed as pegged out.
+//
+// Peg-outs are submitted with the AsyncSubmitter of the custodian's Horizon client,
+// or with the async endpoint of an equator.Client's server.
+// With other clients,
+// and after a Horizon server reports that it has no async endpoint,
+// peg-outs are submitted synchronously.
+func AsyncPegOuts() Option {
+	return func(c *Custodian) {
+		c.asyncPegOuts = true
+	}
+}
+
+// Statuses of a tx submitted asynchronously.
+const (
+	AsyncPending       = "PENDING"
+	AsyncDuplicate     = "DUPLICATE"
+	AsyncTryAgainLater = "TRY_AGAIN_LATER"
+	AsyncError         = "ERROR"
+)
+
+// AsyncSubmission is Horizon's response to a tx submitted asynchronously.
+type AsyncSubmission struct {
+	Hash   string `json:"hash"`
+	Status string `json:"tx_status"`
+
+	// ErrorResultXDR is the base64-encoded TransactionResult
+	// of a tx with status AsyncError.
+	ErrorResultXDR string `json:"error_result_xdr,omitempty"`
+}
+
+// ErrAsyncUnsupported is returned by an AsyncSubmitter
+// whose Horizon server cannot submit txs asynchronously.
+var ErrAsyncUnsupported = errors.New("async tx submission unsupported")
+
+// AsyncSubmitter is implemented by Horizon clients
+// that can submit txs asynchronously (see AsyncPegOuts).
+type AsyncSubmitter interface {
+	SubmitTransactionAsync(txeBase64 string) (AsyncSubmission, error)
+}
+
+// asyncClient submits txs to the async endpoint
+// of an equator.Client's server.
+type asyncClient struct {
+	*equator.Client
+}
+
+func (c asyncClient) SubmitTransactionAsync(txeBase64 string) (AsyncSubmission, error) {
+	resp, err := c.HTTP.PostForm(c.URL+"/transactions_async", url.Values{"tx": {txeBase64}})
+	if err != nil {
+		return AsyncSubmission{}, errors.Wrap(err, "posting tx")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		// Older Horizon servers have no such endpoint.
+		return AsyncSubmission{}, ErrAsyncUnsupported
+	}
+	var s AsyncSubmission
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	if err != nil {
+		return AsyncSubmission{}, errors.Wrapf(err, "decoding response with status %d", resp.StatusCode)
+	}
+	if s.Status == "" {
+		return AsyncSubmission{}, fmt.Errorf("response with status %d has no tx status", resp.StatusCode)
+	}
+	return s, nil
+}
+
+// asyncSubmitter returns the AsyncSubmitter with which to submit peg-out txs,
+// or nil if they are submitted synchronously.
+func (c *Custodian) asyncSubmitter() AsyncSubmitter {
+	if !c.asyncPegOuts || atomic.LoadInt32(&c.asyncUnsupported) != 0 {
+		return nil
+	}
+	switch hclient := c.hclient.(type) {
+	case AsyncSubmitter:
+		return hclient
+	case *equator.Client:
+		return asyncClient{hclient}
+	}
+	return nil
+}
+
+// asyncRejection is the error of a tx that Horizon did not accept
+// for asynchronous submission.
+type asyncRejection struct {
+	status    string
+	resultXDR string
+}
+
+func (e *asyncRejection) Error() string {
+	if e.resultXDR == "" {
+		return fmt.Sprintf("tx not accepted: %s", e.status)
+	}
+	return fmt.Sprintf("tx not accepted: %s (result %s)", e.status, e.resultXDR)
+}
+
+// class classifies the rejection as classifyHorizonError does a failed submission.
+// A tx that Horizon asks to be submitted later is retryable like one whose fee is too low,
+// the usual cause.
+func (e *asyncRejection) class() ErrorClass {
+	if e.status == AsyncTryAgainLater {
+		return ClassRetryableFee
+	}
+	var result xdr.TransactionResult
+	err := xdr.SafeUnmarshalBase64(e.resultXDR, &result)
+	if err != nil {
+		// The tx was still not accepted, so it is never applied.
+		return ClassPermanent
+	}
+	return classifyTxResult(result)
+}
+
+// signAndSubmitPegOutTx signs and submits the peg-out tx with the given hash,
+// asynchronously if the custodian does so (see AsyncPegOuts).
+// It reports whether the tx was accepted but is pending,
+// rather than applied.
+func (c *Custodian) signAndSubmitPegOutTx(ctx context.Context, tx *b.TransactionBuilder, hash string) (bool, error) {
+	as := c.asyncSubmitter()
+	if as == nil {
+		return false, c.signAndSubmitTx(ctx, tx, hash)
+	}
+	_, span := c.startSpan(ctx, "equator.submit_async", SpanContext{})
+	span.SetAttribute("zioncoin.tx", hash)
+	err := c.signAndSubmitAsync(as, tx)
+	span.End(err)
+	if errors.Root(err) == ErrAsyncUnsupported {
+		log.Print("equator server cannot submit txs asynchronously, submitting peg-outs synchronously")
+		atomic.StoreInt32(&c.asyncUnsupported, 1)
+		return false, c.signAndSubmitTx(ctx, tx, hash)
+	}
+	return err == nil, err
+}
+
+// signAndSubmitAsync signs tx with the custodian's seed
+// and submits it with as.
+func (c *Custodian) signAndSubmitAsync(as AsyncSubmitter, tx *b.TransactionBuilder) error {
+	txenv, err := tx.Sign(c.seed)
+	if err != nil {
+		return errors.Wrap(err, "signing tx")
+	}
+	txstr, err := xdr.MarshalBase64(txenv.E)
+	if err != nil {
+		return errors.Wrap(err, "marshaling txenv")
+	}
+	s, err := as.SubmitTransactionAsync(txstr)
+	if err != nil {
+		return err
+	}
+	switch s.Status {
+	case AsyncPending, AsyncDuplicate:
+		return nil
+	case AsyncTryAgainLater, AsyncError:
+		return &asyncRejection{status: s.Status, resultXDR: s.ErrorResultXDR}
+	}
+	return fmt.Errorf("unknown async submission status %q", s.Status)
+}
+
+// Runs as a goroutine until ctx is canceled.
+// confirmPegOuts streams the custodian account's txs from the equator server,
+// confirming the pending peg-outs whose txs appear.
+// Peg-outs whose txs were applied while the stream was down
+// are looked up each time it connects.
+func (c *Custodian) confirmPegOuts(ctx context.Context) {
+	defer log.Print("confirmPegOuts exiting")
+	backoff := i10rnet.Backoff{Base: 100 * time.Millisecond}
+
+	for {
+		cur := equator.Cursor("now")
+		c.checkPendingPegOuts(ctx)
+		err := c.hclient.StreamTransactions(ctx, c.AccountID.Address(), &cur, func(tx equator.Transaction) {
+			c.retryDB(ctx, fmt.Sprintf("confirming peg-out tx %s", tx.Hash), func(ctx context.Context) error {
+				return c.confirmPegOut(ctx, tx.Hash)
+			})
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("tx stream for peg-out confirmations disconnected (%v), retrying...", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff.Next()):
+		}
+	}
+}
+
+// checkPendingPegOuts looks up the tx of each pending peg-out,
+// confirming those that have been applied.
+func (c *Custodian) checkPendingPegOuts(ctx context.Context) {
+	var hashes []string
+	err := sqlutil.ForQueryRows(ctx, c.DB, `SELECT zioncoin_tx FROM exports WHERE pegged_out=$1 AND custodian_id=$2`, pegOutPending, c.label, func(hash string) {
+		hashes = append(hashes, hash)
+	})
+	if err != nil {
+		log.Printf("querying pending peg-outs: %s", err)
+		return
+	}
+	for _, hash := range hashes {
+		_, err = c.hclient.LoadTransaction(hash)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			log.Printf("loading pending peg-out tx %s: %s", hash, err)
+			continue
+		}
+		err = c.retryDB(ctx, fmt.Sprintf("confirming peg-out tx %s", hash), func(ctx context.Context) error {
+			return c.confirmPegOut(ctx, hash)
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// confirmPegOut marks the pending peg-out whose tx has the given hash, if any,
+// as pegged out,
+// or partly pegged out if it has tranches left to pay,
+// and records its fee.
+func (c *Custodian) confirmPegOut(ctx context.Context, hash string) error {
+	var (
+		txid, ref []byte
+		version   int64
+	)
+	const q = `SELECT txid, pegout_json, version FROM exports WHERE zioncoin_tx=$1 AND pegged_out=$2 AND custodian_id=$3`
+	err := c.DB.QueryRowContext(ctx, q, hash, pegOutPending, c.label).Scan(&txid, &ref, &version)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "looking up peg-out tx %s", hash)
+	}
+	var p pegOut
+	err = decodeRefdata(ref, &p)
+	if err != nil {
+		return errors.Wrapf(err, "unmarshaling refdata of export %x", txid)
+	}
+	var tranches int
+	err = c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM tranches WHERE export_txid=$1`, txid).Scan(&tranches)
+	if err != nil {
+		return errors.Wrapf(err, "counting tranches of export %x", txid)
+	}
+	state := pegOutOK
+	if tranches > 0 {
+		state = pegOutPartial
+	}
+	var asset xdr.Asset
+	err = xdr.SafeUnmarshal(p.AssetXDR, &asset)
+	if err != nil {
+		return errors.Wrapf(err, "unmarshaling asset of export %x", txid)
+	}
+	// The fee was charged when the peg-out was submitted.
+	_, fee, err := c.feePolicy(asset).Payout(p.Amount)
+	if err == nil && fee > 0 {
+		err = c.recordFee(ctx, txid, p.AssetXDR, fee)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.updateExportState(ctx, txid, version, state, hash)
+	if errors.Root(err) == errExportChanged {
+		// Confirmed on the next check, if still pending.
+		log.Printf("export %x changed while its peg-out was confirmed", txid)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("confirmed peg-out tx %s of export %x", hash, txid)
+	return nil
+}
@@ -0,0 +1,219 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/network"
+	"github.com/zioncoin/go/xdr"
+)
+
+// holdAsync has hclient accept txs for asynchronous submission,
+// holding each one back from the client it wraps until apply is called,
+// and report the txs not yet applied as not found.
+// With unsupported set, it reports that it cannot submit asynchronously.
+// It returns apply and the count of async submissions.
+func holdAsync(hclient *fakeClient, unsupported bool) (apply func(hashes ...string) error, async *int32) {
+	var (
+		mu      sync.Mutex
+		held    []string
+		applied = make(map[string]bool)
+	)
+	async = new(int32)
+	hclient.submitTransactionAsync = func(txeBase64 string) (AsyncSubmission, error) {
+		atomic.AddInt32(async, 1)
+		if unsupported {
+			return AsyncSubmission{}, ErrAsyncUnsupported
+		}
+		var txe xdr.TransactionEnvelope
+		err := xdr.SafeUnmarshalBase64(txeBase64, &txe)
+		if err != nil {
+			return AsyncSubmission{}, err
+		}
+		hash, err := network.HashTransaction(&txe.Tx, network.TestNetworkPassphrase)
+		if err != nil {
+			return AsyncSubmission{}, err
+		}
+		mu.Lock()
+		held = append(held, txeBase64)
+		mu.Unlock()
+		return AsyncSubmission{Hash: hex.EncodeToString(hash[:]), Status: AsyncPending}, nil
+	}
+	hclient.loadTransaction = func(hash string) (equator.Transaction, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !applied[hash] {
+			return equator.Transaction{}, notFound()
+		}
+		return equator.Transaction{Hash: hash}, nil
+	}
+	// The held txs are submitted to the wrapped client,
+	// which streams them as applied.
+	apply = func(hashes ...string) error {
+		mu.Lock()
+		txs := held
+		held = nil
+		for _, hash := range hashes {
+			applied[hash] = true
+		}
+		mu.Unlock()
+		for _, txe := range txs {
+			_, err := hclient.ClientInterface.SubmitTransaction(txe)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return apply, async
+}
+
+func TestAsyncPegOuts(t *testing.T) {
+	cases := []struct {
+		name        string
+		async       bool
+		unsupported bool
+		wantAsync   int32
+	}{
+		{"sync", false, false, 0},
+		{"async", true, false, 1},
+		{"async on older equator", true, true, 1},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			var opts []Option
+			if tt.async {
+				opts = append(opts, AsyncPegOuts())
+			}
+			withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+				exporter, err := keypair.Random()
+				if err != nil {
+					t.Fatal(err)
+				}
+				lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+				if err != nil {
+					t.Fatal(err)
+				}
+				hclient := &fakeClient{ClientInterface: c.hclient}
+				apply, async := holdAsync(hclient, tt.unsupported)
+				c.hclient = hclient
+
+				txid := []byte("export")
+				insertTestExport(t, db, txid, lumenXDR, 1000, exporter.Address())
+				exportState := func() (pegOutState, string) {
+					var (
+						state pegOutState
+						hash  string
+					)
+					err := db.QueryRow("SELECT pegged_out, zioncoin_tx FROM exports WHERE txid=$1", txid).Scan(&state, &hash)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return state, hash
+				}
+
+				ctx, cancel := context.WithCancel(ctx)
+				pegouts := make(chan pegOut)
+				done := make(chan struct{})
+				go func() {
+					c.pegOutFromExports(ctx, pegouts)
+					close(done)
+				}()
+				defer func() {
+					cancel()
+					for range pegouts {
+					}
+					<-done
+				}()
+				if tt.async {
+					go c.confirmPegOuts(ctx)
+				}
+
+				// awaitState wakes pegOutFromExports until the export is in state want.
+				awaitState := func(want pegOutState) string {
+					for {
+						state, hash := exportState()
+						if state == want {
+							return hash
+						}
+						select {
+						case <-ctx.Done():
+							t.Fatalf("timed out waiting for export in state %d, got %d", want, state)
+						case <-pegouts:
+						case <-time.After(50 * time.Millisecond):
+							c.exports.Broadcast()
+						}
+					}
+				}
+
+				if tt.async && !tt.unsupported {
+					// Accepted, but not yet applied.
+					hash := awaitState(pegOutPending)
+					if hash == "" {
+						t.Fatal("pending peg-out has no tx hash")
+					}
+					time.Sleep(100 * time.Millisecond)
+					if state, _ := exportState(); state != pegOutPending {
+						t.Fatalf("got state %d before peg-out tx was applied, want %d", state, pegOutPending)
+					}
+					stats, err := c.Stats(ctx, time.Hour)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if stats.Exports.AwaitingConfirmation != 1 {
+						t.Errorf("got %d exports awaiting confirmation, want 1", stats.Exports.AwaitingConfirmation)
+					}
+					err = apply(hash)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				awaitState(pegOutOK)
+				if n := atomic.LoadInt32(async); n != tt.wantAsync {
+					t.Errorf("got %d async submissions, want %d", n, tt.wantAsync)
+				}
+				if unsupported := atomic.LoadInt32(&c.asyncUnsupported) != 0; unsupported != tt.unsupported {
+					t.Errorf("got async unsupported %t, want %t", unsupported, tt.unsupported)
+				}
+			}, opts...)
+		})
+	}
+}
+
+func TestAsyncRejectionClass(t *testing.T) {
+	result := func(code xdr.TransactionResultCode) string {
+		s, err := xdr.MarshalBase64(xdr.TransactionResult{Result: xdr.TransactionResultResult{Code: code}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	cases := []struct {
+		rej  asyncRejection
+		want ErrorClass
+	}{
+		{asyncRejection{status: AsyncTryAgainLater}, ClassRetryableFee},
+		{asyncRejection{status: AsyncError, resultXDR: result(xdr.TransactionResultCodeTxBadSeq)}, ClassRetryableSeq},
+		{asyncRejection{status: AsyncError, resultXDR: result(xdr.TransactionResultCodeTxInsufficientFee)}, ClassRetryableFee},
+		{asyncRejection{status: AsyncError, resultXDR: result(xdr.TransactionResultCodeTxBadAuth)}, ClassBadAuth},
+		{asyncRejection{status: AsyncError, resultXDR: result(xdr.TransactionResultCodeTxTooLate)}, ClassPermanent},
+		{asyncRejection{status: AsyncError, resultXDR: "garbage"}, ClassPermanent},
+	}
+	for _, tt := range cases {
+		rej := tt.rej
+		if got, _ := classifyHorizonError(&rej); got != tt.want {
+			t.Errorf("%s: got class %s, want %s", rej.Error(), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/zioncoin/go/clients/equator"
+)
+
+// backfillIdle is how long Backfill waits for another transaction
+// before concluding that it has streamed all of the account's history.
+// It applies only when there is no stored peg-in cursor to stop at.
+var backfillIdle = 30 * time.Second
+
+// Backfill records peg-in payments made to the custodian account
+// from ledger fromLedger onward,
+// for an account that received peg-in payments
+// before this custodian began watching it,
+// e.g. one migrated from another system.
+// It streams the account's transactions
+// up to the stored peg-in cursor,
+// beyond which watchPegIns has seen them,
+// or, if there is none,
+// up to the latest ledger known to Horizon.
+//
+// Only payments matching a peg awaiting payment are recorded,
+// and queued for import like any other peg-in.
+// Payments for pegs already paid or imported,
+// or matching no peg,
+// are skipped rather than flagged,
+// so Backfill may safely cover history that has already been processed,
+// and may be run more than once.
+// It does not move the peg-in cursor.
+func (c *Custodian) Backfill(ctx context.Context, fromLedger uint32) error {
+	var stop string
+	err := c.DB.QueryRowContext(ctx, "SELECT cursor FROM custodian WHERE label=$1", c.label).Scan(&stop)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Wrap(err, "reading cursor from db")
+	}
+	var stopToid int64
+	if stop != "" {
+		stopToid, err = strconv.ParseInt(stop, 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "parsing peg-in cursor %q", stop)
+		}
+	} else {
+		root, err := c.hclient.Root()
+		if err != nil {
+			return errors.Wrap(err, "getting equator root")
+		}
+		// The greatest paging token in the latest ledger.
+		stopToid = (int64(root.HorizonSequence)+1)<<32 - 1
+	}
+	if int64(fromLedger)<<32 > stopToid {
+		return fmt.Errorf("backfill start ledger %d is past the end of history at ledger %d", fromLedger, stopToid>>32)
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		done     bool
+		recorded int
+		handErr  error
+	)
+	finish := func(err error) {
+		mu.Lock()
+		done = true
+		if handErr == nil {
+			handErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+	idle := time.AfterFunc(backfillIdle, func() { finish(nil) })
+	defer idle.Stop()
+
+	// Horizon paging tokens place the ledger sequence in the high 32 bits.
+	cur := equator.Cursor(strconv.FormatInt(int64(fromLedger)<<32, 10))
+	err = c.hclient.StreamTransactions(streamCtx, c.AccountID.Address(), &cur, func(tx equator.Transaction) {
+		if streamCtx.Err() != nil {
+			return
+		}
+		idle.Stop()
+		defer idle.Reset(backfillIdle)
+		toid, err := strconv.ParseInt(tx.PT, 10, 64)
+		if err != nil {
+			finish(errors.Wrapf(err, "parsing paging token %q of Zioncoin tx %s", tx.PT, tx.ID))
+			return
+		}
+		if toid > stopToid {
+			finish(nil)
+			return
+		}
+		payments, err := c.pegInPayments(tx)
+		if err != nil {
+			finish(err)
+			return
+		}
+		for _, p := range payments {
+			ok, err := c.backfillPegIn(ctx, tx.ID, cursorLedger(tx.PT), p)
+			if err != nil {
+				finish(err)
+				return
+			}
+			if ok {
+				recorded++
+			}
+		}
+		if toid == stopToid {
+			finish(nil)
+		}
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if handErr != nil {
+		return handErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil && !done {
+		return errors.Wrap(err, "streaming custodian account history")
+	}
+	log.Printf("backfill from ledger %d recorded %d peg-in payments", fromLedger, recorded)
+	if recorded > 0 && c.pegState() == pegPaid {
+		c.imports.Broadcast()
+	}
+	return nil
+}
+
+// backfillPegIn records peg-in payment p,
+// observed in Zioncoin tx txid in the given ledger,
+// if it matches a peg awaiting payment.
+// It reports whether it did.
+func (c *Custodian) backfillPegIn(ctx context.Context, txid string, ledger int32, p pegInPayment) (bool, error) {
+	problem, err := c.checkIssuer(ctx, p.assetXDR)
+	if err != nil {
+		return false, err
+	}
+	if problem != "" {
+		log.Printf("backfill: skipping peg-in payment in Zioncoin tx %s with nonce hash %x: %s", txid, p.nonceHash, problem)
+		return false, nil
+	}
+	var numAffected int64
+	err = c.retryDB(ctx, fmt.Sprintf("backfilling peg-in payment for hash %x", p.nonceHash), func(ctx context.Context) error {
+		dbtx, err := c.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return errors.Wrap(err, "beginning db transaction")
+		}
+		defer dbtx.Rollback()
+
+		numAffected, err = markPegPaid(ctx, dbtx, c.label, txid, ledger, c.pegState(), p.nonceHash, p.source, p.amount, p.assetXDR)
+		if err != nil {
+			return err
+		}
+		return errors.Wrapf(dbtx.Commit(), "committing peg-in payment for hash %x", p.nonceHash)
+	})
+	if err != nil {
+		return false, err
+	}
+	if numAffected == 0 {
+		log.Printf("backfill: skipping payment in Zioncoin tx %s with nonce hash %x, which matches no peg awaiting payment", txid, p.nonceHash)
+		return false, nil
+	}
+	log.Printf("backfill: recorded peg-in payment in Zioncoin tx %s with nonce hash %x", txid, p.nonceHash)
+	return true, nil
+}
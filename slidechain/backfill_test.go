@@ -0,0 +1,212 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol/bc"
+	b "github.com/zioncoin/go/build"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/network"
+	"github.com/zioncoin/go/xdr"
+)
+
+func TestBackfill(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		kp, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The history is streamed from after the given cursor,
+		// then the stream waits for ctx to be canceled, as Horizon's does,
+		// and latest is reported as the latest ledger in the Horizon root.
+		var (
+			history []equator.Transaction
+			latest  int32
+		)
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		hclient.streamTransactions = func(ctx context.Context, accountID string, cursor *equator.Cursor, handler equator.TransactionHandler) error {
+			from, err := strconv.ParseInt(string(*cursor), 10, 64)
+			if err != nil {
+				return err
+			}
+			for _, tx := range history {
+				if ctx.Err() != nil {
+					return nil
+				}
+				toid, err := strconv.ParseInt(tx.PT, 10, 64)
+				if err != nil {
+					return err
+				}
+				if toid > from {
+					handler(tx)
+				}
+			}
+			<-ctx.Done()
+			return nil
+		}
+		hclient.root = func() (equator.Root, error) {
+			root, err := hclient.ClientInterface.Root()
+			root.HorizonSequence = latest
+			return root, err
+		}
+		c.hclient = hclient
+
+		// payIn adds to the history a 10-lumen payment to the custodian
+		// with the given memo hash, as the first tx in the given ledger.
+		payIn := func(ledger int64, nonceHash [32]byte) string {
+			tx, err := b.Transaction(
+				b.Network{Passphrase: network.TestNetworkPassphrase},
+				b.SourceAccount{AddressOrSeed: kp.Address()},
+				b.Sequence{Sequence: uint64(ledger)},
+				b.MemoHash{Value: xdr.Hash(nonceHash)},
+				b.Payment(
+					b.Destination{AddressOrSeed: c.AccountID.Address()},
+					b.NativeAmount{Amount: "10"},
+				),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, err := tx.Sign(kp.Seed())
+			if err != nil {
+				t.Fatal(err)
+			}
+			envXDR, err := xdr.MarshalBase64(env.E)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pt := strconv.FormatInt(ledger<<32|1<<12, 10)
+			history = append(history, equator.Transaction{
+				ID:          fmt.Sprintf("ledger%d", ledger),
+				PT:          pt,
+				EnvelopeXdr: envXDR,
+			})
+			return pt
+		}
+		newPeg := func(i int64) [32]byte {
+			expMS := int64(bc.Millis(time.Now().Add(10*time.Minute))) + i
+			nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
+			err := c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, expMS, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return nonceHash
+		}
+
+		var (
+			early    = newPeg(1)
+			imported = newPeg(2)
+			pending  = newPeg(3)
+			beyond   = newPeg(4)
+			unknown  = uniqueNonceHash(c.InitBlockHash.Bytes(), 5)
+		)
+		_, err = db.Exec("UPDATE pegs SET amount=5, zioncoin_tx=1, imported=1 WHERE nonce_hash=$1", imported[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		payIn(90, early)
+		payIn(100, imported)
+		payIn(101, pending)
+		payIn(102, unknown)
+		cursor := payIn(103, imported)
+		payIn(104, beyond)
+
+		// watchPegIns has seen the history through ledger 103.
+		_, err = db.Exec("UPDATE custodian SET cursor=$1 WHERE seed=$2", cursor, c.seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		check := func() {
+			t.Helper()
+			cases := []struct {
+				name       string
+				nonceHash  [32]byte
+				wantPaid   int
+				wantAmount int64
+			}{
+				{"early", early, 0, 0},
+				{"imported", imported, 1, 5},
+				{"pending", pending, 1, 10 * 10000000},
+				{"beyond", beyond, 0, 0},
+			}
+			for _, tt := range cases {
+				var (
+					paid   int
+					amount sql.NullInt64
+				)
+				err := db.QueryRow("SELECT zioncoin_tx, amount FROM pegs WHERE nonce_hash=$1", tt.nonceHash[:]).Scan(&paid, &amount)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if paid != tt.wantPaid || amount.Int64 != tt.wantAmount {
+					t.Errorf("%s peg: got zioncoin_tx=%d, amount %d, want zioncoin_tx=%d, amount %d", tt.name, paid, amount.Int64, tt.wantPaid, tt.wantAmount)
+				}
+			}
+			var flagged, events int
+			err := db.QueryRow("SELECT COUNT(*) FROM flagged_pegs").Scan(&flagged)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if flagged != 0 {
+				t.Errorf("got %d flagged payments, want 0", flagged)
+			}
+			err = db.QueryRow("SELECT COUNT(*) FROM events WHERE type=$1", EventPegIn).Scan(&events)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if events != 1 {
+				t.Errorf("got %d peg-in events, want 1", events)
+			}
+			var cur string
+			err = db.QueryRow("SELECT cursor FROM custodian WHERE seed=$1", c.seed).Scan(&cur)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cur != cursor {
+				t.Errorf("got cursor %q after backfill, want %q", cur, cursor)
+			}
+		}
+
+		err = c.Backfill(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check()
+
+		// Backfilling again changes nothing.
+		err = c.Backfill(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check()
+
+		// Without a stored cursor,
+		// Backfill stops at the latest ledger known to Horizon.
+		_, err = db.Exec("UPDATE custodian SET cursor='' WHERE seed=$1", c.seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cursor = ""
+		latest = 103
+		err = c.Backfill(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check()
+
+		err = c.Backfill(ctx, 104)
+		if err == nil {
+			t.Error("got no error backfilling from past the latest ledger")
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/chain/txvm/errors"
+)
+
+// MaxExportBacklog bounds the number of exports awaiting peg-out
+// (pending, marked for retry, or awaiting an offline signature).
+// Once the backlog reaches max,
+// for instance because Horizon is down and peg-outs are stalled,
+// the custodian defers recording new exports,
+// and reports itself unhealthy,
+// until the backlog drops below max.
+// Deferred exports are not lost:
+// they remain on the txvm chain and are recorded in block order once work drains.
+// Zero, the default, means no bound.
+func MaxExportBacklog(max int) Option {
+	return func(c *Custodian) {
+		c.maxExportBacklog = max
+	}
+}
+
+// exportBacklog counts the exports awaiting peg-out.
+func (c *Custodian) exportBacklog(ctx context.Context) (int, error) {
+	var n int
+	err := c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM exports WHERE pegged_out IN ($1, $2, $3) AND custodian_id=$4`, pegOutNotYet, pegOutRetry, pegOutUnsigned, c.label).Scan(&n)
+	return n, errors.Wrap(err, "counting exports awaiting peg-out")
+}
+
+// awaitExportBacklog blocks while the export backlog is at its bound,
+// rechecking once per block interval.
+// It returns an error only if ctx is canceled.
+func (c *Custodian) awaitExportBacklog(ctx context.Context) error {
+	if c.maxExportBacklog <= 0 {
+		return nil
+	}
+	const component = "export backlog"
+	for {
+		var n int
+		err := c.retryDB(ctx, "counting export backlog", func(ctx context.Context) error {
+			var err error
+			n, err = c.exportBacklog(ctx)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if n < c.maxExportBacklog {
+			c.health.setHealthy(component)
+			return nil
+		}
+		c.health.setUnhealthy(component, fmt.Errorf("%d exports awaiting peg-out, at limit of %d; deferring new exports", n, c.maxExportBacklog))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.S.blockInterval):
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestExportBacklog(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		c.S.blockInterval = 50 * time.Millisecond
+
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		backlogged := func() bool {
+			for _, p := range c.health.problems() {
+				if strings.HasPrefix(p, "export backlog:") {
+					return true
+				}
+			}
+			return false
+		}
+
+		// With no peg-outs running, recorded exports are never drained.
+		insertTestExport(t, db, []byte("export 1"), lumenXDR, 100, exporter.Address())
+		err = c.awaitExportBacklog(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if backlogged() {
+			t.Fatal("backpressure engaged below the backlog limit")
+		}
+		insertTestExport(t, db, []byte("export 2"), lumenXDR, 100, exporter.Address())
+
+		done := make(chan error, 1)
+		go func() {
+			done <- c.awaitExportBacklog(ctx)
+		}()
+		select {
+		case err := <-done:
+			t.Fatalf("new export not deferred at the backlog limit (err %v)", err)
+		case <-time.After(500 * time.Millisecond):
+		}
+		if !backlogged() {
+			t.Error("custodian healthy while deferring exports")
+		}
+
+		w := httptest.NewRecorder()
+		c.Status(w, httptest.NewRequest("GET", "/status", nil))
+		var status Status
+		err = json.Unmarshal(w.Body.Bytes(), &status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Exports.Backlog != 2 || status.Exports.BacklogLimit != 2 {
+			t.Errorf("got backlog %d of %d in status, want 2 of 2", status.Exports.Backlog, status.Exports.BacklogLimit)
+		}
+
+		// Once a peg-out drains the backlog, the deferred export proceeds.
+		_, err = db.Exec("UPDATE exports SET pegged_out=$1 WHERE txid=$2", pegOutOK, []byte("export 1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for the backlog to drain")
+		}
+		if backlogged() {
+			t.Error("custodian still unhealthy after the backlog drained")
+		}
+	}, MaxExportBacklog(2))
+}
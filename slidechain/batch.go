@@ -0,0 +1,188 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txvm"
+)
+
+// BatchWrites causes the custodian to batch its db writes
+// for exports and peg-ins:
+// it records all the exports in a txvm block in one db transaction,
+// and all the peg-in payments in a Zioncoin tx in one db transaction,
+// rather than one transaction each.
+// This saves a commit per export on busy chains.
+// The peg-out workers are woken once the batch is committed.
+// If a batch fails, none of it is written,
+// and its block or Zioncoin tx is processed again.
+func BatchWrites() Option {
+	return func(c *Custodian) {
+		c.batchWrites = true
+	}
+}
+
+// recordExportBatch records the exports in batch in the db,
+// then wakes up the goroutine that executes peg-outs on the main chain.
+// The exports may already be recorded if their block is being reprocessed.
+// While peg-outs are not keeping up, it waits for them to drain first.
+func (c *Custodian) recordExportBatch(ctx context.Context, batch []exportRecord) error {
+	err := c.awaitExportBacklog(ctx)
+	if err != nil {
+		return err
+	}
+	err = c.recordExports(ctx, batch)
+	if err != nil {
+		return err
+	}
+	for _, r := range batch {
+		exportedAssetBytes := txvm.AssetID(importIssuanceSeed[:], r.info.AssetXDR)
+		log.Printf("recorded export: %d of txvm asset %x (Zioncoin %x) for %s in tx %x", r.info.Amount, exportedAssetBytes, r.info.AssetXDR, r.info.Exporter, r.txid)
+		if r.payoutAfterMS > 0 {
+			log.Printf("export tx %x is reversible until %s", r.txid, bc.FromMillis(uint64(r.payoutAfterMS)))
+		}
+	}
+	c.exports.Broadcast()
+	return nil
+}
+
+// exportRecord is an export for recordExports to record.
+type exportRecord struct {
+	txid, ref     []byte
+	info          pegOut
+	payoutAfterMS int64
+	height        uint64 // of the block containing the export
+}
+
+// recordExports is recordExport for each of recs,
+// all in one db transaction (see BatchWrites).
+// If any fails, none is recorded.
+func (c *Custodian) recordExports(ctx context.Context, recs []exportRecord) (err error) {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	var spans []Span
+	defer func() {
+		for _, span := range spans {
+			span.End(err)
+		}
+	}()
+	for _, r := range recs {
+		spanCtx, span := c.startSpan(ctx, "slidechain.export", SpanContext{})
+		spans = append(spans, span)
+		span.SetAttribute("slidechain.export", hex.EncodeToString(r.txid))
+		err = c.insertExport(spanCtx, dbtx, r, span.SpanContext())
+		if err != nil {
+			return err
+		}
+	}
+	if len(recs) == 1 {
+		return errors.Wrapf(dbtx.Commit(), "committing export tx %x", recs[0].txid)
+	}
+	return errors.Wrapf(dbtx.Commit(), "committing %d export txs", len(recs))
+}
+
+// insertExport records, as part of dbtx, export r,
+// traced by the span with context trace,
+// and logs an event for it.
+// It does nothing if the export is already recorded.
+func (c *Custodian) insertExport(ctx context.Context, dbtx *sql.Tx, r exportRecord, trace SpanContext) error {
+	result, err := dbtx.ExecContext(ctx, `INSERT OR IGNORE INTO exports (txid, pegout_json, payout_after_ms, custodian_id, recorded_ms, asset_xdr, amount, trace_parent, block_height, base_fee) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`, r.txid, r.ref, r.payoutAfterMS, c.label, int64(bc.Millis(time.Now())), r.info.AssetXDR, r.info.Amount, trace.String(), r.height, c.pegOutBaseFee(r.info))
+	if err != nil {
+		return errors.Wrapf(err, "recording export tx %x", r.txid)
+	}
+	numAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "checking rows affected by recording export tx %x", r.txid)
+	}
+	if numAffected == 0 {
+		return nil
+	}
+	return appendEvent(ctx, dbtx, Event{
+		Type:     EventExport,
+		TxVMTxID: r.txid,
+		Account:  r.info.Exporter,
+		AssetXDR: r.info.AssetXDR,
+		Amount:   r.info.Amount,
+	})
+}
+
+// recordPegIns is recordPegIn for several payments in Zioncoin tx txid,
+// all recorded, with cursor, in one db transaction
+// (see BatchWrites).
+func (c *Custodian) recordPegIns(ctx context.Context, txid, cursor string, payments []pegInPayment) error {
+	problems := make([]string, len(payments))
+	for i, p := range payments {
+		var err error
+		problems[i], err = c.checkIssuer(ctx, p.assetXDR)
+		if err != nil {
+			return err
+		}
+	}
+	what := fmt.Sprintf("recording %d peg-in payments in Zioncoin tx %s", len(payments), txid)
+	if len(payments) == 1 {
+		what = fmt.Sprintf("recording peg-in payment for hash %x", payments[0].nonceHash)
+	}
+	// The cursor is not moved by SetCursor meanwhile.
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+	if c.streamGen != c.cursorGen {
+		// The payments are from a stream at a cursor since moved,
+		// and are recorded, if at all, from the stream at the new one.
+		return nil
+	}
+	var numAffected int64
+	err := c.retryDB(ctx, what, func(ctx context.Context) error {
+		numAffected = 0
+		dbtx, err := c.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return errors.Wrap(err, "beginning db transaction")
+		}
+		defer dbtx.Rollback()
+
+		for i, p := range payments {
+			var n int64
+			if problems[i] != "" {
+				// The custodian could not peg this asset out,
+				// so the payment is flagged for manual refund
+				// and its peg left awaiting payment.
+				log.Printf("peg-in payment in Zioncoin tx %s with nonce hash %x: %s", txid, p.nonceHash, problems[i])
+				err = flagPegIn(ctx, dbtx, c.label, txid, p.nonceHash, p.source, p.amount, p.assetXDR, "issuer")
+			} else {
+				n, err = recordPayment(ctx, dbtx, c.label, txid, cursorLedger(cursor), c.pegState(), p.nonceHash, p.source, p.amount, p.assetXDR)
+			}
+			if err != nil {
+				return err
+			}
+			numAffected += n
+		}
+
+		// We update the cursor to avoid double-processing a transaction.
+		_, err = dbtx.ExecContext(ctx, `UPDATE custodian SET cursor=$1 WHERE label=$2`, cursor, c.label)
+		if err != nil {
+			return errors.Wrap(err, "updating cursor")
+		}
+		return errors.Wrapf(dbtx.Commit(), "committing peg-in payments of Zioncoin tx %s", txid)
+	})
+	if err != nil {
+		return err
+	}
+
+	if numAffected == 0 || c.pegState() == pegConfirming {
+		return nil
+	}
+
+	// Wake up a goroutine that executes imports for not-yet-imported pegs.
+	log.Printf("broadcasting import for Zioncoin tx %s", txid)
+	c.imports.Broadcast()
+	return nil
+}
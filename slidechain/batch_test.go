@@ -0,0 +1,164 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+)
+
+func TestRecordExports(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch := testExportBatch(lumenXDR, "a", 3)
+
+		// A batch that fails partway is rolled back whole.
+		_, err = db.Exec(`ALTER TABLE events RENAME TO events_away`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.recordExports(ctx, batch)
+		if err == nil {
+			t.Fatal("got no error recording exports without an events table")
+		}
+		var n int
+		err = db.QueryRow(`SELECT COUNT(*) FROM exports`).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("got %d exports recorded by a failed batch, want 0", n)
+		}
+		_, err = db.Exec(`ALTER TABLE events_away RENAME TO events`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Retrying it records every export, with its event, once.
+		for i := 0; i < 2; i++ {
+			err = c.recordExports(ctx, batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = db.QueryRow(`SELECT COUNT(*) FROM exports`).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(batch) {
+			t.Errorf("got %d exports recorded, want %d", n, len(batch))
+		}
+		err = db.QueryRow(`SELECT COUNT(*) FROM events WHERE type=$1`, EventExport).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(batch) {
+			t.Errorf("got %d export events, want %d", n, len(batch))
+		}
+	})
+}
+
+func TestRecordPegIns(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var payments []pegInPayment
+		for i := int64(1); i <= 2; i++ {
+			expMS := int64(bc.Millis(time.Now().Add(10*time.Minute))) + i
+			nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
+			err := c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, expMS, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payments = append(payments, pegInPayment{nonceHash: nonceHash[:], source: "source", amount: 10 * i, assetXDR: lumenXDR})
+		}
+		err = c.recordPegIns(ctx, "txid", "7", payments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		err = db.QueryRow(`SELECT COUNT(*) FROM pegs WHERE zioncoin_tx=1 AND payer='source'`).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(payments) {
+			t.Errorf("got %d pegs paid, want %d", n, len(payments))
+		}
+		cur, err := c.pegInCursor(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cur != "7" {
+			t.Errorf("got cursor %q after recording peg-ins, want %q", cur, "7")
+		}
+	})
+}
+
+// testExportBatch returns n exports of lumenXDR,
+// with txids distinguished by prefix.
+func testExportBatch(lumenXDR []byte, prefix string, n int) []exportRecord {
+	batch := make([]exportRecord, n)
+	for i := range batch {
+		batch[i] = exportRecord{
+			txid: []byte(fmt.Sprintf("%s-%d", prefix, i)),
+			ref:  []byte("{}"),
+			info: pegOut{AssetXDR: lumenXDR, Exporter: importTestAccountID, Amount: int64(i + 1)},
+		}
+	}
+	return batch
+}
+
+// BenchmarkRecordExports compares recording a block of exports
+// one db transaction per export with recording them in one batch.
+func BenchmarkRecordExports(bench *testing.B) {
+	const blockSize = 100
+	lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+	if err != nil {
+		bench.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, batched := range []bool{false, true} {
+		name := "per-row"
+		if batched {
+			name = "batched"
+		}
+		bench.Run(name, func(bench *testing.B) {
+			withTestCustodian(ctx, bench, func(ctx context.Context, db *sql.DB, c *Custodian) {
+				bench.ResetTimer()
+				start := time.Now()
+				for i := 0; i < bench.N; i++ {
+					batch := testExportBatch(lumenXDR, fmt.Sprint(i), blockSize)
+					if batched {
+						err := c.recordExports(ctx, batch)
+						if err != nil {
+							bench.Fatal(err)
+						}
+						continue
+					}
+					for _, r := range batch {
+						err := c.recordExports(ctx, []exportRecord{r})
+						if err != nil {
+							bench.Fatal(err)
+						}
+					}
+				}
+				bench.ReportMetric(float64(bench.N*blockSize)/time.Since(start).Seconds(), "exports/s")
+			})
+		})
+	}
+}
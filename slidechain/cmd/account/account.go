@@ -7,7 +7,6 @@ import (
 	"os"
 
 	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
-	"github.com/zioncoin/go/clients/equator"
 )
 
 var args []string
@@ -20,7 +19,23 @@ func main() {
 	args = os.Args[2:]
 	switch subcommand {
 	case "new":
-		kp := zioncoin.NewFundedAccount()
+		var (
+			fs         flag.FlagSet
+			friendbot  zioncoin.Friendbot
+			equatorURL string
+		)
+		fs.StringVar(&equatorURL, "equator", zioncoin.DefaultEquatorURL, "equator URL")
+		fs.IntVar(&friendbot.Attempts, "attempts", zioncoin.DefaultFriendbotAttempts, "maximum friendbot requests")
+		fs.DurationVar(&friendbot.Timeout, "timeout", zioncoin.DefaultFriendbotTimeout, "timeout of each friendbot request")
+		err := fs.Parse(args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		friendbot.HClient = zioncoin.NewClient(equatorURL)
+		kp, err := friendbot.NewFundedAccount()
+		if err != nil {
+			log.Fatal(err)
+		}
 		log.Printf("seed: %s, address: %s", kp.Seed(), kp.Address())
 	case "issue":
 		var (
@@ -29,7 +44,9 @@ func main() {
 			code        string
 			amount      string
 			destination string
+			equatorURL  string
 		)
+		fs.StringVar(&equatorURL, "equator", zioncoin.DefaultEquatorURL, "equator URL")
 		fs.StringVar(&seed, "seed", "", "seed of the Zioncoin account issuing funds")
 		fs.StringVar(&code, "code", "", "code of the issued asset")
 		fs.StringVar(&amount, "amount", "", "amount of the asset to issue")
@@ -38,17 +55,19 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		err = zioncoin.IssueAsset(equator.DefaultTestNetClient, seed, code, amount, destination)
+		err = zioncoin.IssueAsset(zioncoin.NewClient(equatorURL), seed, code, amount, destination)
 		if err != nil {
 			log.Fatal(err)
 		}
 	case "trust":
 		var (
-			fs     flag.FlagSet
-			seed   string
-			code   string
-			issuer string
+			fs         flag.FlagSet
+			seed       string
+			code       string
+			issuer     string
+			equatorURL string
 		)
+		fs.StringVar(&equatorURL, "equator", zioncoin.DefaultEquatorURL, "equator URL")
 		fs.StringVar(&seed, "seed", "", "seed of the Zioncoin account issuing trustline")
 		fs.StringVar(&code, "code", "", "asset code of the asset to trust")
 		fs.StringVar(&issuer, "issuer", "", "issuer account ID of the asset to trust")
@@ -56,7 +75,7 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		err = zioncoin.TrustAsset(equator.DefaultTestNetClient, seed, code, issuer)
+		err = zioncoin.TrustAsset(zioncoin.NewClient(equatorURL), seed, code, issuer)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -69,10 +88,17 @@ func usage() {
 
 	Available subcommands are: new, issue, trust.
 
+	Each subcommand talks to the equator server given by
+	-equator URL (default https://equator-testnet.zion.info).
+
 	The new subcommand generates a new Zioncoin testnet account
 	and obtains testnet funds. It will print out the seed and 
-	address of the newly created account. The new subcommand
-	takes no arguments.
+	address of the newly created account. Failed friendbot
+	requests are retried with backoff.
+
+	new:
+		-attempts N		maximum friendbot requests (default 5)
+		-timeout DURATION	timeout of each friendbot request (default 30s)
 	
 	The issue subcommand issues a new asset on the Zioncoin testnet
 	from the given account. 
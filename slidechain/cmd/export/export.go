@@ -3,7 +3,9 @@ package main
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -11,12 +13,15 @@ import (
 	"strings"
 	"time"
 
+	"github.com/chain/txvm/errors"
 	"github.com/golang/protobuf/proto"
 	"github.com/interzioncoin/slingshot/slidechain"
 	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
 	"github.com/interzioncoin/starlight/worizon/xlm"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/zioncoin/go/clients/equator"
 	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/network"
 	"github.com/zioncoin/go/xdr"
 )
 
@@ -27,11 +32,36 @@ func main() {
 		anchor      = flag.String("anchor", "", "txvm anchor of input to consume")
 		input       = flag.String("input", "", "total amount of input")
 		slidechaind = flag.String("slidechaind", "http://127.0.0.1:2423", "url of slidechaind server")
+		equatorURL  = flag.String("equator", zioncoin.DefaultEquatorURL, "equator URL")
 		code        = flag.String("code", "", "asset code if exporting non-lumen Zioncoin asset")
 		issuer      = flag.String("issuer", "", "issuer of asset if exporting non-lumen Zioncoin asset")
+		destination = flag.String("destination", "", "Zioncoin account to peg out to (default the account of -prv)")
+		reversible  = flag.Duration("reversible", 0, "window after the export in which it may be canceled before peg-out (default irreversible)")
+		metadata    = flag.String("metadata", "", "JSON metadata to carry in the export's refdata")
+		cosigned    = flag.Bool("cosigned", false, "make the custodian a signer of the temp account, for a custodian run with -cosignpegouts")
+		all         = flag.Bool("all", false, "export the whole input, leaving no change (-amount is ignored)")
+		txVersion   = flag.Int64("txversion", slidechain.DefaultTxVersion, "txvm version of the export tx")
+		refdata     = flag.String("refdata", string(slidechain.DefaultRefdataFormat), "encoding of the export's refdata: json or binary (smaller and deterministic)")
+		memo        = flag.String("memo", "", "text memo, such as a deployment tag, for the temp account txs (at most 28 bytes)")
+		maxOutst    = flag.Int("maxoutstanding", 0, "maximum temp accounts the exporter may have created but not yet merged (0: no limit; requires -tempdb)")
+		tempDB      = flag.String("tempdb", "", "path to sqlite db tracking the exporter's outstanding temp accounts, for -maxoutstanding and -reclaimafter")
+		reclaimTTL  = flag.Duration("reclaimafter", 0, "before exporting, cancel the exporter's pre-exports older than this whose temp accounts were never merged (0: never; requires -tempdb)")
+		expires     = flag.Duration("expires", 0, "time after which the export tx may not be included in a block (default no expiration)")
+		convertAmt  = flag.String("convertamount", "", "amount of another asset to be paid instead of the exported one, for a custodian run with -conversions")
+		convertCode = flag.String("convertcode", "", "asset code of the asset paid with -convertamount (default lumens)")
+		convertIss  = flag.String("convertissuer", "", "issuer of the asset paid with -convertamount")
+		ownAccount  = flag.Bool("ownaccount", false, "use the account of -prv, dedicated to exports, as the temp account instead of creating one")
+		baseFee     = flag.Int64("basefee", 0, "base fee of the custodian's peg-out transactions, in stroops per operation, as set by its -basefee (0: get it from slidechaind)")
+		pegOutMemo  = flag.Bool("pegoutmemo", false, "have the peg-out transaction carry the export's anchor as its hash memo")
 	)
 
 	flag.Parse()
+	if *all {
+		if *input == "" {
+			log.Fatal("must specify input amount to export all of it")
+		}
+		*amount = *input
+	}
 	if *amount == "" {
 		log.Fatal("must specify amount to peg-out")
 	}
@@ -41,9 +71,24 @@ func main() {
 	if *prv == "" {
 		log.Fatal("must specify txvm account keypair")
 	}
+	if *baseFee != 0 && *baseFee < 100 {
+		log.Fatal("-basefee must be at least the network minimum of 100")
+	}
 	if (*code != "" && *issuer == "") || (*code == "" && *issuer != "") {
 		log.Fatal("must specify both code and issuer for non-lumen Zioncoin asset")
 	}
+	if (*convertCode != "" && *convertIss == "") || (*convertCode == "" && *convertIss != "") {
+		log.Fatal("must specify both code and issuer for non-lumen conversion asset")
+	}
+	if *convertAmt != "" && (*cosigned || *reversible != 0 || *metadata != "" || *all || *txVersion != slidechain.DefaultTxVersion) {
+		log.Fatal("cannot combine -convertamount with -cosigned, -reversible, -metadata, -all, or -txversion")
+	}
+	if *ownAccount && (*cosigned || *convertAmt != "" || *maxOutst > 0) {
+		log.Fatal("cannot combine -ownaccount with -cosigned, -convertamount, or -maxoutstanding")
+	}
+	if *pegOutMemo && (*cosigned || *convertAmt != "" || *ownAccount || *reversible != 0 || *metadata != "" || *txVersion != slidechain.DefaultTxVersion || *refdata == string(slidechain.RefdataBinary)) {
+		log.Fatal("cannot combine -pegoutmemo with -cosigned, -convertamount, -ownaccount, -reversible, -metadata, -txversion, or binary -refdata")
+	}
 	if *input == "" {
 		log.Printf("no input amount specified, default to export amount %s", *amount)
 		*input = *amount
@@ -71,6 +116,22 @@ func main() {
 		log.Fatalf("error parsing input amount %s: %s", *input, err)
 	}
 
+	var conv *slidechain.Conversion
+	if *convertAmt != "" {
+		convertAsset := zioncoin.NativeAsset()
+		if *convertCode != "" {
+			convertAsset, err = zioncoin.NewAsset(*convertCode, *convertIss)
+			if err != nil {
+				log.Fatalf("error creating conversion asset from code %s and issuer %s: %s", *convertCode, *convertIss, err)
+			}
+		}
+		convertAmount, err := xlm.Parse(*convertAmt)
+		if err != nil {
+			log.Fatalf("error parsing conversion amount %s: %s", *convertAmt, err)
+		}
+		conv = &slidechain.Conversion{Asset: convertAsset, Amount: int64(convertAmount)}
+	}
+
 	*slidechaind = strings.TrimRight(*slidechaind, "/")
 
 	// Build and submit the pre-export transaction.
@@ -80,9 +141,9 @@ func main() {
 	rawbytes := mustDecodeHex(*prv)
 	copy(seed[:], rawbytes)
 	kp, err := keypair.FromRawSeed(seed)
-	hclient := equator.DefaultTestNetClient
+	hclient := zioncoin.NewClient(*equatorURL)
 	if _, err := hclient.SequenceForAccount(kp.Address()); err != nil {
-		err := zioncoin.FundAccount(kp.Address())
+		err := zioncoin.Friendbot{HClient: hclient}.Fund(kp.Address())
 		if err != nil {
 			log.Fatalf("error funding Zioncoin account %s: %s", kp.Address(), err)
 		}
@@ -97,13 +158,106 @@ func main() {
 	if err != nil {
 		log.Fatalf("error unmarshaling custodian account id: %s", err)
 	}
-	tempAddr, seqnum, err := slidechain.SubmitPreExportTx(hclient, kp, custodian.Address(), asset, int64(exportAmount))
+	payout, err := pegOutPayout(*slidechaind, asset, int64(exportAmount))
+	if err != nil {
+		log.Fatalf("error computing peg-out payout: %s", err)
+	}
+	if *baseFee == 0 {
+		*baseFee, err = custodianBaseFee(*slidechaind)
+		if err != nil {
+			log.Fatalf("error getting custodian base fee: %s", err)
+		}
+	}
+	if *destination == "" {
+		*destination = kp.Address()
+	}
+	limiter := &slidechain.TempAccountLimiter{
+		Max:            slidechain.DefaultMaxTempAccounts,
+		MaxPerExporter: slidechain.DefaultMaxTempAccountsPerExporter,
+	}
+	var temps *slidechain.TempAccounts
+	if *maxOutst > 0 && *tempDB == "" {
+		log.Fatal("-maxoutstanding requires -tempdb")
+	}
+	if *reclaimTTL > 0 && *tempDB == "" {
+		log.Fatal("-reclaimafter requires -tempdb")
+	}
+	if *tempDB != "" {
+		db, err := sql.Open("sqlite3", *tempDB)
+		if err != nil {
+			log.Fatalf("error opening temp account db: %s", err)
+		}
+		defer db.Close()
+		limiter.MaxOutstandingPerExporter = *maxOutst
+		temps = &slidechain.TempAccounts{DB: db}
+	}
+	if *reclaimTTL > 0 {
+		n, err := temps.Reclaim(ctx, hclient, kp, *reclaimTTL)
+		if err != nil {
+			log.Printf("error reclaiming temp accounts: %s", err)
+		}
+		if n > 0 {
+			log.Printf("reclaimed %d abandoned temp accounts", n)
+		}
+	}
+	preExportOpts := slidechain.PreExportOptions{
+		Destination:  *destination,
+		Conversion:   conv,
+		Cosigned:     *cosigned,
+		OwnAccount:   *ownAccount,
+		BaseFee:      *baseFee,
+		Memo:         *memo,
+		Limiter:      limiter,
+		TempAccounts: temps,
+	}
+	var memoAnchor []byte
+	if *pegOutMemo {
+		memoAnchor = slidechain.ExportAnchor(mustDecodeHex(*anchor))
+		preExportOpts.MemoAnchor = memoAnchor
+	}
+	tempAddr, seqnum, err := slidechain.SubmitPreExportTxWithOptions(hclient, kp, custodian.Address(), asset, payout, preExportOpts)
 	if err != nil {
 		log.Fatalf("error submitting pre-export tx: %s", err)
 	}
 
+	// Before retiring funds on slidechain,
+	// confirm that the temp account will authorize the expected peg-out.
+	err = checkPreauthSigner(hclient, slidechain.PegOutParams{
+		Custodian:  custodian.Address(),
+		Exporter:   *destination,
+		Owner:      kp.Address(),
+		TempAddr:   tempAddr,
+		Network:    network.TestNetworkPassphrase,
+		Asset:      asset,
+		Amount:     payout,
+		Seqnum:     seqnum,
+		Cosigned:   *cosigned,
+		BaseFee:    *baseFee,
+		Conversion: conv,
+		MemoAnchor: memoAnchor,
+	})
+	if err != nil {
+		log.Fatalf("error checking temp account signer: %s", err)
+	}
+
 	// Export funds from slidechain.
-	tx, err := slidechain.BuildExportTx(ctx, asset, int64(exportAmount), int64(inputAmount), tempAddr, mustDecodeHex(*anchor), rawbytes, seqnum)
+	var expiration time.Time
+	if *expires > 0 {
+		expiration = time.Now().Add(*expires)
+	}
+	tx, changeAnchor, err := slidechain.BuildExportTxWithOptions(ctx, asset, int64(exportAmount), int64(inputAmount), tempAddr, mustDecodeHex(*anchor), rawbytes, seqnum, slidechain.ExportOptions{
+		Destination: *destination,
+		Expiration:  expiration,
+		Window:      *reversible,
+		Custodian:   custodian.Address(),
+		Metadata:    []byte(*metadata),
+		RetireAll:   *all,
+		Version:     *txVersion,
+		Format:      slidechain.RefdataFormat(*refdata),
+		Conversion:  conv,
+		MemoAnchor:  *pegOutMemo,
+		BaseFee:     *baseFee,
+	})
 	if err != nil {
 		log.Fatalf("error building export tx: %s", err)
 	}
@@ -128,6 +282,86 @@ func main() {
 		log.Fatalf("bad status code %d from POST /submit?wait=1", resp.StatusCode)
 	}
 	log.Printf("successfully submitted export transaction: %x", tx.ID)
+	if changeAnchor != nil {
+		log.Printf("change of %d returned with anchor %x", inputAmount-exportAmount, changeAnchor)
+	}
+	if memoAnchor != nil {
+		log.Printf("peg-out transaction will carry hash memo %x", memoAnchor)
+	}
+	if *reversible > 0 {
+		log.Printf("to cancel the export within %s: slidectl cancel-export -url %s -prv [exporter prv key] -txid %x", *reversible, *slidechaind, tx.ID.Bytes())
+	}
+}
+
+// checkPreauthSigner checks that the temp account in params
+// has the preauth signer for the peg-out described by params.
+func checkPreauthSigner(hclient equator.ClientInterface, params slidechain.PegOutParams) error {
+	want, err := slidechain.ComputePegOutPreauthHash(params)
+	if err != nil {
+		return err
+	}
+	account, err := hclient.LoadAccount(params.TempAddr)
+	if err != nil {
+		return errors.Wrapf(err, "loading temp account %s", params.TempAddr)
+	}
+	for _, signer := range account.Signers {
+		if signer.Key == want {
+			return nil
+		}
+	}
+	return fmt.Errorf("temp account %s lacks preauth signer %s", params.TempAddr, want)
+}
+
+// custodianBaseFee returns the base fee of the custodian's peg-out transactions,
+// as published by slidechaind.
+func custodianBaseFee(slidechaind string) (int64, error) {
+	resp, err := http.Get(slidechaind + "/fees/base")
+	if err != nil {
+		return 0, errors.Wrap(err, "getting custodian base fee")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return 0, fmt.Errorf("status code %d from GET /fees/base", resp.StatusCode)
+	}
+	var fee slidechain.BaseFeeResponse
+	err = json.NewDecoder(resp.Body).Decode(&fee)
+	if err != nil {
+		return 0, errors.Wrap(err, "decoding custodian base fee")
+	}
+	return fee.BaseFee, nil
+}
+
+// pegOutPayout returns the amount the custodian will pay out for an export,
+// net of its peg-out fee for the asset,
+// in the peg-out transaction
+// (the first tranche, if the custodian splits the payout).
+func pegOutPayout(slidechaind string, asset xdr.Asset, amount int64) (int64, error) {
+	resp, err := http.Get(slidechaind + "/fees")
+	if err != nil {
+		return 0, errors.Wrap(err, "getting custodian fees")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return 0, fmt.Errorf("status code %d from GET /fees", resp.StatusCode)
+	}
+	var fees map[string]slidechain.FeePolicy
+	err = json.NewDecoder(resp.Body).Decode(&fees)
+	if err != nil {
+		return 0, errors.Wrap(err, "decoding custodian fees")
+	}
+	policy := fees[asset.String()]
+	payout, fee, err := policy.Payout(amount)
+	if err != nil {
+		return 0, err
+	}
+	if fee > 0 {
+		log.Printf("custodian will deduct a fee of %d, paying out %d", fee, payout)
+	}
+	tranches := policy.Split(payout)
+	if len(tranches) > 1 {
+		log.Printf("custodian will pay out %d in %d tranches, starting with %d", payout, len(tranches), tranches[0])
+	}
+	return tranches[0], nil
 }
 
 func mustDecodeHex(src string) []byte {
@@ -9,13 +9,11 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/chain/txvm/crypto/ed25519"
 	"github.com/chain/txvm/errors"
 	"github.com/chain/txvm/protocol/bc"
-	"github.com/zioncoin/go/clients/equator"
 
 	"github.com/interzioncoin/slingshot/slidechain"
 	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
@@ -28,11 +26,12 @@ func main() {
 		amount      = flag.String("amount", "", "amount to peg, in lumens")
 		recipient   = flag.String("recipient", "", "hex-encoded txvm public key for the recipient of the pegged funds")
 		seed        = flag.String("seed", "", "seed of Zioncoin source account")
-		equatorURL  = flag.String("equator", "https://equator-testnet.zion.info", "equator URL")
+		equatorURL  = flag.String("equator", zioncoin.DefaultEquatorURL, "equator URL")
 		code        = flag.String("code", "", "asset code for non-Lumen asset")
 		issuer      = flag.String("issuer", "", "asset issuer for non-Lumen asset")
 		bcidHex     = flag.String("bcid", "", "hex-encoded initial block ID")
 		slidechaind = flag.String("slidechaind", "http://127.0.0.1:2423", "url of slidechaind server")
+		metadata    = flag.String("metadata", "", "JSON metadata to record with the peg")
 	)
 	flag.Parse()
 
@@ -48,6 +47,7 @@ func main() {
 	if *bcidHex == "" {
 		log.Fatal("must specify initial block ID")
 	}
+	hclient := zioncoin.NewClient(*equatorURL)
 	if *recipient == "" {
 		log.Print("no recipient specified, generating txvm keypair...")
 		pubkey, privkey, err := ed25519.GenerateKey(nil)
@@ -59,7 +59,10 @@ func main() {
 	}
 	if *seed == "" {
 		log.Print("no seed specified, generating and funding a new account...")
-		kp := zioncoin.NewFundedAccount()
+		kp, err := zioncoin.Friendbot{HClient: hclient}.NewFundedAccount()
+		if err != nil {
+			log.Fatalf("error funding new account: %s", err)
+		}
 		*seed = kp.Seed()
 	}
 
@@ -96,14 +99,10 @@ func main() {
 		log.Fatal("marshaling asset xdr: ", err)
 	}
 	expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
-	nonceHash, err := doPrePegIn(bcidBytes[:], assetXDR, int64(amountXLM), expMS, recipientPubkey[:], *slidechaind)
+	nonceHash, err := doPrePegIn(bcidBytes[:], assetXDR, int64(amountXLM), expMS, recipientPubkey[:], []byte(*metadata), *slidechaind)
 	if err != nil {
 		log.Fatal("doing pre-peg-in tx: ", err)
 	}
-	hclient := &equator.Client{
-		URL:  strings.TrimRight(*equatorURL, "/"),
-		HTTP: new(http.Client),
-	}
 	tx, err := zioncoin.BuildPegInTx(*seed, nonceHash, *amount, *code, *issuer, *custodian, hclient)
 	if err != nil {
 		log.Fatal("building transaction: ", err)
@@ -117,7 +116,7 @@ func main() {
 
 // doPrePegIn calls the pre-peg-in Slidechain RPC.
 // That RPC builds, submits, and waits for the pre-peg TxVM transaction and records the peg-in in the database.
-func doPrePegIn(bcid, assetXDR []byte, amount, expMS int64, pubkey ed25519.PublicKey, slidechaind string) ([32]byte, error) {
+func doPrePegIn(bcid, assetXDR []byte, amount, expMS int64, pubkey ed25519.PublicKey, metadata []byte, slidechaind string) ([32]byte, error) {
 	var nonceHash [32]byte
 	p := slidechain.PrePegIn{
 		BcID:        bcid,
@@ -125,6 +124,7 @@ func doPrePegIn(bcid, assetXDR []byte, amount, expMS int64, pubkey ed25519.Publi
 		AssetXDR:    assetXDR,
 		RecipPubkey: pubkey,
 		ExpMS:       expMS,
+		Metadata:    metadata,
 	}
 	pegBits, err := json.Marshal(&p)
 	if err != nil {
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/interzioncoin/slingshot/slidechain"
 	_ "github.com/mattn/go-sqlite3"
@@ -20,22 +29,185 @@ func main() {
 		dbfile        = flag.String("db", "slidechain.db", "path to db")
 		url           = flag.String("equator", "https://equator-testnet.zion.info", "equator server url")
 		blockInterval = flag.Duration("interval", slidechain.DefaultBlockInterval, "expected interval between txvm blocks")
+		network       = flag.String("network", "", "passphrase of the Zioncoin network the equator server must be on (default: any)")
+		startCursor   = flag.String("startcursor", "", "Horizon cursor from which to stream peg-ins on first run")
+		startLedger   = flag.Int("startledger", 0, "ledger from which to stream peg-ins on first run (ignored if -startcursor is given)")
+		feesFile      = flag.String("fees", "", "path to JSON file of peg-out fee policies, keyed by asset")
+		convFile      = flag.String("conversions", "", "path to JSON file of permitted peg-out conversions")
+		label         = flag.String("label", "", "name distinguishing this custodian from others sharing the db")
+		webhookURL    = flag.String("webhook", "", "URL to notify of settled peg-outs")
+		webhookSecret = flag.String("webhooksecret", "", "path to file containing the shared secret for signing webhook requests")
+		adminToken    = flag.String("admintoken", "", "path to file containing the bearer token required by admin endpoints such as /cursor (default: admin endpoints disabled)")
+		maxLag        = flag.Int("maxingestionlag", slidechain.DefaultMaxIngestionLag, "ledgers equator ingestion may trail core before reporting unhealthy (negative: never)")
+		pegInSource   = flag.String("peginsource", string(slidechain.PegInsFromTxs), "equator stream from which to observe peg-ins: transactions or payments")
+		importWorkers = flag.Int("importworkers", slidechain.DefaultImportWorkers, "number of imports to build and submit at once")
+		orderImports  = flag.Bool("orderimports", false, "import each recipient's pegs in arrival order")
+		importBatch   = flag.Int("importbatch", 0, "number of pegs to import at once in one txvm tx (0 or 1: one per tx)")
+		importRefunds = flag.String("importrefunds", string(slidechain.HoldFailedImports), "what to do with pegs that can never be imported: hold or payer (refund the payer)")
+		confirmations = flag.Int("peginconfirmations", 0, "ledgers to close after a peg-in payment's before importing it (0: import at once)")
+		dbTimeout     = flag.Duration("dbtimeout", slidechain.DefaultDBTimeout, "bound on each db statement, after which it is retried (negative: none)")
+		pegInKeys     = flag.Duration("peginkeywindow", slidechain.DefaultPegInKeyWindow, "how long to remember the idempotency keys of pre-peg-in requests")
+		baseReserve   = flag.Int64("basereserve", slidechain.DefaultBaseReserve, "base reserve of the Zioncoin network, in stroops")
+		baseFee       = flag.Int64("basefee", 100, "base fee of the custodian's Zioncoin transactions, in stroops per operation (applies to exports pre-exported after a change)")
+		trancheIval   = flag.Duration("trancheinterval", slidechain.DefaultTrancheInterval, "interval between the partial payments of peg-outs split into tranches")
+		offlineSign   = flag.Bool("offlinesigning", false, "leave peg-out transactions for signing offline with slidectl sign-pegouts")
+		maxBacklog    = flag.Int("maxexportbacklog", 0, "exports awaiting peg-out beyond which new exports are deferred (0: no limit)")
+		onLedgers     = flag.Bool("reconcileonledgers", false, "finish settled peg-outs once per closed ledger instead of once a minute")
+		deadline      = flag.Duration("exportdeadline", 0, "how long an export may go unsettled before it is reported stuck (0: no deadline)")
+		coldWallet    = flag.String("coldwallet", "", "Zioncoin account to which to sweep balances above -sweepthresholds")
+		sweepFile     = flag.String("sweepthresholds", "", "path to JSON file of the balances, in stroops keyed by asset, above which to sweep to -coldwallet")
+		observer      = flag.Bool("observer", false, "watch the custodian account read-only, importing, pegging out, and submitting nothing")
+		observedAddr  = flag.String("observeraccount", "", "address of the account to watch with -observer (default: the custodian account in the db)")
+		verifyIssuers = flag.Bool("verifyissuers", false, "flag peg-ins of credit assets whose issuer is missing or can revoke the custodian's trustline")
+		verifyTemps   = flag.Bool("verifytempaccounts", false, "check each export's temp account on the Zioncoin network before pegging out")
+		cosign        = flag.Bool("cosignpegouts", false, "require the custodian's signature, besides the preauth tx, on each export's temp account")
+		audit         = flag.Bool("audit", false, "witness each peg-out in a signed, hash-chained log in the db")
+		trustRecheck  = flag.Duration("trustlinerecheck", 0, "how often to check again for the missing trustlines of exporters whose peg-outs await them (0: peg out regardless)")
+		trustTimeout  = flag.Duration("trustlinetimeout", 0, "how long after it is recorded an export may await its exporter's trustline before it is refunded (0: no limit)")
+		verifyExports = flag.Bool("verifyexports", false, "re-verify the exporter's signature on each export before pegging out")
+		batchWrites   = flag.Bool("batchwrites", false, "record each block's exports, and each Zioncoin tx's peg-ins, in one db transaction")
+		accountCheck  = flag.Duration("accountcheck", time.Minute, "how often to check that the custodian account exists with its signers and thresholds unchanged, halting submissions if not (0: never)")
+		asyncPegOuts  = flag.Bool("asyncpegouts", false, "submit peg-out transactions asynchronously, confirming them from the transaction stream (synchronously on older equator servers)")
+		recoverState  = flag.Bool("recover", false, "reconcile the db with txvm and the Zioncoin network before starting")
+		recoverBatch  = flag.Int("recoverbatch", slidechain.DefaultRecoveryBatchSize, "number of exports -recover reads from the db at a time")
+		backfill      = flag.Int("backfill", 0, "ledger from which to record past peg-in payments still awaiting import (0: none)")
+		maxRetries    = flag.Int("maxpegoutretries", slidechain.DefaultMaxPegOutRetries, "times to retry a peg-out transaction failing with a retryable error, such as tx_bad_seq, before refunding its export (negative: no limit)")
+		retryBackoff  = flag.Duration("pegoutretrybackoff", slidechain.DefaultPegOutRetryBackoff, "delay before the first retry of a peg-out transaction failing with a retryable error, growing for later retries")
+		retryMax      = flag.Duration("pegoutretrybackoffmax", slidechain.DefaultPegOutRetryBackoffMax, "bound on the delay before any retry of a peg-out transaction")
+		pegOutBatch   = flag.Int("maxpegoutbatch", 1, "number of peg-out payments from the custodian account, such as of held dust, to make in one transaction (at most 100)")
+		recoveryLog   = flag.String("recoverylog", "", "path to log of peg-out states not yet written to the db (default slidechain-recovery.log, or slidechain-recovery-LABEL.log with -label)")
+		drainTimeout  = flag.Duration("draintimeout", slidechain.DefaultDrainTimeout, "how long to wait on shutdown for in-flight peg-outs before abandoning them")
 	)
 
 	flag.Parse()
 
-	db, err := sql.Open("sqlite3", *dbfile)
+	dsn := *dbfile
+	if *dbTimeout > 0 {
+		// The sqlite driver waits on a locked db without regard to deadlines,
+		// so bound the wait as well.
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn = fmt.Sprintf("%s%s_busy_timeout=%d", dsn, sep, *dbTimeout/time.Millisecond)
+	}
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		log.Fatalf("error opening db: %s", err)
 	}
 	defer db.Close()
-	c, err := slidechain.GetCustodian(ctx, db, *url, *blockInterval)
+	if *label != "" {
+		log.SetPrefix(fmt.Sprintf("[%s] ", *label))
+	}
+	cfg := slidechain.Config{
+		DB:                      db,
+		HorizonURL:              *url,
+		NetworkPassphrase:       *network,
+		BlockInterval:           *blockInterval,
+		Label:                   *label,
+		StartCursor:             *startCursor,
+		RecoveryLog:             *recoveryLog,
+		MaxPegOutRetries:        *maxRetries,
+		PegOutRetryBackoff:      *retryBackoff,
+		PegOutRetryBackoffMax:   *retryMax,
+		MaxPegOutBatch:          *pegOutBatch,
+		MaxIngestionLag:         int32(*maxLag),
+		PegInSource:             slidechain.PegInSource(*pegInSource),
+		ImportWorkers:           *importWorkers,
+		OrderImportsByRecipient: *orderImports,
+		ImportBatch:             *importBatch,
+		ImportRefunds:           slidechain.ImportRefundPolicy(*importRefunds),
+		PegInConfirmations:      *confirmations,
+		DBTimeout:               *dbTimeout,
+		PegInKeyWindow:          *pegInKeys,
+		BaseReserve:             *baseReserve,
+		BaseFee:                 *baseFee,
+		TrancheInterval:         *trancheIval,
+		OfflineSigning:          *offlineSign,
+		MaxExportBacklog:        *maxBacklog,
+		ReconcileOnLedgers:      *onLedgers,
+		ExportDeadline:          *deadline,
+		ColdWallet:              *coldWallet,
+		Observer:                *observer,
+		ObservedAddress:         *observedAddr,
+		VerifyIssuers:           *verifyIssuers,
+		VerifyTempAccounts:      *verifyTemps,
+		CosignPegOuts:           *cosign,
+		AuditMode:               *audit,
+		VerifyExportSigs:        *verifyExports,
+		BatchWrites:             *batchWrites,
+		TrustlineRecheck:        *trustRecheck,
+		TrustlineTimeout:        *trustTimeout,
+		AsyncPegOuts:            *asyncPegOuts,
+		AccountCheckInterval:    *accountCheck,
+		RecoverOnStart:          *recoverState,
+		RecoveryBatchSize:       *recoverBatch,
+		WebhookURL:              *webhookURL,
+		DrainTimeout:            *drainTimeout,
+	}
+	if *startCursor == "" {
+		cfg.StartLedger = int32(*startLedger)
+	}
+	if *feesFile != "" {
+		feesJSON, err := ioutil.ReadFile(*feesFile)
+		if err != nil {
+			log.Fatalf("error reading fees file: %s", err)
+		}
+		err = json.Unmarshal(feesJSON, &cfg.Fees)
+		if err != nil {
+			log.Fatalf("error parsing fees file: %s", err)
+		}
+	}
+	if *convFile != "" {
+		convJSON, err := ioutil.ReadFile(*convFile)
+		if err != nil {
+			log.Fatalf("error reading conversions file: %s", err)
+		}
+		err = json.Unmarshal(convJSON, &cfg.Conversions)
+		if err != nil {
+			log.Fatalf("error parsing conversions file: %s", err)
+		}
+	}
+	if *sweepFile != "" {
+		thresholdsJSON, err := ioutil.ReadFile(*sweepFile)
+		if err != nil {
+			log.Fatalf("error reading sweep thresholds file: %s", err)
+		}
+		err = json.Unmarshal(thresholdsJSON, &cfg.SweepThresholds)
+		if err != nil {
+			log.Fatalf("error parsing sweep thresholds file: %s", err)
+		}
+	}
+	if *webhookSecret != "" {
+		secret, err := ioutil.ReadFile(*webhookSecret)
+		if err != nil {
+			log.Fatalf("error reading webhook secret: %s", err)
+		}
+		cfg.WebhookSecret = bytes.TrimSpace(secret)
+	}
+	if *adminToken != "" {
+		token, err := ioutil.ReadFile(*adminToken)
+		if err != nil {
+			log.Fatalf("error reading admin token: %s", err)
+		}
+		cfg.AdminToken = bytes.TrimSpace(token)
+	}
+	c, err := slidechain.NewCustodian(ctx, cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	go c.BS.ExpireBlocks(ctx)
 
+	if *backfill > 0 {
+		go func() {
+			err := c.Backfill(ctx, uint32(*backfill))
+			if err != nil {
+				log.Printf("error backfilling peg-ins: %s", err)
+			}
+		}()
+	}
+
 	listener, err := net.Listen("tcp", *addr)
 	if err != nil {
 		log.Fatal(err)
@@ -47,5 +219,46 @@ func main() {
 	http.HandleFunc("/get", c.S.Get)
 	http.HandleFunc("/account", c.Account)
 	http.HandleFunc("/prepegin", c.DoPrePegIn)
+	http.HandleFunc("/pegin/instructions", c.PegInInstructionsHandler)
+	http.HandleFunc("/health", c.Health)
+	http.HandleFunc("/fees", c.Fees)
+	http.HandleFunc("/fees/base", c.BaseFeeHandler)
+	http.HandleFunc("/assets", c.Assets)
+	http.HandleFunc("/webhooks", c.Webhooks)
+	http.HandleFunc("/webhooks/replay", c.ReplayWebhookHandler)
+	http.HandleFunc("/status", c.Status)
+	http.HandleFunc("/status/pegin", c.PegInHandler)
+	http.HandleFunc("/stats", c.StatsHandler)
+	http.HandleFunc("/pegouts/pause", c.PausePegOutsHandler)
+	http.HandleFunc("/pegouts/resume", c.ResumePegOutsHandler)
+	http.HandleFunc("/pegouts/tranches/resume", c.ResumeTranchesHandler)
+	http.HandleFunc("/pegouts/unsigned", c.UnsignedPegOutsHandler)
+	http.HandleFunc("/pegouts/signed", c.SubmitSignedPegOutHandler)
+	http.HandleFunc("/exports/cancel", c.CancelExportHandler)
+	http.HandleFunc("/exports/build", c.BuildExportTxHandler)
+	http.HandleFunc("/exports/finish", c.FinishExportTxHandler)
+	http.HandleFunc("/cursor", c.CursorHandler)
+
+	// On SIGINT or SIGTERM, stop serving and shut the custodian down.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("received %s", sig)
+		listener.Close()
+	}()
 	http.Serve(listener, nil)
+
+	// Beyond the drain, the custodian's goroutines get shutdownGrace to exit.
+	const shutdownGrace = 10 * time.Second
+	drain := *drainTimeout
+	if drain == 0 {
+		drain = slidechain.DefaultDrainTimeout
+	}
+	shutdownCtx, cancel := context.WithTimeout(ctx, drain+shutdownGrace)
+	defer cancel()
+	err = c.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("shutting down: %s", err)
+	}
 }
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/golang/protobuf/proto"
+	"github.com/interzioncoin/slingshot/slidechain"
+	"github.com/zioncoin/go/xdr"
+)
+
+var args []string
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	subcommand := os.Args[1]
+	args = os.Args[2:]
+	switch subcommand {
+	case "inspect-export":
+		inspectExport()
+	case "status":
+		status()
+	case "unsigned-pegouts":
+		unsignedPegOuts()
+	case "sign-pegouts":
+		signPegOuts()
+	case "submit-pegouts":
+		submitPegOuts()
+	case "cancel-export":
+		cancelExport()
+	default:
+		usage()
+	}
+}
+
+func inspectExport() {
+	var (
+		fs    flag.FlagSet
+		txStr string
+	)
+	fs.StringVar(&txStr, "tx", "", "hex or base64 encoding of the serialized slidechain tx")
+	err := fs.Parse(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if txStr == "" && fs.NArg() > 0 {
+		txStr = fs.Arg(0)
+	}
+	if txStr == "" {
+		log.Fatal("must specify tx")
+	}
+	txbits, err := decodeTx(strings.TrimSpace(txStr))
+	if err != nil {
+		log.Fatalf("decoding tx: %s", err)
+	}
+	var rawTx bc.RawTx
+	err = proto.Unmarshal(txbits, &rawTx)
+	if err != nil {
+		log.Fatalf("parsing tx: %s", err)
+	}
+	tx, err := bc.NewTx(rawTx.Program, rawTx.Version, rawTx.Runlimit)
+	if err != nil {
+		log.Fatalf("validating tx: %s", err)
+	}
+	fmt.Printf("tx %x\n", tx.ID.Bytes())
+
+	ref, err := slidechain.InspectExportTx(tx)
+	if err != nil {
+		fmt.Printf("not recognized as an export: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("recognized as an export")
+
+	refJSON, err := slidechain.RefdataToJSON(ref)
+	if err != nil {
+		log.Fatalf("decoding reference data: %s", err)
+	}
+	var buf bytes.Buffer
+	err = json.Indent(&buf, refJSON, "", "  ")
+	if err != nil {
+		log.Fatalf("formatting reference data: %s", err)
+	}
+	fmt.Printf("reference data:\n%s\n", buf.String())
+
+	var info struct {
+		AssetXDR []byte `json:"asset"`
+	}
+	err = json.Unmarshal(refJSON, &info)
+	if err != nil {
+		log.Fatalf("unmarshaling reference data: %s", err)
+	}
+	var asset xdr.Asset
+	err = xdr.SafeUnmarshal(info.AssetXDR, &asset)
+	if err != nil {
+		fmt.Printf("asset: cannot decode XDR %x: %s\n", info.AssetXDR, err)
+		return
+	}
+	fmt.Printf("asset: %s\n", asset.String())
+}
+
+func status() {
+	var (
+		fs      flag.FlagSet
+		url     string
+		jsonOut bool
+	)
+	fs.StringVar(&url, "url", "http://localhost:2423", "base URL of the custodian's HTTP API")
+	fs.BoolVar(&jsonOut, "json", false, "print the custodian's status as JSON")
+	err := fs.Parse(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(url, "/") + "/status")
+	if err != nil {
+		log.Fatalf("getting custodian status: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalf("reading custodian status: %s", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		log.Fatalf("status %d getting custodian status: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var s slidechain.Status
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		log.Fatalf("parsing custodian status: %s", err)
+	}
+
+	if jsonOut {
+		var buf bytes.Buffer
+		err = json.Indent(&buf, body, "", "  ")
+		if err != nil {
+			log.Fatalf("formatting custodian status: %s", err)
+		}
+		fmt.Println(buf.String())
+	} else {
+		printStatus(s)
+	}
+	if len(s.Problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+func printStatus(s slidechain.Status) {
+	if s.Label != "" {
+		fmt.Printf("custodian %s (%s)\n", s.AccountID, s.Label)
+	} else {
+		fmt.Printf("custodian %s\n", s.AccountID)
+	}
+	fmt.Printf("initial block %s\n", s.InitBlockID)
+
+	equatorOK := true
+	for _, p := range s.Problems {
+		if strings.HasPrefix(p, "equator") {
+			equatorOK = false
+		}
+	}
+	switch {
+	case s.Ingestion == nil:
+		fmt.Println("equator: not yet checked")
+	case !equatorOK:
+		fmt.Printf("equator: degraded (last reached %s, ledger %d, %d ledgers behind core)\n", s.Ingestion.Checked.Format(time.RFC3339), s.Ingestion.HistoryLedger, s.Ingestion.Lag)
+	default:
+		fmt.Printf("equator: ok (ledger %d, %d ledgers behind core)\n", s.Ingestion.HistoryLedger, s.Ingestion.Lag)
+	}
+
+	fmt.Printf("peg-ins: %d awaiting payment, %d awaiting import\n", s.PegIns.AwaitingPayment, s.PegIns.AwaitingImport)
+	if s.PegIns.CursorLedger > 0 && s.Ingestion != nil {
+		fmt.Printf("peg-in lag: last peg-in observed at ledger %d, %d ledgers ago\n", s.PegIns.CursorLedger, s.Ingestion.HistoryLedger-s.PegIns.CursorLedger)
+	}
+
+	paused := ""
+	if s.PegOutsPaused {
+		paused = " (paused)"
+	}
+	fmt.Printf("exports%s: %d pending, %d retrying, %d failed, %d settling in tranches, %d pegged out\n", paused, s.Exports.Pending, s.Exports.Retry, s.Exports.Failed, s.Exports.Settling, s.Exports.PeggedOut)
+	if s.Exports.Unsigned > 0 {
+		fmt.Printf("exports awaiting offline signature: %d\n", s.Exports.Unsigned)
+	}
+	if s.Exports.BacklogLimit > 0 {
+		fmt.Printf("export backlog: %d of %d\n", s.Exports.Backlog, s.Exports.BacklogLimit)
+	}
+
+	if len(s.Problems) == 0 {
+		fmt.Println("health: ok")
+		return
+	}
+	fmt.Println("health: unhealthy")
+	for _, p := range s.Problems {
+		fmt.Printf("\t%s\n", p)
+	}
+}
+
+func unsignedPegOuts() {
+	var (
+		fs  flag.FlagSet
+		url string
+	)
+	fs.StringVar(&url, "url", "http://localhost:2423", "base URL of the custodian's HTTP API")
+	err := fs.Parse(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(url, "/") + "/pegouts/unsigned")
+	if err != nil {
+		log.Fatalf("getting unsigned peg-outs: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalf("reading unsigned peg-outs: %s", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		log.Fatalf("status %d getting unsigned peg-outs: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var buf bytes.Buffer
+	err = json.Indent(&buf, body, "", "  ")
+	if err != nil {
+		log.Fatalf("formatting unsigned peg-outs: %s", err)
+	}
+	fmt.Println(buf.String())
+}
+
+func signPegOuts() {
+	var (
+		fs                    flag.FlagSet
+		bundlesFile, seedFile string
+	)
+	fs.StringVar(&bundlesFile, "bundles", "", "path to JSON file of peg-out bundles, as printed by unsigned-pegouts")
+	fs.StringVar(&seedFile, "seed", "", "path to file containing the custodian's seed")
+	err := fs.Parse(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if bundlesFile == "" || seedFile == "" {
+		log.Fatal("must specify -bundles and -seed")
+	}
+	bundlesJSON, err := ioutil.ReadFile(bundlesFile)
+	if err != nil {
+		log.Fatalf("reading bundles: %s", err)
+	}
+	var bundles []slidechain.PegOutBundle
+	err = json.Unmarshal(bundlesJSON, &bundles)
+	if err != nil {
+		log.Fatalf("parsing bundles: %s", err)
+	}
+	seed, err := ioutil.ReadFile(seedFile)
+	if err != nil {
+		log.Fatalf("reading seed: %s", err)
+	}
+	var sigs []slidechain.PegOutSignature
+	for _, bundle := range bundles {
+		sig, err := slidechain.SignPegOutOffline(bundle, strings.TrimSpace(string(seed)))
+		if err != nil {
+			log.Fatalf("signing peg-out of export %x: %s", bundle.ExportTxID, err)
+		}
+		log.Printf("signed peg-out of export %x: %d of asset %x to %s", bundle.ExportTxID, bundle.Amount, bundle.AssetXDR, bundle.Exporter)
+		sigs = append(sigs, sig)
+	}
+	out, err := json.MarshalIndent(sigs, "", "  ")
+	if err != nil {
+		log.Fatalf("marshaling signatures: %s", err)
+	}
+	fmt.Println(string(out))
+}
+
+func submitPegOuts() {
+	var (
+		fs            flag.FlagSet
+		url, sigsFile string
+	)
+	fs.StringVar(&url, "url", "http://localhost:2423", "base URL of the custodian's HTTP API")
+	fs.StringVar(&sigsFile, "sigs", "", "path to JSON file of peg-out signatures, as printed by sign-pegouts")
+	err := fs.Parse(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if sigsFile == "" {
+		log.Fatal("must specify -sigs")
+	}
+	sigsJSON, err := ioutil.ReadFile(sigsFile)
+	if err != nil {
+		log.Fatalf("reading signatures: %s", err)
+	}
+	var sigs []slidechain.PegOutSignature
+	err = json.Unmarshal(sigsJSON, &sigs)
+	if err != nil {
+		log.Fatalf("parsing signatures: %s", err)
+	}
+	client := http.Client{Timeout: time.Minute}
+	failed := false
+	for _, sig := range sigs {
+		body, err := json.Marshal(sig)
+		if err != nil {
+			log.Fatalf("marshaling signature: %s", err)
+		}
+		resp, err := client.Post(strings.TrimSuffix(url, "/")+"/pegouts/signed", "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Fatalf("submitting peg-out of export %x: %s", sig.ExportTxID, err)
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Fatalf("reading response for export %x: %s", sig.ExportTxID, err)
+		}
+		if resp.StatusCode/100 != 2 {
+			fmt.Printf("export %x: status %d: %s\n", sig.ExportTxID, resp.StatusCode, strings.TrimSpace(string(respBody)))
+			failed = true
+			continue
+		}
+		fmt.Printf("export %x: submitted Zioncoin tx %s\n", sig.ExportTxID, strings.TrimSpace(string(respBody)))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func cancelExport() {
+	var (
+		fs             flag.FlagSet
+		url, prv, txid string
+	)
+	fs.StringVar(&url, "url", "http://localhost:2423", "base URL of the custodian's HTTP API")
+	fs.StringVar(&prv, "prv", "", "hex encoding of the exporter's ed25519 key")
+	fs.StringVar(&txid, "txid", "", "hex encoding of the export txid")
+	err := fs.Parse(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if prv == "" || txid == "" {
+		log.Fatal("must specify -prv and -txid")
+	}
+	prvBytes, err := hex.DecodeString(prv)
+	if err != nil || len(prvBytes) != ed25519.PrivateKeySize {
+		log.Fatalf("-prv must be the hex encoding of a %d-byte ed25519 key", ed25519.PrivateKeySize)
+	}
+	txidBytes, err := hex.DecodeString(txid)
+	if err != nil {
+		log.Fatalf("decoding txid: %s", err)
+	}
+	body, err := json.Marshal(slidechain.SignExportCancellation(txidBytes, prvBytes))
+	if err != nil {
+		log.Fatalf("marshaling cancellation: %s", err)
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(strings.TrimSuffix(url, "/")+"/exports/cancel", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Fatalf("canceling export %s: %s", txid, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		log.Fatalf("status %d canceling export %s: %s", resp.StatusCode, txid, strings.TrimSpace(string(respBody)))
+	}
+	fmt.Printf("export %s canceled; its funds will be returned on slidechain\n", txid)
+}
+
+// decodeTx decodes a hex- or base64-encoded tx.
+func decodeTx(s string) ([]byte, error) {
+	bits, err := hex.DecodeString(s)
+	if err == nil {
+		return bits, nil
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, `Usage:
+	slidectl SUBCOMMAND ...args...
+
+	Available subcommands are: inspect-export, status,
+	unsigned-pegouts, sign-pegouts, submit-pegouts, cancel-export.
+
+	The inspect-export subcommand checks whether a slidechain
+	transaction is recognized by the custodian as an export,
+	using the same checks as the custodian itself. It prints the
+	decoded export reference data, or the check that failed.
+
+	The status subcommand queries a running custodian's HTTP API
+	and summarizes its peg-ins, exports, and health. It exits with
+	a non-zero status if the custodian reports itself unhealthy.
+
+	The unsigned-pegouts, sign-pegouts, and submit-pegouts
+	subcommands sign peg-out transactions offline, for a custodian
+	run with -offlinesigning. unsigned-pegouts prints the peg-out
+	transactions awaiting signature as JSON bundles. sign-pegouts,
+	run on the machine holding the custodian's seed, checks and
+	signs each bundle, printing the signatures as JSON.
+	submit-pegouts sends the signatures to the custodian, which
+	submits the signed transactions.
+
+	The cancel-export subcommand cancels a reversible export,
+	built by the export command with -reversible, before its
+	window closes. The custodian then returns the exported funds
+	on slidechain instead of pegging them out.
+
+	inspect-export:
+		-tx TX		hex or base64 encoding of the serialized tx
+
+	status:
+		-url URL	base URL of the custodian (default http://localhost:2423)
+		-json		print the custodian's status as JSON
+
+	unsigned-pegouts:
+		-url URL	base URL of the custodian (default http://localhost:2423)
+
+	sign-pegouts:
+		-bundles FILE	JSON peg-out bundles printed by unsigned-pegouts
+		-seed FILE	file containing the custodian's seed
+
+	submit-pegouts:
+		-url URL	base URL of the custodian (default http://localhost:2423)
+		-sigs FILE	JSON signatures printed by sign-pegouts
+
+	cancel-export:
+		-url URL	base URL of the custodian (default http://localhost:2423)
+		-prv KEY	hex encoding of the exporter's ed25519 key
+		-txid TXID	hex encoding of the export txid
+	`)
+	os.Exit(1)
+}
@@ -0,0 +1,574 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/zioncoin/go/xdr"
+)
+
+// Config holds the settings of a Custodian.
+// Only DB and HorizonURL are required;
+// the zero value of every other field selects its default.
+type Config struct {
+	// DB is the custodian's db.
+	DB *sql.DB
+
+	// HorizonURL is the URL of the Horizon server
+	// through which the custodian reaches the Zioncoin network.
+	HorizonURL string
+
+	// NetworkPassphrase, if set, must match the passphrase
+	// of the Horizon server's network,
+	// guarding against pointing a custodian at the wrong network.
+	NetworkPassphrase string
+
+	// BlockInterval is the expected interval between txvm blocks
+	// (by default, DefaultBlockInterval).
+	BlockInterval time.Duration
+
+	// Label distinguishes the custodian from others sharing DB (see Label).
+	Label string
+
+	// StartCursor and StartLedger select where to stream peg-ins from
+	// on the custodian's first run (see StartCursor and StartLedger).
+	// At most one may be set.
+	StartCursor string
+	StartLedger int32
+
+	// Fees holds the peg-out fee policy for each asset (see PegOutFees).
+	Fees map[string]FeePolicy
+
+	// Conversions holds the permitted peg-out conversions (see Conversions).
+	Conversions []ConversionPolicy
+
+	// RecoveryLog is the path of the peg-out recovery log
+	// (by default, DefaultRecoveryLog, scoped to Label).
+	RecoveryLog string
+
+	// MaxIngestionLag is the number of ledgers by which Horizon may trail Core
+	// before the custodian reports itself degraded (see MaxIngestionLag).
+	MaxIngestionLag int32
+
+	// ExportStateAttempts bounds the attempts to record a peg-out's state
+	// in the db (by default, DefaultExportStateAttempts).
+	ExportStateAttempts int
+
+	// MaxPegOutRetries bounds the retries of a peg-out tx
+	// that failed with a retryable error
+	// (by default, DefaultMaxPegOutRetries; see MaxPegOutRetries).
+	MaxPegOutRetries int
+
+	// PegOutRetryBackoff and PegOutRetryBackoffMax space the retries
+	// of a peg-out tx that failed with a retryable error
+	// (by default, DefaultPegOutRetryBackoff and DefaultPegOutRetryBackoffMax;
+	// see PegOutRetryBackoff).
+	PegOutRetryBackoff    time.Duration
+	PegOutRetryBackoffMax time.Duration
+
+	// MaxPegOutBatch is the number of peg-out payments,
+	// at most 100, that the custodian makes from its own account in one tx
+	// (by default, 1; see MaxPegOutBatch).
+	MaxPegOutBatch int
+
+	// PegInSource selects the Horizon stream from which to observe peg-ins
+	// (by default, PegInsFromTxs; see PegIns).
+	PegInSource PegInSource
+
+	// ImportWorkers is the number of imports built and submitted at once
+	// (by default, DefaultImportWorkers; see ImportWorkers).
+	// OrderImportsByRecipient preserves the arrival order
+	// of each recipient's imports (see OrderImportsByRecipient).
+	ImportWorkers           int
+	OrderImportsByRecipient bool
+
+	// ImportBatch, if greater than 1, is the number of pegs
+	// imported at once in one txvm tx (see BatchImports).
+	ImportBatch int
+
+	// ImportRefunds selects what becomes of the funds of pegs
+	// that can never be imported (see ImportRefunds).
+	ImportRefunds ImportRefundPolicy
+
+	// PegInConfirmations is the number of ledgers to close
+	// after a peg-in payment's before it is imported
+	// (see PegInConfirmations).
+	PegInConfirmations int
+
+	// DBTimeout bounds each db statement of the peg-in and peg-out goroutines
+	// (by default, DefaultDBTimeout; see DBTimeout).
+	DBTimeout time.Duration
+
+	// PegInKeyWindow is how long the idempotency keys
+	// of pre-peg-in requests are remembered
+	// (by default, DefaultPegInKeyWindow; see PegInKeyWindow).
+	PegInKeyWindow time.Duration
+
+	// BaseReserve is the Zioncoin network's base reserve, in stroops
+	// (by default, DefaultBaseReserve; see BaseReserve).
+	BaseReserve int64
+
+	// BaseFee is the base fee, in stroops per operation,
+	// of the custodian's Zioncoin txs
+	// (by default, 100; see BaseFee).
+	BaseFee int64
+
+	// TrancheInterval is the interval between the partial payments
+	// of a peg-out split into tranches
+	// (by default, DefaultTrancheInterval; see TrancheInterval).
+	TrancheInterval time.Duration
+
+	// OfflineSigning leaves peg-out txs to be signed offline
+	// (see OfflineSigning).
+	OfflineSigning bool
+
+	// MaxExportBacklog bounds the exports awaiting peg-out
+	// before new exports are deferred (see MaxExportBacklog).
+	MaxExportBacklog int
+
+	// ReconcileOnLedgers finishes peg-outs once per closed ledger
+	// rather than once a minute (see ReconcileOnLedgers).
+	ReconcileOnLedgers bool
+
+	// ExportDeadline, if positive, is how long an export may go unsettled
+	// before it is escalated, and passed to OnStuckExport if that is set
+	// (see ExportDeadline).
+	ExportDeadline time.Duration
+	OnStuckExport  func(StuckExport)
+
+	// ColdWallet, if set, is the account to which the custodian sweeps
+	// its balance of each asset in SweepThresholds above the asset's threshold
+	// (see ColdWallet).
+	ColdWallet      string
+	SweepThresholds map[string]int64
+
+	// Observer runs the custodian read-only,
+	// watching the account with address ObservedAddress,
+	// or by default the one in the db (see Observer).
+	Observer        bool
+	ObservedAddress string
+
+	// VerifyIssuers flags peg-ins of assets
+	// whose issuers keep the custodian from pegging them out (see VerifyIssuers).
+	VerifyIssuers bool
+
+	// VerifyTempAccounts checks each export's temp account on the Zioncoin network
+	// before recording it (see VerifyTempAccounts).
+	VerifyTempAccounts bool
+
+	// CosignPegOuts expects each export's temp account
+	// to need the custodian's signature as well as the preauth tx
+	// (see CosignPegOuts).
+	CosignPegOuts bool
+
+	// AuditMode witnesses each peg-out in the witness log
+	// (see AuditMode).
+	AuditMode bool
+
+	// VerifyExportSigs re-verifies the exporter's signature
+	// on each export before recording it (see VerifyExportSigs).
+	VerifyExportSigs bool
+
+	// AdminToken, if set, is the bearer token
+	// required by the admin endpoints (see AdminToken).
+	AdminToken []byte
+
+	// BatchWrites records the exports of each block,
+	// and the peg-ins of each Zioncoin tx,
+	// in one db transaction (see BatchWrites).
+	BatchWrites bool
+
+	// RecoverOnStart reconciles the db with the txvm chain
+	// and the Zioncoin network before the custodian starts
+	// (see RecoverOnStart).
+	RecoverOnStart bool
+
+	// RecoveryBatchSize is the number of exports Recover reads at a time
+	// (by default, DefaultRecoveryBatchSize; see RecoveryBatchSize).
+	RecoveryBatchSize int
+
+	// WebhookURL, if set, is notified of settled peg-outs,
+	// with requests signed with WebhookSecret (see Webhook).
+	WebhookURL    string
+	WebhookSecret []byte
+
+	// Tracer, if set, traces exports through their peg-outs
+	// (see Tracing).
+	Tracer Tracer
+
+	// Sequencer, if set, numbers the txs from the custodian account
+	// (see CustodianSequencer).
+	Sequencer Sequencer
+
+	// TrustlineRecheck, if positive, causes exports
+	// whose exporters lack trustlines to their assets
+	// to await the trustlines, checking again at this interval,
+	// for at most TrustlineTimeout, if positive (see AwaitTrustlines).
+	TrustlineRecheck time.Duration
+	TrustlineTimeout time.Duration
+
+	// ExportPolicy, if set, checks each export before it is recorded,
+	// rejecting those for which it returns an error
+	// (see ExportPolicy).
+	ExportPolicy func(ProposedExport) error
+
+	// PegOutValidator, if set, checks each peg-out tx before it is submitted,
+	// holding for review the exports of those for which it returns an error
+	// (see PegOutValidator).
+	PegOutValidator func(ProposedPegOut) error
+
+	// AsyncPegOuts submits peg-out txs asynchronously
+	// where Horizon supports it,
+	// confirming them from the custodian account's tx stream
+	// (see AsyncPegOuts).
+	AsyncPegOuts bool
+
+	// AccountCheckInterval, if positive, is how often the custodian checks
+	// that its Zioncoin account is still usable and unchanged,
+	// halting submissions while it is not (see CheckAccount).
+	AccountCheckInterval time.Duration
+
+	// DrainTimeout is how long Shutdown waits for in-flight peg-outs
+	// before abandoning them
+	// (by default, DefaultDrainTimeout; see DrainTimeout).
+	DrainTimeout time.Duration
+}
+
+// minBlockInterval is the shortest accepted Config.BlockInterval.
+const minBlockInterval = 100 * time.Millisecond
+
+// Validate reports the first problem found with the config, if any.
+func (cfg Config) Validate() error {
+	if cfg.DB == nil {
+		return errors.New("config: DB is required")
+	}
+	if cfg.HorizonURL == "" {
+		return errors.New("config: HorizonURL is required")
+	}
+	err := validateURL(cfg.HorizonURL)
+	if err != nil {
+		return errors.Wrap(err, "config: HorizonURL")
+	}
+	if cfg.BlockInterval != 0 && cfg.BlockInterval < minBlockInterval {
+		return fmt.Errorf("config: BlockInterval %s is shorter than the minimum of %s", cfg.BlockInterval, minBlockInterval)
+	}
+	if cfg.StartCursor != "" && cfg.StartLedger != 0 {
+		return errors.New("config: at most one of StartCursor and StartLedger may be set")
+	}
+	if cfg.StartLedger < 0 {
+		return fmt.Errorf("config: StartLedger %d is negative", cfg.StartLedger)
+	}
+	for asset, policy := range cfg.Fees {
+		if policy.Flat < 0 || policy.MinPayout < 0 || policy.MaxPayout < 0 || policy.TrancheMin < 0 || policy.MaxPerTx < 0 || policy.DustThreshold < 0 {
+			return fmt.Errorf("config: fee policy for %s has a negative amount", asset)
+		}
+		if policy.BasisPoints < 0 || policy.BasisPoints > 10000 {
+			return fmt.Errorf("config: fee policy for %s has basis points %d outside [0, 10000]", asset, policy.BasisPoints)
+		}
+		if policy.Tranches < 0 {
+			return fmt.Errorf("config: fee policy for %s has negative tranches %d", asset, policy.Tranches)
+		}
+	}
+	for _, policy := range cfg.Conversions {
+		from, err := parseAsset(policy.From)
+		if err != nil {
+			return errors.Wrap(err, "config: conversion policy")
+		}
+		to, err := parseAsset(policy.To)
+		if err != nil {
+			return errors.Wrap(err, "config: conversion policy")
+		}
+		if from.Equals(to) {
+			return fmt.Errorf("config: conversion policy converts %s to itself", policy.From)
+		}
+		if policy.MaxSlippageBP < 0 || policy.MaxSlippageBP > 10000 {
+			return fmt.Errorf("config: conversion policy from %s to %s has slippage limit %d outside [0, 10000]", policy.From, policy.To, policy.MaxSlippageBP)
+		}
+	}
+	switch cfg.PegInSource {
+	case "", PegInsFromTxs, PegInsFromPayments:
+	default:
+		return fmt.Errorf("config: PegInSource %q is not %q or %q", cfg.PegInSource, PegInsFromTxs, PegInsFromPayments)
+	}
+	if cfg.ImportWorkers < 0 {
+		return fmt.Errorf("config: ImportWorkers %d is negative", cfg.ImportWorkers)
+	}
+	if cfg.ImportBatch < 0 {
+		return fmt.Errorf("config: ImportBatch %d is negative", cfg.ImportBatch)
+	}
+	switch cfg.ImportRefunds {
+	case "", HoldFailedImports, RefundFailedImports:
+	default:
+		return fmt.Errorf("config: ImportRefunds %q is not %q or %q", cfg.ImportRefunds, HoldFailedImports, RefundFailedImports)
+	}
+	if cfg.PegInConfirmations < 0 {
+		return fmt.Errorf("config: PegInConfirmations %d is negative", cfg.PegInConfirmations)
+	}
+	if cfg.BaseReserve < 0 {
+		return fmt.Errorf("config: BaseReserve %d is negative", cfg.BaseReserve)
+	}
+	if cfg.BaseFee != 0 && cfg.BaseFee < minBaseFee {
+		return fmt.Errorf("config: BaseFee %d is below the network minimum of %d", cfg.BaseFee, minBaseFee)
+	}
+	if cfg.TrancheInterval < 0 {
+		return fmt.Errorf("config: TrancheInterval %s is negative", cfg.TrancheInterval)
+	}
+	if cfg.MaxExportBacklog < 0 {
+		return fmt.Errorf("config: MaxExportBacklog %d is negative", cfg.MaxExportBacklog)
+	}
+	if cfg.ExportDeadline < 0 {
+		return fmt.Errorf("config: ExportDeadline %s is negative", cfg.ExportDeadline)
+	}
+	if cfg.OnStuckExport != nil && cfg.ExportDeadline == 0 {
+		return errors.New("config: OnStuckExport requires ExportDeadline")
+	}
+	if cfg.DrainTimeout < 0 {
+		return fmt.Errorf("config: DrainTimeout %s is negative", cfg.DrainTimeout)
+	}
+	if cfg.ColdWallet != "" {
+		var cold xdr.AccountId
+		if err := cold.SetAddress(cfg.ColdWallet); err != nil {
+			return fmt.Errorf("config: ColdWallet %q is not a Zioncoin address", cfg.ColdWallet)
+		}
+	} else if len(cfg.SweepThresholds) > 0 {
+		return errors.New("config: SweepThresholds requires ColdWallet")
+	}
+	for asset, threshold := range cfg.SweepThresholds {
+		if threshold < 0 {
+			return fmt.Errorf("config: sweep threshold %d for asset %s is negative", threshold, asset)
+		}
+	}
+	if cfg.ObservedAddress != "" {
+		if !cfg.Observer {
+			return errors.New("config: ObservedAddress requires Observer")
+		}
+		var accountID xdr.AccountId
+		err := accountID.SetAddress(cfg.ObservedAddress)
+		if err != nil {
+			return errors.Wrap(err, "config: ObservedAddress")
+		}
+	}
+	if cfg.PegInKeyWindow < 0 {
+		return fmt.Errorf("config: PegInKeyWindow %s is negative", cfg.PegInKeyWindow)
+	}
+	if cfg.RecoveryBatchSize < 0 {
+		return fmt.Errorf("config: RecoveryBatchSize %d is negative", cfg.RecoveryBatchSize)
+	}
+	if cfg.TrustlineRecheck < 0 {
+		return fmt.Errorf("config: TrustlineRecheck %s is negative", cfg.TrustlineRecheck)
+	}
+	if cfg.TrustlineTimeout < 0 {
+		return fmt.Errorf("config: TrustlineTimeout %s is negative", cfg.TrustlineTimeout)
+	}
+	if cfg.TrustlineTimeout > 0 && cfg.TrustlineRecheck == 0 {
+		return errors.New("config: TrustlineTimeout requires TrustlineRecheck")
+	}
+	if cfg.AccountCheckInterval < 0 {
+		return fmt.Errorf("config: AccountCheckInterval %s is negative", cfg.AccountCheckInterval)
+	}
+	if cfg.ExportStateAttempts < 0 {
+		return fmt.Errorf("config: ExportStateAttempts %d is negative", cfg.ExportStateAttempts)
+	}
+	if cfg.PegOutRetryBackoff < 0 {
+		return fmt.Errorf("config: PegOutRetryBackoff %s is negative", cfg.PegOutRetryBackoff)
+	}
+	if cfg.PegOutRetryBackoffMax < 0 {
+		return fmt.Errorf("config: PegOutRetryBackoffMax %s is negative", cfg.PegOutRetryBackoffMax)
+	}
+	if cfg.MaxPegOutBatch < 0 || cfg.MaxPegOutBatch > maxTxOps {
+		return fmt.Errorf("config: MaxPegOutBatch %d is not between 0 and %d", cfg.MaxPegOutBatch, maxTxOps)
+	}
+	if cfg.PegOutRetryBackoff > 0 && cfg.PegOutRetryBackoffMax > 0 && cfg.PegOutRetryBackoffMax < cfg.PegOutRetryBackoff {
+		return fmt.Errorf("config: PegOutRetryBackoffMax %s is less than PegOutRetryBackoff %s", cfg.PegOutRetryBackoffMax, cfg.PegOutRetryBackoff)
+	}
+	if cfg.WebhookURL != "" {
+		err = validateURL(cfg.WebhookURL)
+		if err != nil {
+			return errors.Wrap(err, "config: WebhookURL")
+		}
+		if len(cfg.WebhookSecret) == 0 {
+			return errors.New("config: WebhookURL requires WebhookSecret")
+		}
+	}
+	return nil
+}
+
+func validateURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("URL %q is not http or https", s)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("URL %q has no host", s)
+	}
+	return nil
+}
+
+// options returns the Options equivalent to the config.
+func (cfg Config) options() []Option {
+	opts := []Option{Label(cfg.Label)}
+	if cfg.StartCursor != "" {
+		opts = append(opts, StartCursor(cfg.StartCursor))
+	} else if cfg.StartLedger > 0 {
+		opts = append(opts, StartLedger(cfg.StartLedger))
+	}
+	if cfg.Fees != nil {
+		opts = append(opts, PegOutFees(cfg.Fees))
+	}
+	if len(cfg.Conversions) > 0 {
+		opts = append(opts, Conversions(cfg.Conversions))
+	}
+	if cfg.RecoveryLog != "" {
+		opts = append(opts, RecoveryLog(cfg.RecoveryLog))
+	}
+	if cfg.MaxIngestionLag != 0 {
+		opts = append(opts, MaxIngestionLag(cfg.MaxIngestionLag))
+	}
+	if cfg.ExportStateAttempts > 0 {
+		opts = append(opts, ExportStateAttempts(cfg.ExportStateAttempts))
+	}
+	if cfg.MaxPegOutRetries != 0 {
+		opts = append(opts, MaxPegOutRetries(cfg.MaxPegOutRetries))
+	}
+	if cfg.PegOutRetryBackoff > 0 || cfg.PegOutRetryBackoffMax > 0 {
+		opts = append(opts, PegOutRetryBackoff(cfg.PegOutRetryBackoff, cfg.PegOutRetryBackoffMax))
+	}
+	if cfg.MaxPegOutBatch > 0 {
+		opts = append(opts, MaxPegOutBatch(cfg.MaxPegOutBatch))
+	}
+	if cfg.PegInSource != "" {
+		opts = append(opts, PegIns(cfg.PegInSource))
+	}
+	if cfg.ImportWorkers > 0 {
+		opts = append(opts, ImportWorkers(cfg.ImportWorkers))
+	}
+	if cfg.OrderImportsByRecipient {
+		opts = append(opts, OrderImportsByRecipient())
+	}
+	if cfg.ImportBatch > 1 {
+		opts = append(opts, BatchImports(cfg.ImportBatch))
+	}
+	if cfg.ImportRefunds != "" {
+		opts = append(opts, ImportRefunds(cfg.ImportRefunds))
+	}
+	if cfg.PegInConfirmations > 0 {
+		opts = append(opts, PegInConfirmations(cfg.PegInConfirmations))
+	}
+	if cfg.DBTimeout != 0 {
+		opts = append(opts, DBTimeout(cfg.DBTimeout))
+	}
+	if cfg.PegInKeyWindow != 0 {
+		opts = append(opts, PegInKeyWindow(cfg.PegInKeyWindow))
+	}
+	if cfg.BaseReserve > 0 {
+		opts = append(opts, BaseReserve(cfg.BaseReserve))
+	}
+	if cfg.BaseFee > 0 {
+		opts = append(opts, BaseFee(cfg.BaseFee))
+	}
+	if cfg.TrancheInterval > 0 {
+		opts = append(opts, TrancheInterval(cfg.TrancheInterval))
+	}
+	if cfg.OfflineSigning {
+		opts = append(opts, OfflineSigning())
+	}
+	if cfg.MaxExportBacklog > 0 {
+		opts = append(opts, MaxExportBacklog(cfg.MaxExportBacklog))
+	}
+	if cfg.ReconcileOnLedgers {
+		opts = append(opts, ReconcileOnLedgers())
+	}
+	if cfg.ExportDeadline > 0 {
+		opts = append(opts, ExportDeadline(cfg.ExportDeadline, cfg.OnStuckExport))
+	}
+	if cfg.ColdWallet != "" {
+		opts = append(opts, ColdWallet(cfg.ColdWallet, cfg.SweepThresholds))
+	}
+	if cfg.Observer {
+		opts = append(opts, Observer(cfg.ObservedAddress))
+	}
+	if cfg.VerifyIssuers {
+		opts = append(opts, VerifyIssuers())
+	}
+	if cfg.VerifyTempAccounts {
+		opts = append(opts, VerifyTempAccounts())
+	}
+	if cfg.CosignPegOuts {
+		opts = append(opts, CosignPegOuts())
+	}
+	if cfg.AuditMode {
+		opts = append(opts, AuditMode())
+	}
+	if cfg.VerifyExportSigs {
+		opts = append(opts, VerifyExportSigs())
+	}
+	if cfg.BatchWrites {
+		opts = append(opts, BatchWrites())
+	}
+	if len(cfg.AdminToken) > 0 {
+		opts = append(opts, AdminToken(cfg.AdminToken))
+	}
+	if cfg.RecoverOnStart {
+		opts = append(opts, RecoverOnStart())
+	}
+	if cfg.RecoveryBatchSize > 0 {
+		opts = append(opts, RecoveryBatchSize(cfg.RecoveryBatchSize))
+	}
+	if cfg.WebhookURL != "" {
+		opts = append(opts, Webhook(cfg.WebhookURL, cfg.WebhookSecret))
+	}
+	if cfg.Tracer != nil {
+		opts = append(opts, Tracing(cfg.Tracer))
+	}
+	if cfg.Sequencer != nil {
+		opts = append(opts, CustodianSequencer(cfg.Sequencer))
+	}
+	if cfg.TrustlineRecheck > 0 {
+		opts = append(opts, AwaitTrustlines(cfg.TrustlineRecheck, cfg.TrustlineTimeout))
+	}
+	if cfg.ExportPolicy != nil {
+		opts = append(opts, ExportPolicy(cfg.ExportPolicy))
+	}
+	if cfg.PegOutValidator != nil {
+		opts = append(opts, PegOutValidator(cfg.PegOutValidator))
+	}
+	if cfg.AsyncPegOuts {
+		opts = append(opts, AsyncPegOuts())
+	}
+	if cfg.AccountCheckInterval > 0 {
+		opts = append(opts, CheckAccount(cfg.AccountCheckInterval))
+	}
+	if cfg.DrainTimeout > 0 {
+		opts = append(opts, DrainTimeout(cfg.DrainTimeout))
+	}
+	return opts
+}
+
+// NewCustodian validates cfg and returns a running Custodian configured by it,
+// as GetCustodian does.
+func NewCustodian(ctx context.Context, cfg Config) (*Custodian, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	blockInterval := cfg.BlockInterval
+	if blockInterval == 0 {
+		blockInterval = DefaultBlockInterval
+	}
+	c, err := newCustodian(ctx, cfg.DB, hclient(cfg.HorizonURL), blockInterval, cfg.options()...)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.NetworkPassphrase != "" && cfg.NetworkPassphrase != c.network {
+		return nil, fmt.Errorf("config: NetworkPassphrase %q does not match Horizon network %q", cfg.NetworkPassphrase, c.network)
+	}
+	c.start(ctx)
+	return c, nil
+}
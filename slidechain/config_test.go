@@ -0,0 +1,91 @@
+package slidechain
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	db := new(sql.DB) // never used
+	valid := Config{DB: db, HorizonURL: "https://equator-testnet.zion.info"}
+
+	cases := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr string
+	}{
+		{"valid", func(*Config) {}, ""},
+		{"no db", func(cfg *Config) { cfg.DB = nil }, "DB is required"},
+		{"no url", func(cfg *Config) { cfg.HorizonURL = "" }, "HorizonURL is required"},
+		{"bad url", func(cfg *Config) { cfg.HorizonURL = "equator-testnet.zion.info" }, "HorizonURL"},
+		{"short interval", func(cfg *Config) { cfg.BlockInterval = time.Millisecond }, "BlockInterval"},
+		{"cursor and ledger", func(cfg *Config) { cfg.StartCursor, cfg.StartLedger = "1", 1 }, "at most one"},
+		{"negative ledger", func(cfg *Config) { cfg.StartLedger = -1 }, "StartLedger"},
+		{"negative fee", func(cfg *Config) { cfg.Fees = map[string]FeePolicy{"native": {Flat: -1}} }, "negative amount"},
+		{"fee over 100%", func(cfg *Config) { cfg.Fees = map[string]FeePolicy{"native": {BasisPoints: 10001}} }, "basis points"},
+		{"negative tranches", func(cfg *Config) { cfg.Fees = map[string]FeePolicy{"native": {Tranches: -1}} }, "negative tranches"},
+		{"negative dust threshold", func(cfg *Config) { cfg.Fees = map[string]FeePolicy{"native": {DustThreshold: -1}} }, "negative amount"},
+		{"negative attempts", func(cfg *Config) { cfg.ExportStateAttempts = -1 }, "ExportStateAttempts"},
+		{"negative retry backoff", func(cfg *Config) { cfg.PegOutRetryBackoff = -time.Second }, "PegOutRetryBackoff"},
+		{"peg-out batch too large", func(cfg *Config) { cfg.MaxPegOutBatch = 101 }, "MaxPegOutBatch"},
+		{"retry backoff above max", func(cfg *Config) { cfg.PegOutRetryBackoff, cfg.PegOutRetryBackoffMax = time.Minute, time.Second }, "less than PegOutRetryBackoff"},
+		{"negative base reserve", func(cfg *Config) { cfg.BaseReserve = -1 }, "BaseReserve"},
+		{"base fee below minimum", func(cfg *Config) { cfg.BaseFee = 50 }, "BaseFee"},
+		{"negative tranche interval", func(cfg *Config) { cfg.TrancheInterval = -time.Second }, "TrancheInterval"},
+		{"negative export backlog", func(cfg *Config) { cfg.MaxExportBacklog = -1 }, "MaxExportBacklog"},
+		{"negative export deadline", func(cfg *Config) { cfg.ExportDeadline = -time.Hour }, "ExportDeadline"},
+		{"stuck export alert without deadline", func(cfg *Config) { cfg.OnStuckExport = func(StuckExport) {} }, "requires ExportDeadline"},
+		{"observed address without observer", func(cfg *Config) { cfg.ObservedAddress = importTestAccountID }, "requires Observer"},
+		{"bad observed address", func(cfg *Config) { cfg.Observer, cfg.ObservedAddress = true, "nope" }, "ObservedAddress"},
+		{"negative key window", func(cfg *Config) { cfg.PegInKeyWindow = -time.Hour }, "PegInKeyWindow"},
+		{"negative import batch", func(cfg *Config) { cfg.ImportBatch = -1 }, "ImportBatch"},
+		{"bad import refunds", func(cfg *Config) { cfg.ImportRefunds = "sender" }, "ImportRefunds"},
+		{"negative drain timeout", func(cfg *Config) { cfg.DrainTimeout = -time.Second }, "DrainTimeout"},
+		{"conversion slippage", func(cfg *Config) {
+			cfg.Conversions = []ConversionPolicy{{From: "native", To: "credit_alphanum4/USD/" + importTestAccountID, MaxSlippageBP: 10001}}
+		}, "slippage"},
+		{"conversion to itself", func(cfg *Config) {
+			cfg.Conversions = []ConversionPolicy{{From: "native", To: "native"}}
+		}, "itself"},
+		{"webhook without secret", func(cfg *Config) { cfg.WebhookURL = "https://example.com/hook" }, "WebhookSecret"},
+		{"webhook", func(cfg *Config) {
+			cfg.WebhookURL = "https://example.com/hook"
+			cfg.WebhookSecret = []byte("secret")
+		}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := valid
+			c.modify(&cfg)
+			err := cfg.Validate()
+			if c.wantErr == "" {
+				if err != nil {
+					t.Errorf("got error %s, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("got error %v, want one mentioning %q", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigOptions(t *testing.T) {
+	cfg := Config{
+		Label:               "lumens",
+		StartLedger:         3,
+		Fees:                map[string]FeePolicy{"native": {Flat: 10}},
+		RecoveryLog:         "recovery.log",
+		ExportStateAttempts: 2,
+	}
+	var c Custodian
+	for _, opt := range cfg.options() {
+		opt(&c)
+	}
+	if c.label != cfg.Label || c.startCursor != "12884901888" || c.fees["native"].Flat != 10 || c.recoveryLog != cfg.RecoveryLog || c.exportStateAttempts != 2 || c.webhook != nil {
+		t.Errorf("config %+v produced custodian settings label %q, cursor %q, fees %v, recovery log %q, attempts %d, webhook %v", cfg, c.label, c.startCursor, c.fees, c.recoveryLog, c.exportStateAttempts, c.webhook)
+	}
+}
@@ -0,0 +1,106 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	i10rnet "github.com/interzioncoin/starlight/net"
+	"github.com/zioncoin/go/clients/equator"
+)
+
+// States of a peg, in pegs.zioncoin_tx.
+// A paid peg awaits import.
+const (
+	pegUnpaid     = 0
+	pegPaid       = 1
+	pegConfirming = 2
+)
+
+// PegInConfirmations causes the custodian to defer
+// the import of each peg-in
+// until n further ledgers have closed
+// after the ledger of its payment.
+// Until then the peg is paid but awaiting confirmation.
+// By default, and with n of zero,
+// a peg-in is imported as soon as its payment is seen.
+func PegInConfirmations(n int) Option {
+	return func(c *Custodian) {
+		c.pegInConfirmations = n
+	}
+}
+
+// pegState returns the state in which to record a newly paid peg.
+func (c *Custodian) pegState() int {
+	if c.pegInConfirmations > 0 {
+		return pegConfirming
+	}
+	return pegPaid
+}
+
+// cursorLedger returns the ledger of the Horizon paging token cursor,
+// or zero if it has none.
+func cursorLedger(cursor string) int32 {
+	toid, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return int32(toid >> 32)
+}
+
+// Runs as a goroutine until ctx is canceled.
+// confirmPegIns streams closed ledgers from the equator server,
+// confirming the pegs awaiting confirmation
+// whose payments are deep enough after each.
+func (c *Custodian) confirmPegIns(ctx context.Context) {
+	defer log.Print("confirmPegIns exiting")
+	backoff := i10rnet.Backoff{Base: 100 * time.Millisecond}
+
+	cur := equator.Cursor("now")
+	for {
+		err := c.hclient.StreamLedgers(ctx, &cur, func(ledger equator.Ledger) {
+			cur = equator.Cursor(ledger.PagingToken())
+			c.retryDB(ctx, fmt.Sprintf("confirming peg-ins at ledger %d", ledger.Sequence), func(ctx context.Context) error {
+				return c.confirmPegInsAt(ctx, ledger.Sequence)
+			})
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("ledger stream for peg-in confirmations disconnected (%v), retrying...", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff.Next()):
+		}
+	}
+}
+
+// confirmPegInsAt marks as paid, and so ready for import,
+// the pegs awaiting confirmation
+// whose payments are at least c.pegInConfirmations ledgers before the given one.
+// A peg whose payment's ledger is unknown
+// counts its confirmations from the first ledger seen here.
+func (c *Custodian) confirmPegInsAt(ctx context.Context, ledger int32) error {
+	_, err := c.DB.ExecContext(ctx, `UPDATE pegs SET ledger=$1 WHERE zioncoin_tx=$2 AND ledger=0 AND custodian_id=$3`, ledger, pegConfirming, c.label)
+	if err != nil {
+		return errors.Wrap(err, "recording ledgers of unconfirmed pegs")
+	}
+	const q = `UPDATE pegs SET zioncoin_tx=$1 WHERE zioncoin_tx=$2 AND ledger<=$3 AND custodian_id=$4`
+	result, err := c.DB.ExecContext(ctx, q, pegPaid, pegConfirming, int64(ledger)-int64(c.pegInConfirmations), c.label)
+	if err != nil {
+		return errors.Wrap(err, "confirming pegs")
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "counting confirmed pegs")
+	}
+	if n > 0 {
+		log.Printf("confirmed %d peg-ins at ledger %d, broadcasting import", n, ledger)
+		c.imports.Broadcast()
+	}
+	return nil
+}
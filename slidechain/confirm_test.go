@@ -0,0 +1,112 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/zioncoin/go/clients/equator"
+)
+
+func TestPegInConfirmations(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		// The ledgers sent on ledgers are streamed,
+		// with a send on handled once each has been handled.
+		var (
+			ledgers = make(chan int32)
+			handled = make(chan struct{})
+		)
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		hclient.streamLedgers = func(ctx context.Context, cursor *equator.Cursor, handler equator.LedgerHandler) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case seq := <-ledgers:
+					handler(equator.Ledger{Sequence: seq})
+					handled <- struct{}{}
+				}
+			}
+		}
+		c.hclient = hclient
+		go c.confirmPegIns(ctx)
+		advance := func(ledger int32) {
+			select {
+			case <-ctx.Done():
+				t.Fatal(ctx.Err())
+			case ledgers <- ledger:
+			}
+			<-handled
+		}
+
+		newPeg := func(i int64) [32]byte {
+			expMS := int64(bc.Millis(time.Now().Add(10*time.Minute))) + i
+			nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
+			err := c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, expMS, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return nonceHash
+		}
+		check := func(name string, nonceHash [32]byte, wantState int) {
+			t.Helper()
+			var state int
+			err := db.QueryRow("SELECT zioncoin_tx FROM pegs WHERE nonce_hash=$1", nonceHash[:]).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state != wantState {
+				t.Errorf("%s peg: got zioncoin_tx=%d, want %d", name, state, wantState)
+			}
+		}
+
+		// One peg's payment is in ledger 100,
+		// the other's in a ledger not known from its cursor.
+		early, unknown := newPeg(1), newPeg(2)
+		err := c.recordPegIn(ctx, "tx1", strconv.FormatInt(100<<32|1<<12, 10), early[:], "source", 10, []byte("asset"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.recordPegIn(ctx, "tx2", "cursor", unknown[:], "source", 10, []byte("asset"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		check("early", early, pegConfirming)
+		check("unknown", unknown, pegConfirming)
+
+		var s Status
+		err = c.pegStatus(ctx, &s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.PegIns.AwaitingConfirmation != 2 || s.PegIns.AwaitingImport != 0 {
+			t.Errorf("got %d pegs awaiting confirmation and %d awaiting import, want 2 and 0", s.PegIns.AwaitingConfirmation, s.PegIns.AwaitingImport)
+		}
+
+		advance(101)
+		advance(102)
+		check("early", early, pegConfirming)
+		advance(103)
+		check("early", early, pegPaid)
+
+		// The unknown peg counts its confirmations from ledger 101,
+		// the first seen after its payment.
+		check("unknown", unknown, pegConfirming)
+		advance(104)
+		check("unknown", unknown, pegPaid)
+
+		p, err := c.PegIn(ctx, unknown[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.Paid || p.Confirming {
+			t.Errorf("got paid %v, confirming %v for confirmed peg, want paid and not confirming", p.Paid, p.Confirming)
+		}
+	}, PegInConfirmations(3))
+}
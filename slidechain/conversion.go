@@ -0,0 +1,229 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interzioncoin/starlight/worizon/xlm"
+	"github.com/zioncoin/go/amount"
+	b "github.com/zioncoin/go/build"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/xdr"
+)
+
+// Conversion asks the custodian to pay out an export
+// in an asset other than the one exported
+// (see ExportOptions.Conversion).
+// The export's peg-out tx buys Amount of Asset for the exporter
+// with a path payment from the custodian account,
+// spending at most the payout of the exported asset.
+type Conversion struct {
+	Asset  xdr.Asset
+	Amount int64
+}
+
+// ConversionPolicy permits the custodian to convert exports
+// of one asset to another when pegging them out (see Conversions).
+type ConversionPolicy struct {
+	// From and To are the string forms of the exported asset
+	// and of the asset paid out,
+	// as in the keys of PegOutFees.
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// MaxSlippageBP bounds, in basis points,
+	// how far the average price of a conversion
+	// may exceed the best price in the order book.
+	MaxSlippageBP int64 `json:"max_slippage_bp"`
+}
+
+// Conversions permits the custodian to peg out exports requesting conversion
+// (see ExportOptions.Conversion)
+// between the pairs of assets in policies.
+// Before pegging out such an export,
+// the custodian prices its conversion from the Zioncoin order book.
+// It refuses the conversion, failing the export,
+// if no policy covers its assets,
+// if the order book cannot fill it within the export's payout,
+// or if its average price exceeds the best price
+// by more than the policy's MaxSlippageBP.
+// Each conversion pegged out is recorded in the conversions table.
+func Conversions(policies []ConversionPolicy) Option {
+	return func(c *Custodian) {
+		c.conversions = make(map[string]ConversionPolicy)
+		for _, policy := range policies {
+			c.conversions[conversionKey(policy.From, policy.To)] = policy
+		}
+	}
+}
+
+func conversionKey(from, to string) string {
+	return from + " " + to
+}
+
+// conversion returns the conversion requested by p, if any.
+func (p pegOut) conversion() (*Conversion, error) {
+	if len(p.ConvertAssetXDR) == 0 {
+		return nil, nil
+	}
+	var asset xdr.Asset
+	err := xdr.SafeUnmarshal(p.ConvertAssetXDR, &asset)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshaling conversion asset")
+	}
+	return &Conversion{Asset: asset, Amount: p.ConvertAmount}, nil
+}
+
+// checkConversion prices conv,
+// to be paid for with at most sendMax of asset,
+// from the offers in the Zioncoin order book selling conv.Asset for asset,
+// best first.
+// It returns the cost of the conversion in asset,
+// and the reason the custodian refuses it, if it does.
+func (c *Custodian) checkConversion(asset xdr.Asset, sendMax int64, conv Conversion) (int64, string, error) {
+	policy, ok := c.conversions[conversionKey(asset.String(), conv.Asset.String())]
+	if !ok {
+		return 0, fmt.Sprintf("no conversion policy from %s to %s", asset.String(), conv.Asset.String()), nil
+	}
+	selling, err := equatorAsset(conv.Asset)
+	if err != nil {
+		return 0, "", err
+	}
+	buying, err := equatorAsset(asset)
+	if err != nil {
+		return 0, "", err
+	}
+	book, err := c.hclient.LoadOrderBook(selling, buying)
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "loading order book of %s for %s", conv.Asset.String(), asset.String())
+	}
+
+	var (
+		cost      = new(big.Int)
+		best      *big.Int
+		remaining = conv.Amount
+	)
+	for _, level := range book.Asks {
+		if remaining == 0 {
+			break
+		}
+		if level.PriceR.N <= 0 || level.PriceR.D <= 0 {
+			return 0, "", fmt.Errorf("order book has invalid price %d/%d", level.PriceR.N, level.PriceR.D)
+		}
+		offered, err := amount.ParseInt64(level.Amount)
+		if err != nil {
+			return 0, "", errors.Wrapf(err, "parsing order book amount %s", level.Amount)
+		}
+		if best == nil {
+			best = priceOf(conv.Amount, level.PriceR.N, level.PriceR.D)
+		}
+		take := offered
+		if take > remaining {
+			take = remaining
+		}
+		cost.Add(cost, priceOf(take, level.PriceR.N, level.PriceR.D))
+		remaining -= take
+	}
+	if remaining > 0 {
+		return 0, fmt.Sprintf("order book cannot fill %d of %s", conv.Amount, conv.Asset.String()), nil
+	}
+	if !cost.IsInt64() || cost.Int64() > sendMax {
+		return 0, fmt.Sprintf("conversion costs %s of %s, more than the payout of %d", cost, asset.String(), sendMax), nil
+	}
+	// The slippage is cost/best - 1.
+	slippageBP := new(big.Int).Mul(cost, big.NewInt(10000))
+	slippageBP.Quo(slippageBP, best).Sub(slippageBP, big.NewInt(10000))
+	if slippageBP.Cmp(big.NewInt(policy.MaxSlippageBP)) > 0 {
+		return cost.Int64(), fmt.Sprintf("conversion slippage of %s basis points exceeds the limit of %d", slippageBP, policy.MaxSlippageBP), nil
+	}
+	return cost.Int64(), "", nil
+}
+
+// checkPegOutConversion is checkConversion
+// for the peg-out of tranches of asset,
+// which converts to conv if it is not nil.
+// A converted payout cannot be split into tranches,
+// since the conversion is fixed in the first tranche's peg-out tx.
+func (c *Custodian) checkPegOutConversion(asset xdr.Asset, tranches []int64, conv *Conversion) (int64, string, error) {
+	if conv == nil {
+		return 0, "", nil
+	}
+	if len(tranches) != 1 {
+		return 0, fmt.Sprintf("conversion of a payout split into %d tranches", len(tranches)), nil
+	}
+	return c.checkConversion(asset, tranches[0], *conv)
+}
+
+// priceOf returns the cost of amount at price n/d, rounded up.
+func priceOf(amount int64, n, d int32) *big.Int {
+	cost := new(big.Int).Mul(big.NewInt(amount), big.NewInt(int64(n)))
+	cost.Add(cost, big.NewInt(int64(d)-1))
+	return cost.Quo(cost, big.NewInt(int64(d)))
+}
+
+// equatorAsset returns asset as Horizon represents it.
+func equatorAsset(asset xdr.Asset) (equator.Asset, error) {
+	var a equator.Asset
+	err := asset.Extract(&a.Type, &a.Code, &a.Issuer)
+	return a, errors.Wrapf(err, "extracting asset %s", asset.String())
+}
+
+// buildAsset returns asset as the Zioncoin tx builder represents it.
+func buildAsset(asset xdr.Asset) (b.Asset, error) {
+	var typ, code, issuer string
+	err := asset.Extract(&typ, &code, &issuer)
+	if err != nil {
+		return b.Asset{}, errors.Wrapf(err, "extracting asset %s", asset.String())
+	}
+	if asset.Type == xdr.AssetTypeAssetTypeNative {
+		return b.NativeAsset(), nil
+	}
+	return b.CreditAsset(code, issuer), nil
+}
+
+// buildPathPaymentOp builds the path payment of conv
+// from the custodian's account to the exporter's,
+// spending at most sendMax of asset.
+func buildPathPaymentOp(custodianAddr, exporterAddr string, asset xdr.Asset, sendMax int64, conv Conversion) b.PaymentBuilder {
+	sendAsset, err := buildAsset(asset)
+	if err != nil {
+		return b.PaymentBuilder{Err: err}
+	}
+	destAsset, err := buildAsset(conv.Asset)
+	if err != nil {
+		return b.PaymentBuilder{Err: err}
+	}
+	// Amounts are in stroops, as in buildPaymentOp.
+	destAmount := xlm.Amount(conv.Amount).HorizonString()
+	var destMut interface{} = b.NativeAmount{Amount: destAmount}
+	if !destAsset.Native {
+		destMut = b.CreditAmount{Code: destAsset.Code, Issuer: destAsset.Issuer, Amount: destAmount}
+	}
+	return b.Payment(
+		b.SourceAccount{AddressOrSeed: custodianAddr},
+		b.Destination{AddressOrSeed: exporterAddr},
+		destMut,
+		b.PayWith(sendAsset, xlm.Amount(sendMax).HorizonString()),
+	)
+}
+
+// recordConversion records the conversion of export txid,
+// paid for with at most sendMax of asset at the quoted cost,
+// by Zioncoin tx zioncoinTx.
+func (c *Custodian) recordConversion(ctx context.Context, txid []byte, asset xdr.Asset, sendMax, cost int64, conv Conversion, zioncoinTx string) error {
+	assetXDR, err := asset.MarshalBinary()
+	if err != nil {
+		return errors.Wrap(err, "marshaling asset xdr")
+	}
+	convertXDR, err := conv.Asset.MarshalBinary()
+	if err != nil {
+		return errors.Wrap(err, "marshaling conversion asset xdr")
+	}
+	const q = `INSERT OR REPLACE INTO conversions (export_txid, send_asset_xdr, send_max, quoted_cost, dest_asset_xdr, dest_amount, zioncoin_tx, recorded_ms) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err = c.DB.ExecContext(ctx, q, txid, assetXDR, sendMax, cost, convertXDR, conv.Amount, zioncoinTx, int64(bc.Millis(time.Now())))
+	return errors.Wrapf(err, "recording conversion of export %x", txid)
+}
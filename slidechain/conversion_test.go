@@ -0,0 +1,159 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/xdr"
+)
+
+// insertTestConvertingExport is insertTestExport
+// for an export requesting conversion to conv.
+func insertTestConvertingExport(t *testing.T, db *sql.DB, txid, assetXDR []byte, amount int64, exporter string, conv Conversion) {
+	temp, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	convertXDR, err := conv.Asset.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var zero32 [32]byte
+	ref, err := json.Marshal(pegOut{
+		AssetXDR:        assetXDR,
+		TempAddr:        temp.Address(),
+		Seqnum:          1,
+		Exporter:        exporter,
+		Amount:          amount,
+		Anchor:          zero32[:],
+		Pubkey:          zero32[:],
+		ConvertAssetXDR: convertXDR,
+		ConvertAmount:   conv.Amount,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO exports (txid, pegout_json) VALUES ($1, $2)", txid, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPegOutConversion(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	usd := makeAsset(xdr.AssetTypeAssetTypeCreditAlphanum4, "USD", importTestAccountID)
+	policies := []ConversionPolicy{{From: usd.String(), To: "native", MaxSlippageBP: 100}}
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		usdXDR, err := usd.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counting := &fakeClient{ClientInterface: c.hclient}
+		// 300 stroops at 2 USD each, then more at 4.
+		counting.loadOrderBook = func(selling, buying equator.Asset, params ...interface{}) (equator.OrderBookSummary, error) {
+			return equator.OrderBookSummary{Asks: []equator.PriceLevel{
+				{PriceR: equator.Price{N: 2, D: 1}, Price: "2.0000000", Amount: "0.0000300"},
+				{PriceR: equator.Price{N: 4, D: 1}, Price: "4.0000000", Amount: "1.0000000"},
+			}}, nil
+		}
+		c.hclient = counting
+
+		var (
+			converted = []byte("converted")
+			slipped   = []byte("slipped")
+		)
+		// 200 stroops cost 400 at the best price.
+		insertTestConvertingExport(t, db, converted, usdXDR, 1000, exporter.Address(), Conversion{Asset: zioncoin.NativeAsset(), Amount: 200})
+		// 400 stroops cost 300*2 + 100*4 = 1000, 25% above the best price.
+		insertTestConvertingExport(t, db, slipped, usdXDR, 1000, exporter.Address(), Conversion{Asset: zioncoin.NativeAsset(), Amount: 400})
+
+		pegouts := make(chan pegOut)
+		go c.pegOutFromExports(ctx, pegouts)
+
+		states := make(map[string]pegOutState)
+		for len(states) < 2 {
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for peg-outs")
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			case p := <-pegouts:
+				states[string(p.TxID)] = p.State
+			}
+		}
+		if states[string(converted)] != pegOutOK {
+			t.Errorf("got converted export in state %d, want %d", states[string(converted)], pegOutOK)
+		}
+		if states[string(slipped)] != pegOutFail {
+			t.Errorf("got slipped export in state %d, want %d", states[string(slipped)], pegOutFail)
+		}
+
+		var (
+			sendMax, cost, destAmount int64
+			zioncoinTx                string
+		)
+		err = db.QueryRow("SELECT send_max, quoted_cost, dest_amount, zioncoin_tx FROM conversions WHERE export_txid=$1", converted).Scan(&sendMax, &cost, &destAmount, &zioncoinTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sendMax != 1000 || cost != 400 || destAmount != 200 || zioncoinTx == "" {
+			t.Errorf("got conversion with send max %d, cost %d, dest amount %d, tx %q; want 1000, 400, 200, and a tx", sendMax, cost, destAmount, zioncoinTx)
+		}
+		var n int
+		err = db.QueryRow("SELECT COUNT(*) FROM conversions WHERE export_txid=$1", slipped).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Error("got a conversion recorded for the refused export")
+		}
+		var reason string
+		err = db.QueryRow("SELECT reason FROM export_failures WHERE txid=$1", slipped).Scan(&reason)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(reason, "slippage") {
+			t.Errorf("got failure reason %q, want one mentioning slippage", reason)
+		}
+
+		// Only the converted export was submitted, as a path payment.
+		counting.mu.Lock()
+		txs := counting.txs
+		counting.mu.Unlock()
+		if len(txs) != 1 {
+			t.Fatalf("got %d submitted txs, want 1", len(txs))
+		}
+		var env xdr.TransactionEnvelope
+		err = xdr.SafeUnmarshalBase64(txs[0], &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found bool
+		for _, op := range env.Tx.Operations {
+			if op.Body.Type != xdr.OperationTypePathPayment {
+				continue
+			}
+			found = true
+			pp := op.Body.PathPaymentOp
+			if !pp.SendAsset.Equals(usd) || pp.SendMax != 1000 || pp.DestAsset.Type != xdr.AssetTypeAssetTypeNative || pp.DestAmount != 200 {
+				t.Errorf("got path payment of %d %s for at most %d %s, want 200 native for at most 1000 %s", pp.DestAmount, pp.DestAsset.String(), pp.SendMax, pp.SendAsset.String(), usd.String())
+			}
+		}
+		if !found {
+			t.Error("got no path payment in the peg-out tx")
+		}
+	}, Conversions(policies))
+}
@@ -0,0 +1,181 @@
+package slidechain
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interzioncoin/slingshot/slidechain/net"
+)
+
+// errCursorRewind is the root of the error from SetCursor
+// for a cursor behind the current one.
+var errCursorRewind = errors.New("cursor would move backward")
+
+// errBadCursor is the root of the error from SetCursor and RewindCursor
+// for a cursor that is not a position in the equator server's history.
+var errBadCursor = errors.New("bad cursor")
+
+// GetCursor returns the Horizon paging token
+// from which the custodian resumes streaming peg-ins:
+// the cursor stored in the db,
+// or, before one is stored, the start cursor (see StartCursor).
+func (c *Custodian) GetCursor(ctx context.Context) (string, error) {
+	cur, err := c.pegInCursor(ctx)
+	return string(cur), err
+}
+
+// SetCursor moves the peg-in cursor forward to cursor,
+// a Horizon paging token,
+// e.g. to skip a Zioncoin tx the custodian cannot process.
+// Peg-in payments before cursor not yet recorded are never recorded.
+// The peg-in stream restarts from the new cursor.
+// SetCursor refuses to move the cursor backward,
+// with an error whose root is errCursorRewind;
+// for that, use RewindCursor.
+func (c *Custodian) SetCursor(ctx context.Context, cursor string) error {
+	return c.setCursor(ctx, cursor, false)
+}
+
+// RewindCursor is like SetCursor,
+// but may also move the cursor backward,
+// e.g. after the equator server's history is rebuilt.
+// The peg-in payments after cursor are then seen again:
+// those already recorded are flagged as duplicates (see flagPegIn),
+// and are not imported twice.
+func (c *Custodian) RewindCursor(ctx context.Context, cursor string) error {
+	return c.setCursor(ctx, cursor, true)
+}
+
+func (c *Custodian) setCursor(ctx context.Context, cursor string, force bool) error {
+	reason, err := c.cursorProblem(cursor)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		return errors.Wrapf(errBadCursor, "cursor %q %s", cursor, reason)
+	}
+
+	// No peg-in is recorded, moving the cursor, meanwhile.
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+
+	cur, err := c.GetCursor(ctx)
+	if err != nil {
+		return err
+	}
+	if !force {
+		// A start cursor of "now" is behind every paging token.
+		if n, err := strconv.ParseInt(cur, 10, 64); err == nil {
+			if m, _ := strconv.ParseInt(cursor, 10, 64); m < n {
+				return errors.Wrapf(errCursorRewind, "from %s to %s", cur, cursor)
+			}
+		}
+	}
+	_, err = c.DB.ExecContext(ctx, `UPDATE custodian SET cursor=$1 WHERE label=$2`, cursor, c.label)
+	if err != nil {
+		return errors.Wrap(err, "setting cursor")
+	}
+	log.Printf("moved peg-in cursor from %q to %q", cur, cursor)
+
+	// Peg-ins from the stream at the old cursor are no longer recorded,
+	// and the stream restarts at the new one (see watchPegIns).
+	c.cursorGen++
+	if c.stopStream != nil {
+		c.stopStream()
+	}
+	return nil
+}
+
+// cursorProblem returns the reason cur cannot be a position
+// in the equator server's history, if it cannot.
+// It returns an error only when the check itself fails.
+func (c *Custodian) cursorProblem(cur string) (string, error) {
+	n, err := strconv.ParseInt(cur, 10, 64)
+	if err != nil || n < 0 {
+		return "is not a paging token", nil
+	}
+	root, err := c.hclient.Root()
+	if err != nil {
+		return "", errors.Wrap(err, "getting equator root")
+	}
+	// A zero ledger means the server did not report one.
+	if ledger := int32(n >> 32); root.HorizonSequence > 0 && ledger > root.HorizonSequence {
+		return fmt.Sprintf("is at ledger %d, beyond the equator server's latest ledger %d", ledger, root.HorizonSequence), nil
+	}
+	return "", nil
+}
+
+// AdminToken requires the bearer token token
+// in the Authorization header of requests to the custodian's admin endpoints,
+// such as CursorHandler.
+// Without it, they refuse every request.
+func AdminToken(token []byte) Option {
+	return func(c *Custodian) {
+		c.adminToken = token
+	}
+}
+
+// authorizeAdmin reports whether req bears the custodian's admin token
+// (see AdminToken).
+// If not, it responds to req with an error.
+func (c *Custodian) authorizeAdmin(w http.ResponseWriter, req *http.Request) bool {
+	if len(c.adminToken) == 0 {
+		net.Errorf(w, http.StatusForbidden, "admin endpoints are disabled without an admin token")
+		return false
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), c.adminToken) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		net.Errorf(w, http.StatusUnauthorized, "missing or wrong admin token")
+		return false
+	}
+	return true
+}
+
+// CursorHandler, an admin endpoint (see AdminToken),
+// responds to a GET request with the peg-in cursor, as JSON,
+// and to a POST request by setting the cursor
+// to the cursor form value (see SetCursor),
+// or, if the force form value is true, rewinding it (see RewindCursor).
+func (c *Custodian) CursorHandler(w http.ResponseWriter, req *http.Request) {
+	if !c.authorizeAdmin(w, req) {
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		cur, err := c.GetCursor(req.Context())
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(struct {
+			Cursor string `json:"cursor"`
+		}{cur})
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+		}
+	case http.MethodPost:
+		force, _ := strconv.ParseBool(req.FormValue("force"))
+		err := c.setCursor(req.Context(), req.FormValue("cursor"), force)
+		switch errors.Root(err) {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errBadCursor:
+			net.Errorf(w, http.StatusBadRequest, "%s", err)
+		case errCursorRewind:
+			net.Errorf(w, http.StatusConflict, "%s (set force=true to rewind)", err)
+		default:
+			net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		}
+	default:
+		net.Errorf(w, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+	}
+}
@@ -0,0 +1,143 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/errors"
+)
+
+// Paging tokens in ledger 1.
+const (
+	testCursor1 = "4294967297"
+	testCursor2 = "4294967298"
+)
+
+func TestSetCursor(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		var stops int
+		c.stopStream = func() { stops++ }
+
+		for _, bad := range []string{"", "now", "-1", "cursor"} {
+			err := c.RewindCursor(ctx, bad)
+			if errors.Root(err) != errBadCursor {
+				t.Errorf("got error %v setting cursor %q, want %v", err, bad, errBadCursor)
+			}
+		}
+
+		// Forward moves are allowed.
+		for _, cur := range []string{testCursor1, testCursor1, testCursor2} {
+			err := c.SetCursor(ctx, cur)
+			if err != nil {
+				t.Fatalf("setting cursor %s: %s", cur, err)
+			}
+		}
+		// Backward moves must be forced.
+		err := c.SetCursor(ctx, testCursor1)
+		if errors.Root(err) != errCursorRewind {
+			t.Errorf("got error %v moving cursor backward, want %v", err, errCursorRewind)
+		}
+		cur, err := c.GetCursor(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cur != testCursor2 {
+			t.Errorf("got cursor %s after refused rewind, want %s", cur, testCursor2)
+		}
+		err = c.RewindCursor(ctx, testCursor1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur, err = c.GetCursor(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cur != testCursor1 {
+			t.Errorf("got cursor %s after forced rewind, want %s", cur, testCursor1)
+		}
+		if stops != 4 {
+			t.Errorf("got %d stops of the peg-in stream, want one per move (4)", stops)
+		}
+
+		// Peg-ins from the stream at the old cursor no longer move it.
+		err = c.recordPegIn(ctx, "txid", testCursor2, make([]byte, 32), "source", 10, []byte("asset"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur, err = c.GetCursor(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cur != testCursor1 {
+			t.Errorf("got cursor %s after peg-in from a stopped stream, want %s", cur, testCursor1)
+		}
+	})
+}
+
+func TestCursorHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	const token = "secret"
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		do := func(method, auth string, form url.Values) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, "/cursor", strings.NewReader(form.Encode())).WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if auth != "" {
+				req.Header.Set("Authorization", "Bearer "+auth)
+			}
+			w := httptest.NewRecorder()
+			c.CursorHandler(w, req)
+			return w
+		}
+
+		if w := do("GET", "", nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("got status %d without a token, want %d", w.Code, http.StatusUnauthorized)
+		}
+		if w := do("GET", "wrong", nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("got status %d with the wrong token, want %d", w.Code, http.StatusUnauthorized)
+		}
+		if w := do("POST", token, url.Values{"cursor": {testCursor2}}); w.Code != http.StatusNoContent {
+			t.Fatalf("got status %d setting cursor: %s", w.Code, w.Body.String())
+		}
+		if w := do("POST", token, url.Values{"cursor": {testCursor1}}); w.Code != http.StatusConflict {
+			t.Errorf("got status %d rewinding cursor without force, want %d", w.Code, http.StatusConflict)
+		}
+		if w := do("POST", token, url.Values{"cursor": {testCursor1}, "force": {"true"}}); w.Code != http.StatusNoContent {
+			t.Fatalf("got status %d rewinding cursor with force: %s", w.Code, w.Body.String())
+		}
+		w := do("GET", token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d getting cursor: %s", w.Code, w.Body.String())
+		}
+		var got struct {
+			Cursor string `json:"cursor"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Cursor != testCursor1 {
+			t.Errorf("got cursor %s, want %s", got.Cursor, testCursor1)
+		}
+	}, AdminToken([]byte(token)))
+
+	// Without a token, the endpoint is disabled.
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		w := httptest.NewRecorder()
+		c.CursorHandler(w, httptest.NewRequest("GET", "/cursor", nil).WithContext(ctx))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("got status %d without an admin token configured, want %d", w.Code, http.StatusForbidden)
+		}
+	})
+}
@@ -5,9 +5,9 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,6 +19,7 @@ import (
 	"github.com/chain/txvm/protocol/bc"
 	"github.com/interzioncoin/slingshot/slidechain/net"
 	"github.com/interzioncoin/slingshot/slidechain/store"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
 	"github.com/zioncoin/go/clients/equator"
 	"github.com/zioncoin/go/keypair"
 	"github.com/zioncoin/go/xdr"
@@ -42,26 +43,352 @@ type Custodian struct {
 	network string
 	privkey ed25519.PrivateKey
 
+	health health
+
+	// paused is non-zero while peg-outs are paused.
+	// Access it atomically.
+	paused int32
+
+	// fees holds the peg-out fee policy for each asset, keyed by asset string.
+	fees map[string]FeePolicy
+
+	// auditMode causes the custodian to witness its peg-outs
+	// in the witness log (see AuditMode).
+	auditMode bool
+
+	// conversions holds the permitted peg-out conversions (see Conversions),
+	// keyed by conversionKey.
+	conversions map[string]ConversionPolicy
+
+	// startCursor is the Horizon cursor from which watchPegIns
+	// streams when no cursor has been stored yet.
+	startCursor equator.Cursor
+
+	// label distinguishes this custodian from others sharing its db.
+	label string
+
+	// webhook, if non-nil, is notified of settled peg-outs.
+	webhook *webhook
+
+	// recoveryLog is the path of the file recording peg-out states
+	// that could not be written to the db (see RecoveryLog).
+	recoveryLog string
+
+	ingestion ingestion
+
+	// protocol records the Zioncoin network's protocol version.
+	protocol protocolState
+
+	// rateLimits records Horizon's rate limiting of the custodian's requests,
+	// if its Horizon client was made by hclient.
+	rateLimits *rateLimitedHTTP
+
+	// maxIngestionLag is the number of ledgers by which Horizon may trail Core
+	// before the custodian is degraded (see MaxIngestionLag).
+	maxIngestionLag int32
+
+	// exportStateAttempts bounds the attempts to record a peg-out's state
+	// (see ExportStateAttempts).
+	exportStateAttempts int
+
+	// maxPegOutRetries bounds the retries of a peg-out tx
+	// (see MaxPegOutRetries).
+	maxPegOutRetries int
+
+	// pegOutRetryBackoff and pegOutRetryBackoffMax
+	// space the retries of a peg-out tx (see PegOutRetryBackoff).
+	pegOutRetryBackoff    time.Duration
+	pegOutRetryBackoffMax time.Duration
+
+	// maxPegOutBatch is the number of peg-out payments
+	// made from the custodian's account in one tx (see MaxPegOutBatch).
+	maxPegOutBatch int
+
+	// verifyExportSigs causes watchExports to re-verify
+	// the exporter's signature on each export (see VerifyExportSigs).
+	verifyExportSigs bool
+
+	// batchWrites causes watchExports and streamPegInTxs
+	// to batch their db writes (see BatchWrites).
+	batchWrites bool
+
+	// cursorMu serializes moving the peg-in cursor,
+	// by SetCursor or by recording peg-ins,
+	// and protects the fields below.
+	// cursorGen counts the moves by SetCursor,
+	// and streamGen is its value when the current peg-in stream started.
+	// stopStream, if set, stops the current peg-in stream.
+	cursorMu   sync.Mutex
+	cursorGen  int64
+	streamGen  int64
+	stopStream context.CancelFunc
+
+	// adminToken, if set, authorizes requests to admin endpoints
+	// (see AdminToken).
+	adminToken []byte
+
+	// recoverOnStart causes newCustodian to call Recover
+	// (see RecoverOnStart).
+	recoverOnStart bool
+
+	// sequencer numbers the txs from the custodian account
+	// (see CustodianSequencer).
+	sequencer Sequencer
+
+	// tracer, if set, starts the spans tracing exports (see Tracing).
+	tracer Tracer
+
+	// recoveryBatchSize is the number of exports Recover reads at a time
+	// (see RecoveryBatchSize).
+	recoveryBatchSize int
+
+	// verifyTempAccounts causes watchExports to check
+	// each export's temp account on the Zioncoin network (see VerifyTempAccounts).
+	verifyTempAccounts bool
+
+	// cosignPegOuts causes the custodian to build peg-out txs
+	// for temp accounts of which it is a signer (see CosignPegOuts).
+	cosignPegOuts bool
+
+	// baseReserve is the Zioncoin network's base reserve, in stroops
+	// (see BaseReserve).
+	baseReserve int64
+
+	// offlineSigning causes pegOutFromExports to prepare peg-out txs
+	// for signing offline rather than submit them (see OfflineSigning).
+	// offlineMu serializes the submission of offline-signed txs.
+	offlineSigning bool
+	offlineMu      sync.Mutex
+
+	// reconcileOnLedgers causes watchPegOuts to finish peg-outs
+	// once per closed ledger (see ReconcileOnLedgers).
+	// ledgerStreamUp is 1 while the ledger stream is delivering ledgers,
+	// and is accessed atomically.
+	reconcileOnLedgers bool
+	ledgerStreamUp     int32
+
+	// windowTimer wakes pegOutFromExports
+	// when the window of the next reversible export closes,
+	// or the backoff of the next retried peg-out elapses.
+	windowTimer *time.Timer
+
+	// trustlineRecheck is how often exports awaiting their exporters' trustlines
+	// are checked again, waking pegOutFromExports with trustlineTimer,
+	// and trustlineTimeout how long they may wait (see AwaitTrustlines).
+	trustlineRecheck time.Duration
+	trustlineTimeout time.Duration
+	trustlineTimer   *time.Timer
+
+	// accountCheckInterval is how often watchAccount checks the custodian account
+	// (see CheckAccount).
+	// accountSigners is its signing configuration at the first check,
+	// and accountHalted is set, atomically,
+	// while submissions are halted because of the account.
+	accountCheckInterval time.Duration
+	accountSigners       *accountSigners
+	accountHalted        int32
+
+	// asyncPegOuts causes peg-out txs to be submitted asynchronously
+	// (see AsyncPegOuts).
+	// asyncUnsupported is set, atomically,
+	// once the Horizon server reports that it cannot do so.
+	asyncPegOuts     bool
+	asyncUnsupported int32
+
+	// maxExportBacklog bounds the exports awaiting peg-out
+	// before watchExports defers recording more (see MaxExportBacklog).
+	maxExportBacklog int
+
+	// trancheInterval is the interval at which watchPegOuts
+	// pays the tranches of split peg-outs (see TrancheInterval).
+	trancheInterval time.Duration
+
+	// pegInSource selects the Horizon stream from which watchPegIns observes peg-ins.
+	pegInSource PegInSource
+
+	// pegInConfirmations is the number of ledgers to close
+	// after a peg-in payment's before it is imported
+	// (see PegInConfirmations).
+	pegInConfirmations int
+
+	// importWorkers is the number of imports built and submitted at once
+	// (see ImportWorkers).
+	importWorkers int
+
+	// orderImports causes the imports of each recipient
+	// to be done in arrival order (see OrderImportsByRecipient).
+	orderImports bool
+
+	// importBatch, if greater than 1, is the number of pegs imported at once
+	// in one txvm tx (see BatchImports),
+	// which is split if it exceeds importBatchRunlimit or importBatchBytes
+	// (by default, DefaultImportBatchRunlimit and DefaultImportBatchBytes).
+	importBatch         int
+	importBatchRunlimit int64
+	importBatchBytes    int
+
+	// importRefunds selects what becomes of the funds of pegs
+	// that can never be imported (see ImportRefunds).
+	importRefunds ImportRefundPolicy
+
+	// dbTimeout bounds each db statement of the peg-in and peg-out goroutines
+	// (see DBTimeout).
+	dbTimeout time.Duration
+
+	// pegInKeyWindow is how long DoPrePegIn remembers
+	// the idempotency keys of requests (see PegInKeyWindow).
+	pegInKeyWindow time.Duration
+
+	// observer causes the custodian to watch the account observedAddress
+	// without importing, pegging out, or submitting txs (see Observer).
+	observer        bool
+	observedAddress string
+
+	// verifyIssuers causes peg-ins of assets whose issuers
+	// keep the custodian from pegging them out to be flagged (see VerifyIssuers).
+	verifyIssuers bool
+	issuers       issuerCache
+
+	// exportDeadline is how long an export may go unsettled
+	// before it is escalated to stuckExportAlert (see ExportDeadline).
+	exportDeadline   time.Duration
+	stuckExportAlert func(StuckExport)
+
+	// exportPolicy, if set, checks each export before it is recorded
+	// (see ExportPolicy).
+	exportPolicy func(ProposedExport) error
+
+	// pegOutValidator, if set, checks each peg-out tx before it is submitted
+	// (see PegOutValidator).
+	pegOutValidator func(ProposedPegOut) error
+
+	// coldWallet, if set, is the account to which watchColdWallet sweeps
+	// balances above sweepThresholds (see ColdWallet).
+	coldWallet      string
+	sweepThresholds map[string]int64
+
+	// drainTimeout bounds how long Shutdown waits for in-flight peg-outs
+	// (see DrainTimeout).
+	// stop cancels the goroutines started by launch,
+	// and running counts those still running.
+	// draining is set, atomically, once Shutdown begins.
+	// inFlight is the txid of the export pegOutFromExports is pegging out,
+	// guarded by inFlightMu.
+	drainTimeout time.Duration
+	stop         context.CancelFunc
+	running      sync.WaitGroup
+	draining     int32
+	inFlightMu   sync.Mutex
+	inFlight     []byte
+
 	DB            *sql.DB
 	BS            *store.BlockStore
 	S             *submitter
 	InitBlockHash bc.Hash
 	AccountID     xdr.AccountId
+
+	// BaseFee is the base fee, in stroops per operation,
+	// of the custodian's Zioncoin txs (see BaseFee).
+	BaseFee int64
+}
+
+// Option configures optional Custodian behavior.
+type Option func(*Custodian)
+
+// StartCursor causes the custodian to stream peg-in transactions
+// from the given Horizon cursor on its first run.
+// It has no effect once a cursor has been stored in the db.
+func StartCursor(cur string) Option {
+	return func(c *Custodian) {
+		c.startCursor = equator.Cursor(cur)
+	}
+}
+
+// VerifyExportSigs causes the custodian to re-verify,
+// before recording an export, that the exporter's signature
+// in the export transaction validates against the pubkey in its reference data.
+// Block validation already enforces the signature;
+// this is a defense-in-depth check on the peg-out path.
+func VerifyExportSigs() Option {
+	return func(c *Custodian) {
+		c.verifyExportSigs = true
+	}
+}
+
+// PegInSource selects the Horizon stream from which a custodian observes peg-ins.
+type PegInSource string
+
+const (
+	// PegInsFromTxs streams the custodian account's transactions
+	// and parses their operations. It is the default.
+	PegInsFromTxs PegInSource = "transactions"
+
+	// PegInsFromPayments streams the custodian account's payments,
+	// which Horizon has already decomposed from their transactions.
+	PegInsFromPayments PegInSource = "payments"
+)
+
+// PegIns selects the Horizon stream from which the custodian observes peg-ins.
+// Both streams yield the same peg-ins and share the stored cursor.
+func PegIns(src PegInSource) Option {
+	return func(c *Custodian) {
+		c.pegInSource = src
+	}
+}
+
+// StartLedger causes the custodian to stream peg-in transactions
+// beginning with the given ledger on its first run,
+// e.g. the ledger in which the custodian account was created.
+// It has no effect once a cursor has been stored in the db.
+func StartLedger(ledger int32) Option {
+	// Horizon paging tokens place the ledger sequence in the high 32 bits.
+	return StartCursor(strconv.FormatInt(int64(ledger)<<32, 10))
+}
+
+// Label names the custodian,
+// distinguishing it in logs and status reports
+// from other custodians, possibly sharing the same db,
+// that serve different asset sets or networks.
+// Each label has its own custodian account, txvm chain, and pins;
+// the default is the empty label.
+func Label(label string) Option {
+	return func(c *Custodian) {
+		c.label = label
+	}
 }
 
 // GetCustodian returns a Custodian object, loading the preset
 // account ID and seed from the db if it exists, otherwise generating
 // a new keypair and funding the account.
-func GetCustodian(ctx context.Context, db *sql.DB, equatorURL string, blockInterval time.Duration) (*Custodian, error) {
-	c, err := newCustodian(ctx, db, hclient(equatorURL), blockInterval)
+func GetCustodian(ctx context.Context, db *sql.DB, equatorURL string, blockInterval time.Duration, opts ...Option) (*Custodian, error) {
+	return GetCustodianWithClient(ctx, db, hclient(equatorURL), blockInterval, opts...)
+}
+
+// GetCustodianWithClient is like GetCustodian,
+// but the custodian makes all its equator requests through hclient.
+// The status of a custodian made this way
+// reports no equator rate limits.
+func GetCustodianWithClient(ctx context.Context, db *sql.DB, hclient equator.ClientInterface, blockInterval time.Duration, opts ...Option) (*Custodian, error) {
+	c, err := newCustodian(ctx, db, hclient, blockInterval, opts...)
 	if err != nil {
 		return nil, err
 	}
-	c.launch(ctx)
+	c.start(ctx)
 	return c, nil
 }
 
-func newCustodian(ctx context.Context, db *sql.DB, hclient equator.ClientInterface, blockInterval time.Duration) (*Custodian, error) {
+// start checks the custodian's Zioncoin account and launches it.
+func (c *Custodian) start(ctx context.Context) {
+	// Missing trustlines are reported now rather than at peg-out time,
+	// but they do not prevent the custodian from running.
+	err := c.checkPegOutAssets(ctx)
+	if err != nil {
+		log.Printf("checking peg-out assets: %s", err)
+	}
+	c.launch(ctx)
+}
+
+func newCustodian(ctx context.Context, db *sql.DB, hclient equator.ClientInterface, blockInterval time.Duration, opts ...Option) (*Custodian, error) {
 	err := setSchema(db)
 	if err != nil {
 		return nil, errors.Wrap(err, "setting db schema")
@@ -72,13 +399,36 @@ func newCustodian(ctx context.Context, db *sql.DB, hclient equator.ClientInterfa
 		return nil, errors.Wrap(err, "getting equator client root")
 	}
 
-	custAccountID, seed, err := custodianAccount(ctx, db, hclient)
-	if err != nil {
-		return nil, errors.Wrap(err, "creating/fetching custodian account")
+	c := &Custodian{BaseFee: baseFee}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.BaseFee < minBaseFee {
+		return nil, fmt.Errorf("base fee %d is below the network minimum of %d", c.BaseFee, minBaseFee)
+	}
+	if hc, ok := hclient.(*equator.Client); ok {
+		c.rateLimits, _ = hc.HTTP.(*rateLimitedHTTP)
+	}
+
+	var (
+		custAccountID *xdr.AccountId
+		seed          string
+	)
+	if c.observer {
+		custAccountID, err = observedAccount(ctx, db, c.label, c.observedAddress)
+		if err != nil {
+			return nil, errors.Wrap(err, "fetching observed account")
+		}
+		hclient = observerClient{hclient}
+	} else {
+		custAccountID, seed, err = custodianAccount(ctx, db, hclient, c.label)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating/fetching custodian account")
+		}
 	}
 
 	heights := make(chan uint64)
-	bs, err := store.New(db, heights)
+	bs, err := store.NewLabeled(db, c.label, heights)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -97,31 +447,44 @@ func newCustodian(ctx context.Context, db *sql.DB, hclient equator.ClientInterfa
 		log.Fatal(err)
 	}
 
-	return &Custodian{
-		seed:      seed,
-		AccountID: *custAccountID,
-		S: &submitter{
-			w:             multichan.New((*bc.Block)(nil)),
-			chain:         chain,
-			initialBlock:  initialBlock,
-			blockInterval: blockInterval,
-		},
-		DB:            db,
-		BS:            bs,
-		hclient:       hclient,
-		imports:       sync.NewCond(new(sync.Mutex)),
-		exports:       sync.NewCond(new(sync.Mutex)),
-		network:       root.NetworkPassphrase,
-		privkey:       custodianPrv,
-		InitBlockHash: initialBlock.Hash(),
-	}, nil
-}
-
-func custodianAccount(ctx context.Context, db *sql.DB, hclient equator.ClientInterface) (*xdr.AccountId, string, error) {
+	c.seed = seed
+	c.AccountID = *custAccountID
+	c.S = &submitter{
+		w:             multichan.New((*bc.Block)(nil)),
+		chain:         chain,
+		initialBlock:  initialBlock,
+		blockInterval: blockInterval,
+		readOnly:      c.observer,
+	}
+	c.DB = db
+	c.BS = bs
+	c.hclient = hclient
+	c.imports = sync.NewCond(new(sync.Mutex))
+	c.exports = sync.NewCond(new(sync.Mutex))
+	c.network = root.NetworkPassphrase
+	c.observeProtocol(root.ProtocolVersion)
+	c.privkey = custodianPrv
+	c.InitBlockHash = initialBlock.Hash()
+	if c.sequencer == nil {
+		// Loaded with the custodian's current client.
+		c.sequencer = &sequencer{load: func(account string) (xdr.SequenceNumber, error) {
+			return c.hclient.SequenceForAccount(account)
+		}}
+	}
+	if c.recoverOnStart {
+		_, err = c.Recover(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "recovering custodian state")
+		}
+	}
+	return c, nil
+}
+
+func custodianAccount(ctx context.Context, db *sql.DB, hclient equator.ClientInterface, label string) (*xdr.AccountId, string, error) {
 	var seed string
-	err := db.QueryRow("SELECT seed FROM custodian").Scan(&seed)
+	err := db.QueryRow("SELECT seed FROM custodian WHERE label=$1", label).Scan(&seed)
 	if err == sql.ErrNoRows {
-		return makeNewCustodianAccount(ctx, db, hclient)
+		return makeNewCustodianAccount(ctx, db, hclient, label)
 	}
 	if err != nil {
 		return nil, "", errors.Wrap(err, "reading seed from db")
@@ -131,14 +494,14 @@ func custodianAccount(ctx context.Context, db *sql.DB, hclient equator.ClientInt
 	if err != nil {
 		return nil, "", errors.Wrap(err, "parsing keypair from seed")
 	}
-	log.Printf("using preexisting custodian account %s", kp.Address())
+	log.Printf("using preexisting custodian account %s (label %q)", kp.Address(), label)
 
 	var custAccountID xdr.AccountId
 	err = custAccountID.SetAddress(kp.Address())
 	return &custAccountID, seed, err
 }
 
-func makeNewCustodianAccount(ctx context.Context, db *sql.DB, hclient equator.ClientInterface) (*xdr.AccountId, string, error) {
+func makeNewCustodianAccount(ctx context.Context, db *sql.DB, hclient equator.ClientInterface, label string) (*xdr.AccountId, string, error) {
 	pair, err := keypair.Random()
 	if err != nil {
 		return nil, "", errors.Wrap(err, "generating new keypair")
@@ -147,19 +510,12 @@ func makeNewCustodianAccount(ctx context.Context, db *sql.DB, hclient equator.Cl
 	log.Printf("seed: %s", pair.Seed())
 	log.Printf("addr: %s", pair.Address())
 
-	resp, err := http.Get("https://friendbot.zion.info/?addr=" + pair.Address())
+	// Check the funded account through hclient,
+	// rather than the default testnet client.
+	err = zioncoin.Friendbot{HClient: hclient}.Fund(pair.Address())
 	if err != nil {
 		return nil, "", errors.Wrap(err, "requesting lumens through friendbot")
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, "", errors.Wrapf(err, "reading response from bad friendbot request %d", resp.StatusCode)
-		}
-		return nil, "", fmt.Errorf("error funding address through friendbot. got bad status code %d, response %s", resp.StatusCode, body)
-	}
 	log.Println("account successfully funded")
 
 	account, err := hclient.LoadAccount(pair.Address())
@@ -176,7 +532,7 @@ func makeNewCustodianAccount(ctx context.Context, db *sql.DB, hclient equator.Cl
 		}
 	}
 
-	_, err = db.Exec("INSERT INTO custodian (seed) VALUES ($1)", pair.Seed())
+	_, err = db.Exec("INSERT INTO custodian (seed, label) VALUES ($1, $2)", pair.Seed(), label)
 	if err != nil {
 		return nil, "", errors.Wrapf(err, "storing new custodian account")
 	}
@@ -198,13 +554,47 @@ func (c *Custodian) Account(w http.ResponseWriter, req *http.Request) {
 
 // launch kicks off the Custodian's long-running goroutines
 // that stream txs, import, and export.
+// In observer mode, only those that stream txs are launched.
+// Shutdown stops them.
 func (c *Custodian) launch(ctx context.Context) {
+	ctx, c.stop = context.WithCancel(ctx)
+	c.spawn(ctx, c.watchPegIns)
+	c.spawn(ctx, c.watchExports)
+	if c.pegInConfirmations > 0 {
+		c.spawn(ctx, c.confirmPegIns)
+	}
+	c.spawn(ctx, c.watchIngestion)
+	if c.observer {
+		return
+	}
 	pegouts := make(chan pegOut)
-	go c.watchPegIns(ctx)
-	go c.importFromPegIns(ctx, nil)
-	go c.watchExports(ctx)
-	go c.pegOutFromExports(ctx, pegouts)
-	go c.watchPegOuts(ctx, pegouts)
+	c.spawn(ctx, func(ctx context.Context) { c.importFromPegIns(ctx, nil) })
+	c.spawn(ctx, func(ctx context.Context) { c.pegOutFromExports(ctx, pegouts) })
+	c.spawn(ctx, func(ctx context.Context) { c.watchPegOuts(ctx, pegouts) })
+	if c.asyncPegOuts {
+		c.spawn(ctx, c.confirmPegOuts)
+	}
+	if c.accountCheckInterval > 0 {
+		c.spawn(ctx, c.watchAccount)
+	}
+	if c.webhook != nil {
+		c.spawn(ctx, c.deliverWebhooks)
+	}
+	if c.exportDeadline > 0 {
+		c.spawn(ctx, c.watchStuckExports)
+	}
+	if c.coldWallet != "" {
+		c.spawn(ctx, c.watchColdWallet)
+	}
+}
+
+// spawn runs f as a goroutine counted in c.running.
+func (c *Custodian) spawn(ctx context.Context, f func(context.Context)) {
+	c.running.Add(1)
+	go func() {
+		defer c.running.Done()
+		f(ctx)
+	}()
 }
 
 func mustDecodeHex(inp string) []byte {
@@ -216,13 +606,81 @@ func mustDecodeHex(inp string) []byte {
 }
 
 func setSchema(db *sql.DB) error {
+	// Dbs created before a table was scoped to its custodian have it unscoped.
+	// It is set aside, recreated by schema, and copied back.
+	for _, t := range scopedTables {
+		var exists, scoped bool
+		err := db.QueryRow("SELECT COUNT(*) > 0 FROM sqlite_master WHERE type='table' AND name=$1", t.table).Scan(&exists)
+		if err != nil {
+			return errors.Wrapf(err, "checking for table %s", t.table)
+		}
+		err = db.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info($1) WHERE name='custodian_id'", t.table).Scan(&scoped)
+		if err != nil {
+			return errors.Wrapf(err, "checking for column %s.custodian_id", t.table)
+		}
+		if exists && !scoped {
+			_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s RENAME TO %s_unscoped", t.table, t.table))
+			if err != nil {
+				return errors.Wrapf(err, "setting aside table %s", t.table)
+			}
+		}
+	}
 	_, err := db.Exec(schema)
-	return errors.Wrap(err, "creating db schema")
+	if err != nil {
+		return errors.Wrap(err, "creating db schema")
+	}
+	for _, t := range scopedTables {
+		err = copyUnscoped(db, t.table, t.columns)
+		if err != nil {
+			return err
+		}
+	}
+	// Dbs created before a column was added lack it.
+	for _, col := range addedColumns {
+		var exists bool
+		err = db.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info($1) WHERE name=$2", col.table, col.name).Scan(&exists)
+		if err != nil {
+			return errors.Wrapf(err, "checking for column %s.%s", col.table, col.name)
+		}
+		if !exists {
+			_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", col.table, col.name, col.def))
+			if err != nil {
+				return errors.Wrapf(err, "adding column %s.%s", col.table, col.name)
+			}
+		}
+	}
+	_, err = db.Exec(indexes)
+	return errors.Wrap(err, "creating db indexes")
+}
+
+// copyUnscoped copies the rows of table's unscoped predecessor, if any,
+// which has the given columns, into table, and drops it.
+func copyUnscoped(db *sql.DB, table, columns string) error {
+	var exists bool
+	err := db.QueryRow("SELECT COUNT(*) > 0 FROM sqlite_master WHERE type='table' AND name=$1", table+"_unscoped").Scan(&exists)
+	if err != nil || !exists {
+		return errors.Wrapf(err, "checking for table %s_unscoped", table)
+	}
+	dbtx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	_, err = dbtx.Exec(fmt.Sprintf("INSERT OR IGNORE INTO %s (%s) SELECT %s FROM %s_unscoped", table, columns, columns, table))
+	if err != nil {
+		return errors.Wrapf(err, "copying rows of table %s", table)
+	}
+	_, err = dbtx.Exec(fmt.Sprintf("DROP TABLE %s_unscoped", table))
+	if err != nil {
+		return errors.Wrapf(err, "dropping table %s_unscoped", table)
+	}
+	return errors.Wrapf(dbtx.Commit(), "scoping table %s", table)
 }
 
 func hclient(url string) *equator.Client {
 	return &equator.Client{
 		URL:  strings.TrimRight(url, "/"),
-		HTTP: new(http.Client),
+		HTTP: &rateLimitedHTTP{client: new(http.Client)},
 	}
 }
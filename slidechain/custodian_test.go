@@ -0,0 +1,455 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bobg/multichan"
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/txresult"
+	"github.com/interzioncoin/slingshot/slidechain/mockequator"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	b "github.com/zioncoin/go/build"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/network"
+	"github.com/zioncoin/go/xdr"
+)
+
+func TestCustodianLabels(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	testdir, err := ioutil.TempDir("", "slidechaintest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testdir)
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s/testdb", testdir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = setSchema(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := []string{"lumens", "credits"}
+	seeds := make(map[string]string)
+	for _, label := range labels {
+		kp, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("INSERT INTO custodian (seed, label) VALUES ($1, $2)", kp.Seed(), label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seeds[label] = kp.Seed()
+	}
+	kp, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO custodian (seed, label) VALUES ($1, $2)", kp.Seed(), labels[0])
+	if err == nil {
+		t.Errorf("inserted a second custodian with label %q", labels[0])
+	}
+
+	custodians := make(map[string]*Custodian)
+	for i, label := range labels {
+		c, err := newCustodian(ctx, db, mockequator.New(), DefaultBlockInterval, Label(label), StartCursor(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.seed != seeds[label] {
+			t.Errorf("custodian %q got seed %s, want %s", label, c.seed, seeds[label])
+		}
+		custodians[label] = c
+	}
+
+	// Storing one custodian's peg-in cursor must not change the other's.
+	_, err = db.Exec("UPDATE custodian SET cursor=$1 WHERE seed=$2", "67890", custodians[labels[0]].seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, label := range labels {
+		want := fmt.Sprint(i)
+		if i == 0 {
+			want = "67890"
+		}
+		cur, err := custodians[label].pegInCursor(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(cur) != want {
+			t.Errorf("custodian %q got cursor %q, want %q", label, cur, want)
+		}
+	}
+
+	// One custodian's pending imports and exports are not visible to the other.
+	lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO pegs (nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms, zioncoin_tx, custodian_id) VALUES ($1, 1, $2, $3, 1, 1, $4)", []byte("lumens peg"), lumenXDR, testRecipPubKey, labels[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertTestExport(t, db, []byte("lumens export"), lumenXDR, 100, exporter.Address())
+	_, err = db.Exec("UPDATE exports SET custodian_id=$1 WHERE txid=$2", labels[0], []byte("lumens export"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, label := range labels {
+		want := 1 - i
+		pending, err := custodians[label].pendingImports(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != want {
+			t.Errorf("custodian %q has %d pending imports, want %d", label, len(pending), want)
+		}
+		var s Status
+		err = custodians[label].pegStatus(ctx, &s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.PegIns.AwaitingImport != want || s.Exports.Pending != want {
+			t.Errorf("custodian %q has %d peg-ins awaiting import and %d pending exports, want %d of each", label, s.PegIns.AwaitingImport, s.Exports.Pending, want)
+		}
+	}
+	err = custodians[labels[1]].CancelExport(ctx, ExportCancellation{ExportTxID: []byte("lumens export")})
+	if err == nil || !strings.Contains(err.Error(), "no pending export") {
+		t.Errorf("got error %v canceling custodian %q's export from %q, want no pending export", err, labels[0], labels[1])
+	}
+
+	// Reopening a custodian by label finds the same account.
+	c, err := newCustodian(ctx, db, mockequator.New(), DefaultBlockInterval, Label(labels[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AccountID.Address() != custodians[labels[1]].AccountID.Address() {
+		t.Errorf("reopened custodian %q got account %s, want %s", labels[1], c.AccountID.Address(), custodians[labels[1]].AccountID.Address())
+	}
+}
+
+func TestCustodianLabelMigration(t *testing.T) {
+	testdir, err := ioutil.TempDir("", "slidechaintest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testdir)
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s/testdb", testdir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The custodian table as created before labels existed.
+	_, err = db.Exec("CREATE TABLE custodian (seed TEXT NOT NULL PRIMARY KEY, cursor TEXT NOT NULL DEFAULT '')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO custodian (seed) VALUES ('seed')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// And the pins table as created before pins were scoped to their custodian.
+	_, err = db.Exec("CREATE TABLE pins (name TEXT NOT NULL PRIMARY KEY, height INTEGER NOT NULL DEFAULT 0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO pins (name, height) VALUES ('watchExports', 7)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setSchema(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seed string
+	err = db.QueryRow("SELECT seed FROM custodian WHERE label=''").Scan(&seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seed != "seed" {
+		t.Errorf("got seed %q for the default label, want %q", seed, "seed")
+	}
+	var height int
+	err = db.QueryRow("SELECT height FROM pins WHERE custodian_id='' AND name='watchExports'").Scan(&height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 7 {
+		t.Errorf("got height %d for the default label's pin, want 7", height)
+	}
+	// Setting the schema again leaves the scoped table alone.
+	err = setSchema(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharedDB(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	testdir, err := ioutil.TempDir("", "slidechaintest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testdir)
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s/testdb", testdir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = setSchema(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two custodians share the db and the equator server.
+	hclient := &fakeClient{ClientInterface: mockequator.New()}
+	labels := []string{"lumens", "credits"}
+	custodians := make(map[string]*Custodian)
+	for _, label := range labels {
+		kp, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("INSERT INTO custodian (seed, label) VALUES ($1, $2)", kp.Seed(), label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := newCustodian(ctx, db, hclient, 100*time.Millisecond, Label(label))
+		if err != nil {
+			t.Fatal(err)
+		}
+		custodians[label] = c
+	}
+	lumens, credits := custodians["lumens"], custodians["credits"]
+
+	// Each custodian has an exporter with a peg awaiting payment.
+	const amount = 100000000 // 10 lumens
+	native := zioncoin.NativeAsset()
+	lumenXDR, err := native.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type exporter struct {
+		kp        *keypair.Full
+		pub       ed25519.PublicKey
+		prv       ed25519.PrivateKey
+		nonceHash [32]byte
+	}
+	exporters := make(map[string]*exporter)
+	for i, label := range labels {
+		c := custodians[label]
+		pub, prv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var seed [32]byte
+		copy(seed[:], prv)
+		kp, err := keypair.FromRawSeed(seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expMS := int64(bc.Millis(time.Now().Add(10*time.Minute))) + int64(i)
+		prepegTx, err := buildPrePegInTx(c.InitBlockHash.Bytes(), lumenXDR, pub, amount, expMS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := c.S.w.Reader()
+		_, err = c.S.submitTx(ctx, prepegTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.S.waitOnTx(ctx, prepegTx.ID, r)
+		r.Dispose()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
+		err = c.insertPegIn(ctx, nonceHash[:], pub, expMS, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exporters[label] = &exporter{kp: kp, pub: pub, prv: prv, nonceHash: nonceHash}
+	}
+
+	// The lumens custodian is paid with the credits custodian's memo,
+	// which it must not consume, before each is paid with its own.
+	pay := func(payer *keypair.Full, seq uint64, c *Custodian, nonceHash [32]byte) {
+		tx, err := b.Transaction(
+			b.Network{Passphrase: network.TestNetworkPassphrase},
+			b.SourceAccount{AddressOrSeed: payer.Address()},
+			b.Sequence{Sequence: seq},
+			b.MemoHash{Value: xdr.Hash(nonceHash)},
+			b.Payment(
+				b.Destination{AddressOrSeed: c.AccountID.Address()},
+				b.NativeAmount{Amount: "10"},
+			),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = zioncoin.SignAndSubmitTx(hclient, tx, payer.Seed())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stray, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pay(stray, 1, lumens, exporters["credits"].nonceHash)
+	pay(exporters["lumens"].kp, 1, lumens, exporters["lumens"].nonceHash)
+	pay(exporters["credits"].kp, 1, credits, exporters["credits"].nonceHash)
+
+	// Both custodians run in full: block building, imports, exports, and pins.
+	readers := make(map[string]*multichan.R)
+	for _, label := range labels {
+		readers[label] = custodians[label].S.w.Reader()
+		defer readers[label].Dispose()
+	}
+	for _, c := range custodians {
+		c.launch(ctx)
+	}
+	defer func() {
+		// Stop the custodians and let their pending blocks commit
+		// before the db is closed.
+		for _, c := range custodians {
+			c.stop()
+			c.running.Wait()
+		}
+		for _, c := range custodians {
+			for {
+				c.S.bbmu.Lock()
+				idle := c.S.bb == nil
+				c.S.bbmu.Unlock()
+				if idle {
+					break
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+	}()
+
+	// Each custodian imports its own peg on its own chain,
+	// and exports it back out.
+	for _, label := range labels {
+		c, e := custodians[label], exporters[label]
+		var anchor []byte
+		for anchor == nil {
+			got, ok := readers[label].Read(ctx)
+			if !ok {
+				t.Fatalf("timed out waiting for custodian %q to import", label)
+			}
+			for _, tx := range got.(*bc.Block).Transactions {
+				if isImportTx(tx, amount, lumenXDR, e.pub) {
+					anchor = txresult.New(tx).Outputs[0].Value.Anchor
+				}
+			}
+		}
+		tempAddr, seqnum, err := SubmitPreExportTx(hclient, e.kp, c.AccountID.Address(), native, amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exportTx, err := BuildExportTx(ctx, native, amount, amount, tempAddr, anchor, e.prv, seqnum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.S.submitTx(ctx, exportTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for finished := 0; finished < len(labels); {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for peg-outs (%d finished)", finished)
+		case <-time.After(100 * time.Millisecond):
+		}
+		events, err := lumens.ReadEvents(ctx, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		finished = 0
+		for _, ev := range events {
+			if ev.Type == EventExportFinished && ev.State == pegOutOK {
+				finished++
+			}
+		}
+	}
+
+	var reason string
+	creditsHash := exporters["credits"].nonceHash
+	err = db.QueryRow("SELECT reason FROM flagged_pegs WHERE nonce_hash=$1", creditsHash[:]).Scan(&reason)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason != "unknown" {
+		t.Errorf("lumens custodian flagged the credits custodian's peg as %q, want %q", reason, "unknown")
+	}
+	for _, label := range labels {
+		e := exporters[label]
+		var (
+			nonceHash []byte
+			pegs      int
+		)
+		err = db.QueryRow("SELECT COUNT(*), MAX(nonce_hash) FROM pegs WHERE custodian_id=$1 AND imported=1", label).Scan(&pegs, &nonceHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pegs != 1 || !bytes.Equal(nonceHash, e.nonceHash[:]) {
+			t.Errorf("custodian %q imported %d pegs (last %x), want only its own %x", label, pegs, nonceHash, e.nonceHash[:])
+		}
+		var height int
+		err = db.QueryRow("SELECT height FROM pins WHERE custodian_id=$1 AND name='watchExports'", label).Scan(&height)
+		if err != nil {
+			t.Fatalf("getting custodian %q's watchExports pin: %s", label, err)
+		}
+		if height < 3 {
+			t.Errorf("custodian %q's watchExports pin is at block %d, want at least 3", label, height)
+		}
+	}
+
+	// Each exporter is paid once, by its own custodian.
+	payers := make(map[string][]string)
+	hclient.mu.Lock()
+	for _, txe := range hclient.txs {
+		var env xdr.TransactionEnvelope
+		err = xdr.SafeUnmarshalBase64(txe, &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range env.Tx.Operations {
+			if op.Body.PaymentOp != nil && op.SourceAccount != nil {
+				dest := op.Body.PaymentOp.Destination.Address()
+				payers[dest] = append(payers[dest], op.SourceAccount.Address())
+			}
+		}
+	}
+	hclient.mu.Unlock()
+	for _, label := range labels {
+		got := payers[exporters[label].kp.Address()]
+		if len(got) != 1 || got[0] != custodians[label].AccountID.Address() {
+			t.Errorf("custodian %q's exporter was paid by %v, want only by %s", label, got, custodians[label].AccountID.Address())
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	i10rnet "github.com/interzioncoin/starlight/net"
+)
+
+// DefaultDBTimeout is the default bound on each db statement
+// executed by the custodian's peg-in and peg-out goroutines.
+const DefaultDBTimeout = 10 * time.Second
+
+const maxDBRetryWait = 10 * time.Second
+
+// DBTimeout bounds each db statement executed by the custodian's
+// peg-in and peg-out goroutines (by default, DefaultDBTimeout).
+// A statement that runs longer fails and is retried with backoff,
+// so a slow or locked db delays the custodian instead of wedging it.
+// A negative value disables the bound.
+func DBTimeout(d time.Duration) Option {
+	return func(c *Custodian) {
+		c.dbTimeout = d
+	}
+}
+
+// dbContext returns a child of ctx whose deadline bounds a single db statement.
+func (c *Custodian) dbContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	d := c.dbTimeout
+	if d == 0 {
+		d = DefaultDBTimeout
+	}
+	if d < 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// retryDB calls f with a context from dbContext,
+// retrying with backoff until f succeeds or ctx is canceled,
+// in which case it returns ctx.Err().
+// It returns at once an error that no retry can fix,
+// from a closed db (see isDBClosed).
+// The custodian reports itself unhealthy while f is failing.
+func (c *Custodian) retryDB(ctx context.Context, what string, f func(context.Context) error) error {
+	backoff := i10rnet.Backoff{Base: 100 * time.Millisecond}
+	for {
+		dbctx, cancel := c.dbContext(ctx)
+		err := f(dbctx)
+		cancel()
+		if err == nil {
+			c.health.setHealthy("db")
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = errors.Wrap(err, what)
+		c.health.setUnhealthy("db", err)
+		if isDBClosed(err) {
+			return err
+		}
+		log.Printf("%s, retrying...", err)
+		wait := backoff.Next()
+		if wait > maxDBRetryWait {
+			wait = maxDBRetryWait
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// isDBClosed reports whether err is from a closed db or connection.
+// database/sql does not export the error of a closed db,
+// so it is matched by its message.
+func isDBClosed(err error) bool {
+	return err != nil && (errors.Root(err) == sql.ErrConnDone || strings.Contains(err.Error(), "sql: database is closed"))
+}
+
+// supervise runs f, which does the work of a long-running goroutine,
+// until ctx is done.
+// When f returns an error that a restart may fix,
+// supervise logs it and runs f again after a backoff.
+// When the db is closed (see isDBClosed),
+// supervise gives up and reports the custodian unhealthy.
+func (c *Custodian) supervise(ctx context.Context, what string, f func(context.Context) error) {
+	backoff := i10rnet.Backoff{Base: time.Second}
+	for {
+		err := f(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			// f stops without error only when ctx is done.
+			err = errors.New("stopped unexpectedly")
+		}
+		err = errors.Wrap(err, what)
+		if isDBClosed(err) {
+			log.Printf("%s, giving up", err)
+			c.health.setUnhealthy(what, err)
+			return
+		}
+		wait := backoff.Next()
+		if wait > maxDBRetryWait {
+			wait = maxDBRetryWait
+		}
+		log.Printf("%s, restarting in %s", err, wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestDBTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	const timeout = 200 * time.Millisecond
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		txid := []byte("export")
+		insertTestExport(t, db, txid, lumenXDR, 100, exporter.Address())
+
+		// Make every update of the exports table take far longer than the timeout,
+		// counting the rows of a billion-row join.
+		_, err = db.Exec(`CREATE TABLE big (n INTEGER)`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`WITH RECURSIVE seq(n) AS (SELECT 1 UNION ALL SELECT n+1 FROM seq WHERE n < 1000) INSERT INTO big SELECT n FROM seq`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`CREATE TRIGGER slow BEFORE UPDATE ON exports BEGIN SELECT COUNT(*) FROM big a, big b, big c; END`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		err = c.updateExportState(ctx, txid, 0, pegOutOK, "zioncointx")
+		if err == nil {
+			t.Fatal("got no error from slow update")
+		}
+		if elapsed := time.Since(start); elapsed > 10*timeout {
+			t.Errorf("slow update failed after %s, want about %s", elapsed, timeout)
+		}
+
+		// A retried update succeeds once the db is no longer slow.
+		go func() {
+			time.Sleep(2 * timeout)
+			_, err := db.Exec(`DROP TRIGGER slow`)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+		err = c.retryDB(ctx, "updating export", func(ctx context.Context) error {
+			return c.updateExportState(ctx, txid, 0, pegOutOK, "zioncointx")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var state pegOutState
+		err = db.QueryRow("SELECT pegged_out FROM exports WHERE txid=$1", txid).Scan(&state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != pegOutOK {
+			t.Errorf("got export state %d after retried update, want %d", state, pegOutOK)
+		}
+	}, DBTimeout(timeout))
+}
+
+func TestSupervise(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		// A recoverable error restarts f.
+		var runs int
+		c.supervise(ctx, "testing", func(ctx context.Context) error {
+			runs++
+			if runs < 2 {
+				return errors.New("transient")
+			}
+			// Closing the db ends supervision.
+			err := db.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c.retryDB(ctx, "querying", func(ctx context.Context) error {
+				_, err := db.ExecContext(ctx, "SELECT 1")
+				return err
+			})
+		})
+		if runs != 2 {
+			t.Errorf("got %d runs, want 2", runs)
+		}
+		if problems := c.health.problems(); len(problems) == 0 {
+			t.Error("custodian healthy after giving up on a closed db")
+		}
+	})
+}
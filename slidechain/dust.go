@@ -0,0 +1,364 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/zioncoin/go/xdr"
+)
+
+// An export of less than an asset's FeePolicy.DustThreshold is dust:
+// too small to be worth its own peg-out tx.
+// If the policy rejects dust, the export fails and is refunded on slidechain.
+// If it holds dust (FeePolicy.HoldDust),
+// the export is put in state pegOutDust
+// until the held dust of the same asset for the same exporter
+// adds up to the threshold.
+// settleDust then pays the total, net of a single fee,
+// in one payment from the custodian's account,
+// batched with those of other exporters and assets (see MaxPegOutBatch),
+// and marks the held exports pegged out,
+// or failed, to be refunded on slidechain, if the payment's tx fails.
+// Their preauthorized peg-out txs are never submitted,
+// so their exporters reclaim the temp accounts with CancelPreExport.
+
+// isDust reports whether an export of amount is dust under p.
+func (p FeePolicy) isDust(amount int64) bool {
+	return p.DustThreshold > 0 && amount < p.DustThreshold
+}
+
+// DustExport describes an export held as dust (see FeePolicy.HoldDust).
+type DustExport struct {
+	TxID     string `json:"txid"`
+	Exporter string `json:"exporter"`
+	Asset    string `json:"asset"`
+	AssetXDR []byte `json:"asset_xdr"`
+	Amount   int64  `json:"amount"`
+}
+
+// heldDust returns the exports held as dust, for Status.
+func (c *Custodian) heldDust(ctx context.Context) ([]DustExport, error) {
+	var held []DustExport
+	const q = `SELECT txid, pegout_json FROM exports WHERE pegged_out=$1 AND custodian_id=$2 ORDER BY txid`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, pegOutDust, c.label, func(txid, ref []byte) error {
+		var p pegOut
+		err := decodeRefdata(ref, &p)
+		if err != nil {
+			return errors.Wrapf(err, "unmarshaling refdata of export %x", txid)
+		}
+		d := DustExport{
+			TxID:     hex.EncodeToString(txid),
+			Exporter: p.Exporter,
+			AssetXDR: p.AssetXDR,
+			Amount:   p.Amount,
+		}
+		var asset xdr.Asset
+		if xdr.SafeUnmarshal(p.AssetXDR, &asset) == nil {
+			d.Asset = asset.String()
+		}
+		held = append(held, d)
+		return nil
+	})
+	return held, errors.Wrap(err, "reading exports held as dust")
+}
+
+// dustBatch is the held dust of one asset for one exporter.
+type dustBatch struct {
+	exporter string
+	assetXDR []byte
+	exports  []pegOut // with TxID and Version set
+	total    int64
+
+	// asset, payout, and fee are set for a batch
+	// that has reached its dust threshold (see readyDustBatch).
+	asset       xdr.Asset
+	payout, fee int64
+
+	// zioncoinTx is the hash of the payment submitted for the batch, if any.
+	zioncoinTx string
+}
+
+// settleDust pays out each batch of held dust that has reached its threshold,
+// up to MaxPegOutBatch batches in each Zioncoin tx,
+// sending the exports it pegs out to pegouts.
+// A batch whose payment was submitted but not recorded,
+// e.g. because of a crash,
+// is marked pegged out if the payment is on the Zioncoin network,
+// and is otherwise held again.
+// It returns an error only if ctx is canceled.
+func (c *Custodian) settleDust(ctx context.Context, pegouts chan<- pegOut) error {
+	const q = `SELECT txid, pegout_json, version, zioncoin_tx FROM exports WHERE pegged_out=$1 AND custodian_id=$2 ORDER BY recorded_ms, txid`
+	var batches []*dustBatch
+	err := c.retryDB(ctx, "reading held dust", func(ctx context.Context) error {
+		batches = nil
+		byKey := make(map[string]*dustBatch)
+		return sqlutil.ForQueryRows(ctx, c.DB, q, pegOutDust, c.label, func(txid, ref []byte, version int64, zioncoinTx string) error {
+			var p pegOut
+			err := decodeRefdata(ref, &p)
+			if err != nil {
+				// Retrying cannot fix it, so it is left for an operator.
+				log.Printf("skipping malformed dust export %x: %s", txid, err)
+				return nil
+			}
+			p.TxID, p.Version = txid, version
+			// A batch being paid is keyed by its payment,
+			// so it is settled as it was submitted.
+			key := p.Exporter + " " + string(p.AssetXDR) + " " + zioncoinTx
+			batch := byKey[key]
+			if batch == nil {
+				batch = &dustBatch{exporter: p.Exporter, assetXDR: p.AssetXDR, zioncoinTx: zioncoinTx}
+				byKey[key] = batch
+				batches = append(batches, batch)
+			}
+			batch.exports = append(batch.exports, p)
+			batch.total += p.Amount
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	var ready []*dustBatch
+	for _, batch := range batches {
+		if c.submissionsHalted() {
+			return nil
+		}
+		if batch.zioncoinTx != "" {
+			err = c.resolveDustBatch(ctx, batch, pegouts)
+			if err != nil {
+				return err
+			}
+		} else if c.readyDustBatch(batch) {
+			ready = append(ready, batch)
+		}
+	}
+	for size := c.pegOutBatchSize(); len(ready) > 0; {
+		if c.submissionsHalted() {
+			return nil
+		}
+		n := size
+		if n > len(ready) {
+			n = len(ready)
+		}
+		err = c.payDustBatches(ctx, ready[:n], pegouts)
+		if err != nil {
+			return err
+		}
+		ready = ready[n:]
+	}
+	return nil
+}
+
+// readyDustBatch reports whether batch has reached its asset's dust threshold
+// and can be paid,
+// setting its asset, payout, and fee if so.
+func (c *Custodian) readyDustBatch(batch *dustBatch) bool {
+	err := xdr.SafeUnmarshal(batch.assetXDR, &batch.asset)
+	if err != nil {
+		log.Printf("holding %d dust export(s) for %s: unmarshaling asset from XDR %x: %s", len(batch.exports), batch.exporter, batch.assetXDR, err)
+		return false
+	}
+	policy := c.feePolicy(batch.asset)
+	if policy.isDust(batch.total) {
+		return false
+	}
+	batch.payout, batch.fee, err = policy.Payout(batch.total)
+	if err != nil {
+		log.Printf("holding %d dust export(s) of %s for %s: %s", len(batch.exports), batch.asset.String(), batch.exporter, err)
+		return false
+	}
+	return true
+}
+
+// payDustBatches pays batches, ready to be paid (see readyDustBatch),
+// in one Zioncoin tx.
+// Their exports succeed or fail together with the tx:
+// if it fails, each is marked pegOutFail,
+// with the tx's error as its failure reason,
+// and is refunded on slidechain.
+// It returns an error only if ctx is canceled.
+func (c *Custodian) payDustBatches(ctx context.Context, batches []*dustBatch, pegouts chan<- pegOut) error {
+	payments := make([]batchPayment, 0, len(batches))
+	for _, batch := range batches {
+		payments = append(payments, batchPayment{destination: batch.exporter, asset: batch.asset, amount: batch.payout})
+	}
+	tx, err := c.buildBatchPegOutTx(payments)
+	if err != nil {
+		log.Printf("building dust payment to %s: %s", batches[0].exporter, err)
+		return nil
+	}
+	hash, err := tx.HashHex()
+	if err != nil {
+		log.Printf("hashing dust payment to %s: %s", batches[0].exporter, err)
+		return nil
+	}
+
+	// The payment is recorded on the batches' exports before it is submitted,
+	// so that after a crash resolveDustBatch can tell whether it happened.
+	var claimed bool
+	err = c.retryDB(ctx, "recording dust payment", func(ctx context.Context) error {
+		var err error
+		claimed, err = c.setDustPayment(ctx, dustExports(batches), hash)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		// An export in the batches changed concurrently.
+		// The batches are re-read on the next pass.
+		return nil
+	}
+	incrDustVersions(batches)
+
+	for _, batch := range batches {
+		log.Printf("paying %d dust export(s) of %s to %s: %d (fee %d) in tx %s", len(batch.exports), batch.asset.String(), batch.exporter, batch.payout, batch.fee, hash)
+	}
+	c.setInFlight(batches[0].exports[0].TxID)
+	err = c.submitCustodianTx(ctx, tx, hash)
+	c.setInFlight(nil)
+	if err != nil {
+		if ctx.Err() != nil {
+			// The payment may have been submitted.
+			// The recorded hash lets resolveDustBatch tell on the next run.
+			return ctx.Err()
+		}
+		reason := fmt.Sprintf("paying dust in tx %s: %s", hash, err)
+		log.Print(reason)
+		for _, batch := range batches {
+			for _, p := range batch.exports {
+				err = c.failExport(ctx, p.TxID, reason)
+				if err != nil {
+					return err
+				}
+			}
+			err = c.settleDustBatch(ctx, batch, pegOutFail, "", pegouts)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, batch := range batches {
+		if batch.fee > 0 {
+			err = c.retryDB(ctx, "recording fee", func(ctx context.Context) error {
+				return c.recordFee(ctx, batch.exports[0].TxID, batch.assetXDR, batch.fee)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		err = c.retryDB(ctx, "witnessing peg-out", func(ctx context.Context) error {
+			return c.witnessPegOut(ctx, batch.exports[0].TxID, hash, batch.assetXDR, batch.payout, batch.exporter)
+		})
+		if err != nil {
+			return err
+		}
+		err = c.settleDustBatch(ctx, batch, pegOutOK, hash, pegouts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dustExports returns the exports of batches.
+func dustExports(batches []*dustBatch) []pegOut {
+	var exports []pegOut
+	for _, batch := range batches {
+		exports = append(exports, batch.exports...)
+	}
+	return exports
+}
+
+// incrDustVersions increments the versions of the exports of batches,
+// after setDustPayment.
+func incrDustVersions(batches []*dustBatch) {
+	for _, batch := range batches {
+		for i := range batch.exports {
+			batch.exports[i].Version++
+		}
+	}
+}
+
+// resolveDustBatch marks batch pegged out
+// if its payment is on the Zioncoin network,
+// and otherwise holds it again.
+// It returns an error only if ctx is canceled.
+func (c *Custodian) resolveDustBatch(ctx context.Context, batch *dustBatch, pegouts chan<- pegOut) error {
+	_, err := c.hclient.LoadTransaction(batch.zioncoinTx)
+	if isNotFound(err) {
+		log.Printf("dust payment %s to %s not found, holding its exports again", batch.zioncoinTx, batch.exporter)
+		return c.retryDB(ctx, "releasing dust payment", func(ctx context.Context) error {
+			_, err := c.setDustPayment(ctx, batch.exports, "")
+			return err
+		})
+	}
+	if err != nil {
+		// Retried on the next pass.
+		log.Printf("loading dust payment %s: %s", batch.zioncoinTx, err)
+		return nil
+	}
+	return c.settleDustBatch(ctx, batch, pegOutOK, batch.zioncoinTx, pegouts)
+}
+
+// settleDustBatch puts the exports of batch in state,
+// pegOutOK if pegged out by Zioncoin tx hash
+// or pegOutFail if its payment failed,
+// and sends them to pegouts.
+func (c *Custodian) settleDustBatch(ctx context.Context, batch *dustBatch, state pegOutState, hash string, pegouts chan<- pegOut) error {
+	for _, p := range batch.exports {
+		var err error
+		p.Version, p.State, err = c.recordExportOutcome(ctx, p.TxID, p.Version, pegOutDust, state, hash)
+		if err != nil {
+			// Finished concurrently,
+			// or the state is in the recovery log and is applied on a later pass.
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			// finishPegOuts completes it on the next run.
+			return ctx.Err()
+		case pegouts <- p:
+		}
+	}
+	return nil
+}
+
+// setDustPayment records hash as the payment of exports,
+// held as dust at their versions,
+// incrementing their versions.
+// It reports false, recording nothing, if any export has changed.
+func (c *Custodian) setDustPayment(ctx context.Context, exports []pegOut, hash string) (bool, error) {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	for _, p := range exports {
+		result, err := dbtx.ExecContext(ctx, `UPDATE exports SET zioncoin_tx=$1, version=version+1 WHERE txid=$2 AND version=$3 AND pegged_out=$4`, hash, p.TxID, p.Version, pegOutDust)
+		if err != nil {
+			return false, errors.Wrapf(err, "recording dust payment of export %x", p.TxID)
+		}
+		numAffected, err := result.RowsAffected()
+		if err != nil {
+			return false, errors.Wrapf(err, "checking rows affected by recording dust payment of export %x", p.TxID)
+		}
+		if numAffected == 0 {
+			return false, nil
+		}
+	}
+	return true, errors.Wrap(dbtx.Commit(), "committing dust payment")
+}
+
+// dustReason is the failure reason of an export of amount
+// rejected as dust under policy.
+func dustReason(amount int64, policy FeePolicy) string {
+	return fmt.Sprintf("export of %d is below the dust threshold of %d", amount, policy.DustThreshold)
+}
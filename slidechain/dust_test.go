@@ -0,0 +1,350 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/xdr"
+)
+
+func TestDustHold(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	fees := map[string]FeePolicy{"native": {Flat: 10, DustThreshold: 1000, HoldDust: true}}
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		c.hclient = hclient
+
+		exportState := func(txid []byte) pegOutState {
+			var state pegOutState
+			err := db.QueryRow("SELECT pegged_out FROM exports WHERE txid=$1", txid).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return state
+		}
+		awaitState := func(txid []byte, want pegOutState) {
+			for exportState(txid) != want {
+				select {
+				case <-ctx.Done():
+					t.Fatalf("timed out waiting for export %s to reach state %d", txid, want)
+				case <-time.After(50 * time.Millisecond):
+					c.exports.Broadcast()
+				}
+			}
+		}
+
+		pegouts := make(chan pegOut, 10)
+		go c.pegOutFromExports(ctx, pegouts)
+
+		var (
+			first  = []byte("first")
+			second = []byte("second")
+			lone   = []byte("lone")
+		)
+		insertTestExport(t, db, first, lumenXDR, 400, exporter.Address())
+		insertTestExport(t, db, lone, lumenXDR, 700, other.Address())
+		awaitState(first, pegOutDust)
+		awaitState(lone, pegOutDust)
+
+		held, err := c.heldDust(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(held) != 2 {
+			t.Errorf("got %d exports held as dust, want 2", len(held))
+		}
+
+		// The second export brings the exporter's held dust to the threshold,
+		// but the other exporter's remains held.
+		insertTestExport(t, db, second, lumenXDR, 700, exporter.Address())
+		awaitState(first, pegOutOK)
+		awaitState(second, pegOutOK)
+		if state := exportState(lone); state != pegOutDust {
+			t.Errorf("got lone dust export in state %d, want %d", state, pegOutDust)
+		}
+		for i := 0; i < 2; i++ {
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for peg-outs")
+			case p := <-pegouts:
+				if p.State != pegOutOK {
+					t.Errorf("got peg-out of export %s in state %d, want %d", p.TxID, p.State, pegOutOK)
+				}
+			}
+		}
+
+		var tx1, tx2 string
+		err = db.QueryRow("SELECT zioncoin_tx FROM exports WHERE txid=$1", first).Scan(&tx1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.QueryRow("SELECT zioncoin_tx FROM exports WHERE txid=$1", second).Scan(&tx2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tx1 == "" || tx1 != tx2 {
+			t.Errorf("got peg-out txs %q and %q, want one payment for both", tx1, tx2)
+		}
+		var fee int64
+		err = db.QueryRow("SELECT SUM(amount) FROM fees").Scan(&fee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fee != 10 {
+			t.Errorf("got fees totaling %d, want one fee of 10", fee)
+		}
+
+		// The held exports were paid by one payment of 1100 less the fee.
+		hclient.mu.Lock()
+		txs := hclient.txs
+		hclient.mu.Unlock()
+		if len(txs) != 1 {
+			t.Fatalf("got %d submitted txs, want 1", len(txs))
+		}
+		var env xdr.TransactionEnvelope
+		err = xdr.SafeUnmarshalBase64(txs[0], &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(env.Tx.Operations) != 1 || env.Tx.Operations[0].Body.Type != xdr.OperationTypePayment {
+			t.Fatalf("got dust payment tx with operations %+v, want one payment", env.Tx.Operations)
+		}
+		payment := env.Tx.Operations[0].Body.PaymentOp
+		if payment.Destination.Address() != exporter.Address() || payment.Amount != 1090 {
+			t.Errorf("got payment of %d to %s, want 1090 to %s", payment.Amount, payment.Destination.Address(), exporter.Address())
+		}
+	}, PegOutFees(fees))
+}
+
+func TestDustReject(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	fees := map[string]FeePolicy{"native": {DustThreshold: 1000}}
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		txid := []byte("dust")
+		insertTestExport(t, db, txid, lumenXDR, 400, exporter.Address())
+
+		pegouts := make(chan pegOut)
+		go c.pegOutFromExports(ctx, pegouts)
+		var p pegOut
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for peg-out")
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			case p = <-pegouts:
+				break wait
+			}
+		}
+		if p.State != pegOutFail {
+			t.Errorf("got dust export in state %d, want %d", p.State, pegOutFail)
+		}
+		var reason string
+		err = db.QueryRow("SELECT reason FROM export_failures WHERE txid=$1", txid).Scan(&reason)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(reason, "dust threshold") {
+			t.Errorf("got failure reason %q, want one mentioning the dust threshold", reason)
+		}
+		held, err := c.heldDust(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(held) != 0 {
+			t.Errorf("got %d exports held as dust, want none", len(held))
+		}
+	}, PegOutFees(fees))
+}
+
+func TestDustBatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	fees := map[string]FeePolicy{"native": {Flat: 10, DustThreshold: 1000, HoldDust: true}}
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		c.hclient = hclient
+
+		// Each of three exporters has held dust reaching the threshold,
+		// to be paid in batches of two.
+		var exporters []string
+		for _, name := range []string{"a", "b", "c"} {
+			kp, err := keypair.Random()
+			if err != nil {
+				t.Fatal(err)
+			}
+			exporters = append(exporters, kp.Address())
+			insertTestExport(t, db, []byte(name+"1"), lumenXDR, 600, kp.Address())
+			insertTestExport(t, db, []byte(name+"2"), lumenXDR, 600, kp.Address())
+		}
+
+		pegouts := make(chan pegOut, 10)
+		go c.pegOutFromExports(ctx, pegouts)
+		for i := 0; i < 6; {
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for peg-outs")
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			case p := <-pegouts:
+				if p.State != pegOutOK {
+					t.Errorf("got peg-out of export %s in state %d, want %d", p.TxID, p.State, pegOutOK)
+				}
+				i++
+			}
+		}
+
+		hashes := make(map[string]string)
+		for _, txid := range []string{"a1", "a2", "b1", "b2", "c1", "c2"} {
+			var hash string
+			err = db.QueryRow("SELECT zioncoin_tx FROM exports WHERE txid=$1", []byte(txid)).Scan(&hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hashes[txid] = hash
+		}
+		if hashes["a1"] == "" || hashes["a1"] != hashes["b2"] || hashes["c1"] == hashes["a1"] || hashes["c1"] != hashes["c2"] {
+			t.Errorf("got peg-out txs %v, want one for exporters a and b and another for c", hashes)
+		}
+		var fee int64
+		err = db.QueryRow("SELECT SUM(amount) FROM fees").Scan(&fee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fee != 30 {
+			t.Errorf("got fees totaling %d, want one fee of 10 per exporter", fee)
+		}
+
+		hclient.mu.Lock()
+		txs := hclient.txs
+		hclient.mu.Unlock()
+		if len(txs) != 2 {
+			t.Fatalf("got %d submitted txs, want 2", len(txs))
+		}
+		var paid []string
+		for i, want := range []int{2, 1} {
+			var env xdr.TransactionEnvelope
+			err = xdr.SafeUnmarshalBase64(txs[i], &env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(env.Tx.Operations) != want {
+				t.Errorf("got %d payments in tx %d, want %d", len(env.Tx.Operations), i, want)
+			}
+			for _, op := range env.Tx.Operations {
+				if op.Body.PaymentOp == nil || op.Body.PaymentOp.Amount != 1190 {
+					t.Errorf("got operation %+v, want a payment of 1190", op.Body)
+					continue
+				}
+				paid = append(paid, op.Body.PaymentOp.Destination.Address())
+			}
+		}
+		if strings.Join(paid, " ") != strings.Join(exporters, " ") {
+			t.Errorf("got payments to %v, want %v", paid, exporters)
+		}
+	}, PegOutFees(fees), MaxPegOutBatch(2))
+}
+
+func TestDustBatchFail(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	fees := map[string]FeePolicy{"native": {Flat: 10, DustThreshold: 1000, HoldDust: true}}
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hclient := &fakeClient{ClientInterface: c.hclient, fails: 1}
+		c.hclient = hclient
+
+		// Two exporters' held dust is paid in one tx, which fails.
+		for _, name := range []string{"a", "b"} {
+			kp, err := keypair.Random()
+			if err != nil {
+				t.Fatal(err)
+			}
+			insertTestExport(t, db, []byte(name+"1"), lumenXDR, 600, kp.Address())
+			insertTestExport(t, db, []byte(name+"2"), lumenXDR, 600, kp.Address())
+		}
+
+		pegouts := make(chan pegOut, 10)
+		go c.pegOutFromExports(ctx, pegouts)
+		for i := 0; i < 4; {
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for peg-outs")
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			case p := <-pegouts:
+				if p.State != pegOutFail {
+					t.Errorf("got peg-out of export %s in state %d, want %d", p.TxID, p.State, pegOutFail)
+				}
+				i++
+			}
+		}
+
+		for _, txid := range []string{"a1", "a2", "b1", "b2"} {
+			var (
+				state  pegOutState
+				reason string
+			)
+			err = db.QueryRow("SELECT pegged_out FROM exports WHERE txid=$1", []byte(txid)).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state != pegOutFail {
+				t.Errorf("got export %s in state %d, want %d", txid, state, pegOutFail)
+			}
+			err = db.QueryRow("SELECT reason FROM export_failures WHERE txid=$1", []byte(txid)).Scan(&reason)
+			if err != nil {
+				t.Fatalf("getting failure reason of export %s: %s", txid, err)
+			}
+			if !strings.Contains(reason, "paying dust") {
+				t.Errorf("got failure reason %q for export %s, want one for the dust payment", reason, txid)
+			}
+		}
+
+		hclient.mu.Lock()
+		n := len(hclient.txs)
+		hclient.mu.Unlock()
+		if n != 0 {
+			t.Errorf("got %d successful txs, want the failed batch not to be retried", n)
+		}
+	}, PegOutFees(fees), MaxPegOutBatch(2))
+}
@@ -0,0 +1,120 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+)
+
+// EventType identifies the state change recorded by an Event.
+type EventType string
+
+const (
+	// EventPegIn records a peg-in payment matched to its pre-peg-in.
+	EventPegIn EventType = "pegin"
+	// EventPegInFlagged records a peg-in payment flagged for manual refund.
+	EventPegInFlagged EventType = "pegin_flagged"
+	// EventImport records the import of a peg-in to txvm.
+	EventImport EventType = "import"
+	// EventExport records an export tx observed on txvm.
+	EventExport EventType = "export"
+	// EventExportFailed records an export rejected before peg-out.
+	EventExportFailed EventType = "export_failed"
+	// EventExportRejected records an export rejected by the export policy,
+	// which is not recorded for peg-out (see ExportPolicy).
+	EventExportRejected EventType = "export_rejected"
+	// EventExportOrphaned records an export in a block
+	// replaced in a slidechain reorg (see RunPin):
+	// with state pegOutNotYet if its peg-out was reversed,
+	// otherwise with the state of its peg-out.
+	EventExportOrphaned EventType = "export_orphaned"
+	// EventPegOut records the outcome of a peg-out on Zioncoin.
+	EventPegOut EventType = "pegout"
+	// EventTranche records the payment, or failed payment,
+	// of a tranche of a peg-out after the first.
+	EventTranche EventType = "tranche"
+	// EventExportFinished records the retirement or refund
+	// of an export's funds on txvm after peg-out.
+	EventExportFinished EventType = "export_finished"
+	// EventSweep records a payment of excess balance
+	// from the custodian account to its cold wallet.
+	EventSweep EventType = "sweep"
+)
+
+// Event is an entry in the custodian's peg event log.
+// Events are numbered by Seq in the order they were committed,
+// and each is written in the same db transaction as the state change it records,
+// so a consumer that stores the Seq of the last event it processed
+// can resume with ReadEvents after a crash
+// without missing or repeating an event.
+type Event struct {
+	Seq         int64     `json:"seq"`
+	Type        EventType `json:"type"`
+	TimestampMS uint64    `json:"timestamp_ms"`
+
+	// NonceHash identifies the peg of a peg-in or import event.
+	NonceHash []byte `json:"nonce_hash,omitempty"`
+	// TxVMTxID is the import tx of an import event
+	// and the export tx of an export, peg-out, or tranche event.
+	TxVMTxID []byte `json:"txvm_txid,omitempty"`
+	// ZioncoinTx is the hash of the Zioncoin tx
+	// of the peg-in payment, peg-out, tranche, or sweep.
+	ZioncoinTx string `json:"zioncoin_tx,omitempty"`
+	// Account is the Zioncoin account that paid a peg-in
+	// or is to receive a peg-out or sweep.
+	Account  string      `json:"account,omitempty"`
+	AssetXDR []byte      `json:"asset,omitempty"`
+	Amount   int64       `json:"amount,omitempty"`
+	State    pegOutState `json:"state,omitempty"`
+	Reason   string      `json:"reason,omitempty"`
+}
+
+// appendEvent adds ev to the event log as part of dbtx.
+// Its Seq and TimestampMS are assigned on insertion.
+func appendEvent(ctx context.Context, dbtx *sql.Tx, ev Event) error {
+	ev.Seq = 0
+	ev.TimestampMS = bc.Millis(time.Now())
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return errors.Wrapf(err, "marshaling %s event", ev.Type)
+	}
+	_, err = dbtx.ExecContext(ctx, `INSERT INTO events (type, data, timestamp_ms) VALUES ($1, $2, $3)`, ev.Type, data, ev.TimestampMS)
+	return errors.Wrapf(err, "recording %s event", ev.Type)
+}
+
+// ReadEvents returns up to limit events from the peg event log
+// with sequence numbers greater than afterSeq, in order.
+// Pass 0 to read from the beginning of the log.
+func (c *Custodian) ReadEvents(ctx context.Context, afterSeq int64, limit int) ([]Event, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	rows, err := c.DB.QueryContext(ctx, `SELECT seq, data FROM events WHERE seq > $1 ORDER BY seq LIMIT $2`, afterSeq, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying events")
+	}
+	defer rows.Close()
+	var events []Event
+	for rows.Next() {
+		var (
+			seq  int64
+			data []byte
+		)
+		err = rows.Scan(&seq, &data)
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning event")
+		}
+		var ev Event
+		err = json.Unmarshal(data, &ev)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unmarshaling event %d", seq)
+		}
+		ev.Seq = seq
+		events = append(events, ev)
+	}
+	return events, errors.Wrap(rows.Err(), "iterating over events")
+}
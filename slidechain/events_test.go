@@ -0,0 +1,92 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol/bc"
+)
+
+func TestReadEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
+		err := c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, expMS, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.recordPegIn(ctx, "txid1", "1", nonceHash[:], "source", 10, []byte("asset"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A repeated payment is flagged.
+		err = c.recordPegIn(ctx, "txid2", "2", nonceHash[:], "source", 10, []byte("asset"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.recordImport(ctx, nonceHash[:], []byte("import"), 10, []byte("asset"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		insertTestExport(t, db, []byte("export"), []byte("asset"), 10, importTestAccountID)
+		err = c.updateExportState(ctx, []byte("export"), 0, pegOutOK, "zioncointx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.recordExportFailure(ctx, []byte("failed"), []byte(`{}`), "no temp account")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Recording the same failure again logs no new event.
+		err = c.recordExportFailure(ctx, []byte("failed"), []byte(`{}`), "no temp account")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []Event{
+			{Type: EventPegIn, NonceHash: nonceHash[:], ZioncoinTx: "txid1"},
+			{Type: EventPegInFlagged, NonceHash: nonceHash[:], ZioncoinTx: "txid2", Reason: "duplicate"},
+			{Type: EventImport, NonceHash: nonceHash[:], TxVMTxID: []byte("import")},
+			{Type: EventPegOut, TxVMTxID: []byte("export"), ZioncoinTx: "zioncointx", State: pegOutOK},
+			{Type: EventExportFailed, TxVMTxID: []byte("failed"), Reason: "no temp account"},
+		}
+		got, err := c.ReadEvents(ctx, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("got %d events, want %d", len(got), len(want))
+		}
+		for i, ev := range got {
+			w := want[i]
+			if ev.Type != w.Type || !bytes.Equal(ev.NonceHash, w.NonceHash) || !bytes.Equal(ev.TxVMTxID, w.TxVMTxID) || ev.ZioncoinTx != w.ZioncoinTx || ev.State != w.State || ev.Reason != w.Reason {
+				t.Errorf("event %d: got %+v, want %+v", i, ev, w)
+			}
+			if i > 0 && ev.Seq <= got[i-1].Seq {
+				t.Errorf("event %d: got seq %d after %d", i, ev.Seq, got[i-1].Seq)
+			}
+		}
+
+		// A consumer resumes after the last event it processed.
+		page, err := c.ReadEvents(ctx, got[1].Seq, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != 2 || page[0].Seq != got[2].Seq || page[1].Seq != got[3].Seq {
+			t.Errorf("got page %+v, want events %d and %d", page, got[2].Seq, got[3].Seq)
+		}
+		page, err = c.ReadEvents(ctx, got[len(got)-1].Seq, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != 0 {
+			t.Errorf("got %d events after the last, want 0", len(page))
+		}
+	})
+}
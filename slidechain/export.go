@@ -1,12 +1,14 @@
 package slidechain
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math"
-	"strconv"
+	"time"
 
 	"github.com/bobg/sqlutil"
 	"github.com/chain/txvm/crypto/ed25519"
@@ -18,7 +20,9 @@ import (
 	"github.com/chain/txvm/protocol/txvm/op"
 	"github.com/chain/txvm/protocol/txvm/txvmutil"
 	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	i10rnet "github.com/interzioncoin/starlight/net"
 	"github.com/interzioncoin/starlight/worizon/xlm"
+	"github.com/zioncoin/go/amount"
 	b "github.com/zioncoin/go/build"
 	"github.com/zioncoin/go/clients/equator"
 	"github.com/zioncoin/go/keypair"
@@ -36,6 +40,99 @@ type pegOut struct {
 	Anchor   []byte      `json:"anchor"`
 	Pubkey   []byte      `json:"pubkey"`
 	State    pegOutState `json:"-"`
+
+	// Owner is the Zioncoin account that funded the temp account
+	// and holds its cancellation signer,
+	// when that is not the Exporter receiving the payout.
+	Owner string `json:"owner,omitempty"`
+
+	// WindowMS, if positive, makes the export reversible:
+	// the custodian defers its peg-out
+	// until WindowMS milliseconds after the block containing it,
+	// and until then the exporter may cancel it (see CancelExport).
+	WindowMS int64 `json:"window_ms,omitempty"`
+
+	// Custodian, if set, is the Zioncoin account of the custodian
+	// that is to peg out the export,
+	// when several custodians share a db.
+	Custodian string `json:"custodian,omitempty"`
+
+	// Metadata, if set, is JSON supplied by the exporter,
+	// e.g. the metadata of the peg-in that imported the funds
+	// (see PrePegIn).
+	// It may be at most MaxPegMetadata bytes.
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+
+	// ConvertAssetXDR, if set, is the asset
+	// in which the exporter is paid ConvertAmount
+	// instead of the exported asset (see Conversion).
+	ConvertAssetXDR []byte `json:"convert_asset,omitempty"`
+	ConvertAmount   int64  `json:"convert_amount,omitempty"`
+
+	// Recipients, if set, divide the payout among themselves,
+	// each paid by its own payment in the one peg-out tx,
+	// instead of it all going to the Exporter
+	// (see ExportOptions.Recipients).
+	Recipients []Recipient `json:"recipients,omitempty"`
+
+	// MemoAnchor, if set, has the peg-out tx carry Anchor as its hash memo,
+	// by which the exporter can match the payment to the export
+	// (see ExportOptions.MemoAnchor).
+	// It is carried only by JSON refdata.
+	MemoAnchor bool `json:"memo_anchor,omitempty"`
+
+	// BaseFee, if set, is the base fee with which the export was pre-exported,
+	// and so the one its preauthorized peg-out tx pays
+	// (see ExportOptions.BaseFee).
+	BaseFee int64 `json:"base_fee,omitempty"`
+
+	// RecordedFee is the base fee recorded with the export's row,
+	// or zero if it was recorded before the custodian recorded fees
+	// (see pegOutBaseFee).
+	RecordedFee int64 `json:"-"`
+
+	// Version is the version of the export's row when it was read
+	// (see claimExport).
+	Version int64 `json:"-"`
+
+	// Trace is the span context of the export's recording,
+	// the parent of the spans of its peg-out (see Tracer).
+	Trace SpanContext `json:"-"`
+
+	// Format is the format of the refdata p was decoded from,
+	// in which the post-peg-out tx must re-encode it.
+	Format RefdataFormat `json:"-"`
+}
+
+// memo returns the hash memo of p's peg-out tx, if any.
+func (p pegOut) memo() []byte {
+	if p.MemoAnchor {
+		return p.Anchor
+	}
+	return nil
+}
+
+// owner returns the Zioncoin account that funded p's temp account.
+func (p pegOut) owner() string {
+	if p.Owner != "" {
+		return p.Owner
+	}
+	return p.Exporter
+}
+
+// pegOutBaseFee returns the base fee of the peg-out tx of export p:
+// the fee it was pre-exported with, if its refdata records one;
+// else the custodian's base fee when the export was recorded;
+// else, for an export recorded before the custodian recorded fees,
+// its current base fee.
+func (c *Custodian) pegOutBaseFee(p pegOut) int64 {
+	if p.BaseFee != 0 {
+		return p.BaseFee
+	}
+	if p.RecordedFee != 0 {
+		return p.RecordedFee
+	}
+	return c.BaseFee
 }
 
 type pegOutState int
@@ -45,10 +142,134 @@ const (
 	pegOutOK
 	pegOutRetry
 	pegOutFail
+
+	// pegOutPartial is the state of a peg-out split into tranches
+	// whose first tranche has been paid
+	// but whose remaining tranches are not all paid (see payTranches).
+	pegOutPartial
+
+	// pegOutUnsigned is the state of an export whose peg-out tx
+	// awaits a signature made offline (see OfflineSigning).
+	pegOutUnsigned
+
+	// pegOutNoTrust is the state of an export
+	// awaiting its exporter's trustline to the exported asset
+	// (see AwaitTrustlines).
+	pegOutNoTrust
+
+	// pegOutPending is the state of an export
+	// whose peg-out tx was accepted for asynchronous submission
+	// but is not yet seen applied (see AsyncPegOuts).
+	pegOutPending
+
+	// pegOutDust is the state of an export held as dust,
+	// to be paid out with others from the same exporter
+	// (see FeePolicy.HoldDust).
+	pegOutDust
+
+	// pegOutHeld is the state of an export
+	// whose peg-out tx the custodian's validator rejected,
+	// held for an operator's review (see PegOutValidator).
+	pegOutHeld
 )
 
+// baseFee is the default base fee, in stroops per operation,
+// of the Zioncoin txs of the custodian and of exporters
+// (see BaseFee).
 const baseFee = 100
 
+// minBaseFee is the Zioncoin network's minimum base fee,
+// in stroops per operation.
+const minBaseFee = 100
+
+// BaseFee sets the base fee, in stroops per operation,
+// of the custodian's Zioncoin txs (by default, 100),
+// so that it can be raised when the network is congested.
+// The fee of a peg-out tx is part of the hash preauthorized by its temp account,
+// so exporters pre-export with the custodian's base fee
+// (see PreExportOptions.BaseFee and PegOutParams.BaseFee)
+// and record it in the export (see ExportOptions.BaseFee).
+// Each export is pegged out with the fee it records,
+// or else the custodian's base fee when the export was recorded,
+// so a change applies only to exports recorded after it.
+// The fee must be at least the network's minimum of 100.
+func BaseFee(stroops int64) Option {
+	return func(c *Custodian) {
+		c.BaseFee = stroops
+	}
+}
+
+// DefaultMaxPegOutRetries is the default number of times
+// the custodian retries a peg-out tx that failed with a retryable error
+// before failing its export.
+const DefaultMaxPegOutRetries = 10
+
+// MaxPegOutRetries sets the number of times the custodian retries
+// a peg-out tx that failed with a retryable error, such as tx_bad_seq,
+// before failing its export and refunding it on slidechain
+// (by default, DefaultMaxPegOutRetries),
+// so that a wedged temp account is not retried forever.
+// A negative value retries without limit.
+func MaxPegOutRetries(n int) Option {
+	return func(c *Custodian) {
+		c.maxPegOutRetries = n
+	}
+}
+
+// pegOutRetriesExceeded reports whether a peg-out retried retries times
+// has exceeded the custodian's limit (see MaxPegOutRetries).
+func (c *Custodian) pegOutRetriesExceeded(retries int) bool {
+	max := c.maxPegOutRetries
+	if max == 0 {
+		max = DefaultMaxPegOutRetries
+	}
+	return max > 0 && retries > max
+}
+
+const (
+	// DefaultPegOutRetryBackoff is the default delay
+	// before the first retry of a peg-out tx.
+	DefaultPegOutRetryBackoff = time.Second
+
+	// DefaultPegOutRetryBackoffMax is the default bound
+	// on the delay before any retry of a peg-out tx.
+	DefaultPegOutRetryBackoffMax = 5 * time.Minute
+)
+
+// PegOutRetryBackoff sets the delay before the first retry
+// of a peg-out tx that failed with a retryable error
+// (by default, DefaultPegOutRetryBackoff),
+// and the bound on the delay, growing with backoff, before each later one
+// (by default, DefaultPegOutRetryBackoffMax).
+// Zero leaves the corresponding default in place.
+func PegOutRetryBackoff(base, max time.Duration) Option {
+	return func(c *Custodian) {
+		c.pegOutRetryBackoff = base
+		c.pegOutRetryBackoffMax = max
+	}
+}
+
+// pegOutRetryDelay returns the delay before retrying
+// a peg-out tx that has failed retries times with a retryable error.
+func (c *Custodian) pegOutRetryDelay(retries int) time.Duration {
+	base, max := c.pegOutRetryBackoff, c.pegOutRetryBackoffMax
+	if base <= 0 {
+		base = DefaultPegOutRetryBackoff
+	}
+	if max <= 0 {
+		max = DefaultPegOutRetryBackoffMax
+	}
+	backoff := i10rnet.Backoff{Base: base}
+	var dur time.Duration
+	for i := 0; i < retries; i++ {
+		dur = backoff.Next()
+		if dur >= max {
+			return max
+		}
+	}
+	return dur
+}
+
 const (
 	custodianSigCheckerFmt = `txid x"%x" get 0 checksig verify`
 
@@ -100,6 +321,29 @@ func (c *Custodian) pegOutFromExports(ctx context.Context, pegouts chan<- pegOut
 	defer log.Print("pegOutFromExports exiting")
 	defer close(pegouts)
 
+	c.supervise(ctx, "pegging out exports", func(ctx context.Context) error {
+		return c.pegOutExports(ctx, pegouts)
+	})
+}
+
+// pegOutExports pegs out exports as they are recorded
+// until ctx is done or it fails with an error,
+// which it returns for its supervisor (see pegOutFromExports).
+// An export it cannot even read is logged and skipped,
+// and other exports it cannot peg out are failed,
+// without stopping the rest.
+func (c *Custodian) pegOutExports(ctx context.Context, pegouts chan<- pegOut) error {
+	// Stops the waiter below if this returns early.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer c.setInFlight(nil)
+
+	// malformed holds the txids of exports
+	// whose refdata or asset cannot be decoded.
+	// They are skipped, being unfit either to peg out or to refund,
+	// and left for an operator.
+	malformed := make(map[string]bool)
+
 	ch := make(chan struct{})
 	go func() {
 		c.exports.L.Lock()
@@ -109,105 +353,632 @@ func (c *Custodian) pegOutFromExports(ctx context.Context, pegouts chan<- pegOut
 				return
 			}
 			c.exports.Wait()
-			ch <- struct{}{}
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- struct{}{}:
+			}
 		}
 	}()
 
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return nil
 		case <-ch:
 		}
-		const q = `SELECT txid, pegout_json FROM exports WHERE pegged_out IN ($1, $2)`
+		if c.submissionsHalted() {
+			continue
+		}
+		// unrecorded holds the txids of exports whose peg-out state
+		// is in the recovery log but not yet in the db.
+		// They must not be pegged out again.
+		unrecorded, err := c.replayRecoveryLog(ctx)
+		if err != nil {
+			log.Printf("replaying recovery log: %s", err)
+		}
+		if unrecorded == nil {
+			unrecorded = make(map[string]bool)
+		}
+		// Reversible exports are skipped until their windows close,
+		// and retried peg-outs until their backoffs elapse.
+		const q = `SELECT txid, pegout_json, pegged_out, version, trace_parent, recorded_ms, retries, base_fee FROM exports WHERE pegged_out IN ($1, $2, $3) AND payout_after_ms <= $4 AND next_attempt_ms <= $4 AND custodian_id=$5`
 
 		var (
 			txids, refs [][]byte
+			states      []pegOutState
+			versions    []int64
+			traces      []string
+			recorded    []int64
+			retries     []int
+			fees        []int64
+			nowMS       = int64(bc.Millis(time.Now()))
 		)
-		err := sqlutil.ForQueryRows(ctx, c.DB, q, pegOutNotYet, pegOutRetry, func(txid, ref []byte) {
-			txids = append(txids, txid)
-			refs = append(refs, ref)
+		err = c.retryDB(ctx, "reading export rows", func(ctx context.Context) error {
+			txids, refs, states, versions, traces, recorded, retries, fees = nil, nil, nil, nil, nil, nil, nil, nil
+			return sqlutil.ForQueryRows(ctx, c.DB, q, pegOutNotYet, pegOutRetry, pegOutNoTrust, nowMS, c.label, func(txid, ref []byte, state pegOutState, version int64, trace string, recordedMS int64, numRetries int, fee int64) {
+				if unrecorded[string(txid)] || malformed[string(txid)] {
+					return
+				}
+				txids = append(txids, txid)
+				refs = append(refs, ref)
+				states = append(states, state)
+				versions = append(versions, version)
+				traces = append(traces, trace)
+				recorded = append(recorded, recordedMS)
+				retries = append(retries, numRetries)
+				fees = append(fees, fee)
+			})
 		})
 		if err != nil {
-			log.Fatalf("reading export rows: %s", err)
+			return err
 		}
+		// awaitingTrust is set when an export is left awaiting its exporter's trustline,
+		// to be checked again after the recheck interval.
+		var awaitingTrust bool
 		for i, txid := range txids {
-			var p pegOut
-			err := json.Unmarshal(refs[i], &p)
+			// Marked in flight before the check,
+			// so Shutdown waits for any peg-out begun before it.
+			c.setInFlight(txid)
+			if c.submissionsHalted() {
+				// Remaining exports are pegged out on resume.
+				break
+			}
+			var (
+				p     pegOut
+				asset xdr.Asset
+			)
+			err := decodeRefdata(refs[i], &p)
+			if err == nil {
+				err = errors.Wrapf(xdr.SafeUnmarshal(p.AssetXDR, &asset), "unmarshaling asset from XDR %x", p.AssetXDR)
+			}
 			if err != nil {
-				log.Fatalf("unmarshaling refdata: %s", err)
+				log.Printf("skipping malformed export %x: %s", txid, err)
+				malformed[string(txid)] = true
+				err = c.failExport(ctx, txid, fmt.Sprintf("malformed export: %s", err))
+				if err != nil {
+					return err
+				}
+				continue
 			}
-			var asset xdr.Asset
-			err = xdr.SafeUnmarshal(p.AssetXDR, &asset)
+			var claimed bool
+			err = c.retryDB(ctx, "claiming export", func(ctx context.Context) error {
+				var err error
+				claimed, err = c.claimExport(ctx, txid, versions[i])
+				return err
+			})
 			if err != nil {
-				log.Fatalf("unmarshalling asset from XDR %x: %s", p.AssetXDR, err)
+				return err
+			}
+			if !claimed {
+				// Another worker changed the export since it was read.
+				// It is re-read on the next pass.
+				log.Printf("export %x changed concurrently, skipping", txid)
+				continue
 			}
+			p.Version = versions[i] + 1
+			p.Trace = parseSpanContext(traces[i])
+			p.RecordedFee = fees[i]
+			// An export with an invalid address or conversion,
+			// or an exporter address that needs a newer protocol,
+			// fails rather than the custodian.
 			var tempID xdr.AccountId
 			err = tempID.SetAddress(p.TempAddr)
 			if err != nil {
-				log.Fatalf("setting temp address to %s: %s", p.TempAddr, err)
+				err = errors.Wrapf(err, "invalid temp account %q", p.TempAddr)
 			}
+			destReason := c.checkDestinations(p)
 			var exporter xdr.AccountId
-			err = exporter.SetAddress(p.Exporter)
-			if err != nil {
-				log.Fatalf("setting exporter address to %s: %s", p.Exporter, err)
+			if destReason == "" && err == nil {
+				err = errors.Wrapf(exporter.SetAddress(p.Exporter), "invalid exporter account %q", p.Exporter)
+			}
+			conv, convErr := p.conversion()
+			if err == nil {
+				err = convErr
+			}
+			if destReason == "" && err != nil {
+				destReason = err.Error()
+			}
+			// payAsset is the asset paid to the exporter.
+			payAsset := asset
+			if conv != nil {
+				payAsset = conv.Asset
 			}
 
-			log.Printf("pegging out export %x: %d of %s to %s", txid, p.Amount, asset.String(), p.Exporter)
-			peggedOut := pegOutOK
-			err = c.pegOut(ctx, exporter, asset, p.Amount, tempID, xdr.SequenceNumber(p.Seqnum))
-			if err != nil {
+			var (
+				peggedOut  = pegOutOK
+				zioncoinTx string
+			)
+			policy := c.feePolicy(asset)
+			payout, fee, err := policy.Payout(p.Amount)
+			tranches := policy.Split(payout)
+			check, reason, merged, cost := c.checkExport(p, asset, payAsset, conv, policy, tranches, destReason, err, states[i], retries[i], recorded[i], nowMS)
+			switch check {
+			case exportUnchecked:
+				// Retried on the next pass.
+				log.Printf("checking export %x: %s", txid, reason)
+				continue
+			case exportRejected:
+				log.Printf("rejecting peg-out of export %x: %s", txid, reason)
 				peggedOut = pegOutFail
-				if herr, ok := errors.Root(err).(*equator.Error); ok {
-					resultCodes, rerr := herr.ResultCodes()
-					if rerr != nil {
-						log.Fatalf("getting error codes from failed submission of tx %x (with equator err '%s'): %s", txid, herr, rerr)
+				err = c.failExport(ctx, txid, reason)
+				if err != nil {
+					return err
+				}
+			case exportDust:
+				log.Printf("holding export %x as dust: %d of %s for %s", txid, p.Amount, asset.String(), p.Exporter)
+				peggedOut = pegOutDust
+			case exportNoTrust:
+				// The peg-out tx would fail, consuming its preauth signer,
+				// so the export awaits the trustline.
+				awaitingTrust = true
+				if states[i] == pegOutNoTrust {
+					continue
+				}
+				log.Printf("deferring peg-out of export %x: %s", txid, reason)
+				peggedOut = pegOutNoTrust
+			case exportReady:
+				if len(tranches) > 1 {
+					// The later tranches are scheduled first,
+					// so they are never missing once the first is paid.
+					err = c.retryDB(ctx, "scheduling tranches", func(ctx context.Context) error {
+						return c.scheduleTranches(ctx, txid, tranches[1:])
+					})
+					if err != nil {
+						return err
+					}
+				}
+				if c.offlineSigning {
+					log.Printf("preparing peg-out of export %x for offline signing: %d of %s to %s (fee %d) in %d tranche(s)", txid, payout, asset.String(), p.Exporter, fee, len(tranches))
+					err = c.authorizeTrustlines(ctx, p.payees(tranches[0]), payAsset)
+					if err != nil {
+						// Retried on the next pass.
+						log.Printf("authorizing exporter trustline of export %x: %s", txid, err)
+						continue
+					}
+					err = c.retryDB(ctx, "preparing peg-out", func(ctx context.Context) error {
+						_, err := c.preparePegOut(ctx, txid, p, asset, tranches, fee)
+						return err
+					})
+					if err != nil {
+						return err
 					}
-					if resultCodes.TransactionCode == xdr.TransactionResultCodeTxBadSeq.String() {
-						peggedOut = pegOutRetry
+					// The export awaits SubmitSignedPegOut.
+					continue
+				}
+				log.Printf("pegging out export %x: %d of %s to %s (fee %d) in %d tranche(s), returning %d stroops to %s", txid, payout, asset.String(), p.Exporter, fee, len(tranches), merged, p.owner())
+				spanCtx, span := c.startSpan(ctx, "slidechain.pegout", p.Trace)
+				span.SetAttribute("slidechain.export", hex.EncodeToString(txid))
+				var pending bool
+				zioncoinTx, pending, err = c.pegOut(spanCtx, txid, exporter, p.owner(), asset, tranches[0], conv, p.Recipients, tempID, xdr.SequenceNumber(p.Seqnum), p.memo(), c.pegOutBaseFee(p))
+				span.End(err)
+				if err == nil && conv != nil {
+					err := c.retryDB(ctx, "recording conversion", func(ctx context.Context) error {
+						return c.recordConversion(ctx, txid, asset, tranches[0], cost, *conv, zioncoinTx)
+					})
+					if err != nil {
+						return err
+					}
+				}
+				if err == nil {
+					paidXDR, paid := p.AssetXDR, tranches[0]
+					if conv != nil {
+						paidXDR, paid = p.ConvertAssetXDR, conv.Amount
+					}
+					for _, payee := range p.payees(paid) {
+						err := c.retryDB(ctx, "witnessing peg-out", func(ctx context.Context) error {
+							return c.witnessPegOut(ctx, txid, zioncoinTx, paidXDR, payee.Amount, payee.Destination)
+						})
+						if err != nil {
+							return err
+						}
+					}
+				}
+				if err != nil {
+					peggedOut = pegOutFailureState(txid, err)
+					if peggedOut == pegOutHeld {
+						reason := err.Error()
+						err := c.retryDB(ctx, "recording peg-out rejection", func(ctx context.Context) error {
+							return c.recordPegOutRejection(ctx, txid, reason)
+						})
+						if err != nil {
+							return err
+						}
+					}
+				} else if pending {
+					// Its fee is recorded, and any later tranches paid,
+					// once confirmPegOuts sees the tx applied.
+					peggedOut = pegOutPending
+				} else {
+					if len(tranches) > 1 {
+						// The remaining tranches are paid by watchPegOuts.
+						peggedOut = pegOutPartial
+					}
+					if fee > 0 {
+						err = c.retryDB(ctx, "recording fee", func(ctx context.Context) error {
+							return c.recordFee(ctx, txid, p.AssetXDR, fee)
+						})
+						if err != nil {
+							return err
+						}
 					}
 				}
 			}
-			p.State = peggedOut
-			result, err := c.DB.ExecContext(ctx, `UPDATE exports SET pegged_out=$1 WHERE txid=$2`, peggedOut, txid)
-			if err != nil {
-				log.Fatalf("updating pegged_out in export table: %s", err)
+			p.Version, peggedOut, err = c.recordExportOutcome(ctx, txid, p.Version, states[i], peggedOut, zioncoinTx)
+			if errors.Root(err) == errExportChanged {
+				// Finished concurrently.
+				continue
 			}
-			numAffected, err := result.RowsAffected()
 			if err != nil {
-				log.Fatalf("checking rows affected by update exports query for txid %x: %s", txid, err)
-			}
-			if numAffected != 1 {
-				log.Fatalf("got %d rows affected by update exports query for txid %x, want 1", numAffected, txid)
+				// The state is in the recovery log and is applied on a later pass.
+				// Until then the export is skipped, so it is not pegged out twice.
+				unrecorded[string(txid)] = true
+				continue
 			}
+			p.State = peggedOut
 			// Send peg-out info to goroutine for successes and non-retriable failures.
 			// The goroutine needs the txid to look up rows in the exports table, so it is stored in the peg-out struct.
 			if peggedOut == pegOutOK || peggedOut == pegOutFail {
 				p.TxID = txid
-				pegouts <- p
+				select {
+				case <-ctx.Done():
+					// finishPegOuts completes it on the next run.
+					return nil
+				case pegouts <- p:
+				}
 			}
 		}
+		c.setInFlight(nil)
+		// Including the exports deferred during this pass.
+		err = c.retryDB(ctx, "scheduling deferred exports", func(ctx context.Context) error {
+			return c.wakeForDeferredExports(ctx, nowMS)
+		})
+		if err != nil {
+			return err
+		}
+		err = c.settleDust(ctx, pegouts)
+		if err != nil {
+			return err
+		}
+		if awaitingTrust {
+			c.wakeForTrustlines()
+		}
+	}
+}
+
+// exportCheck is the outcome of checkExport:
+// what pegOutFromExports does with an export.
+type exportCheck int
+
+const (
+	// exportReady is an export ready to peg out.
+	exportReady exportCheck = iota
+
+	// exportRejected is an export whose peg-out fails,
+	// and whose funds are refunded on slidechain.
+	exportRejected
+
+	// exportUnchecked is an export whose check itself failed,
+	// e.g. with Horizon unreachable.
+	// It is checked again on the next pass.
+	exportUnchecked
+
+	// exportDust is an export held as dust (see FeePolicy.HoldDust).
+	exportDust
+
+	// exportNoTrust is an export awaiting its exporter's trustline
+	// (see AwaitTrustlines).
+	exportNoTrust
+)
+
+// checkExport checks export p, in the given state, before its peg-out,
+// which pays tranches of asset, as payAsset, under policy.
+// destReason and invalid are why the export's accounts or conversion,
+// or its payout, are invalid, if they are.
+// It returns what to do with the export and, unless it is ready, why;
+// for a ready export, it also returns the amount, in stroops,
+// that the merge of its temp account returns,
+// and the cost of its conversion, if any.
+func (c *Custodian) checkExport(p pegOut, asset, payAsset xdr.Asset, conv *Conversion, policy FeePolicy, tranches []int64, destReason string, invalid error, state pegOutState, numRetries int, recordedMS, nowMS int64) (check exportCheck, reason string, merged, cost int64) {
+	if state == pegOutRetry && c.pegOutRetriesExceeded(numRetries) {
+		// A peg-out tx that keeps failing, e.g. with a wedged sequence number,
+		// is not resubmitted forever.
+		return exportRejected, fmt.Sprintf("peg-out tx failed with a retryable error %d times", numRetries), 0, 0
+	}
+	if destReason != "" {
+		return exportRejected, destReason, 0, 0
+	}
+	if reason := checkPegOutRecipients(p, policy, tranches); reason != "" {
+		return exportRejected, reason, 0, 0
+	}
+	if policy.isDust(p.Amount) {
+		if policy.HoldDust {
+			return exportDust, "", 0, 0
+		}
+		return exportRejected, dustReason(p.Amount, policy), 0, 0
+	}
+	if invalid != nil {
+		return exportRejected, invalid.Error(), 0, 0
+	}
+	merged, reason, err := c.checkTempAccountMerge(p.TempAddr, p.owner(), c.pegOutBaseFee(p))
+	if err != nil {
+		return exportUnchecked, fmt.Sprintf("checking temp account: %s", err), 0, 0
+	}
+	if reason != "" {
+		// The peg-out tx would fail, consuming its preauth signer.
+		return exportRejected, reason, 0, 0
+	}
+	reason, err = c.checkPayeeTrustlines(p, payAsset)
+	if err != nil {
+		return exportUnchecked, fmt.Sprintf("checking exporter trustline: %s", err), 0, 0
+	}
+	if reason != "" && c.trustlineTimedOut(recordedMS, nowMS) {
+		return exportRejected, fmt.Sprintf("%s after %s", reason, c.trustlineTimeout), 0, 0
+	}
+	if reason != "" {
+		return exportNoTrust, reason, 0, 0
+	}
+	cost, reason, err = c.checkPegOutConversion(asset, tranches, conv)
+	if err != nil {
+		return exportUnchecked, fmt.Sprintf("pricing conversion: %s", err), 0, 0
+	}
+	if reason != "" {
+		return exportRejected, reason, 0, 0
+	}
+	return exportReady, "", merged, cost
+}
+
+// failExport records reason as why export txid failed to peg out,
+// retrying until it is recorded (see retryDB).
+func (c *Custodian) failExport(ctx context.Context, txid []byte, reason string) error {
+	return c.retryDB(ctx, "recording export failure", func(ctx context.Context) error {
+		return c.recordFailureReason(ctx, txid, reason)
+	})
+}
+
+// pegOut submits the peg-out tx for export txid,
+// after checking it with the custodian's validator, if any (see PegOutValidator),
+// paying exporter, or converting the payment to conv if it is not nil,
+// or dividing it among recips if they are not empty,
+// and merging the temp account to owner.
+// The tx carries memo, if not nil, as its hash memo,
+// and pays fee per operation (see pegOutBaseFee).
+// It returns the hex-encoded hash of the Zioncoin tx,
+// and whether the tx was accepted but not yet applied (see AsyncPegOuts).
+func (c *Custodian) pegOut(ctx context.Context, txid []byte, exporter xdr.AccountId, owner string, asset xdr.Asset, amount int64, conv *Conversion, recips []Recipient, tempID xdr.AccountId, seqnum xdr.SequenceNumber, memo []byte, fee int64) (string, bool, error) {
+	payAsset := asset
+	if conv != nil {
+		payAsset = conv.Asset
+	}
+	var err error
+	if len(recips) > 0 {
+		err = c.authorizeTrustlines(ctx, recips, payAsset)
+	} else {
+		err = c.authorizeTrustline(ctx, exporter, payAsset)
+	}
+	if err != nil {
+		return "", false, errors.Wrap(err, "authorizing exporter trustline")
+	}
+	tx, err := buildPegOutTx(c.AccountID.Address(), exporter.Address(), owner, tempID.Address(), c.network, asset, amount, conv, recips, seqnum, memo, fee, c.cosignPegOuts)
+	if err != nil {
+		return "", false, errors.Wrap(err, "building peg-out tx")
+	}
+	hash, err := tx.HashHex()
+	if err != nil {
+		return "", false, errors.Wrap(err, "hashing peg-out tx")
+	}
+	err = c.validatePegOut(ctx, txid, tx, hash)
+	if err != nil {
+		return "", false, err
+	}
+	// The custodian's signature authorizes the payment
+	// and, when it cosigns peg-outs (see CosignPegOuts),
+	// adds to the temp account's preauth signer.
+	pending, err := c.signAndSubmitPegOutTx(ctx, tx, hash)
+	if err != nil {
+		err = c.resolveUnknownSubmission(hash, err)
+	}
+	return hash, pending, errors.Wrap(err, "submitting peg-out tx")
+}
+
+// resolveUnknownSubmission resolves err, the failure of the submission of the tx with the given hash,
+// when it leaves the tx's fate unknown, as after a timeout,
+// by looking up the tx.
+// It returns nil if the tx was applied after all, and otherwise err.
+func (c *Custodian) resolveUnknownSubmission(hash string, err error) error {
+	if class, _ := classifyHorizonError(err); class != ClassUnknown {
+		return err
+	}
+	_, lookupErr := c.hclient.LoadTransaction(hash)
+	if lookupErr != nil {
+		log.Printf("looking up tx %s after its submission failed (%s): %s", hash, err, lookupErr)
+		return err
+	}
+	log.Printf("tx %s was applied although its submission failed: %s", hash, err)
+	return nil
+}
+
+// pegOutFailureState returns the state of export txid
+// after the submission of its peg-out tx failed with err:
+// pegOutHeld if the custodian's validator rejected the tx,
+// pegOutRetry if the tx had a bad sequence number or too low a fee,
+// or if the tx's fate is unknown and it was not found applied
+// (see resolveUnknownSubmission),
+// otherwise pegOutFail.
+// A peg-out tx resubmitted on retry is the same tx,
+// so it is applied at most once.
+func pegOutFailureState(txid []byte, err error) pegOutState {
+	if errors.Root(err) == errPegOutRejected {
+		log.Printf("holding export %x for review: %s", txid, err)
+		return pegOutHeld
+	}
+	class, opCodes := classifyHorizonError(err)
+	switch class {
+	case ClassRetryableSeq, ClassRetryableFee:
+		return pegOutRetry
+	case ClassUnknown:
+		log.Printf("peg-out tx of export %x not found after its submission failed, retrying: %s", txid, err)
+		return pegOutRetry
+	}
+	log.Printf("peg-out tx of export %x failed (%s, operation codes %v)", txid, class, opCodes)
+	return pegOutFail
+}
+
+// authorizeTrustline authorizes the exporter's trustline for asset
+// when the custodian is the asset's issuer and the asset is AUTH_REQUIRED,
+// so that the peg-out payment can be received.
+// It does nothing for other assets.
+// Authorizing a trustline that is already authorized is harmless.
+func (c *Custodian) authorizeTrustline(ctx context.Context, exporter xdr.AccountId, asset xdr.Asset) error {
+	var (
+		code   string
+		issuer xdr.AccountId
+	)
+	switch asset.Type {
+	case xdr.AssetTypeAssetTypeCreditAlphanum4:
+		code, issuer = string(asset.AlphaNum4.AssetCode[:]), asset.AlphaNum4.Issuer
+	case xdr.AssetTypeAssetTypeCreditAlphanum12:
+		code, issuer = string(asset.AlphaNum12.AssetCode[:]), asset.AlphaNum12.Issuer
+	default:
+		return nil
+	}
+	if issuer.Address() != c.AccountID.Address() {
+		return nil
+	}
+	account, err := c.hclient.LoadAccount(issuer.Address())
+	if err != nil {
+		return errors.Wrapf(err, "loading issuer account %s", issuer.Address())
+	}
+	if !account.Flags.AuthRequired {
+		return nil
+	}
+	tx, err := c.custodianTx(b.AllowTrust(
+		b.Trustor{Address: exporter.Address()},
+		b.AllowTrustAsset{Code: code},
+		b.Authorize{Value: true},
+	))
+	if err != nil {
+		return errors.Wrap(err, "building allow-trust tx")
+	}
+	hash, err := tx.HashHex()
+	if err != nil {
+		return errors.Wrap(err, "hashing allow-trust tx")
+	}
+	err = c.submitCustodianTx(ctx, tx, hash)
+	return errors.Wrapf(err, "submitting allow-trust tx for %s", exporter.Address())
+}
+
+// pegOutTxFee returns the fee of the peg-out tx built by buildPegOutTx
+// at base fee fee, which the temp account pays.
+// A cosigned peg-out tx also removes the custodian's signer.
+func pegOutTxFee(fee int64, cosigned bool) int64 {
+	if cosigned {
+		return 4 * fee
 	}
+	return 3 * fee
 }
 
-func (c *Custodian) pegOut(ctx context.Context, exporter xdr.AccountId, asset xdr.Asset, amount int64, tempID xdr.AccountId, seqnum xdr.SequenceNumber) error {
-	tx, err := buildPegOutTx(c.AccountID.Address(), exporter.Address(), tempID.Address(), c.network, asset, amount, seqnum)
+// pegOutTxOps returns the number of operations in the peg-out tx
+// that pays amount of asset to exporter,
+// or divides it among recips if they are not empty,
+// from a temp account owned by owner.
+// Their number does not depend on the temp account,
+// so the custodian's account stands in for it.
+func pegOutTxOps(custodian, exporter, owner, network string, asset xdr.Asset, amount int64, recips []Recipient, cosigned bool) (int, error) {
+	tx, err := buildPegOutTx(custodian, exporter, owner, custodian, network, asset, amount, nil, recips, 0, nil, baseFee, cosigned)
 	if err != nil {
-		return errors.Wrap(err, "building peg-out tx")
+		return 0, errors.Wrap(err, "building peg-out tx")
 	}
-	_, err = zioncoin.SignAndSubmitTx(c.hclient, tx, c.seed)
-	return errors.Wrap(err, "submitting peg-out tx")
+	return len(tx.TX.Operations), nil
 }
 
-func buildPegOutTx(custodianAddr, exporterAddr, tempAddr, network string, asset xdr.Asset, amount int64, seqnum xdr.SequenceNumber) (*b.TransactionBuilder, error) {
+// buildPegOutTx builds the peg-out tx for an export,
+// which pays the exporter and returns the temp account's lumens to its owner.
+// If cosigned is true,
+// the custodian is also a signer of the temp account (see PreExportOptions.Cosigned),
+// and the tx removes that signer too.
+// If conv is not nil,
+// the exporter is paid conv instead,
+// bought with at most amount of asset.
+// If recips are not empty,
+// amount is instead divided among them,
+// one payment each, all succeeding or failing together.
+// If memo is not nil,
+// the tx carries it, an export's 32-byte anchor, as its hash memo
+// (see ExportOptions.MemoAnchor).
+// A temp account that is its own owner
+// is the exporter's own account (see PreExportOptions.OwnAccount),
+// which the tx leaves in place.
+// The tx pays base fee fee per operation.
+func buildPegOutTx(custodianAddr, exporterAddr, ownerAddr, tempAddr, network string, asset xdr.Asset, amount int64, conv *Conversion, recips []Recipient, seqnum xdr.SequenceNumber, memo []byte, fee int64, cosigned bool) (*b.TransactionBuilder, error) {
+	paymentOps := []b.TransactionMutator{buildPaymentOp(custodianAddr, exporterAddr, asset, amount)}
+	if conv != nil {
+		if len(recips) > 0 {
+			return nil, errors.New("cannot convert a payout to several recipients")
+		}
+		paymentOps = []b.TransactionMutator{buildPathPaymentOp(custodianAddr, exporterAddr, asset, amount, *conv)}
+	}
+	if len(recips) > 0 {
+		var err error
+		paymentOps, err = buildRecipientPaymentOps(custodianAddr, asset, amount, recips)
+		if err != nil {
+			return nil, err
+		}
+	}
+	muts := []b.TransactionMutator{
+		b.Network{Passphrase: network},
+		b.SourceAccount{AddressOrSeed: tempAddr},
+		b.Sequence{Sequence: uint64(seqnum) + 1},
+		b.BaseFee{Amount: uint64(fee)},
+	}
+	if memo != nil {
+		var hash xdr.Hash
+		if len(memo) != len(hash) {
+			return nil, fmt.Errorf("memo of %d bytes, want %d", len(memo), len(hash))
+		}
+		copy(hash[:], memo)
+		muts = append(muts, b.MemoHash{Value: hash})
+	}
+	// The owner's signer on the temp account (see CancelPreExport),
+	// and the custodian's if any,
+	// must be removed before the account can be merged.
+	if cosigned {
+		muts = append(muts, b.SetOptions(
+			b.SourceAccount{AddressOrSeed: tempAddr},
+			b.RemoveSigner(custodianAddr),
+		))
+	}
+	if ownerAddr != tempAddr {
+		removeOwnerOp := b.SetOptions(
+			b.SourceAccount{AddressOrSeed: tempAddr},
+			b.RemoveSigner(ownerAddr),
+		)
+		mergeAccountOp := b.AccountMerge(
+			b.Destination{AddressOrSeed: ownerAddr},
+		)
+		muts = append(muts, removeOwnerOp, mergeAccountOp)
+	}
+	muts = append(muts, paymentOps...)
+	return b.Transaction(muts...)
+}
+
+// buildPaymentOp builds the payment of amount of asset
+// from the custodian's account to the exporter's.
+// An asset of an unknown type makes an op
+// whose error is returned by the tx builder.
+func buildPaymentOp(custodianAddr, exporterAddr string, asset xdr.Asset, amount int64) b.PaymentBuilder {
+	// The amount is in stroops, as in the peg-in payment and the export.
+	// XDR scales down an amount unit of every asset by a factor of 10^7,
+	// so the Horizon amount string is computed the same way
+	// for native and non-native assets.
+	horizonAmount := xlm.Amount(amount).HorizonString()
 	var paymentOp b.PaymentBuilder
 	switch asset.Type {
 	case xdr.AssetTypeAssetTypeNative:
-		lumens := xlm.Amount(amount)
 		paymentOp = b.Payment(
 			b.SourceAccount{AddressOrSeed: custodianAddr},
 			b.Destination{AddressOrSeed: exporterAddr},
-			b.NativeAmount{Amount: lumens.HorizonString()},
+			b.NativeAmount{Amount: horizonAmount},
 		)
 	case xdr.AssetTypeAssetTypeCreditAlphanum4:
 		paymentOp = b.Payment(
@@ -216,7 +987,7 @@ func buildPegOutTx(custodianAddr, exporterAddr, tempAddr, network string, asset
 			b.CreditAmount{
 				Code:   string(asset.AlphaNum4.AssetCode[:]),
 				Issuer: asset.AlphaNum4.Issuer.Address(),
-				Amount: strconv.FormatInt(amount, 10),
+				Amount: horizonAmount,
 			},
 		)
 	case xdr.AssetTypeAssetTypeCreditAlphanum12:
@@ -226,27 +997,46 @@ func buildPegOutTx(custodianAddr, exporterAddr, tempAddr, network string, asset
 			b.CreditAmount{
 				Code:   string(asset.AlphaNum12.AssetCode[:]),
 				Issuer: asset.AlphaNum12.Issuer.Address(),
-				Amount: strconv.FormatInt(amount, 10),
+				Amount: horizonAmount,
 			},
 		)
+	default:
+		// Building a tx with the op fails with this error,
+		// rather than with a malformed payment.
+		paymentOp = b.PaymentBuilder{Err: fmt.Errorf("unsupported asset type %v", asset.Type)}
 	}
-	mergeAccountOp := b.AccountMerge(
-		b.Destination{AddressOrSeed: exporterAddr},
-	)
-	return b.Transaction(
-		b.Network{Passphrase: network},
-		b.SourceAccount{AddressOrSeed: tempAddr},
-		b.Sequence{Sequence: uint64(seqnum) + 1},
-		b.BaseFee{Amount: baseFee},
-		mergeAccountOp,
-		paymentOp,
-	)
+	return paymentOp
+}
+
+// tempAccountSubentries is the number of subentries
+// of a temp account set up by SubmitPreExportTx:
+// its preauth signer and its owner's signer.
+const tempAccountSubentries = 2
+
+// tempAccountFeeBuffer is funding of a temp account
+// beyond its minimum balance and the fee of its peg-out tx.
+// It covers a rise in the base reserve of up to one reserve per subentry,
+// or the larger fee of a cancellation tx.
+// Like the rest of the temp account's lumens,
+// it is returned to the owner when the account is merged.
+const tempAccountFeeBuffer = DefaultBaseReserve
+
+// tempAccountFunding returns the lumens, in stroops,
+// with which to create a temp account that will have the given number of subentries
+// and pay for a peg-out tx of the given number of operations:
+// its minimum balance at baseReserve,
+// plus the peg-out fee at base fee fee,
+// plus tempAccountFeeBuffer.
+func tempAccountFunding(baseReserve, fee int64, subentries, ops int) int64 {
+	return int64(2+subentries)*baseReserve + int64(ops)*fee + tempAccountFeeBuffer
 }
 
 // createTempAccount builds and submits a transaction to the Zioncoin
-// network that creates a new temporary account. It returns the
-// temporary account keypair and sequence number.
-func createTempAccount(hclient equator.ClientInterface, kp *keypair.Full) (*keypair.Full, xdr.SequenceNumber, error) {
+// network that creates a new temporary account funded with funding stroops,
+// paying base fee fee.
+// If memo is not empty, it is the transaction's text memo.
+// It returns the temporary account keypair and sequence number.
+func createTempAccount(hclient equator.ClientInterface, kp *keypair.Full, funding, fee int64, memo string) (*keypair.Full, xdr.SequenceNumber, error) {
 	root, err := hclient.Root()
 	if err != nil {
 		return nil, 0, errors.Wrap(err, "getting Horizon root")
@@ -255,16 +1045,20 @@ func createTempAccount(hclient equator.ClientInterface, kp *keypair.Full) (*keyp
 	if err != nil {
 		return nil, 0, errors.Wrap(err, "generating random account")
 	}
-	tx, err := b.Transaction(
+	muts := []b.TransactionMutator{
 		b.Network{Passphrase: root.NetworkPassphrase},
 		b.SourceAccount{AddressOrSeed: kp.Address()},
 		b.AutoSequence{SequenceProvider: hclient},
-		b.BaseFee{Amount: baseFee},
+		b.BaseFee{Amount: uint64(fee)},
 		b.CreateAccount(
-			b.NativeAmount{Amount: (2 * xlm.Lumen).HorizonString()},
+			b.NativeAmount{Amount: xlm.Amount(funding).HorizonString()},
 			b.Destination{AddressOrSeed: tempKP.Address()},
 		),
-	)
+	}
+	if memo != "" {
+		muts = append(muts, b.MemoText{Value: memo})
+	}
+	tx, err := b.Transaction(muts...)
 	if err != nil {
 		return nil, 0, errors.Wrap(err, "building temp account creation tx")
 	}
@@ -279,49 +1073,285 @@ func createTempAccount(hclient equator.ClientInterface, kp *keypair.Full) (*keyp
 	return tempKP, seqnum, nil
 }
 
+// PegOutParams are the inputs to a peg-out transaction.
+type PegOutParams struct {
+	Custodian string             // the custodian's Zioncoin account ID
+	Exporter  string             // the exporter's Zioncoin account ID, which receives the payout
+	Owner     string             // the account that funded TempAddr, if not Exporter
+	TempAddr  string             // the temporary account created by SubmitPreExportTx
+	Network   string             // the Zioncoin network passphrase
+	Asset     xdr.Asset          // the pegged-out asset
+	Amount    int64              // the payout, net of any custodian fee, in stroops (the first tranche, if split)
+	Seqnum    xdr.SequenceNumber // the temporary account's sequence number
+	Cosigned  bool               // whether the custodian is a signer of TempAddr (see PreExportOptions.Cosigned)
+	BaseFee   int64              // the custodian's base fee, in stroops per operation (default 100; see BaseFee)
+
+	// Conversion, if not nil, is paid to Exporter instead,
+	// bought with at most Amount of Asset (see ExportOptions.Conversion).
+	Conversion *Conversion
+
+	// Recipients, if not empty, divide Amount among themselves
+	// instead of it being paid to Exporter
+	// (see ExportOptions.Recipients).
+	Recipients []Recipient
+
+	// MemoAnchor, if not nil, is the export's anchor,
+	// which the tx carries as its hash memo (see ExportOptions.MemoAnchor).
+	// It is the anchor of the retired funds,
+	// as returned by ExportAnchor, not of the spent input.
+	MemoAnchor []byte
+}
+
+// ComputePegOutPreauthHash returns the strkey-encoded hash of the peg-out transaction
+// described by params.
+// SubmitPreExportTx adds this hash as the temporary account's preauth signer,
+// so an exporter can check the signer on the Zioncoin network against it
+// before retiring funds on slidechain.
+func ComputePegOutPreauthHash(params PegOutParams) (string, error) {
+	owner := params.Owner
+	if owner == "" {
+		owner = params.Exporter
+	}
+	fee := params.BaseFee
+	if fee == 0 {
+		fee = baseFee
+	}
+	tx, err := buildPegOutTx(params.Custodian, params.Exporter, owner, params.TempAddr, params.Network, params.Asset, params.Amount, params.Conversion, params.Recipients, params.Seqnum, params.MemoAnchor, fee, params.Cosigned)
+	if err != nil {
+		return "", errors.Wrap(err, "building peg-out tx")
+	}
+	hash, err := tx.Hash()
+	if err != nil {
+		return "", errors.Wrap(err, "hashing peg-out tx")
+	}
+	hashStr, err := strkey.Encode(strkey.VersionByteHashTx, hash[:])
+	return hashStr, errors.Wrap(err, "encoding peg-out tx hash")
+}
+
 // SubmitPreExportTx builds and submits the two pre-export transactions
 // to the Zioncoin network.
 // The first transaction creates a new temporary account.
-// The second transaction sets the signer on the temporary account
-// to be a preauth transaction, which merges the account and pays
-// out the pegged-out funds.
+// The second transaction sets the signers on the temporary account:
+// a preauth transaction, which merges the account and pays
+// out the pegged-out funds,
+// and the exporter's own key, which can cancel the export (see CancelPreExport).
+// The amount is the payout,
+// i.e. the exported amount net of any custodian fee (see FeePolicy.Payout),
+// or the first tranche of the payout if the custodian splits it (see FeePolicy.Split).
+// The payout goes to the exporter's own account, kp.
 // The function returns the temporary account address and sequence number.
+// It is SubmitPreExportTxWithOptions with the zero PreExportOptions,
+// so the temporary account is not tracked:
+// if the export is never made or is refunded,
+// only the exporter's own CancelPreExport recovers its lumens,
+// and TempAccounts.Reclaim never finds it.
 func SubmitPreExportTx(hclient equator.ClientInterface, kp *keypair.Full, custodian string, asset xdr.Asset, amount int64) (string, xdr.SequenceNumber, error) {
+	return SubmitPreExportTxWithOptions(hclient, kp, custodian, asset, amount, PreExportOptions{})
+}
+
+// PreExportOptions are the optional settings of a pre-export
+// (see SubmitPreExportTxWithOptions).
+// Each must match the corresponding setting of the export tx
+// (see ExportOptions),
+// or the peg-out tx differs from the one the temp account preauthorizes,
+// and the export is refunded on slidechain.
+type PreExportOptions struct {
+	// Destination, if not empty, is the Zioncoin account
+	// to which the payout goes,
+	// instead of the exporter's own account.
+	Destination string
+
+	// Conversion, if not nil, is paid to the destination instead,
+	// bought with at most the payout of the exported asset
+	// (see ExportOptions.Conversion).
+	Conversion *Conversion
+
+	// Recipients, if not empty, divide the payout among themselves
+	// instead of it going to the destination
+	// (see ExportOptions.Recipients).
+	// Their amounts must add up to the payout.
+	Recipients []Recipient
+
+	// MemoAnchor, if not nil, is the anchor of the exported funds,
+	// as returned by ExportAnchor,
+	// which the peg-out tx carries as its hash memo
+	// (see ExportOptions.MemoAnchor).
+	MemoAnchor []byte
+
+	// Cosigned also makes the custodian a signer of the temporary account,
+	// whose thresholds then need both the preauth transaction and the custodian's signature:
+	// the payout happens only when the custodian signs the peg-out transaction.
+	// It is for exports to custodians that cosign peg-outs (see CosignPegOuts).
+	// The exporter's own key still suffices to cancel the export.
+	Cosigned bool
+
+	// OwnAccount uses the exporter's own account as the temporary account
+	// instead of creating and funding a new one,
+	// saving the exporter a transaction and the new account's reserve.
+	// The peg-out transaction leaves the account in place for the next export.
+	// The account must exist, with lumens for the fees,
+	// and should be dedicated to exports:
+	// any other transaction from it changes its sequence number,
+	// so that the peg-out fails and the export is refunded on slidechain,
+	// and each pre-export voids any earlier one
+	// whose peg-out has not happened.
+	// It cannot be combined with Conversion, Recipients, MemoAnchor, or Cosigned.
+	OwnAccount bool
+
+	// BaseFee, if positive, is the base fee, in stroops per operation,
+	// of the custodian to which the pre-export is made (see the BaseFee option),
+	// which the preauthorized peg-out tx must pay.
+	// Slidechaind publishes it at /fees/base (see BaseFeeHandler).
+	// It is also the base fee of the pre-export txs.
+	// If zero, the default of 100 is used,
+	// and the peg-out fails if the custodian's base fee is higher.
+	BaseFee int64
+
+	// Memo, if not empty, is the text memo
+	// of the transactions creating and setting up the temp account,
+	// such as a deployment tag,
+	// by which to find them on a block explorer.
+	// It is at most 28 bytes.
+	// Peg-ins are matched to pegs by the hash memos
+	// of payments to the custodian account,
+	// which these transactions never are.
+	Memo string
+
+	// Limiter, if not nil, limits the pre-export
+	// instead of the default TempAccountLimiter.
+	Limiter *TempAccountLimiter
+
+	// TempAccounts, if not nil, tracks the temp account of the pre-export
+	// until it is merged, reclaimed, or canceled through it.
+	// If nil, the temp account is not tracked anywhere,
+	// and an abandoned one must be canceled with CancelPreExport.
+	TempAccounts *TempAccounts
+}
+
+// fee returns the base fee of opts.
+func (opts PreExportOptions) fee() int64 {
+	if opts.BaseFee > 0 {
+		return opts.BaseFee
+	}
+	return baseFee
+}
+
+// SubmitPreExportTxWithOptions is like SubmitPreExportTx,
+// with the settings in opts.
+func SubmitPreExportTxWithOptions(hclient equator.ClientInterface, kp *keypair.Full, custodian string, asset xdr.Asset, amount int64, opts PreExportOptions) (string, xdr.SequenceNumber, error) {
+	if len(opts.Recipients) > 0 {
+		if opts.Destination != "" || opts.Conversion != nil {
+			return "", 0, errors.New("cannot combine recipients with a destination or conversion")
+		}
+		total, err := recipientsTotal(opts.Recipients)
+		if err != nil {
+			return "", 0, err
+		}
+		if total != amount {
+			return "", 0, fmt.Errorf("recipient amounts add up to %d, not the payout %d", total, amount)
+		}
+	}
+	if opts.OwnAccount {
+		if opts.Conversion != nil || len(opts.Recipients) > 0 || opts.MemoAnchor != nil || opts.Cosigned {
+			return "", 0, errors.New("cannot combine an own-account pre-export with a conversion, recipients, memo anchor, or cosigner")
+		}
+		// No temp account is created,
+		// so it is neither limited nor tracked.
+		return submitAccountPreExportTx(hclient, kp, custodian, asset, amount, opts)
+	}
+	limiter := opts.Limiter
+	if limiter == nil {
+		limiter = defaultTempAccountLimiter
+	}
+	return limiter.submit(hclient, kp, opts.TempAccounts, func() (string, xdr.SequenceNumber, error) {
+		return submitPreExportTx(hclient, kp, custodian, asset, amount, opts)
+	})
+}
+
+// submitPreExportTx does the work of SubmitPreExportTxWithOptions
+// for a new temp account.
+func submitPreExportTx(hclient equator.ClientInterface, kp *keypair.Full, custodian string, asset xdr.Asset, amount int64, opts PreExportOptions) (string, xdr.SequenceNumber, error) {
+	if len(opts.Memo) > b.MemoTextMaxLength {
+		return "", 0, fmt.Errorf("memo %q is longer than %d bytes", opts.Memo, b.MemoTextMaxLength)
+	}
+	fee := opts.fee()
+	destination, err := exportDestination(kp, opts.Destination)
+	if err != nil {
+		return "", 0, err
+	}
 	root, err := hclient.Root()
 	if err != nil {
 		return "", 0, errors.Wrap(err, "getting Horizon root")
 	}
 
-	tempKP, seqnum, err := createTempAccount(hclient, kp)
+	// The temp account pays for the peg-out tx,
+	// so its funding depends on the tx's operations.
+	ops, err := pegOutTxOps(custodian, destination, kp.Address(), root.NetworkPassphrase, asset, amount, opts.Recipients, opts.Cosigned)
 	if err != nil {
-		return "", 0, errors.Wrap(err, "creating temp account")
+		return "", 0, err
 	}
-
-	preauthTx, err := buildPegOutTx(custodian, kp.Address(), tempKP.Address(), root.NetworkPassphrase, asset, amount, seqnum)
-	if err != nil {
-		return "", 0, errors.Wrap(err, "building preauth tx")
+	subentries := tempAccountSubentries
+	if opts.Cosigned {
+		// The custodian's signer.
+		subentries++
 	}
-	preauthTxHash, err := preauthTx.Hash()
+	tempKP, seqnum, err := createTempAccount(hclient, kp, tempAccountFunding(DefaultBaseReserve, fee, subentries, ops), fee, opts.Memo)
 	if err != nil {
-		return "", 0, errors.Wrap(err, "hashing preauth tx")
+		return "", 0, errors.Wrap(err, "creating temp account")
 	}
-	hashStr, err := strkey.Encode(strkey.VersionByteHashTx, preauthTxHash[:])
+
+	hashStr, err := ComputePegOutPreauthHash(PegOutParams{
+		Custodian:  custodian,
+		Exporter:   destination,
+		Owner:      kp.Address(),
+		TempAddr:   tempKP.Address(),
+		Network:    root.NetworkPassphrase,
+		Asset:      asset,
+		Amount:     amount,
+		Seqnum:     seqnum,
+		Cosigned:   opts.Cosigned,
+		BaseFee:    fee,
+		Conversion: opts.Conversion,
+		Recipients: opts.Recipients,
+		MemoAnchor: opts.MemoAnchor,
+	})
 	if err != nil {
-		return "", 0, errors.Wrap(err, "encoding preauth tx hash")
+		return "", 0, errors.Wrap(err, "computing preauth tx hash")
 	}
 
-	tx, err := b.Transaction(
+	// The preauth signer alone meets the thresholds,
+	// or, if cosigned, together with the custodian's signer.
+	// The owner's signer meets them alone either way.
+	threshold := uint32(1)
+	if opts.Cosigned {
+		threshold = 2
+	}
+	muts := []b.TransactionMutator{
 		b.Network{Passphrase: root.NetworkPassphrase},
 		b.SourceAccount{AddressOrSeed: kp.Address()},
 		b.AutoSequence{SequenceProvider: hclient},
-		b.BaseFee{Amount: baseFee},
+		b.BaseFee{Amount: uint64(fee)},
 		b.SetOptions(
 			b.SourceAccount{AddressOrSeed: tempKP.Address()},
 			b.MasterWeight(0),
-			b.SetThresholds(1, 1, 1),
+			b.SetThresholds(threshold, threshold, threshold),
 			b.AddSigner(hashStr, 1),
 		),
-	)
+		b.SetOptions(
+			b.SourceAccount{AddressOrSeed: tempKP.Address()},
+			b.AddSigner(kp.Address(), threshold),
+		),
+	}
+	if opts.Cosigned {
+		muts = append(muts, b.SetOptions(
+			b.SourceAccount{AddressOrSeed: tempKP.Address()},
+			b.AddSigner(custodian, 1),
+		))
+	}
+	if opts.Memo != "" {
+		muts = append(muts, b.MemoText{Value: opts.Memo})
+	}
+	tx, err := b.Transaction(muts...)
 	if err != nil {
 		return "", 0, errors.Wrap(err, "building pre-export tx")
 	}
@@ -332,84 +1362,492 @@ func SubmitPreExportTx(hclient equator.ClientInterface, kp *keypair.Full, custod
 	return tempKP.Address(), seqnum, nil
 }
 
+// CancelPreExport unwinds a pre-export made by SubmitPreExportTx,
+// merging the temporary account, and its lumens, back to the exporter.
+// It uses the exporter's signer on the temporary account,
+// so is possible from the time SubmitPreExportTx returns
+// until the custodian's peg-out transaction merges the account.
+// Cancelling after retiring funds on slidechain with BuildExportTx
+// makes the peg-out fail, and the custodian refunds the retired funds on slidechain.
+// Empty trustlines added to the temporary account are removed before the merge.
+// Temporary accounts created before exporters were made signers cannot be cancelled.
+func CancelPreExport(hclient equator.ClientInterface, kp *keypair.Full, tempAddr string) error {
+	root, err := hclient.Root()
+	if err != nil {
+		return errors.Wrap(err, "getting Horizon root")
+	}
+	account, err := hclient.LoadAccount(tempAddr)
+	if err != nil {
+		return errors.Wrapf(err, "loading temp account %s", tempAddr)
+	}
+	var (
+		isSigner      bool
+		removeSigners []b.TransactionMutator
+	)
+	for _, signer := range account.Signers {
+		if signer.Key == tempAddr {
+			// The master key, already of weight zero.
+			continue
+		}
+		if signer.Key == kp.Address() {
+			isSigner = signer.Weight > 0
+			continue
+		}
+		removeSigners = append(removeSigners, b.SetOptions(
+			b.SourceAccount{AddressOrSeed: tempAddr},
+			b.RemoveSigner(signer.Key),
+		))
+	}
+	if !isSigner {
+		return fmt.Errorf("%s is not a signer of temp account %s", kp.Address(), tempAddr)
+	}
+	// Trustlines added to the temp account must also be removed before the merge.
+	var removeTrustlines []b.TransactionMutator
+	for _, balance := range account.Balances {
+		if balance.Type == "native" {
+			continue
+		}
+		if bal, err := amount.ParseInt64(balance.Balance); err != nil || bal != 0 {
+			return fmt.Errorf("temp account %s holds %s of %s:%s, which must be sent elsewhere before cancelling", tempAddr, balance.Balance, balance.Code, balance.Issuer)
+		}
+		removeTrustlines = append(removeTrustlines, b.RemoveTrust(
+			balance.Code,
+			balance.Issuer,
+			b.SourceAccount{AddressOrSeed: tempAddr},
+		))
+	}
+	muts := []b.TransactionMutator{
+		b.Network{Passphrase: root.NetworkPassphrase},
+		b.SourceAccount{AddressOrSeed: tempAddr},
+		b.AutoSequence{SequenceProvider: hclient},
+		b.BaseFee{Amount: baseFee},
+	}
+	muts = append(muts, removeTrustlines...)
+	muts = append(muts, removeSigners...)
+	muts = append(muts,
+		b.SetOptions(
+			b.SourceAccount{AddressOrSeed: tempAddr},
+			b.RemoveSigner(kp.Address()),
+		),
+		b.AccountMerge(b.Destination{AddressOrSeed: kp.Address()}),
+	)
+	tx, err := b.Transaction(muts...)
+	if err != nil {
+		return errors.Wrap(err, "building cancellation tx")
+	}
+	_, err = zioncoin.SignAndSubmitTx(hclient, tx, kp.Seed())
+	return errors.Wrap(err, "submitting cancellation tx")
+}
+
+// exportDestination returns the Zioncoin account to which an export by kp pegs out:
+// destination, if it is not empty, otherwise kp's own account.
+func exportDestination(kp keypair.KP, destination string) (string, error) {
+	if destination == "" {
+		return kp.Address(), nil
+	}
+	_, err := strkey.Decode(strkey.VersionByteAccountID, destination)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid destination account %q", destination)
+	}
+	return destination, nil
+}
+
 // BuildExportTx builds a txvm retirement tx for an asset issued
 // onto slidechain. It will retire `amount` of the asset, and the
 // remaining input will be output back to the original account.
+// The retired funds are pegged out to the Zioncoin account of the spending key prv,
+// which signs the tx.
+// The export names no custodian,
+// so it is pegged out by the first custodian sharing the db to record it.
+// It is BuildExportTxWithOptions with the zero ExportOptions.
 func BuildExportTx(ctx context.Context, asset xdr.Asset, exportAmt, inputAmt int64, tempAddr string, anchor []byte, prv ed25519.PrivateKey, seqnum xdr.SequenceNumber) (*bc.Tx, error) {
+	tx, _, err := BuildExportTxWithOptions(ctx, asset, exportAmt, inputAmt, tempAddr, anchor, prv, seqnum, ExportOptions{})
+	return tx, err
+}
+
+// ExportOptions are the optional settings of an export tx
+// (see BuildExportTxWithOptions).
+// Those affecting the peg-out tx
+// must match the pre-export's (see PreExportOptions).
+type ExportOptions struct {
+	// Destination, if not empty, is the Zioncoin account
+	// to which the retired funds are pegged out,
+	// instead of the account of the spending key.
+	// The tx is still signed by the spending key.
+	Destination string
+
+	// Expiration, if not zero,
+	// makes the tx valid only in blocks no later than it:
+	// a block builder refuses it after then,
+	// and the custodian does not peg out an export
+	// that it finds in a later block.
+	Expiration time.Time
+
+	// Window, if positive, makes the export reversible:
+	// the custodian does not peg out the export
+	// until Window has passed since the tx is included in a block.
+	// Until then the exporter may cancel the export with CancelExport,
+	// and the retired funds are returned to it on slidechain.
+	Window time.Duration
+
+	// Custodian, if not empty,
+	// is the Zioncoin account of the only custodian to peg out the export.
+	Custodian string
+
+	// Metadata, if not empty, is carried in the export's refdata
+	// and must be JSON of at most MaxPegMetadata bytes.
+	Metadata json.RawMessage
+
+	// RetireAll exports the whole input, whatever the export amount,
+	// leaving no change.
+	RetireAll bool
+
+	// Version, if not zero, is the txvm version of the tx,
+	// which must be one the custodian supports
+	// (by default, DefaultTxVersion).
+	Version int64
+
+	// Format, if not empty, is the encoding of the export's refdata
+	// (by default, DefaultRefdataFormat).
+	// RefdataBinary makes the tx smaller
+	// and its refdata bytes deterministic.
+	// The custodian decodes refdata in any format.
+	Format RefdataFormat
+
+	// Conversion, if not nil, asks the custodian to pay it out
+	// instead of the exported asset (see Conversion).
+	// The custodian refuses conversions it does not permit (see Conversions),
+	// and the retired funds are then refunded on slidechain.
+	Conversion *Conversion
+
+	// Recipients, if not empty, asks the custodian
+	// to divide the payout among them,
+	// at most MaxRecipients of them,
+	// with a payment to each in the one peg-out tx,
+	// so that either all are paid or none is.
+	// Their amounts must add up to the payout,
+	// the exported amount net of any custodian fee (see FeePolicy.Payout).
+	// The custodian refuses to divide a payout it would split into tranches,
+	// and the retired funds are then refunded on slidechain.
+	Recipients []Recipient
+
+	// MemoAnchor asks the custodian to give the peg-out tx a hash memo
+	// of the export's anchor, ExportAnchor(anchor),
+	// so that the exporter can tell which export a payment is for
+	// by the memo alone.
+	// It cannot be combined with binary refdata.
+	MemoAnchor bool
+
+	// ChangePubkey, if not empty, is paid the change instead of prv's key,
+	// such as a cold custody key while a hot key signs the spend.
+	// The export itself is still signed with prv,
+	// whose key the refdata records as the exporter's,
+	// and the peg-out and any refund are unaffected.
+	ChangePubkey ed25519.PublicKey
+
+	// BaseFee, if positive, is the base fee the export was pre-exported with
+	// (see PreExportOptions.BaseFee),
+	// which the refdata records so that the custodian pegs it out with that fee
+	// even if its own base fee changes in the meantime.
+	// If zero, the custodian uses its base fee when it records the export.
+	BaseFee int64
+}
+
+// BuildExportTxWithOptions is like BuildExportTx,
+// with the settings in opts.
+// When inputAmt exceeds exportAmt,
+// it also returns the anchor of the change,
+// with which it can be spent;
+// otherwise the change anchor is nil.
+func BuildExportTxWithOptions(ctx context.Context, asset xdr.Asset, exportAmt, inputAmt int64, tempAddr string, anchor []byte, prv ed25519.PrivateKey, seqnum xdr.SequenceNumber, opts ExportOptions) (*bc.Tx, []byte, error) {
+	pubkey := prv.Public().(ed25519.PublicKey)
+	prog1, version, txid, changeAnchor, err := prepareExportTx(asset, exportAmt, inputAmt, tempAddr, anchor, pubkey, seqnum, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	sig := ed25519.Sign(prv, exportSigMsg(txid, anchor))
+	tx, err := finishExportTx(prog1, version, sig)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tx, changeAnchor, nil
+}
+
+// DefaultTxVersion is the default txvm version of export txs
+// (see ExportOptions.Version).
+const DefaultTxVersion = 3
+
+// supportedTxVersions are the txvm versions
+// of the export txs the custodian recognizes.
+var supportedTxVersions = []int64{DefaultTxVersion}
+
+// checkTxVersion returns an error if version is not in supportedTxVersions.
+func checkTxVersion(version int64) error {
+	for _, v := range supportedTxVersions {
+		if version == v {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported txvm version %d (supported versions: %v)", version, supportedTxVersions)
+}
+
+// ExportAnchor returns the anchor of the funds an export tx retires
+// when it spends the input with anchor.
+// It is the anchor recorded in the export's refdata,
+// and the hash memo of its peg-out tx if memoed (see ExportOptions.MemoAnchor).
+func ExportAnchor(anchor []byte) []byte {
+	// The exported value is split off of the input, leaving the change,
+	// and a zero value is split off of it for finalize.
+	retireAnchor1 := txvm.VMHash("Split2", anchor)
+	retireAnchor := txvm.VMHash("Split1", retireAnchor1[:])
+	return retireAnchor[:]
+}
+
+// prepareExportTx builds the program of an export tx,
+// spending the input with anchor held by pubkey,
+// up to the point requiring the exporter's signature.
+// It returns the program, its txvm version, the ID of the tx,
+// and the anchor of the change, if any,
+// which is paid to opts.ChangePubkey, or to pubkey if it is empty.
+// The signature is on exportSigMsg(txid, anchor).
+func prepareExportTx(asset xdr.Asset, exportAmt, inputAmt int64, tempAddr string, anchor []byte, pubkey ed25519.PublicKey, seqnum xdr.SequenceNumber, opts ExportOptions) (prog1 []byte, version int64, txid, changeAnchor []byte, err error) {
+	format := opts.Format
+	if format == "" {
+		format = DefaultRefdataFormat
+	}
+	version = opts.Version
+	if version == 0 {
+		version = DefaultTxVersion
+	}
+	err = checkTxVersion(version)
+	if err != nil {
+		return nil, 0, nil, nil, err
+	}
+	if len(pubkey) != ed25519.PublicKeySize {
+		return nil, 0, nil, nil, fmt.Errorf("invalid public key length %d", len(pubkey))
+	}
+	changePubkey := opts.ChangePubkey
+	if len(changePubkey) == 0 {
+		changePubkey = pubkey
+	} else if len(changePubkey) != ed25519.PublicKeySize {
+		return nil, 0, nil, nil, fmt.Errorf("invalid change public key length %d", len(changePubkey))
+	}
+	err = checkRefdataFormat(format)
+	if err != nil {
+		return nil, 0, nil, nil, err
+	}
+	if opts.MemoAnchor && format == RefdataBinary {
+		return nil, 0, nil, nil, errors.New("cannot memo a peg-out with binary refdata")
+	}
+	if opts.RetireAll {
+		exportAmt = inputAmt
+	}
 	if inputAmt < exportAmt {
-		return nil, fmt.Errorf("cannot have input amount %d less than export amount %d", inputAmt, exportAmt)
+		return nil, 0, nil, nil, fmt.Errorf("cannot have input amount %d less than export amount %d", inputAmt, exportAmt)
+	}
+	if opts.Window < 0 {
+		return nil, 0, nil, nil, fmt.Errorf("cannot have negative reversible window %s", opts.Window)
+	}
+	if opts.BaseFee != 0 && opts.BaseFee < minBaseFee {
+		return nil, 0, nil, nil, fmt.Errorf("base fee %d is below the network minimum of %d", opts.BaseFee, minBaseFee)
+	}
+	var expMS int64
+	if !opts.Expiration.IsZero() {
+		expMS = int64(bc.Millis(opts.Expiration))
+		if expMS <= 0 {
+			return nil, 0, nil, nil, fmt.Errorf("invalid expiration %s", opts.Expiration)
+		}
+	}
+	if opts.Custodian != "" {
+		var custodianID xdr.AccountId
+		err := custodianID.SetAddress(opts.Custodian)
+		if err != nil {
+			return nil, 0, nil, nil, errors.Wrapf(err, "invalid custodian account %q", opts.Custodian)
+		}
+	}
+	err = checkPegMetadata(opts.Metadata)
+	if err != nil {
+		return nil, 0, nil, nil, err
 	}
 	assetXDR, err := asset.MarshalBinary()
 	if err != nil {
-		return nil, err
+		return nil, 0, nil, nil, err
 	}
 	assetID := bc.NewHash(txvm.AssetID(importIssuanceSeed[:], assetXDR))
-	var rawSeed [32]byte
-	copy(rawSeed[:], prv)
-	kp, err := keypair.FromRawSeed(rawSeed)
+	owner, err := strkey.Encode(strkey.VersionByteAccountID, pubkey)
 	if err != nil {
-		return nil, err
+		return nil, 0, nil, nil, err
+	}
+	kp, err := keypair.Parse(owner)
+	if err != nil {
+		return nil, 0, nil, nil, err
+	}
+	exporter, err := exportDestination(kp, opts.Destination)
+	if err != nil {
+		return nil, 0, nil, nil, err
 	}
-	pubkey := prv.Public().(ed25519.PublicKey)
 
-	// We first split off the difference between inputAmt and exportAmt.
+	// We first split off the difference between inputAmt and exportAmt,
+	// which is the change, if any.
 	// Then, we split off the zero-value for finalize, creating the retire anchor.
-	retireAnchor1 := txvm.VMHash("Split2", anchor)
-	retireAnchor := txvm.VMHash("Split1", retireAnchor1[:])
+	if inputAmt != exportAmt {
+		changeAnchor1 := txvm.VMHash("Split1", anchor)
+		changeAnchor = changeAnchor1[:]
+	}
 	ref := pegOut{
-		AssetXDR: assetXDR,
-		TempAddr: tempAddr,
-		Seqnum:   int64(seqnum),
-		Exporter: kp.Address(),
-		Amount:   exportAmt,
-		Anchor:   retireAnchor[:],
-		Pubkey:   pubkey,
+		AssetXDR:   assetXDR,
+		TempAddr:   tempAddr,
+		Seqnum:     int64(seqnum),
+		Exporter:   exporter,
+		Amount:     exportAmt,
+		Anchor:     ExportAnchor(anchor),
+		Pubkey:     pubkey,
+		WindowMS:   int64(opts.Window / time.Millisecond),
+		Custodian:  opts.Custodian,
+		Metadata:   opts.Metadata,
+		MemoAnchor: opts.MemoAnchor,
+		BaseFee:    opts.BaseFee,
+	}
+	if exporter != kp.Address() {
+		ref.Owner = kp.Address()
+	}
+	if conv := opts.Conversion; conv != nil {
+		if conv.Amount <= 0 {
+			return nil, 0, nil, nil, fmt.Errorf("invalid conversion amount %d", conv.Amount)
+		}
+		ref.ConvertAssetXDR, err = conv.Asset.MarshalBinary()
+		if err != nil {
+			return nil, 0, nil, nil, errors.Wrap(err, "marshaling conversion asset xdr")
+		}
+		ref.ConvertAmount = conv.Amount
 	}
-	refdata, err := json.Marshal(ref)
+	if recips := opts.Recipients; len(recips) > 0 {
+		if opts.Conversion != nil {
+			return nil, 0, nil, nil, errors.New("cannot convert a payout to several recipients")
+		}
+		total, err := recipientsTotal(recips)
+		if err != nil {
+			return nil, 0, nil, nil, err
+		}
+		if total > exportAmt {
+			return nil, 0, nil, nil, fmt.Errorf("recipient amounts add up to %d, more than the export amount %d", total, exportAmt)
+		}
+		ref.Recipients = recips
+	}
+	refdata, err := encodeRefdata(ref, format)
 	if err != nil {
-		return nil, errors.Wrap(err, "marshaling reference data")
+		return nil, 0, nil, nil, errors.Wrap(err, "marshaling reference data")
 	}
+	// The expiration, if any, is logged first,
+	// ahead of the entries that InspectExportTx expects.
+	// The refdata is pushed once:
+	// one copy is logged when the input is spent,
+	// and the other stays at the bottom of the stack
+	// until it is passed to the export contract.
 	b := new(txvmutil.Builder)
+	if expMS > 0 {
+		b.PushdataInt64(0).PushdataInt64(expMS).Op(op.TimeRange)
+	}
 	b.PushdataBytes(refdata)                                                                                             // con stack: json
-	b.Op(op.Put)                                                                                                         // arg stack: json
-	standard.SpendMultisig(b, 1, []ed25519.PublicKey{pubkey}, inputAmt, assetID, anchor, standard.PayToMultisigSeed1[:]) // arg stack: inputval, sigcheck
-	b.Op(op.Get).Op(op.Get)                                                                                              // con stack: sigcheck, inputval
-	b.PushdataInt64(exportAmt).Op(op.Split)                                                                              // con stack: sigcheck, changeval, retireval
-	b.PushdataInt64(1).Op(op.Roll)                                                                                       // con stack: sigcheck, retireval, changeval
+	b.Op(op.Dup).Op(op.Put)                                                                                              // con stack: json; arg stack: json
+	standard.SpendMultisig(b, 1, []ed25519.PublicKey{pubkey}, inputAmt, assetID, anchor, standard.PayToMultisigSeed1[:]) // con stack: json; arg stack: inputval, sigcheck
+	b.Op(op.Get).Op(op.Get)                                                                                              // con stack: json, sigcheck, inputval
+	b.PushdataInt64(exportAmt).Op(op.Split)                                                                              // con stack: json, sigcheck, changeval, retireval
+	b.PushdataInt64(1).Op(op.Roll)                                                                                       // con stack: json, sigcheck, retireval, changeval
 	if inputAmt != exportAmt {
-		b.PushdataBytes(nil).Op(op.Put)                                                    // con stack: sigcheck, retireval, changeval; arg stack: refdata
-		b.Op(op.Put)                                                                       // con stack: sigcheck, retireval; arg stack: refdata, changeval
-		b.Tuple(func(tup *txvmutil.TupleBuilder) { tup.PushdataBytes(pubkey) }).Op(op.Put) // con stack: sigcheck, retireval; arg stack: refdata, changeval, {pubkey}
-		b.PushdataInt64(1).Op(op.Put)                                                      // con stack: sigcheck, retireval; arg stack: refdata, changeval, {pubkey}, 1
-		b.PushdataBytes(standard.PayToMultisigProg1).Op(op.Contract).Op(op.Call)           // con stack: sigcheck, retireval
+		b.PushdataBytes(nil).Op(op.Put)                                                          // con stack: json, sigcheck, retireval, changeval; arg stack: refdata
+		b.Op(op.Put)                                                                             // con stack: json, sigcheck, retireval; arg stack: refdata, changeval
+		b.Tuple(func(tup *txvmutil.TupleBuilder) { tup.PushdataBytes(changePubkey) }).Op(op.Put) // con stack: json, sigcheck, retireval; arg stack: refdata, changeval, {changepubkey}
+		b.PushdataInt64(1).Op(op.Put)                                                            // con stack: json, sigcheck, retireval; arg stack: refdata, changeval, {changepubkey}, 1
+		b.PushdataBytes(standard.PayToMultisigProg1).Op(op.Contract).Op(op.Call)                 // con stack: json, sigcheck, retireval
 	} else {
-		b.Op(op.Drop) // con stack: sigcheck, retireval
+		b.Op(op.Drop) // con stack: json, sigcheck, retireval
 	}
-	// con stack: sigcheck, retireval
-	b.PushdataInt64(0).Op(op.Split).PushdataInt64(1).Op(op.Roll).Op(op.Put)            // con stack: sigcheck, zeroval; arg stack: retireval
-	b.PushdataBytes(refdata).Op(op.Put)                                                // con stack: sigcheck, zeroval; arg stack: retireval, json
+	// con stack: json, sigcheck, retireval
+	b.PushdataInt64(0).Op(op.Split).PushdataInt64(1).Op(op.Roll).Op(op.Put)            // con stack: json, sigcheck, zeroval; arg stack: retireval
+	b.PushdataInt64(2).Op(op.Roll).Op(op.Put)                                          // con stack: sigcheck, zeroval; arg stack: retireval, json
 	b.Tuple(func(tup *txvmutil.TupleBuilder) { tup.PushdataBytes(pubkey) }).Op(op.Put) // con stack: sigcheck, zeroval; arg stack: retireval, json, {pubkey}
 	b.PushdataBytes(exportContract1Prog)                                               // con stack: sigchecker, zeroval, exportContract; arg stack: retireval, json, {pubkey}
 	b.Op(op.Contract).Op(op.Call)                                                      // con stack: sigchecker, zeroval
 	b.Op(op.Finalize)                                                                  // con stack: sigchecker
-	prog1 := b.Build()
-	vm, err := txvm.Validate(prog1, 3, math.MaxInt64, txvm.StopAfterFinalize)
+	prog1 = b.Build()
+	var outputAnchor []byte
+	vm, err := txvm.Validate(prog1, version, math.MaxInt64, txvm.StopAfterFinalize, txvm.BeforeStep(captureExportAnchor(&outputAnchor)))
+	if err != nil {
+		return nil, 0, nil, nil, errors.Wrap(err, "computing transaction ID")
+	}
+	// The custodian finds the export contract by the anchor in refdata,
+	// so the derivation above must match what the program actually did.
+	err = checkExportAnchor(outputAnchor, ref.Anchor)
+	if err != nil {
+		return nil, 0, nil, nil, err
+	}
+	return prog1, version, vm.TxID[:], changeAnchor, nil
+}
+
+// exportSigMsg is the message the exporter signs
+// to authorize export tx txid spending the input with anchor.
+func exportSigMsg(txid, anchor []byte) []byte {
+	var id [32]byte
+	copy(id[:], txid)
+	return append(standard.VerifyTxID(id), anchor...)
+}
+
+// finishExportTx completes the export tx with program prog1,
+// as built by prepareExportTx,
+// with the exporter's signature sig.
+// Making the tx runs it,
+// so a bad signature is an error.
+func finishExportTx(prog1 []byte, version int64, sig []byte) (*bc.Tx, error) {
+	vm, err := txvm.Validate(prog1, version, math.MaxInt64, txvm.StopAfterFinalize)
 	if err != nil {
 		return nil, errors.Wrap(err, "computing transaction ID")
 	}
-	sigProg := standard.VerifyTxID(vm.TxID)
-	msg := append(sigProg, anchor...)
-	sig := ed25519.Sign(prv, msg)
+	b := new(txvmutil.Builder).Concat(prog1)
 	b.PushdataBytes(sig).Op(op.Put)
-	b.PushdataBytes(sigProg).Op(op.Put)
+	b.PushdataBytes(standard.VerifyTxID(vm.TxID)).Op(op.Put)
 	b.Op(op.Call)
 
 	prog2 := b.Build()
 	var runlimit int64
-	tx, err := bc.NewTx(prog2, 3, math.MaxInt64, txvm.GetRunlimit(&runlimit))
+	tx, err := bc.NewTx(prog2, version, math.MaxInt64, txvm.GetRunlimit(&runlimit))
 	if err != nil {
 		return nil, errors.Wrap(err, "making export tx")
 	}
 	tx.Runlimit = math.MaxInt64 - runlimit
 	return tx, nil
 }
+
+// captureExportAnchor returns a txvm.BeforeStep callback
+// that sets *anchor to the anchor of the value
+// that the export contract outputs for retirement,
+// which is just below the output program on the contract's stack
+// at its output instruction.
+func captureExportAnchor(anchor *[]byte) func(*txvm.VM) {
+	return func(vm *txvm.VM) {
+		if vm.OpCode() != op.Output || !bytes.Equal(vm.Seed(), exportContract1Seed[:]) || vm.StackLen() < 2 {
+			return
+		}
+		item, ok := vm.StackItem(vm.StackLen() - 2).(txvm.Tuple)
+		if !ok || len(item) != 4 {
+			return
+		}
+		if code, ok := item[0].(txvm.Bytes); !ok || len(code) != 1 || code[0] != txvm.ValueCode {
+			return
+		}
+		*anchor, _ = item[3].(txvm.Bytes)
+	}
+}
+
+// checkExportAnchor checks that the anchor of the value output by an export program,
+// as captured by captureExportAnchor,
+// is the anchor written into the export's reference data.
+func checkExportAnchor(got, want []byte) error {
+	if got == nil {
+		return errors.New("export program outputs no value from the export contract")
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("export contract outputs value with anchor %x, but reference data has anchor %x", got, want)
+	}
+	return nil
+}
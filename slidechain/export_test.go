@@ -1,20 +1,38 @@
 package slidechain
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/standard"
+	"github.com/chain/txvm/protocol/txbuilder/txresult"
+	"github.com/chain/txvm/protocol/txvm"
 	"github.com/interzioncoin/slingshot/slidechain/mockequator"
 	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/interzioncoin/starlight/worizon/xlm"
+	b "github.com/zioncoin/go/build"
 	"github.com/zioncoin/go/clients/equator"
 	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/network"
+	"github.com/zioncoin/go/strkey"
 	"github.com/zioncoin/go/xdr"
 )
 
@@ -144,3 +162,1939 @@ func TestPegOut(t *testing.T) {
 	// Avoids closing the database while the watch peg-outs goroutine still needs it.
 	<-pegouts
 }
+
+// refusingHTTP fails any request made through it.
+type refusingHTTP struct {
+	t *testing.T
+}
+
+func (h refusingHTTP) Do(req *http.Request) (*http.Response, error) {
+	return h.refuse(req.URL.String())
+}
+
+func (h refusingHTTP) Get(url string) (*http.Response, error) {
+	return h.refuse(url)
+}
+
+func (h refusingHTTP) PostForm(url string, data url.Values) (*http.Response, error) {
+	return h.refuse(url)
+}
+
+func (h refusingHTTP) refuse(url string) (*http.Response, error) {
+	h.t.Errorf("request to %s bypassed the injected equator client", url)
+	return nil, fmt.Errorf("refusing request to %s", url)
+}
+
+// TestInjectedClient checks that a full pre-export and peg-out cycle
+// talks to equator only through the client it is given.
+func TestInjectedClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	defaultClient := equator.DefaultTestNetClient
+	equator.DefaultTestNetClient = &equator.Client{URL: defaultClient.URL, HTTP: refusingHTTP{t}}
+	defer func() { equator.DefaultTestNetClient = defaultClient }()
+
+	testdir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testdir)
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s/testdb", testdir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Pre-seed the custodian account, as withTestCustodian does,
+	// so that newCustodian does not request lumens from friendbot.
+	err = setSchema(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	custodianKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO custodian (seed) VALUES ($1)", custodianKP.Seed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hclient := &fakeClient{ClientInterface: mockequator.New()}
+	c, err := newCustodian(ctx, db, hclient, DefaultBlockInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pegouts := make(chan pegOut)
+	go c.pegOutFromExports(ctx, pegouts)
+
+	kp, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	asset := zioncoin.NativeAsset()
+	assetXDR, err := asset.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const amount = 50
+	tempAddr, seqnum, err := SubmitPreExportTx(hclient, kp, c.AccountID.Address(), asset, amount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txid := []byte("injected")
+	var zero32 [32]byte
+	ref, err := json.Marshal(pegOut{
+		TxID:     txid,
+		AssetXDR: assetXDR,
+		TempAddr: tempAddr,
+		Seqnum:   int64(seqnum),
+		Exporter: kp.Address(),
+		Amount:   amount,
+		Anchor:   zero32[:],
+		Pubkey:   zero32[:],
+		State:    pegOutNotYet,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO exports (txid, pegout_json) VALUES ($1, $2)", txid, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.exports.Broadcast()
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("context timed out: no peg-out")
+	case <-pegouts:
+	}
+
+	var pegOutSubmitted bool
+	hclient.mu.Lock()
+	for _, txe := range hclient.txs {
+		var env xdr.TransactionEnvelope
+		err = xdr.SafeUnmarshalBase64(txe, &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Tx.SourceAccount.Address() == tempAddr {
+			pegOutSubmitted = true
+		}
+	}
+	hclient.mu.Unlock()
+	if !pegOutSubmitted {
+		t.Error("peg-out tx not submitted through the injected client")
+	}
+}
+
+func TestInspectExportTx(t *testing.T) {
+	ctx := context.Background()
+	_, exporterPrv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var anchor [32]byte
+	for _, amounts := range [][2]int64{{50, 50}, {30, 50}} {
+		exportAmt, inputAmt := amounts[0], amounts[1]
+		tx, err := BuildExportTx(ctx, zioncoin.NativeAsset(), exportAmt, inputAmt, tempKP.Address(), anchor[:], exporterPrv, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := InspectExportTx(tx)
+		if err != nil {
+			t.Fatalf("export of %d from %d not recognized: %s", exportAmt, inputAmt, err)
+		}
+		var p pegOut
+		err = json.Unmarshal(ref, &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Amount != exportAmt || p.TempAddr != tempKP.Address() {
+			t.Errorf("got amount %d and temp account %s, want %d and %s", p.Amount, p.TempAddr, exportAmt, tempKP.Address())
+		}
+	}
+
+	prepegTx, err := buildPrePegInTx(anchor[:], []byte("asset"), testRecipPubKey, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InspectExportTx(prepegTx)
+	if err == nil {
+		t.Error("pre-peg-in tx recognized as an export")
+	}
+}
+
+func TestExportTxVersion(t *testing.T) {
+	ctx := context.Background()
+	_, exporterPrv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var anchor [32]byte
+	for _, version := range supportedTxVersions {
+		tx, _, err := BuildExportTxWithOptions(ctx, zioncoin.NativeAsset(), 30, 50, tempKP.Address(), anchor[:], exporterPrv, 1, ExportOptions{Version: version})
+		if err != nil {
+			t.Fatalf("building export at txvm version %d: %s", version, err)
+		}
+		if tx.Version != version {
+			t.Errorf("got export tx of version %d, want %d", tx.Version, version)
+		}
+		_, err = txvm.Validate(tx.Program, tx.Version, tx.Runlimit)
+		if err != nil {
+			t.Errorf("validating export at txvm version %d: %s", version, err)
+		}
+		_, err = InspectExportTx(tx)
+		if err != nil {
+			t.Errorf("export at txvm version %d not recognized: %s", version, err)
+		}
+
+		// An export claiming an unsupported version is not recognized.
+		unsupported := *tx
+		unsupported.Version = 99
+		_, err = InspectExportTx(&unsupported)
+		if err == nil {
+			t.Errorf("export at txvm version %d recognized", unsupported.Version)
+		}
+	}
+
+	_, _, err = BuildExportTxWithOptions(ctx, zioncoin.NativeAsset(), 30, 50, tempKP.Address(), anchor[:], exporterPrv, 1, ExportOptions{Version: 99})
+	if err == nil {
+		t.Error("got no error building an export at unsupported txvm version 99")
+	}
+}
+
+// TestExportRefdataOnce checks that an export tx carries its reference data
+// once in its program, while the export is still recognized
+// and the export contract still holds the full reference data.
+func TestExportRefdataOnce(t *testing.T) {
+	ctx := context.Background()
+	_, exporterPrv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var anchor [32]byte
+	for _, amounts := range [][2]int64{{50, 50}, {30, 50}} {
+		exportAmt, inputAmt := amounts[0], amounts[1]
+		tx, err := BuildExportTx(ctx, zioncoin.NativeAsset(), exportAmt, inputAmt, tempKP.Address(), anchor[:], exporterPrv, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := InspectExportTx(tx)
+		if err != nil {
+			t.Fatalf("export of %d from %d not recognized: %s", exportAmt, inputAmt, err)
+		}
+		if n := bytes.Count(tx.Program, ref); n != 1 {
+			t.Errorf("export of %d from %d has reference data %d times in its program, want 1", exportAmt, inputAmt, n)
+		}
+		var p pegOut
+		err = json.Unmarshal(ref, &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.TxID = tx.ID.Bytes()
+		p.State = pegOutOK
+		// The post-peg-out tx spends the export contract
+		// only if the contract's state holds exactly this reference data.
+		postTx, err := buildPostPegOutTx(p, custodianPrv, time.Now())
+		if err != nil {
+			t.Fatalf("spending export of %d from %d: %s", exportAmt, inputAmt, err)
+		}
+		if len(postTx.Inputs) != 1 {
+			t.Fatalf("post-peg-out tx has %d inputs, want 1", len(postTx.Inputs))
+		}
+		var found bool
+		for _, out := range tx.Outputs {
+			if out.ID == postTx.Inputs[0].ID {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("post-peg-out tx for export of %d from %d spends no output of the export", exportAmt, inputAmt)
+		}
+	}
+}
+
+// BenchmarkExportTxSize reports the size of the program of an export tx with change.
+func BenchmarkExportTxSize(bench *testing.B) {
+	ctx := context.Background()
+	_, exporterPrv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		bench.Fatal(err)
+	}
+	tempKP, err := keypair.Random()
+	if err != nil {
+		bench.Fatal(err)
+	}
+	var anchor [32]byte
+	var size int
+	for i := 0; i < bench.N; i++ {
+		tx, err := BuildExportTx(ctx, zioncoin.NativeAsset(), 30, 50, tempKP.Address(), anchor[:], exporterPrv, 1)
+		if err != nil {
+			bench.Fatal(err)
+		}
+		size = len(tx.Program)
+	}
+	bench.ReportMetric(float64(size), "program-bytes")
+}
+
+func TestExportAnchor(t *testing.T) {
+	ctx := context.Background()
+	_, exporterPrv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchor := txvm.VMHash("anchor", nil)
+	// Exporting the whole input drops the zero change;
+	// exporting part of it pays the change back to the exporter.
+	for _, amounts := range [][2]int64{{50, 50}, {30, 50}} {
+		exportAmt, inputAmt := amounts[0], amounts[1]
+		tx, err := BuildExportTx(ctx, zioncoin.NativeAsset(), exportAmt, inputAmt, tempKP.Address(), anchor[:], exporterPrv, 1)
+		if err != nil {
+			t.Fatalf("building export of %d from %d: %s", exportAmt, inputAmt, err)
+		}
+		ref, err := InspectExportTx(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p pegOut
+		err = json.Unmarshal(ref, &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []byte
+		_, err = txvm.Validate(tx.Program, tx.Version, tx.Runlimit, txvm.BeforeStep(captureExportAnchor(&got)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkExportAnchor(got, p.Anchor)
+		if err != nil {
+			t.Errorf("export of %d from %d: %s", exportAmt, inputAmt, err)
+		}
+		err = checkExportAnchor(got, anchor[:])
+		if err == nil {
+			t.Errorf("export of %d from %d: input anchor accepted as the retired value's anchor", exportAmt, inputAmt)
+		}
+	}
+}
+
+func TestExportChangeAnchor(t *testing.T) {
+	ctx := context.Background()
+	exporterPub, exporterPrv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchor := txvm.VMHash("anchor", nil)
+
+	tx, changeAnchor, err := BuildExportTxWithOptions(ctx, zioncoin.NativeAsset(), 30, 50, tempKP.Address(), anchor[:], exporterPrv, 1, ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Besides the change, the tx outputs the export contract holding the retired value.
+	var change *txresult.Output
+	for _, out := range txresult.New(tx).Outputs {
+		if len(out.Pubkeys) == 1 && bytes.Equal(out.Pubkeys[0], exporterPub) {
+			change = out
+		}
+	}
+	if change == nil || change.Value == nil {
+		t.Fatal("no change paid to the exporter's key in the tx log")
+	}
+	if change.Value.Amount != 20 {
+		t.Errorf("got change of %d, want 20", change.Value.Amount)
+	}
+	if !bytes.Equal(changeAnchor, change.Value.Anchor) {
+		t.Errorf("got change anchor %x, want %x from the tx log", changeAnchor, change.Value.Anchor)
+	}
+
+	_, changeAnchor, err = BuildExportTxWithOptions(ctx, zioncoin.NativeAsset(), 50, 50, tempKP.Address(), anchor[:], exporterPrv, 1, ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changeAnchor != nil {
+		t.Errorf("got change anchor %x exporting the whole input, want none", changeAnchor)
+	}
+
+	// With retireAll, the export amount is ignored.
+	tx, changeAnchor, err = BuildExportTxWithOptions(ctx, zioncoin.NativeAsset(), 30, 50, tempKP.Address(), anchor[:], exporterPrv, 1, ExportOptions{RetireAll: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changeAnchor != nil {
+		t.Errorf("got change anchor %x with retireAll, want none", changeAnchor)
+	}
+	for _, out := range txresult.New(tx).Outputs {
+		if len(out.Pubkeys) == 1 && bytes.Equal(out.Pubkeys[0], exporterPub) {
+			t.Error("got change paid to the exporter's key with retireAll")
+		}
+	}
+}
+
+func TestExportChangeKey(t *testing.T) {
+	ctx := context.Background()
+	exporterPub, exporterPrv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coldPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchor := txvm.VMHash("anchor", nil)
+
+	// The change goes to the cold key,
+	// while the refdata still names the signer as the exporter.
+	tx, changeAnchor, err := BuildExportTxWithOptions(ctx, zioncoin.NativeAsset(), 30, 50, tempKP.Address(), anchor[:], exporterPrv, 1, ExportOptions{ChangePubkey: coldPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var change *txresult.Output
+	for _, out := range txresult.New(tx).Outputs {
+		if len(out.Pubkeys) != 1 || out.Value == nil {
+			continue
+		}
+		if bytes.Equal(out.Pubkeys[0], exporterPub) && out.Value.Amount == 20 {
+			t.Error("got change paid to the signer's key")
+		}
+		if bytes.Equal(out.Pubkeys[0], coldPub) {
+			change = out
+		}
+	}
+	if change == nil {
+		t.Fatal("no change paid to the change key in the tx log")
+	}
+	if change.Value.Amount != 20 {
+		t.Errorf("got change of %d, want 20", change.Value.Amount)
+	}
+	if !bytes.Equal(changeAnchor, change.Value.Anchor) {
+		t.Errorf("got change anchor %x, want %x from the tx log", changeAnchor, change.Value.Anchor)
+	}
+	ref, err := InspectExportTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p pegOut
+	err = decodeRefdata(ref, &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporterAddr, err := strkey.Encode(strkey.VersionByteAccountID, exporterPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Exporter != exporterAddr || !bytes.Equal(p.Pubkey, exporterPub) {
+		t.Errorf("got exporter %s with pubkey %x, want %s with %x", p.Exporter, p.Pubkey, exporterAddr, []byte(exporterPub))
+	}
+	err = verifyExportSig(tx, exporterPub)
+	if err != nil {
+		t.Errorf("export signature: %s", err)
+	}
+
+	// An empty change key pays the change to the signer, as BuildExportTx does.
+	want, err := BuildExportTx(ctx, zioncoin.NativeAsset(), 30, 50, tempKP.Address(), anchor[:], exporterPrv, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := BuildExportTxWithOptions(ctx, zioncoin.NativeAsset(), 30, 50, tempKP.Address(), anchor[:], exporterPrv, 1, ExportOptions{ChangePubkey: ed25519.PublicKey{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != want.ID {
+		t.Errorf("got tx %x with no change key, want %x", got.ID.Bytes(), want.ID.Bytes())
+	}
+
+	_, _, err = BuildExportTxWithOptions(ctx, zioncoin.NativeAsset(), 30, 50, tempKP.Address(), anchor[:], exporterPrv, 1, ExportOptions{ChangePubkey: coldPub[:5]})
+	if err == nil {
+		t.Error("got no error with a short change key")
+	}
+}
+
+func TestVerifyExportSig(t *testing.T) {
+	ctx := context.Background()
+	exporterPub, exporterPrv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var anchor [32]byte
+	tx, err := BuildExportTx(ctx, zioncoin.NativeAsset(), 50, 50, tempKP.Address(), anchor[:], exporterPrv, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyExportSig(tx, exporterPub)
+	if err != nil {
+		t.Fatalf("valid export rejected: %s", err)
+	}
+
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyExportSig(tx, otherPub)
+	if err == nil {
+		t.Error("export accepted with the wrong pubkey")
+	}
+
+	// BuildExportTx signs deterministically, so the signature can be found in the program.
+	msg := append(standard.VerifyTxID(tx.ID.Byte32()), anchor[:]...)
+	sig := ed25519.Sign(exporterPrv, msg)
+	i := bytes.Index(tx.Program, sig)
+	if i < 0 {
+		t.Fatal("signature not found in export program")
+	}
+	tampered := *tx
+	tampered.Program = append([]byte{}, tx.Program...)
+	tampered.Program[i] ^= 1
+	err = verifyExportSig(&tampered, exporterPub)
+	if err == nil {
+		t.Error("export accepted with a tampered signature")
+	}
+}
+
+func TestExportAccountReason(t *testing.T) {
+	ctx := context.Background()
+	_, exporterPrv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var anchor [32]byte
+	infoOf := func(destination string) pegOut {
+		tx, _, err := BuildExportTxWithOptions(ctx, zioncoin.NativeAsset(), 50, 50, tempKP.Address(), anchor[:], exporterPrv, 1, ExportOptions{Destination: destination})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := InspectExportTx(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info pegOut
+		err = decodeRefdata(ref, &info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	own := infoOf("")
+	toOther := infoOf(other.Address())
+	mismatched := own
+	mismatched.Exporter = other.Address()
+	wrongOwner := toOther
+	wrongOwner.Owner = tempKP.Address()
+	shortKey := own
+	shortKey.Pubkey = own.Pubkey[:31]
+
+	cases := []struct {
+		name       string
+		info       pegOut
+		wantReject bool
+	}{
+		{"own account", own, false},
+		{"destination with owner", toOther, false},
+		{"exporter not the signer's", mismatched, true},
+		{"owner not the signer's", wrongOwner, true},
+		{"short pubkey", shortKey, true},
+	}
+	for _, tc := range cases {
+		reason := exportAccountReason(tc.info)
+		if (reason != "") != tc.wantReject {
+			t.Errorf("%s: got reason %q, want rejection %v", tc.name, reason, tc.wantReject)
+		}
+	}
+}
+
+func TestFeePolicyPayout(t *testing.T) {
+	cases := []struct {
+		policy      FeePolicy
+		amount      int64
+		payout, fee int64
+		wantErr     bool
+	}{
+		{FeePolicy{}, 100, 100, 0, false},
+		{FeePolicy{Flat: 10}, 100, 90, 10, false},
+		{FeePolicy{BasisPoints: 250}, 1000, 975, 25, false},
+		{FeePolicy{Flat: 10, BasisPoints: 100}, 1000, 980, 20, false},
+		{FeePolicy{Flat: 100}, 100, 0, 0, true},
+		{FeePolicy{Flat: 200}, 100, 0, 0, true},
+		{FeePolicy{Flat: 10, MinPayout: 100}, 105, 0, 0, true},
+		{FeePolicy{Flat: 10, MinPayout: 100}, 110, 100, 10, false},
+		{FeePolicy{BasisPoints: 1}, math.MaxInt64, math.MaxInt64 - math.MaxInt64/10000, math.MaxInt64 / 10000, false},
+	}
+	for _, c := range cases {
+		payout, fee, err := c.policy.Payout(c.amount)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%+v.Payout(%d): got payout %d, fee %d, want error", c.policy, c.amount, payout, fee)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v.Payout(%d): %s", c.policy, c.amount, err)
+			continue
+		}
+		if payout != c.payout || fee != c.fee {
+			t.Errorf("%+v.Payout(%d): got payout %d, fee %d, want %d, %d", c.policy, c.amount, payout, fee, c.payout, c.fee)
+		}
+	}
+}
+
+func TestPegOutFees(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	usd := makeAsset(xdr.AssetTypeAssetTypeCreditAlphanum4, "USD", importTestAccountID)
+	fees := map[string]FeePolicy{
+		"native":     {Flat: 10, BasisPoints: 100, MinPayout: 100},
+		usd.String(): {BasisPoints: 50},
+	}
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases := []struct {
+			asset     xdr.Asset
+			amount    int64
+			wantState pegOutState
+			wantPaid  int64
+		}{
+			{zioncoin.NativeAsset(), 1000, pegOutOK, 980},
+			{usd, 2000, pegOutOK, 1990},
+			{zioncoin.NativeAsset(), 105, pegOutFail, 0}, // dust after fee
+		}
+		// Temp account address to expected payout.
+		wantPaid := make(map[string]int64)
+		for i, tt := range cases {
+			assetXDR, err := tt.asset.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tempAddr := insertTestExport(t, db, []byte{byte(i)}, assetXDR, tt.amount, exporter.Address())
+			if tt.wantState == pegOutOK {
+				wantPaid[tempAddr] = tt.wantPaid
+			}
+		}
+
+		pegouts := make(chan pegOut)
+		go c.pegOutFromExports(ctx, pegouts)
+
+		for i := 0; i < len(cases); {
+			var p pegOut
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for peg-outs")
+			case <-time.After(100 * time.Millisecond):
+				// pegOutFromExports may not have been waiting for the previous broadcast.
+				c.exports.Broadcast()
+				continue
+			case p = <-pegouts:
+				i++
+			}
+			tt := cases[p.TxID[0]]
+			if p.State != tt.wantState {
+				t.Errorf("export of %d of %s: got state %d, want %d", tt.amount, tt.asset.String(), p.State, tt.wantState)
+			}
+		}
+
+		var numFees int
+		var totalFees int64
+		err = db.QueryRow("SELECT COUNT(*), SUM(amount) FROM fees").Scan(&numFees, &totalFees)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if numFees != 2 || totalFees != 30 {
+			t.Errorf("got %d fees totaling %d, want 2 totaling 30", numFees, totalFees)
+		}
+
+		streamCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		var cursor equator.Cursor
+		err = c.hclient.StreamTransactions(streamCtx, c.AccountID.Address(), &cursor, func(tx equator.Transaction) {
+			var env xdr.TransactionEnvelope
+			err := xdr.SafeUnmarshalBase64(tx.EnvelopeXdr, &env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			temp := env.Tx.SourceAccount.Address()
+			want, ok := wantPaid[temp]
+			if !ok {
+				t.Errorf("unexpected peg-out tx from %s", temp)
+				return
+			}
+			delete(wantPaid, temp)
+			var paid int64
+			for _, op := range env.Tx.Operations {
+				if op.Body.Type == xdr.OperationTypePayment {
+					paid = int64(op.Body.PaymentOp.Amount)
+				}
+			}
+			if paid != want {
+				t.Errorf("got payout %d from %s, want %d", paid, temp, want)
+			}
+			if len(wantPaid) == 0 {
+				cancel()
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(wantPaid) != 0 {
+			t.Errorf("missing %d peg-out tx(s)", len(wantPaid))
+		}
+	}, PegOutFees(fees))
+}
+
+// insertTestExport records an export in the db as watchExports would,
+// with a new random temp account, returning the temp account address.
+func insertTestExport(t *testing.T, db *sql.DB, txid, assetXDR []byte, amount int64, exporter string) string {
+	temp, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var zero32 [32]byte // anchor and pubkey do not matter to peg-outs
+	ref, err := json.Marshal(pegOut{
+		AssetXDR: assetXDR,
+		TempAddr: temp.Address(),
+		Seqnum:   1,
+		Exporter: exporter,
+		Amount:   amount,
+		Anchor:   zero32[:],
+		Pubkey:   zero32[:],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO exports (txid, pegout_json) VALUES ($1, $2)", txid, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return temp.Address()
+}
+
+func TestPegOutMalformedExports(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Refdata that cannot be decoded is skipped.
+		_, err = db.Exec("INSERT INTO exports (txid, pegout_json) VALUES ($1, $2)", []byte("garbled"), []byte("{not json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// An export with an invalid temp account fails.
+		var zero32 [32]byte
+		ref, err := json.Marshal(pegOut{
+			AssetXDR: lumenXDR,
+			TempAddr: "not an address",
+			Seqnum:   1,
+			Exporter: exporter.Address(),
+			Amount:   100,
+			Anchor:   zero32[:],
+			Pubkey:   zero32[:],
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("INSERT INTO exports (txid, pegout_json) VALUES ($1, $2)", []byte("badtemp"), ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Neither stops the peg-out of a good export.
+		insertTestExport(t, db, []byte("good"), lumenXDR, 100, exporter.Address())
+
+		pegouts := make(chan pegOut)
+		go c.pegOutFromExports(ctx, pegouts)
+		defer func() {
+			// Wait for pegOutFromExports to exit before the db is closed.
+			cancel()
+			for range pegouts {
+			}
+		}()
+		got := make(map[string]pegOutState)
+		for len(got) < 2 {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for peg-outs, got %v", got)
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			case p := <-pegouts:
+				got[string(p.TxID)] = p.State
+			}
+		}
+		if got["good"] != pegOutOK {
+			t.Errorf("got state %d for good export, want %d", got["good"], pegOutOK)
+		}
+		if got["badtemp"] != pegOutFail {
+			t.Errorf("got state %d for export with invalid temp account, want %d", got["badtemp"], pegOutFail)
+		}
+		if _, ok := got["garbled"]; ok {
+			t.Error("got peg-out of export with garbled refdata")
+		}
+		var (
+			state  pegOutState
+			reason string
+		)
+		err = db.QueryRow("SELECT e.pegged_out, f.reason FROM exports e JOIN export_failures f ON f.txid=e.txid WHERE e.txid=$1", []byte("garbled")).Scan(&state, &reason)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != pegOutNotYet || !strings.Contains(reason, "malformed") {
+			t.Errorf("got state %d and reason %q for garbled export, want %d and a malformed-export reason", state, reason, pegOutNotYet)
+		}
+	})
+}
+
+func TestMaxPegOutRetries(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		hclient := &fakeClient{ClientInterface: c.hclient, failure: txFailure(t, xdr.TransactionResultCodeTxBadSeq)}
+		c.hclient = hclient
+
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pegouts := make(chan pegOut)
+		go c.pegOutFromExports(ctx, pegouts)
+		defer func() {
+			// Wait for pegOutFromExports to exit before the db is closed.
+			cancel()
+			for range pegouts {
+			}
+		}()
+
+		cases := []struct {
+			txid        string
+			fails       int
+			wantState   pegOutState
+			wantSubmits int
+			wantRetries int
+		}{
+			// Submitted once and retried twice, then failed.
+			{"wedged", 100, pegOutFail, 3, 3},
+			// Succeeds on its last retry, resetting the count.
+			{"recovered", 2, pegOutOK, 3, 0},
+		}
+		for _, tt := range cases {
+			atomic.StoreInt32(&hclient.fails, int32(tt.fails))
+			atomic.StoreInt32(&hclient.submitted, 0)
+			insertTestExport(t, db, []byte(tt.txid), lumenXDR, 100, exporter.Address())
+
+			var p pegOut
+			for p.TxID == nil {
+				select {
+				case <-ctx.Done():
+					t.Fatalf("timed out waiting for peg-out of export %s", tt.txid)
+				case <-time.After(100 * time.Millisecond):
+					c.exports.Broadcast()
+				case p = <-pegouts:
+				}
+			}
+			if string(p.TxID) != tt.txid || p.State != tt.wantState {
+				t.Errorf("got state %d of export %s, want %d of export %s", p.State, p.TxID, tt.wantState, tt.txid)
+			}
+			if submitted := atomic.LoadInt32(&hclient.submitted); submitted != int32(tt.wantSubmits) {
+				t.Errorf("export %s: got %d submissions, want %d", tt.txid, submitted, tt.wantSubmits)
+			}
+			var retries int
+			err = db.QueryRow("SELECT retries FROM exports WHERE txid=$1", []byte(tt.txid)).Scan(&retries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if retries != tt.wantRetries {
+				t.Errorf("export %s: got %d retries recorded, want %d", tt.txid, retries, tt.wantRetries)
+			}
+		}
+	}, MaxPegOutRetries(2), PegOutRetryBackoff(10*time.Millisecond, 50*time.Millisecond))
+}
+
+func TestPegOutRetryBackoff(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	const base = 300 * time.Millisecond
+
+	c := &Custodian{pegOutRetryBackoff: base, pegOutRetryBackoffMax: time.Second}
+	if d := c.pegOutRetryDelay(1); d < base*3/4 || d > base*5/4 {
+		t.Errorf("got delay %s before first retry, want %s ±25%%", d, base)
+	}
+	if d := c.pegOutRetryDelay(100); d != time.Second {
+		t.Errorf("got delay %s before 100th retry, want the maximum %s", d, time.Second)
+	}
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		hclient := &fakeClient{ClientInterface: c.hclient, failure: txFailure(t, xdr.TransactionResultCodeTxBadSeq), fails: 2}
+		c.hclient = hclient
+
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		insertTestExport(t, db, []byte("export"), lumenXDR, 100, exporter.Address())
+
+		pegouts := make(chan pegOut)
+		go c.pegOutFromExports(ctx, pegouts)
+		defer func() {
+			// Wait for pegOutFromExports to exit before the db is closed.
+			cancel()
+			for range pegouts {
+			}
+		}()
+
+		// Broadcasts in between must not hurry the retries.
+		var p pegOut
+		for p.TxID == nil {
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for peg-out")
+			case <-time.After(10 * time.Millisecond):
+				c.exports.Broadcast()
+			case p = <-pegouts:
+			}
+		}
+		if p.State != pegOutOK {
+			t.Fatalf("got state %d, want %d", p.State, pegOutOK)
+		}
+
+		hclient.mu.Lock()
+		times := hclient.times
+		hclient.mu.Unlock()
+		if len(times) != 3 {
+			t.Fatalf("got %d submissions, want 3", len(times))
+		}
+		// The second retry waits longer than the first, less jitter.
+		wantGap := base
+		for i := 1; i < len(times); i++ {
+			if gap := times[i].Sub(times[i-1]); gap < wantGap*3/4 {
+				t.Errorf("retry %d came %s after the previous attempt, want at least %s", i, gap, wantGap*3/4)
+			}
+			wantGap = wantGap * 6 / 5
+		}
+	}, PegOutRetryBackoff(base, 10*time.Second))
+}
+
+func TestPausePegOuts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pegouts := make(chan pegOut)
+		go c.pegOutFromExports(ctx, pegouts)
+
+		c.PausePegOuts()
+		for i := 0; i < 3; i++ {
+			insertTestExport(t, db, []byte{byte(i)}, lumenXDR, 100, exporter.Address())
+		}
+		for i := 0; i < 5; i++ {
+			c.exports.Broadcast()
+			select {
+			case p := <-pegouts:
+				t.Fatalf("export %x pegged out while paused", p.TxID)
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		var pending int
+		err = db.QueryRow("SELECT COUNT(*) FROM exports WHERE pegged_out=$1", pegOutNotYet).Scan(&pending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pending != 3 {
+			t.Fatalf("got %d pending exports while paused, want 3", pending)
+		}
+
+		w := httptest.NewRecorder()
+		c.Status(w, httptest.NewRequest("GET", "/status", nil))
+		var status Status
+		err = json.Unmarshal(w.Body.Bytes(), &status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !status.PegOutsPaused {
+			t.Error("status does not report peg-outs paused")
+		}
+
+		c.ResumePegOuts()
+		for i := 0; i < 3; {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for backlog after resume (got %d of 3 peg-outs)", i)
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			case p := <-pegouts:
+				if p.State != pegOutOK {
+					t.Errorf("export %x: got state %d, want %d", p.TxID, p.State, pegOutOK)
+				}
+				i++
+			}
+		}
+		if c.pegOutsPaused() {
+			t.Error("peg-outs still paused after resume")
+		}
+	})
+}
+
+func TestBurnRecord(t *testing.T) {
+	exporter, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var zero32 [32]byte
+	p := pegOut{
+		TxID:     []byte("export"),
+		AssetXDR: lumenXDR,
+		TempAddr: exporter.Address(),
+		Exporter: exporter.Address(),
+		Amount:   50,
+		Anchor:   zero32[:],
+		Pubkey:   testRecipPubKey,
+		State:    pegOutOK,
+	}
+	now := time.Now()
+	tx, err := buildPostPegOutTx(p, custodianPrv, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	burn, ok := burnFromTx(tx)
+	if !ok {
+		t.Fatal("retirement tx has no burn record")
+	}
+	if !bytes.Equal(burn.ExportTxID, p.TxID) || burn.Amount != p.Amount || burn.Recipient != p.Exporter || burn.TimestampMS != int64(bc.Millis(now)) {
+		t.Errorf("got burn record %+v, want export %x of %d to %s at %d", burn, p.TxID, p.Amount, p.Exporter, bc.Millis(now))
+	}
+
+	p.State = pegOutFail
+	tx, err = buildPostPegOutTx(p, custodianPrv, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := burnFromTx(tx); ok {
+		t.Error("refund tx has a burn record")
+	}
+}
+
+func TestRetirementMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		usdXDR, err := makeAsset(xdr.AssetTypeAssetTypeCreditAlphanum4, "USD", importTestAccountID).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var zero32 [32]byte
+		p := pegOut{
+			TxID:     []byte("export"),
+			AssetXDR: lumenXDR,
+			TempAddr: exporter.Address(),
+			Exporter: exporter.Address(),
+			Amount:   50,
+			Anchor:   zero32[:],
+			Pubkey:   testRecipPubKey,
+			State:    pegOutOK,
+		}
+		tx, err := buildPostPegOutTx(p, custodianPrv, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason := checkRetirement(tx); reason != "" {
+			t.Fatalf("got mismatch %q for matching retirement", reason)
+		}
+
+		// The retire contract's refdata claims a peg-out of another asset.
+		claimed := p
+		claimed.AssetXDR = usdXDR
+		refdata, err := json.Marshal(claimed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Log[2][2] = txvm.Bytes(refdata)
+		isBurn, err := c.recordBurn(ctx, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isBurn {
+			t.Fatal("mismatched retirement not recognized as a burn")
+		}
+		var burns int
+		err = db.QueryRow("SELECT COUNT(*) FROM burns").Scan(&burns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if burns != 0 {
+			t.Errorf("got %d burns recorded, want 0", burns)
+		}
+		var reason string
+		err = db.QueryRow("SELECT reason FROM export_failures WHERE txid=$1", p.TxID).Scan(&reason)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason == "" {
+			t.Error("got empty failure reason")
+		}
+	})
+}
+
+func TestAmountConservation(t *testing.T) {
+	ctx := context.Background()
+	issuer, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	custodian, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, exporterPrv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var anchor [32]byte
+
+	assets := []struct {
+		code string
+		want xdr.AssetType
+	}{
+		{"", xdr.AssetTypeAssetTypeNative},
+		{"USD", xdr.AssetTypeAssetTypeCreditAlphanum4},
+		{"USDC", xdr.AssetTypeAssetTypeCreditAlphanum4},
+		{"SLIDECHAIN", xdr.AssetTypeAssetTypeCreditAlphanum12},
+	}
+	amounts := []int64{1, 9999999, int64(xlm.Lumen), 123456789012, math.MaxInt64}
+
+	for _, a := range assets {
+		asset := zioncoin.NativeAsset()
+		if a.code != "" {
+			asset, err = zioncoin.NewAsset(a.code, issuer.Address())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if asset.Type != a.want {
+			t.Fatalf("asset %q has type %s, want %s", a.code, asset.Type, a.want)
+		}
+		for _, amount := range amounts {
+			t.Run(fmt.Sprintf("%s/%d", asset.String(), amount), func(t *testing.T) {
+				// Peg-in: the peg and export commands parse the user's
+				// amount into stroops, and the peg-in payment carries the
+				// same amount as a Horizon string.
+				horizonAmount := xlm.Amount(amount).HorizonString()
+				parsed, err := xlm.Parse(horizonAmount)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if int64(parsed) != amount {
+					t.Fatalf("parsed Horizon amount %s as %d, want %d", horizonAmount, parsed, amount)
+				}
+				var pegIn b.PaymentBuilder
+				if a.code == "" {
+					pegIn = b.Payment(b.Destination{AddressOrSeed: custodian.Address()}, b.NativeAmount{Amount: horizonAmount})
+				} else {
+					pegIn = b.Payment(b.Destination{AddressOrSeed: custodian.Address()}, b.CreditAmount{Code: a.code, Issuer: issuer.Address(), Amount: horizonAmount})
+				}
+				if pegIn.Err != nil {
+					t.Fatal(pegIn.Err)
+				}
+				if int64(pegIn.P.Amount) != amount || !pegIn.P.Asset.Equals(asset) {
+					t.Errorf("peg-in payment of %d %s, want %d %s", pegIn.P.Amount, pegIn.P.Asset.String(), amount, asset.String())
+				}
+
+				// Export: the amount recorded by the custodian is the exported amount.
+				exportTx, err := BuildExportTx(ctx, asset, amount, amount, tempKP.Address(), anchor[:], exporterPrv, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ref, err := InspectExportTx(exportTx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var p pegOut
+				err = json.Unmarshal(ref, &p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p.Amount != amount {
+					t.Errorf("export recorded %d, want %d", p.Amount, amount)
+				}
+
+				// Peg-out: the payment pays out exactly the exported amount.
+				tx, err := buildPegOutTx(custodian.Address(), exporter.Address(), exporter.Address(), tempKP.Address(), network.TestNetworkPassphrase, asset, p.Amount, nil, nil, 1, nil, baseFee, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var payment *xdr.PaymentOp
+				for _, op := range tx.TX.Operations {
+					if op.Body.PaymentOp != nil {
+						payment = op.Body.PaymentOp
+					}
+				}
+				if payment == nil {
+					t.Fatalf("peg-out tx has operations %v, want a payment", tx.TX.Operations)
+				}
+				if int64(payment.Amount) != amount || !payment.Asset.Equals(asset) {
+					t.Errorf("peg-out payment of %d %s, want %d %s", payment.Amount, payment.Asset.String(), amount, asset.String())
+				}
+			})
+		}
+	}
+}
+
+func TestComputePegOutPreauthHash(t *testing.T) {
+	hclient := &fakeClient{ClientInterface: mockequator.New()}
+	exporter, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	custodian, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	asset := zioncoin.NativeAsset()
+	const amount = 50 * int64(xlm.Lumen)
+
+	tempAddr, seqnum, err := SubmitPreExportTx(hclient, exporter, custodian.Address(), asset, amount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Find the preauth signer added to the temp account by the pre-export tx.
+	var signer, exporterSigner string
+	for _, txe := range hclient.txs {
+		var env xdr.TransactionEnvelope
+		err = xdr.SafeUnmarshalBase64(txe, &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range env.Tx.Operations {
+			if op.Body.SetOptionsOp == nil || op.Body.SetOptionsOp.Signer == nil {
+				continue
+			}
+			key := op.Body.SetOptionsOp.Signer.Key
+			switch key.Type {
+			case xdr.SignerKeyTypeSignerKeyTypePreAuthTx:
+				signer = key.Address()
+			case xdr.SignerKeyTypeSignerKeyTypeEd25519:
+				exporterSigner = key.Address()
+			}
+		}
+	}
+	if signer == "" {
+		t.Fatal("pre-export tx adds no preauth signer")
+	}
+	if exporterSigner != exporter.Address() {
+		t.Errorf("pre-export tx adds exporter signer %q, want %s", exporterSigner, exporter.Address())
+	}
+
+	params := PegOutParams{
+		Custodian: custodian.Address(),
+		Exporter:  exporter.Address(),
+		TempAddr:  tempAddr,
+		Network:   network.TestNetworkPassphrase,
+		Asset:     asset,
+		Amount:    amount,
+		Seqnum:    seqnum,
+	}
+	got, err := ComputePegOutPreauthHash(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != signer {
+		t.Errorf("got preauth hash %s, want signer %s", got, signer)
+	}
+
+	// The hash commits to the payout.
+	params.Amount--
+	other, err := ComputePegOutPreauthHash(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == signer {
+		t.Error("preauth hash does not depend on the payout amount")
+	}
+}
+
+func TestPegOutMemo(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, exporterPrv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	asset := zioncoin.NativeAsset()
+	var anchor [32]byte
+	anchor[0] = 1
+	exportAnchor := ExportAnchor(anchor[:])
+
+	// The export's refdata asks for the memo of its anchor.
+	exportTx, _, err := BuildExportTxWithOptions(ctx, asset, 50, 50, tempKP.Address(), anchor[:], exporterPrv, 1, ExportOptions{Destination: exporter.Address(), MemoAnchor: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := InspectExportTx(exportTx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p pegOut
+	err = decodeRefdata(ref, &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.MemoAnchor || !bytes.Equal(p.Anchor, exportAnchor) {
+		t.Fatalf("got memo anchor %t and anchor %x, want true and %x", p.MemoAnchor, p.Anchor, exportAnchor)
+	}
+	if !bytes.Equal(p.memo(), exportAnchor) {
+		t.Errorf("got memo %x, want %x", p.memo(), exportAnchor)
+	}
+
+	// The preauth hash commits to the memo.
+	custodian, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := PegOutParams{
+		Custodian:  custodian.Address(),
+		Exporter:   exporter.Address(),
+		TempAddr:   tempKP.Address(),
+		Network:    network.TestNetworkPassphrase,
+		Asset:      asset,
+		Amount:     50,
+		Seqnum:     1,
+		MemoAnchor: exportAnchor,
+	}
+	memoed, err := ComputePegOutPreauthHash(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.MemoAnchor = nil
+	unmemoed, err := ComputePegOutPreauthHash(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memoed == unmemoed {
+		t.Error("preauth hash does not depend on the memo")
+	}
+	_, err = buildPegOutTx(custodian.Address(), exporter.Address(), exporter.Address(), tempKP.Address(), network.TestNetworkPassphrase, asset, 50, nil, nil, 1, []byte("short"), baseFee, false)
+	if err == nil {
+		t.Error("got no error building peg-out tx with a short memo")
+	}
+
+	// The peg-out tx carries the memo.
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		c.hclient = hclient
+
+		ref, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("INSERT INTO exports (txid, pegout_json) VALUES ($1, $2)", exportTx.ID.Bytes(), ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pegouts := make(chan pegOut)
+		go c.pegOutFromExports(ctx, pegouts)
+		defer func() {
+			// Wait for pegOutFromExports to exit before the db is closed.
+			cancel()
+			for range pegouts {
+			}
+		}()
+		var got pegOut
+		for got.TxID == nil {
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for peg-out")
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			case got = <-pegouts:
+			}
+		}
+		if got.State != pegOutOK {
+			t.Fatalf("got peg-out state %d, want %d", got.State, pegOutOK)
+		}
+
+		hclient.mu.Lock()
+		defer hclient.mu.Unlock()
+		if len(hclient.txs) != 1 {
+			t.Fatalf("got %d txs submitted, want 1", len(hclient.txs))
+		}
+		var env xdr.TransactionEnvelope
+		err = xdr.SafeUnmarshalBase64(hclient.txs[0], &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Tx.Memo.Type != xdr.MemoTypeMemoHash {
+			t.Fatalf("got memo type %d, want %d", env.Tx.Memo.Type, xdr.MemoTypeMemoHash)
+		}
+		if memo := *env.Tx.Memo.Hash; !bytes.Equal(memo[:], exportAnchor) {
+			t.Errorf("got memo %x, want export anchor %x", memo[:], exportAnchor)
+		}
+	})
+}
+
+func TestBuildPegOutTxUnknownAsset(t *testing.T) {
+	custodian, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	asset := xdr.Asset{Type: xdr.AssetType(99)}
+	_, err = buildPegOutTx(custodian.Address(), exporter.Address(), exporter.Address(), exporter.Address(), network.TestNetworkPassphrase, asset, 50, nil, nil, 1, nil, baseFee, false)
+	if err == nil || !strings.Contains(err.Error(), "unsupported asset type") {
+		t.Errorf("got error %v building peg-out tx of unknown asset type, want one about the asset type", err)
+	}
+	_, err = b.Transaction(b.SourceAccount{AddressOrSeed: custodian.Address()}, b.Sequence{Sequence: 1}, buildPaymentOp(custodian.Address(), exporter.Address(), asset, 50))
+	if err == nil {
+		t.Error("got no error building payment of unknown asset type")
+	}
+}
+
+// accountsWith returns a loadAccount func
+// reporting the signers and balances, if not nil, for every account,
+// as they are when it is called.
+func accountsWith(signers *[]equator.Signer, balances *[]equator.Balance) func(string) (equator.Account, error) {
+	return func(accountID string) (equator.Account, error) {
+		var account equator.Account
+		if signers != nil {
+			account.Signers = *signers
+		}
+		if balances != nil {
+			account.Balances = *balances
+		}
+		account.AccountID = accountID
+		return account, nil
+	}
+}
+
+func TestCancelPreExport(t *testing.T) {
+	exporter, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	temp, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const preauth = "TBU2RRGLXH3E5CQHTD3ODLDF2BWDCYUSSBLLZ5GNW7JXHDIYKXZWHXL7"
+	signers := []equator.Signer{
+		{Key: temp.Address(), Weight: 0},
+		{Key: preauth, Weight: 1},
+		{Key: exporter.Address(), Weight: 1},
+	}
+	hclient := &fakeClient{ClientInterface: mockequator.New(), loadAccount: accountsWith(&signers, nil)}
+	err = CancelPreExport(hclient, exporter, temp.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hclient.txs) != 1 {
+		t.Fatalf("got %d submitted txs, want 1", len(hclient.txs))
+	}
+	var env xdr.TransactionEnvelope
+	err = xdr.SafeUnmarshalBase64(hclient.txs[0], &env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Tx.SourceAccount.Address() != temp.Address() {
+		t.Errorf("cancellation tx has source %s, want temp account %s", env.Tx.SourceAccount.Address(), temp.Address())
+	}
+	if len(env.Signatures) != 1 {
+		t.Errorf("cancellation tx has %d signatures, want 1", len(env.Signatures))
+	}
+	var removed []string
+	var mergedTo string
+	for _, op := range env.Tx.Operations {
+		switch {
+		case op.Body.SetOptionsOp != nil && op.Body.SetOptionsOp.Signer != nil:
+			if op.Body.SetOptionsOp.Signer.Weight != 0 {
+				t.Errorf("cancellation tx sets signer %s to weight %d", op.Body.SetOptionsOp.Signer.Key.Address(), op.Body.SetOptionsOp.Signer.Weight)
+			}
+			removed = append(removed, op.Body.SetOptionsOp.Signer.Key.Address())
+		case op.Body.Destination != nil:
+			if mergedTo != "" {
+				t.Error("cancellation tx has several merges")
+			}
+			mergedTo = op.Body.Destination.Address()
+		default:
+			t.Errorf("unexpected operation %v in cancellation tx", op)
+		}
+	}
+	if len(removed) != 2 || removed[0] != preauth || removed[1] != exporter.Address() {
+		t.Errorf("cancellation tx removes signers %v, want %s and %s", removed, preauth, exporter.Address())
+	}
+	if mergedTo != exporter.Address() {
+		t.Errorf("cancellation tx merges temp account to %q, want %s", mergedTo, exporter.Address())
+	}
+
+	// Without the exporter's signer, there is nothing to cancel with.
+	signers = signers[:2]
+	err = CancelPreExport(hclient, exporter, temp.Address())
+	if err == nil {
+		t.Error("cancelled pre-export without exporter signer")
+	}
+}
+
+func TestCancelPreExportTrustline(t *testing.T) {
+	exporter, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	temp, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustline := equator.Balance{Balance: "0.0000000"}
+	trustline.Type = "credit_alphanum4"
+	trustline.Code = "USD"
+	trustline.Issuer = importTestAccountID
+	signers := []equator.Signer{
+		{Key: temp.Address(), Weight: 0},
+		{Key: exporter.Address(), Weight: 1},
+	}
+	balances := []equator.Balance{trustline}
+	hclient := &fakeClient{ClientInterface: mockequator.New(), loadAccount: accountsWith(&signers, &balances)}
+	err = CancelPreExport(hclient, exporter, temp.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hclient.txs) != 1 {
+		t.Fatalf("got %d submitted txs, want 1", len(hclient.txs))
+	}
+	var env xdr.TransactionEnvelope
+	err = xdr.SafeUnmarshalBase64(hclient.txs[0], &env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The trustline must be removed before the merge.
+	var removedTrust, merged bool
+	for _, op := range env.Tx.Operations {
+		switch op.Body.Type {
+		case xdr.OperationTypeChangeTrust:
+			if merged {
+				t.Error("cancellation tx removes trustline after merge")
+			}
+			ct := op.Body.ChangeTrustOp
+			if ct.Limit != 0 || ct.Line.AlphaNum4 == nil || ct.Line.AlphaNum4.Issuer.Address() != importTestAccountID {
+				t.Errorf("cancellation tx changes trustline %s to limit %d, want removal of USD trustline", ct.Line.String(), ct.Limit)
+			}
+			removedTrust = true
+		case xdr.OperationTypeAccountMerge:
+			merged = true
+		}
+	}
+	if !removedTrust || !merged {
+		t.Errorf("cancellation tx removes trustline %t and merges %t, want both", removedTrust, merged)
+	}
+
+	// A trustline holding funds cannot be removed.
+	hclient.txs = nil
+	balances[0].Balance = "1.0000000"
+	err = CancelPreExport(hclient, exporter, temp.Address())
+	if err == nil {
+		t.Error("cancelled pre-export with funded trustline")
+	}
+	if len(hclient.txs) != 0 {
+		t.Errorf("got %d submitted txs cancelling with funded trustline, want 0", len(hclient.txs))
+	}
+}
+
+func TestAuthRequiredPegOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var exporterID xdr.AccountId
+		err = exporterID.SetAddress(exporter.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases := []struct {
+			name      string
+			asset     xdr.Asset
+			wantAllow bool
+		}{
+			{"custodian-issued", makeAsset(xdr.AssetTypeAssetTypeCreditAlphanum4, "USD", c.AccountID.Address()), true},
+			{"custodian-issued long code", makeAsset(xdr.AssetTypeAssetTypeCreditAlphanum12, "USDOLLARS", c.AccountID.Address()), true},
+			{"other issuer", makeAsset(xdr.AssetTypeAssetTypeCreditAlphanum4, "USD", importTestAccountID), false},
+			{"native", zioncoin.NativeAsset(), false},
+		}
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				// Every account is AUTH_REQUIRED.
+				hclient := &fakeClient{ClientInterface: mockequator.New()}
+				hclient.loadAccount = func(accountID string) (equator.Account, error) {
+					account := equator.Account{Flags: equator.AccountFlags{AuthRequired: true}}
+					account.AccountID = accountID
+					return account, nil
+				}
+				c.hclient = hclient
+				temp, err := keypair.Random()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var tempID xdr.AccountId
+				err = tempID.SetAddress(temp.Address())
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, _, err = c.pegOut(ctx, nil, exporterID, exporter.Address(), tt.asset, 100, nil, nil, tempID, 1, nil, c.BaseFee)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				wantTxs := 1
+				if tt.wantAllow {
+					wantTxs = 2
+				}
+				if len(hclient.txs) != wantTxs {
+					t.Fatalf("got %d submitted txs, want %d", len(hclient.txs), wantTxs)
+				}
+				if !tt.wantAllow {
+					return
+				}
+				var env xdr.TransactionEnvelope
+				err = xdr.SafeUnmarshalBase64(hclient.txs[0], &env)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if env.Tx.SourceAccount.Address() != c.AccountID.Address() {
+					t.Errorf("allow-trust tx has source %s, want custodian %s", env.Tx.SourceAccount.Address(), c.AccountID.Address())
+				}
+				if len(env.Tx.Operations) != 1 || env.Tx.Operations[0].Body.Type != xdr.OperationTypeAllowTrust {
+					t.Fatalf("first submitted tx is not a single allow-trust op: %+v", env.Tx.Operations)
+				}
+				op := env.Tx.Operations[0].Body.AllowTrustOp
+				if op.Trustor.Address() != exporter.Address() || !op.Authorize {
+					t.Errorf("got allow-trust of %s (authorize %t), want authorization of %s", op.Trustor.Address(), op.Authorize, exporter.Address())
+				}
+			})
+		}
+	})
+}
+
+func TestPegOutToDestination(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		c.hclient = hclient
+
+		_, exporterPrv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var seed [32]byte
+		copy(seed[:], exporterPrv)
+		exporter, err := keypair.FromRawSeed(seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The peg-out goes to an account not controlled by the exporter's key,
+		// such as an exchange deposit account.
+		destination, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		asset := zioncoin.NativeAsset()
+		const amount = 50 * int64(xlm.Lumen)
+
+		_, _, err = BuildExportTxWithOptions(ctx, asset, amount, amount, destination.Address(), make([]byte, 32), exporterPrv, 1, ExportOptions{Destination: "not an account"})
+		if err == nil {
+			t.Error("export to an invalid destination account succeeded")
+		}
+
+		tempAddr, seqnum, err := SubmitPreExportTxWithOptions(hclient, exporter, c.AccountID.Address(), asset, amount, PreExportOptions{Destination: destination.Address()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var preauth string
+		for _, txe := range hclient.txs {
+			var env xdr.TransactionEnvelope
+			err = xdr.SafeUnmarshalBase64(txe, &env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, op := range env.Tx.Operations {
+				if op.Body.SetOptionsOp != nil && op.Body.SetOptionsOp.Signer != nil && op.Body.SetOptionsOp.Signer.Key.Type == xdr.SignerKeyTypeSignerKeyTypePreAuthTx {
+					preauth = op.Body.SetOptionsOp.Signer.Key.Address()
+				}
+			}
+		}
+
+		var anchor [32]byte
+		exportTx, _, err := BuildExportTxWithOptions(ctx, asset, amount, amount, tempAddr, anchor[:], exporterPrv, seqnum, ExportOptions{Destination: destination.Address()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := InspectExportTx(exportTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p pegOut
+		err = json.Unmarshal(ref, &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Exporter != destination.Address() || p.owner() != exporter.Address() {
+			t.Fatalf("got export to %s owned by %s, want %s owned by %s", p.Exporter, p.owner(), destination.Address(), exporter.Address())
+		}
+		err = verifyExportSig(exportTx, p.Pubkey)
+		if err != nil {
+			t.Errorf("export to destination not signed by the exporter's key: %s", err)
+		}
+
+		var exporterID, tempID xdr.AccountId
+		err = exporterID.SetAddress(p.Exporter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tempID.SetAddress(p.TempAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hclient.txs = nil
+		_, _, err = c.pegOut(ctx, nil, exporterID, p.owner(), asset, amount, nil, nil, tempID, xdr.SequenceNumber(p.Seqnum), nil, c.BaseFee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hclient.txs) != 1 {
+			t.Fatalf("got %d submitted txs, want 1", len(hclient.txs))
+		}
+		var env xdr.TransactionEnvelope
+		err = xdr.SafeUnmarshalBase64(hclient.txs[0], &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := network.HashTransaction(&env.Tx, c.network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := strkey.Encode(strkey.VersionByteHashTx, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != preauth {
+			t.Errorf("peg-out tx has hash %s, want temp account's preauth signer %s", got, preauth)
+		}
+		for _, op := range env.Tx.Operations {
+			switch op.Body.Type {
+			case xdr.OperationTypePayment:
+				if dest := op.Body.PaymentOp.Destination.Address(); dest != destination.Address() {
+					t.Errorf("peg-out pays %s, want destination %s", dest, destination.Address())
+				}
+			case xdr.OperationTypeAccountMerge:
+				if dest := op.Body.Destination.Address(); dest != exporter.Address() {
+					t.Errorf("peg-out merges temp account to %s, want exporter %s", dest, exporter.Address())
+				}
+			}
+		}
+	})
+}
+
+func TestExportExpiration(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		c.S.blockInterval = 100 * time.Millisecond
+
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipPub, recipPrv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		body, err := json.Marshal(PrePegIn{
+			BcID:        c.InitBlockHash.Bytes(),
+			Amount:      10,
+			AssetXDR:    lumenXDR,
+			RecipPubkey: recipPub,
+			ExpMS:       expMS,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		c.DoPrePegIn(w, httptest.NewRequest("POST", "/prepegin", bytes.NewReader(body)).WithContext(ctx))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d from pre-peg-in: %s", w.Code, w.Body.String())
+		}
+		err = c.recordPegIn(ctx, "txid", "1", w.Body.Bytes(), "source", 10, lumenXDR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		importTxBytes, err := c.buildImportTx(10, expMS, lumenXDR, recipPub, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var runlimit int64
+		importTx, err := bc.NewTx(importTxBytes, 3, math.MaxInt64, txvm.GetRunlimit(&runlimit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		importTx.Runlimit = math.MaxInt64 - runlimit
+		r, err := c.S.submitTx(ctx, importTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.S.waitOnTx(ctx, importTx.ID, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		utxo, err := OutputRefFromResult(txresult.New(importTx).Outputs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		tempKP, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// An export that expired before the next block is refused.
+		expired, _, err := BuildExportTxFromUTXO(ctx, utxo, zioncoin.NativeAsset(), 10, tempKP.Address(), recipPrv, 1, ExportOptions{Expiration: time.Now().Add(-time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = InspectExportTx(expired); err != nil {
+			t.Fatalf("expiring export not recognized: %s", err)
+		}
+		_, err = c.S.submitTx(ctx, expired)
+		if errors.Root(err) != protocol.ErrTxTooOld {
+			t.Fatalf("got error %v submitting expired export, want %s", err, protocol.ErrTxTooOld)
+		}
+
+		// The same export expiring later is included.
+		exportTx, _, err := BuildExportTxFromUTXO(ctx, utxo, zioncoin.NativeAsset(), 10, tempKP.Address(), recipPrv, 1, ExportOptions{Expiration: time.Now().Add(time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err = c.S.submitTx(ctx, exportTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.S.waitOnTx(ctx, exportTx.ID, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exportExpired(exportTx, bc.Millis(time.Now())) {
+			t.Error("unexpired export reported expired")
+		}
+		if !exportExpired(exportTx, bc.Millis(time.Now().Add(time.Hour))) {
+			t.Error("export not reported expired after its expiration")
+		}
+	})
+}
@@ -0,0 +1,191 @@
+package slidechain
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/golang/protobuf/proto"
+	"github.com/interzioncoin/slingshot/slidechain/net"
+	"github.com/zioncoin/go/xdr"
+)
+
+// An ExportTxRequest asks the custodian to build an export tx
+// for an exporter holding its own key (see BuildExportTxHandler).
+// Its fields are the arguments of BuildExportTxWithOptions,
+// with the public key of the exporter's txvm key in place of the key itself.
+type ExportTxRequest struct {
+	AssetXDR     []byte `json:"asset_xdr"`
+	ExportAmount int64  `json:"export_amount"`
+	InputAmount  int64  `json:"input_amount"`
+	TempAddr     string `json:"temp_addr"`
+	Destination  string `json:"destination,omitempty"`
+	Anchor       []byte `json:"anchor"`
+	Pubkey       []byte `json:"pubkey"`
+	Seqnum       int64  `json:"seqnum"`
+
+	// ExpMS, if not zero, is the expiration of the tx
+	// in milliseconds since 1970.
+	ExpMS int64 `json:"exp_ms,omitempty"`
+
+	// MemoAnchor is as in ExportOptions.
+	MemoAnchor bool `json:"memo_anchor,omitempty"`
+
+	// ChangePubkey, if not empty, is the key paid the change
+	// in place of Pubkey (see ExportOptions.ChangePubkey).
+	ChangePubkey []byte `json:"change_pubkey,omitempty"`
+}
+
+// An UnsignedExportTx is an export tx built up to the exporter's signature.
+type UnsignedExportTx struct {
+	// Prog1 is the tx program so far, and Version its txvm version.
+	Prog1   []byte `json:"prog1"`
+	Version int64  `json:"version"`
+
+	// TxID is the ID of the finished tx.
+	TxID []byte `json:"txid"`
+
+	// SigMsg is the message to sign
+	// with the exporter's txvm key.
+	SigMsg []byte `json:"sig_msg"`
+
+	// ChangeAnchor is the anchor of the change
+	// paid back to the exporter's key, if any.
+	ChangeAnchor []byte `json:"change_anchor,omitempty"`
+}
+
+// A SignedExportTx is an UnsignedExportTx
+// with the exporter's signature of its SigMsg
+// (see SignExportTx).
+type SignedExportTx struct {
+	Prog1     []byte `json:"prog1"`
+	Version   int64  `json:"version"`
+	Signature []byte `json:"signature"`
+}
+
+// BuildUnsignedExportTx builds the export tx of req
+// up to the point requiring the exporter's signature,
+// as BuildExportTxWithOptions would with the exporter's key.
+// FinishExportTx completes it.
+func BuildUnsignedExportTx(req ExportTxRequest) (UnsignedExportTx, error) {
+	var asset xdr.Asset
+	err := xdr.SafeUnmarshal(req.AssetXDR, &asset)
+	if err != nil {
+		return UnsignedExportTx{}, errors.Wrap(err, "unmarshaling asset xdr")
+	}
+	var expiration time.Time
+	if req.ExpMS != 0 {
+		expiration = bc.FromMillis(uint64(req.ExpMS))
+	}
+	opts := ExportOptions{
+		Destination:  req.Destination,
+		Expiration:   expiration,
+		MemoAnchor:   req.MemoAnchor,
+		ChangePubkey: req.ChangePubkey,
+	}
+	prog1, version, txid, changeAnchor, err := prepareExportTx(asset, req.ExportAmount, req.InputAmount, req.TempAddr, req.Anchor, req.Pubkey, xdr.SequenceNumber(req.Seqnum), opts)
+	if err != nil {
+		return UnsignedExportTx{}, err
+	}
+	return UnsignedExportTx{
+		Prog1:        prog1,
+		Version:      version,
+		TxID:         txid,
+		SigMsg:       exportSigMsg(txid, req.Anchor),
+		ChangeAnchor: changeAnchor,
+	}, nil
+}
+
+// SignExportTx signs unsigned with prv, the exporter's txvm key.
+func SignExportTx(unsigned UnsignedExportTx, prv ed25519.PrivateKey) SignedExportTx {
+	return SignedExportTx{
+		Prog1:     unsigned.Prog1,
+		Version:   unsigned.Version,
+		Signature: ed25519.Sign(prv, unsigned.SigMsg),
+	}
+}
+
+// FinishExportTx adds the exporter's signature to an export tx
+// built by BuildUnsignedExportTx,
+// returning the finished tx, ready for submission to slidechain.
+// It is an error if the signature is not the exporter's.
+func FinishExportTx(signed SignedExportTx) (*bc.Tx, error) {
+	err := checkTxVersion(signed.Version)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := finishExportTx(signed.Prog1, signed.Version, signed.Signature)
+	if err != nil {
+		return nil, err
+	}
+	_, err = InspectExportTx(tx)
+	if err != nil {
+		return nil, errors.Wrap(err, "inspecting export tx")
+	}
+	return tx, nil
+}
+
+// BuildExportTxHandler responds to a POST request
+// with a JSON ExportTxRequest in its body
+// with the JSON UnsignedExportTx built by BuildUnsignedExportTx,
+// for exporters that sign with their own keys but do not run txvm.
+// They complete the tx with FinishExportTxHandler.
+func (c *Custodian) BuildExportTxHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	var exportReq ExportTxRequest
+	err := json.NewDecoder(req.Body).Decode(&exportReq)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "decoding export tx request: %s", err)
+		return
+	}
+	unsigned, err := BuildUnsignedExportTx(exportReq)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(unsigned)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+		return
+	}
+}
+
+// FinishExportTxHandler responds to a POST request
+// with a JSON SignedExportTx in its body
+// with the tx finished by FinishExportTx,
+// serialized as for submission to /submit.
+// The tx is not submitted.
+func (c *Custodian) FinishExportTxHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	var signed SignedExportTx
+	err := json.NewDecoder(req.Body).Decode(&signed)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "decoding signed export tx: %s", err)
+		return
+	}
+	tx, err := FinishExportTx(signed)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	bits, err := proto.Marshal(&tx.RawTx)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "marshaling export tx: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, err = w.Write(bits)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+	}
+}
@@ -0,0 +1,119 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/golang/protobuf/proto"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestBuildExportTxHandlers(t *testing.T) {
+	ctx := context.Background()
+	pubkey, exporterPrv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPrv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assetXDR, err := zioncoin.NativeAsset().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var anchor [32]byte
+	anchor[0] = 1
+	c := new(Custodian)
+
+	post := func(h http.HandlerFunc, v interface{}) *httptest.ResponseRecorder {
+		body, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+		return w
+	}
+
+	// The two-step exchange yields the tx BuildExportTx would.
+	want, wantChange, err := BuildExportTxWithOptions(ctx, zioncoin.NativeAsset(), 30, 50, tempKP.Address(), anchor[:], exporterPrv, 1, ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := post(c.BuildExportTxHandler, ExportTxRequest{
+		AssetXDR:     assetXDR,
+		ExportAmount: 30,
+		InputAmount:  50,
+		TempAddr:     tempKP.Address(),
+		Anchor:       anchor[:],
+		Pubkey:       pubkey,
+		Seqnum:       1,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d building export tx, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var unsigned UnsignedExportTx
+	err = json.NewDecoder(w.Body).Decode(&unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unsigned.TxID, want.ID.Bytes()) {
+		t.Errorf("got txid %x, want %x", unsigned.TxID, want.ID.Bytes())
+	}
+	if !bytes.Equal(unsigned.ChangeAnchor, wantChange) {
+		t.Errorf("got change anchor %x, want %x", unsigned.ChangeAnchor, wantChange)
+	}
+
+	w = post(c.FinishExportTxHandler, SignExportTx(unsigned, exporterPrv))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d finishing export tx, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var rawTx bc.RawTx
+	err = proto.Unmarshal(w.Body.Bytes(), &rawTx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := bc.NewTx(rawTx.Program, rawTx.Version, rawTx.Runlimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.ID != want.ID {
+		t.Errorf("got finished tx %x, want %x", tx.ID.Bytes(), want.ID.Bytes())
+	}
+	_, err = InspectExportTx(tx)
+	if err != nil {
+		t.Errorf("finished tx not recognized as an export: %s", err)
+	}
+
+	// A signature by another key is refused.
+	w = post(c.FinishExportTxHandler, SignExportTx(unsigned, otherPrv))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d finishing export tx signed by another key, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// So is a request the custodian cannot build.
+	w = post(c.BuildExportTxHandler, ExportTxRequest{
+		AssetXDR:     assetXDR,
+		ExportAmount: 50,
+		InputAmount:  30,
+		TempAddr:     tempKP.Address(),
+		Anchor:       anchor[:],
+		Pubkey:       pubkey,
+		Seqnum:       1,
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d building export of more than its input, want %d", w.Code, http.StatusBadRequest)
+	}
+}
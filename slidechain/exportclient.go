@@ -0,0 +1,300 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/golang/protobuf/proto"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/strkey"
+	"github.com/zioncoin/go/xdr"
+)
+
+// settlementPollInterval is how often AwaitPegOut
+// checks whether an export's temp account has been merged.
+const settlementPollInterval = 5 * time.Second
+
+// ExportClient exports funds from slidechain in one call,
+// doing the steps an exporter otherwise takes one by one:
+// the pre-export, the export tx, and its submission to slidechaind.
+type ExportClient struct {
+	// Slidechaind is the URL of the slidechaind server.
+	Slidechaind string
+
+	// Horizon is the client of the Zioncoin network
+	// on which the exporter's account and temp accounts live.
+	Horizon equator.ClientInterface
+
+	// HTTP makes the requests to Slidechaind.
+	// If nil, http.DefaultClient is used.
+	HTTP *http.Client
+
+	// Limiter limits the temp accounts made by pre-exports.
+	// If nil, the default limits apply (see PreExportOptions.Limiter).
+	Limiter *TempAccountLimiter
+
+	// TempAccounts, if not nil, tracks the temp accounts made by pre-exports,
+	// so that those of failed exports can be reclaimed
+	// (see PreExportOptions.TempAccounts).
+	TempAccounts *TempAccounts
+
+	// Refdata is the format of the export's refdata.
+	// If empty, DefaultRefdataFormat is used.
+	Refdata RefdataFormat
+}
+
+// ExportReceipt describes an export made by ExportClient.Export.
+type ExportReceipt struct {
+	// TxID is the ID of the export tx on slidechain.
+	TxID bc.Hash
+
+	// TempAddr and Seqnum identify the temp account
+	// whose preauthorized tx pegs the export out.
+	TempAddr string
+	Seqnum   xdr.SequenceNumber
+
+	// Payout is the amount the peg-out tx pays the exporter,
+	// net of the custodian's fee.
+	Payout int64
+
+	// Change is the output paying back the input not exported, if any.
+	Change *OutputRef
+}
+
+// Export exports amount of asset from the slidechain output input,
+// controlled by the txvm key with the same seed as kp,
+// to kp's Zioncoin account.
+// It makes the pre-export for the custodian's payout,
+// builds the export tx, and submits it to slidechaind,
+// waiting until it is in a block.
+// If the export tx cannot be built or slidechaind refuses it,
+// the pre-export is canceled and its temp account merged back into kp's account.
+// The returned receipt tracks the peg-out (see AwaitPegOut).
+func (e *ExportClient) Export(ctx context.Context, kp *keypair.Full, asset xdr.Asset, amount int64, input OutputRef) (ExportReceipt, error) {
+	prv, err := txvmKey(kp)
+	if err != nil {
+		return ExportReceipt{}, err
+	}
+	custodian, err := e.custodian(ctx)
+	if err != nil {
+		return ExportReceipt{}, err
+	}
+	payout, err := e.payout(ctx, asset, amount)
+	if err != nil {
+		return ExportReceipt{}, err
+	}
+	fee, err := e.baseFee(ctx)
+	if err != nil {
+		return ExportReceipt{}, err
+	}
+
+	tempAddr, seqnum, err := SubmitPreExportTxWithOptions(e.Horizon, kp, custodian, asset, payout, PreExportOptions{
+		BaseFee:      fee,
+		Limiter:      e.Limiter,
+		TempAccounts: e.TempAccounts,
+	})
+	if err != nil {
+		return ExportReceipt{}, errors.Wrap(err, "submitting pre-export tx")
+	}
+	tx, change, err := BuildExportTxFromUTXO(ctx, input, asset, amount, tempAddr, prv, seqnum, ExportOptions{Format: e.Refdata, BaseFee: fee})
+	if err != nil {
+		return ExportReceipt{}, e.cancel(kp, tempAddr, errors.Wrap(err, "building export tx"))
+	}
+	refused, err := e.submit(ctx, tx)
+	if refused {
+		return ExportReceipt{}, e.cancel(kp, tempAddr, err)
+	}
+	if err != nil {
+		// The export tx may yet be in a block,
+		// so the temp account is left for its peg-out.
+		return ExportReceipt{}, errors.Wrapf(err, "submitting export tx %x with temp account %s", tx.ID.Bytes(), tempAddr)
+	}
+	return ExportReceipt{
+		TxID:     tx.ID,
+		TempAddr: tempAddr,
+		Seqnum:   seqnum,
+		Payout:   payout,
+		Change:   change,
+	}, nil
+}
+
+// txvmKey returns the txvm private key with the same seed as kp.
+func txvmKey(kp *keypair.Full) (ed25519.PrivateKey, error) {
+	seed, err := strkey.Decode(strkey.VersionByteSeed, kp.Seed())
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding exporter seed")
+	}
+	_, prv, err := ed25519.GenerateKey(bytes.NewReader(seed))
+	return prv, errors.Wrap(err, "deriving exporter txvm key")
+}
+
+// cancel cancels the pre-export with temp account tempAddr
+// after a failure err of the export, which it returns.
+func (e *ExportClient) cancel(kp *keypair.Full, tempAddr string, err error) error {
+	var cerr error
+	if e.TempAccounts != nil {
+		cerr = e.TempAccounts.CancelPreExport(e.Horizon, kp, tempAddr)
+	} else {
+		cerr = CancelPreExport(e.Horizon, kp, tempAddr)
+	}
+	if cerr != nil {
+		return errors.Wrapf(err, "canceling pre-export with temp account %s: %s", tempAddr, cerr)
+	}
+	return err
+}
+
+func (e *ExportClient) client() *http.Client {
+	if e.HTTP != nil {
+		return e.HTTP
+	}
+	return http.DefaultClient
+}
+
+func (e *ExportClient) url(path string) string {
+	return strings.TrimRight(e.Slidechaind, "/") + path
+}
+
+// get GETs path from slidechaind.
+// The caller must close the body of the response.
+func (e *ExportClient) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", e.url(path), nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "building request for %s", path)
+	}
+	resp, err := e.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting %s", path)
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("status code %d from GET %s", resp.StatusCode, path)
+	}
+	return resp, nil
+}
+
+// custodian returns the address of slidechaind's custodian account.
+func (e *ExportClient) custodian(ctx context.Context) (string, error) {
+	resp, err := e.get(ctx, "/account")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var custodian xdr.AccountId
+	_, err = xdr.Unmarshal(resp.Body, &custodian)
+	if err != nil {
+		return "", errors.Wrap(err, "unmarshaling custodian account id")
+	}
+	return custodian.Address(), nil
+}
+
+// payout returns the amount the custodian's peg-out tx
+// pays for an export of amount of asset:
+// the payout net of its fee,
+// or the first tranche if it splits the payout.
+func (e *ExportClient) payout(ctx context.Context, asset xdr.Asset, amount int64) (int64, error) {
+	resp, err := e.get(ctx, "/fees")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var fees map[string]FeePolicy
+	err = json.NewDecoder(resp.Body).Decode(&fees)
+	if err != nil {
+		return 0, errors.Wrap(err, "decoding custodian fees")
+	}
+	policy := fees[asset.String()]
+	payout, _, err := policy.Payout(amount)
+	if err != nil {
+		return 0, errors.Wrapf(err, "export of %d of %s", amount, asset.String())
+	}
+	return policy.Split(payout)[0], nil
+}
+
+// baseFee returns the custodian's base fee,
+// which the peg-out tx preauthorized by the pre-export must pay.
+func (e *ExportClient) baseFee(ctx context.Context) (int64, error) {
+	resp, err := e.get(ctx, "/fees/base")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var fee BaseFeeResponse
+	err = json.NewDecoder(resp.Body).Decode(&fee)
+	if err != nil {
+		return 0, errors.Wrap(err, "decoding custodian base fee")
+	}
+	return fee.BaseFee, nil
+}
+
+// submit submits tx to slidechaind and waits until it is in a block.
+// It reports whether slidechaind refused the tx,
+// so that it can never be in a block.
+func (e *ExportClient) submit(ctx context.Context, tx *bc.Tx) (bool, error) {
+	txbits, err := proto.Marshal(&tx.RawTx)
+	if err != nil {
+		return true, errors.Wrap(err, "marshaling export tx")
+	}
+	req, err := http.NewRequest("POST", e.url("/submit?wait=1"), bytes.NewReader(txbits))
+	if err != nil {
+		return true, errors.Wrap(err, "building request to submit export tx")
+	}
+	resp, err := e.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 4 {
+		return true, fmt.Errorf("status code %d from POST /submit", resp.StatusCode)
+	}
+	if resp.StatusCode/100 != 2 {
+		return false, fmt.Errorf("status code %d from POST /submit", resp.StatusCode)
+	}
+	return false, nil
+}
+
+// PeggedOut reports whether the export's peg-out tx has been applied,
+// merging its temp account into the exporter's account.
+func (r ExportReceipt) PeggedOut(hclient equator.ClientInterface) (bool, error) {
+	_, err := hclient.LoadAccount(r.TempAddr)
+	if isNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "loading temp account %s", r.TempAddr)
+	}
+	return false, nil
+}
+
+// AwaitPegOut waits until the export's peg-out tx has been applied
+// or ctx is done.
+// An export the custodian refuses to peg out is refunded on slidechain,
+// and its temp account is never merged;
+// bound the wait with ctx,
+// and reclaim the temp account of a refunded export with CancelPreExport.
+func (r ExportReceipt) AwaitPegOut(ctx context.Context, hclient equator.ClientInterface) error {
+	ticker := time.NewTicker(settlementPollInterval)
+	defer ticker.Stop()
+	for {
+		ok, err := r.PeggedOut(hclient)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
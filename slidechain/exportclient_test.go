@@ -0,0 +1,198 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/txresult"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/xdr"
+)
+
+// loadTempAccounts returns a loadAccount func
+// serving every account loaded from hclient as a temp account
+// with signer as a signer,
+// except that the accounts in merged are not found.
+func loadTempAccounts(hclient equator.ClientInterface, signer string, merged map[string]bool) func(string) (equator.Account, error) {
+	return func(accountID string) (equator.Account, error) {
+		if merged[accountID] {
+			return equator.Account{}, notFound()
+		}
+		account, err := hclient.LoadAccount(accountID)
+		account.Signers = append(account.Signers, equator.Signer{Key: signer, Weight: 1})
+		return account, err
+	}
+}
+
+func TestExportClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		c.S.blockInterval = 100 * time.Millisecond
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/account", c.Account)
+		mux.HandleFunc("/fees", c.Fees)
+		mux.HandleFunc("/fees/base", c.BaseFeeHandler)
+		mux.Handle("/submit", c.S)
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		prv, err := txvmKey(exporter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := prv.Public().(ed25519.PublicKey)
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Import 100 to the exporter's txvm key.
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		body, err := json.Marshal(PrePegIn{
+			BcID:        c.InitBlockHash.Bytes(),
+			Amount:      100,
+			AssetXDR:    lumenXDR,
+			RecipPubkey: pub,
+			ExpMS:       expMS,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		c.DoPrePegIn(w, httptest.NewRequest("POST", "/prepegin", bytes.NewReader(body)).WithContext(ctx))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d from pre-peg-in: %s", w.Code, w.Body.String())
+		}
+		err = c.recordPegIn(ctx, "txid", "1", w.Body.Bytes(), "source", 100, lumenXDR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		importTxBytes, err := c.buildImportTx(100, expMS, lumenXDR, pub, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var runlimit int64
+		importTx, err := bc.NewTx(importTxBytes, 3, math.MaxInt64, txvm.GetRunlimit(&runlimit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		importTx.Runlimit = math.MaxInt64 - runlimit
+		r, err := c.S.submitTx(ctx, importTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.S.waitOnTx(ctx, importTx.ID, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input, err := OutputRefFromResult(txresult.New(importTx).Outputs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mergedTemps := make(map[string]bool)
+		hclient := &fakeClient{ClientInterface: c.hclient, loadAccount: loadTempAccounts(c.hclient, exporter.Address(), mergedTemps)}
+		client := &ExportClient{Slidechaind: server.URL, Horizon: hclient}
+		height := c.S.chain.Height()
+		receipt, err := client.Export(ctx, exporter, zioncoin.NativeAsset(), 60, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The export tx is on slidechain, retiring 60 and returning 40 in change.
+		if c.S.chain.Height() <= height {
+			t.Errorf("got chain height %d after export, want more than %d", c.S.chain.Height(), height)
+		}
+		if receipt.Change == nil || receipt.Change.Amount != 40 {
+			t.Errorf("got change %+v, want 40", receipt.Change)
+		}
+		if receipt.TempAddr == "" || receipt.Payout != 60 {
+			t.Errorf("got receipt with temp account %q, payout %d; want a temp account paying 60", receipt.TempAddr, receipt.Payout)
+		}
+		// The receipt records the temp account's sequence number as Horizon reports it.
+		seqnum, err := hclient.SequenceForAccount(receipt.TempAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receipt.Seqnum != seqnum {
+			t.Errorf("got receipt with seqnum %d, want %d", receipt.Seqnum, seqnum)
+		}
+
+		// The pre-export created and set up the temp account,
+		// paying the custodian's base fee.
+		txs := hclient.submittedTxs()
+		var created bool
+		for _, txe := range txs {
+			var env xdr.TransactionEnvelope
+			err = xdr.SafeUnmarshalBase64(txe, &env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, op := range env.Tx.Operations {
+				if op.Body.CreateAccountOp != nil && op.Body.CreateAccountOp.Destination.Address() == receipt.TempAddr {
+					created = true
+					if want := int64(len(env.Tx.Operations)) * c.BaseFee; int64(env.Tx.Fee) != want {
+						t.Errorf("got temp account creation fee %d, want %d", env.Tx.Fee, want)
+					}
+				}
+			}
+		}
+		if !created {
+			t.Errorf("no submitted tx creates temp account %s", receipt.TempAddr)
+		}
+
+		// The receipt tracks the peg-out by its temp account.
+		ok, err := receipt.PeggedOut(hclient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Error("got export pegged out before its temp account was merged")
+		}
+		mergedTemps[receipt.TempAddr] = true
+		err = receipt.AwaitPegOut(ctx, hclient)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// An export of more than the input cannot be built,
+		// so its pre-export is canceled, merging the temp account back.
+		_, err = client.Export(ctx, exporter, zioncoin.NativeAsset(), 1000, *receipt.Change)
+		if err == nil {
+			t.Fatal("got no error exporting more than the input")
+		}
+		txs = hclient.submittedTxs()
+		last := txs[len(txs)-1]
+		var env xdr.TransactionEnvelope
+		err = xdr.SafeUnmarshalBase64(last, &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var merged bool
+		for _, op := range env.Tx.Operations {
+			merged = merged || op.Body.Type == xdr.OperationTypeAccountMerge
+		}
+		if !merged {
+			t.Errorf("got last tx with operations %+v, want the pre-export canceled by an account merge", env.Tx.Operations)
+		}
+	}, BaseFee(2*baseFee))
+}
@@ -0,0 +1,176 @@
+package slidechain
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/xdr"
+)
+
+// fakeClient is the Horizon client of tests that need more than mockequator.
+// It passes each call on to the client it wraps,
+// unless the test sets the func for that method,
+// which it calls instead, e.g. to serve fixed data or record calls.
+// It also counts the txs submitted through it,
+// failing the next fails of them,
+// and records the rest, which it passes on.
+type fakeClient struct {
+	equator.ClientInterface
+
+	loadAccount            func(accountID string) (equator.Account, error)
+	loadTransaction        func(hash string) (equator.Transaction, error)
+	loadOrderBook          func(selling, buying equator.Asset, params ...interface{}) (equator.OrderBookSummary, error)
+	sequenceForAccount     func(accountID string) (xdr.SequenceNumber, error)
+	submitTransaction      func(txeBase64 string) (equator.TransactionSuccess, error)
+	submitTransactionAsync func(txeBase64 string) (AsyncSubmission, error)
+	streamTransactions     func(ctx context.Context, accountID string, cursor *equator.Cursor, handler equator.TransactionHandler) error
+	streamLedgers          func(ctx context.Context, cursor *equator.Cursor, handler equator.LedgerHandler) error
+	root                   func() (equator.Root, error)
+
+	// fails is the number of submissions to fail next,
+	// each with failure, or a generic error if it is nil.
+	fails   int32
+	failure error
+
+	submitted int32 // including failed submissions
+
+	mu    sync.Mutex
+	times []time.Time // of each submission, including failed ones
+	txs   []string    // not including failed submissions
+}
+
+func (c *fakeClient) LoadAccount(accountID string) (equator.Account, error) {
+	if c.loadAccount != nil {
+		return c.loadAccount(accountID)
+	}
+	return c.ClientInterface.LoadAccount(accountID)
+}
+
+func (c *fakeClient) LoadTransaction(hash string) (equator.Transaction, error) {
+	if c.loadTransaction != nil {
+		return c.loadTransaction(hash)
+	}
+	return c.ClientInterface.LoadTransaction(hash)
+}
+
+func (c *fakeClient) LoadOrderBook(selling, buying equator.Asset, params ...interface{}) (equator.OrderBookSummary, error) {
+	if c.loadOrderBook != nil {
+		return c.loadOrderBook(selling, buying, params...)
+	}
+	return c.ClientInterface.LoadOrderBook(selling, buying, params...)
+}
+
+func (c *fakeClient) SequenceForAccount(accountID string) (xdr.SequenceNumber, error) {
+	if c.sequenceForAccount != nil {
+		return c.sequenceForAccount(accountID)
+	}
+	return c.ClientInterface.SequenceForAccount(accountID)
+}
+
+func (c *fakeClient) SubmitTransaction(txeBase64 string) (equator.TransactionSuccess, error) {
+	atomic.AddInt32(&c.submitted, 1)
+	c.mu.Lock()
+	c.times = append(c.times, time.Now())
+	c.mu.Unlock()
+	if c.failNext() {
+		failure := c.failure
+		if failure == nil {
+			failure = errors.New("tx failed")
+		}
+		return equator.TransactionSuccess{}, failure
+	}
+	c.mu.Lock()
+	c.txs = append(c.txs, txeBase64)
+	c.mu.Unlock()
+	if c.submitTransaction != nil {
+		return c.submitTransaction(txeBase64)
+	}
+	return c.ClientInterface.SubmitTransaction(txeBase64)
+}
+
+// SubmitTransactionAsync reports that the wrapped client
+// cannot submit txs asynchronously, unless it can.
+func (c *fakeClient) SubmitTransactionAsync(txeBase64 string) (AsyncSubmission, error) {
+	if c.submitTransactionAsync != nil {
+		return c.submitTransactionAsync(txeBase64)
+	}
+	if as, ok := c.ClientInterface.(AsyncSubmitter); ok {
+		return as.SubmitTransactionAsync(txeBase64)
+	}
+	return AsyncSubmission{}, ErrAsyncUnsupported
+}
+
+func (c *fakeClient) StreamTransactions(ctx context.Context, accountID string, cursor *equator.Cursor, handler equator.TransactionHandler) error {
+	if c.streamTransactions != nil {
+		return c.streamTransactions(ctx, accountID, cursor, handler)
+	}
+	return c.ClientInterface.StreamTransactions(ctx, accountID, cursor, handler)
+}
+
+func (c *fakeClient) StreamLedgers(ctx context.Context, cursor *equator.Cursor, handler equator.LedgerHandler) error {
+	if c.streamLedgers != nil {
+		return c.streamLedgers(ctx, cursor, handler)
+	}
+	return c.ClientInterface.StreamLedgers(ctx, cursor, handler)
+}
+
+func (c *fakeClient) Root() (equator.Root, error) {
+	if c.root != nil {
+		return c.root()
+	}
+	return c.ClientInterface.Root()
+}
+
+// failNext reports whether to fail a submission,
+// counting it against c.fails.
+func (c *fakeClient) failNext() bool {
+	for {
+		n := atomic.LoadInt32(&c.fails)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&c.fails, n, n-1) {
+			return true
+		}
+	}
+}
+
+// submittedTxs returns the txs submitted through c, in order.
+func (c *fakeClient) submittedTxs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.txs...)
+}
+
+// notFound is the error with which Horizon reports a missing resource.
+func notFound() error {
+	return &equator.Error{Problem: equator.Problem{Status: http.StatusNotFound}}
+}
+
+// loadAccountsFrom returns a loadAccount func serving accounts,
+// reporting any other account as not found.
+func loadAccountsFrom(accounts map[string]equator.Account) func(string) (equator.Account, error) {
+	return func(accountID string) (equator.Account, error) {
+		account, ok := accounts[accountID]
+		if !ok {
+			return equator.Account{}, notFound()
+		}
+		return account, nil
+	}
+}
+
+// loadTxsFrom returns a loadTransaction func serving the txs in txs,
+// reporting any other tx as not found.
+func loadTxsFrom(txs map[string]bool) func(string) (equator.Transaction, error) {
+	return func(hash string) (equator.Transaction, error) {
+		if !txs[hash] {
+			return equator.Transaction{}, notFound()
+		}
+		return equator.Transaction{Hash: hash}, nil
+	}
+}
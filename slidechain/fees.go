@@ -0,0 +1,166 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interzioncoin/slingshot/slidechain/net"
+	"github.com/zioncoin/go/xdr"
+)
+
+// FeePolicy describes the fee a custodian deducts from an exported amount
+// before paying it out on the Zioncoin network.
+// All amounts are in the asset's smallest unit (stroops, for lumens).
+type FeePolicy struct {
+	// Flat is charged on every peg-out.
+	Flat int64 `json:"flat"`
+
+	// BasisPoints is charged in hundredths of a percent of the exported amount.
+	BasisPoints int64 `json:"basis_points"`
+
+	// MinPayout is the smallest amount, net of the fee, that will be pegged out.
+	MinPayout int64 `json:"min_payout"`
+
+	// MaxPayout, if positive, is the largest amount, net of the fee,
+	// that one export will be pegged out.
+	MaxPayout int64 `json:"max_payout,omitempty"`
+
+	// Tranches, if greater than 1, is the number of partial payments
+	// into which a payout of at least TrancheMin is split (see Split).
+	Tranches   int   `json:"tranches,omitempty"`
+	TrancheMin int64 `json:"tranche_min,omitempty"`
+
+	// MaxPerTx, if positive, caps the amount paid by any one transaction,
+	// as some regulated assets or risk policies require.
+	// A larger payout is split into as many payments as the cap requires
+	// (see Split).
+	MaxPerTx int64 `json:"max_per_tx,omitempty"`
+
+	// DustThreshold, if positive, is the smallest exported amount
+	// pegged out on its own.
+	// Smaller exports are rejected,
+	// or, if HoldDust is true,
+	// held until those of the same exporter add up to the threshold
+	// and then paid out together.
+	DustThreshold int64 `json:"dust_threshold,omitempty"`
+	HoldDust      bool  `json:"hold_dust,omitempty"`
+}
+
+// Payout returns the amount paid out for an export of the given amount,
+// and the fee deducted from it.
+// It is an error for the fee to leave less than the policy's minimum payout,
+// or nothing at all,
+// or for the payout to exceed the policy's maximum.
+func (p FeePolicy) Payout(amount int64) (payout, fee int64, err error) {
+	pct := new(big.Int).Mul(big.NewInt(amount), big.NewInt(p.BasisPoints))
+	pct.Quo(pct, big.NewInt(10000))
+	total := pct.Add(pct, big.NewInt(p.Flat))
+	if total.Sign() < 0 || total.Cmp(big.NewInt(amount)) >= 0 {
+		return 0, 0, fmt.Errorf("fee %s leaves nothing of amount %d to peg out", total, amount)
+	}
+	fee = total.Int64()
+	payout = amount - fee
+	if payout < p.MinPayout {
+		return 0, 0, fmt.Errorf("payout %d after fee %d is below the minimum of %d", payout, fee, p.MinPayout)
+	}
+	if p.MaxPayout > 0 && payout > p.MaxPayout {
+		return 0, 0, fmt.Errorf("payout %d after fee %d is above the maximum of %d", payout, fee, p.MaxPayout)
+	}
+	return payout, fee, nil
+}
+
+// Split returns the partial payments of a payout under the policy's tranches.
+// The first is paid by the preauthorized peg-out tx,
+// so it is the amount an exporter must preauthorize (see SubmitPreExportTx);
+// the rest are paid by the custodian in later ledgers.
+// A payout that is not split is returned as a single payment.
+// If the largest tranche, the first, would exceed MaxPerTx,
+// the payout is instead split into payments of MaxPerTx each,
+// preceded by one of the remainder.
+// Either way the payments sum to the payout.
+func (p FeePolicy) Split(payout int64) []int64 {
+	tranches := p.splitTranches(payout)
+	if p.MaxPerTx <= 0 || tranches[0] <= p.MaxPerTx {
+		return tranches
+	}
+	n := (payout + p.MaxPerTx - 1) / p.MaxPerTx
+	tranches = make([]int64, n)
+	for i := range tranches {
+		tranches[i] = p.MaxPerTx
+	}
+	tranches[0] = payout - (n-1)*p.MaxPerTx
+	return tranches
+}
+
+// splitTranches splits payout into the policy's tranches.
+func (p FeePolicy) splitTranches(payout int64) []int64 {
+	n := int64(p.Tranches)
+	if n <= 1 || payout < p.TrancheMin || payout < n {
+		return []int64{payout}
+	}
+	tranches := make([]int64, n)
+	for i := range tranches {
+		tranches[i] = payout / n
+	}
+	tranches[0] += payout % n
+	return tranches
+}
+
+// PegOutFees sets the fee policy for each asset the custodian pegs out,
+// keyed by the asset's string form
+// (e.g. "native" or "credit_alphanum4/USD/G...").
+// Assets with no policy are pegged out with no fee.
+func PegOutFees(fees map[string]FeePolicy) Option {
+	return func(c *Custodian) {
+		c.fees = fees
+	}
+}
+
+func (c *Custodian) feePolicy(asset xdr.Asset) FeePolicy {
+	return c.fees[asset.String()]
+}
+
+func (c *Custodian) recordFee(ctx context.Context, txid []byte, assetXDR []byte, fee int64) error {
+	_, err := c.DB.ExecContext(ctx, `INSERT OR IGNORE INTO fees (txid, asset_xdr, amount) VALUES ($1, $2, $3)`, txid, assetXDR, fee)
+	return errors.Wrapf(err, "recording fee for export %x", txid)
+}
+
+// Fees responds with the custodian's peg-out fee policies as JSON.
+// Exporters need these to pre-authorize a peg-out of the amount net of the fee.
+func (c *Custodian) Fees(w http.ResponseWriter, req *http.Request) {
+	fees := c.fees
+	if fees == nil {
+		fees = make(map[string]FeePolicy)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(fees)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+		return
+	}
+}
+
+// BaseFeeResponse is the JSON response of BaseFeeHandler.
+type BaseFeeResponse struct {
+	// BaseFee is the custodian's base fee, in stroops per operation
+	// (see the BaseFee option).
+	BaseFee int64 `json:"base_fee"`
+}
+
+// BaseFeeHandler responds with the custodian's base fee
+// as a JSON BaseFeeResponse.
+// Exporters need it to pre-export (see PreExportOptions.BaseFee),
+// since the fee is part of the hash of the peg-out tx
+// their temp accounts preauthorize.
+func (c *Custodian) BaseFeeHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(BaseFeeResponse{BaseFee: c.BaseFee})
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+		return
+	}
+}
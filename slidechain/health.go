@@ -0,0 +1,65 @@
+package slidechain
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// health tracks the components of a Custodian that are currently failing.
+// The zero value reports healthy.
+type health struct {
+	mu       sync.Mutex
+	failures map[string]error
+}
+
+func (h *health) setUnhealthy(component string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.failures == nil {
+		h.failures = make(map[string]error)
+	}
+	if _, ok := h.failures[component]; !ok {
+		log.Printf("%s is unhealthy: %s", component, err)
+	}
+	h.failures[component] = err
+}
+
+func (h *health) setHealthy(component string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.failures[component]; ok {
+		log.Printf("%s has recovered", component)
+		delete(h.failures, component)
+	}
+}
+
+// problems returns a description of each failing component, sorted by component.
+func (h *health) problems() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var result []string
+	for component, err := range h.failures {
+		result = append(result, fmt.Sprintf("%s: %s", component, err))
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Health reports whether the custodian's long-running goroutines are healthy.
+// It responds with status 200 if so,
+// otherwise with status 503 and a description of each failing component.
+func (c *Custodian) Health(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	problems := c.health.problems()
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	for _, p := range problems {
+		fmt.Fprintln(w, p)
+	}
+}
@@ -0,0 +1,148 @@
+package slidechain
+
+import (
+	"net/http"
+
+	"github.com/chain/txvm/errors"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/xdr"
+)
+
+// ErrorClass classifies the failure of a transaction submitted to Horizon.
+type ErrorClass int
+
+const (
+	// ClassPermanent is a failure that resubmitting the tx cannot fix.
+	ClassPermanent ErrorClass = iota
+
+	// ClassRetryableSeq is a tx with a stale sequence number,
+	// which succeeds if rebuilt with the source account's current one.
+	ClassRetryableSeq
+
+	// ClassRetryableFee is a tx whose fee was below the network's minimum.
+	ClassRetryableFee
+
+	// ClassInsufficientBalance is a tx whose source account
+	// could not pay the fee, an amount, or its reserve.
+	ClassInsufficientBalance
+
+	// ClassBadAuth is a tx or operation lacking the signatures it needs.
+	ClassBadAuth
+
+	// ClassUnknown is a failure carrying no tx result,
+	// e.g. a timeout, after which the tx may yet be applied.
+	// Looking up the tx's hash resolves it.
+	ClassUnknown
+)
+
+func (class ErrorClass) String() string {
+	switch class {
+	case ClassPermanent:
+		return "permanent"
+	case ClassRetryableSeq:
+		return "retryable-seq"
+	case ClassRetryableFee:
+		return "retryable-fee"
+	case ClassInsufficientBalance:
+		return "insufficient-balance"
+	case ClassBadAuth:
+		return "bad-auth"
+	case ClassUnknown:
+		return "unknown"
+	}
+	return "invalid"
+}
+
+// classifyHorizonError classifies err, returned by the submission of a tx to Horizon,
+// and returns the result codes Horizon reports for the tx's operations, if any.
+// The class is decided by the tx's XDR result;
+// an operation's result decides the class of a failed tx.
+// An error carrying no result, such as a Horizon timeout, a reset connection,
+// or an expired context, is ClassUnknown: the tx may yet be applied.
+// A tx not accepted for asynchronous submission (see AsyncPegOuts)
+// is classified by its status and result.
+func classifyHorizonError(err error) (ErrorClass, []string) {
+	if rej, ok := errors.Root(err).(*asyncRejection); ok {
+		return rej.class(), nil
+	}
+	herr, ok := errors.Root(err).(*equator.Error)
+	if !ok {
+		return ClassUnknown, nil
+	}
+	var opCodes []string
+	if codes, err := herr.ResultCodes(); err == nil {
+		opCodes = codes.OperationCodes
+	}
+	resultXDR, err := herr.ResultString()
+	if err != nil {
+		if herr.Problem.Status >= http.StatusInternalServerError || herr.Problem.Status == http.StatusTooManyRequests {
+			return ClassUnknown, opCodes
+		}
+		// Horizon refused the tx without trying it, e.g. as malformed.
+		return ClassPermanent, opCodes
+	}
+	var result xdr.TransactionResult
+	err = xdr.SafeUnmarshalBase64(resultXDR, &result)
+	if err != nil {
+		return ClassUnknown, opCodes
+	}
+	return classifyTxResult(result), opCodes
+}
+
+// classifyTxResult classifies a tx that failed with the given result.
+func classifyTxResult(result xdr.TransactionResult) ErrorClass {
+	switch result.Result.Code {
+	case xdr.TransactionResultCodeTxBadSeq:
+		return ClassRetryableSeq
+	case xdr.TransactionResultCodeTxInsufficientFee:
+		return ClassRetryableFee
+	case xdr.TransactionResultCodeTxInsufficientBalance:
+		return ClassInsufficientBalance
+	case xdr.TransactionResultCodeTxBadAuth, xdr.TransactionResultCodeTxBadAuthExtra:
+		return ClassBadAuth
+	case xdr.TransactionResultCodeTxFailed:
+		ops, _ := result.Result.GetResults()
+		for _, op := range ops {
+			if class := classifyOpResult(op); class != ClassPermanent {
+				return class
+			}
+		}
+	}
+	return ClassPermanent
+}
+
+// classifyOpResult classifies a failed tx by the result of one of its operations.
+// It returns ClassPermanent for an operation
+// that failed for no reason with a class of its own, or succeeded.
+func classifyOpResult(op xdr.OperationResult) ErrorClass {
+	if op.Code == xdr.OperationResultCodeOpBadAuth {
+		return ClassBadAuth
+	}
+	tr, ok := op.GetTr()
+	if !ok {
+		return ClassPermanent
+	}
+	var underfunded bool
+	switch tr.Type {
+	case xdr.OperationTypeCreateAccount:
+		code := tr.CreateAccountResult.Code
+		underfunded = code == xdr.CreateAccountResultCodeCreateAccountUnderfunded || code == xdr.CreateAccountResultCodeCreateAccountLowReserve
+	case xdr.OperationTypePayment:
+		underfunded = tr.PaymentResult.Code == xdr.PaymentResultCodePaymentUnderfunded
+	case xdr.OperationTypePathPayment:
+		underfunded = tr.PathPaymentResult.Code == xdr.PathPaymentResultCodePathPaymentUnderfunded
+	case xdr.OperationTypeManageOffer:
+		code := tr.ManageOfferResult.Code
+		underfunded = code == xdr.ManageOfferResultCodeManageOfferUnderfunded || code == xdr.ManageOfferResultCodeManageOfferLowReserve
+	case xdr.OperationTypeSetOptions:
+		underfunded = tr.SetOptionsResult.Code == xdr.SetOptionsResultCodeSetOptionsLowReserve
+	case xdr.OperationTypeChangeTrust:
+		underfunded = tr.ChangeTrustResult.Code == xdr.ChangeTrustResultCodeChangeTrustLowReserve
+	case xdr.OperationTypeManageData:
+		underfunded = tr.ManageDataResult.Code == xdr.ManageDataResultCodeManageDataLowReserve
+	}
+	if underfunded {
+		return ClassInsufficientBalance
+	}
+	return ClassPermanent
+}
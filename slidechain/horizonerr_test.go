@@ -0,0 +1,135 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/chain/txvm/errors"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/xdr"
+)
+
+// txFailure returns the error Horizon gives for a tx that failed with the given result code
+// and operation results.
+func txFailure(t *testing.T, code xdr.TransactionResultCode, ops ...xdr.OperationResult) error {
+	result := xdr.TransactionResult{Result: xdr.TransactionResultResult{Code: code}}
+	if code == xdr.TransactionResultCodeTxFailed {
+		result.Result.Results = &ops
+	}
+	resultXDR, err := xdr.MarshalBase64(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultJSON, err := json.Marshal(resultXDR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &equator.Error{Problem: equator.Problem{
+		Type:   "https://zion.info/horizon-errors/transaction_failed",
+		Title:  "Transaction Failed",
+		Status: http.StatusBadRequest,
+		Extras: map[string]json.RawMessage{"result_xdr": resultJSON},
+	}}
+}
+
+// paymentResult returns the result of a payment operation with the given code.
+func paymentResult(code xdr.PaymentResultCode) xdr.OperationResult {
+	return xdr.OperationResult{
+		Code: xdr.OperationResultCodeOpInner,
+		Tr: &xdr.OperationResultTr{
+			Type:          xdr.OperationTypePayment,
+			PaymentResult: &xdr.PaymentResult{Code: code},
+		},
+	}
+}
+
+func TestClassifyHorizonError(t *testing.T) {
+	success := paymentResult(xdr.PaymentResultCodePaymentSuccess)
+	lowReserve := xdr.OperationResult{
+		Code: xdr.OperationResultCodeOpInner,
+		Tr: &xdr.OperationResultTr{
+			Type:                xdr.OperationTypeCreateAccount,
+			CreateAccountResult: &xdr.CreateAccountResult{Code: xdr.CreateAccountResultCodeCreateAccountLowReserve},
+		},
+	}
+	badAuth := xdr.OperationResult{Code: xdr.OperationResultCodeOpBadAuth}
+
+	cases := []struct {
+		name      string
+		err       error
+		wantClass ErrorClass
+	}{
+		{"bad seq", txFailure(t, xdr.TransactionResultCodeTxBadSeq), ClassRetryableSeq},
+		{"wrapped bad seq", errors.Wrap(txFailure(t, xdr.TransactionResultCodeTxBadSeq), "submitting peg-out tx"), ClassRetryableSeq},
+		{"insufficient fee", txFailure(t, xdr.TransactionResultCodeTxInsufficientFee), ClassRetryableFee},
+		{"insufficient balance", txFailure(t, xdr.TransactionResultCodeTxInsufficientBalance), ClassInsufficientBalance},
+		{"bad auth", txFailure(t, xdr.TransactionResultCodeTxBadAuth), ClassBadAuth},
+		{"bad auth extra", txFailure(t, xdr.TransactionResultCodeTxBadAuthExtra), ClassBadAuth},
+		{"underfunded op", txFailure(t, xdr.TransactionResultCodeTxFailed, success, paymentResult(xdr.PaymentResultCodePaymentUnderfunded)), ClassInsufficientBalance},
+		{"low reserve op", txFailure(t, xdr.TransactionResultCodeTxFailed, lowReserve), ClassInsufficientBalance},
+		{"bad auth op", txFailure(t, xdr.TransactionResultCodeTxFailed, badAuth, success), ClassBadAuth},
+		{"no trust op", txFailure(t, xdr.TransactionResultCodeTxFailed, paymentResult(xdr.PaymentResultCodePaymentNoTrust)), ClassPermanent},
+		{"too late", txFailure(t, xdr.TransactionResultCodeTxTooLate), ClassPermanent},
+		{"malformed", &equator.Error{Problem: equator.Problem{Status: http.StatusBadRequest}}, ClassPermanent},
+		{"timeout", &equator.Error{Problem: equator.Problem{Status: http.StatusGatewayTimeout}}, ClassUnknown},
+		{"rate limited", &equator.Error{Problem: equator.Problem{Status: http.StatusTooManyRequests}}, ClassUnknown},
+		{"not from horizon", errors.New("connection reset by peer"), ClassUnknown},
+		{"deadline", errors.Wrap(context.DeadlineExceeded, "submitting peg-out tx"), ClassUnknown},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			class, _ := classifyHorizonError(c.err)
+			if class != c.wantClass {
+				t.Errorf("got class %s, want %s", class, c.wantClass)
+			}
+		})
+	}
+
+	// The operation codes Horizon reports are passed along.
+	herr := txFailure(t, xdr.TransactionResultCodeTxFailed, paymentResult(xdr.PaymentResultCodePaymentNoTrust)).(*equator.Error)
+	codes, err := json.Marshal(equator.TransactionResultCodes{TransactionCode: "tx_failed", OperationCodes: []string{"op_no_trust"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	herr.Problem.Extras["result_codes"] = codes
+	if _, ops := classifyHorizonError(herr); !reflect.DeepEqual(ops, []string{"op_no_trust"}) {
+		t.Errorf("got operation codes %v, want [op_no_trust]", ops)
+	}
+}
+
+func TestResolveUnknownSubmission(t *testing.T) {
+	timeout := &equator.Error{Problem: equator.Problem{Status: http.StatusGatewayTimeout}}
+	badSeq := txFailure(t, xdr.TransactionResultCodeTxBadSeq)
+	cases := []struct {
+		name    string
+		err     error
+		applied bool
+		want    error
+	}{
+		{"timeout, applied", timeout, true, nil},
+		{"timeout, not applied", timeout, false, timeout},
+		{"deadline, applied", context.DeadlineExceeded, true, nil},
+		{"bad seq", badSeq, true, badSeq},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			// The tx is found if it was applied.
+			hclient := &fakeClient{loadTransaction: func(hash string) (equator.Transaction, error) {
+				if !tt.applied {
+					return equator.Transaction{}, notFound()
+				}
+				return equator.Transaction{Hash: hash}, nil
+			}}
+			c := &Custodian{hclient: hclient}
+			if got := c.resolveUnknownSubmission("hash", tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if state := pegOutFailureState([]byte("txid"), timeout); state != pegOutRetry {
+		t.Errorf("got state %d after an unresolved timeout, want %d", state, pegOutRetry)
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"math"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bobg/sqlutil"
 	"github.com/chain/txvm/crypto/ed25519"
@@ -18,28 +22,48 @@ import (
 )
 
 // buildImportTx builds the import transaction.
+// The peg's metadata, if any, is the refdata of the issued value's output.
 func (c *Custodian) buildImportTx(
 	amount, expMS int64,
-	assetXDR, recipPubkey []byte,
+	assetXDR, recipPubkey, metadata []byte,
 ) ([]byte, error) {
-	// Input plain-data consume token contract and put it on the arg stack.
+	return c.buildImportBatchTx([]pendingImport{{
+		amount:   amount,
+		expMS:    expMS,
+		assetXDR: assetXDR,
+		recip:    recipPubkey,
+		metadata: metadata,
+	}})
+}
+
+// buildImportBatchTx builds a transaction importing each of batch,
+// issuing the values and paying them to their recipients in order.
+// A batch of one is built as buildImportTx builds it.
+func (c *Custodian) buildImportBatchTx(batch []pendingImport) ([]byte, error) {
 	buf := new(bytes.Buffer)
-	fmt.Fprintf(buf, "{'C', x'%x', x'%x',", createTokenSeed[:], consumeTokenProg)
-	fmt.Fprintf(buf, " {'Z', %d}, {'T', {x'%x'}},", int64(1), recipPubkey)
-	// For a slight optimization, the anchor for that contract's value is
-	// split from the value generated by the `nonce` instruction. Reconstructing
-	// this new anchor is below.
-	nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
-	snapshotNonceHash := txvm.VMHash("Split2", nonceHash[:])
-	fmt.Fprintf(buf, " {'V', %d, x'%x', x'%x'},", 0, zeroSeed[:], snapshotNonceHash[:])
-	fmt.Fprintf(buf, " {'Z', %d}, {'S', x'%x'}}", amount, assetXDR)
-	fmt.Fprintf(buf, " input put\n")                                       // arg stack: consumeTokenContract
-	fmt.Fprintf(buf, "x'%x' contract call\n", importIssuanceProg)          // arg stack: sigchecker, issuedval, {recip}, quorum
-	fmt.Fprintf(buf, "get get get splitzero\n")                            // con stack: quorum, {recip}, issuedval, zeroval; arg stack: sigchecker
-	fmt.Fprintf(buf, "3 bury\n")                                           // con stack: zeroval, quorum, {recip}, issuedval; arg stack: sigchecker
-	fmt.Fprintf(buf, "'' put\n")                                           // con stack: zeroval, quorum, {recip}, issuedval; arg stack: sigchecker, refdata
-	fmt.Fprintf(buf, "put put put\n")                                      // con stack: zeroval; arg stack: sigchecker, refdata, issuedval, {recip}, quorum
-	fmt.Fprintf(buf, "x'%x' contract call\n", standard.PayToMultisigProg1) // con stack: zeroval; arg stack: sigchecker
+	for _, p := range batch {
+		// Input plain-data consume token contract and put it on the arg stack.
+		fmt.Fprintf(buf, "{'C', x'%x', x'%x',", createTokenSeed[:], consumeTokenProg)
+		fmt.Fprintf(buf, " {'Z', %d}, {'T', {x'%x'}},", int64(1), p.recip)
+		// For a slight optimization, the anchor for that contract's value is
+		// split from the value generated by the `nonce` instruction. Reconstructing
+		// this new anchor is below.
+		nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), p.expMS)
+		snapshotNonceHash := txvm.VMHash("Split2", nonceHash[:])
+		fmt.Fprintf(buf, " {'V', %d, x'%x', x'%x'},", 0, zeroSeed[:], snapshotNonceHash[:])
+		fmt.Fprintf(buf, " {'Z', %d}, {'S', x'%x'}}", p.amount, p.assetXDR)
+		fmt.Fprintf(buf, " input put\n")                                       // arg stack: consumeTokenContract
+		fmt.Fprintf(buf, "x'%x' contract call\n", importIssuanceProg)          // arg stack: sigchecker, issuedval, {recip}, quorum
+		fmt.Fprintf(buf, "get get get splitzero\n")                            // con stack: quorum, {recip}, issuedval, zeroval; arg stack: sigchecker
+		fmt.Fprintf(buf, "3 bury\n")                                           // con stack: zeroval, quorum, {recip}, issuedval; arg stack: sigchecker
+		fmt.Fprintf(buf, "x'%x' put\n", p.metadata)                            // con stack: zeroval, quorum, {recip}, issuedval; arg stack: sigchecker, refdata
+		fmt.Fprintf(buf, "put put put\n")                                      // con stack: zeroval; arg stack: sigchecker, refdata, issuedval, {recip}, quorum
+		fmt.Fprintf(buf, "x'%x' contract call\n", standard.PayToMultisigProg1) // con stack: zeroval; arg stack: sigchecker
+	}
+	// Each import leaves a zero value; the first finalizes the tx.
+	for i := 1; i < len(batch); i++ {
+		fmt.Fprintf(buf, "drop\n")
+	}
 	fmt.Fprintf(buf, "finalize\n")
 	tx1, err := asm.Assemble(buf.String())
 	if err != nil {
@@ -50,7 +74,9 @@ func (c *Custodian) buildImportTx(
 		return nil, errors.Wrap(err, "computing transaction ID")
 	}
 	sig := ed25519.Sign(c.privkey, vm.TxID[:])
-	fmt.Fprintf(buf, "get x'%x' put call\n", sig) // check sig
+	for range batch {
+		fmt.Fprintf(buf, "get x'%x' put call\n", sig) // check sig
+	}
 	tx2, err := asm.Assemble(buf.String())
 	if err != nil {
 		return nil, errors.Wrap(err, "assembling signature section")
@@ -58,6 +84,72 @@ func (c *Custodian) buildImportTx(
 	return tx2, nil
 }
 
+// DefaultImportWorkers is the default number of imports
+// the custodian builds and submits at once.
+const DefaultImportWorkers = 1
+
+// importRetryDelay is how long the custodian waits
+// before retrying imports that failed.
+const importRetryDelay = 10 * time.Second
+
+// ImportWorkers sets the number of imports
+// the custodian builds and submits at once
+// (by default, DefaultImportWorkers).
+// Unless OrderImportsByRecipient is also given,
+// imports may then complete in any order.
+func ImportWorkers(n int) Option {
+	return func(c *Custodian) {
+		c.importWorkers = n
+	}
+}
+
+// OrderImportsByRecipient causes the custodian to import
+// the pegs of each recipient in the order their payments arrived,
+// while still importing for different recipients in parallel (see ImportWorkers).
+// A failed import holds up the recipient's later ones
+// until it succeeds on a retry.
+func OrderImportsByRecipient() Option {
+	return func(c *Custodian) {
+		c.orderImports = true
+	}
+}
+
+// Default caps on each import tx built by BatchImports.
+// The txvm runlimit is the tx's cost to run,
+// and the size that of its program in bytes.
+const (
+	DefaultImportBatchRunlimit = 1 << 20
+	DefaultImportBatchBytes    = 64 << 10
+)
+
+// BatchImports causes the custodian to import pending pegs
+// up to max at a time in a single txvm tx,
+// which issues each peg's value and pays it to its recipient.
+// A batch whose tx would exceed DefaultImportBatchRunlimit or DefaultImportBatchBytes
+// is split in halves until each tx is within both.
+// Batches are made from pegs in arrival order
+// and submitted one at a time,
+// so ImportWorkers and OrderImportsByRecipient do not apply.
+// If a batch's tx is refused,
+// its pegs are imported one by one instead,
+// so that one peg that cannot be imported does not hold up the others.
+func BatchImports(max int) Option {
+	return func(c *Custodian) {
+		c.importBatch = max
+	}
+}
+
+// pendingImport is a peg whose payment has arrived on the Zioncoin network
+// but which has not yet been imported.
+type pendingImport struct {
+	nonceHash []byte
+	amount    int64
+	assetXDR  []byte
+	recip     []byte
+	expMS     int64
+	metadata  []byte
+}
+
 func (c *Custodian) importFromPegIns(ctx context.Context, ready chan struct{}) {
 	defer log.Print("importFromPegIns exiting")
 
@@ -73,7 +165,11 @@ func (c *Custodian) importFromPegIns(ctx context.Context, ready chan struct{}) {
 				return
 			}
 			c.imports.Wait()
-			ch <- struct{}{}
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- struct{}{}:
+			}
 		}
 	}()
 
@@ -84,60 +180,373 @@ func (c *Custodian) importFromPegIns(ctx context.Context, ready chan struct{}) {
 		case <-ch:
 		}
 
-		var (
-			amounts, expMSs                []int64
-			nonceHashes, assetXDRs, recips [][]byte
-		)
-		const q = `SELECT nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms FROM pegs WHERE imported=0 AND zioncoin_tx=1`
-		err := sqlutil.ForQueryRows(ctx, c.DB, q, func(nonceHash []byte, amount int64, assetXDR, recip []byte, expMS int64) {
-			nonceHashes = append(nonceHashes, nonceHash)
-			amounts = append(amounts, amount)
-			assetXDRs = append(assetXDRs, assetXDR)
-			recips = append(recips, recip)
-			expMSs = append(expMSs, expMS)
-		})
-		if err == context.Canceled {
+		pending, err := c.pendingImports(ctx)
+		if ctx.Err() != nil {
 			return
 		}
 		if err != nil {
-			log.Fatalf("querying pegs: %s", err)
-		}
-		for i, nonceHash := range nonceHashes {
-			var (
-				amount   = amounts[i]
-				assetXDR = assetXDRs[i]
-				recip    = recips[i]
-				expMS    = expMSs[i]
-			)
-			err = c.doImport(ctx, nonceHash, amount, assetXDR, recip, expMS)
+			log.Print(err)
+			c.health.setUnhealthy("imports", err)
+			c.retryImportsLater()
+			continue
+		}
+		var refundsFailed int
+		if c.importRefunds == RefundFailedImports {
+			pending, err = c.refundImportFailures(ctx, pending)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("refunding failed imports: %s", err)
+				c.health.setUnhealthy("imports", err)
+				c.retryImportsLater()
+				continue
+			}
+		}
+		var failed int
+		if c.importBatch > 1 {
+			failed = c.runImportBatches(ctx, pending)
+		} else {
+			failed = runImports(ctx, pending, c.importWorkers, c.orderImports, c.doImport)
+		}
+		if c.importRefunds == RefundFailedImports {
+			refundsFailed, err = c.payRefunds(ctx)
+			if ctx.Err() != nil {
+				return
+			}
 			if err != nil {
-				if err == context.Canceled {
+				log.Printf("paying import refunds: %s", err)
+				c.health.setUnhealthy("import refunds", err)
+				c.retryImportsLater()
+				continue
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if refundsFailed > 0 {
+			c.health.setUnhealthy("import refunds", fmt.Errorf("%d refunds failed", refundsFailed))
+		} else {
+			c.health.setHealthy("import refunds")
+		}
+		if failed > 0 {
+			c.health.setUnhealthy("imports", fmt.Errorf("%d imports failed", failed))
+		} else {
+			c.health.setHealthy("imports")
+		}
+		if failed > 0 || refundsFailed > 0 {
+			// Failed imports and refunds remain pending.
+			c.retryImportsLater()
+		}
+	}
+}
+
+// retryImportsLater wakes importFromPegIns after importRetryDelay,
+// to retry the imports and refunds that failed or were not attempted.
+func (c *Custodian) retryImportsLater() {
+	time.AfterFunc(importRetryDelay, func() {
+		c.imports.L.Lock()
+		c.imports.Broadcast()
+		c.imports.L.Unlock()
+	})
+}
+
+// pendingImports returns the pegs awaiting import, in arrival order.
+// Pegs whose import tx mismatched them (see checkImport),
+// and those being refunded (see ImportRefunds), are left out.
+func (c *Custodian) pendingImports(ctx context.Context) ([]pendingImport, error) {
+	var pending []pendingImport
+	const q = `SELECT nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms, metadata FROM pegs WHERE imported=0 AND zioncoin_tx=1 AND custodian_id=$1 AND nonce_hash NOT IN (SELECT nonce_hash FROM import_mismatches) AND nonce_hash NOT IN (SELECT nonce_hash FROM refunds) ORDER BY arrival`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, c.label, func(nonceHash []byte, amount int64, assetXDR, recip []byte, expMS int64, metadata []byte) {
+		pending = append(pending, pendingImport{
+			nonceHash: nonceHash,
+			amount:    amount,
+			assetXDR:  assetXDR,
+			recip:     recip,
+			expMS:     expMS,
+			metadata:  metadata,
+		})
+	})
+	return pending, errors.Wrap(err, "querying pegs")
+}
+
+// runImports calls doImport for each of pending, using the given number of workers,
+// and returns the number of imports that failed.
+// A failed import is logged.
+// If byRecipient is true,
+// the imports of each recipient are done by the same worker, in the order of pending,
+// and a failed import holds up the ones after it for the same recipient,
+// which are left for the next pass;
+// otherwise each import is done by the next idle worker,
+// and a failed import does not hold up the ones after it.
+func runImports(ctx context.Context, pending []pendingImport, workers int, byRecipient bool, doImport func(context.Context, pendingImport) error) int {
+	if workers < 1 {
+		workers = DefaultImportWorkers
+	}
+	queues := make([]chan pendingImport, workers)
+	for i := range queues {
+		queues[i] = make(chan pendingImport, len(pending))
+	}
+	for i, p := range pending {
+		w := i % workers
+		if byRecipient {
+			h := fnv.New32a()
+			h.Write(p.recip)
+			w = int(h.Sum32() % uint32(workers))
+		}
+		queues[w] <- p
+	}
+
+	var (
+		wg     sync.WaitGroup
+		failed int32
+	)
+	for _, q := range queues {
+		close(q)
+		wg.Add(1)
+		go func(q <-chan pendingImport) {
+			defer wg.Done()
+			held := make(map[string]bool) // recipients with a failed import
+			for p := range q {
+				if ctx.Err() != nil {
 					return
 				}
-				log.Fatal(err)
+				if held[string(p.recip)] {
+					log.Printf("holding import of peg with nonce hash %x behind a failed import for recipient %x", p.nonceHash, p.recip)
+					continue
+				}
+				err := doImport(ctx, p)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("importing peg with nonce hash %x: %s", p.nonceHash, err)
+					}
+					atomic.AddInt32(&failed, 1)
+					if byRecipient {
+						held[string(p.recip)] = true
+					}
+				}
 			}
-		}
+		}(q)
 	}
+	wg.Wait()
+	return int(failed)
 }
 
-func (c *Custodian) doImport(ctx context.Context, nonceHash []byte, amount int64, assetXDR, recip []byte, expMS int64) error {
-	log.Printf("doing import from tx with hash %x: %d of asset %x for recipient %x with expiration %d", nonceHash, amount, assetXDR, recip, expMS)
-	importTxBytes, err := c.buildImportTx(amount, expMS, assetXDR, recip)
+func (c *Custodian) doImport(ctx context.Context, p pendingImport) error {
+	log.Printf("doing import from tx with hash %x: %d of asset %x for recipient %x with expiration %d", p.nonceHash, p.amount, p.assetXDR, p.recip, p.expMS)
+	importTxBytes, err := c.buildImportTx(p.amount, p.expMS, p.assetXDR, p.recip, p.metadata)
 	if err != nil {
 		return errors.Wrap(err, "building import tx")
 	}
+	return c.submitImport(ctx, importTxBytes, p)
+}
+
+// submitImport submits import tx prog for peg p,
+// once its issuance is verified (see checkImport),
+// then records the import.
+func (c *Custodian) submitImport(ctx context.Context, prog []byte, p pendingImport) error {
 	var runlimit int64
-	importTx, err := bc.NewTx(importTxBytes, 3, math.MaxInt64, txvm.GetRunlimit(&runlimit))
+	importTx, err := bc.NewTx(prog, 3, math.MaxInt64, txvm.GetRunlimit(&runlimit))
 	if err != nil {
 		return errors.Wrap(err, "computing transaction ID")
 	}
 	importTx.Runlimit = math.MaxInt64 - runlimit
+	iss := issuanceAt(txresult.New(importTx), 0)
+	err = c.checkImport(ctx, importTx.ID.Bytes(), iss, p)
+	if err != nil {
+		return err
+	}
 	_, err = c.S.submitTx(ctx, importTx)
 	if err != nil {
 		return errors.Wrap(err, "submitting import tx")
 	}
-	txresult := txresult.New(importTx)
-	log.Printf("assetID %x amount %d anchor %x\n", txresult.Issuances[0].Value.AssetID.Bytes(), txresult.Issuances[0].Value.Amount, txresult.Issuances[0].Value.Anchor)
-	_, err = c.DB.ExecContext(ctx, `UPDATE pegs SET imported=1 WHERE nonce_hash = $1`, nonceHash)
-	return errors.Wrapf(err, "setting imported=1 for tx with hash %x", nonceHash)
+	log.Printf("assetID %x amount %d anchor %x\n", iss.Value.AssetID.Bytes(), iss.Value.Amount, iss.Value.Anchor)
+	return c.recordImport(ctx, p.nonceHash, importTx.ID.Bytes(), p.amount, p.assetXDR)
+}
+
+// runImportBatches imports pending in batches of up to c.importBatch
+// (see BatchImports),
+// and returns the number of imports that failed.
+func (c *Custodian) runImportBatches(ctx context.Context, pending []pendingImport) int {
+	var failed int
+	for len(pending) > 0 && ctx.Err() == nil {
+		n := c.importBatch
+		if n > len(pending) {
+			n = len(pending)
+		}
+		failed += c.doImportBatch(ctx, pending[:n])
+		pending = pending[n:]
+	}
+	return failed
+}
+
+// doImportBatch imports batch in one tx,
+// or in several if one would exceed the custodian's caps,
+// and returns the number of imports that failed.
+func (c *Custodian) doImportBatch(ctx context.Context, batch []pendingImport) int {
+	if len(batch) == 1 {
+		return c.doImportOne(ctx, batch[0])
+	}
+	importTxBytes, err := c.buildImportBatchTx(batch)
+	if err != nil {
+		log.Printf("building import tx for batch of %d: %s", len(batch), err)
+		return c.doImportEach(ctx, batch)
+	}
+	var runlimit int64
+	importTx, err := bc.NewTx(importTxBytes, 3, math.MaxInt64, txvm.GetRunlimit(&runlimit))
+	if err != nil {
+		log.Printf("computing transaction ID for batch of %d: %s", len(batch), err)
+		return c.doImportEach(ctx, batch)
+	}
+	importTx.Runlimit = math.MaxInt64 - runlimit
+
+	maxRunlimit, maxBytes := c.importBatchRunlimit, c.importBatchBytes
+	if maxRunlimit == 0 {
+		maxRunlimit = DefaultImportBatchRunlimit
+	}
+	if maxBytes == 0 {
+		maxBytes = DefaultImportBatchBytes
+	}
+	if importTx.Runlimit > maxRunlimit || len(importTxBytes) > maxBytes {
+		half := len(batch) / 2
+		return c.doImportBatch(ctx, batch[:half]) + c.doImportBatch(ctx, batch[half:])
+	}
+
+	// The tx issues the pegs' values in batch order.
+	// It is submitted only if they all match their pegs.
+	result := txresult.New(importTx)
+	var (
+		failed  int
+		matched []pendingImport
+	)
+	for i, p := range batch {
+		err = c.checkImport(ctx, importTx.ID.Bytes(), issuanceAt(result, i), p)
+		if err != nil {
+			log.Printf("checking import of peg with nonce hash %x: %s", p.nonceHash, err)
+			failed++
+			continue
+		}
+		matched = append(matched, p)
+	}
+	if failed > 0 {
+		log.Printf("not submitting import tx %x for batch of %d, importing the %d matching pegs one by one", importTx.ID.Bytes(), len(batch), len(matched))
+		return failed + c.doImportEach(ctx, matched)
+	}
+
+	_, err = c.S.submitTx(ctx, importTx)
+	if err != nil {
+		log.Printf("submitting import tx %x for batch of %d, importing them one by one: %s", importTx.ID.Bytes(), len(batch), err)
+		return c.doImportEach(ctx, batch)
+	}
+	for i, p := range batch {
+		iss := issuanceAt(result, i)
+		log.Printf("imported peg with nonce hash %x in tx %x: %d of asset %x with anchor %x", p.nonceHash, importTx.ID.Bytes(), iss.Value.Amount, iss.Value.AssetID.Bytes(), iss.Value.Anchor)
+		err = c.recordImport(ctx, p.nonceHash, importTx.ID.Bytes(), p.amount, p.assetXDR)
+		if err != nil {
+			log.Printf("recording import of peg with nonce hash %x: %s", p.nonceHash, err)
+			failed++
+		}
+	}
+	return failed
+}
+
+// doImportEach imports each of batch in its own tx,
+// and returns the number of imports that failed.
+func (c *Custodian) doImportEach(ctx context.Context, batch []pendingImport) int {
+	var failed int
+	for _, p := range batch {
+		if ctx.Err() != nil {
+			break
+		}
+		failed += c.doImportOne(ctx, p)
+	}
+	return failed
+}
+
+// doImportOne imports p in its own tx,
+// and returns 1 if that failed and 0 if not.
+func (c *Custodian) doImportOne(ctx context.Context, p pendingImport) int {
+	err := c.doImport(ctx, p)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("importing peg with nonce hash %x: %s", p.nonceHash, err)
+		}
+		return 1
+	}
+	return 0
+}
+
+// issuanceAt returns the i'th issuance of result,
+// or nil if it has fewer.
+func issuanceAt(result *txresult.Result, i int) *txresult.Issuance {
+	if i >= len(result.Issuances) {
+		return nil
+	}
+	return result.Issuances[i]
+}
+
+// checkIssuance cross-checks iss, the value issued for peg p by its import tx,
+// against the peg's recorded asset and amount.
+// It returns a description of the first mismatch found,
+// or "" if the issuance matches the peg.
+func checkIssuance(iss *txresult.Issuance, p pendingImport) string {
+	if iss == nil || iss.Value == nil {
+		return "import tx logs no issued value for the peg"
+	}
+	if iss.Value.Amount != uint64(p.amount) {
+		return fmt.Sprintf("issued amount %d does not match peg amount %d", iss.Value.Amount, p.amount)
+	}
+	wantAssetID := txvm.AssetID(importIssuanceSeed[:], p.assetXDR)
+	if !bytes.Equal(iss.Value.AssetID.Bytes(), wantAssetID[:]) {
+		return fmt.Sprintf("issued asset %x does not match peg asset %x (Zioncoin %x)", iss.Value.AssetID.Bytes(), wantAssetID[:], p.assetXDR)
+	}
+	return ""
+}
+
+// checkImport checks iss, the value that txvm tx txid would issue for peg p,
+// before the tx is submitted.
+// An issuance that does not match the peg (see checkIssuance)
+// is recorded in import_mismatches and returned as an error,
+// and the tx must not be submitted:
+// it would issue the wrong value and use up the peg's uniqueness token.
+// A peg with a mismatch is not imported again
+// until its import_mismatches row is removed.
+func (c *Custodian) checkImport(ctx context.Context, txid []byte, iss *txresult.Issuance, p pendingImport) error {
+	reason := checkIssuance(iss, p)
+	if reason == "" {
+		return nil
+	}
+	log.Printf("refusing import tx %x of peg with nonce hash %x: %s", txid, p.nonceHash, reason)
+	const q = `INSERT OR IGNORE INTO import_mismatches (nonce_hash, txid, reason, custodian_id) VALUES ($1, $2, $3, $4)`
+	_, err := c.DB.ExecContext(ctx, q, p.nonceHash, txid, reason, c.label)
+	if err != nil {
+		return errors.Wrapf(err, "recording import mismatch for tx with hash %x", p.nonceHash)
+	}
+	return fmt.Errorf("import tx %x mismatches its peg: %s", txid, reason)
+}
+
+// recordImport marks the peg with the given nonce hash as imported by txvm tx txid,
+// logging an event for the import in the same db transaction.
+func (c *Custodian) recordImport(ctx context.Context, nonceHash, txid []byte, amount int64, assetXDR []byte) error {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	_, err = dbtx.ExecContext(ctx, `UPDATE pegs SET imported=1 WHERE nonce_hash = $1`, nonceHash)
+	if err != nil {
+		return errors.Wrapf(err, "setting imported=1 for tx with hash %x", nonceHash)
+	}
+	err = appendEvent(ctx, dbtx, Event{
+		Type:      EventImport,
+		NonceHash: nonceHash,
+		TxVMTxID:  txid,
+		AssetXDR:  assetXDR,
+		Amount:    amount,
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(dbtx.Commit(), "committing import for tx with hash %x", nonceHash)
 }
@@ -0,0 +1,573 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/txresult"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestRunImports(t *testing.T) {
+	const (
+		numRecips = 8
+		perRecip  = 5
+	)
+	// Pegs for each recipient arrive interleaved with those for the others.
+	var pending []pendingImport
+	for seq := 0; seq < perRecip; seq++ {
+		for r := 0; r < numRecips; r++ {
+			pending = append(pending, pendingImport{
+				nonceHash: []byte{byte(r), byte(seq)},
+				recip:     []byte(fmt.Sprintf("recipient %d", r)),
+			})
+		}
+	}
+	failing := []byte{0, 1}
+
+	for _, byRecipient := range []bool{false, true} {
+		t.Run(fmt.Sprintf("byRecipient=%t", byRecipient), func(t *testing.T) {
+			var (
+				mu                sync.Mutex
+				attempts          = make(map[byte][]byte) // recipient to seqs, in order attempted
+				running, maxInUse int
+			)
+			doImport := func(ctx context.Context, p pendingImport) error {
+				mu.Lock()
+				attempts[p.nonceHash[0]] = append(attempts[p.nonceHash[0]], p.nonceHash[1])
+				running++
+				if running > maxInUse {
+					maxInUse = running
+				}
+				mu.Unlock()
+
+				time.Sleep(time.Duration(p.nonceHash[0]+p.nonceHash[1]) * time.Millisecond)
+
+				mu.Lock()
+				running--
+				mu.Unlock()
+				if string(p.nonceHash) == string(failing) {
+					return errors.New("import failed")
+				}
+				return nil
+			}
+			failed := runImports(context.Background(), pending, 3, byRecipient, doImport)
+			if failed != 1 {
+				t.Errorf("got %d failed imports, want 1", failed)
+			}
+			if maxInUse < 2 {
+				t.Errorf("got at most %d concurrent imports, want at least 2", maxInUse)
+			}
+			for r := byte(0); r < numRecips; r++ {
+				seqs := attempts[r]
+				want := perRecip
+				if byRecipient && r == failing[0] {
+					// The failed import holds up the recipient's later ones.
+					want = int(failing[1]) + 1
+				}
+				if len(seqs) != want {
+					t.Errorf("recipient %d: got %d imports, want %d", r, len(seqs), want)
+					continue
+				}
+				if !byRecipient {
+					continue
+				}
+				for i, seq := range seqs {
+					if seq != byte(i) {
+						t.Errorf("recipient %d: got imports in order %v, want arrival order", r, seqs)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPegArrivalOrder(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		var nonceHashes [][32]byte
+		for i := int64(0); i < 3; i++ {
+			nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS+i)
+			err := c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, expMS+i, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonceHashes = append(nonceHashes, nonceHash)
+		}
+		// Payments arrive in the reverse of the order the pegs were created.
+		for i := len(nonceHashes) - 1; i >= 0; i-- {
+			err := c.recordPegIn(ctx, "txid", "cursor", nonceHashes[i][:], "source", 10, []byte("asset"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		var got [][]byte
+		const q = `SELECT nonce_hash FROM pegs WHERE imported=0 AND zioncoin_tx=1 ORDER BY arrival`
+		rows, err := db.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var nonceHash []byte
+			err = rows.Scan(&nonceHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, nonceHash)
+		}
+		if err = rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 3 {
+			t.Fatalf("got %d arrived pegs, want 3", len(got))
+		}
+		for i, nonceHash := range got {
+			if string(nonceHash) != string(nonceHashes[2-i][:]) {
+				t.Errorf("peg %d in arrival order has nonce hash %x, want %x", i, nonceHash, nonceHashes[2-i][:])
+			}
+		}
+	})
+}
+
+func TestPegMetadata(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		c.S.blockInterval = 100 * time.Millisecond
+
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipPub, recipPrv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		prePegIn := func(metadata json.RawMessage) *httptest.ResponseRecorder {
+			body, err := json.Marshal(PrePegIn{
+				BcID:        c.InitBlockHash.Bytes(),
+				Amount:      10,
+				AssetXDR:    lumenXDR,
+				RecipPubkey: recipPub,
+				ExpMS:       expMS,
+				Metadata:    metadata,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c.DoPrePegIn(w, httptest.NewRequest("POST", "/prepegin", bytes.NewReader(body)).WithContext(ctx))
+			return w
+		}
+
+		tooBig := json.RawMessage(`"` + strings.Repeat("x", MaxPegMetadata) + `"`)
+		if w := prePegIn(tooBig); w.Code != http.StatusBadRequest {
+			t.Errorf("got status %d from pre-peg-in with %d bytes of metadata, want %d", w.Code, len(tooBig), http.StatusBadRequest)
+		}
+
+		metadata := json.RawMessage(`{"source":"ref 1","tier":2}`)
+		w := prePegIn(metadata)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d from pre-peg-in: %s", w.Code, w.Body.String())
+		}
+		nonceHash := w.Body.Bytes()
+		err = c.recordPegIn(ctx, "txid", "1", nonceHash, "source", 10, lumenXDR)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		peg, err := c.PegIn(ctx, nonceHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !peg.Paid || peg.Imported {
+			t.Errorf("got paid %t, imported %t before import, want true, false", peg.Paid, peg.Imported)
+		}
+		if !bytes.Equal(peg.Metadata, metadata) {
+			t.Fatalf("got peg metadata %s, want %s", peg.Metadata, metadata)
+		}
+
+		importTxBytes, err := c.buildImportTx(10, expMS, lumenXDR, recipPub, peg.Metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var runlimit int64
+		importTx, err := bc.NewTx(importTxBytes, 3, math.MaxInt64, txvm.GetRunlimit(&runlimit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		importTx.Runlimit = math.MaxInt64 - runlimit
+		r, err := c.S.submitTx(ctx, importTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.S.waitOnTx(ctx, importTx.ID, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.recordImport(ctx, nonceHash, importTx.ID.Bytes(), 10, lumenXDR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output := txresult.New(importTx).Outputs[0]
+		if !bytes.Equal(output.RefData, metadata) {
+			t.Errorf("got import output refdata %s, want %s", output.RefData, metadata)
+		}
+		peg, err = c.PegIn(ctx, nonceHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !peg.Imported {
+			t.Error("peg not imported after import")
+		}
+
+		// The recipient exports the imported value with the peg's metadata.
+		tempKP, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = BuildExportTxWithOptions(ctx, zioncoin.NativeAsset(), 10, 10, tempKP.Address(), output.Value.Anchor, recipPrv, 1, ExportOptions{Metadata: tooBig})
+		if err == nil {
+			t.Errorf("built export with %d bytes of metadata", len(tooBig))
+		}
+		exportTx, _, err := BuildExportTxWithOptions(ctx, zioncoin.NativeAsset(), 10, 10, tempKP.Address(), output.Value.Anchor, recipPrv, 1, ExportOptions{Metadata: peg.Metadata})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err = c.S.submitTx(ctx, exportTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.S.waitOnTx(ctx, exportTx.ID, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := InspectExportTx(exportTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p pegOut
+		err = json.Unmarshal(ref, &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p.Metadata, metadata) {
+			t.Errorf("got export metadata %s, want %s", p.Metadata, metadata)
+		}
+	})
+}
+
+func TestBatchImports(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		c.S.blockInterval = 100 * time.Millisecond
+
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each of four recipients is pegged a different amount.
+		want := make(map[string]int64)
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		for i := int64(0); i < 4; i++ {
+			recipPub, _, err := ed25519.GenerateKey(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			amount := 10 * (i + 1)
+			body, err := json.Marshal(PrePegIn{
+				BcID:        c.InitBlockHash.Bytes(),
+				Amount:      amount,
+				AssetXDR:    lumenXDR,
+				RecipPubkey: recipPub,
+				ExpMS:       expMS + i,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c.DoPrePegIn(w, httptest.NewRequest("POST", "/prepegin", bytes.NewReader(body)).WithContext(ctx))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d from pre-peg-in: %s", w.Code, w.Body.String())
+			}
+			err = c.recordPegIn(ctx, "txid", fmt.Sprint(i+1), w.Body.Bytes(), "source", amount, lumenXDR)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want[string(recipPub)] = amount
+		}
+		pending, err := c.pendingImports(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 4 {
+			t.Fatalf("got %d pending imports, want 4", len(pending))
+		}
+
+		// The runlimit cap admits two imports per tx but not four.
+		runlimitOf := func(batch []pendingImport) int64 {
+			prog, err := c.buildImportBatchTx(batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var runlimit int64
+			_, err = bc.NewTx(prog, 3, math.MaxInt64, txvm.GetRunlimit(&runlimit))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return math.MaxInt64 - runlimit
+		}
+		c.importBatch = 4
+		c.importBatchRunlimit = runlimitOf(pending[:2])
+		if r := runlimitOf(pending[2:]); r > c.importBatchRunlimit {
+			c.importBatchRunlimit = r
+		}
+		if runlimitOf(pending) <= c.importBatchRunlimit {
+			t.Fatal("batch of four is within the runlimit cap of a batch of two")
+		}
+
+		r := c.S.w.Reader()
+		defer r.Dispose()
+		if failed := c.runImportBatches(ctx, pending); failed != 0 {
+			t.Fatalf("got %d failed imports, want 0", failed)
+		}
+		var importTxs int
+		for len(want) > 0 {
+			got, ok := r.Read(ctx)
+			if !ok {
+				t.Fatalf("timed out with %d recipients not credited", len(want))
+			}
+			for _, tx := range got.(*bc.Block).Transactions {
+				result := txresult.New(tx)
+				if len(result.Issuances) == 0 {
+					continue
+				}
+				importTxs++
+				if len(result.Issuances) != 2 || len(result.Outputs) != 2 {
+					t.Errorf("import tx %x has %d issuances and %d outputs, want 2 of each", tx.ID.Bytes(), len(result.Issuances), len(result.Outputs))
+				}
+				for _, out := range result.Outputs {
+					recip := string(out.Pubkeys[0])
+					amount, ok := want[recip]
+					if !ok {
+						t.Fatalf("import tx %x pays unknown recipient %x", tx.ID.Bytes(), out.Pubkeys[0])
+					}
+					if int64(out.Value.Amount) != amount {
+						t.Errorf("recipient %x credited %d, want %d", out.Pubkeys[0], out.Value.Amount, amount)
+					}
+					delete(want, recip)
+				}
+			}
+		}
+		if importTxs != 2 {
+			t.Errorf("got %d import txs, want 2", importTxs)
+		}
+		var imported int
+		err = db.QueryRow("SELECT COUNT(*) FROM pegs WHERE imported=1").Scan(&imported)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imported != 4 {
+			t.Errorf("got %d pegs marked imported, want 4", imported)
+		}
+	})
+}
+
+func TestImportIssuanceMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		c.S.blockInterval = 100 * time.Millisecond
+
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The first peg's uniqueness token is for one more than its payment,
+		// so the chain accepts an import issuing one more than the peg's amount.
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		for i := int64(0); i < 2; i++ {
+			recipPub, _, err := ed25519.GenerateKey(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokenAmount := int64(100)
+			if i == 0 {
+				tokenAmount++
+			}
+			body, err := json.Marshal(PrePegIn{
+				BcID:        c.InitBlockHash.Bytes(),
+				Amount:      tokenAmount,
+				AssetXDR:    lumenXDR,
+				RecipPubkey: recipPub,
+				ExpMS:       expMS + i,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c.DoPrePegIn(w, httptest.NewRequest("POST", "/prepegin", bytes.NewReader(body)).WithContext(ctx))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d from pre-peg-in: %s", w.Code, w.Body.String())
+			}
+			err = c.recordPegIn(ctx, "txid", fmt.Sprint(i+1), w.Body.Bytes(), "source", 100, lumenXDR)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		pending, err := c.pendingImports(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 2 {
+			t.Fatalf("got %d pending imports, want 2", len(pending))
+		}
+		bad, good := pending[0], pending[1]
+
+		r := c.S.w.Reader()
+		defer r.Dispose()
+
+		// A faulty builder issues more than was pegged in.
+		// Its tx is refused before it reaches the chain.
+		prog, err := c.buildImportTx(bad.amount+1, bad.expMS, bad.assetXDR, bad.recip, bad.metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.submitImport(ctx, prog, bad)
+		if err == nil || strings.Contains(err.Error(), "submitting") {
+			t.Fatalf("got error %v importing with the wrong amount, want a mismatch", err)
+		}
+		var imported int
+		err = db.QueryRow("SELECT imported FROM pegs WHERE nonce_hash=$1", bad.nonceHash).Scan(&imported)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imported != 0 {
+			t.Errorf("got peg with mismatched import marked imported=%d, want 0", imported)
+		}
+		var reason string
+		err = db.QueryRow("SELECT reason FROM import_mismatches WHERE nonce_hash=$1", bad.nonceHash).Scan(&reason)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(reason, "amount") {
+			t.Errorf("got mismatch reason %q, want it to mention the amount", reason)
+		}
+
+		// The mismatched peg is not imported again; the other one is imported.
+		pending, err = c.pendingImports(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 1 || !bytes.Equal(pending[0].nonceHash, good.nonceHash) {
+			t.Fatalf("got %d pending imports after mismatch, want only the good one", len(pending))
+		}
+		err = c.doImport(ctx, good)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Waiting for the block also keeps its commit from outliving the db.
+		got, ok := r.Read(ctx)
+		if !ok {
+			t.Fatal("timed out waiting for the import block")
+		}
+		b := got.(*bc.Block)
+		if len(b.Transactions) != 1 {
+			t.Fatalf("got %d txs in the import block, want only the good import", len(b.Transactions))
+		}
+		iss := txresult.New(b.Transactions[0]).Issuances
+		if len(iss) != 1 || int64(iss[0].Value.Amount) != good.amount {
+			t.Errorf("got issuances %+v in the import block, want one of %d", iss, good.amount)
+		}
+		err = db.QueryRow("SELECT imported FROM pegs WHERE nonce_hash=$1", good.nonceHash).Scan(&imported)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imported != 1 {
+			t.Errorf("got matching peg marked imported=%d, want 1", imported)
+		}
+	})
+}
+
+func TestImportFromPegInsDBError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		// A db error reading pending imports leaves importFromPegIns running,
+		// reporting imports unhealthy until a retry succeeds.
+		closed, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed.Close()
+		c.DB = closed
+
+		ready := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			c.importFromPegIns(ctx, ready)
+		}()
+		<-ready
+		c.imports.L.Lock()
+		c.imports.Broadcast()
+		c.imports.L.Unlock()
+		for {
+			var unhealthy bool
+			for _, p := range c.health.problems() {
+				if strings.HasPrefix(p, "imports:") {
+					unhealthy = true
+				}
+			}
+			if unhealthy {
+				break
+			}
+			select {
+			case <-done:
+				t.Fatal("importFromPegIns exited after a db error")
+			case <-ctx.Done():
+				t.Fatal(ctx.Err())
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		select {
+		case <-done:
+			t.Fatal("importFromPegIns exited after a db error")
+		default:
+		}
+		cancel()
+		c.imports.L.Lock()
+		c.imports.Broadcast()
+		c.imports.L.Unlock()
+		<-done
+	})
+}
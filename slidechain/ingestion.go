@@ -0,0 +1,112 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/chain/txvm/errors"
+)
+
+// DefaultMaxIngestionLag is the default number of ledgers
+// by which Horizon's ingestion may trail Zioncoin Core
+// before the custodian reports itself degraded.
+const DefaultMaxIngestionLag = 10
+
+const ingestionCheckInterval = 30 * time.Second
+
+// ingestion records how far Horizon's ingestion trails Zioncoin Core,
+// as of the last check.
+type ingestion struct {
+	mu            sync.Mutex
+	coreLedger    int32
+	historyLedger int32
+	checked       time.Time
+}
+
+// IngestionStatus describes how far Horizon's ingestion trails Zioncoin Core.
+type IngestionStatus struct {
+	CoreLedger    int32     `json:"core_latest_ledger"`
+	HistoryLedger int32     `json:"history_latest_ledger"`
+	Lag           int32     `json:"lag"`
+	Checked       time.Time `json:"checked"`
+}
+
+// MaxIngestionLag sets the number of ledgers by which Horizon's ingestion
+// may trail Zioncoin Core before the custodian reports itself degraded
+// (by default, DefaultMaxIngestionLag).
+// A negative value reports the lag without ever marking the custodian degraded.
+func MaxIngestionLag(ledgers int32) Option {
+	return func(c *Custodian) {
+		c.maxIngestionLag = ledgers
+	}
+}
+
+// Runs as a goroutine.
+func (c *Custodian) watchIngestion(ctx context.Context) {
+	defer log.Print("watchIngestion exiting")
+
+	ticker := time.NewTicker(ingestionCheckInterval)
+	defer ticker.Stop()
+	for {
+		err := c.checkIngestion()
+		if err != nil {
+			log.Printf("checking equator ingestion: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkIngestion compares the latest ledgers known to Horizon and to Zioncoin Core,
+// marking the custodian degraded if Horizon is too far behind.
+// While Horizon is behind, peg-ins appear delayed
+// even though the custodian itself is working.
+func (c *Custodian) checkIngestion() error {
+	const component = "equator ingestion"
+	root, err := c.hclient.Root()
+	if err != nil {
+		err = errors.Wrap(err, "getting equator root")
+		c.health.setUnhealthy(component, err)
+		return err
+	}
+	c.observeProtocol(root.ProtocolVersion)
+	c.ingestion.mu.Lock()
+	c.ingestion.coreLedger = root.CoreSequence
+	c.ingestion.historyLedger = root.HorizonSequence
+	c.ingestion.checked = time.Now()
+	c.ingestion.mu.Unlock()
+
+	max := c.maxIngestionLag
+	if max == 0 {
+		max = DefaultMaxIngestionLag
+	}
+	lag := root.CoreSequence - root.HorizonSequence
+	if max > 0 && lag > max {
+		c.health.setUnhealthy(component, fmt.Errorf("equator ingestion is %d ledgers behind core (ledger %d vs. %d)", lag, root.HorizonSequence, root.CoreSequence))
+	} else {
+		c.health.setHealthy(component)
+	}
+	return nil
+}
+
+// ingestionStatus returns the result of the last ingestion check,
+// or nil if there has been none.
+func (c *Custodian) ingestionStatus() *IngestionStatus {
+	c.ingestion.mu.Lock()
+	defer c.ingestion.mu.Unlock()
+	if c.ingestion.checked.IsZero() {
+		return nil
+	}
+	return &IngestionStatus{
+		CoreLedger:    c.ingestion.coreLedger,
+		HistoryLedger: c.ingestion.historyLedger,
+		Lag:           c.ingestion.coreLedger - c.ingestion.historyLedger,
+		Checked:       c.ingestion.checked,
+	}
+}
@@ -0,0 +1,75 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zioncoin/go/clients/equator"
+)
+
+func TestIngestionLag(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		// The Horizon root reports the latest ledgers core and history.
+		var core, history int32
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		hclient.root = func() (equator.Root, error) {
+			root, err := hclient.ClientInterface.Root()
+			root.CoreSequence = core
+			root.HorizonSequence = history
+			return root, err
+		}
+		c.hclient = hclient
+
+		cases := []struct {
+			core, history int32
+			wantHealthy   bool
+		}{
+			{100, 100, true},
+			{100, 95, true},
+			{100, 80, false},
+			{100, 99, true},
+		}
+		for _, tc := range cases {
+			core, history = tc.core, tc.history
+			err := c.checkIngestion()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c.Status(w, httptest.NewRequest("GET", "/status", nil))
+			var status Status
+			err = json.Unmarshal(w.Body.Bytes(), &status)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Ingestion == nil {
+				t.Fatal("status has no ingestion report")
+			}
+			if status.Ingestion.Lag != tc.core-tc.history {
+				t.Errorf("core %d, history %d: got lag %d, want %d", tc.core, tc.history, status.Ingestion.Lag, tc.core-tc.history)
+			}
+			healthy := len(status.Problems) == 0
+			if healthy != tc.wantHealthy {
+				t.Errorf("core %d, history %d: got healthy %v, want %v (problems %v)", tc.core, tc.history, healthy, tc.wantHealthy, status.Problems)
+			}
+		}
+
+		// With a negative limit, lag is reported but never degrades the custodian.
+		c.maxIngestionLag = -1
+		core, history = 1000, 1
+		err := c.checkIngestion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if problems := c.health.problems(); len(problems) != 0 {
+			t.Errorf("got problems %v with ingestion checks disabled", problems)
+		}
+	}, MaxIngestionLag(10))
+}
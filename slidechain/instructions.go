@@ -0,0 +1,166 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interzioncoin/slingshot/slidechain/net"
+	"github.com/zioncoin/go/xdr"
+)
+
+// errBadPegInRequest is the root of errors from PegInInstructions
+// for requests that the custodian would refuse.
+var errBadPegInRequest = errors.New("bad peg-in request")
+
+// DepositInstructions tell a user how to pay the peg-in
+// described by a PrePegIn request (see PegInInstructions).
+// All amounts are in the asset's smallest unit (stroops, for lumens).
+type DepositInstructions struct {
+	// Custodian is the Zioncoin account to pay.
+	Custodian string `json:"custodian"`
+
+	// Asset and AssetXDR are the asset to pay,
+	// in string form and as XDR,
+	// and Amount the amount of it.
+	Asset    string `json:"asset"`
+	AssetXDR []byte `json:"asset_xdr"`
+	Amount   int64  `json:"amount"`
+
+	// MemoHash is the peg-in's nonce hash,
+	// which the payment must carry as its hash memo.
+	// It is the nonce hash DoPrePegIn responds with
+	// when the same request is made to it.
+	MemoHash []byte `json:"memo_hash"`
+
+	// ExpMS is the expiration time of the peg-in's nonce,
+	// in milliseconds since the epoch.
+	// The peg-in must be imported before then.
+	ExpMS int64 `json:"exp_ms"`
+
+	// MinPayout and MaxPayout bound the amount, net of the fee,
+	// that one export of the asset is pegged out,
+	// as set by the asset's FeePolicy.
+	// A zero MaxPayout is no bound.
+	MinPayout int64 `json:"min_payout"`
+	MaxPayout int64 `json:"max_payout,omitempty"`
+}
+
+// PegInInstructions checks that the custodian can peg in
+// the peg-in of request p,
+// and returns the instructions for paying it,
+// without submitting its pre-peg-in tx or recording it.
+// The request must name its expiration time:
+// a nonce generated by the custodian (see PrePegIn.GenerateNonce)
+// is not chosen until the peg-in is recorded.
+// A request the custodian would refuse
+// gets an error whose root is errBadPegInRequest,
+// or errNonceCollision if its nonce hash is already registered.
+func (c *Custodian) PegInInstructions(ctx context.Context, p PrePegIn) (DepositInstructions, error) {
+	if c.observer {
+		return DepositInstructions{}, errObserver
+	}
+	if p.GenerateNonce {
+		return DepositInstructions{}, errors.Wrap(errBadPegInRequest, "instructions need exp_ms: a generated nonce is chosen only by /prepegin")
+	}
+	if p.ExpMS <= int64(bc.Millis(time.Now())) {
+		return DepositInstructions{}, errors.Wrapf(errBadPegInRequest, "exp_ms %d is not in the future", p.ExpMS)
+	}
+	if p.Amount <= 0 {
+		return DepositInstructions{}, errors.Wrapf(errBadPegInRequest, "amount %d is not positive", p.Amount)
+	}
+	if len(p.RecipPubkey) != ed25519.PublicKeySize {
+		return DepositInstructions{}, errors.Wrapf(errBadPegInRequest, "recip_pubkey has %d bytes, not %d", len(p.RecipPubkey), ed25519.PublicKeySize)
+	}
+	err := checkPegMetadata(p.Metadata)
+	if err != nil {
+		return DepositInstructions{}, errors.Wrap(errBadPegInRequest, err.Error())
+	}
+	var asset xdr.Asset
+	err = xdr.SafeUnmarshal(p.AssetXDR, &asset)
+	if err != nil {
+		return DepositInstructions{}, errors.Wrapf(errBadPegInRequest, "asset_xdr: %s", err)
+	}
+	problem, err := c.checkIssuer(ctx, p.AssetXDR)
+	if err != nil {
+		return DepositInstructions{}, err
+	}
+	if problem != "" {
+		return DepositInstructions{}, errors.Wrapf(errBadPegInRequest, "asset %s: %s", asset.String(), problem)
+	}
+
+	nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), p.ExpMS)
+	registered, err := c.pegInRegistered(ctx, nonceHash[:])
+	if err != nil {
+		return DepositInstructions{}, err
+	}
+	if registered {
+		return DepositInstructions{}, errors.Wrapf(errNonceCollision, "%x", nonceHash[:])
+	}
+	bcid := p.BcID
+	if len(bcid) == 0 {
+		bcid = c.InitBlockHash.Bytes()
+	}
+	// The pre-peg-in tx is built, but not submitted,
+	// to check that DoPrePegIn could build it.
+	_, err = buildPrePegInTx(bcid, p.AssetXDR, p.RecipPubkey, p.Amount, p.ExpMS)
+	if err != nil {
+		return DepositInstructions{}, errors.Wrap(errBadPegInRequest, err.Error())
+	}
+
+	policy := c.feePolicy(asset)
+	return DepositInstructions{
+		Custodian: c.AccountID.Address(),
+		Asset:     asset.String(),
+		AssetXDR:  p.AssetXDR,
+		Amount:    p.Amount,
+		MemoHash:  nonceHash[:],
+		ExpMS:     p.ExpMS,
+		MinPayout: policy.MinPayout,
+		MaxPayout: policy.MaxPayout,
+	}, nil
+}
+
+// PegInInstructionsHandler responds with the DepositInstructions, as JSON,
+// for the PrePegIn request in the body (see PegInInstructions).
+// Nothing is recorded:
+// the peg-in must still be requested from DoPrePegIn before it is paid.
+func (c *Custodian) PegInInstructionsHandler(w http.ResponseWriter, req *http.Request) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading request: %s", err)
+		return
+	}
+	var p PrePegIn
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "parsing request: %s", err)
+		return
+	}
+	instructions, err := c.PegInInstructions(req.Context(), p)
+	switch errors.Root(err) {
+	case nil:
+	case errObserver:
+		net.Errorf(w, http.StatusForbidden, "%s", err)
+		return
+	case errBadPegInRequest:
+		net.Errorf(w, http.StatusBadRequest, "%s", err)
+		return
+	case errNonceCollision:
+		net.Errorf(w, http.StatusConflict, "%s", err)
+		return
+	default:
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(instructions)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+	}
+}
@@ -0,0 +1,99 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+)
+
+func TestPegInInstructions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		c.S.blockInterval = 100 * time.Millisecond
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := PrePegIn{
+			BcID:        c.InitBlockHash.Bytes(),
+			Amount:      100,
+			AssetXDR:    lumenXDR,
+			RecipPubkey: testRecipPubKey,
+			ExpMS:       int64(bc.Millis(time.Now().Add(10 * time.Minute))),
+		}
+		body, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		c.PegInInstructionsHandler(w, httptest.NewRequest("POST", "/pegin/instructions", bytes.NewReader(body)).WithContext(ctx))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d from peg-in instructions: %s", w.Code, w.Body.String())
+		}
+		var instructions DepositInstructions
+		err = json.Unmarshal(w.Body.Bytes(), &instructions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if instructions.Custodian != c.AccountID.Address() || instructions.Amount != 100 || instructions.Asset != zioncoin.NativeAsset().String() {
+			t.Errorf("got instructions to pay %d of %s to %s, want 100 of %s to %s", instructions.Amount, instructions.Asset, instructions.Custodian, zioncoin.NativeAsset().String(), c.AccountID.Address())
+		}
+		registered, err := c.pegInRegistered(ctx, instructions.MemoHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if registered {
+			t.Error("peg-in recorded by instructions request")
+		}
+
+		// The peg-in recorded for the same request expects the same memo hash.
+		w = httptest.NewRecorder()
+		c.DoPrePegIn(w, httptest.NewRequest("POST", "/prepegin", bytes.NewReader(body)).WithContext(ctx))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d from pre-peg-in: %s", w.Code, w.Body.String())
+		}
+		if !bytes.Equal(w.Body.Bytes(), instructions.MemoHash) {
+			t.Errorf("got nonce hash %x from pre-peg-in, want memo hash %x from instructions", w.Body.Bytes(), instructions.MemoHash)
+		}
+
+		// Once it is recorded, instructions for it are refused.
+		_, err = c.PegInInstructions(ctx, p)
+		if errors.Root(err) != errNonceCollision {
+			t.Errorf("got error %v for instructions for a recorded peg-in, want %v", err, errNonceCollision)
+		}
+
+		generated := p
+		generated.ExpMS, generated.GenerateNonce = 0, true
+		expired := p
+		expired.ExpMS = int64(bc.Millis(time.Now().Add(-time.Minute)))
+		shortKey := p
+		shortKey.ExpMS++
+		shortKey.RecipPubkey = testRecipPubKey[:31]
+		badAsset := p
+		badAsset.ExpMS++
+		badAsset.AssetXDR = []byte("nope")
+		for name, req := range map[string]PrePegIn{
+			"generated nonce": generated,
+			"expired":         expired,
+			"short pubkey":    shortKey,
+			"bad asset":       badAsset,
+		} {
+			_, err = c.PegInInstructions(ctx, req)
+			if errors.Root(err) != errBadPegInRequest {
+				t.Errorf("%s: got error %v, want %v", name, err, errBadPegInRequest)
+			}
+		}
+	})
+}
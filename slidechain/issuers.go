@@ -0,0 +1,112 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	i10rnet "github.com/interzioncoin/starlight/net"
+	"github.com/zioncoin/go/xdr"
+)
+
+// issuerCacheTTL is how long the result of checking an asset's issuer is reused.
+const issuerCacheTTL = 10 * time.Minute
+
+// VerifyIssuers causes the custodian to check, before accepting a peg-in of a credit asset,
+// that the asset's issuer account exists on the Zioncoin network
+// and cannot revoke the custodian's authorization to hold the asset.
+// Otherwise the custodian could not peg the asset out,
+// so the payment is flagged for manual refund (see flagged_pegs) rather than imported,
+// and its peg remains awaiting payment.
+// The result of each check is reused for a few minutes.
+func VerifyIssuers() Option {
+	return func(c *Custodian) {
+		c.verifyIssuers = true
+	}
+}
+
+type issuerCheck struct {
+	problem string
+	expires time.Time
+}
+
+// issuerCache holds the results of recent issuer checks,
+// keyed by asset XDR.
+type issuerCache struct {
+	mu     sync.Mutex
+	checks map[string]issuerCheck
+}
+
+// checkIssuer checks the issuer of the asset with the given XDR
+// when the custodian verifies issuers.
+// If the asset cannot be pegged out,
+// checkIssuer returns a description of the problem.
+// It retries with backoff while the issuer cannot be loaded,
+// returning an error only if ctx is canceled.
+func (c *Custodian) checkIssuer(ctx context.Context, assetXDR []byte) (string, error) {
+	if !c.verifyIssuers {
+		return "", nil
+	}
+	c.issuers.mu.Lock()
+	check, ok := c.issuers.checks[string(assetXDR)]
+	c.issuers.mu.Unlock()
+	if ok && time.Now().Before(check.expires) {
+		return check.problem, nil
+	}
+
+	backoff := i10rnet.Backoff{Base: 100 * time.Millisecond}
+	for {
+		problem, err := c.issuerProblem(assetXDR)
+		if err == nil {
+			c.issuers.mu.Lock()
+			if c.issuers.checks == nil {
+				c.issuers.checks = make(map[string]issuerCheck)
+			}
+			c.issuers.checks[string(assetXDR)] = issuerCheck{problem: problem, expires: time.Now().Add(issuerCacheTTL)}
+			c.issuers.mu.Unlock()
+			return problem, nil
+		}
+		log.Printf("checking issuer of asset %x: %s, retrying...", assetXDR, err)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(backoff.Next()):
+		}
+	}
+}
+
+// issuerProblem loads the issuer of the asset with the given XDR
+// and describes the problem that keeps the custodian from pegging it out, if any.
+func (c *Custodian) issuerProblem(assetXDR []byte) (string, error) {
+	var asset xdr.Asset
+	err := xdr.SafeUnmarshal(assetXDR, &asset)
+	if err != nil {
+		return "", errors.Wrap(err, "unmarshaling asset")
+	}
+	var issuer xdr.AccountId
+	switch asset.Type {
+	case xdr.AssetTypeAssetTypeCreditAlphanum4:
+		issuer = asset.AlphaNum4.Issuer
+	case xdr.AssetTypeAssetTypeCreditAlphanum12:
+		issuer = asset.AlphaNum12.Issuer
+	default:
+		return "", nil
+	}
+	if issuer.Equals(c.AccountID) {
+		return "", nil
+	}
+	account, err := c.hclient.LoadAccount(issuer.Address())
+	if isNotFound(err) {
+		return fmt.Sprintf("issuer account %s does not exist", issuer.Address()), nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "loading issuer account %s", issuer.Address())
+	}
+	if account.Flags.AuthRevocable {
+		return fmt.Sprintf("issuer account %s can revoke the custodian's authorization to hold the asset", issuer.Address()), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,103 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/xdr"
+)
+
+func TestVerifyIssuers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		missing, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		revocable, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accounts := make(map[string]equator.Account)
+		accounts[importTestAccountID] = equator.Account{}
+		var revocableAccount equator.Account
+		revocableAccount.Flags.AuthRevocable = true
+		accounts[revocable.Address()] = revocableAccount
+		// The accounts loaded are counted.
+		var loads int32
+		serve := loadAccountsFrom(accounts)
+		c.hclient = &fakeClient{ClientInterface: c.hclient, loadAccount: func(accountID string) (equator.Account, error) {
+			atomic.AddInt32(&loads, 1)
+			return serve(accountID)
+		}}
+
+		assetXDR := func(issuer string) []byte {
+			asset := makeAsset(xdr.AssetTypeAssetTypeCreditAlphanum4, "USD", issuer)
+			b, err := asset.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cases := []struct {
+			name      string
+			assetXDR  []byte
+			wantLoads int32 // total after this payment
+			wantPaid  bool
+		}{
+			{"nonexistent issuer", assetXDR(missing.Address()), 1, false},
+			{"nonexistent issuer cached", assetXDR(missing.Address()), 1, false},
+			{"revocable issuer", assetXDR(revocable.Address()), 2, false},
+			{"good issuer", assetXDR(importTestAccountID), 3, true},
+			{"lumens", lumenXDR, 3, true},
+			{"own issue", assetXDR(c.AccountID.Address()), 3, true},
+		}
+		for i, tc := range cases {
+			expMS := int64(bc.Millis(time.Now().Add(10*time.Minute))) + int64(i)
+			nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
+			err = c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, expMS, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			txid := string(rune('a' + i))
+			err = c.recordPegIn(ctx, txid, "1", nonceHash[:], "source", 100, tc.assetXDR)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var zioncoinTx int
+			err = db.QueryRow("SELECT zioncoin_tx FROM pegs WHERE nonce_hash=$1", nonceHash[:]).Scan(&zioncoinTx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if paid := zioncoinTx == 1; paid != tc.wantPaid {
+				t.Errorf("%s: got peg paid %v, want %v", tc.name, paid, tc.wantPaid)
+			}
+			var flagged int
+			err = db.QueryRow("SELECT COUNT(*) FROM flagged_pegs WHERE nonce_hash=$1 AND reason='issuer'", nonceHash[:]).Scan(&flagged)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wantFlagged := !tc.wantPaid; (flagged == 1) != wantFlagged {
+				t.Errorf("%s: got %d flagged payments, want flagged %v", tc.name, flagged, wantFlagged)
+			}
+			if loads := atomic.LoadInt32(&loads); loads != tc.wantLoads {
+				t.Errorf("%s: got %d issuer lookups, want %d", tc.name, loads, tc.wantLoads)
+			}
+		}
+	}, VerifyIssuers())
+}
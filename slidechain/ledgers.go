@@ -0,0 +1,60 @@
+package slidechain
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	i10rnet "github.com/interzioncoin/starlight/net"
+	"github.com/zioncoin/go/clients/equator"
+)
+
+// ReconcileOnLedgers causes watchPegOuts to finish settled and failed peg-outs
+// once per ledger closed on the Zioncoin network,
+// as streamed from the equator server,
+// rather than once a minute.
+// While the ledger stream is disconnected,
+// the custodian falls back to the minute ticker.
+func ReconcileOnLedgers() Option {
+	return func(c *Custodian) {
+		c.reconcileOnLedgers = true
+	}
+}
+
+// Runs as a goroutine until ctx is canceled.
+// watchLedgers streams closed ledgers from the equator server,
+// signaling closes after each.
+// A signal not yet received when the next ledger closes
+// stands for both.
+func (c *Custodian) watchLedgers(ctx context.Context, closes chan<- struct{}) {
+	defer log.Print("watchLedgers exiting")
+	backoff := i10rnet.Backoff{Base: 100 * time.Millisecond}
+
+	cur := equator.Cursor("now")
+	for {
+		err := c.hclient.StreamLedgers(ctx, &cur, func(ledger equator.Ledger) {
+			atomic.StoreInt32(&c.ledgerStreamUp, 1)
+			cur = equator.Cursor(ledger.PagingToken())
+			select {
+			case closes <- struct{}{}:
+			default:
+			}
+		})
+		atomic.StoreInt32(&c.ledgerStreamUp, 0)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("ledger stream disconnected (%v), reconciling peg-outs once a minute until it reconnects", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff.Next()):
+		}
+	}
+}
+
+// ledgerStreamConnected reports whether watchLedgers is receiving ledgers.
+func (c *Custodian) ledgerStreamConnected() bool {
+	return atomic.LoadInt32(&c.ledgerStreamUp) == 1
+}
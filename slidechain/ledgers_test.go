@@ -0,0 +1,85 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/zioncoin/go/clients/equator"
+)
+
+func TestReconcileOnLedgers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		// The ledgers sent on ledgers are streamed,
+		// with the cursor of each stream reported on cursors,
+		// and a send on disconnect closes the stream.
+		var (
+			ledgers    = make(chan equator.Ledger)
+			cursors    = make(chan equator.Cursor, 2)
+			disconnect = make(chan struct{})
+		)
+		c.hclient = &fakeClient{ClientInterface: c.hclient, streamLedgers: func(ctx context.Context, cursor *equator.Cursor, handler equator.LedgerHandler) error {
+			cursors <- *cursor
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-disconnect:
+					return errors.New("stream closed")
+				case ledger := <-ledgers:
+					handler(ledger)
+				}
+			}
+		}}
+
+		closes := make(chan struct{}, 1)
+		go c.watchLedgers(ctx, closes)
+		if cur := <-cursors; cur != "now" {
+			t.Errorf("ledger stream started at cursor %q, want now", cur)
+		}
+
+		// Each closed ledger triggers one reconciliation.
+		for seq := int32(1); seq <= 3; seq++ {
+			ledgers <- equator.Ledger{Sequence: seq, PT: strconv.Itoa(int(seq))}
+			select {
+			case <-closes:
+			case <-ctx.Done():
+				t.Fatalf("no reconciliation triggered by ledger %d", seq)
+			}
+			select {
+			case <-closes:
+				t.Fatalf("ledger %d triggered more than one reconciliation", seq)
+			default:
+			}
+			if !c.ledgerStreamConnected() {
+				t.Fatalf("ledger stream not connected after ledger %d", seq)
+			}
+		}
+
+		// Once the stream disconnects, the ticker takes over
+		// until the stream resumes after the last ledger seen.
+		disconnect <- struct{}{}
+		select {
+		case cur := <-cursors:
+			if cur != "3" {
+				t.Errorf("ledger stream resumed at cursor %q, want 3", cur)
+			}
+		case <-ctx.Done():
+			t.Fatal("ledger stream not resumed")
+		}
+		if c.ledgerStreamConnected() {
+			t.Error("ledger stream connected after disconnecting, before any new ledger")
+		}
+		ledgers <- equator.Ledger{Sequence: 4, PT: "4"}
+		<-closes
+		if !c.ledgerStreamConnected() {
+			t.Error("ledger stream not connected after resuming")
+		}
+	})
+}
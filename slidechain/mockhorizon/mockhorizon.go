@@ -2,9 +2,13 @@ package mockequator
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"sync"
 
 	"github.com/pkg/errors"
+	"github.com/zioncoin/go/amount"
 	"github.com/zioncoin/go/clients/equator"
 	"github.com/zioncoin/go/network"
 	"github.com/zioncoin/go/xdr"
@@ -14,7 +18,6 @@ import (
 // struct, which implements equator.ClientInterface
 func New() *Client {
 	return &Client{
-		mu:        new(sync.Mutex),
 		submitted: sync.NewCond(new(sync.Mutex)),
 	}
 }
@@ -26,9 +29,9 @@ func New() *Client {
 // want to submit transactions and then stream to see if they
 // have been successfully included in the ledger.
 type Client struct {
-	txs       []string
-	mu        *sync.Mutex
+	// Protects txs.
 	submitted *sync.Cond
+	txs       []string
 }
 
 // SubmitTransaction unmarshals the tx envelope string into a xdr.TransactionEnvelope,
@@ -40,53 +43,162 @@ func (c *Client) SubmitTransaction(txeBase64 string) (equator.TransactionSuccess
 	if err != nil {
 		return equator.TransactionSuccess{}, errors.Wrap(err, "submittx: unmarshaling tx envelope")
 	}
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.submitted.L.Lock()
+	defer c.submitted.L.Unlock()
 	c.txs = append(c.txs, txeBase64)
 	c.submitted.Broadcast()
 	return equator.TransactionSuccess{}, nil
 }
 
-// StreamTransactions "streams" all transactions that have been submitted to SubmitTransaction.
+// StreamTransactions "streams" all transactions that have been submitted to SubmitTransaction,
+// including those submitted before the stream began,
+// with their hashes on the test network.
 func (c *Client) StreamTransactions(ctx context.Context, accountID string, cursor *equator.Cursor, handler equator.TransactionHandler) error {
-	txindex := 0
-	ch := make(chan struct{})
-
 	go func() {
+		<-ctx.Done()
 		c.submitted.L.Lock()
 		defer c.submitted.L.Unlock()
-		for {
-			if ctx.Err() != nil {
-				return
-			}
-			c.submitted.Wait()
-			ch <- struct{}{}
-		}
+		c.submitted.Broadcast()
 	}()
 
+	txindex := 0
 	for {
-		select {
-		case <-ctx.Done():
+		c.submitted.L.Lock()
+		for txindex >= len(c.txs) && ctx.Err() == nil {
+			c.submitted.Wait()
+		}
+		txs := c.txs[txindex:]
+		c.submitted.L.Unlock()
+
+		if ctx.Err() != nil {
 			return nil
-		case <-ch:
 		}
 
-		c.mu.Lock()
+		for _, tx := range txs {
+			var txe xdr.TransactionEnvelope
+			err := xdr.SafeUnmarshalBase64(tx, &txe)
+			if err != nil {
+				return errors.Wrap(err, "streamtransactions: unmarshaling tx envelope")
+			}
+			hash, err := network.HashTransaction(&txe.Tx, network.TestNetworkPassphrase)
+			if err != nil {
+				return errors.Wrap(err, "streamtransactions: hashing tx")
+			}
+			htx := equator.Transaction{EnvelopeXdr: tx, Hash: hex.EncodeToString(hash[:])}
+			handler(htx)
+			txindex++
+		}
+	}
+}
+
+// StreamPayments "streams" the payment operations to and from accountID
+// in all transactions that have been submitted to SubmitTransaction,
+// including those submitted before the stream began.
+// As with Horizon, the memo of each payment's transaction is not included;
+// use LoadMemo to load it.
+func (c *Client) StreamPayments(ctx context.Context, accountID string, cursor *equator.Cursor, handler equator.PaymentHandler) error {
+	go func() {
+		<-ctx.Done()
+		c.submitted.L.Lock()
+		defer c.submitted.L.Unlock()
+		c.submitted.Broadcast()
+	}()
+
+	txindex := 0
+	for {
+		c.submitted.L.Lock()
+		for txindex >= len(c.txs) && ctx.Err() == nil {
+			c.submitted.Wait()
+		}
 		txs := c.txs[txindex:]
-		c.mu.Unlock()
+		c.submitted.L.Unlock()
+
+		if ctx.Err() != nil {
+			return nil
+		}
 
 		for _, tx := range txs {
-			htx := equator.Transaction{EnvelopeXdr: tx}
-			handler(htx)
+			var txe xdr.TransactionEnvelope
+			err := xdr.SafeUnmarshalBase64(tx, &txe)
+			if err != nil {
+				return errors.Wrap(err, "streampayments: unmarshaling tx envelope")
+			}
+			for i, op := range txe.Tx.Operations {
+				if op.Body.Type != xdr.OperationTypePayment {
+					continue
+				}
+				from := txe.Tx.SourceAccount
+				if op.SourceAccount != nil {
+					from = *op.SourceAccount
+				}
+				payment := op.Body.PaymentOp
+				if from.Address() != accountID && payment.Destination.Address() != accountID {
+					continue
+				}
+				p := equator.Payment{
+					// Paging tokens are ordered as Horizon's are:
+					// by transaction, then by operation within it.
+					PagingToken: fmt.Sprintf("%d", int64(txindex+1)<<12|int64(i+1)),
+					Type:        "payment",
+					From:        from.Address(),
+					To:          payment.Destination.Address(),
+					Amount:      amount.String(payment.Amount),
+				}
+				p.Links.Transaction.Href = fmt.Sprintf("%s%d", txLinkPrefix, txindex)
+				err = payment.Asset.Extract(&p.AssetType, &p.AssetCode, &p.AssetIssuer)
+				if err != nil {
+					return errors.Wrap(err, "streampayments: extracting asset")
+				}
+				handler(p)
+			}
 			txindex++
 		}
 	}
 }
 
+const txLinkPrefix = "mockequator:tx/"
+
+// LoadMemo loads the memo of the transaction containing p,
+// which must have come from StreamPayments.
+func (c *Client) LoadMemo(p *equator.Payment) error {
+	var txindex int
+	_, err := fmt.Sscanf(p.Links.Transaction.Href, txLinkPrefix+"%d", &txindex)
+	if err != nil {
+		return errors.Wrapf(err, "loadmemo: parsing transaction link %s", p.Links.Transaction.Href)
+	}
+	c.submitted.L.Lock()
+	if txindex < 0 || txindex >= len(c.txs) {
+		c.submitted.L.Unlock()
+		return errors.Errorf("loadmemo: no transaction %d", txindex)
+	}
+	tx := c.txs[txindex]
+	c.submitted.L.Unlock()
+
+	var txe xdr.TransactionEnvelope
+	err = xdr.SafeUnmarshalBase64(tx, &txe)
+	if err != nil {
+		return errors.Wrap(err, "loadmemo: unmarshaling tx envelope")
+	}
+	switch txe.Tx.Memo.Type {
+	case xdr.MemoTypeMemoNone:
+		p.Memo.Type = "none"
+	case xdr.MemoTypeMemoText:
+		p.Memo.Type, p.Memo.Value = "text", *txe.Tx.Memo.Text
+	case xdr.MemoTypeMemoId:
+		p.Memo.Type, p.Memo.Value = "id", fmt.Sprintf("%d", *txe.Tx.Memo.Id)
+	case xdr.MemoTypeMemoHash:
+		p.Memo.Type, p.Memo.Value = "hash", base64.StdEncoding.EncodeToString(txe.Tx.Memo.Hash[:])
+	case xdr.MemoTypeMemoReturn:
+		p.Memo.Type, p.Memo.Value = "return", base64.StdEncoding.EncodeToString(txe.Tx.Memo.RetHash[:])
+	}
+	return nil
+}
+
 // Unimplemented functions
 func (*Client) Root() (equator.Root, error) {
 	return equator.Root{
 		NetworkPassphrase: network.TestNetworkPassphrase,
+		ProtocolVersion:   10,
 	}, nil
 }
 
@@ -94,8 +206,13 @@ func (*Client) HomeDomainForAccount(aid string) (string, error) {
 	return "", nil
 }
 
+// LoadAccount returns an account with ample lumens and no subentries.
 func (*Client) LoadAccount(accountID string) (equator.Account, error) {
-	return equator.Account{}, nil
+	var account equator.Account
+	account.AccountID = accountID
+	account.Balances = []equator.Balance{{Balance: "10000.0000000"}}
+	account.Balances[0].Type = "native"
+	return account, nil
 }
 
 func (*Client) LoadAccountOffers(accountID string, params ...interface{}) (equator.OffersPage, error) {
@@ -114,10 +231,6 @@ func (*Client) LoadAccountMergeAmount(p *equator.Payment) error {
 	return nil
 }
 
-func (*Client) LoadMemo(p *equator.Payment) error {
-	return nil
-}
-
 func (*Client) LoadOperation(operationID string) (equator.Payment, error) {
 	return equator.Payment{}, nil
 }
@@ -137,7 +250,3 @@ func (*Client) SequenceForAccount(accountID string) (xdr.SequenceNumber, error)
 func (*Client) StreamLedgers(ctx context.Context, cursor *equator.Cursor, handler equator.LedgerHandler) error {
 	return nil
 }
-
-func (*Client) StreamPayments(ctx context.Context, accountID string, cursor *equator.Cursor, handler equator.PaymentHandler) error {
-	return nil
-}
@@ -0,0 +1,70 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/chain/txvm/errors"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/xdr"
+)
+
+// errObserver is returned by the custodian's submit paths in observer mode.
+var errObserver = errors.New("custodian is in observer mode")
+
+// Observer runs the custodian read-only,
+// watching the Zioncoin account with the given address
+// without holding its seed.
+// The custodian still records peg-ins and exports in its db
+// and reports them in its status,
+// but imports nothing, pegs nothing out,
+// and submits no transactions, to TxVM or to the Zioncoin network.
+// If address is empty,
+// the account is that of the custodian already in the db under the custodian's label,
+// whose seed is not used.
+//
+// An observer sharing a db with a running custodian
+// can be promoted by restarting it without this option.
+func Observer(address string) Option {
+	return func(c *Custodian) {
+		c.observer = true
+		c.observedAddress = address
+	}
+}
+
+// observedAccount returns the account ID of the custodian
+// watched in observer mode.
+// Unlike custodianAccount, it never creates an account.
+func observedAccount(ctx context.Context, db *sql.DB, label, address string) (*xdr.AccountId, error) {
+	if address == "" {
+		var seed string
+		err := db.QueryRowContext(ctx, "SELECT seed FROM custodian WHERE label=$1", label).Scan(&seed)
+		if err == sql.ErrNoRows {
+			return nil, errors.Wrapf(err, "observer needs an account address or a custodian with label %q", label)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading seed from db")
+		}
+		kp, err := keypair.Parse(seed)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing keypair from seed")
+		}
+		address = kp.Address()
+	}
+	var accountID xdr.AccountId
+	err := accountID.SetAddress(address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing observed address %s", address)
+	}
+	return &accountID, nil
+}
+
+// observerClient is an equator client that refuses to submit transactions.
+type observerClient struct {
+	equator.ClientInterface
+}
+
+func (observerClient) SubmitTransaction(string) (equator.TransactionSuccess, error) {
+	return equator.TransactionSuccess{}, errObserver
+}
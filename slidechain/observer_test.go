@@ -0,0 +1,177 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interzioncoin/slingshot/slidechain/mockequator"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	b "github.com/zioncoin/go/build"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/network"
+	"github.com/zioncoin/go/xdr"
+)
+
+func TestObserver(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	testdir, err := ioutil.TempDir("", "slidechaintest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testdir)
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s/testdb", testdir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = setSchema(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	custodian, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO custodian (seed) VALUES ($1)", custodian.Seed())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := mockequator.New()
+	hclient := &fakeClient{ClientInterface: mock}
+	c, err := newCustodian(ctx, db, hclient, DefaultBlockInterval, Observer(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AccountID.Address() != custodian.Address() {
+		t.Fatalf("observing account %s, want %s", c.AccountID.Address(), custodian.Address())
+	}
+	if c.seed != "" {
+		t.Error("observer holds the custodian's seed")
+	}
+
+	ctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+
+	// An export awaiting peg-out and a peg-in awaiting payment.
+	exporter, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertTestExport(t, db, []byte("export"), lumenXDR, 100, exporter.Address())
+	expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+	nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
+	err = c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, expMS, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The peg-in is paid directly to Horizon, not through the observer.
+	payer, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := b.Transaction(
+		b.Network{Passphrase: network.TestNetworkPassphrase},
+		b.SourceAccount{AddressOrSeed: payer.Address()},
+		b.Sequence{Sequence: 1},
+		b.MemoHash{Value: xdr.Hash(nonceHash)},
+		b.Payment(
+			b.Destination{AddressOrSeed: custodian.Address()},
+			b.NativeAmount{Amount: "10"},
+		),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = zioncoin.SignAndSubmitTx(mock, tx, payer.Seed())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.watchPegIns(ctx)
+		close(done)
+	}()
+	defer func() {
+		// Wait for watchPegIns to exit before the db is closed.
+		cancel()
+		<-done
+	}()
+
+	for {
+		var zioncoinTx int
+		err = db.QueryRow("SELECT zioncoin_tx FROM pegs WHERE nonce_hash=$1", nonceHash[:]).Scan(&zioncoinTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if zioncoinTx == 1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for peg-in")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// Every submit path is refused.
+	_, err = zioncoin.SignAndSubmitTx(c.hclient, tx, payer.Seed())
+	if err == nil {
+		t.Error("observer submitted a Zioncoin tx")
+	}
+	importTx, err := bc.NewTx(nil, 3, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.S.submitTx(ctx, importTx)
+	if err != errObserver {
+		t.Errorf("got error %v submitting a TxVM tx, want %v", err, errObserver)
+	}
+	_, err = c.SubmitSignedPegOut(ctx, PegOutSignature{ExportTxID: []byte("export")})
+	if err != errObserver {
+		t.Errorf("got error %v submitting a signed peg-out, want %v", err, errObserver)
+	}
+	w := httptest.NewRecorder()
+	c.DoPrePegIn(w, httptest.NewRequest("POST", "/prepegin", strings.NewReader("{}")))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got status %d for a pre-peg-in, want %d", w.Code, http.StatusForbidden)
+	}
+
+	var imported int
+	err = db.QueryRow("SELECT imported FROM pegs WHERE nonce_hash=$1", nonceHash[:]).Scan(&imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 0 {
+		t.Error("observer imported a peg-in")
+	}
+	var state pegOutState
+	err = db.QueryRow("SELECT pegged_out FROM exports WHERE txid=$1", []byte("export")).Scan(&state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != pegOutNotYet {
+		t.Errorf("observer changed export state to %d", state)
+	}
+	if n := atomic.LoadInt32(&hclient.submitted); n != 0 {
+		t.Errorf("observer submitted %d Zioncoin txs, want 0", n)
+	}
+}
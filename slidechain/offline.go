@@ -0,0 +1,399 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/interzioncoin/slingshot/slidechain/net"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/network"
+	"github.com/zioncoin/go/xdr"
+)
+
+// OfflineSigning causes the custodian to leave peg-out transactions unsigned,
+// so that they can be signed with the custodian's key on a machine
+// that is never online.
+// Instead of submitting an export's peg-out tx,
+// the custodian prepares it as a PegOutBundle
+// and records the export as awaiting signature.
+// The workflow is then:
+//   - UnsignedPegOuts lists the bundles awaiting signature,
+//     and PreparePegOut returns the bundle of one export;
+//   - SignPegOutOffline, run where the key is kept,
+//     checks each bundle and signs its tx;
+//   - SubmitSignedPegOut adds the signature to the tx and submits it,
+//     after which the export proceeds as if the custodian had submitted it.
+func OfflineSigning() Option {
+	return func(c *Custodian) {
+		c.offlineSigning = true
+	}
+}
+
+// A PegOutBundle is the unsigned peg-out tx of an export,
+// with the metadata needed to check it before signing.
+type PegOutBundle struct {
+	ExportTxID []byte `json:"export_txid"`
+
+	// Network is the passphrase of the Zioncoin network,
+	// which is part of the hash to be signed.
+	Network string `json:"network"`
+
+	// Tx is the base64-encoded XDR of the unsigned Zioncoin tx,
+	// and Hash its hex-encoded hash.
+	Tx   string `json:"tx"`
+	Hash string `json:"hash"`
+
+	// Custodian pays Amount of the asset with XDR AssetXDR to Exporter.
+	// The payment is the first of Tranches tranches (see FeePolicy.Split),
+	// and is net of Fee.
+	Custodian string `json:"custodian"`
+	Exporter  string `json:"exporter"`
+	AssetXDR  []byte `json:"asset"`
+	Amount    int64  `json:"amount"`
+	Fee       int64  `json:"fee"`
+	Tranches  int    `json:"tranches"`
+}
+
+// A PegOutSignature is the custodian's signature
+// on the peg-out tx of a PegOutBundle,
+// as produced by SignPegOutOffline.
+type PegOutSignature struct {
+	ExportTxID []byte `json:"export_txid"`
+
+	// Signature is the base64-encoded XDR of an xdr.DecoratedSignature.
+	Signature string `json:"signature"`
+}
+
+// preparePegOut records the unsigned peg-out tx of export txid,
+// which pays the first of tranches,
+// and marks the export as awaiting an offline signature,
+// provided the export is still at p.Version.
+// Preparing an export again records the same tx.
+func (c *Custodian) preparePegOut(ctx context.Context, txid []byte, p pegOut, asset xdr.Asset, tranches []int64, fee int64) (PegOutBundle, error) {
+	conv, err := p.conversion()
+	if err != nil {
+		return PegOutBundle{}, err
+	}
+	tx, err := buildPegOutTx(c.AccountID.Address(), p.Exporter, p.owner(), p.TempAddr, c.network, asset, tranches[0], conv, p.Recipients, xdr.SequenceNumber(p.Seqnum), p.memo(), c.pegOutBaseFee(p), c.cosignPegOuts)
+	if err != nil {
+		return PegOutBundle{}, errors.Wrap(err, "building peg-out tx")
+	}
+	hash, err := tx.HashHex()
+	if err != nil {
+		return PegOutBundle{}, errors.Wrap(err, "hashing peg-out tx")
+	}
+	txstr, err := xdr.MarshalBase64(tx.TX)
+	if err != nil {
+		return PegOutBundle{}, errors.Wrap(err, "marshaling peg-out tx")
+	}
+	bundle := PegOutBundle{
+		ExportTxID: txid,
+		Network:    c.network,
+		Tx:         txstr,
+		Hash:       hash,
+		Custodian:  c.AccountID.Address(),
+		Exporter:   p.Exporter,
+		AssetXDR:   p.AssetXDR,
+		Amount:     tranches[0],
+		Fee:        fee,
+		Tranches:   len(tranches),
+	}
+	bundleJSON, err := json.Marshal(bundle)
+	if err != nil {
+		return PegOutBundle{}, errors.Wrap(err, "marshaling peg-out bundle")
+	}
+
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return PegOutBundle{}, errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	result, err := dbtx.ExecContext(ctx, `UPDATE exports SET pegged_out=$1, version=version+1 WHERE txid=$2 AND pegged_out IN ($3, $4, $5, $1) AND version=$6`, pegOutUnsigned, txid, pegOutNotYet, pegOutRetry, pegOutNoTrust, p.Version)
+	if err != nil {
+		return PegOutBundle{}, errors.Wrapf(err, "marking export %x unsigned", txid)
+	}
+	numAffected, err := result.RowsAffected()
+	if err != nil {
+		return PegOutBundle{}, errors.Wrapf(err, "checking rows affected by marking export %x unsigned", txid)
+	}
+	if numAffected == 0 {
+		return PegOutBundle{}, errors.Wrapf(errExportChanged, "export %x is no longer awaiting peg-out at version %d", txid, p.Version)
+	}
+	_, err = dbtx.ExecContext(ctx, `INSERT OR REPLACE INTO offline_pegouts (export_txid, bundle_json) VALUES ($1, $2)`, txid, bundleJSON)
+	if err != nil {
+		return PegOutBundle{}, errors.Wrapf(err, "recording peg-out bundle of export %x", txid)
+	}
+	return bundle, errors.Wrapf(dbtx.Commit(), "committing peg-out bundle of export %x", txid)
+}
+
+// PreparePegOut returns the bundle of export txid,
+// whose peg-out tx the custodian has prepared for offline signing.
+// It returns an error if the export is not awaiting an offline signature.
+func (c *Custodian) PreparePegOut(ctx context.Context, txid []byte) (PegOutBundle, error) {
+	bundle, _, err := c.unsignedPegOut(ctx, txid)
+	return bundle, err
+}
+
+// unsignedPegOut returns the bundle of export txid,
+// which is awaiting an offline signature,
+// and the export's version.
+func (c *Custodian) unsignedPegOut(ctx context.Context, txid []byte) (PegOutBundle, int64, error) {
+	var (
+		bundleJSON []byte
+		version    int64
+	)
+	const q = `SELECT o.bundle_json, e.version FROM offline_pegouts o JOIN exports e ON e.txid = o.export_txid WHERE o.export_txid = $1 AND e.pegged_out = $2 AND e.custodian_id = $3`
+	err := c.DB.QueryRowContext(ctx, q, txid, pegOutUnsigned, c.label).Scan(&bundleJSON, &version)
+	if err == sql.ErrNoRows {
+		return PegOutBundle{}, 0, fmt.Errorf("export %x is not awaiting an offline signature", txid)
+	}
+	if err != nil {
+		return PegOutBundle{}, 0, errors.Wrapf(err, "reading peg-out bundle of export %x", txid)
+	}
+	var bundle PegOutBundle
+	err = json.Unmarshal(bundleJSON, &bundle)
+	return bundle, version, errors.Wrapf(err, "unmarshaling peg-out bundle of export %x", txid)
+}
+
+// UnsignedPegOuts returns the bundles of the exports awaiting an offline signature.
+func (c *Custodian) UnsignedPegOuts(ctx context.Context) ([]PegOutBundle, error) {
+	var bundles []PegOutBundle
+	const q = `SELECT o.bundle_json FROM offline_pegouts o JOIN exports e ON e.txid = o.export_txid WHERE e.pegged_out = $1 AND e.custodian_id = $2 ORDER BY o.export_txid`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, pegOutUnsigned, c.label, func(bundleJSON []byte) error {
+		var bundle PegOutBundle
+		err := json.Unmarshal(bundleJSON, &bundle)
+		if err != nil {
+			return errors.Wrap(err, "unmarshaling peg-out bundle")
+		}
+		bundles = append(bundles, bundle)
+		return nil
+	})
+	return bundles, errors.Wrap(err, "querying unsigned peg-outs")
+}
+
+// SignPegOutOffline signs the peg-out tx of bundle with the custodian's seed.
+// It needs no network access,
+// so it can run on the machine where the seed is kept.
+// Before signing it checks the bundle's tx against its metadata:
+// the tx must hash to the bundle's hash on its network,
+// must not be paid for by the custodian,
+// and its only operation from the custodian's account
+// must be the bundle's payment to the exporter.
+func SignPegOutOffline(bundle PegOutBundle, seed string) (PegOutSignature, error) {
+	kp, err := keypair.Parse(seed)
+	if err != nil {
+		return PegOutSignature{}, errors.Wrap(err, "parsing custodian seed")
+	}
+	full, ok := kp.(*keypair.Full)
+	if !ok {
+		return PegOutSignature{}, errors.New("custodian seed is an address, not a seed")
+	}
+	if full.Address() != bundle.Custodian {
+		return PegOutSignature{}, fmt.Errorf("seed is for account %s, not custodian %s", full.Address(), bundle.Custodian)
+	}
+	var tx xdr.Transaction
+	err = xdr.SafeUnmarshalBase64(bundle.Tx, &tx)
+	if err != nil {
+		return PegOutSignature{}, errors.Wrap(err, "unmarshaling peg-out tx")
+	}
+	hash, err := network.HashTransaction(&tx, bundle.Network)
+	if err != nil {
+		return PegOutSignature{}, errors.Wrap(err, "hashing peg-out tx")
+	}
+	if hex.EncodeToString(hash[:]) != bundle.Hash {
+		return PegOutSignature{}, fmt.Errorf("peg-out tx has hash %x, not %s", hash[:], bundle.Hash)
+	}
+	err = checkPegOutTx(tx, bundle)
+	if err != nil {
+		return PegOutSignature{}, err
+	}
+	sig, err := full.SignDecorated(hash[:])
+	if err != nil {
+		return PegOutSignature{}, errors.Wrap(err, "signing peg-out tx")
+	}
+	sigstr, err := xdr.MarshalBase64(sig)
+	if err != nil {
+		return PegOutSignature{}, errors.Wrap(err, "marshaling signature")
+	}
+	return PegOutSignature{ExportTxID: bundle.ExportTxID, Signature: sigstr}, nil
+}
+
+// checkPegOutTx checks that tx spends from the custodian's account
+// only the payment described by bundle.
+func checkPegOutTx(tx xdr.Transaction, bundle PegOutBundle) error {
+	if tx.SourceAccount.Address() == bundle.Custodian {
+		return errors.New("peg-out tx is paid for by the custodian")
+	}
+	var payments int
+	for i, op := range tx.Operations {
+		if op.SourceAccount == nil || op.SourceAccount.Address() != bundle.Custodian {
+			continue
+		}
+		if op.Body.Type != xdr.OperationTypePayment {
+			return fmt.Errorf("peg-out tx operation %d from the custodian is a %s, not a payment", i, op.Body.Type)
+		}
+		payment := op.Body.MustPaymentOp()
+		assetXDR, err := payment.Asset.MarshalBinary()
+		if err != nil {
+			return errors.Wrapf(err, "marshaling asset of peg-out tx operation %d", i)
+		}
+		if payment.Destination.Address() != bundle.Exporter || int64(payment.Amount) != bundle.Amount || !bytes.Equal(assetXDR, bundle.AssetXDR) {
+			return fmt.Errorf("peg-out tx operation %d pays %d of %s to %s, not %d of %x to %s", i, payment.Amount, payment.Asset.String(), payment.Destination.Address(), bundle.Amount, bundle.AssetXDR, bundle.Exporter)
+		}
+		payments++
+	}
+	if payments != 1 {
+		return fmt.Errorf("peg-out tx has %d payments from the custodian, want 1", payments)
+	}
+	return nil
+}
+
+// SubmitSignedPegOut submits the peg-out tx of an export awaiting an offline signature,
+// signed with sig.
+// The signature is verified against the custodian's account first,
+// and the export left awaiting signature if it does not verify.
+// Once the tx is submitted,
+// the export's state is recorded as if the custodian had submitted it itself.
+// It returns the hex-encoded hash of the Zioncoin tx.
+func (c *Custodian) SubmitSignedPegOut(ctx context.Context, sig PegOutSignature) (string, error) {
+	if c.observer {
+		return "", errObserver
+	}
+
+	// Only one submission of an export's tx may decide its state.
+	c.offlineMu.Lock()
+	defer c.offlineMu.Unlock()
+
+	bundle, version, err := c.unsignedPegOut(ctx, sig.ExportTxID)
+	if err != nil {
+		return "", err
+	}
+
+	var decorated xdr.DecoratedSignature
+	err = xdr.SafeUnmarshalBase64(sig.Signature, &decorated)
+	if err != nil {
+		return "", errors.Wrap(err, "unmarshaling signature")
+	}
+	hash, err := hex.DecodeString(bundle.Hash)
+	if err != nil {
+		return "", errors.Wrapf(err, "decoding hash of export %x peg-out tx", sig.ExportTxID)
+	}
+	err = keypair.MustParse(c.AccountID.Address()).Verify(hash, decorated.Signature)
+	if err != nil {
+		return "", errors.Wrapf(err, "verifying signature on peg-out tx of export %x", sig.ExportTxID)
+	}
+	var env xdr.TransactionEnvelope
+	err = xdr.SafeUnmarshalBase64(bundle.Tx, &env.Tx)
+	if err != nil {
+		return "", errors.Wrapf(err, "unmarshaling peg-out tx of export %x", sig.ExportTxID)
+	}
+	env.Signatures = []xdr.DecoratedSignature{decorated}
+	envstr, err := xdr.MarshalBase64(env)
+	if err != nil {
+		return "", errors.Wrapf(err, "marshaling peg-out tx envelope of export %x", sig.ExportTxID)
+	}
+
+	// Claim the export so that no other worker acts on it
+	// while its tx is submitted.
+	claimed, err := c.claimExport(ctx, sig.ExportTxID, version)
+	if err != nil {
+		return "", err
+	}
+	if !claimed {
+		return "", fmt.Errorf("export %x changed concurrently; try again", sig.ExportTxID)
+	}
+	version++
+
+	log.Printf("submitting offline-signed peg-out tx %s of export %x", bundle.Hash, sig.ExportTxID)
+	state := pegOutOK
+	_, err = zioncoin.SubmitTx(c.hclient, envstr)
+	if err != nil {
+		err = c.resolveUnknownSubmission(bundle.Hash, err)
+	}
+	if err != nil {
+		log.Printf("submitting offline-signed peg-out tx %s of export %x: %s", bundle.Hash, sig.ExportTxID, err)
+		state = pegOutFailureState(sig.ExportTxID, err)
+	} else {
+		if bundle.Tranches > 1 {
+			// The remaining tranches are paid by watchPegOuts.
+			state = pegOutPartial
+		}
+		if bundle.Fee > 0 {
+			err = c.recordFee(ctx, sig.ExportTxID, bundle.AssetXDR, bundle.Fee)
+			if err != nil {
+				log.Printf("recording fee of export %x: %s", sig.ExportTxID, err)
+			}
+		}
+		err = c.retryDB(ctx, "witnessing peg-out", func(ctx context.Context) error {
+			return c.witnessPegOut(ctx, sig.ExportTxID, bundle.Hash, bundle.AssetXDR, bundle.Amount, bundle.Exporter)
+		})
+		if err != nil {
+			log.Printf("witnessing peg-out of export %x: %s", sig.ExportTxID, err)
+		}
+	}
+	// A settled or failed peg-out is finished by watchPegOuts,
+	// and one marked for retry is prepared again by pegOutFromExports.
+	_, state, serr := c.recordExportOutcome(ctx, sig.ExportTxID, version, pegOutUnsigned, state, bundle.Hash)
+	if serr != nil {
+		log.Printf("recording state of export %x: %s", sig.ExportTxID, serr)
+	}
+	if state == pegOutRetry {
+		c.exports.Broadcast()
+	}
+	if state == pegOutFail || state == pegOutRetry {
+		return bundle.Hash, errors.Wrapf(err, "submitting peg-out tx of export %x", sig.ExportTxID)
+	}
+	return bundle.Hash, nil
+}
+
+// UnsignedPegOutsHandler responds with the bundles of the exports
+// awaiting an offline signature, as a JSON array.
+func (c *Custodian) UnsignedPegOutsHandler(w http.ResponseWriter, req *http.Request) {
+	bundles, err := c.UnsignedPegOuts(req.Context())
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	if bundles == nil {
+		bundles = []PegOutBundle{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(bundles)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+		return
+	}
+}
+
+// SubmitSignedPegOutHandler submits the peg-out tx
+// signed by the JSON PegOutSignature in the body of a POST request,
+// responding with the hex-encoded hash of the Zioncoin tx.
+func (c *Custodian) SubmitSignedPegOutHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	var sig PegOutSignature
+	err := json.NewDecoder(req.Body).Decode(&sig)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "decoding signature: %s", err)
+		return
+	}
+	hash, err := c.SubmitSignedPegOut(req.Context(), sig)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, hash)
+}
@@ -0,0 +1,143 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/xdr"
+)
+
+func TestOfflinePegOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		c.hclient = hclient
+
+		txid := []byte("export")
+		insertTestExport(t, db, txid, lumenXDR, 1000, exporter.Address())
+		exportState := func() (pegOutState, string) {
+			var (
+				state pegOutState
+				hash  string
+			)
+			err := db.QueryRow("SELECT pegged_out, zioncoin_tx FROM exports WHERE txid=$1", txid).Scan(&state, &hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return state, hash
+		}
+
+		// The custodian prepares the peg-out tx but does not submit it.
+		pegOutCtx, cancelPegOuts := context.WithCancel(ctx)
+		pegouts := make(chan pegOut)
+		done := make(chan struct{})
+		go func() {
+			c.pegOutFromExports(pegOutCtx, pegouts)
+			close(done)
+		}()
+		for state, _ := exportState(); state != pegOutUnsigned; state, _ = exportState() {
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for the peg-out to be prepared")
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			case p := <-pegouts:
+				t.Fatalf("got peg-out in state %d before signing", p.State)
+			}
+		}
+		cancelPegOuts()
+		for range pegouts {
+		}
+		<-done
+		if hclient.submitted != 0 {
+			t.Fatalf("custodian submitted %d txs with offline signing", hclient.submitted)
+		}
+
+		bundles, err := c.UnsignedPegOuts(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bundles) != 1 || string(bundles[0].ExportTxID) != string(txid) || bundles[0].Amount != 1000 {
+			t.Fatalf("got unsigned peg-outs %+v, want one of 1000 for export %x", bundles, txid)
+		}
+		bundle := bundles[0]
+
+		// The offline signer rejects a bundle whose metadata misdescribes its tx.
+		tampered := bundle
+		tampered.Amount = 2000
+		_, err = SignPegOutOffline(tampered, c.seed)
+		if err == nil {
+			t.Error("signed a bundle whose payment does not match its amount")
+		}
+
+		// The custodian rejects a signature by another key.
+		other, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashBytes, err := hex.DecodeString(bundle.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherSig, err := other.SignDecorated(hashBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherSigStr, err := xdr.MarshalBase64(otherSig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.SubmitSignedPegOut(ctx, PegOutSignature{ExportTxID: txid, Signature: otherSigStr})
+		if err == nil {
+			t.Error("submitted a peg-out signed by another key")
+		}
+		if state, _ := exportState(); state != pegOutUnsigned || hclient.submitted != 0 {
+			t.Fatalf("got export state %d and %d submissions after a bad signature, want %d and 0", state, hclient.submitted, pegOutUnsigned)
+		}
+
+		sig, err := SignPegOutOffline(bundle, c.seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := c.SubmitSignedPegOut(ctx, sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state, gotHash := exportState(); state != pegOutOK || gotHash != bundle.Hash || hash != bundle.Hash {
+			t.Errorf("got export state %d with tx %s (returned %s), want %d with tx %s", state, gotHash, hash, pegOutOK, bundle.Hash)
+		}
+		if hclient.submitted != 1 {
+			t.Fatalf("got %d submissions, want 1", hclient.submitted)
+		}
+		var env xdr.TransactionEnvelope
+		err = xdr.SafeUnmarshalBase64(hclient.txs[0], &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kp := keypair.MustParse(c.AccountID.Address())
+		if len(env.Signatures) != 1 || env.Signatures[0].Hint != xdr.SignatureHint(kp.Hint()) {
+			t.Errorf("submitted tx has %d signatures, want one by the custodian", len(env.Signatures))
+		}
+
+		// The export is no longer awaiting signature.
+		_, err = c.SubmitSignedPegOut(ctx, sig)
+		if err == nil {
+			t.Error("submitted a peg-out twice")
+		}
+	}, OfflineSigning())
+}
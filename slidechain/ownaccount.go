@@ -0,0 +1,139 @@
+package slidechain
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/amount"
+	b "github.com/zioncoin/go/build"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/xdr"
+)
+
+// submitAccountPreExportTx makes a pre-export
+// like SubmitPreExportTxWithOptions with opts.OwnAccount,
+// using kp's own account as the temporary account
+// instead of creating and funding a new one,
+// saving the exporter a transaction and the new account's reserve.
+// It adds only the preauth signer to the account.
+// The peg-out transaction pays its fee from the account
+// but, unlike with a temporary account, leaves it in place,
+// so the account can be used for the next export.
+//
+// The account must exist,
+// with lumens above its minimum balance for the fees,
+// and should be dedicated to exports:
+// any other transaction from it changes its sequence number,
+// so that the peg-out fails and the export is refunded on slidechain.
+// For the same reason, each pre-export voids any earlier one
+// whose peg-out has not happened.
+// Cleaning up is the exporter's responsibility:
+// a preauth signer whose peg-out never happens stays on the account,
+// holding a base reserve,
+// until removed by the account's next pre-export
+// or by the exporter.
+//
+// The function returns kp's address and the sequence number
+// to pass to BuildExportTx, signed with kp's key.
+func submitAccountPreExportTx(hclient equator.ClientInterface, kp *keypair.Full, custodian string, asset xdr.Asset, amt int64, opts PreExportOptions) (string, xdr.SequenceNumber, error) {
+	fee := opts.fee()
+	destination, err := exportDestination(kp, opts.Destination)
+	if err != nil {
+		return "", 0, err
+	}
+	root, err := hclient.Root()
+	if err != nil {
+		return "", 0, errors.Wrap(err, "getting Horizon root")
+	}
+	account, err := hclient.LoadAccount(kp.Address())
+	if isNotFound(err) {
+		return "", 0, fmt.Errorf("account %s does not exist", kp.Address())
+	}
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "loading account %s", kp.Address())
+	}
+	current, err := strconv.ParseInt(account.Sequence, 10, 64)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "parsing sequence number %q of account %s", account.Sequence, kp.Address())
+	}
+	// The pre-export tx takes the next sequence number,
+	// and the peg-out tx the one after.
+	if current < 0 || current > math.MaxInt64-2 {
+		return "", 0, fmt.Errorf("account %s has unusable sequence number %d", kp.Address(), current)
+	}
+	seqnum := xdr.SequenceNumber(current + 1)
+
+	hashStr, err := ComputePegOutPreauthHash(PegOutParams{
+		Custodian: custodian,
+		Exporter:  destination,
+		Owner:     kp.Address(),
+		TempAddr:  kp.Address(),
+		Network:   root.NetworkPassphrase,
+		Asset:     asset,
+		Amount:    amt,
+		Seqnum:    seqnum,
+		BaseFee:   fee,
+	})
+	if err != nil {
+		return "", 0, errors.Wrap(err, "computing preauth tx hash")
+	}
+	// The account pays for the peg-out tx as well as the pre-export tx.
+	pegOutTx, err := buildPegOutTx(custodian, destination, kp.Address(), kp.Address(), root.NetworkPassphrase, asset, amt, nil, nil, seqnum, nil, fee, false)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "building peg-out tx")
+	}
+
+	muts := []b.TransactionMutator{
+		b.Network{Passphrase: root.NetworkPassphrase},
+		b.SourceAccount{AddressOrSeed: kp.Address()},
+		b.Sequence{Sequence: uint64(seqnum)},
+		b.BaseFee{Amount: uint64(fee)},
+	}
+	var (
+		lumens int64
+		stale  int32
+	)
+	// Preauth signers left by earlier pre-exports
+	// can no longer be used.
+	for _, signer := range account.Signers {
+		if signer.Type == "preauth_tx" {
+			muts = append(muts, b.SetOptions(b.RemoveSigner(signer.Key)))
+			stale++
+		}
+	}
+	for _, balance := range account.Balances {
+		if balance.Type != "native" {
+			continue
+		}
+		lumens, err = amount.ParseInt64(balance.Balance)
+		if err != nil {
+			return "", 0, errors.Wrapf(err, "parsing lumen balance %q of account %s", balance.Balance, kp.Address())
+		}
+	}
+	// The preauth signer must meet the threshold for the peg-out tx's fee and sequence number.
+	weight := uint32(account.Thresholds.LowThreshold)
+	if weight == 0 {
+		weight = 1
+	}
+	muts = append(muts, b.SetOptions(b.AddSigner(hashStr, weight)))
+
+	minBalance := int64(2+account.SubentryCount-stale+1) * DefaultBaseReserve
+	fees := int64(stale+1+int32(len(pegOutTx.TX.Operations))) * fee
+	if lumens-fees < minBalance {
+		return "", 0, fmt.Errorf("account %s balance of %d stroops does not cover the pre-export and peg-out fees of %d above its minimum balance of %d", kp.Address(), lumens, fees, minBalance)
+	}
+
+	tx, err := b.Transaction(muts...)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "building pre-export tx")
+	}
+	_, err = zioncoin.SignAndSubmitTx(hclient, tx, kp.Seed())
+	if err != nil {
+		return "", 0, errors.Wrap(err, "submitting pre-export tx")
+	}
+	return kp.Address(), seqnum, nil
+}
@@ -0,0 +1,174 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/interzioncoin/starlight/worizon/xlm"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/network"
+	"github.com/zioncoin/go/strkey"
+	"github.com/zioncoin/go/xdr"
+)
+
+func TestAccountPreExport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		accounts := make(map[string]equator.Account)
+		hclient := &fakeClient{ClientInterface: c.hclient, loadAccount: loadAccountsFrom(accounts)}
+		c.hclient = hclient
+
+		_, exporterPrv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var seed [32]byte
+		copy(seed[:], exporterPrv)
+		exporter, err := keypair.FromRawSeed(seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		asset := zioncoin.NativeAsset()
+		const amount = 50 * int64(xlm.Lumen)
+
+		_, _, err = SubmitPreExportTxWithOptions(hclient, exporter, c.AccountID.Address(), asset, amount, PreExportOptions{OwnAccount: true})
+		if err == nil || !strings.Contains(err.Error(), "does not exist") {
+			t.Fatalf("got error %v pre-exporting from a missing account, want one containing %q", err, "does not exist")
+		}
+
+		// The account still has the preauth signer of an earlier pre-export.
+		const stale = "TBU2RRGLXH3E5CQHTD3ODLDF2BWDCYUSSBLLZ5GNW7JXHDIYKXZWHXL7"
+		account := equator.Account{
+			Sequence:      "41",
+			SubentryCount: 1,
+			Signers: []equator.Signer{
+				{Key: exporter.Address(), Weight: 1, Type: "ed25519_public_key"},
+				{Key: stale, Weight: 1, Type: "preauth_tx"},
+			},
+		}
+		account.AccountID = exporter.Address()
+		native := equator.Balance{Balance: "1.0000000"}
+		native.Type = "native"
+		account.Balances = []equator.Balance{native}
+		accounts[exporter.Address()] = account
+		_, _, err = SubmitPreExportTxWithOptions(hclient, exporter, c.AccountID.Address(), asset, amount, PreExportOptions{OwnAccount: true})
+		if err == nil || !strings.Contains(err.Error(), "does not cover") {
+			t.Fatalf("got error %v pre-exporting from an account without lumens for the fees, want one containing %q", err, "does not cover")
+		}
+
+		account.Balances[0].Balance = "10.0000000"
+		accounts[exporter.Address()] = account
+		tempAddr, seqnum, err := SubmitPreExportTxWithOptions(hclient, exporter, c.AccountID.Address(), asset, amount, PreExportOptions{OwnAccount: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tempAddr != exporter.Address() || seqnum != 42 {
+			t.Fatalf("got temp account %s with sequence number %d, want %s with 42", tempAddr, seqnum, exporter.Address())
+		}
+		if len(hclient.txs) != 1 {
+			t.Fatalf("got %d pre-export txs submitted, want 1", len(hclient.txs))
+		}
+		var env xdr.TransactionEnvelope
+		err = xdr.SafeUnmarshalBase64(hclient.txs[0], &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var preauth string
+		for _, op := range env.Tx.Operations {
+			if op.Body.Type == xdr.OperationTypeCreateAccount {
+				t.Error("pre-export tx creates an account")
+			}
+			if op.Body.SetOptionsOp == nil || op.Body.SetOptionsOp.Signer == nil {
+				continue
+			}
+			signer := op.Body.SetOptionsOp.Signer
+			switch {
+			case signer.Key.Address() == stale && signer.Weight == 0:
+			case signer.Key.Type == xdr.SignerKeyTypeSignerKeyTypePreAuthTx && signer.Weight > 0:
+				preauth = signer.Key.Address()
+			default:
+				t.Errorf("pre-export tx sets unexpected signer %s with weight %d", signer.Key.Address(), signer.Weight)
+			}
+		}
+		if len(env.Tx.Operations) != 2 || preauth == "" {
+			t.Fatalf("got pre-export tx with %d ops and preauth signer %q, want 2 ops removing the stale signer and adding a new one", len(env.Tx.Operations), preauth)
+		}
+		account.Sequence = "42"
+		account.Signers[1].Key = preauth
+		accounts[exporter.Address()] = account
+
+		var anchor [32]byte
+		exportTx, err := BuildExportTx(ctx, asset, amount, amount, tempAddr, anchor[:], exporterPrv, seqnum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := InspectExportTx(exportTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p pegOut
+		err = decodeRefdata(ref, &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason := exportAccountReason(p); reason != "" {
+			t.Fatalf("custodian refuses export: %s", reason)
+		}
+		if reason, err := c.checkTempAccount(p); err != nil || reason != "" {
+			t.Fatalf("got error %v and failure %q checking the exporter's account, want neither", err, reason)
+		}
+		merged, reason, err := c.checkTempAccountMerge(p.TempAddr, p.owner(), c.BaseFee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason != "" || merged != 0 {
+			t.Errorf("got failure %q and merge of %d, want none and 0", reason, merged)
+		}
+
+		var exporterID xdr.AccountId
+		err = exporterID.SetAddress(p.Exporter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hclient.txs = nil
+		_, _, err = c.pegOut(ctx, nil, exporterID, p.owner(), asset, amount, nil, nil, exporterID, xdr.SequenceNumber(p.Seqnum), nil, c.BaseFee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hclient.txs) != 1 {
+			t.Fatalf("got %d peg-out txs submitted, want 1", len(hclient.txs))
+		}
+		err = xdr.SafeUnmarshalBase64(hclient.txs[0], &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := network.HashTransaction(&env.Tx, c.network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := strkey.Encode(strkey.VersionByteHashTx, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != preauth {
+			t.Errorf("peg-out tx has hash %s, want the account's preauth signer %s", got, preauth)
+		}
+		// The account pays the fee and is left in place.
+		if env.Tx.SourceAccount.Address() != exporter.Address() || env.Tx.SeqNum != 43 {
+			t.Errorf("got peg-out tx from %s with sequence number %d, want from %s with 43", env.Tx.SourceAccount.Address(), env.Tx.SeqNum, exporter.Address())
+		}
+		for _, op := range env.Tx.Operations {
+			if op.Body.Type != xdr.OperationTypePayment {
+				t.Errorf("peg-out tx has %s op, want only the payment", op.Body.Type)
+			}
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+)
+
+// DefaultPegInKeyWindow is the default time for which DoPrePegIn
+// remembers the idempotency key of a pre-peg-in request.
+const DefaultPegInKeyWindow = 24 * time.Hour
+
+// prePegInWait bounds how long DoPrePegIn waits
+// for its pre-peg-in tx to reach the TxVM chain.
+const prePegInWait = 2 * time.Minute
+
+// pegInKeyPendingTimeout is the time after which an idempotency key
+// reserved by a request that never completed may be reused.
+// It outlasts the request's wait on its pre-peg-in tx,
+// with a minute to spare for the rest of the request,
+// so that a retry cannot record a second peg-in
+// while the first request may still record its own.
+const pegInKeyPendingTimeout = prePegInWait + time.Minute
+
+// PegInKeyHeader is the HTTP header in which a client may supply
+// the idempotency key of a pre-peg-in request (see DoPrePegIn).
+const PegInKeyHeader = "Idempotency-Key"
+
+var (
+	errPegInKeyPending = errors.New("request with this idempotency key is in progress")
+	errPegInKeyReused  = errors.New("idempotency key was used for a different request")
+)
+
+// PegInKeyWindow sets how long DoPrePegIn remembers the idempotency key
+// of a pre-peg-in request (by default, DefaultPegInKeyWindow).
+// Within that time, a request repeating the key gets the nonce hash
+// of the original peg-in rather than recording a new one.
+func PegInKeyWindow(d time.Duration) Option {
+	return func(c *Custodian) {
+		c.pegInKeyWindow = d
+	}
+}
+
+// pegInRequestHash returns the hash identifying pre-peg-in request p
+// among those with its idempotency key.
+func pegInRequestHash(p PrePegIn) ([]byte, error) {
+	p.IdempotencyKey = ""
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshaling pre-peg-in request")
+	}
+	h := sha256.Sum256(data)
+	return h[:], nil
+}
+
+// reservePegInKey reserves idempotency key for a new pre-peg-in request
+// with the given request hash (see pegInRequestHash).
+// If a request with the same key completed within the key window,
+// it returns that request's nonce hash instead.
+// If such a request is still in progress, it returns errPegInKeyPending.
+// If either request has a different hash, it returns errPegInKeyReused.
+func (c *Custodian) reservePegInKey(ctx context.Context, key string, reqHash []byte) ([]byte, error) {
+	window := c.pegInKeyWindow
+	if window == 0 {
+		window = DefaultPegInKeyWindow
+	}
+	now := time.Now()
+
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	var (
+		nonceHash, prevHash []byte
+		createdMS           int64
+	)
+	err = dbtx.QueryRowContext(ctx, `SELECT nonce_hash, request_hash, created_ms FROM pegin_keys WHERE key=$1`, key).Scan(&nonceHash, &prevHash, &createdMS)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, errors.Wrapf(err, "looking up idempotency key %q", key)
+	case nonceHash != nil && createdMS > int64(bc.Millis(now.Add(-window))),
+		nonceHash == nil && createdMS > int64(bc.Millis(now.Add(-pegInKeyPendingTimeout))):
+		// Keys reserved before request hashes were recorded have none.
+		if len(prevHash) > 0 && !bytes.Equal(prevHash, reqHash) {
+			return nil, errPegInKeyReused
+		}
+		if nonceHash == nil {
+			return nil, errPegInKeyPending
+		}
+		return nonceHash, nil
+	}
+
+	_, err = dbtx.ExecContext(ctx, `DELETE FROM pegin_keys WHERE created_ms <= $1`, bc.Millis(now.Add(-window)))
+	if err != nil {
+		return nil, errors.Wrap(err, "deleting expired idempotency keys")
+	}
+	_, err = dbtx.ExecContext(ctx, `INSERT OR REPLACE INTO pegin_keys (key, request_hash, created_ms) VALUES ($1, $2, $3)`, key, reqHash, bc.Millis(now))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reserving idempotency key %q", key)
+	}
+	return nil, errors.Wrapf(dbtx.Commit(), "committing reservation of idempotency key %q", key)
+}
+
+// releasePegInKey releases the idempotency key of a pre-peg-in request that failed,
+// so that the request may be retried.
+func (c *Custodian) releasePegInKey(key string) {
+	ctx, cancel := c.dbContext(context.Background())
+	defer cancel()
+	_, err := c.DB.ExecContext(ctx, `DELETE FROM pegin_keys WHERE key=$1 AND nonce_hash IS NULL`, key)
+	if err != nil {
+		log.Printf("releasing idempotency key %q: %s", key, err)
+	}
+}
+
+// insertKeyedPegIn records a peg, as insertPegIn does,
+// together with the idempotency key of the request that created it.
+func (c *Custodian) insertKeyedPegIn(ctx context.Context, key string, nonceHash, recip []byte, expMS int64, metadata []byte) error {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	_, err = dbtx.ExecContext(ctx, insertPegInQ, nonceHash, recip, expMS, c.label, string(metadata))
+	if err != nil {
+		return errors.Wrap(err, "inserting peg in db")
+	}
+	_, err = dbtx.ExecContext(ctx, `UPDATE pegin_keys SET nonce_hash=$1 WHERE key=$2`, nonceHash, key)
+	if err != nil {
+		return errors.Wrapf(err, "recording nonce hash for idempotency key %q", key)
+	}
+	return errors.Wrap(dbtx.Commit(), "committing peg")
+}
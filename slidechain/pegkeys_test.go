@@ -0,0 +1,133 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+)
+
+func TestPegInIdempotencyKey(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		c.S.blockInterval = 100 * time.Millisecond
+
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		send := func(key string, useHeader bool, expMS int64) *httptest.ResponseRecorder {
+			p := PrePegIn{
+				BcID:        c.InitBlockHash.Bytes(),
+				Amount:      10,
+				AssetXDR:    lumenXDR,
+				RecipPubkey: testRecipPubKey,
+				ExpMS:       expMS,
+			}
+			if !useHeader {
+				p.IdempotencyKey = key
+			}
+			body, err := json.Marshal(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest("POST", "/prepegin", bytes.NewReader(body)).WithContext(ctx)
+			if useHeader {
+				req.Header.Set(PegInKeyHeader, key)
+			}
+			w := httptest.NewRecorder()
+			c.DoPrePegIn(w, req)
+			return w
+		}
+		prePegIn := func(key string, useHeader bool, expMS int64) []byte {
+			w := send(key, useHeader, expMS)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d from pre-peg-in: %s", w.Code, w.Body.String())
+			}
+			return w.Body.Bytes()
+		}
+		countPegs := func() int {
+			var n int
+			err := db.QueryRow("SELECT COUNT(*) FROM pegs").Scan(&n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+
+		first := prePegIn("key1", true, expMS)
+		repeat := prePegIn("key1", false, expMS)
+		if !bytes.Equal(repeat, first) {
+			t.Errorf("repeated request got nonce hash %x, want original %x", repeat, first)
+		}
+		if n := countPegs(); n != 1 {
+			t.Errorf("got %d pegs after repeated request, want 1", n)
+		}
+
+		// A different request may not reuse the key.
+		if w := send("key1", true, expMS+1); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("got status %d from different request with the same key, want %d", w.Code, http.StatusUnprocessableEntity)
+		}
+		if n := countPegs(); n != 1 {
+			t.Errorf("got %d pegs after different request with the same key, want 1", n)
+		}
+
+		other := prePegIn("key2", true, expMS+1)
+		if bytes.Equal(other, first) {
+			t.Error("request with a different key got the same nonce hash")
+		}
+		if n := countPegs(); n != 2 {
+			t.Errorf("got %d pegs after request with a new key, want 2", n)
+		}
+
+		// Once the key window has passed, the key identifies a new request.
+		_, err = db.Exec("UPDATE pegin_keys SET created_ms=created_ms-$1 WHERE key='key1'", int64(2*time.Hour/time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expired := prePegIn("key1", true, expMS+2)
+		if bytes.Equal(expired, first) {
+			t.Error("request with an expired key got the original nonce hash")
+		}
+		if n := countPegs(); n != 3 {
+			t.Errorf("got %d pegs after request with an expired key, want 3", n)
+		}
+	}, PegInKeyWindow(time.Hour))
+}
+
+func TestPegInIdempotencyKeyPending(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		nonceHash, err := c.reservePegInKey(ctx, "key", []byte("request"))
+		if err != nil || nonceHash != nil {
+			t.Fatalf("got nonce hash %x and error %v reserving new key, want neither", nonceHash, err)
+		}
+		_, err = c.reservePegInKey(ctx, "key", []byte("request"))
+		if err != errPegInKeyPending {
+			t.Errorf("got error %v reserving key of request in progress, want %v", err, errPegInKeyPending)
+		}
+		_, err = c.reservePegInKey(ctx, "key", []byte("other request"))
+		if err != errPegInKeyReused {
+			t.Errorf("got error %v reserving key of request in progress for another request, want %v", err, errPegInKeyReused)
+		}
+
+		// A failed request releases its key for a retry.
+		c.releasePegInKey("key")
+		nonceHash, err = c.reservePegInKey(ctx, "key", []byte("request"))
+		if err != nil || nonceHash != nil {
+			t.Fatalf("got nonce hash %x and error %v reserving released key, want neither", nonceHash, err)
+		}
+	})
+}
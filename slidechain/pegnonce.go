@@ -0,0 +1,62 @@
+package slidechain
+
+import (
+	"context"
+	"crypto/rand"
+	"math/big"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+)
+
+// The expiration time of a nonce generated by the custodian
+// (see PrePegIn.GenerateNonce)
+// is pegInNonceTTL from the request
+// plus a random part of pegInNonceJitter,
+// which makes its nonce hash hard for other clients to predict.
+const (
+	pegInNonceTTL    = 10 * time.Minute
+	pegInNonceJitter = 10 * time.Minute
+
+	// pegInNonceAttempts bounds the expiration times tried
+	// before generating a nonce gives up.
+	pegInNonceAttempts = 8
+)
+
+// errNonceCollision is the root of the error returned
+// for a pre-peg-in whose nonce hash is already registered.
+var errNonceCollision = errors.New("nonce hash already registered")
+
+// pegInRegistered reports whether a peg with nonceHash,
+// pending or consumed, is recorded in the db.
+// Nonce hashes are unique across all custodians sharing the db,
+// as the primary key of the pegs table.
+func (c *Custodian) pegInRegistered(ctx context.Context, nonceHash []byte) (bool, error) {
+	var n int
+	err := c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM pegs WHERE nonce_hash=$1`, nonceHash).Scan(&n)
+	return n > 0, errors.Wrapf(err, "looking up peg with nonce hash %x", nonceHash)
+}
+
+// generatePegInNonce picks a random expiration time for a pre-peg-in nonce
+// whose nonce hash, under blockchain ID bcid, is not yet registered.
+func (c *Custodian) generatePegInNonce(ctx context.Context, bcid []byte) (int64, error) {
+	baseMS := int64(bc.Millis(time.Now().Add(pegInNonceTTL)))
+	jitter := big.NewInt(int64(pegInNonceJitter / time.Millisecond))
+	for attempt := 0; attempt < pegInNonceAttempts; attempt++ {
+		n, err := rand.Int(rand.Reader, jitter)
+		if err != nil {
+			return 0, errors.Wrap(err, "generating nonce")
+		}
+		expMS := baseMS + n.Int64()
+		nonceHash := uniqueNonceHash(bcid, expMS)
+		registered, err := c.pegInRegistered(ctx, nonceHash[:])
+		if err != nil {
+			return 0, err
+		}
+		if !registered {
+			return expMS, nil
+		}
+	}
+	return 0, errors.Wrapf(errNonceCollision, "generating nonce after %d attempts", pegInNonceAttempts)
+}
@@ -0,0 +1,131 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+)
+
+func TestPegInNonceCollision(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		c.S.blockInterval = 100 * time.Millisecond
+
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		prePegIn := func() *httptest.ResponseRecorder {
+			body, err := json.Marshal(PrePegIn{
+				BcID:        c.InitBlockHash.Bytes(),
+				Amount:      10,
+				AssetXDR:    lumenXDR,
+				RecipPubkey: testRecipPubKey,
+				ExpMS:       expMS,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c.DoPrePegIn(w, httptest.NewRequest("POST", "/prepegin", bytes.NewReader(body)).WithContext(ctx))
+			return w
+		}
+
+		if w := prePegIn(); w.Code != http.StatusOK {
+			t.Fatalf("got status %d from first pre-peg-in: %s", w.Code, w.Body.String())
+		}
+		// A second client choosing the same expiration time collides.
+		if w := prePegIn(); w.Code != http.StatusConflict {
+			t.Errorf("got status %d from colliding pre-peg-in, want %d", w.Code, http.StatusConflict)
+		}
+
+		// It still collides once the first peg is consumed.
+		_, err = db.Exec("UPDATE pegs SET zioncoin_tx=1, imported=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w := prePegIn(); w.Code != http.StatusConflict {
+			t.Errorf("got status %d from pre-peg-in colliding with consumed peg, want %d", w.Code, http.StatusConflict)
+		}
+		var n int
+		err = db.QueryRow("SELECT COUNT(*) FROM pegs").Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("got %d pegs, want 1", n)
+		}
+	})
+}
+
+func TestGeneratedPegInNonce(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		c.S.blockInterval = 100 * time.Millisecond
+
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		prePegIn := func(expMS int64) *httptest.ResponseRecorder {
+			body, err := json.Marshal(PrePegIn{
+				Amount:        10,
+				AssetXDR:      lumenXDR,
+				RecipPubkey:   testRecipPubKey,
+				ExpMS:         expMS,
+				GenerateNonce: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c.DoPrePegIn(w, httptest.NewRequest("POST", "/prepegin", bytes.NewReader(body)).WithContext(ctx))
+			return w
+		}
+
+		if w := prePegIn(1); w.Code != http.StatusBadRequest {
+			t.Errorf("got status %d from pre-peg-in generating a nonce with exp_ms set, want %d", w.Code, http.StatusBadRequest)
+		}
+
+		start := time.Now()
+		hashes := make(map[string]bool)
+		for i := 0; i < 2; i++ {
+			w := prePegIn(0)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d from pre-peg-in: %s", w.Code, w.Body.String())
+			}
+			nonceHash := w.Body.Bytes()
+			if hashes[string(nonceHash)] {
+				t.Fatalf("got repeated nonce hash %x", nonceHash)
+			}
+			hashes[string(nonceHash)] = true
+
+			var expMS int64
+			err = db.QueryRow("SELECT nonce_expms FROM pegs WHERE nonce_hash=$1", nonceHash).Scan(&expMS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS); !bytes.Equal(got[:], nonceHash) {
+				t.Errorf("got nonce hash %x for expiration %d, want %x", nonceHash, expMS, got[:])
+			}
+			earliest := int64(bc.Millis(start.Add(pegInNonceTTL)))
+			latest := int64(bc.Millis(time.Now().Add(pegInNonceTTL + pegInNonceJitter)))
+			if expMS < earliest || expMS > latest {
+				t.Errorf("got nonce expiration %d, want between %d and %d", expMS, earliest, latest)
+			}
+		}
+	})
+}
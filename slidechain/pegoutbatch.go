@@ -0,0 +1,58 @@
+package slidechain
+
+import (
+	b "github.com/zioncoin/go/build"
+	"github.com/zioncoin/go/xdr"
+)
+
+// maxTxOps is the most operations a Zioncoin tx may have.
+const maxTxOps = 100
+
+// MaxPegOutBatch sets the number of peg-out payments
+// the custodian may make from its own account in one Zioncoin tx
+// (by default, 1: one tx per payment), at most 100.
+// Batching saves fees and ledger capacity
+// for exporters making many small exports.
+// It applies to the payments of held dust (see FeePolicy.HoldDust)
+// and to the tranches after the first of split peg-outs (see FeePolicy.Split),
+// which all succeed or fail with their tx:
+// if it fails, the exports of its dust are failed and refunded on slidechain,
+// and its tranches are failed, pausing their schedules (see ResumeTranches).
+// Peg-outs paid by the preauthorized txs of their temp accounts
+// are submitted individually regardless,
+// since each tx has its temp account's sequence number.
+func MaxPegOutBatch(n int) Option {
+	return func(c *Custodian) {
+		c.maxPegOutBatch = n
+	}
+}
+
+// pegOutBatchSize is the number of payments
+// in each batched peg-out tx (see MaxPegOutBatch).
+func (c *Custodian) pegOutBatchSize() int {
+	if c.maxPegOutBatch < 1 {
+		return 1
+	}
+	if c.maxPegOutBatch > maxTxOps {
+		return maxTxOps
+	}
+	return c.maxPegOutBatch
+}
+
+// A batchPayment is a payment of a batched peg-out tx.
+type batchPayment struct {
+	destination string
+	asset       xdr.Asset
+	amount      int64
+}
+
+// buildBatchPegOutTx builds a tx from the custodian's account
+// making each of payments,
+// for submission with submitCustodianTx.
+func (c *Custodian) buildBatchPegOutTx(payments []batchPayment) (*b.TransactionBuilder, error) {
+	muts := make([]b.TransactionMutator, 0, len(payments))
+	for _, p := range payments {
+		muts = append(muts, buildPaymentOp(c.AccountID.Address(), p.destination, p.asset, p.amount))
+	}
+	return c.custodianTx(muts...)
+}
@@ -0,0 +1,97 @@
+package slidechain
+
+import (
+	"context"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	b "github.com/zioncoin/go/build"
+	"github.com/zioncoin/go/xdr"
+)
+
+// ProposedPegOut is a peg-out tx about to be submitted,
+// with the export it pays out as recorded in the custodian's db
+// (see PegOutValidator).
+type ProposedPegOut struct {
+	// ExportTxID identifies the export.
+	// Exporter, AssetXDR, Amount, and Recipients
+	// are as recorded from its reference data:
+	// Amount is the exported amount, before any fee.
+	ExportTxID []byte
+	Exporter   string
+	AssetXDR   []byte
+	Amount     int64
+	Recipients []Recipient
+
+	// Tx is the fully built peg-out tx, not yet signed,
+	// and Hash its hex-encoded hash.
+	Tx   xdr.Transaction
+	Hash string
+}
+
+// PegOutValidator causes the custodian to call validate
+// on each peg-out tx just before signing and submitting it,
+// for last-mile checks of the operator's,
+// such as that the tx has exactly the expected operations, destination, and amount,
+// a spending policy,
+// or a transaction-screening service.
+// If validate returns an error, the tx is not submitted,
+// and the export is held for review:
+// the error is recorded in the pegout_rejections table of the db,
+// and the export is counted as held in /stats.
+// Its temp account is untouched,
+// so an operator may release it for peg-out
+// by returning its row in the exports table to state 0.
+// Validate is called outside any db transaction.
+// By default peg-out txs are submitted unchecked.
+func PegOutValidator(validate func(ProposedPegOut) error) Option {
+	return func(c *Custodian) {
+		c.pegOutValidator = validate
+	}
+}
+
+// errPegOutRejected is the root of the error from validatePegOut
+// for a peg-out tx that the custodian's validator rejects.
+var errPegOutRejected = errors.New("peg-out tx rejected by validator")
+
+// validatePegOut checks peg-out tx tx, with hex-encoded hash hash,
+// of export txid with the custodian's validator, if any.
+// Failing to read the export rejects the tx too,
+// so it is held for review rather than submitted unchecked.
+func (c *Custodian) validatePegOut(ctx context.Context, txid []byte, tx *b.TransactionBuilder, hash string) error {
+	if c.pegOutValidator == nil {
+		return nil
+	}
+	var ref []byte
+	err := c.DB.QueryRowContext(ctx, `SELECT pegout_json FROM exports WHERE txid=$1`, txid).Scan(&ref)
+	if err != nil {
+		return errors.Wrapf(errPegOutRejected, "reading export %x: %s", txid, err)
+	}
+	var p pegOut
+	err = decodeRefdata(ref, &p)
+	if err != nil {
+		return errors.Wrapf(errPegOutRejected, "decoding reference data of export %x: %s", txid, err)
+	}
+	err = c.pegOutValidator(ProposedPegOut{
+		ExportTxID: txid,
+		Exporter:   p.Exporter,
+		AssetXDR:   p.AssetXDR,
+		Amount:     p.Amount,
+		Recipients: p.Recipients,
+		Tx:         *tx.TX,
+		Hash:       hash,
+	})
+	if err != nil {
+		return errors.Wrapf(errPegOutRejected, "%s", err)
+	}
+	return nil
+}
+
+// recordPegOutRejection records why the validator rejected
+// the peg-out tx of export txid.
+func (c *Custodian) recordPegOutRejection(ctx context.Context, txid []byte, reason string) error {
+	const q = `INSERT OR REPLACE INTO pegout_rejections (txid, reason, custodian_id, rejected_ms) VALUES ($1, $2, $3, $4)`
+	_, err := c.DB.ExecContext(ctx, q, txid, reason, c.label, int64(bc.Millis(time.Now())))
+	return errors.Wrapf(err, "recording rejection of peg-out of export %x", txid)
+}
@@ -0,0 +1,128 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/xdr"
+)
+
+func TestPegOutValidator(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// The validator checks that the tx pays only the recorded exporter.
+	var calls int
+	validate := func(p ProposedPegOut) error {
+		calls++
+		if p.Hash == "" {
+			return fmt.Errorf("no hash")
+		}
+		for _, op := range p.Tx.Operations {
+			if op.Body.PaymentOp == nil {
+				continue
+			}
+			if dest := op.Body.PaymentOp.Destination.Address(); dest != p.Exporter {
+				return fmt.Errorf("payment to %s, want exporter %s", dest, p.Exporter)
+			}
+		}
+		return nil
+	}
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		txid := []byte("txid")
+		tempAddr := insertTestExport(t, db, txid, lumenXDR, 50, exporter.Address())
+
+		for _, tt := range []struct {
+			dest    string
+			wantErr bool
+		}{
+			{exporter.Address(), false},
+			{other.Address(), true},
+		} {
+			tx, err := buildPegOutTx(c.AccountID.Address(), tt.dest, tt.dest, tempAddr, c.network, zioncoin.NativeAsset(), 50, nil, nil, 1, nil, baseFee, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hash, err := tx.HashHex()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.validatePegOut(ctx, txid, tx, hash)
+			if tt.wantErr {
+				if errors.Root(err) != errPegOutRejected {
+					t.Errorf("got error %v validating payment to %s, want rejection", err, tt.dest)
+				}
+			} else if err != nil {
+				t.Errorf("got error %s validating payment to exporter, want none", err)
+			}
+		}
+
+		// An unknown export is rejected without calling the validator.
+		calls = 0
+		tx, err := buildPegOutTx(c.AccountID.Address(), exporter.Address(), exporter.Address(), tempAddr, c.network, zioncoin.NativeAsset(), 50, nil, nil, 1, nil, baseFee, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.validatePegOut(ctx, []byte("unknown"), tx, "hash")
+		if errors.Root(err) != errPegOutRejected {
+			t.Errorf("got error %v validating peg-out of unknown export, want rejection", err)
+		}
+		if calls != 0 {
+			t.Errorf("validator called %d times for unknown export, want 0", calls)
+		}
+
+		// A rejected peg-out tx is not submitted, and its export is held.
+		counting := &fakeClient{ClientInterface: c.hclient}
+		c.hclient = counting
+		var otherID, tempID xdr.AccountId
+		err = otherID.SetAddress(other.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tempID.SetAddress(tempAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = c.pegOut(ctx, txid, otherID, other.Address(), zioncoin.NativeAsset(), 50, nil, nil, tempID, 1, nil, c.BaseFee)
+		if errors.Root(err) != errPegOutRejected {
+			t.Fatalf("got error %v pegging out to %s, want rejection", err, other.Address())
+		}
+		if len(counting.txs) != 0 {
+			t.Errorf("got %d txs submitted, want 0", len(counting.txs))
+		}
+		if state := pegOutFailureState(txid, err); state != pegOutHeld {
+			t.Errorf("got state %d after rejection, want %d", state, pegOutHeld)
+		}
+		err = c.recordPegOutRejection(ctx, txid, err.Error())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reason string
+		err = db.QueryRow("SELECT reason FROM pegout_rejections WHERE txid = $1", txid).Scan(&reason)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason == "" {
+			t.Error("got empty rejection reason")
+		}
+	}, PegOutValidator(validate))
+}
@@ -1,13 +1,26 @@
 package slidechain
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/bobg/sqlutil"
 	"github.com/chain/txvm/errors"
 	"github.com/chain/txvm/protocol/bc"
+	i10rnet "github.com/interzioncoin/starlight/net"
+)
+
+const (
+	// pinUnhealthyAfter is the number of consecutive failures
+	// after which a pin reports itself unhealthy.
+	pinUnhealthyAfter = 5
+
+	pinBackoffBase = 100 * time.Millisecond
+	pinBackoffMax  = 30 * time.Second
 )
 
 // RunPin runs as a goroutine.
@@ -16,77 +29,140 @@ import (
 // this invokes the callback for each block added to the chain.
 // Each successful callback call updates the pin's height in the database,
 // so that processing can resume where it left off after a restart.
+// Pins, like blocks, belong to the custodian (see Label):
+// custodians sharing a db may run pins of the same name.
 // In rare instances it is possible for the callback to be invoked twice on the same block,
 // so it should be idempotent.
-// If the callback returns an error,
-// the goroutine calls log.Fatal,
-// causing an exit.
-// TODO(bobg): permit caller-defined error handling.
+// If the callback or the pin store returns an error,
+// the operation is retried with backoff.
+// After repeated failures the pin is reported unhealthy
+// (see Custodian.Health)
+// until it next succeeds.
+//
+// The pin also records the hash of each block it processes.
+// If blocks it processed are later replaced in the chain
+// (a reorg, detected at startup and whenever a block arrives out of sequence),
+// the pin rewinds to the last block it shares with the chain
+// and invokes the callback again on the blocks after that.
 func (c *Custodian) RunPin(ctx context.Context, name string, f func(context.Context, *bc.Block) error) {
+	c.runPin(ctx, name, f, nil)
+}
+
+// runPin is RunPin,
+// calling rewind, if not nil, with the height of the last block the pin shares with the chain
+// before it rewinds to that height.
+// Like the callback, rewind is retried until it succeeds.
+func (c *Custodian) runPin(ctx context.Context, name string, f func(context.Context, *bc.Block) error, rewind func(context.Context, uint64) error) {
 	defer log.Printf("RunPin(%s) exiting", name)
 
 	r := c.S.w.Reader()
 
-	_, err := c.DB.ExecContext(ctx, `INSERT OR IGNORE INTO pins (name, height) VALUES ($1, 0)`, name)
-	if ctx.Err() != nil {
-		return
-	}
-	if err != nil {
-		log.Fatalf("creating pin %s: %s", name, err)
-	}
-
-	var lastHeight uint64
-	err = c.DB.QueryRowContext(ctx, `SELECT height FROM pins WHERE name = $1`, name).Scan(&lastHeight)
-	if ctx.Err() != nil {
-		return
-	}
-	if err != nil {
-		log.Fatalf("getting height of pin %s: %s", name, err)
-	}
-
-	// Start processing after lastHeight.
-
-	var blocks []*bc.Block
-	err = sqlutil.ForQueryRows(ctx, c.DB, `SELECT bits, height FROM blocks WHERE height > $1 ORDER BY height`, lastHeight, func(bits []byte, height uint64) error {
-		var block bc.Block
-		err = block.FromBytes(bits)
+	var (
+		lastHeight uint64
+		lastHash   []byte // nil if not recorded
+	)
+	err := c.retryPin(ctx, name, func() error {
+		_, err := c.DB.ExecContext(ctx, `INSERT OR IGNORE INTO pins (custodian_id, name, height) VALUES ($1, $2, 0)`, c.label, name)
 		if err != nil {
-			return errors.Wrapf(err, "unmarshaling block %d", height)
+			return errors.Wrapf(err, "creating pin %s", name)
 		}
-		blocks = append(blocks, &block)
-		return nil
+		err = c.DB.QueryRowContext(ctx, `SELECT height FROM pins WHERE custodian_id = $1 AND name = $2`, c.label, name).Scan(&lastHeight)
+		if err != nil {
+			return errors.Wrapf(err, "getting height of pin %s", name)
+		}
+		lastHash, err = c.pinHash(ctx, name, lastHeight)
+		return err
 	})
-	if ctx.Err() != nil {
-		return
-	}
 	if err != nil {
-		log.Fatalf("processing backlog for pin %s: %s", name, err)
+		return
 	}
 
 	processBlock := func(block *bc.Block) error {
 		if block.Height != lastHeight+1 {
-			return fmt.Errorf("missing block %d", lastHeight+1)
+			log.Fatalf("missing block %d", lastHeight+1)
 		}
-		err = f(ctx, block)
-		if err != nil {
-			return errors.Wrapf(err, "running pin %s on block %d", name, block.Height)
-		}
-		_, err = c.DB.Exec(`UPDATE pins SET height = $1 WHERE name = $2`, block.Height, name) // n.b. not ExecContext
+		hash := block.Hash().Bytes()
+		err := c.retryPin(ctx, name, func() error {
+			err := f(ctx, block)
+			if err != nil {
+				return errors.Wrapf(err, "running pin %s on block %d", name, block.Height)
+			}
+			return c.advancePin(name, block.Height, hash)
+		})
 		if err != nil {
-			return errors.Wrapf(err, "updating pin %s after block %d", name, block.Height)
+			return err
 		}
-		lastHeight = block.Height
+		lastHeight, lastHash = block.Height, hash
 		return nil
 	}
 
-	for _, block := range blocks {
-		err = processBlock(block)
-		if ctx.Err() != nil {
-			return
+	// catchUp rewinds the pin if the chain has replaced blocks it processed,
+	// then processes the blocks in the db after lastHeight.
+	catchUp := func() error {
+		var fork uint64
+		err := c.retryPin(ctx, name, func() error {
+			var err error
+			fork, err = c.pinFork(ctx, name, lastHeight)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if fork < lastHeight {
+			log.Printf("pin %s: blocks after %d replaced in the chain, rewinding from block %d", name, fork, lastHeight)
+			err = c.retryPin(ctx, name, func() error {
+				if rewind != nil {
+					err := rewind(ctx, fork)
+					if err != nil {
+						return errors.Wrapf(err, "rewinding pin %s to block %d", name, fork)
+					}
+				}
+				return c.rewindPin(ctx, name, fork)
+			})
+			if err != nil {
+				return err
+			}
+			lastHeight = fork
+			lastHash = nil
+			err = c.retryPin(ctx, name, func() error {
+				var err error
+				lastHash, err = c.pinHash(ctx, name, lastHeight)
+				return err
+			})
+			if err != nil {
+				return err
+			}
 		}
+
+		var blocks []*bc.Block
+		err = c.retryPin(ctx, name, func() error {
+			blocks = nil
+			return sqlutil.ForQueryRows(ctx, c.DB, `SELECT bits, height FROM blocks WHERE custodian_id = $1 AND height > $2 ORDER BY height`, c.label, lastHeight, func(bits []byte, height uint64) error {
+				var block bc.Block
+				err := block.FromBytes(bits)
+				if err != nil {
+					return errors.Wrapf(err, "unmarshaling block %d", height)
+				}
+				blocks = append(blocks, &block)
+				return nil
+			})
+		})
 		if err != nil {
-			log.Fatalf("processing backlog block %d: %s", block.Height, err)
+			return err
+		}
+		for _, block := range blocks {
+			err = processBlock(block)
+			if err != nil {
+				return err
+			}
 		}
+		return nil
+	}
+
+	// Start processing after lastHeight.
+	err = catchUp()
+	if err != nil {
+		return
 	}
 
 	for {
@@ -98,15 +174,127 @@ func (c *Custodian) RunPin(ctx context.Context, name string, f func(context.Cont
 			log.Fatalf("error waiting for block %d", lastHeight+1)
 		}
 		block := x.(*bc.Block)
-		if block.Height <= lastHeight {
+		outOfSequence := block.Height <= lastHeight ||
+			(lastHash != nil && block.PreviousBlockId != nil && !bytes.Equal(block.PreviousBlockId.Bytes(), lastHash))
+		if outOfSequence {
+			// Usually a block already processed,
+			// but possibly one replacing it:
+			// the db, which has the block, tells which.
+			err = catchUp()
+			if err != nil {
+				return
+			}
 			continue
 		}
 		err = processBlock(block)
-		if ctx.Err() != nil {
+		if err != nil {
 			return
 		}
-		if err != nil {
-			log.Fatalf("processing live block %d: %s", block.Height, err)
+	}
+}
+
+// pinHash returns the hash of the block at height processed by pin name,
+// or nil if it is not recorded.
+func (c *Custodian) pinHash(ctx context.Context, name string, height uint64) ([]byte, error) {
+	var hash []byte
+	err := c.DB.QueryRowContext(ctx, `SELECT hash FROM pin_hashes WHERE custodian_id = $1 AND name = $2 AND height = $3`, c.label, name, height).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return hash, errors.Wrapf(err, "getting hash of block %d for pin %s", height, name)
+}
+
+// advancePin records that pin name has processed the block at height with the given hash.
+func (c *Custodian) advancePin(name string, height uint64, hash []byte) error {
+	// n.b. not BeginTx: a processed block is recorded even if the pin is canceled.
+	dbtx, err := c.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	_, err = dbtx.Exec(`UPDATE pins SET height = $1 WHERE custodian_id = $2 AND name = $3`, height, c.label, name)
+	if err != nil {
+		return errors.Wrapf(err, "updating pin %s after block %d", name, height)
+	}
+	_, err = dbtx.Exec(`INSERT OR REPLACE INTO pin_hashes (custodian_id, name, height, hash) VALUES ($1, $2, $3, $4)`, c.label, name, height, hash)
+	if err != nil {
+		return errors.Wrapf(err, "recording hash of block %d for pin %s", height, name)
+	}
+	return errors.Wrapf(dbtx.Commit(), "updating pin %s after block %d", name, height)
+}
+
+// pinFork returns the height of the last block, up to height,
+// that pin name processed and that is still in the chain:
+// one less than the lowest height at which the recorded hash differs from the chain's block,
+// or height if none does.
+// Blocks processed before hashes were recorded are assumed to be in the chain.
+func (c *Custodian) pinFork(ctx context.Context, name string, height uint64) (uint64, error) {
+	const q = `
+		SELECT MIN(p.height) FROM pin_hashes p LEFT JOIN blocks b ON b.custodian_id = p.custodian_id AND b.height = p.height
+		WHERE p.custodian_id = $1 AND p.name = $2 AND p.height <= $3 AND (b.hash IS NULL OR b.hash != p.hash)
+	`
+	var replaced sql.NullInt64
+	err := c.DB.QueryRowContext(ctx, q, c.label, name, height).Scan(&replaced)
+	if err != nil {
+		return 0, errors.Wrapf(err, "comparing blocks of pin %s with the chain", name)
+	}
+	if !replaced.Valid {
+		return height, nil
+	}
+	return uint64(replaced.Int64) - 1, nil
+}
+
+// rewindPin moves pin name back to height,
+// forgetting the hashes of the blocks it processed after that.
+func (c *Custodian) rewindPin(ctx context.Context, name string, height uint64) error {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	_, err = dbtx.ExecContext(ctx, `DELETE FROM pin_hashes WHERE custodian_id = $1 AND name = $2 AND height > $3`, c.label, name, height)
+	if err != nil {
+		return errors.Wrapf(err, "forgetting blocks of pin %s after %d", name, height)
+	}
+	_, err = dbtx.ExecContext(ctx, `UPDATE pins SET height = $1 WHERE custodian_id = $2 AND name = $3`, height, c.label, name)
+	if err != nil {
+		return errors.Wrapf(err, "rewinding pin %s to block %d", name, height)
+	}
+	return errors.Wrapf(dbtx.Commit(), "rewinding pin %s to block %d", name, height)
+}
+
+// retryPin calls fn until it succeeds or ctx is canceled,
+// backing off between attempts.
+// It returns a non-nil error only when ctx is canceled.
+// Once fn has failed pinUnhealthyAfter times in a row,
+// the pin is reported unhealthy until fn succeeds.
+func (c *Custodian) retryPin(ctx context.Context, name string, fn func() error) error {
+	component := fmt.Sprintf("pin %s", name)
+	backoff := i10rnet.Backoff{Base: pinBackoffBase}
+	for failures := 0; ; {
+		err := fn()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			c.health.setHealthy(component)
+			return nil
+		}
+		failures++
+		log.Printf("%s failed (attempt %d), retrying: %s", component, failures, err)
+		if failures >= pinUnhealthyAfter {
+			c.health.setUnhealthy(component, err)
+		}
+		dur := backoff.Next()
+		if dur > pinBackoffMax {
+			dur = pinBackoffMax
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(dur):
 		}
 	}
 }
@@ -1,8 +1,10 @@
 package slidechain
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"testing"
@@ -200,3 +202,199 @@ func TestPins(t *testing.T) {
 		}
 	})
 }
+
+func TestPinStoreRecovery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, _ *httptest.Server, chain *protocol.Chain) {
+		c := &Custodian{
+			S:  s,
+			DB: db,
+		}
+
+		_, err := db.Exec(`CREATE TRIGGER fail_pins BEFORE UPDATE ON pins BEGIN SELECT RAISE(FAIL, 'injected pin store failure'); END`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pinch := make(chan uint64, 100)
+		go c.RunPin(ctx, "pin", func(_ context.Context, block *bc.Block) error {
+			pinch <- block.Height
+			return nil
+		})
+
+		waitFor := func(desc string, cond func() bool) {
+			for !cond() {
+				select {
+				case <-ctx.Done():
+					t.Fatalf("timed out waiting for %s", desc)
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+		}
+		pinHeight := func() uint64 {
+			var height uint64
+			err := db.QueryRow(`SELECT height FROM pins WHERE name = 'pin'`).Scan(&height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return height
+		}
+		healthy := func() bool {
+			w := httptest.NewRecorder()
+			c.Health(w, httptest.NewRequest("GET", "/health", nil))
+			return w.Code == http.StatusOK
+		}
+
+		waitFor("pin to report unhealthy", func() bool { return !healthy() })
+		if h := pinHeight(); h != 0 {
+			t.Fatalf("got pin height %d while pin store is failing, want 0", h)
+		}
+
+		_, err = db.Exec(`DROP TRIGGER fail_pins`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFor("pin to recover", func() bool { return pinHeight() == 1 && healthy() })
+
+		blockTime := time.Now().Add(time.Millisecond)
+		time.Sleep(time.Until(blockTime))
+		bb := protocol.NewBlockBuilder()
+		err = bb.Start(chain.State(), bc.Millis(blockTime))
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, snap, err := bb.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.commitBlock(ctx, &bc.Block{UnsignedBlock: u}, snap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFor("pin to process block 2", func() bool { return pinHeight() == 2 })
+
+		// Block 1 may have been seen more than once, but never out of order.
+		var last uint64
+		for len(pinch) > 0 {
+			height := <-pinch
+			if height < last {
+				t.Errorf("saw block %d after block %d", height, last)
+			}
+			last = height
+		}
+		if last != 2 {
+			t.Errorf("last block seen was %d, want 2", last)
+		}
+	})
+}
+
+func TestPinReorg(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	withTestServer(ctx, t, func(ctx context.Context, db *sql.DB, s *submitter, _ *httptest.Server, chain *protocol.Chain) {
+		c := &Custodian{
+			S:  s,
+			DB: db,
+		}
+
+		pinch := make(chan uint64, 100)
+		rewinds := make(chan uint64, 100)
+		runPin := func(ctx context.Context) {
+			c.runPin(ctx, "pin", func(_ context.Context, block *bc.Block) error {
+				pinch <- block.Height
+				return nil
+			}, func(_ context.Context, fork uint64) error {
+				rewinds <- fork
+				return nil
+			})
+		}
+		expect := func(ch <-chan uint64, desc string, want uint64) {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for %s %d", desc, want)
+			case got := <-ch:
+				if got != want {
+					t.Fatalf("got %s %d, want %d", desc, got, want)
+				}
+			}
+		}
+		// replaceBlock2 makes the block 2 the pin processed
+		// differ from the chain's, as if the chain had replaced it.
+		replaceBlock2 := func() {
+			_, err := db.Exec(`UPDATE pin_hashes SET hash = x'00' WHERE name = 'pin' AND height = 2`)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		pinctx, pincancel := context.WithCancel(ctx)
+		pindone := make(chan struct{})
+		go func() {
+			runPin(pinctx)
+			close(pindone)
+		}()
+		expect(pinch, "block", 1)
+
+		blockTime := time.Now().Add(time.Millisecond)
+		time.Sleep(time.Until(blockTime))
+		bb := protocol.NewBlockBuilder()
+		err := bb.Start(chain.State(), bc.Millis(blockTime))
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, snap, err := bb.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		block2 := &bc.Block{UnsignedBlock: u}
+		err = s.commitBlock(ctx, block2, snap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect(pinch, "block", 2)
+		pincancel()
+		<-pindone
+
+		// At startup.
+		replaceBlock2()
+		go runPin(ctx)
+		expect(rewinds, "rewind to block", 1)
+		expect(pinch, "replayed block", 2)
+
+		// On a block arriving out of sequence.
+		for {
+			hash, err := c.pinHash(ctx, "pin", 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(hash, block2.Hash().Bytes()) {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for the pin to record replayed block 2")
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		replaceBlock2()
+		s.w.Write(block2)
+		expect(rewinds, "rewind to block", 1)
+		expect(pinch, "replayed block", 2)
+
+		fork, err := c.pinFork(ctx, "pin", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fork != 2 {
+			t.Errorf("got pin fork %d after replay, want 2", fork)
+		}
+		select {
+		case fork := <-rewinds:
+			t.Errorf("got unexpected rewind to block %d", fork)
+		default:
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+)
+
+// ProposedExport describes an export observed on txvm,
+// before it is recorded for peg-out (see ExportPolicy).
+type ProposedExport struct {
+	TxID     []byte
+	Exporter string
+	AssetXDR []byte
+	Amount   int64
+
+	// TempAddr is the export's temp account,
+	// and Owner the account that funded it,
+	// if not Exporter.
+	TempAddr string
+	Owner    string
+
+	// Metadata is the JSON supplied by the exporter, if any.
+	Metadata json.RawMessage
+}
+
+// ExportPolicy causes the custodian to check each export it observes
+// with policy before recording it,
+// enforcing rules of the operator's, such as caps per asset,
+// denied destinations, or amount limits.
+// An export for which policy returns an error
+// is recorded with the error in the policy_rejected table of the db
+// instead of the exports table,
+// and is not pegged out;
+// its funds stay in the export contract on txvm for the operator to resolve.
+// Policy is called outside any db transaction,
+// once for each export tx,
+// or again if its block is processed again.
+// By default every export is recorded.
+func ExportPolicy(policy func(ProposedExport) error) Option {
+	return func(c *Custodian) {
+		c.exportPolicy = policy
+	}
+}
+
+// checkExportPolicy checks export tx txid, with reference data ref,
+// against the custodian's export policy, if any,
+// recording it as rejected if the policy rejects it.
+// It reports whether the export may be recorded.
+// It returns an error only when recording the rejection fails.
+func (c *Custodian) checkExportPolicy(ctx context.Context, txid, ref []byte, info pegOut) (bool, error) {
+	if c.exportPolicy == nil {
+		return true, nil
+	}
+	policyErr := c.exportPolicy(ProposedExport{
+		TxID:     txid,
+		Exporter: info.Exporter,
+		AssetXDR: info.AssetXDR,
+		Amount:   info.Amount,
+		TempAddr: info.TempAddr,
+		Owner:    info.Owner,
+		Metadata: info.Metadata,
+	})
+	if policyErr == nil {
+		return true, nil
+	}
+	reason := policyErr.Error()
+	rejected, err := c.recordPolicyRejection(ctx, txid, ref, info, reason)
+	if err != nil {
+		return false, err
+	}
+	if !rejected {
+		// The export was recorded before its block was processed again.
+		return true, nil
+	}
+	log.Printf("export tx %x rejected by policy: %s", txid, reason)
+	return false, nil
+}
+
+// recordPolicyRejection records export tx txid, with reference data ref,
+// as rejected by the export policy for the given reason,
+// and logs an event for it in the same db transaction.
+// It reports whether it did:
+// an export already recorded for peg-out is not rejected.
+func (c *Custodian) recordPolicyRejection(ctx context.Context, txid, ref []byte, info pegOut, reason string) (bool, error) {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	const q = `INSERT OR IGNORE INTO policy_rejected (txid, pegout_json, reason, custodian_id, rejected_ms) SELECT $1, $2, $3, $4, $5 WHERE NOT EXISTS (SELECT 1 FROM exports WHERE txid=$1)`
+	result, err := dbtx.ExecContext(ctx, q, txid, ref, reason, c.label, int64(bc.Millis(time.Now())))
+	if err != nil {
+		return false, errors.Wrapf(err, "recording policy rejection of export tx %x", txid)
+	}
+	numAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "checking rows affected by recording policy rejection of export tx %x", txid)
+	}
+	if numAffected == 0 {
+		var n int
+		err = dbtx.QueryRowContext(ctx, `SELECT COUNT(*) FROM policy_rejected WHERE txid=$1`, txid).Scan(&n)
+		return n > 0, errors.Wrapf(err, "checking policy rejection of export tx %x", txid)
+	}
+	err = appendEvent(ctx, dbtx, Event{
+		Type:     EventExportRejected,
+		TxVMTxID: txid,
+		Account:  info.Exporter,
+		AssetXDR: info.AssetXDR,
+		Amount:   info.Amount,
+		Reason:   reason,
+	})
+	if err != nil {
+		return false, err
+	}
+	err = dbtx.Commit()
+	return err == nil, errors.Wrapf(err, "committing policy rejection of export tx %x", txid)
+}
@@ -0,0 +1,95 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+)
+
+func TestExportPolicy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	const limit = 1000
+	policy := func(e ProposedExport) error {
+		if e.Amount > limit {
+			return fmt.Errorf("amount %d exceeds limit %d", e.Amount, limit)
+		}
+		return nil
+	}
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases := []struct {
+			txid   string
+			amount int64
+			want   bool
+		}{
+			{"small", limit, true},
+			{"large", limit + 1, false},
+		}
+		for _, tt := range cases {
+			info := pegOut{AssetXDR: lumenXDR, Exporter: importTestAccountID, Amount: tt.amount}
+			ref, err := json.Marshal(info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, err := c.checkExportPolicy(ctx, []byte(tt.txid), ref, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.want {
+				t.Errorf("export %s of %d: got %v, want %v", tt.txid, tt.amount, ok, tt.want)
+			}
+		}
+
+		var reason string
+		err = db.QueryRow("SELECT reason FROM policy_rejected WHERE txid=$1", []byte("large")).Scan(&reason)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("amount %d exceeds limit %d", limit+1, limit); reason != want {
+			t.Errorf("got rejection reason %q, want %q", reason, want)
+		}
+		var n int
+		err = db.QueryRow("SELECT COUNT(*) FROM policy_rejected WHERE txid=$1", []byte("small")).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("got %d rejections of export within limit, want 0", n)
+		}
+		events, err := c.ReadEvents(ctx, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || events[0].Type != EventExportRejected || string(events[0].TxVMTxID) != "large" || events[0].Reason != reason {
+			t.Errorf("got events %+v, want one rejection of export large", events)
+		}
+
+		// A recorded export processed again is not rejected.
+		info := pegOut{AssetXDR: lumenXDR, Exporter: importTestAccountID, Amount: limit + 2}
+		ref, err := json.Marshal(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.recordExport(ctx, []byte("recorded"), ref, info, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := c.checkExportPolicy(ctx, []byte("recorded"), ref, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Error("recorded export rejected by policy")
+		}
+	}, ExportPolicy(policy))
+}
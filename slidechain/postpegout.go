@@ -1,31 +1,146 @@
 package slidechain
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log"
 	"math"
+	"time"
 
 	"github.com/chain/txvm/crypto/ed25519"
 	"github.com/chain/txvm/errors"
 	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/standard"
 	"github.com/chain/txvm/protocol/txvm"
 	"github.com/chain/txvm/protocol/txvm/op"
 	"github.com/chain/txvm/protocol/txvm/txvmutil"
 	"github.com/zioncoin/go/xdr"
 )
 
-func (c *Custodian) doPostPegOut(ctx context.Context, p pegOut) error {
+// burnRecord is logged by a post-peg-out tx that retires exported funds,
+// tying the retirement on slidechain to the peg-out on Zioncoin.
+type burnRecord struct {
+	ExportTxID  []byte `json:"export_txid"`
+	Exporter    []byte `json:"exporter"`
+	Recipient   string `json:"recipient"`
+	AssetXDR    []byte `json:"asset"`
+	Amount      int64  `json:"amount"`
+	TimestampMS int64  `json:"timestamp_ms"`
+}
+
+// doPostPegOut retires or refunds the funds of export p on slidechain,
+// according to p.State,
+// provided the export is still at p.Version.
+// Otherwise the export changed since it was read,
+// and it is left for watchPegOuts to re-read.
+func (c *Custodian) doPostPegOut(ctx context.Context, p pegOut) (err error) {
+	ctx, span := c.startSpan(ctx, "slidechain.postpegout", p.Trace)
+	defer func() { span.End(err) }()
+	span.SetAttribute("slidechain.export", hex.EncodeToString(p.TxID))
+
+	claimed, err := c.claimExport(ctx, p.TxID, p.Version)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		log.Printf("export %x changed concurrently, deferring post-peg-out", p.TxID)
+		return nil
+	}
+	tx, err := buildPostPegOutTx(p, c.privkey, time.Now())
+	if err != nil {
+		return err
+	}
+	r, err := c.S.submitTx(ctx, tx)
+	if err != nil {
+		return errors.Wrap(err, "submitting post-peg-out tx")
+	}
+	err = c.S.waitOnTx(ctx, tx.ID, r)
+	if err != nil {
+		return errors.Wrap(err, "waiting on post-peg-out tx to hit txvm")
+	}
+	return c.finishExport(ctx, p)
+}
+
+// finishExport deletes the row of an export whose post-peg-out tx has hit txvm,
+// logging an event recording whether its funds were retired or refunded.
+// If the peg-out succeeded and a webhook is configured,
+// it queues the webhook notification in the same db transaction.
+func (c *Custodian) finishExport(ctx context.Context, p pegOut) error {
+	// TODO(debnil): Implement a mechanism to recover in case of a crash before this.
+	// Currently, the txvm funds will be retired or refunded, but the db will not be updated.
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	var (
+		state      pegOutState
+		zioncoinTx string
+	)
+	err = dbtx.QueryRowContext(ctx, `SELECT pegged_out, zioncoin_tx FROM exports WHERE txid=$1`, p.TxID).Scan(&state, &zioncoinTx)
+	if err != nil {
+		return errors.Wrapf(err, "reading export for tx %x", p.TxID)
+	}
+	notify := state == pegOutOK && c.webhook != nil
+	if notify {
+		err = queuePegOutNotification(ctx, dbtx, p, zioncoinTx)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = dbtx.ExecContext(ctx, `DELETE FROM exports WHERE txid=$1`, p.TxID)
+	if err != nil {
+		return errors.Wrapf(err, "deleting export for tx %x", p.TxID)
+	}
+	_, err = dbtx.ExecContext(ctx, `DELETE FROM tranches WHERE export_txid=$1`, p.TxID)
+	if err != nil {
+		return errors.Wrapf(err, "deleting tranches of export for tx %x", p.TxID)
+	}
+	_, err = dbtx.ExecContext(ctx, `DELETE FROM offline_pegouts WHERE export_txid=$1`, p.TxID)
+	if err != nil {
+		return errors.Wrapf(err, "deleting peg-out bundle of export for tx %x", p.TxID)
+	}
+	err = appendEvent(ctx, dbtx, Event{
+		Type:       EventExportFinished,
+		TxVMTxID:   p.TxID,
+		ZioncoinTx: zioncoinTx,
+		Account:    p.Exporter,
+		AssetXDR:   p.AssetXDR,
+		Amount:     p.Amount,
+		State:      state,
+	})
+	if err != nil {
+		return err
+	}
+	err = dbtx.Commit()
+	if err != nil {
+		return errors.Wrapf(err, "committing deletion of export for tx %x", p.TxID)
+	}
+	if notify {
+		c.notifyWebhooks()
+	}
+	return nil
+}
+
+// buildPostPegOutTx builds the tx that calls the export contract
+// to retire the exported funds if peg-out succeeded
+// or refund them to the exporter if it did not.
+// A retirement also logs a burnRecord, timestamped with now.
+func buildPostPegOutTx(p pegOut, prv ed25519.PrivateKey, now time.Time) (*bc.Tx, error) {
 	var asset xdr.Asset
 	err := asset.UnmarshalBinary(p.AssetXDR)
 	if err != nil {
-		return errors.Wrap(err, "unmarshaling asset xdr")
+		return nil, errors.Wrap(err, "unmarshaling asset xdr")
 	}
 	assetID := bc.NewHash(txvm.AssetID(importIssuanceSeed[:], p.AssetXDR))
 
-	refdata, err := json.Marshal(p)
+	refdata, err := encodeRefdata(p, p.Format)
 	if err != nil {
-		return errors.Wrap(err, "marshaling reference data")
+		return nil, errors.Wrap(err, "marshaling reference data")
 	}
 
 	// The contract needs a non-zero selector to retire funds if the peg-out succeeded.
@@ -60,47 +175,136 @@ func (c *Custodian) doPostPegOut(ctx context.Context, p pegOut) error {
 	})
 	b.PushdataInt64(selector).Op(op.Put) // con stack: snapshot; arg stack: selector
 	b.Op(op.Input).Op(op.Call)           // arg stack: sigchecker, zeroval
-	b.Op(op.Get).Op(op.Finalize)         // arg stack: sigchecker
+	if selector != 0 {
+		burn, err := json.Marshal(burnRecord{
+			ExportTxID:  p.TxID,
+			Exporter:    p.Pubkey,
+			Recipient:   p.Exporter,
+			AssetXDR:    p.AssetXDR,
+			Amount:      p.Amount,
+			TimestampMS: int64(bc.Millis(now)),
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "marshaling burn record")
+		}
+		// The burn record is signed so that it cannot be forged by other retirements.
+		burnSig := ed25519.Sign(prv, burn)
+		b.Tuple(func(tup *txvmutil.TupleBuilder) {
+			tup.PushdataBytes(burn)
+			tup.PushdataBytes(burnSig)
+		}).Op(op.Log) // log: {'L', seed, {burn, sig}}
+	}
+	b.Op(op.Get).Op(op.Finalize) // arg stack: sigchecker
 
 	// Check signature.
 	prog1 := b.Build()
 	vm, err := txvm.Validate(prog1, 3, math.MaxInt64, txvm.StopAfterFinalize)
 	if err != nil {
-		return errors.Wrap(err, "computing transaction ID")
+		return nil, errors.Wrap(err, "computing transaction ID")
 	}
-	sig := ed25519.Sign(c.privkey, vm.TxID[:])
+	sig := ed25519.Sign(prv, vm.TxID[:])
 	b.Op(op.Get).PushdataBytes(sig).Op(op.Put) // con stack: sigchecker; arg stack: sig
 	b.Op(op.Call)
 
-	// Build, submit, and wait for the post-peg-out tx to hit txvm.
 	prog2 := b.Build()
 	var runlimit int64
 	tx, err := bc.NewTx(prog2, 3, math.MaxInt64, txvm.GetRunlimit(&runlimit))
 	if err != nil {
-		return errors.Wrap(err, "making post-peg-out tx")
+		return nil, errors.Wrap(err, "making post-peg-out tx")
 	}
 	tx.Runlimit = math.MaxInt64 - runlimit
-	r, err := c.S.submitTx(ctx, tx)
-	if err != nil {
-		return errors.Wrap(err, "submitting post-peg-out tx")
+	return tx, nil
+}
+
+// burnFromTx returns the burn record logged by tx
+// if it is a post-peg-out tx retiring exported funds,
+// and false otherwise.
+//
+// Expected log:
+//   {"I", ...}
+//   {"X", retireContractSeed, amount, assetID, anchor}
+//   {"L", retireContractSeed, pegout refdata}
+//   {"L", ..., {burn record, custodian signature}}
+//   {"F", ...}
+func burnFromTx(tx *bc.Tx) (*burnRecord, bool) {
+	if len(tx.Log) != 5 {
+		return nil, false
 	}
-	err = c.S.waitOnTx(ctx, tx.ID, r)
-	if err != nil {
-		return errors.Wrap(err, "waiting on post-peg-out tx to hit txvm")
+	if logItemCode(tx.Log[0]) != txvm.InputCode {
+		return nil, false
 	}
-	// Delete relevant row from exports table.
-	// TODO(debnil): Implement a mechanism to recover in case of a crash here.
-	// Currently, the txvm funds will be retired or refunded, but the db will not be updated.
-	result, err := c.DB.ExecContext(ctx, `DELETE FROM exports WHERE txid=$1`, p.TxID)
+	if logItemCode(tx.Log[1]) != txvm.RetireCode || len(tx.Log[1]) < 4 {
+		return nil, false
+	}
+	if seed, ok := tx.Log[1][1].(txvm.Bytes); !ok || !bytes.Equal(seed, standard.RetireContractSeed[:]) {
+		return nil, false
+	}
+	if logItemCode(tx.Log[3]) != txvm.LogCode || len(tx.Log[3]) < 3 {
+		return nil, false
+	}
+	signed, ok := tx.Log[3][2].(txvm.Tuple)
+	if !ok || len(signed) != 2 {
+		return nil, false
+	}
+	burnJSON, ok := signed[0].(txvm.Bytes)
+	if !ok {
+		return nil, false
+	}
+	sig, ok := signed[1].(txvm.Bytes)
+	if !ok || !ed25519.Verify(custodianPub, burnJSON, sig) {
+		return nil, false
+	}
+	var burn burnRecord
+	err := json.Unmarshal(burnJSON, &burn)
 	if err != nil {
-		return errors.Wrapf(err, "deleting export for tx %x", p.TxID)
+		return nil, false
+	}
+	// The burn record must agree with the value actually retired.
+	amount, ok := tx.Log[1][2].(txvm.Int)
+	if !ok || int64(amount) != burn.Amount {
+		return nil, false
 	}
-	numAffected, err := result.RowsAffected()
+	assetID, ok := tx.Log[1][3].(txvm.Bytes)
+	wantAssetID := txvm.AssetID(importIssuanceSeed[:], burn.AssetXDR)
+	if !ok || !bytes.Equal(assetID, wantAssetID[:]) {
+		return nil, false
+	}
+	return &burn, true
+}
+
+// checkRetirement cross-checks the value retired by tx,
+// a post-peg-out tx retiring exported funds (see burnFromTx),
+// against the export's peg-out refdata.
+// The standard retire contract logs the retired amount and asset ID
+// in its {"X", ...} entry,
+// followed by the refdata in its {"L", ...} entry.
+// It returns a description of the first mismatch found,
+// or "" if the retirement matches its refdata.
+func checkRetirement(tx *bc.Tx) string {
+	retire, ref := tx.Log[1], tx.Log[2]
+	if logItemCode(ref) != txvm.LogCode || len(ref) < 3 {
+		return "retirement logs no reference data"
+	}
+	if seed, ok := ref[1].(txvm.Bytes); !ok || !bytes.Equal(seed, standard.RetireContractSeed[:]) {
+		return "retirement reference data is not from the retire contract"
+	}
+	refdata, ok := ref[2].(txvm.Bytes)
+	if !ok {
+		return "retirement reference data is not a string"
+	}
+	var info pegOut
+	err := decodeRefdata(refdata, &info)
 	if err != nil {
-		return errors.Wrapf(err, "checking rows affected by exports delete query for txid %x", p.TxID)
+		return fmt.Sprintf("unmarshaling retirement reference data: %s", err)
 	}
-	if numAffected != 1 {
-		return fmt.Errorf("got %d rows affected by exports delete query, want 1", numAffected)
+	amount, _ := retire[2].(txvm.Int)
+	if int64(amount) != info.Amount {
+		return fmt.Sprintf("retired amount %d does not match peg-out amount %d", amount, info.Amount)
 	}
-	return nil
+	assetID, _ := retire[3].(txvm.Bytes)
+	wantAssetID := txvm.AssetID(importIssuanceSeed[:], info.AssetXDR)
+	if !bytes.Equal(assetID, wantAssetID[:]) {
+		return fmt.Sprintf("retired asset %x does not match peg-out asset %x (Zioncoin %x)", []byte(assetID), wantAssetID[:], info.AssetXDR)
+	}
+	return ""
 }
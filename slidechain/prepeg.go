@@ -24,6 +24,45 @@ type PrePegIn struct {
 	AssetXDR    []byte `json:"asset_xdr"`
 	RecipPubkey []byte `json:"recip_pubkey"`
 	ExpMS       int64  `json:"exp_ms"`
+
+	// IdempotencyKey, if set, identifies the request,
+	// so that a retry of it does not record a second peg-in.
+	// A retry must repeat the request's other fields exactly.
+	// It may instead be given in the PegInKeyHeader header.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// Metadata, if set, is JSON that travels with the peg:
+	// it is stored with the peg in the db
+	// and logged by the import tx as the refdata of the issued value.
+	// It may be at most MaxPegMetadata bytes.
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+
+	// GenerateNonce, if set, has the custodian pick the expiration time
+	// of the peg-in's nonce, which must then be left zero,
+	// so that its nonce hash is random
+	// rather than derived from a time chosen by the client.
+	// BcID defaults to the custodian's initial block ID.
+	GenerateNonce bool `json:"generate_nonce,omitempty"`
+}
+
+// MaxPegMetadata is the size limit, in bytes,
+// of the metadata of a peg-in or export.
+const MaxPegMetadata = 1024
+
+// checkPegMetadata returns an error if metadata
+// is not well-formed JSON of at most MaxPegMetadata bytes.
+// Empty metadata is allowed.
+func checkPegMetadata(metadata []byte) error {
+	if len(metadata) == 0 {
+		return nil
+	}
+	if len(metadata) > MaxPegMetadata {
+		return fmt.Errorf("metadata has %d bytes, limit is %d", len(metadata), MaxPegMetadata)
+	}
+	if !json.Valid(metadata) {
+		return errors.New("metadata is not valid JSON")
+	}
+	return nil
 }
 
 func buildPrePegInTx(bcid, assetXDR, recip []byte, amount, expMS int64) (*bc.Tx, error) {
@@ -55,7 +94,19 @@ func buildPrePegInTx(bcid, assetXDR, recip []byte, amount, expMS int64) (*bc.Tx,
 }
 
 // DoPrePegIn builds, submits, and waits on the pre-peg-in transaction to TxVM, and records a peg-in in the database.
+// It responds with the peg-in's nonce hash.
+// A request whose nonce hash is that of a peg-in already recorded,
+// pending or consumed, is rejected with 409 Conflict.
+// A request with the idempotency key of one that succeeded
+// within the key window (see PegInKeyWindow)
+// gets the nonce hash of the original peg-in instead,
+// unless its other fields differ from the original's,
+// in which case it is rejected with 422 Unprocessable Entity.
 func (c *Custodian) DoPrePegIn(w http.ResponseWriter, req *http.Request) {
+	if c.observer {
+		net.Errorf(w, http.StatusForbidden, "%s", errObserver)
+		return
+	}
 	data, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
@@ -68,43 +119,133 @@ func (c *Custodian) DoPrePegIn(w http.ResponseWriter, req *http.Request) {
 		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
 		return
 	}
+	err = checkPegMetadata(p.Metadata)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if p.GenerateNonce && p.ExpMS != 0 {
+		net.Errorf(w, http.StatusBadRequest, "exp_ms must be zero with generate_nonce")
+		return
+	}
+	ctx := req.Context()
+	key := req.Header.Get(PegInKeyHeader)
+	if key == "" {
+		key = p.IdempotencyKey
+	}
+	if key != "" {
+		reqHash, err := pegInRequestHash(p)
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+			return
+		}
+		nonceHash, err := c.reservePegInKey(ctx, key, reqHash)
+		if err == errPegInKeyPending {
+			net.Errorf(w, http.StatusConflict, "idempotency key %q: %s", key, err)
+			return
+		}
+		if err == errPegInKeyReused {
+			net.Errorf(w, http.StatusUnprocessableEntity, "idempotency key %q: %s", key, err)
+			return
+		}
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+			return
+		}
+		if nonceHash != nil {
+			log.Printf("repeated pre-peg-in request with idempotency key %q, nonce hash %x", key, nonceHash)
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, err = w.Write(nonceHash)
+			if err != nil {
+				net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+			}
+			return
+		}
+		if !c.prePegIn(ctx, w, p, key) {
+			c.releasePegInKey(key)
+		}
+		return
+	}
+	c.prePegIn(ctx, w, p, "")
+}
+
+// prePegIn does the work of DoPrePegIn for request p with idempotency key (if any).
+// It reports whether the peg-in was recorded.
+func (c *Custodian) prePegIn(ctx context.Context, w http.ResponseWriter, p PrePegIn, key string) bool {
+	if p.GenerateNonce {
+		if len(p.BcID) == 0 {
+			p.BcID = c.InitBlockHash.Bytes()
+		}
+		var err error
+		p.ExpMS, err = c.generatePegInNonce(ctx, c.InitBlockHash.Bytes())
+		if errors.Root(err) == errNonceCollision {
+			net.Errorf(w, http.StatusConflict, "%s", err)
+			return false
+		}
+		if err != nil {
+			net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+			return false
+		}
+	}
+	nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), p.ExpMS)
+	registered, err := c.pegInRegistered(ctx, nonceHash[:])
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+		return false
+	}
+	if registered {
+		net.Errorf(w, http.StatusConflict, "%x: %s", nonceHash[:], errNonceCollision)
+		return false
+	}
 	// Build pre-peg-in transaction.
 	tx, err := buildPrePegInTx(p.BcID, p.AssetXDR, p.RecipPubkey, p.Amount, p.ExpMS)
 	if err != nil {
 		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
-		return
+		return false
 	}
 	// Submit pre-peg-in transaction and wait on success.
-	ctx := req.Context()
 	r, err := c.S.submitTx(ctx, tx)
 	if err != nil {
 		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
-		return
+		return false
 	}
-	err = c.S.waitOnTx(ctx, tx.ID, r)
+	waitCtx, cancel := context.WithTimeout(ctx, prePegInWait)
+	err = c.S.waitOnTx(waitCtx, tx.ID, r)
+	cancel()
 	if err != nil {
 		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+		return false
 	}
 	// Record peg in database.
-	nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), p.ExpMS)
-	err = c.insertPegIn(ctx, nonceHash[:], p.RecipPubkey, p.ExpMS)
+	// The nonce hash is the primary key of the pegs table,
+	// so a concurrent request for the same nonce fails here.
+	if key != "" {
+		err = c.insertKeyedPegIn(ctx, key, nonceHash[:], p.RecipPubkey, p.ExpMS, p.Metadata)
+	} else {
+		err = c.insertPegIn(ctx, nonceHash[:], p.RecipPubkey, p.ExpMS, p.Metadata)
+	}
 	if err != nil {
+		if registered, rerr := c.pegInRegistered(ctx, nonceHash[:]); rerr == nil && registered {
+			net.Errorf(w, http.StatusConflict, "%x: %s", nonceHash[:], errNonceCollision)
+			return false
+		}
 		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
-		return
+		return false
 	}
 	log.Printf("recorded peg for tx with nonce hash %x in db", nonceHash[:])
 	w.Header().Set("Content-Type", "application/octet-stream")
 	_, err = w.Write(nonceHash[:])
 	if err != nil {
 		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
-		return
 	}
+	return true
 }
 
-func (c *Custodian) insertPegIn(ctx context.Context, nonceHash, recip []byte, expMS int64) error {
-	const q = `INSERT INTO pegs
-		(nonce_hash, recipient_pubkey, nonce_expms)
-		VALUES ($1, $2, $3)`
-	_, err := c.DB.ExecContext(ctx, q, nonceHash, recip, expMS)
+const insertPegInQ = `INSERT INTO pegs
+		(nonce_hash, recipient_pubkey, nonce_expms, custodian_id, metadata)
+		VALUES ($1, $2, $3, $4, $5)`
+
+func (c *Custodian) insertPegIn(ctx context.Context, nonceHash, recip []byte, expMS int64, metadata []byte) error {
+	_, err := c.DB.ExecContext(ctx, insertPegInQ, nonceHash, recip, expMS, c.label, string(metadata))
 	return errors.Wrap(err, "inserting peg in db")
 }
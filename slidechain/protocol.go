@@ -0,0 +1,153 @@
+package slidechain
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/zioncoin/go/amount"
+	"github.com/zioncoin/go/clients/equator"
+)
+
+// SupportedProtocolVersion is the highest Zioncoin protocol version
+// whose XDR and operation semantics the custodian understands.
+// On a network upgraded past it,
+// the custodian reports itself degraded,
+// halts peg-ins at any tx it cannot parse,
+// and refuses the features it cannot represent.
+const SupportedProtocolVersion = 10
+
+const protocolComponent = "zioncoin protocol"
+
+// errUnsupportedProtocol is the root of errors
+// from Zioncoin txs that the custodian cannot parse
+// because the network has upgraded past SupportedProtocolVersion.
+var errUnsupportedProtocol = errors.New("unsupported Zioncoin protocol")
+
+// protocolState records the Zioncoin network's protocol version,
+// as of the last check.
+type protocolState struct {
+	mu      sync.Mutex
+	version int32
+	checked time.Time
+}
+
+// ProtocolStatus describes the Zioncoin network's protocol version.
+type ProtocolStatus struct {
+	Version   int32     `json:"version"`
+	Supported int32     `json:"supported"`
+	Checked   time.Time `json:"checked"`
+}
+
+// protocolFeature is a feature of the Zioncoin network
+// enabled by a protocol upgrade.
+type protocolFeature struct {
+	name  string
+	since int32 // the protocol version enabling the feature
+}
+
+var (
+	// Since protocol 10, offers reserve their amounts as liabilities,
+	// which cannot be spent.
+	featureLiabilities = protocolFeature{"liabilities", 10}
+
+	// Since protocol 13, an account address may carry a multiplexing id
+	// (an "M" address), which this custodian's XDR cannot represent.
+	featureMuxedAccounts = protocolFeature{"muxed accounts", 13}
+)
+
+// observeProtocol records version as the network's protocol version,
+// marking the custodian degraded if it is newer than SupportedProtocolVersion.
+func (c *Custodian) observeProtocol(version int32) {
+	c.protocol.mu.Lock()
+	prev := c.protocol.version
+	c.protocol.version = version
+	c.protocol.checked = time.Now()
+	c.protocol.mu.Unlock()
+
+	if prev != 0 && prev != version {
+		log.Printf("Zioncoin network upgraded from protocol %d to %d", prev, version)
+	}
+	if version > SupportedProtocolVersion {
+		c.health.setUnhealthy(protocolComponent, fmt.Errorf("network protocol %d is newer than supported protocol %d", version, SupportedProtocolVersion))
+	} else {
+		c.health.setHealthy(protocolComponent)
+	}
+}
+
+// checkProtocol reads the network's protocol version from Horizon
+// and records it.
+func (c *Custodian) checkProtocol() (int32, error) {
+	root, err := c.hclient.Root()
+	if err != nil {
+		return 0, errors.Wrap(err, "getting equator root")
+	}
+	c.observeProtocol(root.ProtocolVersion)
+	return root.ProtocolVersion, nil
+}
+
+// networkProtocol returns the network's protocol version
+// as of the last check.
+func (c *Custodian) networkProtocol() int32 {
+	c.protocol.mu.Lock()
+	defer c.protocol.mu.Unlock()
+	return c.protocol.version
+}
+
+// protocolStatus returns the result of the last protocol check,
+// or nil if there has been none.
+func (c *Custodian) protocolStatus() *ProtocolStatus {
+	c.protocol.mu.Lock()
+	defer c.protocol.mu.Unlock()
+	if c.protocol.checked.IsZero() {
+		return nil
+	}
+	return &ProtocolStatus{
+		Version:   c.protocol.version,
+		Supported: SupportedProtocolVersion,
+		Checked:   c.protocol.checked,
+	}
+}
+
+// checkFeature returns an error if f is not yet enabled on the network,
+// or if the custodian does not support it.
+func (c *Custodian) checkFeature(f protocolFeature) error {
+	if f.since > SupportedProtocolVersion {
+		return fmt.Errorf("%s (protocol %d) are not supported by this custodian (protocol %d)", f.name, f.since, SupportedProtocolVersion)
+	}
+	if v := c.networkProtocol(); v < f.since {
+		return fmt.Errorf("%s are not enabled until protocol %d (network is at %d)", f.name, f.since, v)
+	}
+	return nil
+}
+
+// spendable returns the amount of balance that can be paid out,
+// net of its selling liabilities once the network has them.
+func (c *Custodian) spendable(balance equator.Balance) (int64, error) {
+	have, err := amount.ParseInt64(balance.Balance)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parsing balance %s", balance.Balance)
+	}
+	if c.checkFeature(featureLiabilities) != nil || balance.SellingLiabilities == "" {
+		return have, nil
+	}
+	selling, err := amount.ParseInt64(balance.SellingLiabilities)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parsing selling liabilities %s", balance.SellingLiabilities)
+	}
+	return have - selling, nil
+}
+
+// checkDestination returns a reason the custodian cannot pay addr,
+// or the empty string if it can.
+func (c *Custodian) checkDestination(addr string) string {
+	if strings.HasPrefix(addr, "M") {
+		if err := c.checkFeature(featureMuxedAccounts); err != nil {
+			return fmt.Sprintf("destination %s: %s", addr, err)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/clients/equator"
+)
+
+func TestProtocolUpgrade(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		// The Horizon root reports the given protocol version.
+		var version int32
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		hclient.root = func() (equator.Root, error) {
+			root, err := hclient.ClientInterface.Root()
+			root.ProtocolVersion = version
+			return root, err
+		}
+		c.hclient = hclient
+
+		var balance equator.Balance
+		balance.Balance = "0.0000100"
+		balance.SellingLiabilities = "0.0000030"
+
+		cases := []struct {
+			version       int32
+			wantSpendable int64
+			wantHealthy   bool
+		}{
+			// Before protocol 10, liabilities are not yet enabled.
+			{9, 100, true},
+			{10, 70, true},
+			{SupportedProtocolVersion + 1, 70, false},
+		}
+		for _, tc := range cases {
+			version = tc.version
+			_, err := c.checkProtocol()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status := c.protocolStatus(); status == nil || status.Version != tc.version {
+				t.Errorf("got protocol status %+v, want version %d", status, tc.version)
+			}
+			spendable, err := c.spendable(balance)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if spendable != tc.wantSpendable {
+				t.Errorf("protocol %d: got spendable balance %d, want %d", tc.version, spendable, tc.wantSpendable)
+			}
+			healthy := len(c.health.problems()) == 0
+			if healthy != tc.wantHealthy {
+				t.Errorf("protocol %d: got healthy %v, want %v (problems %v)", tc.version, healthy, tc.wantHealthy, c.health.problems())
+			}
+			// Muxed accounts are refused however far the network has upgraded.
+			if err := c.checkFeature(featureMuxedAccounts); err == nil {
+				t.Errorf("protocol %d: muxed accounts enabled", tc.version)
+			}
+		}
+
+		// Past the supported protocol, an unparseable tx halts peg-ins.
+		_, err := c.pegInPayments(equator.Transaction{ID: "upgraded", EnvelopeXdr: "AAAA"})
+		if errors.Root(err) != errUnsupportedProtocol {
+			t.Errorf("got error %v parsing tx under an unsupported protocol, want %v", err, errUnsupportedProtocol)
+		}
+
+		// An export to a muxed account fails.
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		const muxed = "MAAAAAAAAAAAAAB7BQ2L7E5NBWMXDUCMZSIPOBKRDSBYVLMXGSSKF6YNPIB7Y77ITLVL6"
+		txid := []byte("muxed")
+		insertTestExport(t, db, txid, lumenXDR, 1000, muxed)
+		pegouts := make(chan pegOut)
+		go c.pegOutFromExports(ctx, pegouts)
+		var p pegOut
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for peg-out")
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			case p = <-pegouts:
+				break wait
+			}
+		}
+		if p.State != pegOutFail {
+			t.Errorf("got export to muxed account in state %d, want %d", p.State, pegOutFail)
+		}
+		var reason string
+		err = db.QueryRow("SELECT reason FROM export_failures WHERE txid=$1", txid).Scan(&reason)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(reason, "muxed accounts") {
+			t.Errorf("got failure reason %q, want one mentioning muxed accounts", reason)
+		}
+	})
+}
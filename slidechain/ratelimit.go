@@ -0,0 +1,170 @@
+package slidechain
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zioncoin/go/clients/equator"
+)
+
+const (
+	// maxRateLimitRetries bounds the retries of a request
+	// that Horizon keeps rate limiting.
+	maxRateLimitRetries = 3
+
+	// maxRateLimitWait bounds the wait before retrying a rate-limited request.
+	// A longer wait requested by Horizon is not honored;
+	// the 429 response is returned instead,
+	// leaving the caller to back off.
+	maxRateLimitWait = time.Minute
+)
+
+// RateLimitStatus reports Horizon's rate limiting of the custodian,
+// as of the latest response carrying rate-limit headers.
+type RateLimitStatus struct {
+	// Limit is the number of requests allowed in each period,
+	// of which Remaining are left until the period resets,
+	// Reset seconds after Updated.
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     int       `json:"reset_seconds"`
+	Updated   time.Time `json:"updated"`
+
+	// Throttled counts the requests Horizon has rejected with status 429.
+	Throttled int64 `json:"throttled"`
+}
+
+// rateLimitedHTTP is the equator.HTTP of the custodian's Horizon client.
+// It records the rate-limit headers of each response,
+// and retries a request rejected with status 429 (Too Many Requests)
+// after waiting as long as Horizon's Retry-After header,
+// or failing that its X-Ratelimit-Reset header, asks.
+// Streams do not use it.
+type rateLimitedHTTP struct {
+	client equator.HTTP
+
+	mu     sync.Mutex
+	status RateLimitStatus
+	seen   bool
+}
+
+func (h *rateLimitedHTTP) Do(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.GetBody == nil {
+		// The request cannot be resent.
+		resp, err := h.client.Do(req)
+		if err == nil {
+			h.observe(resp)
+		}
+		return resp, err
+	}
+	return h.retry(func() (*http.Response, error) {
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		return h.client.Do(req)
+	})
+}
+
+func (h *rateLimitedHTTP) Get(url string) (*http.Response, error) {
+	return h.retry(func() (*http.Response, error) {
+		return h.client.Get(url)
+	})
+}
+
+func (h *rateLimitedHTTP) PostForm(url string, data url.Values) (*http.Response, error) {
+	return h.retry(func() (*http.Response, error) {
+		return h.client.PostForm(url, data)
+	})
+}
+
+// retry calls send until its response is not rate limited,
+// waiting between calls as Horizon asks,
+// at most maxRateLimitRetries times.
+func (h *rateLimitedHTTP) retry(send func() (*http.Response, error)) (*http.Response, error) {
+	for i := 0; ; i++ {
+		resp, err := send()
+		if err != nil {
+			return nil, err
+		}
+		wait, limited := h.observe(resp)
+		if !limited || i == maxRateLimitRetries || wait < 0 || wait > maxRateLimitWait {
+			return resp, nil
+		}
+		resp.Body.Close()
+		log.Printf("rate limited by equator, retrying in %s", wait)
+		time.Sleep(wait)
+	}
+}
+
+// observe records the rate-limit headers of resp.
+// If resp is rate limited,
+// it returns true and how long Horizon asks to wait before retrying,
+// or -1 if Horizon does not say.
+func (h *rateLimitedHTTP) observe(resp *http.Response) (time.Duration, bool) {
+	now := time.Now()
+	limited := resp.StatusCode == http.StatusTooManyRequests
+
+	h.mu.Lock()
+	if limit, err := strconv.Atoi(resp.Header.Get("X-Ratelimit-Limit")); err == nil {
+		h.status.Limit = limit
+		h.status.Remaining, _ = strconv.Atoi(resp.Header.Get("X-Ratelimit-Remaining"))
+		h.status.Reset, _ = strconv.Atoi(resp.Header.Get("X-Ratelimit-Reset"))
+		h.status.Updated = now
+		h.seen = true
+	}
+	if limited {
+		h.status.Throttled++
+		h.seen = true
+	}
+	h.mu.Unlock()
+
+	if !limited {
+		return 0, false
+	}
+	return retryAfter(resp.Header, now), true
+}
+
+// retryAfter returns how long, as of now, header asks a client to wait,
+// per its Retry-After field, in seconds or as an HTTP date,
+// or else its X-Ratelimit-Reset field, in seconds.
+// It returns -1 if header has neither.
+func retryAfter(header http.Header, now time.Time) time.Duration {
+	if v := header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			if d := t.Sub(now); d > 0 {
+				return d
+			}
+			return 0
+		}
+	}
+	if secs, err := strconv.Atoi(header.Get("X-Ratelimit-Reset")); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return -1
+}
+
+// rateLimitStatus returns the current RateLimitStatus,
+// or nil if Horizon has reported none.
+func (h *rateLimitedHTTP) rateLimitStatus() *RateLimitStatus {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.seen {
+		return nil
+	}
+	s := h.status
+	return &s
+}
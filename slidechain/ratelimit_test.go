@@ -0,0 +1,83 @@
+package slidechain
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zioncoin/go/clients/equator"
+)
+
+func TestRateLimitRetryAfter(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Ratelimit-Limit", "100")
+		w.Header().Set("X-Ratelimit-Reset", "30")
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("X-Ratelimit-Remaining", "0")
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("X-Ratelimit-Remaining", "99")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"network_passphrase": "test"}`))
+	}))
+	defer srv.Close()
+
+	h := &rateLimitedHTTP{client: new(http.Client)}
+	hclient := &equator.Client{URL: srv.URL, HTTP: h}
+	start := time.Now()
+	root, err := hclient.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if root.NetworkPassphrase != "test" {
+		t.Errorf("got network passphrase %q, want %q", root.NetworkPassphrase, "test")
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("got %d requests, want 2", n)
+	}
+	if elapsed < time.Second || elapsed > 5*time.Second {
+		t.Errorf("retried after %s, want about the 1s asked by Retry-After", elapsed)
+	}
+
+	status := h.rateLimitStatus()
+	if status == nil {
+		t.Fatal("got no rate-limit status")
+	}
+	if status.Limit != 100 || status.Remaining != 99 || status.Reset != 30 || status.Throttled != 1 {
+		t.Errorf("got rate-limit status %+v, want limit 100, remaining 99, reset 30, throttled 1", *status)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		retryAfter, reset string
+		want              time.Duration
+	}{
+		{"2", "", 2 * time.Second},
+		{"2", "30", 2 * time.Second},
+		{now.Add(5 * time.Second).Format(http.TimeFormat), "", 5 * time.Second},
+		{now.Add(-5 * time.Second).Format(http.TimeFormat), "", 0},
+		{"", "30", 30 * time.Second},
+		{"soon", "", -1},
+		{"", "", -1},
+	}
+	for _, tc := range cases {
+		header := make(http.Header)
+		if tc.retryAfter != "" {
+			header.Set("Retry-After", tc.retryAfter)
+		}
+		if tc.reset != "" {
+			header.Set("X-Ratelimit-Reset", tc.reset)
+		}
+		if got := retryAfter(header, now); got != tc.want {
+			t.Errorf("Retry-After %q, X-Ratelimit-Reset %q: got %s, want %s", tc.retryAfter, tc.reset, got, tc.want)
+		}
+	}
+}
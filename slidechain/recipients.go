@@ -0,0 +1,155 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/chain/txvm/errors"
+	b "github.com/zioncoin/go/build"
+	"github.com/zioncoin/go/strkey"
+	"github.com/zioncoin/go/xdr"
+)
+
+// Recipient is one of several Zioncoin accounts
+// among which an export's payout is divided
+// (see ExportOptions.Recipients).
+// Amount is in stroops.
+type Recipient struct {
+	Destination string `json:"destination"`
+	Amount      int64  `json:"amount"`
+}
+
+// maxTxOperations is the most operations a Zioncoin tx may have.
+const maxTxOperations = 100
+
+// MaxRecipients is the most recipients an export may have.
+// Their payments, with the other operations of a cosigned peg-out tx,
+// fit in one Zioncoin tx.
+const MaxRecipients = maxTxOperations - 3
+
+// recipientsTotal returns the total amount paid to recips,
+// or an error if they are not a valid list of recipients.
+func recipientsTotal(recips []Recipient) (int64, error) {
+	if len(recips) == 0 {
+		return 0, errors.New("no recipients")
+	}
+	if len(recips) > MaxRecipients {
+		return 0, fmt.Errorf("%d recipients, more than the limit of %d", len(recips), MaxRecipients)
+	}
+	var total int64
+	for _, r := range recips {
+		_, err := strkey.Decode(strkey.VersionByteAccountID, r.Destination)
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid recipient account %q", r.Destination)
+		}
+		if r.Amount <= 0 {
+			return 0, fmt.Errorf("recipient %s has non-positive amount %d", r.Destination, r.Amount)
+		}
+		if r.Amount > math.MaxInt64-total {
+			return 0, errors.New("recipient amounts overflow")
+		}
+		total += r.Amount
+	}
+	return total, nil
+}
+
+// payees returns the accounts paid by p's peg-out,
+// and how much each is paid,
+// when the peg-out pays amount:
+// p's recipients, if it has them,
+// otherwise the exporter alone.
+func (p pegOut) payees(amount int64) []Recipient {
+	if len(p.Recipients) > 0 {
+		return p.Recipients
+	}
+	return []Recipient{{Destination: p.Exporter, Amount: amount}}
+}
+
+// checkPegOutRecipients returns the reason the custodian refuses
+// to pay the payout of p, split into tranches under policy,
+// to p's recipients, if it has them and the custodian refuses.
+// Their amounts must add up to the payout,
+// which must be neither converted, held as dust,
+// nor split into tranches,
+// since the recipients' payments are all in the one peg-out tx.
+func checkPegOutRecipients(p pegOut, policy FeePolicy, tranches []int64) string {
+	if len(p.Recipients) == 0 {
+		return ""
+	}
+	if len(p.ConvertAssetXDR) > 0 {
+		return "conversion of a payout to several recipients"
+	}
+	if policy.isDust(p.Amount) {
+		return dustReason(p.Amount, policy)
+	}
+	if len(tranches) != 1 {
+		return fmt.Sprintf("payout to several recipients split into %d tranches", len(tranches))
+	}
+	total, err := recipientsTotal(p.Recipients)
+	if err != nil {
+		return err.Error()
+	}
+	if total != tranches[0] {
+		return fmt.Sprintf("recipient amounts add up to %d, not the payout of %d", total, tranches[0])
+	}
+	return ""
+}
+
+// checkDestinations is checkDestination
+// for each account paid by p's peg-out.
+func (c *Custodian) checkDestinations(p pegOut) string {
+	for _, r := range p.payees(0) {
+		if reason := c.checkDestination(r.Destination); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// checkPayeeTrustlines is checkExporterTrustline
+// for each account paid asset by p's peg-out.
+func (c *Custodian) checkPayeeTrustlines(p pegOut, asset xdr.Asset) (string, error) {
+	for _, r := range p.payees(0) {
+		reason, err := c.checkExporterTrustline(r.Destination, asset)
+		if err != nil || reason != "" {
+			return reason, err
+		}
+	}
+	return "", nil
+}
+
+// authorizeTrustlines is authorizeTrustline
+// for each of recips.
+func (c *Custodian) authorizeTrustlines(ctx context.Context, recips []Recipient, asset xdr.Asset) error {
+	for _, r := range recips {
+		var dest xdr.AccountId
+		err := dest.SetAddress(r.Destination)
+		if err != nil {
+			return errors.Wrapf(err, "setting recipient address to %s", r.Destination)
+		}
+		err = c.authorizeTrustline(ctx, dest, asset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildRecipientPaymentOps builds the payments of asset
+// from the custodian's account to each of recips,
+// which must be paid a total of amount.
+func buildRecipientPaymentOps(custodianAddr string, asset xdr.Asset, amount int64, recips []Recipient) ([]b.TransactionMutator, error) {
+	total, err := recipientsTotal(recips)
+	if err != nil {
+		return nil, err
+	}
+	if total != amount {
+		return nil, fmt.Errorf("recipient amounts add up to %d, not %d", total, amount)
+	}
+	var ops []b.TransactionMutator
+	for _, r := range recips {
+		ops = append(ops, buildPaymentOp(custodianAddr, r.Destination, asset, r.Amount))
+	}
+	return ops, nil
+}
@@ -0,0 +1,196 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/interzioncoin/starlight/worizon/xlm"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/network"
+	"github.com/zioncoin/go/strkey"
+	"github.com/zioncoin/go/xdr"
+)
+
+func TestMultiRecipientPegOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		c.hclient = hclient
+
+		_, exporterPrv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var seed [32]byte
+		copy(seed[:], exporterPrv)
+		exporter, err := keypair.FromRawSeed(seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The payout goes mostly to one account,
+		// with a fee to a collector.
+		payee, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		collector, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		asset := zioncoin.NativeAsset()
+		const amount = 50 * int64(xlm.Lumen)
+		recips := []Recipient{
+			{Destination: payee.Address(), Amount: amount - int64(xlm.Lumen)},
+			{Destination: collector.Address(), Amount: int64(xlm.Lumen)},
+		}
+
+		tempAddr, seqnum, err := SubmitPreExportTxWithOptions(hclient, exporter, c.AccountID.Address(), asset, amount, PreExportOptions{Recipients: recips})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var preauth string
+		for _, txe := range hclient.txs {
+			var env xdr.TransactionEnvelope
+			err = xdr.SafeUnmarshalBase64(txe, &env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, op := range env.Tx.Operations {
+				if op.Body.SetOptionsOp != nil && op.Body.SetOptionsOp.Signer != nil && op.Body.SetOptionsOp.Signer.Key.Type == xdr.SignerKeyTypeSignerKeyTypePreAuthTx {
+					preauth = op.Body.SetOptionsOp.Signer.Key.Address()
+				}
+			}
+		}
+
+		var anchor [32]byte
+		exportTx, _, err := BuildExportTxWithOptions(ctx, asset, amount, amount, tempAddr, anchor[:], exporterPrv, seqnum, ExportOptions{Recipients: recips})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := InspectExportTx(exportTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p pegOut
+		err = decodeRefdata(ref, &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p.Recipients) != 2 || p.Exporter != exporter.Address() {
+			t.Fatalf("got export by %s to %d recipients, want export by %s to 2", p.Exporter, len(p.Recipients), exporter.Address())
+		}
+		policy := c.feePolicy(asset)
+		payout, _, err := policy.Payout(p.Amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tranches := policy.Split(payout)
+		if reason := checkPegOutRecipients(p, policy, tranches); reason != "" {
+			t.Fatalf("custodian refuses peg-out to recipients: %s", reason)
+		}
+
+		var exporterID, tempID xdr.AccountId
+		err = exporterID.SetAddress(p.Exporter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tempID.SetAddress(p.TempAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hclient.txs = nil
+		_, _, err = c.pegOut(ctx, nil, exporterID, p.owner(), asset, tranches[0], nil, p.Recipients, tempID, xdr.SequenceNumber(p.Seqnum), nil, c.BaseFee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hclient.txs) != 1 {
+			t.Fatalf("got %d submitted txs, want 1", len(hclient.txs))
+		}
+		var env xdr.TransactionEnvelope
+		err = xdr.SafeUnmarshalBase64(hclient.txs[0], &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := network.HashTransaction(&env.Tx, c.network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := strkey.Encode(strkey.VersionByteHashTx, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != preauth {
+			t.Errorf("peg-out tx has hash %s, want temp account's preauth signer %s", got, preauth)
+		}
+		paid := make(map[string]int64)
+		for _, op := range env.Tx.Operations {
+			if op.Body.Type == xdr.OperationTypePayment {
+				paid[op.Body.PaymentOp.Destination.Address()] += int64(op.Body.PaymentOp.Amount)
+			}
+		}
+		if len(paid) != len(recips) {
+			t.Errorf("peg-out tx pays %d accounts, want %d", len(paid), len(recips))
+		}
+		for _, r := range recips {
+			if paid[r.Destination] != r.Amount {
+				t.Errorf("peg-out tx pays %s %d, want %d", r.Destination, paid[r.Destination], r.Amount)
+			}
+		}
+	})
+}
+
+func TestCheckPegOutRecipients(t *testing.T) {
+	a, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recips := []Recipient{{Destination: a.Address(), Amount: 70}, {Destination: b.Address(), Amount: 30}}
+	tooMany := make([]Recipient, MaxRecipients+1)
+	for i := range tooMany {
+		tooMany[i] = Recipient{Destination: a.Address(), Amount: 1}
+	}
+	cases := []struct {
+		name     string
+		p        pegOut
+		policy   FeePolicy
+		tranches []int64
+		wantOK   bool
+	}{
+		{"no recipients", pegOut{Amount: 100}, FeePolicy{}, []int64{100}, true},
+		{"exact", pegOut{Amount: 100, Recipients: recips}, FeePolicy{}, []int64{100}, true},
+		{"net of fee", pegOut{Amount: 110, Recipients: recips}, FeePolicy{Flat: 10}, []int64{100}, true},
+		{"short", pegOut{Amount: 110, Recipients: recips}, FeePolicy{}, []int64{110}, false},
+		{"tranches", pegOut{Amount: 100, Recipients: recips}, FeePolicy{MaxPerTx: 50}, []int64{50, 50}, false},
+		{"dust", pegOut{Amount: 100, Recipients: recips}, FeePolicy{DustThreshold: 200, HoldDust: true}, []int64{100}, false},
+		{"conversion", pegOut{Amount: 100, Recipients: recips, ConvertAssetXDR: []byte{0}, ConvertAmount: 1}, FeePolicy{}, []int64{100}, false},
+		{"too many", pegOut{Amount: int64(len(tooMany)), Recipients: tooMany}, FeePolicy{}, []int64{int64(len(tooMany))}, false},
+		{"bad destination", pegOut{Amount: 100, Recipients: []Recipient{{Destination: "nope", Amount: 100}}}, FeePolicy{}, []int64{100}, false},
+		{"zero amount", pegOut{Amount: 100, Recipients: []Recipient{{Destination: a.Address(), Amount: 100}, {Destination: b.Address()}}}, FeePolicy{}, []int64{100}, false},
+	}
+	for _, tc := range cases {
+		reason := checkPegOutRecipients(tc.p, tc.policy, tc.tranches)
+		if (reason == "") != tc.wantOK {
+			t.Errorf("%s: got reason %q, want ok %t", tc.name, reason, tc.wantOK)
+		}
+	}
+
+	// The peg-out tx of the most recipients stays within the operation limit.
+	most := tooMany[:MaxRecipients]
+	ops, err := pegOutTxOps(a.Address(), a.Address(), b.Address(), network.TestNetworkPassphrase, zioncoin.NativeAsset(), int64(len(most)), most, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ops > maxTxOperations {
+		t.Errorf("peg-out tx to %d recipients has %d operations, more than %d", len(most), ops, maxTxOperations)
+	}
+}
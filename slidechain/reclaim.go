@@ -0,0 +1,203 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+)
+
+// TempAccounts tracks the temp accounts of an exporter's pre-exports
+// in the temp_accounts table of DB, created if need be,
+// so that those never merged can be reclaimed (see Reclaim)
+// and counted against TempAccountLimiter.MaxOutstandingPerExporter.
+// A pre-export is tracked through PreExportOptions.TempAccounts;
+// one made without it is not,
+// and its temp account, if abandoned, must be canceled by hand.
+type TempAccounts struct {
+	DB *sql.DB
+
+	createTable sync.Once
+	createErr   error
+}
+
+// CancelPreExport is like the package-level CancelPreExport,
+// and also stops tracking the temp account.
+func (t *TempAccounts) CancelPreExport(hclient equator.ClientInterface, kp *keypair.Full, tempAddr string) error {
+	err := CancelPreExport(hclient, kp, tempAddr)
+	if err != nil {
+		return err
+	}
+	return t.forget(tempAddr)
+}
+
+// Reclaim cancels the pre-exports by kp
+// whose temp accounts, tracked in t,
+// were created more than ttl ago and still exist,
+// merging their lumens back to kp's account with CancelPreExport.
+// These are the temp accounts of exports never made,
+// or refunded on slidechain,
+// whose lumens would otherwise be stranded.
+// Temp accounts already merged by their peg-outs are forgotten,
+// including one merged after it is found to exist
+// but before its cancellation is applied.
+// A cancellation applied first makes the peg-out fail,
+// and the custodian refunds the export on slidechain (see CancelPreExport),
+// so ttl should be well beyond the time an export takes to peg out.
+// Reclaim returns the number of temp accounts reclaimed.
+// It tries every temp account before returning the first error.
+func (t *TempAccounts) Reclaim(ctx context.Context, hclient equator.ClientInterface, kp *keypair.Full, ttl time.Duration) (int, error) {
+	err := t.ensureTable()
+	if err != nil {
+		return 0, err
+	}
+	var addrs []string
+	const q = `SELECT address FROM temp_accounts WHERE exporter=$1 AND created_ms <= $2`
+	err = sqlutil.ForQueryRows(ctx, t.DB, q, kp.Address(), int64(bc.Millis(time.Now().Add(-ttl))), func(addr string) {
+		addrs = append(addrs, addr)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "reading temp accounts of exporter %s", kp.Address())
+	}
+	var (
+		reclaimed int
+		firstErr  error
+	)
+	for _, addr := range addrs {
+		if ctx.Err() != nil {
+			return reclaimed, ctx.Err()
+		}
+		ok, err := t.reclaim(hclient, kp, addr)
+		if ok {
+			reclaimed++
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return reclaimed, firstErr
+}
+
+// Watch calls Reclaim every interval
+// until ctx is done,
+// logging the temp accounts it reclaims and any errors.
+// It is meant to run as a goroutine of a long-lived exporter.
+func (t *TempAccounts) Watch(ctx context.Context, hclient equator.ClientInterface, kp *keypair.Full, ttl, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := t.Reclaim(ctx, hclient, kp, ttl)
+		if n > 0 {
+			log.Printf("reclaimed %d temp accounts of exporter %s", n, kp.Address())
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("reclaiming temp accounts of exporter %s: %s", kp.Address(), err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reclaim cancels the pre-export with temp account addr,
+// reporting whether it was canceled.
+// A temp account that no longer exists,
+// before or after the attempt,
+// was merged by its peg-out and is forgotten.
+func (t *TempAccounts) reclaim(hclient equator.ClientInterface, kp *keypair.Full, addr string) (bool, error) {
+	_, err := hclient.LoadAccount(addr)
+	if isNotFound(err) {
+		return false, t.forget(addr)
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "loading temp account %s", addr)
+	}
+	err = CancelPreExport(hclient, kp, addr)
+	if err != nil {
+		// The peg-out may have merged the account since it was loaded,
+		// failing the cancellation.
+		_, lerr := hclient.LoadAccount(addr)
+		if isNotFound(lerr) {
+			return false, t.forget(addr)
+		}
+		return false, errors.Wrapf(err, "reclaiming temp account %s", addr)
+	}
+	return true, t.forget(addr)
+}
+
+// record starts tracking the temp account addr of exporter.
+func (t *TempAccounts) record(addr, exporter string) error {
+	err := t.ensureTable()
+	if err != nil {
+		return err
+	}
+	const q = `INSERT INTO temp_accounts (address, exporter, created_ms) VALUES ($1, $2, $3)`
+	_, err = t.DB.Exec(q, addr, exporter, int64(bc.Millis(time.Now())))
+	return errors.Wrapf(err, "recording temp account %s", addr)
+}
+
+// forget stops tracking the temp account addr.
+func (t *TempAccounts) forget(addr string) error {
+	err := t.ensureTable()
+	if err != nil {
+		return err
+	}
+	_, err = t.DB.Exec(`DELETE FROM temp_accounts WHERE address=$1`, addr)
+	return errors.Wrapf(err, "forgetting temp account %s", addr)
+}
+
+// outstanding returns the number of temp accounts of exporter
+// tracked in t that still exist.
+// Temp accounts that no longer exist,
+// having been merged by their peg-outs or canceled,
+// are no longer outstanding and are forgotten.
+func (t *TempAccounts) outstanding(hclient equator.ClientInterface, exporter string) (int, error) {
+	err := t.ensureTable()
+	if err != nil {
+		return 0, err
+	}
+	var addrs []string
+	err = sqlutil.ForQueryRows(context.Background(), t.DB, `SELECT address FROM temp_accounts WHERE exporter=$1`, exporter, func(addr string) {
+		addrs = append(addrs, addr)
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "reading temp accounts of exporter %s", exporter)
+	}
+	var n int
+	for _, addr := range addrs {
+		_, err := hclient.LoadAccount(addr)
+		if isNotFound(err) {
+			err = t.forget(addr)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err != nil {
+			return 0, errors.Wrapf(err, "loading temp account %s", addr)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// ensureTable creates the temp_accounts table in t.DB
+// if it does not exist.
+func (t *TempAccounts) ensureTable() error {
+	if t.DB == nil {
+		return errors.New("TempAccounts requires DB")
+	}
+	t.createTable.Do(func() {
+		_, t.createErr = t.DB.Exec(tempAccountsSchema)
+	})
+	return errors.Wrap(t.createErr, "creating temp_accounts table")
+}
@@ -0,0 +1,133 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/mockequator"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/xdr"
+)
+
+func TestTempAccountsReclaim(t *testing.T) {
+	ctx := context.Background()
+	testdir, err := ioutil.TempDir("", "slidechaintest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testdir)
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s/tempdb", testdir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	custodian, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Submissions from the temp accounts in failing fail,
+	// after those in racing have been merged by their peg-outs.
+	var (
+		merged  = make(map[string]bool)
+		failing = make(map[string]bool)
+		racing  = make(map[string]bool)
+	)
+	mock := mockequator.New()
+	hclient := &fakeClient{ClientInterface: mock, loadAccount: loadTempAccounts(mock, exporter.Address(), merged)}
+	hclient.submitTransaction = func(txeBase64 string) (equator.TransactionSuccess, error) {
+		var env xdr.TransactionEnvelope
+		err := xdr.SafeUnmarshalBase64(txeBase64, &env)
+		if err != nil {
+			return equator.TransactionSuccess{}, err
+		}
+		source := env.Tx.SourceAccount.Address()
+		if racing[source] {
+			merged[source] = true
+		}
+		if failing[source] {
+			return equator.TransactionSuccess{}, fmt.Errorf("cancellation of %s failed", source)
+		}
+		return mock.SubmitTransaction(txeBase64)
+	}
+	// Temp accounts are tracked even without an outstanding limit.
+	tracked := &TempAccounts{DB: db}
+	var addrs []string
+	for i := 0; i < 4; i++ {
+		tempAddr, _, err := SubmitPreExportTxWithOptions(hclient, exporter, custodian.Address(), zioncoin.NativeAsset(), 100, PreExportOptions{TempAccounts: tracked})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, tempAddr)
+	}
+	abandoned, pegged, raced, stuck := addrs[0], addrs[1], addrs[2], addrs[3]
+	merged[pegged] = true
+	racing[raced] = true
+	failing[raced] = true
+	failing[stuck] = true
+
+	remaining := func() map[string]bool {
+		addrs := make(map[string]bool)
+		rows, err := db.Query("SELECT address FROM temp_accounts WHERE exporter=$1", exporter.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var addr string
+			err = rows.Scan(&addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addrs[addr] = true
+		}
+		if err = rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return addrs
+	}
+
+	// None is older than the ttl yet.
+	n, err := tracked.Reclaim(ctx, hclient, exporter, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 || len(remaining()) != 4 {
+		t.Fatalf("got %d reclaimed and %d remaining before the ttl, want 0 and 4", n, len(remaining()))
+	}
+
+	// The abandoned temp account is reclaimed,
+	// the ones merged by peg-outs, before or during the attempt, are forgotten,
+	// and the one whose cancellation fails is kept for another try.
+	n, err = tracked.Reclaim(ctx, hclient, exporter, 0)
+	if err == nil {
+		t.Error("got no error reclaiming a temp account whose cancellation fails")
+	}
+	if n != 1 {
+		t.Errorf("got %d temp accounts reclaimed, want 1", n)
+	}
+	got := remaining()
+	if len(got) != 1 || !got[stuck] {
+		t.Errorf("got temp accounts %v remaining, want only %s", got, stuck)
+	}
+	if got[abandoned] || got[pegged] || got[raced] {
+		t.Error("reclaimed or merged temp account still tracked")
+	}
+
+	// Reclaiming requires a db.
+	_, err = (&TempAccounts{}).Reclaim(ctx, hclient, exporter, 0)
+	if err == nil {
+		t.Error("got no error reclaiming without a db")
+	}
+}
@@ -0,0 +1,348 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/xdr"
+)
+
+// RecoverOnStart causes NewCustodian to call Recover
+// before the custodian starts its loops,
+// so that state left inconsistent by an unclean shutdown
+// is corrected rather than acted on.
+func RecoverOnStart() Option {
+	return func(c *Custodian) {
+		c.recoverOnStart = true
+	}
+}
+
+// DefaultRecoveryBatchSize is the default number of exports
+// Recover reads from the db at a time (see RecoveryBatchSize).
+const DefaultRecoveryBatchSize = 100
+
+// RecoveryBatchSize sets the number of exports
+// Recover reads from the db at a time
+// to check against the Zioncoin network
+// (by default, DefaultRecoveryBatchSize).
+func RecoveryBatchSize(n int) Option {
+	return func(c *Custodian) {
+		c.recoveryBatchSize = n
+	}
+}
+
+// RecoveryReport describes the reconciliation done by Recover.
+type RecoveryReport struct {
+	// Corrections describes each change Recover made to the db.
+	Corrections []string `json:"corrections,omitempty"`
+
+	// Problems describes each inconsistency Recover found
+	// but left for an operator to resolve.
+	Problems []string `json:"problems,omitempty"`
+}
+
+func (r *RecoveryReport) correct(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("recovery: %s", msg)
+	r.Corrections = append(r.Corrections, msg)
+}
+
+func (r *RecoveryReport) problem(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("recovery: %s", msg)
+	r.Problems = append(r.Problems, msg)
+}
+
+// Recover reconciles the custodian's db with the txvm chain
+// and the Zioncoin network,
+// correcting what an unclean shutdown may have left behind:
+//   - pegs whose import tx reached txvm but were not marked imported
+//     are marked imported, rather than imported again;
+//   - a stored peg-in cursor that is unparsable,
+//     or beyond the latest ledger of the equator server
+//     (e.g. after a network reset),
+//     is replaced with the configured start cursor;
+//   - peg-outs marked for retry whose peg-out tx in fact succeeded
+//     are marked pegged out, rather than failed and refunded;
+//   - peg-outs marked pegged out whose peg-out tx is not on the Zioncoin network
+//     but whose temp account is unused are marked for retry,
+//     rather than retired on txvm without being paid.
+//     Resubmitting the preauthorized peg-out tx cannot pay twice.
+//     So are pending peg-outs (see AsyncPegOuts)
+//     whose txs Horizon accepted but never applied.
+//
+// Peg-outs are checked in batches (see RecoveryBatchSize),
+// with each request to the equator server subject to its rate limits.
+// Canceling ctx stops Recover after the peg-out being checked,
+// and the next Recover resumes after it,
+// as it does after any interruption.
+//
+// It must be called before the custodian's loops start.
+func (c *Custodian) Recover(ctx context.Context) (RecoveryReport, error) {
+	var r RecoveryReport
+	err := c.recoverImports(ctx, &r)
+	if err != nil {
+		return r, errors.Wrap(err, "reconciling imports")
+	}
+	err = c.recoverCursor(ctx, &r)
+	if err != nil {
+		return r, errors.Wrap(err, "reconciling peg-in cursor")
+	}
+	err = c.recoverPegOuts(ctx, &r)
+	if err != nil {
+		return r, errors.Wrap(err, "reconciling peg-outs")
+	}
+	log.Printf("recovery: made %d correction(s), found %d problem(s)", len(r.Corrections), len(r.Problems))
+	return r, nil
+}
+
+// recoverImports marks as imported each pending peg
+// whose uniqueness token has been consumed on txvm,
+// which only its import tx can do.
+func (c *Custodian) recoverImports(ctx context.Context, r *RecoveryReport) error {
+	pending, err := c.pendingImports(ctx)
+	if err != nil {
+		return err
+	}
+	contracts := c.S.chain.State().ContractsTree
+	for _, p := range pending {
+		// The import tx is deterministic,
+		// so rebuilding it identifies the token it consumes.
+		// A peg imported in a batch (see BatchImports) consumed the same token,
+		// though in a tx with another ID.
+		importTxBytes, err := c.buildImportTx(p.amount, p.expMS, p.assetXDR, p.recip, p.metadata)
+		if err != nil {
+			return errors.Wrapf(err, "building import tx for hash %x", p.nonceHash)
+		}
+		importTx, err := bc.NewTx(importTxBytes, 3, math.MaxInt64, txvm.GetRunlimit(new(int64)))
+		if err != nil {
+			return errors.Wrapf(err, "computing import tx ID for hash %x", p.nonceHash)
+		}
+		imported := false
+		for _, con := range importTx.Contracts {
+			if con.Type == bc.InputType && !contracts.Contains(con.ID.Bytes()) {
+				imported = true
+			}
+		}
+		if !imported {
+			continue
+		}
+		err = c.recordImport(ctx, p.nonceHash, importTx.ID.Bytes(), p.amount, p.assetXDR)
+		if err != nil {
+			return err
+		}
+		r.correct("marked peg with nonce hash %x imported by txvm tx %x", p.nonceHash, importTx.ID.Bytes())
+	}
+	return nil
+}
+
+// recoverCursor resets the stored peg-in cursor
+// if it cannot be a position in the equator server's history.
+func (c *Custodian) recoverCursor(ctx context.Context, r *RecoveryReport) error {
+	var cur string
+	err := c.DB.QueryRowContext(ctx, "SELECT cursor FROM custodian WHERE label=$1", c.label).Scan(&cur)
+	if err != nil {
+		return errors.Wrap(err, "reading cursor from db")
+	}
+	if cur == "" {
+		return nil
+	}
+	reason, err := c.cursorProblem(cur)
+	if err != nil {
+		return err
+	}
+	if reason == "" {
+		return nil
+	}
+	_, err = c.DB.ExecContext(ctx, `UPDATE custodian SET cursor=$1 WHERE label=$2`, string(c.startCursor), c.label)
+	if err != nil {
+		return errors.Wrap(err, "resetting cursor")
+	}
+	r.correct("reset peg-in cursor %q, which %s, to %q", cur, reason, c.startCursor)
+	return nil
+}
+
+// recoverPegOuts checks the exports marked pegged out, pending, or for retry
+// against the Zioncoin network,
+// in txid order from the custodian's stored recovery cursor.
+// The cursor is advanced past each export once it is checked,
+// and cleared once all are.
+func (c *Custodian) recoverPegOuts(ctx context.Context, r *RecoveryReport) error {
+	batchSize := c.recoveryBatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultRecoveryBatchSize
+	}
+	var cursor []byte
+	err := c.DB.QueryRowContext(ctx, "SELECT recovery_txid FROM custodian WHERE label=$1", c.label).Scan(&cursor)
+	if err != nil {
+		return errors.Wrap(err, "reading recovery cursor from db")
+	}
+	if len(cursor) > 0 {
+		log.Printf("recovery: resuming peg-out checks after export %x", cursor)
+	} else {
+		cursor = []byte{}
+	}
+	for {
+		var (
+			txids, refs [][]byte
+			states      []pegOutState
+			hashes      []string
+			versions    []int64
+			fees        []int64
+		)
+		const q = `SELECT txid, pegout_json, pegged_out, zioncoin_tx, version, base_fee FROM exports WHERE pegged_out IN ($1, $2, $3) AND custodian_id=$4 AND txid>$5 ORDER BY txid LIMIT $6`
+		err = sqlutil.ForQueryRows(ctx, c.DB, q, pegOutOK, pegOutRetry, pegOutPending, c.label, cursor, batchSize, func(txid, ref []byte, state pegOutState, hash string, version, fee int64) {
+			txids = append(txids, txid)
+			refs = append(refs, ref)
+			states = append(states, state)
+			hashes = append(hashes, hash)
+			versions = append(versions, version)
+			fees = append(fees, fee)
+		})
+		if err != nil {
+			return errors.Wrap(err, "querying exports")
+		}
+		for i, txid := range txids {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			err = c.recoverPegOut(ctx, r, txid, refs[i], states[i], hashes[i], versions[i], fees[i])
+			if err != nil {
+				return err
+			}
+			// Recorded even if ctx was canceled during the check,
+			// which is complete.
+			_, err = c.DB.Exec("UPDATE custodian SET recovery_txid=$1 WHERE label=$2", txid, c.label)
+			if err != nil {
+				return errors.Wrapf(err, "advancing recovery cursor to export %x", txid)
+			}
+			cursor = txid
+		}
+		if len(txids) < batchSize {
+			break
+		}
+	}
+	_, err = c.DB.ExecContext(ctx, "UPDATE custodian SET recovery_txid=$1 WHERE label=$2", []byte{}, c.label)
+	return errors.Wrap(err, "clearing recovery cursor")
+}
+
+// recoverPegOut checks export txid,
+// with reference data ref and the given state, peg-out tx hash, version,
+// and recorded base fee, against the Zioncoin network.
+func (c *Custodian) recoverPegOut(ctx context.Context, r *RecoveryReport, txid, ref []byte, state pegOutState, hash string, version, fee int64) error {
+	var p pegOut
+	err := decodeRefdata(ref, &p)
+	if err != nil {
+		return errors.Wrapf(err, "unmarshaling refdata of export %x", txid)
+	}
+	p.Version = version
+	p.RecordedFee = fee
+	if state == pegOutRetry {
+		err = c.recoverRetriedPegOut(ctx, r, txid, p)
+	} else {
+		err = c.recoverPeggedOut(ctx, r, txid, p, hash)
+	}
+	if errors.Root(err) == errExportChanged {
+		// The custodian's loops acted on the export while it was checked,
+		// with fresher state than the check.
+		log.Printf("export %x changed while being reconciled, leaving it as is", txid)
+		return nil
+	}
+	return err
+}
+
+// recoverRetriedPegOut marks export txid pegged out
+// if its preauthorized peg-out tx is on the Zioncoin network.
+func (c *Custodian) recoverRetriedPegOut(ctx context.Context, r *RecoveryReport, txid []byte, p pegOut) error {
+	var asset xdr.Asset
+	err := xdr.SafeUnmarshal(p.AssetXDR, &asset)
+	if err != nil {
+		return errors.Wrapf(err, "unmarshaling asset of export %x", txid)
+	}
+	policy := c.feePolicy(asset)
+	payout, _, err := policy.Payout(p.Amount)
+	if err != nil {
+		// The peg-out is never submitted.
+		return nil
+	}
+	tranches := policy.Split(payout)
+	conv, err := p.conversion()
+	if err != nil {
+		return errors.Wrapf(err, "export %x", txid)
+	}
+	tx, err := buildPegOutTx(c.AccountID.Address(), p.Exporter, p.owner(), p.TempAddr, c.network, asset, tranches[0], conv, p.Recipients, xdr.SequenceNumber(p.Seqnum), p.memo(), c.pegOutBaseFee(p), c.cosignPegOuts)
+	if err != nil {
+		return errors.Wrapf(err, "building peg-out tx of export %x", txid)
+	}
+	hash, err := tx.HashHex()
+	if err != nil {
+		return errors.Wrapf(err, "hashing peg-out tx of export %x", txid)
+	}
+	_, err = c.hclient.LoadTransaction(hash)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "loading peg-out tx %s of export %x", hash, txid)
+	}
+	state := pegOutOK
+	if len(tranches) > 1 {
+		state = pegOutPartial
+	}
+	err = c.updateExportState(ctx, txid, p.Version, state, hash)
+	if err != nil {
+		return err
+	}
+	r.correct("marked export %x, awaiting retry, pegged out by Zioncoin tx %s", txid, hash)
+	return nil
+}
+
+// recoverPeggedOut marks export txid for retry
+// if its peg-out tx, with the given hash, is not on the Zioncoin network
+// and its temp account is still unused.
+func (c *Custodian) recoverPeggedOut(ctx context.Context, r *RecoveryReport, txid []byte, p pegOut, hash string) error {
+	if hash == "" {
+		// Recorded before peg-out tx hashes were.
+		return nil
+	}
+	_, err := c.hclient.LoadTransaction(hash)
+	if err == nil {
+		return nil
+	}
+	if !isNotFound(err) {
+		return errors.Wrapf(err, "loading peg-out tx %s of export %x", hash, txid)
+	}
+	account, err := c.hclient.LoadAccount(p.TempAddr)
+	if isNotFound(err) {
+		r.problem("export %x is marked pegged out, but its peg-out tx %s is not on the Zioncoin network and its temp account %s is gone", txid, hash, p.TempAddr)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "loading temp account %s of export %x", p.TempAddr, txid)
+	}
+	if account.Sequence != strconv.FormatInt(p.Seqnum, 10) {
+		r.problem("export %x is marked pegged out, but its peg-out tx %s is not on the Zioncoin network and its temp account %s has sequence number %s, not %d", txid, hash, p.TempAddr, account.Sequence, p.Seqnum)
+		return nil
+	}
+	err = c.updateExportState(ctx, txid, p.Version, pegOutRetry, "")
+	if err != nil {
+		return err
+	}
+	r.correct("marked export %x for retry: peg-out tx %s is not on the Zioncoin network", txid, hash)
+	return nil
+}
+
+// isNotFound reports whether err is a 404 response from the equator server.
+func isNotFound(err error) bool {
+	herr, ok := errors.Root(err).(*equator.Error)
+	return ok && herr.Problem.Status == http.StatusNotFound
+}
@@ -0,0 +1,268 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestRecover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		c.S.blockInterval = 100 * time.Millisecond
+
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Two pegs are paid; only the first is imported on txvm,
+		// and neither import is recorded in the db.
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		var nonceHashes [][]byte
+		for i := int64(0); i < 2; i++ {
+			body, err := json.Marshal(PrePegIn{
+				BcID:        c.InitBlockHash.Bytes(),
+				Amount:      10,
+				AssetXDR:    lumenXDR,
+				RecipPubkey: testRecipPubKey,
+				ExpMS:       expMS + i,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			c.DoPrePegIn(w, httptest.NewRequest("POST", "/prepegin", bytes.NewReader(body)).WithContext(ctx))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d from pre-peg-in: %s", w.Code, w.Body.String())
+			}
+			nonceHash := w.Body.Bytes()
+			nonceHashes = append(nonceHashes, nonceHash)
+			err = c.recordPegIn(ctx, "txid", "1", nonceHash, "source", 10, lumenXDR)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		importTxBytes, err := c.buildImportTx(10, expMS, lumenXDR, testRecipPubKey, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var runlimit int64
+		importTx, err := bc.NewTx(importTxBytes, 3, math.MaxInt64, txvm.GetRunlimit(&runlimit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		importTx.Runlimit = math.MaxInt64 - runlimit
+		r, err := c.S.submitTx(ctx, importTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.S.waitOnTx(ctx, importTx.ID, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.Exec("UPDATE custodian SET cursor='not a cursor' WHERE seed=$1", c.seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accounts := make(map[string]equator.Account)
+		txs := map[string]bool{"landed": true}
+		c.hclient = &fakeClient{
+			ClientInterface: c.hclient,
+			loadAccount:     loadAccountsFrom(accounts),
+			loadTransaction: loadTxsFrom(txs),
+		}
+		setState := func(txid []byte, state pegOutState, hash string) {
+			_, err := db.Exec("UPDATE exports SET pegged_out=$1, zioncoin_tx=$2 WHERE txid=$3", state, hash, txid)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The peg-out tx of a retried export succeeded.
+		temp := insertTestExport(t, db, []byte("retry landed"), lumenXDR, 1000, exporter.Address())
+		setState([]byte("retry landed"), pegOutRetry, "")
+		tx, err := buildPegOutTx(c.AccountID.Address(), exporter.Address(), exporter.Address(), temp, c.network, zioncoin.NativeAsset(), 1000, nil, nil, 1, nil, baseFee, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		landedHash, err := tx.HashHex()
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs[landedHash] = true
+
+		// The peg-out tx of a retried export did not succeed.
+		insertTestExport(t, db, []byte("retry pending"), lumenXDR, 1000, exporter.Address())
+		setState([]byte("retry pending"), pegOutRetry, "")
+
+		// The peg-out tx of an export marked pegged out is not on the network,
+		// but its temp account is unused.
+		temp = insertTestExport(t, db, []byte("ok unpaid"), lumenXDR, 1000, exporter.Address())
+		setState([]byte("ok unpaid"), pegOutOK, "lost")
+		account := tempAccount(temp, exporter.Address(), "2.5000000")
+		account.Sequence = "1"
+		accounts[temp] = account
+
+		// The same, but the temp account is gone.
+		insertTestExport(t, db, []byte("ok gone"), lumenXDR, 1000, exporter.Address())
+		setState([]byte("ok gone"), pegOutOK, "lost")
+
+		insertTestExport(t, db, []byte("ok landed"), lumenXDR, 1000, exporter.Address())
+		setState([]byte("ok landed"), pegOutOK, "landed")
+
+		report, err := c.Recover(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, want := range []int{1, 0} {
+			var imported int
+			err = db.QueryRow("SELECT imported FROM pegs WHERE nonce_hash=$1", nonceHashes[i]).Scan(&imported)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if imported != want {
+				t.Errorf("peg %d: got imported=%d, want %d", i, imported, want)
+			}
+		}
+		var cur string
+		err = db.QueryRow("SELECT cursor FROM custodian WHERE seed=$1", c.seed).Scan(&cur)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cur != string(c.startCursor) {
+			t.Errorf("got cursor %q after recovery, want start cursor %q", cur, c.startCursor)
+		}
+		cases := []struct {
+			txid      string
+			wantState pegOutState
+			wantHash  string
+		}{
+			{"retry landed", pegOutOK, landedHash},
+			{"retry pending", pegOutRetry, ""},
+			{"ok unpaid", pegOutRetry, ""},
+			{"ok gone", pegOutOK, "lost"},
+			{"ok landed", pegOutOK, "landed"},
+		}
+		for _, tt := range cases {
+			var (
+				state pegOutState
+				hash  string
+			)
+			err = db.QueryRow("SELECT pegged_out, zioncoin_tx FROM exports WHERE txid=$1", []byte(tt.txid)).Scan(&state, &hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state != tt.wantState || hash != tt.wantHash {
+				t.Errorf("export %q: got state %d with tx %q, want state %d with tx %q", tt.txid, state, hash, tt.wantState, tt.wantHash)
+			}
+		}
+		if len(report.Corrections) != 4 || len(report.Problems) != 1 {
+			t.Errorf("got corrections %q and problems %q, want 4 corrections and 1 problem", report.Corrections, report.Problems)
+		}
+	})
+}
+
+func TestRecoverResume(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs := make(map[string]bool)
+
+		// Five exports pegged out by txs on the network,
+		// each checked with one load of its tx.
+		for i := 0; i < 5; i++ {
+			txid := []byte{'e', byte(i)}
+			hash := string(rune('a' + i))
+			insertTestExport(t, db, txid, lumenXDR, 1000, exporter.Address())
+			_, err = db.Exec("UPDATE exports SET pegged_out=$1, zioncoin_tx=$2 WHERE txid=$3", pegOutOK, hash, txid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			txs[hash] = true
+		}
+		c.recoveryBatchSize = 2
+
+		// Record the txs loaded, calling cancel after the nth.
+		var loaded []string
+		loadTxs := func(n int, cancel func()) func(string) (equator.Transaction, error) {
+			loaded = nil
+			return func(hash string) (equator.Transaction, error) {
+				loaded = append(loaded, hash)
+				if len(loaded) == n {
+					cancel()
+				}
+				return loadTxsFrom(txs)(hash)
+			}
+		}
+
+		// Interrupt recovery while checking the third export.
+		interrupted, cancelRecovery := context.WithCancel(ctx)
+		hclient := &fakeClient{ClientInterface: c.hclient, loadTransaction: loadTxs(3, cancelRecovery)}
+		c.hclient = hclient
+		_, err = c.Recover(interrupted)
+		if errors.Root(err) != context.Canceled {
+			t.Fatalf("got error %v from interrupted recovery, want %v", err, context.Canceled)
+		}
+		if got := strings.Join(loaded, ""); got != "abc" {
+			t.Errorf("interrupted recovery loaded txs %q, want %q", got, "abc")
+		}
+		var cursor []byte
+		err = db.QueryRow("SELECT recovery_txid FROM custodian WHERE label=$1", c.label).Scan(&cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []byte{'e', 2}; !bytes.Equal(cursor, want) {
+			t.Errorf("got recovery cursor %x after interruption, want %x", cursor, want)
+		}
+
+		// Resumed recovery checks only the rest.
+		hclient.loadTransaction = loadTxs(0, nil)
+		_, err = c.Recover(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(loaded, ""); got != "de" {
+			t.Errorf("resumed recovery loaded txs %q, want %q", got, "de")
+		}
+		err = db.QueryRow("SELECT recovery_txid FROM custodian WHERE label=$1", c.label).Scan(&cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cursor) != 0 {
+			t.Errorf("got recovery cursor %x after complete recovery, want none", cursor)
+		}
+	})
+}
@@ -0,0 +1,330 @@
+package slidechain
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	i10rnet "github.com/interzioncoin/starlight/net"
+)
+
+// DefaultRecoveryLog is the default path of the file to which the custodian
+// records peg-out state changes it was unable to write to the db.
+// A custodian with a label (see Label) defaults instead to
+// slidechain-recovery-LABEL.log,
+// so custodians sharing a db and a working directory
+// do not replay each other's entries.
+const DefaultRecoveryLog = "slidechain-recovery.log"
+
+// DefaultExportStateAttempts is the default number of times the custodian tries
+// to record a peg-out's state in the db before writing it to the recovery log.
+const DefaultExportStateAttempts = 5
+
+// recoveryEntry is a line of the recovery log.
+type recoveryEntry struct {
+	TxID       []byte      `json:"txid"`
+	State      pegOutState `json:"state"`
+	ZioncoinTx string      `json:"zioncoin_tx,omitempty"`
+	Time       time.Time   `json:"time"`
+}
+
+// RecoveryLog sets the path of the file to which the custodian records
+// peg-out state changes that it was unable to write to the db
+// (by default, DefaultRecoveryLog, scoped to the custodian's label).
+// Entries in it are applied to the db on the next opportunity.
+func RecoveryLog(path string) Option {
+	return func(c *Custodian) {
+		c.recoveryLog = path
+	}
+}
+
+// ExportStateAttempts sets the number of times the custodian tries
+// to record a peg-out's state in the db before writing it to the recovery log
+// (by default, DefaultExportStateAttempts).
+func ExportStateAttempts(n int) Option {
+	return func(c *Custodian) {
+		c.exportStateAttempts = n
+	}
+}
+
+// errStateLogged is returned by setExportState
+// when it wrote an export's state to the recovery log instead of the db.
+var errStateLogged = errors.New("export state written to recovery log")
+
+// setExportState records the state of a peg-out in the exports table,
+// provided the export is still at version,
+// retrying with backoff on failure.
+// It never resubmits the peg-out itself.
+// It returns the export's new version.
+// If the export has changed since it was read at version,
+// setExportState records nothing and returns errExportChanged,
+// so that the caller re-reads the export before deciding its state
+// (see recordExportOutcome).
+// If the update fails otherwise,
+// the state and the hash of the submitted Zioncoin tx (if any)
+// are appended to the recovery log,
+// and setExportState returns errStateLogged.
+func (c *Custodian) setExportState(ctx context.Context, txid []byte, version int64, state pegOutState, zioncoinTx string) (int64, error) {
+	backoff := i10rnet.Backoff{Base: 100 * time.Millisecond}
+	attempts := c.exportStateAttempts
+	if attempts <= 0 {
+		attempts = DefaultExportStateAttempts
+	}
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = c.updateExportState(ctx, txid, version, state, zioncoinTx)
+		if err == nil {
+			return version + 1, nil
+		}
+		if errors.Root(err) == errExportChanged {
+			return 0, err
+		}
+		log.Printf("updating state of export %x (attempt %d): %s", txid, attempt, err)
+		select {
+		case <-ctx.Done():
+			attempt = attempts
+		case <-time.After(backoff.Next()):
+		}
+	}
+	entry := recoveryEntry{
+		TxID:       txid,
+		State:      state,
+		ZioncoinTx: zioncoinTx,
+		Time:       time.Now(),
+	}
+	rerr := c.appendRecoveryLog(entry)
+	if rerr != nil {
+		// Neither the db nor the recovery log is writable,
+		// so there is no durable record of the peg-out.
+		log.Fatalf("recording state %d of export %x (Zioncoin tx %s) after db error %s: %s", state, txid, zioncoinTx, err, rerr)
+	}
+	c.health.setUnhealthy("peg-out state", err)
+	log.Printf("recorded state %d of export %x (Zioncoin tx %s) in recovery log %s", state, txid, zioncoinTx, c.recoveryLogPath())
+	return 0, errors.Wrapf(errStateLogged, "export %x", txid)
+}
+
+// settled reports whether state records the outcome of an export's peg-out,
+// which recordExportOutcome does not overwrite.
+func (state pegOutState) settled() bool {
+	switch state {
+	case pegOutOK, pegOutPartial, pegOutPending, pegOutFail, pegOutHeld:
+		return true
+	}
+	return false
+}
+
+// recordExportOutcome records state, the outcome of the peg-out of export txid
+// by Zioncoin tx zioncoinTx (if any), with setExportState,
+// provided the export is still at version, in state from.
+// If the export has changed since,
+// it re-reads the export and decides again:
+// an export that has settled concurrently (see settled) keeps its new state,
+// and the custodian reports itself unhealthy if that state contradicts this one;
+// otherwise state is recorded over the change.
+// It returns the export's new version and the state it is now in.
+// It returns errExportChanged if the export has finished concurrently,
+// and errStateLogged if the state was written to the recovery log.
+func (c *Custodian) recordExportOutcome(ctx context.Context, txid []byte, version int64, from, state pegOutState, zioncoinTx string) (int64, pegOutState, error) {
+	for {
+		newVersion, err := c.setExportState(ctx, txid, version, state, zioncoinTx)
+		if errors.Root(err) != errExportChanged {
+			return newVersion, state, err
+		}
+		var (
+			current  pegOutState
+			finished bool
+		)
+		err = c.retryDB(ctx, "re-reading export", func(ctx context.Context) error {
+			err := c.DB.QueryRowContext(ctx, `SELECT pegged_out, version FROM exports WHERE txid=$1`, txid).Scan(&current, &version)
+			finished = err == sql.ErrNoRows
+			if finished {
+				return nil
+			}
+			return errors.Wrapf(err, "reading export %x", txid)
+		})
+		if err != nil {
+			return 0, state, err
+		}
+		if finished {
+			log.Printf("export %x finished concurrently, not recording state %d", txid, state)
+			return 0, state, errors.Wrapf(errExportChanged, "export %x finished", txid)
+		}
+		if current == state {
+			// Recorded concurrently; there is nothing left to record.
+			return version, state, nil
+		}
+		if current == from || !current.settled() {
+			log.Printf("export %x changed concurrently to state %d at version %d; recording state %d over the change", txid, current, version, state)
+			continue
+		}
+		if state.settled() {
+			err = fmt.Errorf("export %x settled concurrently in state %d, but its peg-out (Zioncoin tx %q) ended in state %d", txid, current, zioncoinTx, state)
+			log.Print(err)
+			c.health.setUnhealthy("peg-out state", err)
+		} else {
+			log.Printf("export %x settled concurrently in state %d, not recording state %d", txid, current, state)
+		}
+		return version, current, nil
+	}
+}
+
+// updateExportState records the state of export txid,
+// and the hash of its peg-out tx, if any,
+// provided the export is still at version,
+// and increments its version.
+// It counts the retries of the peg-out (see MaxPegOutRetries),
+// resetting the count once the peg-out tx succeeds,
+// and defers each retry by a growing backoff (see PegOutRetryBackoff).
+// If the export has changed since it was read at version,
+// it returns errExportChanged.
+func (c *Custodian) updateExportState(ctx context.Context, txid []byte, version int64, state pegOutState, zioncoinTx string) error {
+	ctx, cancel := c.dbContext(ctx)
+	defer cancel()
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	// SQLite numbers the placeholders in order of first appearance,
+	// so the arguments follow that order.
+	const q = `UPDATE exports SET pegged_out=$1, zioncoin_tx=$2, version=version+1,
+		retries = CASE WHEN $1 = $3 THEN retries+1 WHEN $1 IN ($4, $5, $6) THEN 0 ELSE retries END
+		WHERE txid=$7 AND version=$8`
+	result, err := dbtx.ExecContext(ctx, q, state, zioncoinTx, pegOutRetry, pegOutOK, pegOutPartial, pegOutPending, txid, version)
+	if err != nil {
+		return errors.Wrap(err, "updating pegged_out in export table")
+	}
+	numAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "checking rows affected by update exports query for txid %x", txid)
+	}
+	if numAffected == 0 {
+		return errors.Wrapf(errExportChanged, "updating export %x at version %d", txid, version)
+	}
+	if state == pegOutRetry {
+		var retries int
+		err = dbtx.QueryRowContext(ctx, `SELECT retries FROM exports WHERE txid=$1`, txid).Scan(&retries)
+		if err != nil {
+			return errors.Wrapf(err, "reading retries of export %x", txid)
+		}
+		next := time.Now().Add(c.pegOutRetryDelay(retries))
+		_, err = dbtx.ExecContext(ctx, `UPDATE exports SET next_attempt_ms=$1 WHERE txid=$2`, int64(bc.Millis(next)), txid)
+		if err != nil {
+			return errors.Wrapf(err, "scheduling retry of export %x", txid)
+		}
+	}
+	err = appendEvent(ctx, dbtx, Event{
+		Type:       EventPegOut,
+		TxVMTxID:   txid,
+		ZioncoinTx: zioncoinTx,
+		State:      state,
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(dbtx.Commit(), "committing state of export %x", txid)
+}
+
+func (c *Custodian) recoveryLogPath() string {
+	if c.recoveryLog != "" {
+		return c.recoveryLog
+	}
+	if c.label == "" {
+		return DefaultRecoveryLog
+	}
+	ext := filepath.Ext(DefaultRecoveryLog)
+	return strings.TrimSuffix(DefaultRecoveryLog, ext) + "-" + url.PathEscape(c.label) + ext
+}
+
+func (c *Custodian) appendRecoveryLog(entry recoveryEntry) error {
+	f, err := os.OpenFile(c.recoveryLogPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "opening recovery log")
+	}
+	err = json.NewEncoder(f).Encode(entry)
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "writing recovery log")
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "syncing recovery log")
+	}
+	return f.Close()
+}
+
+// replayRecoveryLog applies the entries in the recovery log to the db,
+// removing the log once all have been applied.
+// Entries for exports no longer in the db, which have finished, are dropped.
+// It returns the txids of the exports whose state is still unrecorded,
+// which must not be pegged out again.
+func (c *Custodian) replayRecoveryLog(ctx context.Context) (map[string]bool, error) {
+	f, err := os.Open(c.recoveryLogPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "opening recovery log")
+	}
+	var entries []recoveryEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry recoveryEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrap(err, "parsing recovery log")
+		}
+		entries = append(entries, entry)
+	}
+	f.Close()
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading recovery log")
+	}
+
+	// Later entries for an export supersede earlier ones.
+	latest := make(map[string]recoveryEntry)
+	for _, entry := range entries {
+		latest[string(entry.TxID)] = entry
+	}
+	unrecorded := make(map[string]bool)
+	for txid, entry := range latest {
+		// The entry records the outcome of a submitted peg-out tx,
+		// which supersedes the export's state in the db.
+		var version int64
+		version, err = c.exportVersion(ctx, []byte(txid))
+		if errors.Root(err) == sql.ErrNoRows {
+			log.Printf("export %x finished, dropping its recovery log entry", txid)
+			continue
+		}
+		if err == nil {
+			err = c.updateExportState(ctx, []byte(txid), version, entry.State, entry.ZioncoinTx)
+		}
+		if err != nil {
+			log.Printf("replaying recovery log for export %x: %s", txid, err)
+			unrecorded[txid] = true
+		}
+	}
+	if len(unrecorded) > 0 {
+		return unrecorded, fmt.Errorf("could not apply %d recovery log entries", len(unrecorded))
+	}
+	err = os.Remove(c.recoveryLogPath())
+	if err != nil {
+		return nil, errors.Wrap(err, "removing recovery log")
+	}
+	c.health.setHealthy("peg-out state")
+	log.Printf("applied %d recovery log entries", len(latest))
+	return nil, nil
+}
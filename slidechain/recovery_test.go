@@ -0,0 +1,179 @@
+package slidechain
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestExportStateRecovery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	testdir, err := ioutil.TempDir("", "slidechaintest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testdir)
+	recoveryLog := filepath.Join(testdir, "recovery.log")
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		c.hclient = hclient
+
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		txid := []byte("export")
+		insertTestExport(t, db, txid, lumenXDR, 100, exporter.Address())
+
+		// Fail every update of export states,
+		// i.e. the state update following submission of the peg-out tx.
+		_, err = db.Exec(`CREATE TRIGGER fail_exports BEFORE UPDATE OF pegged_out ON exports BEGIN SELECT RAISE(FAIL, 'injected failure'); END`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pegouts := make(chan pegOut)
+		go c.pegOutFromExports(ctx, pegouts)
+		defer func() {
+			// Wait for pegOutFromExports to exit before the db is closed.
+			cancel()
+			for range pegouts {
+			}
+		}()
+
+		for {
+			if _, err := os.Stat(recoveryLog); err == nil {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for recovery log")
+			case p := <-pegouts:
+				t.Fatalf("export %x sent to post-peg-out with unrecorded state", p.TxID)
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			}
+		}
+
+		f, err := os.Open(recoveryLog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []recoveryEntry
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry recoveryEntry
+			err = json.Unmarshal(scanner.Bytes(), &entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, entry)
+		}
+		f.Close()
+		if len(entries) != 1 {
+			t.Fatalf("got %d recovery log entries, want 1", len(entries))
+		}
+		if string(entries[0].TxID) != string(txid) || entries[0].State != pegOutOK || entries[0].ZioncoinTx == "" {
+			t.Errorf("got recovery log entry %+v, want state %d of export %x with a Zioncoin tx hash", entries[0], pegOutOK, txid)
+		}
+		if len(c.health.problems()) == 0 {
+			t.Error("custodian healthy with unrecorded peg-out state")
+		}
+
+		// While the db is still failing, the export must not be pegged out again.
+		for i := 0; i < 5; i++ {
+			c.exports.Broadcast()
+			time.Sleep(100 * time.Millisecond)
+		}
+		if n := atomic.LoadInt32(&hclient.submitted); n != 1 {
+			t.Fatalf("got %d peg-out submissions while db failing, want 1", n)
+		}
+
+		_, err = db.Exec(`DROP TRIGGER fail_exports`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			var state pegOutState
+			err = db.QueryRow(`SELECT pegged_out FROM exports WHERE txid=$1`, txid).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(recoveryLog); state == pegOutOK && os.IsNotExist(err) {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for recovery log to be applied")
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			}
+		}
+		if n := atomic.LoadInt32(&hclient.submitted); n != 1 {
+			t.Errorf("got %d peg-out submissions after recovery, want 1", n)
+		}
+		if problems := c.health.problems(); len(problems) != 0 {
+			t.Errorf("custodian unhealthy after recovery: %v", problems)
+		}
+	}, RecoveryLog(recoveryLog))
+}
+
+func TestRecoveryLogFinishedExport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		// The export's row is gone, as once its peg-out has finished.
+		err := c.appendRecoveryLog(recoveryEntry{TxID: []byte("finished"), State: pegOutOK, ZioncoinTx: "txhash", Time: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		unrecorded, err := c.replayRecoveryLog(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(unrecorded) != 0 {
+			t.Errorf("got unrecorded exports %v, want none", unrecorded)
+		}
+		if _, err := os.Stat(c.recoveryLogPath()); !os.IsNotExist(err) {
+			t.Errorf("recovery log %s remains after replay (stat error %v)", c.recoveryLogPath(), err)
+		}
+	})
+}
+
+func TestRecoveryLogPath(t *testing.T) {
+	cases := []struct {
+		label, path, want string
+	}{
+		{"", "", DefaultRecoveryLog},
+		{"a", "", "slidechain-recovery-a.log"},
+		{"a/b", "", "slidechain-recovery-a%2Fb.log"},
+		{"a", "custom.log", "custom.log"},
+	}
+	for _, tc := range cases {
+		c := &Custodian{label: tc.label, recoveryLog: tc.path}
+		if got := c.recoveryLogPath(); got != tc.want {
+			t.Errorf("got recovery log %q for label %q and path %q, want %q", got, tc.label, tc.path, tc.want)
+		}
+	}
+}
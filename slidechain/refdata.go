@@ -0,0 +1,221 @@
+package slidechain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/chain/txvm/errors"
+)
+
+// RefdataFormat is the encoding of an export's refdata,
+// the pegOut carried in and committed to by its export tx.
+type RefdataFormat string
+
+const (
+	// RefdataJSON encodes refdata as a JSON object.
+	// It is the default.
+	RefdataJSON RefdataFormat = "json"
+
+	// RefdataBinary encodes refdata in a fixed, canonical binary layout
+	// (see encodeBinaryRefdata),
+	// which is smaller than JSON
+	// and has exactly one encoding of each pegOut.
+	RefdataBinary RefdataFormat = "binary"
+)
+
+// DefaultRefdataFormat is the refdata format of the export txs
+// built with no ExportOptions.Format.
+const DefaultRefdataFormat = RefdataJSON
+
+// refdataBinaryVersion is the first byte of binary refdata.
+// JSON refdata always begins with '{',
+// so the first byte tells the formats apart.
+const refdataBinaryVersion byte = 1
+
+// checkRefdataFormat returns an error if format is not a known format.
+func checkRefdataFormat(format RefdataFormat) error {
+	switch format {
+	case RefdataJSON, RefdataBinary:
+		return nil
+	}
+	return fmt.Errorf("unknown refdata format %q (known formats: %q, %q)", format, RefdataJSON, RefdataBinary)
+}
+
+// encodeRefdata encodes p in the given format.
+func encodeRefdata(p pegOut, format RefdataFormat) ([]byte, error) {
+	switch format {
+	case RefdataJSON, "":
+		return json.Marshal(p)
+	case RefdataBinary:
+		return encodeBinaryRefdata(p), nil
+	}
+	return nil, checkRefdataFormat(format)
+}
+
+// decodeRefdata decodes refdata in either format into p,
+// recording the format in p.Format,
+// so that encodeRefdata reproduces it.
+func decodeRefdata(ref []byte, p *pegOut) error {
+	if len(ref) == 0 {
+		return errors.New("empty refdata")
+	}
+	switch ref[0] {
+	case '{':
+		err := json.Unmarshal(ref, p)
+		if err != nil {
+			return err
+		}
+		p.Format = RefdataJSON
+		return nil
+	case refdataBinaryVersion:
+		err := decodeBinaryRefdata(ref, p)
+		if err != nil {
+			return err
+		}
+		p.Format = RefdataBinary
+		return nil
+	}
+	return fmt.Errorf("unknown refdata version byte 0x%02x", ref[0])
+}
+
+// RefdataToJSON returns the JSON encoding of export refdata
+// in any format, e.g. for display.
+func RefdataToJSON(ref []byte) ([]byte, error) {
+	var p pegOut
+	err := decodeRefdata(ref, &p)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(p)
+}
+
+// encodeBinaryRefdata encodes p as refdataBinaryVersion
+// followed by its fields in the order they are declared,
+// each integer as a varint
+// and each string and byte slice as its uvarint length and contents.
+// Recipients, if any, come next,
+// as their uvarint count and each one's destination and amount,
+// and last the BaseFee, if set, after a zero count if there are no recipients;
+// with neither, the encoding ends at ConvertAmount.
+func encodeBinaryRefdata(p pegOut) []byte {
+	buf := []byte{refdataBinaryVersion}
+	putBytes := func(b []byte) {
+		buf = appendUvarint(buf, uint64(len(b)))
+		buf = append(buf, b...)
+	}
+	putInt := func(n int64) {
+		var tmp [binary.MaxVarintLen64]byte
+		buf = append(buf, tmp[:binary.PutVarint(tmp[:], n)]...)
+	}
+	putBytes(p.AssetXDR)
+	putBytes([]byte(p.TempAddr))
+	putInt(p.Seqnum)
+	putBytes([]byte(p.Exporter))
+	putInt(p.Amount)
+	putBytes(p.Anchor)
+	putBytes(p.Pubkey)
+	putBytes([]byte(p.Owner))
+	putInt(p.WindowMS)
+	putBytes([]byte(p.Custodian))
+	putBytes(p.Metadata)
+	putBytes(p.ConvertAssetXDR)
+	putInt(p.ConvertAmount)
+	if len(p.Recipients) > 0 || p.BaseFee != 0 {
+		buf = appendUvarint(buf, uint64(len(p.Recipients)))
+		for _, r := range p.Recipients {
+			putBytes([]byte(r.Destination))
+			putInt(r.Amount)
+		}
+	}
+	if p.BaseFee != 0 {
+		putInt(p.BaseFee)
+	}
+	return buf
+}
+
+func appendUvarint(buf []byte, n uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], n)]...)
+}
+
+// decodeBinaryRefdata decodes binary refdata into p.
+// It accepts only the canonical encoding,
+// the one encodeBinaryRefdata produces,
+// so that the refdata of an export tx can be rebuilt exactly from p.
+func decodeBinaryRefdata(ref []byte, p *pegOut) error {
+	r := bytes.NewReader(ref[1:])
+	var err error
+	getBytes := func() []byte {
+		if err != nil {
+			return nil
+		}
+		var n uint64
+		n, err = binary.ReadUvarint(r)
+		if err != nil {
+			return nil
+		}
+		if n > uint64(r.Len()) {
+			err = fmt.Errorf("field of %d bytes overruns refdata", n)
+			return nil
+		}
+		if n == 0 {
+			return nil
+		}
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+	getInt := func() int64 {
+		if err != nil {
+			return 0
+		}
+		var n int64
+		n, err = binary.ReadVarint(r)
+		return n
+	}
+	var q pegOut
+	q.AssetXDR = getBytes()
+	q.TempAddr = string(getBytes())
+	q.Seqnum = getInt()
+	q.Exporter = string(getBytes())
+	q.Amount = getInt()
+	q.Anchor = getBytes()
+	q.Pubkey = getBytes()
+	q.Owner = string(getBytes())
+	q.WindowMS = getInt()
+	q.Custodian = string(getBytes())
+	q.Metadata = getBytes()
+	q.ConvertAssetXDR = getBytes()
+	q.ConvertAmount = getInt()
+	if err == nil && r.Len() > 0 {
+		var n uint64
+		n, err = binary.ReadUvarint(r)
+		if err == nil && n > MaxRecipients {
+			err = fmt.Errorf("%d recipients, more than the limit of %d", n, MaxRecipients)
+		}
+		for i := uint64(0); err == nil && i < n; i++ {
+			dest := string(getBytes())
+			q.Recipients = append(q.Recipients, Recipient{Destination: dest, Amount: getInt()})
+		}
+	}
+	if err == nil && r.Len() > 0 {
+		q.BaseFee = getInt()
+	}
+	if err != nil {
+		return errors.Wrap(err, "decoding binary refdata")
+	}
+	if r.Len() > 0 {
+		return fmt.Errorf("%d bytes of binary refdata left over", r.Len())
+	}
+	if !bytes.Equal(encodeBinaryRefdata(q), ref) {
+		return errors.New("binary refdata is not canonically encoded")
+	}
+	p.AssetXDR, p.TempAddr, p.Seqnum = q.AssetXDR, q.TempAddr, q.Seqnum
+	p.Exporter, p.Amount, p.Anchor, p.Pubkey = q.Exporter, q.Amount, q.Anchor, q.Pubkey
+	p.Owner, p.WindowMS, p.Custodian, p.Metadata = q.Owner, q.WindowMS, q.Custodian, q.Metadata
+	p.ConvertAssetXDR, p.ConvertAmount = q.ConvertAssetXDR, q.ConvertAmount
+	p.Recipients, p.BaseFee = q.Recipients, q.BaseFee
+	return nil
+}
@@ -0,0 +1,212 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestRefdataRoundTrip(t *testing.T) {
+	lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []pegOut{
+		{
+			AssetXDR: lumenXDR,
+			TempAddr: importTestAccountID,
+			Seqnum:   12345,
+			Exporter: importTestAccountID,
+			Amount:   100,
+			Anchor:   bytes.Repeat([]byte{1}, 32),
+			Pubkey:   testRecipPubKey,
+		},
+		{
+			AssetXDR:        lumenXDR,
+			TempAddr:        importTestAccountID,
+			Seqnum:          1,
+			Exporter:        importTestAccountID,
+			Amount:          1 << 40,
+			Anchor:          bytes.Repeat([]byte{2}, 32),
+			Pubkey:          testRecipPubKey,
+			Owner:           importTestAccountID,
+			WindowMS:        60000,
+			Custodian:       importTestAccountID,
+			Metadata:        json.RawMessage(`{"memo":"x"}`),
+			ConvertAssetXDR: lumenXDR,
+			ConvertAmount:   99,
+		},
+		{
+			AssetXDR: lumenXDR,
+			TempAddr: importTestAccountID,
+			Seqnum:   2,
+			Exporter: importTestAccountID,
+			Amount:   100,
+			Anchor:   bytes.Repeat([]byte{4}, 32),
+			Pubkey:   testRecipPubKey,
+			Recipients: []Recipient{
+				{Destination: importTestAccountID, Amount: 60},
+				{Destination: importTestAccountID, Amount: 40},
+			},
+		},
+		{
+			AssetXDR: lumenXDR,
+			TempAddr: importTestAccountID,
+			Seqnum:   3,
+			Exporter: importTestAccountID,
+			Amount:   100,
+			Anchor:   bytes.Repeat([]byte{5}, 32),
+			Pubkey:   testRecipPubKey,
+			BaseFee:  300,
+		},
+		{
+			AssetXDR: lumenXDR,
+			TempAddr: importTestAccountID,
+			Seqnum:   4,
+			Exporter: importTestAccountID,
+			Amount:   100,
+			Anchor:   bytes.Repeat([]byte{6}, 32),
+			Pubkey:   testRecipPubKey,
+			Recipients: []Recipient{
+				{Destination: importTestAccountID, Amount: 100},
+			},
+			BaseFee: 200,
+		},
+	}
+	for i, p := range cases {
+		for _, format := range []RefdataFormat{RefdataJSON, RefdataBinary} {
+			ref, err := encodeRefdata(p, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got pegOut
+			err = decodeRefdata(ref, &got)
+			if err != nil {
+				t.Fatalf("case %d, %s: %s", i, format, err)
+			}
+			if got.Format != format {
+				t.Errorf("case %d: got format %q decoding %s refdata", i, got.Format, format)
+			}
+			got.Format = ""
+			if !reflect.DeepEqual(got, p) {
+				t.Errorf("case %d, %s: got %+v, want %+v", i, format, got, p)
+			}
+			// Re-encoding in the decoded format reproduces the refdata exactly.
+			again, err := encodeRefdata(got, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again, ref) {
+				t.Errorf("case %d, %s: re-encoded refdata %x, want %x", i, format, again, ref)
+			}
+		}
+
+		// Either format decodes to the same JSON.
+		jsonRef, err := encodeRefdata(p, RefdataJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		binRef, err := encodeRefdata(p, RefdataBinary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(binRef) >= len(jsonRef) {
+			t.Errorf("case %d: got binary refdata of %d bytes, want fewer than JSON's %d", i, len(binRef), len(jsonRef))
+		}
+		fromJSON, err := RefdataToJSON(jsonRef)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromBinary, err := RefdataToJSON(binRef)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(fromJSON, fromBinary) {
+			t.Errorf("case %d: got JSON %s from binary refdata, want %s", i, fromBinary, fromJSON)
+		}
+	}
+}
+
+func TestRefdataDecodeErrors(t *testing.T) {
+	lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := encodeBinaryRefdata(pegOut{AssetXDR: lumenXDR, Amount: 1})
+
+	// A non-minimal varint for the amount decodes to the same value,
+	// but is not the canonical encoding.
+	nonCanonical := append([]byte{refdataBinaryVersion}, appendUvarint(nil, uint64(len(lumenXDR)))...)
+	nonCanonical = append(nonCanonical, lumenXDR...)
+	nonCanonical = append(nonCanonical, 0, 0, 0, 0x82, 0) // temp, seqnum, exporter, amount 1 in two bytes
+	nonCanonical = append(nonCanonical, ref[len(nonCanonical)-1:]...)
+
+	cases := []struct {
+		name string
+		ref  []byte
+	}{
+		{"empty", nil},
+		{"unknown version", append([]byte{2}, ref[1:]...)},
+		{"truncated", ref[:len(ref)-1]},
+		{"trailing bytes", append(append([]byte{}, ref...), 0)},
+		{"zero fee", append(append([]byte{}, ref...), 0, 0)},
+		{"non-canonical", nonCanonical},
+		{"bad json", []byte(`{"amount":`)},
+	}
+	for _, tc := range cases {
+		var p pegOut
+		if err := decodeRefdata(tc.ref, &p); err == nil {
+			t.Errorf("%s: got no error decoding %x", tc.name, tc.ref)
+		}
+	}
+}
+
+func TestBinaryRefdataExportTx(t *testing.T) {
+	ctx := context.Background()
+	_, exporterPrv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchor := bytes.Repeat([]byte{3}, 32)
+	tx, _, err := BuildExportTxWithOptions(ctx, zioncoin.NativeAsset(), 30, 50, tempKP.Address(), anchor, exporterPrv, 1, ExportOptions{Format: RefdataBinary})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := InspectExportTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref[0] != refdataBinaryVersion {
+		t.Fatalf("got refdata starting with 0x%02x, want binary refdata", ref[0])
+	}
+	var p pegOut
+	err = decodeRefdata(ref, &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Amount != 30 || p.TempAddr != tempKP.Address() {
+		t.Errorf("got refdata for %d to %s, want 30 to %s", p.Amount, p.TempAddr, tempKP.Address())
+	}
+	again, err := encodeRefdata(p, p.Format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, ref) {
+		t.Errorf("got re-encoded refdata %x, want %x", again, ref)
+	}
+
+	_, _, err = BuildExportTxWithOptions(ctx, zioncoin.NativeAsset(), 30, 50, tempKP.Address(), anchor, exporterPrv, 1, ExportOptions{Format: "cbor"})
+	if err == nil {
+		t.Error("got no error building export tx with unknown refdata format")
+	}
+}
@@ -0,0 +1,260 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/zioncoin/go/xdr"
+)
+
+// ImportRefundPolicy selects what the custodian does
+// with the funds of a peg-in whose import fails permanently,
+// e.g. because its recipient pubkey is invalid
+// or its nonce expired before it could be imported.
+type ImportRefundPolicy string
+
+const (
+	// HoldFailedImports leaves such a peg awaiting import,
+	// retrying it until an operator intervenes. It is the default.
+	HoldFailedImports ImportRefundPolicy = "hold"
+
+	// RefundFailedImports pays the funds of such a peg
+	// back to the Zioncoin account that paid the peg-in,
+	// recording the refund in the refunds table.
+	// A peg whose payer is unknown,
+	// such as one paid before payers were recorded,
+	// is recorded there as refused, for manual refund.
+	RefundFailedImports ImportRefundPolicy = "payer"
+)
+
+// ImportRefunds selects what the custodian does with the funds of pegs
+// that can never be imported (by default, HoldFailedImports).
+func ImportRefunds(policy ImportRefundPolicy) Option {
+	return func(c *Custodian) {
+		c.importRefunds = policy
+	}
+}
+
+// Values for the refunds.state column.
+const (
+	refundPending = iota
+	refundPaid
+	refundRefused
+)
+
+// importFailure returns why peg p can never be imported as of now,
+// or the empty string if it may yet be.
+func importFailure(p pendingImport, now time.Time) string {
+	if len(p.recip) != ed25519.PublicKeySize {
+		return fmt.Sprintf("recipient pubkey has %d bytes, not %d", len(p.recip), ed25519.PublicKeySize)
+	}
+	if p.expMS <= int64(bc.Millis(now)) {
+		return fmt.Sprintf("peg expired at %d before it was imported", p.expMS)
+	}
+	return ""
+}
+
+// refundImportFailures records for refund the pegs of pending
+// that can never be imported,
+// returning the others.
+// It returns an error only if ctx is canceled.
+func (c *Custodian) refundImportFailures(ctx context.Context, pending []pendingImport) ([]pendingImport, error) {
+	now := time.Now()
+	var importable []pendingImport
+	for _, p := range pending {
+		reason := importFailure(p, now)
+		if reason == "" {
+			importable = append(importable, p)
+			continue
+		}
+		err := c.retryDB(ctx, "recording refund", func(ctx context.Context) error {
+			return c.recordRefund(ctx, p, reason)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return importable, nil
+}
+
+// recordRefund records the refund of peg p,
+// which cannot be imported for the given reason,
+// to the account that paid it,
+// or records the refund as refused if that is unknown.
+// Recording a peg's refund again has no effect.
+func (c *Custodian) recordRefund(ctx context.Context, p pendingImport, reason string) error {
+	var payer string
+	err := c.DB.QueryRowContext(ctx, `SELECT payer FROM pegs WHERE nonce_hash=$1`, p.nonceHash).Scan(&payer)
+	if err != nil {
+		return errors.Wrapf(err, "looking up payer of peg with nonce hash %x", p.nonceHash)
+	}
+	state := refundPending
+	if payer == "" {
+		log.Printf("refusing to refund peg with nonce hash %x (%s): payer unknown", p.nonceHash, reason)
+		state = refundRefused
+	} else {
+		log.Printf("refunding peg with nonce hash %x (%s): %d of asset %x to %s", p.nonceHash, reason, p.amount, p.assetXDR, payer)
+	}
+	const q = `INSERT OR IGNORE INTO refunds (nonce_hash, payer, asset_xdr, amount, reason, state, recorded_ms, custodian_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err = c.DB.ExecContext(ctx, q, p.nonceHash, payer, p.assetXDR, p.amount, reason, state, int64(bc.Millis(time.Now())), c.label)
+	return errors.Wrapf(err, "recording refund of peg with nonce hash %x", p.nonceHash)
+}
+
+// pendingRefund is a refund recorded but not yet known to be paid.
+type pendingRefund struct {
+	nonceHash []byte
+	payer     string
+	assetXDR  []byte
+	amount    int64
+
+	// zioncoinTx is the hash of the payment submitted for the refund, if any.
+	zioncoinTx string
+}
+
+// payRefunds pays the pending refunds,
+// returning the number that failed, to be retried on a later pass.
+// A refund whose payment was submitted but not recorded,
+// e.g. because of a crash,
+// is marked paid if the payment is on the Zioncoin network,
+// and is otherwise paid again.
+// It returns an error only if ctx is canceled.
+func (c *Custodian) payRefunds(ctx context.Context) (int, error) {
+	var pending []pendingRefund
+	err := c.retryDB(ctx, "reading pending refunds", func(ctx context.Context) error {
+		pending = nil
+		const q = `SELECT nonce_hash, payer, asset_xdr, amount, zioncoin_tx FROM refunds WHERE state=$1 AND custodian_id=$2 ORDER BY recorded_ms`
+		return sqlutil.ForQueryRows(ctx, c.DB, q, refundPending, c.label, func(nonceHash []byte, payer string, assetXDR []byte, amount int64, zioncoinTx string) {
+			pending = append(pending, pendingRefund{
+				nonceHash:  nonceHash,
+				payer:      payer,
+				assetXDR:   assetXDR,
+				amount:     amount,
+				zioncoinTx: zioncoinTx,
+			})
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var failed int
+	for _, r := range pending {
+		if c.submissionsHalted() {
+			return failed + 1, nil
+		}
+		var ok bool
+		if r.zioncoinTx != "" {
+			ok, err = c.resolveRefund(ctx, r)
+		} else {
+			ok, err = c.payRefund(ctx, r)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+// payRefund pays refund r,
+// reporting whether it did.
+// It returns an error only if ctx is canceled.
+func (c *Custodian) payRefund(ctx context.Context, r pendingRefund) (bool, error) {
+	var asset xdr.Asset
+	err := xdr.SafeUnmarshal(r.assetXDR, &asset)
+	if err != nil {
+		log.Fatalf("unmarshalling asset from XDR %x: %s", r.assetXDR, err)
+	}
+	tx, err := c.custodianTx(buildPaymentOp(c.AccountID.Address(), r.payer, asset, r.amount))
+	if err != nil {
+		log.Printf("building refund of peg with nonce hash %x: %s", r.nonceHash, err)
+		return false, nil
+	}
+	hash, err := tx.HashHex()
+	if err != nil {
+		log.Printf("hashing refund of peg with nonce hash %x: %s", r.nonceHash, err)
+		return false, nil
+	}
+
+	// The payment is recorded before it is submitted,
+	// so that after a crash resolveRefund can tell whether it happened.
+	var claimed bool
+	err = c.retryDB(ctx, "recording refund payment", func(ctx context.Context) error {
+		var err error
+		claimed, err = c.setRefundPayment(ctx, r.nonceHash, "", hash)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if !claimed {
+		// Another pass is paying it.
+		return true, nil
+	}
+
+	err = c.submitCustodianTx(ctx, tx, hash)
+	if err != nil {
+		log.Printf("refunding peg with nonce hash %x: %s", r.nonceHash, err)
+		return false, c.retryDB(ctx, "releasing refund payment", func(ctx context.Context) error {
+			_, err := c.setRefundPayment(ctx, r.nonceHash, hash, "")
+			return err
+		})
+	}
+	log.Printf("refunded peg with nonce hash %x to %s in Zioncoin tx %s", r.nonceHash, r.payer, hash)
+	return true, c.retryDB(ctx, "recording refund", func(ctx context.Context) error {
+		return c.markRefundPaid(ctx, r.nonceHash)
+	})
+}
+
+// resolveRefund marks refund r paid
+// if its recorded payment is on the Zioncoin network,
+// and otherwise releases the payment to be made again,
+// reporting whether r is paid.
+// It returns an error only if ctx is canceled.
+func (c *Custodian) resolveRefund(ctx context.Context, r pendingRefund) (bool, error) {
+	_, err := c.hclient.LoadTransaction(r.zioncoinTx)
+	if isNotFound(err) {
+		log.Printf("refund payment %s for peg with nonce hash %x not found, paying again", r.zioncoinTx, r.nonceHash)
+		return false, c.retryDB(ctx, "releasing refund payment", func(ctx context.Context) error {
+			_, err := c.setRefundPayment(ctx, r.nonceHash, r.zioncoinTx, "")
+			return err
+		})
+	}
+	if err != nil {
+		log.Printf("loading refund payment %s: %s", r.zioncoinTx, err)
+		return false, nil
+	}
+	return true, c.retryDB(ctx, "recording refund", func(ctx context.Context) error {
+		return c.markRefundPaid(ctx, r.nonceHash)
+	})
+}
+
+// setRefundPayment replaces the payment of the pending refund of the peg
+// with the given nonce hash, if it is old, with hash,
+// reporting whether it did.
+func (c *Custodian) setRefundPayment(ctx context.Context, nonceHash []byte, old, hash string) (bool, error) {
+	const q = `UPDATE refunds SET zioncoin_tx=$1 WHERE nonce_hash=$2 AND zioncoin_tx=$3 AND state=$4`
+	result, err := c.DB.ExecContext(ctx, q, hash, nonceHash, old, refundPending)
+	if err != nil {
+		return false, errors.Wrapf(err, "recording refund payment for nonce hash %x", nonceHash)
+	}
+	numAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "checking rows affected by recording refund payment")
+	}
+	return numAffected > 0, nil
+}
+
+// markRefundPaid marks the refund of the peg with the given nonce hash paid.
+func (c *Custodian) markRefundPaid(ctx context.Context, nonceHash []byte) error {
+	_, err := c.DB.ExecContext(ctx, `UPDATE refunds SET state=$1 WHERE nonce_hash=$2`, refundPaid, nonceHash)
+	return errors.Wrapf(err, "marking refund paid for nonce hash %x", nonceHash)
+}
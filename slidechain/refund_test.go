@@ -0,0 +1,152 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/xdr"
+)
+
+func TestImportFailure(t *testing.T) {
+	now := time.Now()
+	future := int64(bc.Millis(now.Add(time.Minute)))
+	past := int64(bc.Millis(now.Add(-time.Minute)))
+	cases := []struct {
+		name    string
+		p       pendingImport
+		wantErr bool
+	}{
+		{"importable", pendingImport{recip: testRecipPubKey, expMS: future}, false},
+		{"short pubkey", pendingImport{recip: []byte{1, 2, 3}, expMS: future}, true},
+		{"expired", pendingImport{recip: testRecipPubKey, expMS: past}, true},
+	}
+	for _, tc := range cases {
+		reason := importFailure(tc.p, now)
+		if (reason != "") != tc.wantErr {
+			t.Errorf("%s: got failure %q, want failure %v", tc.name, reason, tc.wantErr)
+		}
+	}
+}
+
+func TestImportRefunds(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		c.hclient = hclient
+
+		payer, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		var (
+			paid   = []byte("paid")
+			orphan = []byte("orphan")
+		)
+		for _, peg := range []struct {
+			nonceHash []byte
+			payer     string
+		}{
+			{paid, payer.Address()},
+			{orphan, ""},
+		} {
+			_, err = db.Exec("INSERT INTO pegs (nonce_hash, amount, asset_xdr, recipient_pubkey, nonce_expms, zioncoin_tx, payer) VALUES ($1, 500, $2, $3, $4, 1, $5)", peg.nonceHash, lumenXDR, []byte{1, 2, 3}, expMS, peg.payer)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		pending, err := c.pendingImports(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		importable, err := c.refundImportFailures(ctx, pending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(importable) != 0 {
+			t.Errorf("got %d importable pegs, want 0", len(importable))
+		}
+		// Pegs being refunded are no longer awaiting import.
+		pending, err = c.pendingImports(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 0 {
+			t.Errorf("got %d pegs awaiting import after recording refunds, want 0", len(pending))
+		}
+
+		refundState := func(nonceHash []byte) (int, string) {
+			var (
+				state int
+				tx    string
+			)
+			err := db.QueryRow("SELECT state, zioncoin_tx FROM refunds WHERE nonce_hash=$1", nonceHash).Scan(&state, &tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return state, tx
+		}
+		if state, _ := refundState(orphan); state != refundRefused {
+			t.Errorf("got refund of peg with unknown payer in state %d, want %d", state, refundRefused)
+		}
+
+		// A failed refund payment is released for retry.
+		atomic.StoreInt32(&hclient.fails, 1)
+		failed, err := c.payRefunds(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failed != 1 {
+			t.Errorf("got %d failed refunds, want 1", failed)
+		}
+		if state, tx := refundState(paid); state != refundPending || tx != "" {
+			t.Errorf("got failed refund in state %d with tx %q, want pending with none", state, tx)
+		}
+
+		// Refunds are paid once, however many passes there are.
+		for i := 0; i < 2; i++ {
+			failed, err = c.payRefunds(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if failed != 0 {
+				t.Errorf("pass %d: got %d failed refunds, want 0", i, failed)
+			}
+		}
+		if state, tx := refundState(paid); state != refundPaid || tx == "" {
+			t.Errorf("got refund in state %d with tx %q, want paid", state, tx)
+		}
+
+		hclient.mu.Lock()
+		txs := hclient.txs
+		hclient.mu.Unlock()
+		if len(txs) != 1 {
+			t.Fatalf("got %d submitted txs, want 1", len(txs))
+		}
+		var env xdr.TransactionEnvelope
+		err = xdr.SafeUnmarshalBase64(txs[0], &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(env.Tx.Operations) != 1 || env.Tx.Operations[0].Body.Type != xdr.OperationTypePayment {
+			t.Fatalf("got refund tx with operations %+v, want one payment", env.Tx.Operations)
+		}
+		payment := env.Tx.Operations[0].Body.PaymentOp
+		if payment.Destination.Address() != payer.Address() || payment.Amount != 500 {
+			t.Errorf("got refund of %d to %s, want 500 to %s", payment.Amount, payment.Destination.Address(), payer.Address())
+		}
+	}, ImportRefunds(RefundFailedImports))
+}
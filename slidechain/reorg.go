@@ -0,0 +1,158 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+)
+
+// reorgComponent is the component /health reports unhealthy
+// once an export already pegged out is found in a replaced block.
+const reorgComponent = "slidechain reorg"
+
+// rewindExports handles a reorg of the slidechain (see RunPin),
+// in which the blocks after height fork were replaced.
+// The exports recorded from those blocks may have no retirement behind them,
+// so each is re-verified:
+// the peg-out of one not yet submitted to the Zioncoin network is reversed
+// by forgetting the export,
+// and the export is recorded again if the replacing blocks contain it too.
+// One whose peg-out may already be submitted cannot be reversed:
+// it is recorded in the orphaned_exports table for an operator,
+// and /health reports the custodian unhealthy until restarted.
+// Failed exports, with nothing paid out, are left as they are.
+func (c *Custodian) rewindExports(ctx context.Context, fork uint64) error {
+	const q = `SELECT txid, pegged_out, version, zioncoin_tx, block_height FROM exports WHERE block_height > $1 AND custodian_id = $2`
+	var (
+		txids    [][]byte
+		states   []pegOutState
+		versions []int64
+		hashes   []string
+		heights  []uint64
+	)
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, fork, c.label, func(txid []byte, state pegOutState, version int64, hash string, height uint64) {
+		txids = append(txids, txid)
+		states = append(states, state)
+		versions = append(versions, version)
+		hashes = append(hashes, hash)
+		heights = append(heights, height)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "reading exports after block %d", fork)
+	}
+
+	var orphaned int
+	for i, txid := range txids {
+		switch states[i] {
+		case pegOutFail:
+			continue
+		case pegOutNotYet, pegOutRetry, pegOutNoTrust, pegOutUnsigned, pegOutDust, pegOutHeld:
+			reversed, err := c.reverseExport(ctx, txid, versions[i], heights[i])
+			if err != nil {
+				return err
+			}
+			if reversed {
+				log.Printf("reversed peg-out of export %x from replaced block %d", txid, heights[i])
+				continue
+			}
+			// Claimed for peg-out meanwhile.
+		}
+		log.Printf("export %x from replaced block %d may already be pegged out (state %d, Zioncoin tx %s)", txid, heights[i], states[i], hashes[i])
+		err = c.recordOrphanedExport(ctx, txid, heights[i], states[i], hashes[i])
+		if err != nil {
+			return err
+		}
+		orphaned++
+	}
+	if orphaned > 0 {
+		c.health.setUnhealthy(reorgComponent, fmt.Errorf("%d exports in blocks after %d replaced after peg-out; see the orphaned_exports table", orphaned, fork))
+	}
+	return nil
+}
+
+// reverseExport forgets export txid, from the block at height,
+// and its pending peg-out,
+// if the export is still at version and not being pegged out.
+// It reports whether it did.
+func (c *Custodian) reverseExport(ctx context.Context, txid []byte, version int64, height uint64) (bool, error) {
+	// pegOutFromExports marks an export in flight before claiming it,
+	// so one claimed after the check fails the version check below.
+	c.inFlightMu.Lock()
+	inFlight := bytes.Equal(c.inFlight, txid)
+	c.inFlightMu.Unlock()
+	if inFlight {
+		return false, nil
+	}
+
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	const q = `DELETE FROM exports WHERE txid = $1 AND version = $2 AND pegged_out IN ($3, $4, $5, $6, $7, $8)`
+	result, err := dbtx.ExecContext(ctx, q, txid, version, pegOutNotYet, pegOutRetry, pegOutNoTrust, pegOutUnsigned, pegOutDust, pegOutHeld)
+	if err != nil {
+		return false, errors.Wrapf(err, "reversing export %x", txid)
+	}
+	numAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "checking rows affected by reversing export %x", txid)
+	}
+	if numAffected == 0 {
+		return false, nil
+	}
+	// Tranches and offline bundles are prepared before peg-out.
+	for _, q := range []string{
+		`DELETE FROM tranches WHERE export_txid = $1`,
+		`DELETE FROM offline_pegouts WHERE export_txid = $1`,
+	} {
+		_, err = dbtx.ExecContext(ctx, q, txid)
+		if err != nil {
+			return false, errors.Wrapf(err, "reversing peg-out of export %x", txid)
+		}
+	}
+	err = appendEvent(ctx, dbtx, Event{
+		Type:     EventExportOrphaned,
+		TxVMTxID: txid,
+		State:    pegOutNotYet,
+		Reason:   fmt.Sprintf("block %d replaced before peg-out", height),
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, errors.Wrapf(dbtx.Commit(), "reversing export %x", txid)
+}
+
+// recordOrphanedExport records that export txid, from the block at height,
+// was in a replaced block after its peg-out reached state.
+func (c *Custodian) recordOrphanedExport(ctx context.Context, txid []byte, height uint64, state pegOutState, zioncoinTx string) error {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	const q = `INSERT OR REPLACE INTO orphaned_exports (txid, block_height, pegged_out, zioncoin_tx, custodian_id, detected_ms) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err = dbtx.ExecContext(ctx, q, txid, height, state, zioncoinTx, c.label, int64(bc.Millis(time.Now())))
+	if err != nil {
+		return errors.Wrapf(err, "recording orphaned export %x", txid)
+	}
+	err = appendEvent(ctx, dbtx, Event{
+		Type:       EventExportOrphaned,
+		TxVMTxID:   txid,
+		ZioncoinTx: zioncoinTx,
+		State:      state,
+		Reason:     fmt.Sprintf("block %d replaced after peg-out", height),
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(dbtx.Commit(), "recording orphaned export %x", txid)
+}
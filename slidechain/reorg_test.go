@@ -0,0 +1,102 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+)
+
+func TestRewindExports(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exports := []struct {
+			txid   string
+			height uint64
+			state  pegOutState
+			want   string // "kept", "reversed", or "orphaned"
+		}{
+			{"before-fork", 3, pegOutNotYet, "kept"},
+			{"not-yet", 5, pegOutNotYet, "reversed"},
+			{"unsigned", 5, pegOutUnsigned, "reversed"},
+			{"failed", 5, pegOutFail, "kept"},
+			{"pegged-out", 6, pegOutOK, "orphaned"},
+			{"pending", 6, pegOutPending, "orphaned"},
+			{"in-flight", 6, pegOutNotYet, "orphaned"},
+		}
+		for _, e := range exports {
+			insertTestExport(t, db, []byte(e.txid), lumenXDR, 100, importTestAccountID)
+			_, err = db.Exec(`UPDATE exports SET block_height = $1, pegged_out = $2, custodian_id = $3 WHERE txid = $4`, e.height, e.state, c.label, []byte(e.txid))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = db.Exec(`INSERT INTO offline_pegouts (export_txid, bundle_json) VALUES ($1, '{}')`, []byte("unsigned"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO tranches (export_txid, idx, amount) VALUES ($1, 1, 50)`, []byte("unsigned"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.setInFlight([]byte("in-flight"))
+
+		// Blocks 5 and 6 are replaced.
+		err = c.rewindExports(ctx, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, e := range exports {
+			var recorded, orphaned bool
+			err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM exports WHERE txid = $1), EXISTS (SELECT 1 FROM orphaned_exports WHERE txid = $1)`, []byte(e.txid)).Scan(&recorded, &orphaned)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			switch {
+			case orphaned:
+				got = "orphaned"
+			case recorded:
+				got = "kept"
+			default:
+				got = "reversed"
+			}
+			if got != e.want {
+				t.Errorf("export %s in block %d in state %d: got %s, want %s", e.txid, e.height, e.state, got, e.want)
+			}
+		}
+		var leftovers int
+		err = db.QueryRow(`SELECT (SELECT COUNT(*) FROM offline_pegouts) + (SELECT COUNT(*) FROM tranches)`).Scan(&leftovers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leftovers != 0 {
+			t.Errorf("got %d offline bundles and tranches of reversed exports, want 0", leftovers)
+		}
+		var events int
+		err = db.QueryRow(`SELECT COUNT(*) FROM events WHERE type = $1`, EventExportOrphaned).Scan(&events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if events != 5 {
+			t.Errorf("got %d %s events, want 5", events, EventExportOrphaned)
+		}
+
+		w := httptest.NewRecorder()
+		c.Health(w, httptest.NewRequest("GET", "/health", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("got health status %d after orphaning pegged-out exports, want %d", w.Code, http.StatusServiceUnavailable)
+		}
+	})
+}
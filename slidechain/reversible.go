@@ -0,0 +1,159 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interzioncoin/slingshot/slidechain/net"
+)
+
+// ExportCancellation cancels a reversible export
+// (see ExportOptions.Window).
+type ExportCancellation struct {
+	ExportTxID []byte `json:"export_txid"`
+
+	// Signature is by the key that signed the export tx
+	// (see SignExportCancellation).
+	Signature []byte `json:"signature"`
+}
+
+// SignExportCancellation returns the cancellation of export tx txid
+// signed by prv, the key that signed the export.
+func SignExportCancellation(txid []byte, prv ed25519.PrivateKey) ExportCancellation {
+	return ExportCancellation{
+		ExportTxID: txid,
+		Signature:  ed25519.Sign(prv, exportCancellationMsg(txid)),
+	}
+}
+
+// exportCancellationMsg is the message signed to cancel export tx txid.
+func exportCancellationMsg(txid []byte) []byte {
+	return append([]byte("slidechain export cancellation "), txid...)
+}
+
+// exportPayoutAfter returns the time, in milliseconds since 1970,
+// before which the export described by info must not be pegged out,
+// given the timestamp of the block containing it.
+// It is zero for an irreversible export.
+func exportPayoutAfter(blockMS uint64, info pegOut) int64 {
+	if info.WindowMS <= 0 {
+		return 0
+	}
+	return int64(blockMS) + info.WindowMS
+}
+
+// CancelExport cancels a reversible export whose window has not closed.
+// The export is marked failed,
+// so watchPegOuts refunds the retired funds to the exporter on slidechain
+// instead of pegging them out.
+// The exporter can then reclaim the lumens of its temp account with CancelPreExport.
+func (c *Custodian) CancelExport(ctx context.Context, cancellation ExportCancellation) error {
+	if c.observer {
+		return errObserver
+	}
+	txid := cancellation.ExportTxID
+	var (
+		ref           []byte
+		state         pegOutState
+		payoutAfterMS int64
+		version       int64
+	)
+	err := c.DB.QueryRowContext(ctx, `SELECT pegout_json, pegged_out, payout_after_ms, version FROM exports WHERE txid=$1 AND custodian_id=$2`, txid, c.label).Scan(&ref, &state, &payoutAfterMS, &version)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no pending export %x", txid)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "reading export %x", txid)
+	}
+	var p pegOut
+	err = decodeRefdata(ref, &p)
+	if err != nil {
+		return errors.Wrapf(err, "unmarshaling reference data of export %x", txid)
+	}
+	if payoutAfterMS == 0 {
+		return fmt.Errorf("export %x is not reversible", txid)
+	}
+	if len(p.Pubkey) != ed25519.PublicKeySize || !ed25519.Verify(p.Pubkey, exportCancellationMsg(txid), cancellation.Signature) {
+		return fmt.Errorf("cancellation of export %x is not signed by its exporter", txid)
+	}
+
+	// The window is checked again in the update,
+	// so a cancellation cannot race a peg-out that found the window closed,
+	// and the version is checked so it cannot overwrite a concurrent change.
+	nowMS := int64(bc.Millis(time.Now()))
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+	result, err := dbtx.ExecContext(ctx, `UPDATE exports SET pegged_out=$1, version=version+1 WHERE txid=$2 AND pegged_out=$3 AND payout_after_ms > $4 AND version=$5`, pegOutFail, txid, pegOutNotYet, nowMS, version)
+	if err != nil {
+		return errors.Wrapf(err, "canceling export %x", txid)
+	}
+	numAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "checking rows affected by canceling export %x", txid)
+	}
+	if numAffected == 0 {
+		return fmt.Errorf("export %x not canceled: its window closed at %s, or it changed concurrently", txid, bc.FromMillis(uint64(payoutAfterMS)))
+	}
+	_, err = dbtx.ExecContext(ctx, `INSERT OR IGNORE INTO export_failures (txid, reason) VALUES ($1, $2)`, txid, "canceled by exporter")
+	if err != nil {
+		return errors.Wrapf(err, "recording failure reason for export tx %x", txid)
+	}
+	err = dbtx.Commit()
+	if err != nil {
+		return errors.Wrapf(err, "committing cancellation of export %x", txid)
+	}
+	log.Printf("canceled export %x; refunding %d of Zioncoin %x to %s", txid, p.Amount, p.AssetXDR, p.Exporter)
+	return nil
+}
+
+// wakeForDeferredExports arranges to wake pegOutFromExports
+// when the earliest window of the pending reversible exports closes,
+// or the earliest backoff of the retried peg-outs elapses,
+// if any is still pending at nowMS.
+func (c *Custodian) wakeForDeferredExports(ctx context.Context, nowMS int64) error {
+	const q = `SELECT MIN(MAX(payout_after_ms, next_attempt_ms)) FROM exports WHERE pegged_out IN ($1, $2) AND MAX(payout_after_ms, next_attempt_ms) > $3 AND custodian_id=$4`
+	var next sql.NullInt64
+	err := c.DB.QueryRowContext(ctx, q, pegOutNotYet, pegOutRetry, nowMS, c.label).Scan(&next)
+	if err != nil {
+		return errors.Wrap(err, "reading next deferred export")
+	}
+	if c.windowTimer != nil {
+		c.windowTimer.Stop()
+	}
+	if next.Valid {
+		c.windowTimer = time.AfterFunc(time.Duration(next.Int64-nowMS)*time.Millisecond, c.exports.Broadcast)
+	}
+	return nil
+}
+
+// CancelExportHandler cancels the reversible export
+// described by the JSON ExportCancellation in the body of a POST request.
+func (c *Custodian) CancelExportHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	var cancellation ExportCancellation
+	err := json.NewDecoder(req.Body).Decode(&cancellation)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "decoding cancellation: %s", err)
+		return
+	}
+	err = c.CancelExport(req.Context(), cancellation)
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,175 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestReversibleExport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// The window is in the reference data the exporter signs.
+	_, exporterPrv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempKP, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var anchor [32]byte
+	tx, _, err := BuildExportTxWithOptions(ctx, zioncoin.NativeAsset(), 50, 50, tempKP.Address(), anchor[:], exporterPrv, 1, ExportOptions{Window: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := InspectExportTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info pegOut
+	err = json.Unmarshal(ref, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := exportPayoutAfter(1000, info), int64(1000+time.Hour/time.Millisecond); got != want {
+		t.Errorf("got payout after %d for a one-hour window from 1000, want %d", got, want)
+	}
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		c.hclient = hclient
+
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubkey := exporterPrv.Public().(ed25519.PublicKey)
+		insertReversible := func(txid []byte, payoutAfter time.Time) {
+			temp, err := keypair.Random()
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := pegOut{
+				AssetXDR: lumenXDR,
+				TempAddr: temp.Address(),
+				Seqnum:   1,
+				Exporter: exporter.Address(),
+				Amount:   100,
+				Anchor:   make([]byte, 32),
+				Pubkey:   pubkey,
+				WindowMS: int64(time.Hour / time.Millisecond),
+			}
+			ref, err := json.Marshal(info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.recordExport(ctx, txid, ref, info, int64(bc.Millis(payoutAfter)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		exportState := func(txid []byte) pegOutState {
+			var state pegOutState
+			err := db.QueryRow("SELECT pegged_out FROM exports WHERE txid=$1", txid).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return state
+		}
+
+		expiring, canceled, closed := []byte("expiring"), []byte("canceled"), []byte("closed")
+		expiry := time.Now().Add(time.Second)
+		insertReversible(expiring, expiry)
+		insertReversible(canceled, time.Now().Add(time.Hour))
+
+		// Only the export whose window closes is pegged out, and only once it closes.
+		pegOutCtx, cancelPegOuts := context.WithCancel(ctx)
+		pegouts := make(chan pegOut)
+		done := make(chan struct{})
+		go func() {
+			c.pegOutFromExports(pegOutCtx, pegouts)
+			close(done)
+		}()
+	waitPegOut:
+		for {
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for the window to close")
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			case p := <-pegouts:
+				if now := time.Now(); now.Before(expiry) {
+					t.Fatalf("pegged out export %x %s before its window closed", p.TxID, expiry.Sub(now))
+				}
+				if string(p.TxID) != string(expiring) || p.State != pegOutOK {
+					t.Fatalf("got peg-out of export %q in state %d, want %q in state %d", p.TxID, p.State, expiring, pegOutOK)
+				}
+				break waitPegOut
+			}
+		}
+		cancelPegOuts()
+		for range pegouts {
+		}
+		<-done
+		if hclient.submitted != 1 {
+			t.Errorf("got %d submitted txs, want 1", hclient.submitted)
+		}
+		if state := exportState(canceled); state != pegOutNotYet {
+			t.Fatalf("export in its window has state %d, want %d", state, pegOutNotYet)
+		}
+
+		// Within the window, only the exporter can cancel.
+		_, otherPrv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.CancelExport(ctx, SignExportCancellation(canceled, otherPrv))
+		if err == nil {
+			t.Error("canceled an export with another key")
+		}
+		err = c.CancelExport(ctx, SignExportCancellation(canceled, exporterPrv))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state := exportState(canceled); state != pegOutFail {
+			t.Errorf("canceled export has state %d, want %d for refund", state, pegOutFail)
+		}
+		var reason string
+		err = db.QueryRow("SELECT reason FROM export_failures WHERE txid=$1", canceled).Scan(&reason)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason != "canceled by exporter" {
+			t.Errorf("got failure reason %q for canceled export", reason)
+		}
+
+		// Neither an export whose window has closed nor an irreversible one can be canceled.
+		insertReversible(closed, time.Now().Add(-time.Second))
+		err = c.CancelExport(ctx, SignExportCancellation(closed, exporterPrv))
+		if err == nil {
+			t.Error("canceled an export after its window closed")
+		}
+		if state := exportState(closed); state != pegOutNotYet {
+			t.Errorf("export canceled after its window has state %d, want %d", state, pegOutNotYet)
+		}
+		irreversible := []byte("irreversible")
+		insertTestExport(t, db, irreversible, lumenXDR, 100, exporter.Address())
+		err = c.CancelExport(ctx, SignExportCancellation(irreversible, exporterPrv))
+		if err == nil {
+			t.Error("canceled an irreversible export")
+		}
+	})
+}
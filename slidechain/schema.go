@@ -2,19 +2,34 @@ package slidechain
 
 const schema = `
 CREATE TABLE IF NOT EXISTS blocks (
-  height INTEGER NOT NULL PRIMARY KEY,
-  hash BLOB NOT NULL UNIQUE,
-  bits BLOB NOT NULL
+  custodian_id TEXT NOT NULL DEFAULT '',
+  height INTEGER NOT NULL,
+  hash BLOB NOT NULL,
+  bits BLOB NOT NULL,
+  PRIMARY KEY (custodian_id, height),
+  UNIQUE (custodian_id, hash)
 );
 
 CREATE TABLE IF NOT EXISTS snapshots (
-  height INTEGER NOT NULL PRIMARY KEY,
-  bits BLOB NOT NULL
+  custodian_id TEXT NOT NULL DEFAULT '',
+  height INTEGER NOT NULL,
+  bits BLOB NOT NULL,
+  PRIMARY KEY (custodian_id, height)
 );
 
 CREATE TABLE IF NOT EXISTS pins (
-  name TEXT NOT NULL PRIMARY KEY,
-  height INTEGER NOT NULL DEFAULT 0
+  custodian_id TEXT NOT NULL DEFAULT '',
+  name TEXT NOT NULL,
+  height INTEGER NOT NULL DEFAULT 0,
+  PRIMARY KEY (custodian_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS pin_hashes (
+  custodian_id TEXT NOT NULL DEFAULT '',
+  name TEXT NOT NULL,
+  height INTEGER NOT NULL,
+  hash BLOB NOT NULL,
+  PRIMARY KEY (custodian_id, name, height)
 );
 
 CREATE TABLE IF NOT EXISTS pegs (
@@ -25,17 +40,256 @@ CREATE TABLE IF NOT EXISTS pegs (
   imported INTEGER NOT NULL DEFAULT 0,
   zioncoin_tx INTEGER NOT NULL DEFAULT 0,
   nonce_expms INTEGER NOT NULL,
+  arrival INTEGER NOT NULL DEFAULT 0,
+  custodian_id TEXT NOT NULL DEFAULT '' REFERENCES custodian (label),
+  metadata TEXT NOT NULL DEFAULT '',
+  ledger INTEGER NOT NULL DEFAULT 0,
+  paid_ms INTEGER NOT NULL DEFAULT 0,
+  payer TEXT NOT NULL DEFAULT '',
   PRIMARY KEY (nonce_hash)
 );
 
+CREATE TABLE IF NOT EXISTS pegin_keys (
+  key TEXT NOT NULL PRIMARY KEY,
+  nonce_hash BLOB,
+  created_ms INTEGER NOT NULL,
+  request_hash BLOB NOT NULL DEFAULT x''
+);
+
+CREATE TABLE IF NOT EXISTS flagged_pegs (
+  txid TEXT NOT NULL,
+  nonce_hash BLOB NOT NULL,
+  source TEXT NOT NULL,
+  amount INTEGER NOT NULL,
+  asset_xdr BLOB NOT NULL,
+  reason TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS import_mismatches (
+  nonce_hash BLOB NOT NULL PRIMARY KEY,
+  txid BLOB NOT NULL,
+  reason TEXT NOT NULL,
+  custodian_id TEXT NOT NULL DEFAULT '' REFERENCES custodian (label)
+);
+
+CREATE TABLE IF NOT EXISTS refunds (
+  nonce_hash BLOB NOT NULL PRIMARY KEY,
+  payer TEXT NOT NULL,
+  asset_xdr BLOB NOT NULL,
+  amount INTEGER NOT NULL,
+  reason TEXT NOT NULL,
+  state INTEGER NOT NULL DEFAULT 0,
+  zioncoin_tx TEXT NOT NULL DEFAULT '',
+  recorded_ms INTEGER NOT NULL,
+  custodian_id TEXT NOT NULL DEFAULT '' REFERENCES custodian (label)
+);
+
 CREATE TABLE IF NOT EXISTS exports (
   txid BLOB NOT NULL PRIMARY KEY,
   pegged_out INTEGER NOT NULL DEFAULT 0,
-  pegout_json TEXT NOT NULL
+  pegout_json TEXT NOT NULL,
+  zioncoin_tx TEXT NOT NULL DEFAULT '',
+  payout_after_ms INTEGER NOT NULL DEFAULT 0,
+  version INTEGER NOT NULL DEFAULT 0,
+  custodian_id TEXT NOT NULL DEFAULT '' REFERENCES custodian (label),
+  recorded_ms INTEGER NOT NULL DEFAULT 0,
+  escalated_ms INTEGER NOT NULL DEFAULT 0,
+  asset_xdr BLOB,
+  amount INTEGER NOT NULL DEFAULT 0,
+  trace_parent TEXT NOT NULL DEFAULT '',
+  block_height INTEGER NOT NULL DEFAULT 0,
+  retries INTEGER NOT NULL DEFAULT 0,
+  next_attempt_ms INTEGER NOT NULL DEFAULT 0,
+  base_fee INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS orphaned_exports (
+  txid BLOB NOT NULL PRIMARY KEY,
+  block_height INTEGER NOT NULL,
+  pegged_out INTEGER NOT NULL,
+  zioncoin_tx TEXT NOT NULL DEFAULT '',
+  custodian_id TEXT NOT NULL DEFAULT '' REFERENCES custodian (label),
+  detected_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS export_failures (
+  txid BLOB NOT NULL PRIMARY KEY,
+  reason TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS policy_rejected (
+  txid BLOB NOT NULL PRIMARY KEY,
+  pegout_json BLOB NOT NULL,
+  reason TEXT NOT NULL,
+  custodian_id TEXT NOT NULL DEFAULT '' REFERENCES custodian (label),
+  rejected_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS pegout_rejections (
+  txid BLOB NOT NULL PRIMARY KEY,
+  reason TEXT NOT NULL,
+  custodian_id TEXT NOT NULL DEFAULT '' REFERENCES custodian (label),
+  rejected_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS tranches (
+  export_txid BLOB NOT NULL,
+  idx INTEGER NOT NULL,
+  amount INTEGER NOT NULL,
+  state INTEGER NOT NULL DEFAULT 0,
+  zioncoin_tx TEXT NOT NULL DEFAULT '',
+  PRIMARY KEY (export_txid, idx)
+);
+
+CREATE TABLE IF NOT EXISTS offline_pegouts (
+  export_txid BLOB NOT NULL PRIMARY KEY,
+  bundle_json TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS fees (
+  txid BLOB NOT NULL PRIMARY KEY,
+  asset_xdr BLOB NOT NULL,
+  amount INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS conversions (
+  export_txid BLOB NOT NULL PRIMARY KEY,
+  send_asset_xdr BLOB NOT NULL,
+  send_max INTEGER NOT NULL,
+  quoted_cost INTEGER NOT NULL,
+  dest_asset_xdr BLOB NOT NULL,
+  dest_amount INTEGER NOT NULL,
+  zioncoin_tx TEXT NOT NULL,
+  recorded_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS witness_log (
+  custodian_id TEXT NOT NULL DEFAULT '',
+  position INTEGER NOT NULL,
+  export_txid BLOB NOT NULL,
+  zioncoin_tx TEXT NOT NULL,
+  asset_xdr BLOB NOT NULL,
+  amount INTEGER NOT NULL,
+  destination TEXT NOT NULL,
+  timestamp_ms INTEGER NOT NULL,
+  prev_hash BLOB NOT NULL,
+  hash BLOB NOT NULL,
+  signature BLOB NOT NULL,
+  PRIMARY KEY (custodian_id, position)
+);
+
+CREATE TABLE IF NOT EXISTS burns (
+  txid BLOB NOT NULL PRIMARY KEY,
+  export_txid BLOB NOT NULL,
+  exporter BLOB NOT NULL,
+  recipient TEXT NOT NULL,
+  asset_xdr BLOB NOT NULL,
+  amount INTEGER NOT NULL,
+  timestamp_ms INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS sweeps (
+  zioncoin_tx TEXT NOT NULL PRIMARY KEY,
+  destination TEXT NOT NULL,
+  asset_xdr BLOB NOT NULL,
+  amount INTEGER NOT NULL,
+  timestamp_ms INTEGER NOT NULL,
+  custodian_id TEXT NOT NULL DEFAULT '' REFERENCES custodian (label)
+);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+  export_txid BLOB NOT NULL PRIMARY KEY,
+  payload TEXT NOT NULL,
+  delivered_ms INTEGER NOT NULL DEFAULT 0,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  next_attempt_ms INTEGER NOT NULL DEFAULT 0,
+  last_error TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS events (
+  seq INTEGER PRIMARY KEY AUTOINCREMENT,
+  type TEXT NOT NULL,
+  data TEXT NOT NULL,
+  timestamp_ms INTEGER NOT NULL
 );
 
 CREATE TABLE IF NOT EXISTS custodian (
   seed TEXT NOT NULL PRIMARY KEY,
-  cursor TEXT NOT NULL DEFAULT ''
+  cursor TEXT NOT NULL DEFAULT '',
+  label TEXT NOT NULL DEFAULT '',
+  recovery_txid BLOB NOT NULL DEFAULT x''
 );
 `
+
+// addedColumns lists the columns added to tables in schema after their creation.
+// They are added to the tables of older dbs by setSchema.
+var addedColumns = []struct {
+	table, name, def string
+}{
+	{"custodian", "label", "TEXT NOT NULL DEFAULT ''"},
+	{"exports", "zioncoin_tx", "TEXT NOT NULL DEFAULT ''"},
+	{"pegs", "arrival", "INTEGER NOT NULL DEFAULT 0"},
+	{"exports", "payout_after_ms", "INTEGER NOT NULL DEFAULT 0"},
+	{"exports", "version", "INTEGER NOT NULL DEFAULT 0"},
+	{"pegs", "custodian_id", "TEXT NOT NULL DEFAULT '' REFERENCES custodian (label)"},
+	{"exports", "custodian_id", "TEXT NOT NULL DEFAULT '' REFERENCES custodian (label)"},
+	{"exports", "recorded_ms", "INTEGER NOT NULL DEFAULT 0"},
+	{"exports", "escalated_ms", "INTEGER NOT NULL DEFAULT 0"},
+	{"pegs", "metadata", "TEXT NOT NULL DEFAULT ''"},
+	{"pegs", "ledger", "INTEGER NOT NULL DEFAULT 0"},
+	{"pegs", "paid_ms", "INTEGER NOT NULL DEFAULT 0"},
+	{"exports", "asset_xdr", "BLOB"},
+	{"exports", "amount", "INTEGER NOT NULL DEFAULT 0"},
+	{"custodian", "recovery_txid", "BLOB NOT NULL DEFAULT x''"},
+	{"exports", "trace_parent", "TEXT NOT NULL DEFAULT ''"},
+	{"pegs", "payer", "TEXT NOT NULL DEFAULT ''"},
+	{"exports", "block_height", "INTEGER NOT NULL DEFAULT 0"},
+	{"exports", "retries", "INTEGER NOT NULL DEFAULT 0"},
+	{"exports", "next_attempt_ms", "INTEGER NOT NULL DEFAULT 0"},
+	{"exports", "base_fee", "INTEGER NOT NULL DEFAULT 0"},
+	{"pegin_keys", "request_hash", "BLOB NOT NULL DEFAULT x''"},
+}
+
+// scopedTables lists the tables scoped to their custodian (see Label)
+// after their creation, with the columns they had before.
+// custodian_id is part of their primary keys,
+// so setSchema rebuilds them in older dbs instead of adding the column,
+// giving their rows to the unlabeled custodian.
+var scopedTables = []struct {
+	table, columns string
+}{
+	{"blocks", "height, hash, bits"},
+	{"snapshots", "height, bits"},
+	{"pins", "name, height"},
+	{"pin_hashes", "name, height, hash"},
+}
+
+// tempAccountsSchema is the schema of the table
+// in which TempAccounts tracks the temp accounts of pre-exports.
+// It lives in the exporter's db, not the custodian's.
+const tempAccountsSchema = `
+CREATE TABLE IF NOT EXISTS temp_accounts (
+  address TEXT NOT NULL PRIMARY KEY,
+  exporter TEXT NOT NULL,
+  created_ms INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS temp_accounts_exporter ON temp_accounts (exporter);
+`
+
+// indexes, and views, may refer to columns in addedColumns.
+//
+// The stuck_exports view lists the exports escalated for missing their deadlines
+// (see ExportDeadline) that are neither pegged out (1) nor failed (3).
+const indexes = `
+CREATE UNIQUE INDEX IF NOT EXISTS custodian_label ON custodian (label);
+CREATE INDEX IF NOT EXISTS pegs_custodian ON pegs (custodian_id, zioncoin_tx, imported);
+CREATE INDEX IF NOT EXISTS exports_custodian ON exports (custodian_id, pegged_out);
+CREATE INDEX IF NOT EXISTS pegs_stats ON pegs (custodian_id, zioncoin_tx, imported, asset_xdr, amount);
+CREATE INDEX IF NOT EXISTS pegs_paid ON pegs (custodian_id, paid_ms, asset_xdr, amount);
+CREATE INDEX IF NOT EXISTS exports_stats ON exports (custodian_id, pegged_out, asset_xdr, amount);
+CREATE INDEX IF NOT EXISTS exports_recorded ON exports (custodian_id, recorded_ms, asset_xdr, amount);
+CREATE VIEW IF NOT EXISTS stuck_exports AS
+  SELECT txid, pegged_out, recorded_ms, escalated_ms, custodian_id FROM exports
+  WHERE escalated_ms > 0 AND pegged_out NOT IN (1, 3);
+`
@@ -0,0 +1,118 @@
+package slidechain
+
+import (
+	"context"
+	"sync"
+
+	"github.com/chain/txvm/errors"
+	b "github.com/zioncoin/go/build"
+	"github.com/zioncoin/go/xdr"
+)
+
+// Sequencer hands out the sequence numbers of the txs
+// submitted from the custodian account,
+// such as tranche payments, sweeps, and trustline authorizations,
+// so that txs built concurrently do not collide.
+type Sequencer interface {
+	// Next returns the sequence number for the next tx from account.
+	Next(account string) (xdr.SequenceNumber, error)
+
+	// Failed reports that the tx from account with sequence number seqnum
+	// could not be submitted,
+	// so that it and the numbers after it may not be used.
+	Failed(account string, seqnum xdr.SequenceNumber)
+}
+
+// CustodianSequencer causes the custodian to number its txs with s,
+// for instance one shared with other programs submitting from the custodian account.
+// By default the custodian numbers them itself,
+// counting up from the account's sequence number on the equator server.
+func CustodianSequencer(s Sequencer) Option {
+	return func(c *Custodian) {
+		c.sequencer = s
+	}
+}
+
+// sequencer is the default Sequencer.
+// It loads each account's sequence number with load when first needed,
+// and again after a failed tx,
+// and otherwise counts up from it.
+type sequencer struct {
+	load func(account string) (xdr.SequenceNumber, error)
+
+	mu       sync.Mutex
+	accounts map[string]*accountSeq
+}
+
+type accountSeq struct {
+	// last is the last sequence number handed out,
+	// and loaded the one last loaded.
+	last, loaded xdr.SequenceNumber
+}
+
+func (s *sequencer) Next(account string) (xdr.SequenceNumber, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.accounts[account]
+	if a == nil {
+		seqnum, err := s.load(account)
+		if err != nil {
+			return 0, errors.Wrapf(err, "loading sequence number of %s", account)
+		}
+		a = &accountSeq{last: seqnum, loaded: seqnum}
+		if s.accounts == nil {
+			s.accounts = make(map[string]*accountSeq)
+		}
+		s.accounts[account] = a
+	}
+	a.last++
+	return a.last, nil
+}
+
+func (s *sequencer) Failed(account string, seqnum xdr.SequenceNumber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A failure of a number handed out before the last load
+	// is already reflected in the loaded number.
+	if a := s.accounts[account]; a != nil && seqnum > a.loaded {
+		delete(s.accounts, account)
+	}
+}
+
+// custodianSequence is the b.SequenceProvider of txs from the custodian account.
+type custodianSequence struct {
+	s Sequencer
+}
+
+// SequenceForAccount returns one less than the next sequence number,
+// to which b.AutoSequence adds one.
+func (p custodianSequence) SequenceForAccount(account string) (xdr.SequenceNumber, error) {
+	seqnum, err := p.s.Next(account)
+	return seqnum - 1, err
+}
+
+// custodianTx builds a tx from the custodian account
+// with the next sequence number from the custodian's Sequencer.
+func (c *Custodian) custodianTx(muts ...b.TransactionMutator) (*b.TransactionBuilder, error) {
+	muts = append([]b.TransactionMutator{
+		b.Network{Passphrase: c.network},
+		b.SourceAccount{AddressOrSeed: c.AccountID.Address()},
+		b.AutoSequence{SequenceProvider: custodianSequence{c.sequencer}},
+		b.BaseFee{Amount: uint64(c.BaseFee)},
+	}, muts...)
+	return b.Transaction(muts...)
+}
+
+// submitCustodianTx signs and submits tx, built by custodianTx,
+// with the given hash (see signAndSubmitTx).
+// If it cannot be submitted,
+// its sequence number is reported to the custodian's Sequencer as failed.
+func (c *Custodian) submitCustodianTx(ctx context.Context, tx *b.TransactionBuilder, hash string) error {
+	err := c.signAndSubmitTx(ctx, tx, hash)
+	if err != nil {
+		c.sequencer.Failed(c.AccountID.Address(), tx.TX.SeqNum)
+	}
+	return err
+}
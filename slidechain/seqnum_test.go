@@ -0,0 +1,95 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/xdr"
+)
+
+func TestCustodianSequencer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		// Reject txs reusing a sequence number.
+		var (
+			mu     sync.Mutex
+			seqnum = xdr.SequenceNumber(100) // the highest used
+			used   = make(map[xdr.SequenceNumber]bool)
+			loads  int
+		)
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		hclient.sequenceForAccount = func(string) (xdr.SequenceNumber, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			loads++
+			return seqnum, nil
+		}
+		hclient.submitTransaction = func(txeBase64 string) (equator.TransactionSuccess, error) {
+			var env xdr.TransactionEnvelope
+			err := xdr.SafeUnmarshalBase64(txeBase64, &env)
+			if err != nil {
+				return equator.TransactionSuccess{}, err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if used[env.Tx.SeqNum] {
+				return equator.TransactionSuccess{}, errors.Wrapf(errors.New("tx_bad_seq"), "sequence number %d reused", env.Tx.SeqNum)
+			}
+			used[env.Tx.SeqNum] = true
+			if env.Tx.SeqNum > seqnum {
+				seqnum = env.Tx.SeqNum
+			}
+			return hclient.ClientInterface.SubmitTransaction(txeBase64)
+		}
+		c.hclient = hclient
+		cold, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sweep := func() error {
+			_, err := c.submitSweep(ctx, cold.Address(), zioncoin.NativeAsset(), 10)
+			return err
+		}
+
+		const n = 8
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			go func() { errs <- sweep() }()
+		}
+		for i := 0; i < n; i++ {
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := xdr.SequenceNumber(101); i <= 100+n; i++ {
+			if !used[i] {
+				t.Errorf("sequence number %d unused after %d concurrent txs", i, n)
+			}
+		}
+		if loads != 1 {
+			t.Errorf("got %d sequence number loads, want 1", loads)
+		}
+
+		// A failed tx leaves its number unused,
+		// so the next is numbered from a fresh load.
+		hclient.fails = 1
+		if err := sweep(); err == nil {
+			t.Fatal("got no error from failed submission")
+		}
+		if err := sweep(); err != nil {
+			t.Fatal(err)
+		}
+		if !used[101+n] || loads != 2 {
+			t.Errorf("after failure, got sequence number %d used %v with %d loads, want used with 2 loads", 101+n, used[101+n], loads)
+		}
+	})
+}
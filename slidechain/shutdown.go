@@ -0,0 +1,146 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+)
+
+// DefaultDrainTimeout is the default time Shutdown waits
+// for in-flight peg-outs to finish.
+const DefaultDrainTimeout = 30 * time.Second
+
+const drainPollInterval = 100 * time.Millisecond
+
+// DrainTimeout sets how long Shutdown waits for in-flight peg-outs to finish
+// before abandoning them (by default, DefaultDrainTimeout).
+// The timeout runs independently of the context passed to Shutdown.
+func DrainTimeout(d time.Duration) Option {
+	return func(c *Custodian) {
+		c.drainTimeout = d
+	}
+}
+
+// DrainError reports the peg-outs that Shutdown abandoned
+// when its drain timeout elapsed with them still in flight.
+// Their exports are left as they are,
+// to be settled by the next run of the custodian (or by Recover).
+type DrainError struct {
+	// Abandoned holds the txids of the exports
+	// whose peg-outs were abandoned.
+	Abandoned [][]byte
+}
+
+func (e *DrainError) Error() string {
+	return fmt.Sprintf("abandoned %d in-flight peg-out(s) after drain timeout", len(e.Abandoned))
+}
+
+// Shutdown stops the custodian.
+// It halts new peg-outs, tranche payments, and sweeps,
+// then waits up to the drain timeout (see DrainTimeout)
+// for the peg-out being submitted, if any,
+// and, with AsyncPegOuts, for the pending peg-outs to be confirmed.
+// It then stops the custodian's goroutines
+// and waits until they exit or ctx is done.
+// The drain timeout does not depend on ctx,
+// so ctx must allow for the drain as well.
+// If peg-outs were still in flight after the drain,
+// Shutdown returns a *DrainError listing them.
+func (c *Custodian) Shutdown(ctx context.Context) error {
+	if c.stop == nil {
+		return errors.New("custodian was not started")
+	}
+	if !atomic.CompareAndSwapInt32(&c.draining, 0, 1) {
+		return errors.New("custodian is already shutting down")
+	}
+	timeout := c.drainTimeout
+	if timeout <= 0 {
+		timeout = DefaultDrainTimeout
+	}
+	log.Printf("shutting down, draining in-flight peg-outs for up to %s", timeout)
+	abandoned := c.drain(timeout)
+
+	c.stop()
+	// Wake the goroutines waiting on imports and exports,
+	// so they see the cancellation.
+	for _, cond := range []*sync.Cond{c.imports, c.exports} {
+		cond.L.Lock()
+		cond.Broadcast()
+		cond.L.Unlock()
+	}
+	exited := make(chan struct{})
+	go func() {
+		c.running.Wait()
+		close(exited)
+	}()
+	select {
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "waiting for custodian goroutines to exit")
+	case <-exited:
+	}
+
+	if len(abandoned) > 0 {
+		for _, txid := range abandoned {
+			log.Printf("abandoned in-flight peg-out of export %x", txid)
+		}
+		return &DrainError{Abandoned: abandoned}
+	}
+	log.Print("custodian shut down")
+	return nil
+}
+
+// drain waits up to timeout for the custodian's in-flight peg-outs to finish.
+// It returns the txids of the exports of those still in flight.
+func (c *Custodian) drain(timeout time.Duration) [][]byte {
+	deadline := time.Now().Add(timeout)
+	for {
+		inFlight, err := c.inFlightPegOuts()
+		if err != nil {
+			log.Printf("listing in-flight peg-outs: %s", err)
+		} else if len(inFlight) == 0 {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return inFlight
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// inFlightPegOuts returns the txids of the exports
+// whose peg-outs pegOutFromExports is submitting
+// or, with AsyncPegOuts, are awaiting confirmation.
+func (c *Custodian) inFlightPegOuts() ([][]byte, error) {
+	var txids [][]byte
+	c.inFlightMu.Lock()
+	if c.inFlight != nil {
+		txids = append(txids, c.inFlight)
+	}
+	c.inFlightMu.Unlock()
+	if !c.asyncPegOuts {
+		return txids, nil
+	}
+	ctx, cancel := c.dbContext(context.Background())
+	defer cancel()
+	err := sqlutil.ForQueryRows(ctx, c.DB, `SELECT txid FROM exports WHERE pegged_out=$1 AND custodian_id=$2`, pegOutPending, c.label, func(txid []byte) {
+		if len(txids) > 0 && string(txids[0]) == string(txid) {
+			return
+		}
+		txids = append(txids, txid)
+	})
+	return txids, errors.Wrap(err, "querying pending exports")
+}
+
+// setInFlight records txid as the export pegOutFromExports is pegging out,
+// or, if it is nil, that it is pegging out none.
+func (c *Custodian) setInFlight(txid []byte) {
+	c.inFlightMu.Lock()
+	c.inFlight = txid
+	c.inFlightMu.Unlock()
+}
@@ -0,0 +1,90 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestShutdownDrainTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	const drainTimeout = 500 * time.Millisecond
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The peg-out tx is accepted but never applied,
+		// so the peg-out stays in flight.
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		_, async := holdAsync(hclient, false)
+		c.hclient = hclient
+
+		txid := []byte("inflight")
+		insertTestExport(t, db, txid, lumenXDR, 1000, exporter.Address())
+		exportState := func(txid []byte) pegOutState {
+			var state pegOutState
+			err := db.QueryRow("SELECT pegged_out FROM exports WHERE txid=$1", txid).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return state
+		}
+
+		c.launch(ctx)
+		for exportState(txid) != pegOutPending {
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for peg-out to be submitted")
+			case <-time.After(50 * time.Millisecond):
+				c.exports.Broadcast()
+			}
+		}
+
+		// Shutdown returns, after the drain, only once the goroutines have exited.
+		begin := time.Now()
+		err = c.Shutdown(ctx)
+		elapsed := time.Since(begin)
+		drainErr, ok := err.(*DrainError)
+		if !ok {
+			t.Fatalf("got error %v from Shutdown, want a *DrainError", err)
+		}
+		if len(drainErr.Abandoned) != 1 || string(drainErr.Abandoned[0]) != string(txid) {
+			t.Errorf("got abandoned exports %q, want [%q]", drainErr.Abandoned, txid)
+		}
+		if elapsed < drainTimeout || elapsed > drainTimeout+5*time.Second {
+			t.Errorf("got shutdown in %s, want about the drain timeout of %s", elapsed, drainTimeout)
+		}
+		if state := exportState(txid); state != pegOutPending {
+			t.Errorf("got abandoned export in state %d, want %d", state, pegOutPending)
+		}
+
+		// Nothing more is pegged out once the custodian is shut down.
+		late := []byte("late")
+		insertTestExport(t, db, late, lumenXDR, 1000, exporter.Address())
+		c.exports.Broadcast()
+		time.Sleep(200 * time.Millisecond)
+		if state := exportState(late); state != pegOutNotYet {
+			t.Errorf("got export in state %d after shutdown, want %d", state, pegOutNotYet)
+		}
+		if n := atomic.LoadInt32(async); n != 1 {
+			t.Errorf("got %d peg-out submissions, want 1", n)
+		}
+
+		err = c.Shutdown(ctx)
+		if err == nil {
+			t.Error("got no error shutting down twice")
+		}
+	}, AsyncPegOuts(), DrainTimeout(drainTimeout))
+}
@@ -285,7 +285,7 @@ func TestEndToEnd(t *testing.T) {
 		if err != nil {
 			t.Fatalf("error getting equator client root: %s", err)
 		}
-		accountID, seed, err := custodianAccount(ctx, db, hclient)
+		accountID, seed, err := custodianAccount(ctx, db, hclient, "")
 		if err != nil {
 			t.Fatalf("error creating custodian account: %s", err)
 		}
@@ -345,7 +345,7 @@ func TestEndToEnd(t *testing.T) {
 				t.Fatal("unsuccessfully waited on pre-peg-in tx hitting txvm")
 			}
 			uniqueNonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
-			err = c.insertPegIn(ctx, uniqueNonceHash[:], exporterPubKeyBytes[:], expMS)
+			err = c.insertPegIn(ctx, uniqueNonceHash[:], exporterPubKeyBytes[:], expMS, nil)
 			if err != nil {
 				t.Fatal("could not record peg")
 			}
@@ -543,6 +543,7 @@ func isImportTx(tx *bc.Tx, amount int64, assetXDR []byte, recipPubKey ed25519.Pu
 // {"I", ...}
 // {"X", ...}
 // {"L", ...}
+// {"L", ...} (burn record)
 // {"F", ...}
 //
 // Expected log for refund:
@@ -551,7 +552,7 @@ func isImportTx(tx *bc.Tx, amount int64, assetXDR []byte, recipPubKey ed25519.Pu
 // {"O", ...}
 // {"F", ...}
 func isPostPegOutTx(tx *bc.Tx, asset xdr.Asset, amount int64, tempAddr, exporter string, seqnum int64, anchor, pubkey []byte) bool {
-	if len(tx.Log) != 4 {
+	if len(tx.Log) != 4 && len(tx.Log) != 5 {
 		return false
 	}
 	if tx.Log[0][0].(txvm.Bytes)[0] != txvm.InputCode {
@@ -560,16 +561,16 @@ func isPostPegOutTx(tx *bc.Tx, asset xdr.Asset, amount int64, tempAddr, exporter
 	secondCode := tx.Log[1][0].(txvm.Bytes)[0]
 	thirdCode := tx.Log[2][0].(txvm.Bytes)[0]
 	var foundRetire, foundRefund bool
-	if secondCode == txvm.RetireCode && thirdCode == txvm.LogCode {
+	if len(tx.Log) == 5 && secondCode == txvm.RetireCode && thirdCode == txvm.LogCode {
 		foundRetire = true
 	}
-	if secondCode == txvm.LogCode && thirdCode == txvm.OutputCode {
+	if len(tx.Log) == 4 && secondCode == txvm.LogCode && thirdCode == txvm.OutputCode {
 		foundRefund = true
 	}
 	if !foundRetire && !foundRefund {
 		return false
 	}
-	if tx.Log[3][0].(txvm.Bytes)[0] != txvm.FinalizeCode {
+	if tx.Log[len(tx.Log)-1][0].(txvm.Bytes)[0] != txvm.FinalizeCode {
 		return false
 	}
 	assetXDR, err := asset.MarshalBinary()
@@ -0,0 +1,248 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interzioncoin/slingshot/slidechain/net"
+	"github.com/zioncoin/go/xdr"
+)
+
+// PegStats aggregates a custodian's peg-ins and exports.
+type PegStats struct {
+	// Since and Until bound the window
+	// covered by the Window amounts in Assets.
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+
+	PegIns  PegInCounts  `json:"pegins"`
+	Exports ExportCounts `json:"exports"`
+
+	// Assets holds the amounts pegged in and out of each asset,
+	// keyed by asset as in PegOutFees.
+	Assets map[string]*AssetStats `json:"assets"`
+}
+
+// PegInCounts counts pegs by state.
+type PegInCounts struct {
+	AwaitingPayment      int `json:"awaiting_payment"`
+	AwaitingConfirmation int `json:"awaiting_confirmation"`
+	AwaitingImport       int `json:"awaiting_import"`
+	Imported             int `json:"imported"`
+}
+
+// ExportCounts counts exports by peg-out state.
+type ExportCounts struct {
+	Pending   int `json:"pending"`
+	Retry     int `json:"retry"`
+	Unsigned  int `json:"unsigned"`
+	Settling  int `json:"settling"`
+	PeggedOut int `json:"pegged_out"`
+	Failed    int `json:"failed"`
+
+	// AwaitingTrustline counts exports awaiting their exporters' trustlines
+	// (see AwaitTrustlines).
+	AwaitingTrustline int `json:"awaiting_trustline"`
+
+	// AwaitingConfirmation counts exports whose peg-out txs
+	// were submitted asynchronously but are not yet seen applied
+	// (see AsyncPegOuts).
+	AwaitingConfirmation int `json:"awaiting_confirmation"`
+
+	// Dust counts exports held as dust (see FeePolicy.HoldDust).
+	Dust int `json:"dust"`
+
+	// Held counts exports whose peg-out txs were rejected by the validator,
+	// held for review (see PegOutValidator).
+	Held int `json:"held"`
+}
+
+// AssetStats holds the amounts, in stroops, of an asset
+// pegged in and out.
+type AssetStats struct {
+	// PeggedIn is the amount imported to slidechain,
+	// and PeggedOut the amount of exports pegged out in full.
+	PeggedIn  int64 `json:"pegged_in"`
+	PeggedOut int64 `json:"pegged_out"`
+
+	// WindowPaid is the amount of the peg-in payments
+	// recorded in the window,
+	// and WindowExported that of the exports recorded in it.
+	// Peg-in payments recorded before their time was kept
+	// fall in no window.
+	WindowPaid     int64 `json:"window_paid"`
+	WindowExported int64 `json:"window_exported"`
+}
+
+// Stats returns the custodian's PegStats,
+// with the window ending now and lasting window.
+//
+// Each total is computed from an index covering its query,
+// so Stats does not read the rows of the pegs and exports tables.
+// Exports recorded without their asset and amount in their own columns,
+// such as those of older dbs, have them filled in on first use.
+func (c *Custodian) Stats(ctx context.Context, window time.Duration) (PegStats, error) {
+	until := time.Now()
+	s := PegStats{
+		Since:  until.Add(-window),
+		Until:  until,
+		Assets: make(map[string]*AssetStats),
+	}
+	sinceMS := int64(bc.Millis(s.Since))
+
+	err := c.fillExportAmounts(ctx)
+	if err != nil {
+		return PegStats{}, err
+	}
+
+	// add adds amount of the asset with XDR assetXDR to the total chosen by field.
+	var addErr error
+	add := func(assetXDR []byte, amount int64, field func(*AssetStats) *int64) {
+		if len(assetXDR) == 0 || addErr != nil {
+			return
+		}
+		var asset xdr.Asset
+		err := xdr.SafeUnmarshal(assetXDR, &asset)
+		if err != nil {
+			addErr = errors.Wrapf(err, "unmarshaling asset %x", assetXDR)
+			return
+		}
+		a := s.Assets[asset.String()]
+		if a == nil {
+			a = new(AssetStats)
+			s.Assets[asset.String()] = a
+		}
+		*field(a) += amount
+	}
+
+	const pegsQ = `SELECT zioncoin_tx, imported, asset_xdr, COUNT(*), COALESCE(SUM(amount), 0) FROM pegs WHERE custodian_id=$1 GROUP BY zioncoin_tx, imported, asset_xdr`
+	err = sqlutil.ForQueryRows(ctx, c.DB, pegsQ, c.label, func(state, imported int, assetXDR []byte, n int, amount int64) {
+		switch {
+		case imported != 0:
+			s.PegIns.Imported += n
+			add(assetXDR, amount, func(a *AssetStats) *int64 { return &a.PeggedIn })
+		case state == pegUnpaid:
+			s.PegIns.AwaitingPayment += n
+		case state == pegConfirming:
+			s.PegIns.AwaitingConfirmation += n
+		default:
+			s.PegIns.AwaitingImport += n
+		}
+	})
+	if err != nil {
+		return PegStats{}, errors.Wrap(err, "totaling pegs")
+	}
+
+	const exportsQ = `SELECT pegged_out, asset_xdr, COUNT(*), SUM(amount) FROM exports WHERE custodian_id=$1 GROUP BY pegged_out, asset_xdr`
+	err = sqlutil.ForQueryRows(ctx, c.DB, exportsQ, c.label, func(state pegOutState, assetXDR []byte, n int, amount int64) {
+		switch state {
+		case pegOutNotYet:
+			s.Exports.Pending += n
+		case pegOutRetry:
+			s.Exports.Retry += n
+		case pegOutUnsigned:
+			s.Exports.Unsigned += n
+		case pegOutPartial:
+			s.Exports.Settling += n
+		case pegOutNoTrust:
+			s.Exports.AwaitingTrustline += n
+		case pegOutPending:
+			s.Exports.AwaitingConfirmation += n
+		case pegOutDust:
+			s.Exports.Dust += n
+		case pegOutHeld:
+			s.Exports.Held += n
+		case pegOutFail:
+			s.Exports.Failed += n
+		case pegOutOK:
+			s.Exports.PeggedOut += n
+			add(assetXDR, amount, func(a *AssetStats) *int64 { return &a.PeggedOut })
+		}
+	})
+	if err != nil {
+		return PegStats{}, errors.Wrap(err, "totaling exports")
+	}
+
+	const paidQ = `SELECT asset_xdr, SUM(amount) FROM pegs WHERE custodian_id=$1 AND paid_ms>=$2 GROUP BY asset_xdr`
+	err = sqlutil.ForQueryRows(ctx, c.DB, paidQ, c.label, sinceMS, func(assetXDR []byte, amount int64) {
+		add(assetXDR, amount, func(a *AssetStats) *int64 { return &a.WindowPaid })
+	})
+	if err != nil {
+		return PegStats{}, errors.Wrap(err, "totaling peg-in payments in window")
+	}
+
+	const exportedQ = `SELECT asset_xdr, SUM(amount) FROM exports WHERE custodian_id=$1 AND recorded_ms>=$2 GROUP BY asset_xdr`
+	err = sqlutil.ForQueryRows(ctx, c.DB, exportedQ, c.label, sinceMS, func(assetXDR []byte, amount int64) {
+		add(assetXDR, amount, func(a *AssetStats) *int64 { return &a.WindowExported })
+	})
+	if err != nil {
+		return PegStats{}, errors.Wrap(err, "totaling exports in window")
+	}
+	return s, addErr
+}
+
+// fillExportAmounts copies the asset and amount of each export
+// from its reference data into the exports table's own columns,
+// where they are missing.
+// An export whose reference data names no asset
+// is given an empty asset, so it is not read again.
+func (c *Custodian) fillExportAmounts(ctx context.Context) error {
+	type export struct {
+		txid     []byte
+		assetXDR []byte
+		amount   int64
+	}
+	var exports []export
+	const q = `SELECT txid, pegout_json FROM exports WHERE custodian_id=$1 AND asset_xdr IS NULL`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, c.label, func(txid, ref []byte) {
+		var p pegOut
+		// Unparseable reference data leaves p empty.
+		decodeRefdata(ref, &p)
+		e := export{txid: txid, assetXDR: p.AssetXDR, amount: p.Amount}
+		if e.assetXDR == nil {
+			e.assetXDR = []byte{}
+		}
+		exports = append(exports, e)
+	})
+	if err != nil {
+		return errors.Wrap(err, "querying exports without amounts")
+	}
+	for _, e := range exports {
+		_, err = c.DB.ExecContext(ctx, `UPDATE exports SET asset_xdr=$1, amount=$2 WHERE txid=$3`, e.assetXDR, e.amount, e.txid)
+		if err != nil {
+			return errors.Wrapf(err, "recording amount of export %x", e.txid)
+		}
+	}
+	return nil
+}
+
+// StatsHandler responds with the custodian's PegStats as JSON,
+// for the window given as a duration, such as 24h,
+// in the query parameter window (by default, 24 hours).
+func (c *Custodian) StatsHandler(w http.ResponseWriter, req *http.Request) {
+	window := 24 * time.Hour
+	if v := req.FormValue("window"); v != "" {
+		var err error
+		window, err = time.ParseDuration(v)
+		if err != nil || window < 0 {
+			net.Errorf(w, http.StatusBadRequest, "invalid window %q", v)
+			return
+		}
+	}
+	s, err := c.Stats(req.Context(), window)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "computing peg stats: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(s)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+		return
+	}
+}
@@ -0,0 +1,101 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestStats(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Three pegs: one unpaid, one paid, and one paid and imported.
+		var nonceHashes [][32]byte
+		for i := int64(1); i <= 3; i++ {
+			expMS := int64(bc.Millis(time.Now().Add(10*time.Minute))) + i
+			nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
+			err := c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, expMS, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonceHashes = append(nonceHashes, nonceHash)
+		}
+		err = c.recordPegIn(ctx, "tx1", "cursor", nonceHashes[1][:], "source", 10, lumenXDR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.recordPegIn(ctx, "tx2", "cursor", nonceHashes[2][:], "source", 20, lumenXDR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("UPDATE pegs SET imported=1 WHERE nonce_hash=$1", nonceHashes[2][:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Three exports: one recorded now and pegged out,
+		// one recorded now and pending,
+		// and one recorded long ago without its amount in its own column,
+		// and pegged out.
+		for i, amount := range []int64{30, 40} {
+			txid := []byte{byte(i)}
+			info := pegOut{AssetXDR: lumenXDR, Exporter: exporter.Address(), Amount: amount}
+			err = c.recordExport(ctx, txid, []byte("{}"), info, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		insertTestExport(t, db, []byte("old"), lumenXDR, 50, exporter.Address())
+		_, err = db.Exec("UPDATE exports SET pegged_out=$1 WHERE txid IN ($2, $3)", pegOutOK, []byte{0}, []byte("old"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := c.Stats(ctx, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantPegIns := PegInCounts{AwaitingPayment: 1, AwaitingImport: 1, Imported: 1}
+		if s.PegIns != wantPegIns {
+			t.Errorf("got peg-in counts %+v, want %+v", s.PegIns, wantPegIns)
+		}
+		wantExports := ExportCounts{Pending: 1, PeggedOut: 2}
+		if s.Exports != wantExports {
+			t.Errorf("got export counts %+v, want %+v", s.Exports, wantExports)
+		}
+		a := s.Assets["native"]
+		if a == nil {
+			t.Fatalf("got no stats for native asset, got %v", s.Assets)
+		}
+		want := AssetStats{PeggedIn: 20, PeggedOut: 80, WindowPaid: 30, WindowExported: 70}
+		if *a != want {
+			t.Errorf("got native asset stats %+v, want %+v", *a, want)
+		}
+
+		// The export recorded without its amount now has it.
+		var amount int64
+		err = db.QueryRow("SELECT amount FROM exports WHERE txid=$1", []byte("old")).Scan(&amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if amount != 50 {
+			t.Errorf("got amount %d for old export, want 50", amount)
+		}
+	})
+}
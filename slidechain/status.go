@@ -0,0 +1,297 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interzioncoin/slingshot/slidechain/net"
+)
+
+// Status describes the current state of a custodian.
+type Status struct {
+	Label         string   `json:"label,omitempty"`
+	AccountID     string   `json:"account_id"`
+	InitBlockID   string   `json:"initial_block_id"`
+	PegOutsPaused bool     `json:"pegouts_paused"`
+	Observer      bool     `json:"observer,omitempty"`
+	Problems      []string `json:"problems,omitempty"`
+
+	// Ingestion reports how far Horizon's ingestion trails Zioncoin Core,
+	// distinguishing a stuck custodian from a Horizon that is catching up.
+	Ingestion *IngestionStatus `json:"equator_ingestion,omitempty"`
+
+	// RateLimit reports Horizon's rate-limit budget for the custodian,
+	// once Horizon has reported one.
+	RateLimit *RateLimitStatus `json:"equator_rate_limit,omitempty"`
+
+	// Protocol reports the Zioncoin network's protocol version
+	// and the latest version the custodian supports.
+	Protocol *ProtocolStatus `json:"zioncoin_protocol,omitempty"`
+
+	PegIns  PegInStatus  `json:"pegins"`
+	Exports ExportStatus `json:"exports"`
+}
+
+// PegInStatus describes the progress of peg-ins.
+type PegInStatus struct {
+	// Cursor is the Horizon cursor from which the custodian streams peg-ins,
+	// and CursorLedger the ledger it refers to (zero if unknown).
+	// Comparing CursorLedger with Horizon's latest ledger
+	// gives the lag since the last peg-in was observed.
+	Cursor       string `json:"cursor"`
+	CursorLedger int32  `json:"cursor_ledger"`
+
+	AwaitingPayment int `json:"awaiting_payment"`
+	AwaitingImport  int `json:"awaiting_import"`
+
+	// AwaitingConfirmation counts the paid pegs
+	// whose import is deferred until their payments are confirmed
+	// (see PegInConfirmations).
+	AwaitingConfirmation int `json:"awaiting_confirmation"`
+}
+
+// ExportStatus counts recorded exports by peg-out state.
+type ExportStatus struct {
+	Pending   int `json:"pending"`
+	Retry     int `json:"retry"`
+	Failed    int `json:"failed"`
+	PeggedOut int `json:"pegged_out"`
+
+	// Settling counts peg-outs split into tranches
+	// whose tranches are not all paid.
+	Settling int `json:"settling"`
+
+	// Unsigned counts exports whose peg-out tx awaits an offline signature
+	// (see OfflineSigning).
+	Unsigned int `json:"unsigned"`
+
+	// AwaitingConfirmation counts exports whose peg-out txs
+	// were submitted asynchronously but are not yet seen applied
+	// (see AsyncPegOuts).
+	AwaitingConfirmation int `json:"awaiting_confirmation"`
+
+	// AwaitingTrustline lists the exports awaiting their exporters' trustlines
+	// to the exported assets (see AwaitTrustlines).
+	// Each exporter must add the trustline for its export to be pegged out.
+	AwaitingTrustline []AwaitingTrustline `json:"awaiting_trustline,omitempty"`
+
+	// Backlog counts the exports awaiting peg-out (Pending, Retry, and Unsigned).
+	// When it reaches BacklogLimit, if set,
+	// new exports are deferred (see MaxExportBacklog).
+	Backlog      int `json:"backlog"`
+	BacklogLimit int `json:"backlog_limit,omitempty"`
+
+	// Stuck counts the exports not settled by their deadlines
+	// (see ExportDeadline).
+	Stuck int `json:"stuck"`
+
+	// Dust lists the exports held as dust
+	// until their exporters' held exports add up to the dust threshold
+	// (see FeePolicy.HoldDust).
+	Dust []DustExport `json:"dust,omitempty"`
+}
+
+// Status responds with the custodian's current Status as JSON.
+func (c *Custodian) Status(w http.ResponseWriter, req *http.Request) {
+	s := Status{
+		Label:         c.label,
+		AccountID:     c.AccountID.Address(),
+		InitBlockID:   hex.EncodeToString(c.InitBlockHash.Bytes()),
+		PegOutsPaused: c.pegOutsPaused(),
+		Observer:      c.observer,
+		Problems:      c.health.problems(),
+		Ingestion:     c.ingestionStatus(),
+		RateLimit:     c.rateLimits.rateLimitStatus(),
+		Protocol:      c.protocolStatus(),
+	}
+	err := c.pegStatus(req.Context(), &s)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading peg status: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(s)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+		return
+	}
+}
+
+// pegStatus fills in the PegIns and Exports fields of s from the db.
+func (c *Custodian) pegStatus(ctx context.Context, s *Status) error {
+	cur, err := c.pegInCursor(ctx)
+	if err != nil {
+		return err
+	}
+	s.PegIns.Cursor = string(cur)
+	if n, err := strconv.ParseInt(string(cur), 10, 64); err == nil {
+		s.PegIns.CursorLedger = int32(n >> 32)
+	}
+	const pegsQ = `SELECT COALESCE(SUM(zioncoin_tx=0), 0), COALESCE(SUM(zioncoin_tx=1 AND imported=0), 0), COALESCE(SUM(zioncoin_tx=2), 0) FROM pegs WHERE custodian_id=$1`
+	err = c.DB.QueryRowContext(ctx, pegsQ, c.label).Scan(&s.PegIns.AwaitingPayment, &s.PegIns.AwaitingImport, &s.PegIns.AwaitingConfirmation)
+	if err != nil {
+		return errors.Wrap(err, "counting pegs")
+	}
+	rows, err := c.DB.QueryContext(ctx, `SELECT pegged_out, COUNT(*) FROM exports WHERE custodian_id=$1 GROUP BY pegged_out`, c.label)
+	if err != nil {
+		return errors.Wrap(err, "counting exports")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			state pegOutState
+			n     int
+		)
+		err = rows.Scan(&state, &n)
+		if err != nil {
+			return errors.Wrap(err, "scanning export count")
+		}
+		switch state {
+		case pegOutNotYet:
+			s.Exports.Pending = n
+		case pegOutRetry:
+			s.Exports.Retry = n
+		case pegOutFail:
+			s.Exports.Failed = n
+		case pegOutOK:
+			s.Exports.PeggedOut = n
+		case pegOutPartial:
+			s.Exports.Settling = n
+		case pegOutUnsigned:
+			s.Exports.Unsigned = n
+		case pegOutPending:
+			s.Exports.AwaitingConfirmation = n
+		}
+	}
+	s.Exports.Backlog = s.Exports.Pending + s.Exports.Retry + s.Exports.Unsigned
+	s.Exports.BacklogLimit = c.maxExportBacklog
+	err = rows.Err()
+	if err != nil {
+		return errors.Wrap(err, "counting exports")
+	}
+	s.Exports.AwaitingTrustline, err = c.awaitingTrustlines(ctx)
+	if err != nil {
+		return err
+	}
+	s.Exports.Stuck, err = c.stuckExports(ctx)
+	if err != nil {
+		return err
+	}
+	s.Exports.Dust, err = c.heldDust(ctx)
+	return err
+}
+
+// PegIn describes a single peg-in.
+type PegIn struct {
+	NonceHash []byte `json:"nonce_hash"`
+	Paid      bool   `json:"paid"`
+	Imported  bool   `json:"imported"`
+
+	// Confirming is true while the import of a paid peg-in is deferred
+	// until its payment is confirmed (see PegInConfirmations).
+	Confirming bool `json:"confirming,omitempty"`
+
+	// Amount and AssetXDR are those of the peg-in payment,
+	// once Paid.
+	Amount   int64  `json:"amount,omitempty"`
+	AssetXDR []byte `json:"asset_xdr,omitempty"`
+
+	// Metadata is that given in the peg's PrePegIn, if any.
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+// PegIn returns the peg-in with the given nonce hash.
+// It returns an error wrapping sql.ErrNoRows if there is none.
+func (c *Custodian) PegIn(ctx context.Context, nonceHash []byte) (*PegIn, error) {
+	p := &PegIn{NonceHash: nonceHash}
+	var (
+		paid, imported int
+		metadata       string
+	)
+	const q = `SELECT zioncoin_tx, imported, COALESCE(amount, 0), asset_xdr, metadata FROM pegs WHERE nonce_hash=$1 AND custodian_id=$2`
+	err := c.DB.QueryRowContext(ctx, q, nonceHash, c.label).Scan(&paid, &imported, &p.Amount, &p.AssetXDR, &metadata)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading peg with nonce hash %x", nonceHash)
+	}
+	p.Paid = paid != pegUnpaid
+	p.Confirming = paid == pegConfirming
+	p.Imported = imported != 0
+	if metadata != "" {
+		p.Metadata = json.RawMessage(metadata)
+	}
+	return p, nil
+}
+
+// PegInHandler responds with the PegIn, as JSON,
+// with the hex-encoded nonce hash given in the query parameter nonce_hash.
+func (c *Custodian) PegInHandler(w http.ResponseWriter, req *http.Request) {
+	nonceHash, err := hex.DecodeString(req.FormValue("nonce_hash"))
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "decoding nonce hash: %s", err)
+		return
+	}
+	p, err := c.PegIn(req.Context(), nonceHash)
+	if errors.Root(err) == sql.ErrNoRows {
+		net.Errorf(w, http.StatusNotFound, "no peg with nonce hash %x", nonceHash)
+		return
+	}
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(p)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+		return
+	}
+}
+
+// PausePegOuts stops the custodian from submitting peg-out transactions.
+// Exports continue to be observed and recorded,
+// and are pegged out once ResumePegOuts is called.
+func (c *Custodian) PausePegOuts() {
+	if atomic.CompareAndSwapInt32(&c.paused, 0, 1) {
+		log.Print("pausing peg-outs")
+	}
+}
+
+// ResumePegOuts resumes peg-outs after a call to PausePegOuts,
+// including those of exports recorded while paused.
+func (c *Custodian) ResumePegOuts() {
+	if atomic.CompareAndSwapInt32(&c.paused, 1, 0) {
+		log.Print("resuming peg-outs")
+	}
+	c.exports.Broadcast()
+}
+
+func (c *Custodian) pegOutsPaused() bool {
+	return atomic.LoadInt32(&c.paused) != 0
+}
+
+// PausePegOutsHandler pauses peg-outs in response to a POST request.
+func (c *Custodian) PausePegOutsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	c.PausePegOuts()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResumePegOutsHandler resumes peg-outs in response to a POST request.
+func (c *Custodian) ResumePegOutsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	c.ResumePegOuts()
+	w.WriteHeader(http.StatusNoContent)
+}
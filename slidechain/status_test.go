@@ -0,0 +1,78 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestStatusCounts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		for i := int64(0); i < 3; i++ {
+			nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS+i)
+			err := c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, expMS+i, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				continue
+			}
+			err = c.recordPegIn(ctx, "txid", fmt.Sprint(int64(1000)<<32), nonceHash[:], "source", 10, []byte("asset"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		states := []pegOutState{pegOutNotYet, pegOutNotYet, pegOutRetry, pegOutFail, pegOutOK}
+		for i, state := range states {
+			txid := []byte(fmt.Sprintf("export %d", i))
+			insertTestExport(t, db, txid, lumenXDR, 100, exporter.Address())
+			_, err = db.Exec("UPDATE exports SET pegged_out=$1 WHERE txid=$2", state, txid)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		c.Status(w, httptest.NewRequest("GET", "/status", nil))
+		var status Status
+		err = json.Unmarshal(w.Body.Bytes(), &status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantPegIns := PegInStatus{
+			Cursor:          fmt.Sprint(int64(1000) << 32),
+			CursorLedger:    1000,
+			AwaitingPayment: 1,
+			AwaitingImport:  2,
+		}
+		if status.PegIns != wantPegIns {
+			t.Errorf("got peg-in status %+v, want %+v", status.PegIns, wantPegIns)
+		}
+		wantExports := ExportStatus{Pending: 2, Retry: 1, Failed: 1, PeggedOut: 1, Backlog: 3}
+		if !reflect.DeepEqual(status.Exports, wantExports) {
+			t.Errorf("got export status %+v, want %+v", status.Exports, wantExports)
+		}
+	})
+}
@@ -5,56 +5,183 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/zioncoin/go/amount"
 	b "github.com/zioncoin/go/build"
 	"github.com/zioncoin/go/clients/equator"
 	"github.com/zioncoin/go/keypair"
 )
 
+// Defaults for Friendbot.
+const (
+	DefaultFriendbotURL      = "https://friendbot.zion.info/"
+	DefaultFriendbotAttempts = 5
+	DefaultFriendbotTimeout  = 30 * time.Second
+	DefaultFriendbotBackoff  = time.Second
+)
+
+// Friendbot gets testnet lumens from friendbot.
+// Under testnet load friendbot requests often fail transiently,
+// so they are retried with exponential backoff.
+// The zero value uses the defaults.
+type Friendbot struct {
+	// URL is friendbot's URL. The default is DefaultFriendbotURL.
+	URL string
+
+	// Attempts bounds the requests to friendbot,
+	// and separately the checks that the funded account exists.
+	// The default is DefaultFriendbotAttempts.
+	Attempts int
+
+	// Timeout bounds each request to friendbot.
+	// The default is DefaultFriendbotTimeout.
+	Timeout time.Duration
+
+	// Backoff is the delay after the first failed attempt,
+	// doubling after each further one.
+	// The default is DefaultFriendbotBackoff.
+	Backoff time.Duration
+
+	// HClient is used to check that funded accounts exist.
+	// The default is equator.DefaultTestNetClient.
+	HClient equator.ClientInterface
+}
+
 // NewFundedAccount generates a random keypair, creates
 // an account on the Zioncoin testnet, and gets friendbot
 // funds for that account, returning the account keypair
 func NewFundedAccount() *keypair.Full {
+	kp, err := Friendbot{}.NewFundedAccount()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return kp
+}
+
+// NewFundedAccount is like the package-level NewFundedAccount,
+// but returns an error instead of exiting on failure.
+func (f Friendbot) NewFundedAccount() (*keypair.Full, error) {
 	kp, err := keypair.Random()
 	if err != nil {
-		log.Fatal(err, "generating random keypair")
+		return nil, errors.Wrap(err, "generating random keypair")
 	}
-	err = FundAccount(kp.Address())
+	err = f.Fund(kp.Address())
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	log.Printf("successfully funded %s", kp.Address())
-	return kp
+	return kp, nil
 }
 
 // FundAccount gets friendbot funds for an account on the Zioncoin testnet
 func FundAccount(address string) error {
-	resp, err := http.Get("https://friendbot.zion.info/?addr=" + address)
+	return Friendbot{}.Fund(address)
+}
+
+// Fund gets friendbot funds for an account on the Zioncoin testnet,
+// retrying failed requests that may succeed on retry,
+// and returns once the funded account exists.
+func (f Friendbot) Fund(address string) error {
+	attempts := f.Attempts
+	if attempts <= 0 {
+		attempts = DefaultFriendbotAttempts
+	}
+	backoff := f.Backoff
+	if backoff <= 0 {
+		backoff = DefaultFriendbotBackoff
+	}
+	hclient := f.HClient
+	if hclient == nil {
+		hclient = equator.DefaultTestNetClient
+	}
+
+	var err error
+	for i, delay := 0, backoff; i < attempts; i, delay = i+1, 2*delay {
+		var retry bool
+		retry, err = f.request(address)
+		if err == nil || !retry {
+			break
+		}
+		if i < attempts-1 {
+			log.Printf("friendbot request for %s failed, retrying in %s: %s", address, delay, err)
+			time.Sleep(delay)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Friendbot responds once it has submitted its tx,
+	// which Horizon may not yet reflect.
+	for i, delay := 0, backoff; i < attempts; i, delay = i+1, 2*delay {
+		var account equator.Account
+		account, err = hclient.LoadAccount(address)
+		if err == nil {
+			balance, err := account.GetNativeBalance()
+			if err != nil {
+				return errors.Wrapf(err, "getting lumen balance of account %s", address)
+			}
+			lumens, err := amount.ParseInt64(balance)
+			if err != nil {
+				return errors.Wrapf(err, "parsing lumen balance %q of account %s", balance, address)
+			}
+			if lumens <= 0 {
+				return fmt.Errorf("account %s has no lumens after friendbot funding", address)
+			}
+			return nil
+		}
+		if i < attempts-1 {
+			time.Sleep(delay)
+		}
+	}
+	return errors.Wrapf(err, "loading account %s funded by friendbot", address)
+}
+
+// request makes one friendbot request to fund address,
+// reporting whether a failed request may succeed on retry.
+func (f Friendbot) request(address string) (retry bool, err error) {
+	friendbotURL := f.URL
+	if friendbotURL == "" {
+		friendbotURL = DefaultFriendbotURL
+	}
+	timeout := f.Timeout
+	if timeout <= 0 {
+		timeout = DefaultFriendbotTimeout
+	}
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Get(friendbotURL + "?addr=" + url.QueryEscape(address))
 	if err != nil {
-		return errors.Wrap(err, "requesting friendbot lumens")
+		return true, errors.Wrap(err, "requesting friendbot lumens")
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return errors.Wrapf(err, "reading response from bad friendbot request %d", resp.StatusCode)
+			return true, errors.Wrapf(err, "reading response from bad friendbot request %d", resp.StatusCode)
 		}
-		return fmt.Errorf("error funding address through friendbot. got bad status code %d, response %s", resp.StatusCode, body)
+		retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("error funding address through friendbot. got bad status code %d, response %s", resp.StatusCode, body)
 	}
-	return nil
+	return false, nil
 }
 
 // IssueAsset issues an asset from the specified seed account
 // to the destination account.
-func IssueAsset(hclient *equator.Client, seed, code, amount, destination string) error {
+func IssueAsset(hclient equator.ClientInterface, seed, code, amount, destination string) error {
 	kp, err := keypair.Parse(seed)
 	if err != nil {
 		return err
 	}
+	root, err := hclient.Root()
+	if err != nil {
+		return errors.Wrap(err, "getting equator root")
+	}
 	tx, err := b.Transaction(
 		b.SourceAccount{AddressOrSeed: seed},
-		b.TestNetwork,
+		b.Network{Passphrase: root.NetworkPassphrase},
 		b.AutoSequence{SequenceProvider: hclient},
 		b.Payment(
 			b.Destination{AddressOrSeed: destination},
@@ -74,10 +201,14 @@ func IssueAsset(hclient *equator.Client, seed, code, amount, destination string)
 
 // TrustAsset issues a trustline from the seed account for the specified
 // asset code and issuer.
-func TrustAsset(hclient *equator.Client, seed, code, issuer string) error {
+func TrustAsset(hclient equator.ClientInterface, seed, code, issuer string) error {
+	root, err := hclient.Root()
+	if err != nil {
+		return errors.Wrap(err, "getting equator root")
+	}
 	tx, err := b.Transaction(
 		b.SourceAccount{AddressOrSeed: seed},
-		b.TestNetwork,
+		b.Network{Passphrase: root.NetworkPassphrase},
 		b.AutoSequence{SequenceProvider: hclient},
 		b.Trust(code, issuer),
 	)
@@ -0,0 +1,95 @@
+package zioncoin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+)
+
+// fundedClient reports accounts as existing with lumens
+// once funded is set.
+type fundedClient struct {
+	equator.ClientInterface
+	funded int32
+}
+
+func (c *fundedClient) LoadAccount(accountID string) (equator.Account, error) {
+	if atomic.LoadInt32(&c.funded) == 0 {
+		return equator.Account{}, &equator.Error{Problem: equator.Problem{Status: http.StatusNotFound}}
+	}
+	var account equator.Account
+	account.AccountID = accountID
+	account.Balances = []equator.Balance{{Balance: "10000.0000000"}}
+	account.Balances[0].Type = "native"
+	return account, nil
+}
+
+func TestFriendbotRetry(t *testing.T) {
+	kp, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hclient := new(fundedClient)
+	var requests int32
+	status := int32(http.StatusServiceUnavailable)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("addr") != kp.Address() {
+			t.Errorf("got friendbot request for %q, want %s", req.URL.Query().Get("addr"), kp.Address())
+		}
+		// Fail twice, then succeed.
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			http.Error(w, "overloaded", int(atomic.LoadInt32(&status)))
+			return
+		}
+		atomic.StoreInt32(&hclient.funded, 1)
+	}))
+	defer server.Close()
+
+	f := Friendbot{
+		URL:      server.URL + "/",
+		Attempts: 3,
+		Backoff:  time.Millisecond,
+		HClient:  hclient,
+	}
+	err = f.Fund(kp.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("got %d friendbot requests, want 3", n)
+	}
+
+	// With fewer attempts, the failures are not overcome.
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&hclient.funded, 0)
+	f.Attempts = 2
+	err = f.Fund(kp.Address())
+	if err == nil {
+		t.Error("funding succeeded after two failed requests with two attempts")
+	}
+
+	// An error that retrying cannot fix is not retried.
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	f.Attempts = 3
+	err = f.Fund(kp.Address())
+	if err == nil {
+		t.Error("funding succeeded after a bad request")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("got %d friendbot requests after a bad request, want 1", n)
+	}
+
+	// Funding is not reported until the account exists.
+	atomic.StoreInt32(&requests, 2)
+	f.HClient = new(fundedClient)
+	err = f.Fund(kp.Address())
+	if err == nil {
+		t.Error("funding succeeded though the account does not exist")
+	}
+}
@@ -2,6 +2,8 @@ package zioncoin
 
 import (
 	"log"
+	"net/http"
+	"strings"
 
 	"github.com/chain/txvm/errors"
 	b "github.com/zioncoin/go/build"
@@ -9,6 +11,18 @@ import (
 	"github.com/zioncoin/go/xdr"
 )
 
+// DefaultEquatorURL is the URL of the testnet equator server.
+const DefaultEquatorURL = "https://equator-testnet.zion.info"
+
+// NewClient returns a client for the equator server at url,
+// for commands that take its URL as a flag.
+func NewClient(url string) *equator.Client {
+	return &equator.Client{
+		URL:  strings.TrimRight(url, "/"),
+		HTTP: new(http.Client),
+	}
+}
+
 // SignAndSubmitTx signs and submits a transaction to the Zioncoin network. If there is
 // an error, SubmitTx will log the Result string to the console and return the error.
 func SignAndSubmitTx(hclient equator.ClientInterface, tx *b.TransactionBuilder, seeds ...string) (*equator.TransactionSuccess, error) {
@@ -20,6 +34,12 @@ func SignAndSubmitTx(hclient equator.ClientInterface, tx *b.TransactionBuilder,
 	if err != nil {
 		return nil, errors.Wrap(err, "marshaling pre-export txenv")
 	}
+	return SubmitTx(hclient, txstr)
+}
+
+// SubmitTx submits a signed, base64-encoded transaction envelope to the Zioncoin network.
+// If there is an error, SubmitTx will log the Result string to the console and return the error.
+func SubmitTx(hclient equator.ClientInterface, txstr string) (*equator.TransactionSuccess, error) {
 	resp, submitErr := hclient.SubmitTransaction(txstr)
 	if submitErr != nil {
 		// Attempt to extract more detailed result information
@@ -14,12 +14,19 @@ import (
 
 type BlockStore struct {
 	db      *sql.DB
+	label   string
 	heights chan<- uint64
 }
 
 func New(db *sql.DB, heights chan<- uint64) (*BlockStore, error) {
+	return NewLabeled(db, "", heights)
+}
+
+// NewLabeled returns a BlockStore for the chain of the custodian with the given label.
+// Its blocks and snapshots are kept apart from those of other custodians sharing db.
+func NewLabeled(db *sql.DB, label string, heights chan<- uint64) (*BlockStore, error) {
 	var height uint64
-	err := db.QueryRow("SELECT height FROM blocks ORDER BY height DESC LIMIT 1").Scan(&height)
+	err := db.QueryRow("SELECT height FROM blocks WHERE custodian_id = $1 ORDER BY height DESC LIMIT 1", label).Scan(&height)
 	if err == sql.ErrNoRows {
 		initialBlock, err := protocol.NewInitialBlock(nil, 0, time.Now())
 		if err != nil {
@@ -30,7 +37,7 @@ func New(db *sql.DB, heights chan<- uint64) (*BlockStore, error) {
 		if err != nil {
 			return nil, errors.Wrap(err, "marshaling genesis block for writing to db")
 		}
-		_, err = db.Exec("INSERT OR IGNORE INTO blocks (height, hash, bits) VALUES (1, $1, $2)", h, bits)
+		_, err = db.Exec("INSERT OR IGNORE INTO blocks (custodian_id, height, hash, bits) VALUES ($1, 1, $2, $3)", label, h, bits)
 		if err != nil {
 			return nil, errors.Wrap(err, "writing genesis block to db")
 		}
@@ -39,19 +46,20 @@ func New(db *sql.DB, heights chan<- uint64) (*BlockStore, error) {
 	}
 	return &BlockStore{
 		db:      db,
+		label:   label,
 		heights: heights,
 	}, nil
 }
 
 func (s *BlockStore) Height(context.Context) (uint64, error) {
 	var height uint64
-	err := s.db.QueryRow("SELECT MAX(height) FROM blocks").Scan(&height)
+	err := s.db.QueryRow("SELECT MAX(height) FROM blocks WHERE custodian_id = $1", s.label).Scan(&height)
 	return height, err
 }
 
 func (s *BlockStore) GetBlock(_ context.Context, height uint64) (*bc.Block, error) {
 	var bits []byte
-	err := s.db.QueryRow("SELECT bits FROM blocks WHERE height = $1", height).Scan(&bits)
+	err := s.db.QueryRow("SELECT bits FROM blocks WHERE custodian_id = $1 AND height = $2", s.label, height).Scan(&bits)
 	if err != nil {
 		return nil, errors.Wrapf(err, "reading block %d from db", height)
 	}
@@ -62,7 +70,7 @@ func (s *BlockStore) GetBlock(_ context.Context, height uint64) (*bc.Block, erro
 
 func (s *BlockStore) LatestSnapshot(context.Context) (*state.Snapshot, error) {
 	var bits []byte
-	err := s.db.QueryRow("SELECT bits FROM snapshots ORDER BY height DESC LIMIT 1").Scan(&bits)
+	err := s.db.QueryRow("SELECT bits FROM snapshots WHERE custodian_id = $1 ORDER BY height DESC LIMIT 1", s.label).Scan(&bits)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -80,7 +88,7 @@ func (s *BlockStore) SaveBlock(_ context.Context, b *bc.Block) error {
 	if err != nil {
 		return errors.Wrapf(err, "marshaling block %d for writing to db", b.Height)
 	}
-	_, err = s.db.Exec("INSERT OR IGNORE INTO blocks (height, hash, bits) VALUES ($1, $2, $3)", b.Height, h, bits)
+	_, err = s.db.Exec("INSERT OR IGNORE INTO blocks (custodian_id, height, hash, bits) VALUES ($1, $2, $3, $4)", s.label, b.Height, h, bits)
 	return errors.Wrapf(err, "writing block %d to db", b.Height)
 }
 
@@ -94,7 +102,7 @@ func (s *BlockStore) SaveSnapshot(_ context.Context, snapshot *state.Snapshot) e
 	if err != nil {
 		return errors.Wrapf(err, "marshaling snapshot at height %d for writing to db", snapshot.Height())
 	}
-	_, err = s.db.Exec("INSERT OR IGNORE INTO snapshots (height, bits) VALUES ($1, $2)", snapshot.Height(), bits)
+	_, err = s.db.Exec("INSERT OR IGNORE INTO snapshots (custodian_id, height, bits) VALUES ($1, $2, $3)", s.label, snapshot.Height(), bits)
 	return errors.Wrapf(err, "writing snapshot at height %d to db", snapshot.Height())
 }
 
@@ -123,9 +131,9 @@ func (s *BlockStore) ExpireBlocks(ctx context.Context) {
 
 			height := snap.Header.Height
 
-			const q = `SELECT MIN(height) FROM pins`
+			const q = `SELECT MIN(height) FROM pins WHERE custodian_id = $1`
 			var lowestPin uint64
-			err = s.db.QueryRowContext(ctx, q).Scan(&lowestPin)
+			err = s.db.QueryRowContext(ctx, q, s.label).Scan(&lowestPin)
 			if err != nil {
 				log.Printf("error getting lowest pin in ExpireBlocks: %s", err)
 				continue
@@ -136,7 +144,7 @@ func (s *BlockStore) ExpireBlocks(ctx context.Context) {
 
 			if height > 2 {
 				log.Printf("deleting blocks 2 through %d from the db", height-1)
-				_, err = s.db.ExecContext(ctx, `DELETE FROM blocks WHERE height > 1 AND height < $1`, height)
+				_, err = s.db.ExecContext(ctx, `DELETE FROM blocks WHERE custodian_id = $1 AND height > 1 AND height < $2`, s.label, height)
 				if err != nil {
 					log.Printf("error expiring blocks: %s", err)
 				}
@@ -0,0 +1,133 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+)
+
+const stuckExportCheckInterval = time.Minute
+
+// StuckExport describes an export not settled by its deadline
+// (see ExportDeadline).
+type StuckExport struct {
+	TxID     []byte
+	Exporter string
+	AssetXDR []byte
+	Amount   int64
+	Recorded time.Time
+}
+
+// ExportDeadline sets how long after it is recorded
+// an export may go unsettled,
+// e.g. pending, marked for retry, awaiting an offline signature, a trustline, or confirmation of its peg-out tx,
+// or paid only in part,
+// before the custodian escalates it.
+// An escalated export is marked in the stuck_exports view of the db,
+// counted in the custodian's status,
+// reported by its health check until it settles,
+// and passed to alert, if not nil, once.
+// Escalation does not change the export's peg-out state.
+// Exports recorded before the custodian kept recording times are never escalated.
+// Zero, the default, means no deadline.
+func ExportDeadline(d time.Duration, alert func(StuckExport)) Option {
+	return func(c *Custodian) {
+		c.exportDeadline = d
+		c.stuckExportAlert = alert
+	}
+}
+
+// Runs as a goroutine.
+func (c *Custodian) watchStuckExports(ctx context.Context) {
+	defer log.Print("watchStuckExports exiting")
+
+	ticker := time.NewTicker(stuckExportCheckInterval)
+	defer ticker.Stop()
+	for {
+		err := c.retryDB(ctx, "checking for stuck exports", func(ctx context.Context) error {
+			return c.escalateStuckExports(ctx, time.Now())
+		})
+		if err != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// escalateStuckExports escalates the exports unsettled as of now
+// whose deadlines have passed,
+// then marks the custodian unhealthy while any escalated export is unsettled.
+func (c *Custodian) escalateStuckExports(ctx context.Context, now time.Time) error {
+	const q = `SELECT txid, pegout_json, recorded_ms FROM exports WHERE pegged_out IN ($1, $2, $3, $4, $5, $6) AND recorded_ms > 0 AND recorded_ms <= $7 AND escalated_ms = 0 AND custodian_id=$8`
+	var (
+		txids, refs [][]byte
+		recorded    []int64
+		deadlineMS  = int64(bc.Millis(now.Add(-c.exportDeadline)))
+	)
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, pegOutNotYet, pegOutRetry, pegOutPartial, pegOutUnsigned, pegOutNoTrust, pegOutPending, deadlineMS, c.label, func(txid, ref []byte, recordedMS int64) {
+		txids = append(txids, txid)
+		refs = append(refs, ref)
+		recorded = append(recorded, recordedMS)
+	})
+	if err != nil {
+		return errors.Wrap(err, "reading exports past deadline")
+	}
+	for i, txid := range txids {
+		// Only the first custodian to escalate an export alerts for it.
+		result, err := c.DB.ExecContext(ctx, `UPDATE exports SET escalated_ms=$1 WHERE txid=$2 AND escalated_ms=0`, int64(bc.Millis(now)), txid)
+		if err != nil {
+			return errors.Wrapf(err, "escalating export %x", txid)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return errors.Wrapf(err, "checking rows affected by escalating export %x", txid)
+		}
+		if n == 0 {
+			continue
+		}
+		var p pegOut
+		err = decodeRefdata(refs[i], &p)
+		if err != nil {
+			return errors.Wrapf(err, "unmarshaling refdata of export %x", txid)
+		}
+		stuck := StuckExport{
+			TxID:     txid,
+			Exporter: p.Exporter,
+			AssetXDR: p.AssetXDR,
+			Amount:   p.Amount,
+			Recorded: bc.FromMillis(uint64(recorded[i])),
+		}
+		log.Printf("export %x recorded at %s is not settled after %s", txid, stuck.Recorded, c.exportDeadline)
+		if c.stuckExportAlert != nil {
+			c.stuckExportAlert(stuck)
+		}
+	}
+
+	const component = "stuck exports"
+	n, err := c.stuckExports(ctx)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		c.health.setUnhealthy(component, fmt.Errorf("%d exports not settled within %s", n, c.exportDeadline))
+	} else {
+		c.health.setHealthy(component)
+	}
+	return nil
+}
+
+// stuckExports counts the escalated exports that are still unsettled.
+func (c *Custodian) stuckExports(ctx context.Context) (int, error) {
+	var n int
+	err := c.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM stuck_exports WHERE custodian_id=$1`, c.label).Scan(&n)
+	return n, errors.Wrap(err, "counting stuck exports")
+}
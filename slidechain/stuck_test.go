@@ -0,0 +1,85 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestExportDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	const deadline = time.Hour
+	var alerts []StuckExport
+	alert := func(stuck StuckExport) {
+		alerts = append(alerts, stuck)
+	}
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		record := func(txid string, state pegOutState) {
+			info := pegOut{Exporter: "exporter-" + txid, Amount: 100}
+			ref, err := json.Marshal(info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.recordExport(ctx, []byte(txid), ref, info, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.Exec("UPDATE exports SET pegged_out=$1 WHERE txid=$2", state, []byte(txid))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		record("retrying", pegOutRetry)
+		record("settled", pegOutOK)
+
+		check := func(now time.Time, wantAlerts, wantStuck int) {
+			t.Helper()
+			err := c.escalateStuckExports(ctx, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(alerts) != wantAlerts {
+				t.Fatalf("got %d alerts, want %d", len(alerts), wantAlerts)
+			}
+			n, err := c.stuckExports(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != wantStuck {
+				t.Errorf("got %d stuck exports, want %d", n, wantStuck)
+			}
+			if unhealthy := len(c.health.problems()) > 0; unhealthy != (wantStuck > 0) {
+				t.Errorf("got unhealthy %v with %d stuck exports", unhealthy, wantStuck)
+			}
+		}
+
+		now := time.Now()
+		check(now, 0, 0)
+		check(now.Add(deadline/2), 0, 0)
+
+		// Past the deadline, only the unsettled export is escalated.
+		check(now.Add(deadline+time.Minute), 1, 1)
+		if !bytes.Equal(alerts[0].TxID, []byte("retrying")) || alerts[0].Exporter != "exporter-retrying" || alerts[0].Amount != 100 {
+			t.Errorf("got alert for export %q from %s of %d, want %q from %s of 100", alerts[0].TxID, alerts[0].Exporter, alerts[0].Amount, "retrying", "exporter-retrying")
+		}
+		if alerts[0].Recorded.After(now) || now.Sub(alerts[0].Recorded) > time.Minute {
+			t.Errorf("got recording time %s, want about %s", alerts[0].Recorded, now)
+		}
+
+		// The stuck export is alerted once.
+		check(now.Add(2*deadline), 1, 1)
+
+		// Once it settles, it is no longer stuck.
+		_, err := db.Exec("UPDATE exports SET pegged_out=$1 WHERE txid=$2", pegOutOK, []byte("retrying"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(now.Add(3*deadline), 1, 0)
+	}, ExportDeadline(deadline, alert))
+}
@@ -43,9 +43,15 @@ type submitter struct {
 	chain *protocol.Chain
 
 	blockInterval time.Duration
+
+	// readOnly causes submitTx to refuse all txs (see Observer).
+	readOnly bool
 }
 
 func (s *submitter) submitTx(ctx context.Context, tx *bc.Tx) (*multichan.R, error) {
+	if s.readOnly {
+		return nil, errObserver
+	}
 	s.bbmu.Lock()
 	defer s.bbmu.Unlock()
 
@@ -0,0 +1,234 @@
+package slidechain
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/xdr"
+)
+
+const coldWalletSweepInterval = 10 * time.Minute
+
+// sweepFeeBuffer is the lumen balance, in stroops,
+// left above the custodian's minimum balance by a sweep,
+// to pay the fees of the custodian's own txs,
+// such as sweeps and tranche payments.
+const sweepFeeBuffer = 100 * baseFee
+
+// ColdWallet causes the custodian to sweep,
+// every 10 minutes,
+// the balance of each asset in thresholds above its threshold
+// from the custodian account to the account coldAddr
+// (see SweepToColdWallet).
+// Thresholds are in stroops,
+// keyed by asset as in PegOutFees.
+func ColdWallet(coldAddr string, thresholds map[string]int64) Option {
+	return func(c *Custodian) {
+		c.coldWallet = coldAddr
+		c.sweepThresholds = thresholds
+	}
+}
+
+// Runs as a goroutine.
+func (c *Custodian) watchColdWallet(ctx context.Context) {
+	defer log.Print("watchColdWallet exiting")
+
+	ticker := time.NewTicker(coldWalletSweepInterval)
+	defer ticker.Stop()
+	for {
+		if !c.submissionsHalted() {
+			err := c.SweepToColdWallet(ctx, c.sweepThresholds, c.coldWallet)
+			if err != nil {
+				log.Printf("sweeping to cold wallet: %s", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SweepToColdWallet pays to the account coldAddr
+// the balance of each asset in threshold
+// held by the custodian account in excess of that threshold,
+// recording each sweep in the db.
+// Thresholds are in stroops, keyed by asset as in PegOutFees;
+// assets not in threshold are not swept.
+//
+// A sweep never leaves less of an asset than the custodian owes
+// to exports awaiting peg-out and to unpaid tranches,
+// so that it cannot cause those payments to fail for lack of funds,
+// nor less lumens than the account's minimum balance
+// plus a buffer for the fees of the custodian's own txs.
+func (c *Custodian) SweepToColdWallet(ctx context.Context, threshold map[string]int64, coldAddr string) error {
+	if c.observer {
+		return errObserver
+	}
+	var cold xdr.AccountId
+	err := cold.SetAddress(coldAddr)
+	if err != nil {
+		return errors.Wrapf(err, "parsing cold wallet address %s", coldAddr)
+	}
+	if cold.Equals(c.AccountID) {
+		return errors.New("cold wallet is the custodian account")
+	}
+	obligations, err := c.pegOutObligations(ctx)
+	if err != nil {
+		return err
+	}
+	account, err := c.hclient.LoadAccount(c.AccountID.Address())
+	if err != nil {
+		return errors.Wrap(err, "loading custodian account")
+	}
+	for _, balance := range account.Balances {
+		asset, err := balanceAsset(balance)
+		if err != nil {
+			return err
+		}
+		keep, ok := threshold[asset.String()]
+		if !ok {
+			continue
+		}
+		have, err := c.spendable(balance)
+		if err != nil {
+			return errors.Wrapf(err, "custodian balance of %s", asset.String())
+		}
+		assetXDR, err := asset.MarshalBinary()
+		if err != nil {
+			return errors.Wrap(err, "marshaling asset xdr")
+		}
+		floor := obligations[string(assetXDR)]
+		if asset.Type == xdr.AssetTypeAssetTypeNative {
+			floor += c.minBalance(account) + sweepFeeBuffer
+		}
+		if floor > keep {
+			keep = floor
+		}
+		excess := have - keep
+		if excess <= 0 {
+			continue
+		}
+		hash, err := c.submitSweep(ctx, cold.Address(), asset, excess)
+		if err != nil {
+			return errors.Wrapf(err, "sweeping %d of %s", excess, asset.String())
+		}
+		log.Printf("swept %d of %s to cold wallet %s in Zioncoin tx %s, keeping %d", excess, asset.String(), cold.Address(), hash, keep)
+		err = c.retryDB(ctx, "recording sweep", func(ctx context.Context) error {
+			return c.recordSweep(ctx, hash, cold.Address(), assetXDR, excess)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// balanceAsset returns the asset of a balance of a Zioncoin account.
+func balanceAsset(balance equator.Balance) (xdr.Asset, error) {
+	var (
+		asset xdr.Asset
+		err   error
+	)
+	if balance.Type == "native" {
+		asset, err = xdr.NewAsset(xdr.AssetTypeAssetTypeNative, nil)
+	} else {
+		var issuer xdr.AccountId
+		err = issuer.SetAddress(balance.Issuer)
+		if err == nil {
+			err = asset.SetCredit(balance.Code, issuer)
+		}
+	}
+	return asset, errors.Wrapf(err, "parsing asset of balance %s %s", balance.Code, balance.Issuer)
+}
+
+// minBalance returns the minimum lumen balance of account, in stroops,
+// at the custodian's base reserve.
+func (c *Custodian) minBalance(account equator.Account) int64 {
+	reserve := c.baseReserve
+	if reserve == 0 {
+		reserve = DefaultBaseReserve
+	}
+	return int64(2+account.SubentryCount) * reserve
+}
+
+// pegOutObligations returns the amount of each asset, keyed by asset XDR,
+// that the custodian is yet to pay from its account:
+// the amounts of exports awaiting peg-out, including those held as dust or for review,
+// and of the unpaid tranches of those partly pegged out.
+func (c *Custodian) pegOutObligations(ctx context.Context) (map[string]int64, error) {
+	obligations := make(map[string]int64)
+	const q = `SELECT pegout_json FROM exports WHERE pegged_out IN ($1, $2, $3, $4, $5, $6, $7) AND custodian_id=$8`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, pegOutNotYet, pegOutRetry, pegOutUnsigned, pegOutNoTrust, pegOutPending, pegOutDust, pegOutHeld, c.label, func(ref []byte) error {
+		var p pegOut
+		err := decodeRefdata(ref, &p)
+		if err != nil {
+			return errors.Wrap(err, "unmarshaling reference data")
+		}
+		obligations[string(p.AssetXDR)] += p.Amount
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "querying pending exports")
+	}
+	const trancheQ = `SELECT e.pegout_json, t.amount FROM tranches t JOIN exports e ON e.txid=t.export_txid WHERE e.pegged_out=$1 AND t.state!=$2 AND e.custodian_id=$3`
+	err = sqlutil.ForQueryRows(ctx, c.DB, trancheQ, pegOutPartial, tranchePaid, c.label, func(ref []byte, amount int64) error {
+		var p pegOut
+		err := decodeRefdata(ref, &p)
+		if err != nil {
+			return errors.Wrap(err, "unmarshaling reference data")
+		}
+		obligations[string(p.AssetXDR)] += amount
+		return nil
+	})
+	return obligations, errors.Wrap(err, "querying unpaid tranches")
+}
+
+// submitSweep pays amount of asset from the custodian's account to coldAddr.
+// It returns the hex-encoded hash of the Zioncoin tx.
+func (c *Custodian) submitSweep(ctx context.Context, coldAddr string, asset xdr.Asset, amount int64) (string, error) {
+	tx, err := c.custodianTx(buildPaymentOp(c.AccountID.Address(), coldAddr, asset, amount))
+	if err != nil {
+		return "", errors.Wrap(err, "building sweep tx")
+	}
+	hash, err := tx.HashHex()
+	if err != nil {
+		return "", errors.Wrap(err, "hashing sweep tx")
+	}
+	err = c.submitCustodianTx(ctx, tx, hash)
+	return hash, errors.Wrap(err, "submitting sweep tx")
+}
+
+// recordSweep records the sweep of amount of an asset to coldAddr
+// in Zioncoin tx hash,
+// logging an event for it in the same db transaction.
+func (c *Custodian) recordSweep(ctx context.Context, hash, coldAddr string, assetXDR []byte, amount int64) error {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	const q = `INSERT INTO sweeps (zioncoin_tx, destination, asset_xdr, amount, timestamp_ms, custodian_id) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err = dbtx.ExecContext(ctx, q, hash, coldAddr, assetXDR, amount, int64(bc.Millis(time.Now())), c.label)
+	if err != nil {
+		return errors.Wrapf(err, "recording sweep tx %s", hash)
+	}
+	err = appendEvent(ctx, dbtx, Event{
+		Type:       EventSweep,
+		ZioncoinTx: hash,
+		Account:    coldAddr,
+		AssetXDR:   assetXDR,
+		Amount:     amount,
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(dbtx.Commit(), "committing sweep tx %s", hash)
+}
@@ -0,0 +1,107 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/interzioncoin/starlight/worizon/xlm"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestSweepToColdWallet(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		cold, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accounts := make(map[string]equator.Account)
+		hclient := &fakeClient{ClientInterface: c.hclient, loadAccount: loadAccountsFrom(accounts)}
+		c.hclient = hclient
+		setBalance := func(lumens string) {
+			var account equator.Account
+			account.AccountID = c.AccountID.Address()
+			account = withTrustline(account)
+			native := equator.Balance{Balance: lumens}
+			native.Type = "native"
+			account.Balances = append(account.Balances, native)
+			accounts[c.AccountID.Address()] = account
+		}
+		setBalance("1000.0000000")
+
+		// The custodian owes 600 lumens to a pending export
+		// and 100 to the unpaid tranche of a partial one.
+		insertTestExport(t, db, []byte("pending"), lumenXDR, int64(600*xlm.Lumen), exporter.Address())
+		insertTestExport(t, db, []byte("partial"), lumenXDR, int64(300*xlm.Lumen), exporter.Address())
+		_, err = db.Exec("UPDATE exports SET pegged_out=$1 WHERE txid=$2", pegOutPartial, []byte("partial"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for idx, state := range []trancheState{tranchePaid, trancheNotYet} {
+			_, err = db.Exec("INSERT INTO tranches (export_txid, idx, amount, state) VALUES ($1, $2, $3, $4)", []byte("partial"), idx+1, int64(100*xlm.Lumen), state)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The threshold of 100 lumens is below the obligation floor,
+		// which sweeping must not breach.
+		thresholds := map[string]int64{"native": int64(100 * xlm.Lumen)}
+		err = c.SweepToColdWallet(ctx, thresholds, cold.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// With a trustline, the custodian account has one subentry.
+		floor := int64(700*xlm.Lumen) + 3*DefaultBaseReserve + sweepFeeBuffer
+		wantSwept := int64(1000*xlm.Lumen) - floor
+		var (
+			swept       int64
+			destination string
+		)
+		err = db.QueryRow("SELECT amount, destination FROM sweeps WHERE asset_xdr=$1", lumenXDR).Scan(&swept, &destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if swept != wantSwept || destination != cold.Address() {
+			t.Errorf("got sweep of %d to %s, want %d to %s", swept, destination, wantSwept, cold.Address())
+		}
+
+		// Once the balance is at the floor, nothing more is swept.
+		setBalance(xlm.Amount(floor).HorizonString())
+		err = c.SweepToColdWallet(ctx, thresholds, cold.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sweeps, events int
+		err = db.QueryRow("SELECT COUNT(*) FROM sweeps").Scan(&sweeps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.QueryRow("SELECT COUNT(*) FROM events WHERE type=$1", EventSweep).Scan(&events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sweeps != 1 || events != 1 {
+			t.Errorf("got %d sweeps and %d sweep events, want 1 of each", sweeps, events)
+		}
+
+		err = c.SweepToColdWallet(ctx, thresholds, c.AccountID.Address())
+		if err == nil {
+			t.Error("got no error sweeping to the custodian account itself")
+		}
+	})
+}
@@ -0,0 +1,230 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interzioncoin/starlight/worizon/xlm"
+	"github.com/zioncoin/go/amount"
+	"github.com/zioncoin/go/xdr"
+)
+
+// VerifyTempAccounts causes the custodian to check, before recording an export,
+// that its temp account exists on the Zioncoin network
+// with the expected sequence number and preauth signer.
+// An export that fails the check is not pegged out:
+// the reason is recorded in the export_failures table
+// and the exported funds are returned to the exporter.
+func VerifyTempAccounts() Option {
+	return func(c *Custodian) {
+		c.verifyTempAccounts = true
+	}
+}
+
+// CosignPegOuts causes the custodian to expect each export's temp account
+// to have been set up with PreExportOptions.Cosigned,
+// with the custodian as a signer besides the preauth transaction,
+// so that the peg-out needs the custodian's signature as well.
+// Exports must then all be cosigned:
+// the peg-out tx of a temp account set up by SubmitPreExportTx
+// would not match its preauth signer.
+func CosignPegOuts() Option {
+	return func(c *Custodian) {
+		c.cosignPegOuts = true
+	}
+}
+
+// checkTempAccount checks that the temp account of export p
+// is ready for the custodian's peg-out transaction.
+// If it is not, checkTempAccount returns a description of the problem.
+// It returns an error only when the check itself fails,
+// e.g. when Horizon is unreachable.
+func (c *Custodian) checkTempAccount(p pegOut) (string, error) {
+	account, err := c.hclient.LoadAccount(p.TempAddr)
+	if err != nil {
+		if isNotFound(err) {
+			return fmt.Sprintf("temp account %s does not exist", p.TempAddr), nil
+		}
+		return "", errors.Wrapf(err, "loading temp account %s", p.TempAddr)
+	}
+	seqnum, err := strconv.ParseInt(account.Sequence, 10, 64)
+	if err != nil {
+		return "", errors.Wrapf(err, "parsing sequence number %q of temp account %s", account.Sequence, p.TempAddr)
+	}
+	if seqnum != p.Seqnum {
+		return fmt.Sprintf("temp account %s has sequence number %d, want %d", p.TempAddr, seqnum, p.Seqnum), nil
+	}
+
+	var asset xdr.Asset
+	err = xdr.SafeUnmarshal(p.AssetXDR, &asset)
+	if err != nil {
+		return fmt.Sprintf("invalid asset XDR %x", p.AssetXDR), nil
+	}
+	policy := c.feePolicy(asset)
+	payout, _, err := policy.Payout(p.Amount)
+	if err != nil {
+		// The peg-out is rejected, and the funds returned, in any case.
+		return "", nil
+	}
+	want, err := ComputePegOutPreauthHash(PegOutParams{
+		Custodian:  c.AccountID.Address(),
+		Exporter:   p.Exporter,
+		Owner:      p.Owner,
+		TempAddr:   p.TempAddr,
+		Network:    c.network,
+		Asset:      asset,
+		Amount:     policy.Split(payout)[0],
+		Seqnum:     xdr.SequenceNumber(p.Seqnum),
+		Cosigned:   c.cosignPegOuts,
+		BaseFee:    c.pegOutBaseFee(p),
+		Recipients: p.Recipients,
+		MemoAnchor: p.memo(),
+	})
+	if err != nil {
+		return fmt.Sprintf("cannot compute peg-out preauth hash: %s", err), nil
+	}
+	var hasPreauth, hasCustodian bool
+	for _, signer := range account.Signers {
+		switch {
+		case signer.Weight == 0:
+		case signer.Key == want:
+			hasPreauth = true
+		case signer.Key == c.AccountID.Address():
+			hasCustodian = true
+		}
+	}
+	if !hasPreauth {
+		return fmt.Sprintf("temp account %s lacks preauth signer %s", p.TempAddr, want), nil
+	}
+	if c.cosignPegOuts && !hasCustodian {
+		return fmt.Sprintf("temp account %s lacks custodian signer %s", p.TempAddr, c.AccountID.Address()), nil
+	}
+	return "", nil
+}
+
+// DefaultBaseReserve is the default base reserve of the Zioncoin network, in stroops.
+const DefaultBaseReserve = int64(xlm.Lumen / 2)
+
+// BaseReserve sets the base reserve of the Zioncoin network, in stroops
+// (by default, DefaultBaseReserve),
+// against which the custodian checks that a temp account
+// can pay for its peg-out transaction.
+func BaseReserve(stroops int64) Option {
+	return func(c *Custodian) {
+		c.baseReserve = stroops
+	}
+}
+
+// checkTempAccountMerge checks, just before peg-out,
+// that the temp account at tempAddr can be merged by the peg-out tx,
+// which removes the owner's signer and returns the remaining lumens to the owner.
+// If it cannot, because the account has acquired trustlines or other subentries,
+// or its balance no longer covers the peg-out tx fee above the reserve,
+// checkTempAccountMerge returns a description of the problem.
+// Otherwise it returns the amount, in stroops, that the merge returns.
+// The peg-out tx pays baseFee per operation (see pegOutBaseFee).
+// A temp account that is its own owner (see PreExportOptions.OwnAccount)
+// is not merged, and need only cover the fee:
+// checkTempAccountMerge returns zero for it.
+// It returns an error only when the check itself fails.
+func (c *Custodian) checkTempAccountMerge(tempAddr, owner string, baseFee int64) (int64, string, error) {
+	account, err := c.hclient.LoadAccount(tempAddr)
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "loading temp account %s", tempAddr)
+	}
+	persistent := tempAddr == owner
+	lumens := int64(-1)
+	for _, balance := range account.Balances {
+		if balance.Type != "native" {
+			if persistent {
+				// Left in place, as is the account.
+				continue
+			}
+			// A trustline cannot be removed by the preauthorized peg-out tx.
+			return 0, fmt.Sprintf("temp account %s holds a trustline to %s:%s, which prevents its merge", tempAddr, balance.Code, balance.Issuer), nil
+		}
+		lumens, err = amount.ParseInt64(balance.Balance)
+		if err != nil {
+			return 0, "", errors.Wrapf(err, "parsing lumen balance %q of temp account %s", balance.Balance, tempAddr)
+		}
+	}
+	if lumens < 0 {
+		return 0, fmt.Sprintf("temp account %s has no lumen balance", tempAddr), nil
+	}
+	// An account left in place keeps its signers and subentries.
+	if !persistent {
+		var signers int32
+		for _, signer := range account.Signers {
+			switch {
+			case signer.Key == tempAddr:
+				// The master key, which is not a subentry.
+			case signer.Key == owner, signer.Type == "preauth_tx":
+				// Removed by the peg-out tx.
+				signers++
+			case c.cosignPegOuts && signer.Key == c.AccountID.Address():
+				// Removed by the cosigned peg-out tx.
+				signers++
+			default:
+				return 0, fmt.Sprintf("temp account %s has unexpected signer %s, which prevents its merge", tempAddr, signer.Key), nil
+			}
+		}
+		if extra := account.SubentryCount - signers; extra > 0 {
+			return 0, fmt.Sprintf("temp account %s has %d subentries besides its signers, which prevent its merge", tempAddr, extra), nil
+		}
+	}
+
+	minBalance := c.minBalance(account)
+	fee := pegOutTxFee(baseFee, c.cosignPegOuts)
+	if persistent {
+		// Without the ops removing the owner's signer and merging the account.
+		fee -= 2 * baseFee
+	}
+	if lumens-minBalance < fee {
+		return 0, fmt.Sprintf("temp account %s balance of %d stroops does not cover the peg-out fee of %d above its minimum balance of %d", tempAddr, lumens, fee, minBalance), nil
+	}
+	if persistent {
+		return 0, "", nil
+	}
+	return lumens - fee, "", nil
+}
+
+// recordFailureReason records why export tx txid failed to peg out.
+func (c *Custodian) recordFailureReason(ctx context.Context, txid []byte, reason string) error {
+	_, err := c.DB.ExecContext(ctx, `INSERT OR IGNORE INTO export_failures (txid, reason) VALUES ($1, $2)`, txid, reason)
+	return errors.Wrapf(err, "recording failure reason for export tx %x", txid)
+}
+
+// recordExportFailure records export tx txid, with reference data ref,
+// as failed for the given reason,
+// so that its funds are returned to the exporter rather than pegged out.
+func (c *Custodian) recordExportFailure(ctx context.Context, txid, ref []byte, reason string) error {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	result, err := dbtx.ExecContext(ctx, `INSERT OR IGNORE INTO exports (txid, pegout_json, pegged_out, custodian_id, recorded_ms) VALUES ($1, $2, $3, $4, $5)`, txid, ref, pegOutFail, c.label, int64(bc.Millis(time.Now())))
+	if err != nil {
+		return errors.Wrapf(err, "recording failed export tx %x", txid)
+	}
+	numAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "checking rows affected by recording failed export tx %x", txid)
+	}
+	_, err = dbtx.ExecContext(ctx, `INSERT OR IGNORE INTO export_failures (txid, reason) VALUES ($1, $2)`, txid, reason)
+	if err != nil {
+		return errors.Wrapf(err, "recording failure reason for export tx %x", txid)
+	}
+	if numAffected > 0 {
+		err = appendEvent(ctx, dbtx, Event{Type: EventExportFailed, TxVMTxID: txid, Reason: reason})
+		if err != nil {
+			return err
+		}
+	}
+	return errors.Wrapf(dbtx.Commit(), "committing failure of export tx %x", txid)
+}
@@ -0,0 +1,765 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/mockequator"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/interzioncoin/starlight/worizon/xlm"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/strkey"
+	"github.com/zioncoin/go/xdr"
+)
+
+func TestCheckTempAccount(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		newExport := func() pegOut {
+			temp, err := keypair.Random()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return pegOut{
+				AssetXDR: lumenXDR,
+				TempAddr: temp.Address(),
+				Seqnum:   7,
+				Exporter: exporter.Address(),
+				Amount:   1000,
+			}
+		}
+		readyAccount := func(p pegOut) equator.Account {
+			preauth, err := ComputePegOutPreauthHash(PegOutParams{
+				Custodian: c.AccountID.Address(),
+				Exporter:  p.Exporter,
+				TempAddr:  p.TempAddr,
+				Network:   c.network,
+				Asset:     zioncoin.NativeAsset(),
+				Amount:    p.Amount,
+				Seqnum:    xdr.SequenceNumber(p.Seqnum),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return equator.Account{
+				Sequence: "7",
+				Signers: []equator.Signer{
+					{Key: p.TempAddr, Weight: 0},
+					{Key: preauth, Weight: 1},
+					{Key: p.Exporter, Weight: 1},
+				},
+			}
+		}
+
+		accounts := make(map[string]equator.Account)
+		hclient := &fakeClient{ClientInterface: c.hclient, loadAccount: loadAccountsFrom(accounts)}
+		c.hclient = hclient
+
+		ready := newExport()
+		accounts[ready.TempAddr] = readyAccount(ready)
+
+		missing := newExport()
+
+		bumped := newExport()
+		accounts[bumped.TempAddr] = readyAccount(bumped)
+		acct := accounts[bumped.TempAddr]
+		acct.Sequence = "8"
+		accounts[bumped.TempAddr] = acct
+
+		// The preauth signer commits to a different payout.
+		wrongAmount := newExport()
+		accounts[wrongAmount.TempAddr] = readyAccount(wrongAmount)
+		wrongAmount.Amount = 2000
+
+		cases := []struct {
+			name       string
+			p          pegOut
+			wantReason string
+		}{
+			{"ready", ready, ""},
+			{"missing", missing, "does not exist"},
+			{"bumped", bumped, "has sequence number 8, want 7"},
+			{"wrong amount", wrongAmount, "lacks preauth signer"},
+		}
+		for _, tt := range cases {
+			reason, err := c.checkTempAccount(tt.p)
+			if err != nil {
+				t.Fatalf("%s: %s", tt.name, err)
+			}
+			if tt.wantReason == "" && reason != "" {
+				t.Errorf("%s: got failure %q, want none", tt.name, reason)
+			}
+			if tt.wantReason != "" && !strings.Contains(reason, tt.wantReason) {
+				t.Errorf("%s: got failure %q, want one containing %q", tt.name, reason, tt.wantReason)
+			}
+		}
+
+		txid := []byte("export")
+		err = c.recordExportFailure(ctx, txid, []byte(`{}`), "temp account does not exist")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			state  pegOutState
+			reason string
+		)
+		err = db.QueryRow("SELECT e.pegged_out, f.reason FROM exports e JOIN export_failures f ON e.txid = f.txid WHERE e.txid=$1", txid).Scan(&state, &reason)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != pegOutFail || reason != "temp account does not exist" {
+			t.Errorf("got failed export in state %d with reason %q, want state %d with reason %q", state, reason, pegOutFail, "temp account does not exist")
+		}
+	})
+}
+
+// tempAccount returns a temp account as left by SubmitPreExportTx,
+// holding lumens (in Horizon format) and with owner and preauth signers.
+func tempAccount(addr, owner, lumens string) equator.Account {
+	account := equator.Account{
+		SubentryCount: 2,
+		Signers: []equator.Signer{
+			{Key: addr, Weight: 0, Type: "ed25519_public_key"},
+			{Key: "TBU2RRGLXH3E5CQHTD3ODLDF2BWDCYUSSBLLZ5GNW7JXHDIYKXZWHXL7", Weight: 1, Type: "preauth_tx"},
+			{Key: owner, Weight: 1, Type: "ed25519_public_key"},
+		},
+	}
+	account.AccountID = addr
+	native := equator.Balance{Balance: lumens}
+	native.Type = "native"
+	account.Balances = []equator.Balance{native}
+	return account
+}
+
+// withTrustline adds an empty USD trustline to account.
+func withTrustline(account equator.Account) equator.Account {
+	trustline := equator.Balance{Balance: "0.0000000"}
+	trustline.Type = "credit_alphanum4"
+	trustline.Code = "USD"
+	trustline.Issuer = importTestAccountID
+	account.Balances = append(append([]equator.Balance{}, account.Balances...), trustline)
+	account.SubentryCount++
+	return account
+}
+
+func TestCheckTempAccountMerge(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		owner, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accounts := make(map[string]equator.Account)
+		hclient := &fakeClient{ClientInterface: c.hclient, loadAccount: loadAccountsFrom(accounts)}
+		c.hclient = hclient
+
+		withOffer := tempAccount("offer", owner.Address(), "2.5000000")
+		withOffer.SubentryCount++
+		withSigner := tempAccount("signer", owner.Address(), "2.5000000")
+		withSigner.Signers = append(withSigner.Signers, equator.Signer{Key: importTestAccountID, Weight: 1, Type: "ed25519_public_key"})
+		cases := []struct {
+			name        string
+			account     equator.Account
+			baseReserve int64
+			wantMerged  int64
+			wantReason  string
+		}{
+			{"ready", tempAccount("ready", owner.Address(), "2.5000000"), 0, 25000000 - pegOutTxFee(baseFee, false), ""},
+			{"trustline", withTrustline(tempAccount("trustline", owner.Address(), "2.5000000")), 0, 0, "trustline to USD"},
+			{"offer", withOffer, 0, 0, "1 subentries besides its signers"},
+			{"extra signer", withSigner, 0, 0, "unexpected signer"},
+			{"raised reserve", tempAccount("reserve", owner.Address(), "2.5000000"), int64(xlm.Lumen), 0, "does not cover the peg-out fee"},
+			{"spent", tempAccount("spent", owner.Address(), "2.0000000"), 0, 0, "does not cover the peg-out fee"},
+		}
+		for _, tt := range cases {
+			accounts[tt.account.AccountID] = tt.account
+			c.baseReserve = tt.baseReserve
+			merged, reason, err := c.checkTempAccountMerge(tt.account.AccountID, owner.Address(), c.BaseFee)
+			if err != nil {
+				t.Fatalf("%s: %s", tt.name, err)
+			}
+			if tt.wantReason == "" && (reason != "" || merged != tt.wantMerged) {
+				t.Errorf("%s: got failure %q and merge of %d, want no failure and merge of %d", tt.name, reason, merged, tt.wantMerged)
+			}
+			if tt.wantReason != "" && !strings.Contains(reason, tt.wantReason) {
+				t.Errorf("%s: got failure %q, want one containing %q", tt.name, reason, tt.wantReason)
+			}
+		}
+
+		_, _, err = c.checkTempAccountMerge("missing", owner.Address(), c.BaseFee)
+		if err == nil {
+			t.Error("got no error checking missing temp account")
+		}
+	})
+}
+
+func TestTempAccountFunding(t *testing.T) {
+	// A peg-out with more operations or subentries,
+	// e.g. paying several exports or holding a trustline,
+	// is funded to cover its larger fee above its larger minimum balance.
+	for _, reserve := range []int64{DefaultBaseReserve, int64(xlm.Lumen)} {
+		var last int64
+		for _, tt := range []struct{ subentries, ops int }{{2, 3}, {2, 8}, {3, 8}, {5, 12}} {
+			funding := tempAccountFunding(reserve, baseFee, tt.subentries, tt.ops)
+			minBalance := int64(2+tt.subentries) * reserve
+			if fee := int64(tt.ops) * baseFee; funding-minBalance < fee {
+				t.Errorf("funding of %d for %d subentries and %d ops does not cover fee %d above minimum balance %d", funding, tt.subentries, tt.ops, fee, minBalance)
+			}
+			if funding <= last {
+				t.Errorf("funding of %d for %d subentries and %d ops is no more than that of a simpler peg-out", funding, tt.subentries, tt.ops)
+			}
+			last = funding
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counting := &fakeClient{ClientInterface: c.hclient}
+		const amount = 10 * int64(xlm.Lumen)
+		tempAddr, _, err := SubmitPreExportTx(counting, exporter, c.AccountID.Address(), zioncoin.NativeAsset(), amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops, err := pegOutTxOps(c.AccountID.Address(), exporter.Address(), exporter.Address(), c.network, zioncoin.NativeAsset(), amount, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fee := int64(ops) * baseFee; fee != pegOutTxFee(baseFee, false) {
+			t.Fatalf("peg-out tx of %d ops has fee %d, but merge check expects %d", ops, fee, pegOutTxFee(baseFee, false))
+		}
+
+		// The temp account is created with the funding the peg-out needs.
+		var funding int64 = -1
+		for _, txe := range counting.txs {
+			var env xdr.TransactionEnvelope
+			err = xdr.SafeUnmarshalBase64(txe, &env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, op := range env.Tx.Operations {
+				if op.Body.Type == xdr.OperationTypeCreateAccount && op.Body.CreateAccountOp.Destination.Address() == tempAddr {
+					funding = int64(op.Body.CreateAccountOp.StartingBalance)
+				}
+			}
+		}
+		if want := tempAccountFunding(DefaultBaseReserve, baseFee, tempAccountSubentries, ops); funding != want {
+			t.Fatalf("temp account created with %d stroops, want %d", funding, want)
+		}
+
+		// So the merge check passes, returning all but the fee to the owner.
+		accounts := make(map[string]equator.Account)
+		hclient := &fakeClient{ClientInterface: c.hclient, loadAccount: loadAccountsFrom(accounts)}
+		c.hclient = hclient
+		accounts[tempAddr] = tempAccount(tempAddr, exporter.Address(), xlm.Amount(funding).HorizonString())
+		merged, reason, err := c.checkTempAccountMerge(tempAddr, exporter.Address(), c.BaseFee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason != "" || merged != funding-pegOutTxFee(baseFee, false) {
+			t.Errorf("got merge failure %q and merge of %d, want none and %d", reason, merged, funding-pegOutTxFee(baseFee, false))
+		}
+	})
+}
+
+func TestPegOutTempAccountWithTrustline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accounts := make(map[string]equator.Account)
+		hclient := &fakeClient{ClientInterface: c.hclient, loadAccount: loadAccountsFrom(accounts)}
+		c.hclient = hclient
+
+		readyTemp := insertTestExport(t, db, []byte("ready"), lumenXDR, 1000, exporter.Address())
+		accounts[readyTemp] = tempAccount(readyTemp, exporter.Address(), "2.5000000")
+		trustTemp := insertTestExport(t, db, []byte("trustline"), lumenXDR, 1000, exporter.Address())
+		accounts[trustTemp] = withTrustline(tempAccount(trustTemp, exporter.Address(), "2.5000000"))
+
+		ctx, cancel := context.WithCancel(ctx)
+		pegouts := make(chan pegOut)
+		done := make(chan struct{})
+		go func() {
+			c.pegOutFromExports(ctx, pegouts)
+			close(done)
+		}()
+		defer func() {
+			cancel()
+			for range pegouts {
+			}
+			<-done
+		}()
+
+		states := make(map[string]pegOutState)
+		for len(states) < 2 {
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for peg-outs")
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			case p := <-pegouts:
+				states[string(p.TxID)] = p.State
+			}
+		}
+		if states["ready"] != pegOutOK || states["trustline"] != pegOutFail {
+			t.Errorf("got peg-out states %v, want ready %d and trustline %d", states, pegOutOK, pegOutFail)
+		}
+		if n := atomic.LoadInt32(&hclient.submitted); n != 1 {
+			t.Errorf("got %d submitted peg-out txs, want 1", n)
+		}
+		var reason string
+		err = db.QueryRow("SELECT reason FROM export_failures WHERE txid=$1", []byte("trustline")).Scan(&reason)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(reason, "trustline") {
+			t.Errorf("got failure reason %q, want one about the trustline", reason)
+		}
+	})
+}
+
+func TestCosignedPegOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counting := &fakeClient{ClientInterface: c.hclient}
+		const amount = 10 * int64(xlm.Lumen)
+		tempAddr, seqnum, err := SubmitPreExportTxWithOptions(counting, exporter, c.AccountID.Address(), zioncoin.NativeAsset(), amount, PreExportOptions{Cosigned: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		preauth, err := ComputePegOutPreauthHash(PegOutParams{
+			Custodian: c.AccountID.Address(),
+			Exporter:  exporter.Address(),
+			TempAddr:  tempAddr,
+			Network:   c.network,
+			Asset:     zioncoin.NativeAsset(),
+			Amount:    amount,
+			Seqnum:    seqnum,
+			Cosigned:  true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The temp account needs both the preauth tx and the custodian to pay out,
+		// while the exporter alone can still cancel.
+		var (
+			threshold uint32
+			signers   = make(map[string]uint32)
+			funding   int64
+		)
+		for _, txe := range counting.txs {
+			var env xdr.TransactionEnvelope
+			err = xdr.SafeUnmarshalBase64(txe, &env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, op := range env.Tx.Operations {
+				if op.Body.Type == xdr.OperationTypeCreateAccount {
+					funding = int64(op.Body.CreateAccountOp.StartingBalance)
+				}
+				if op.Body.Type != xdr.OperationTypeSetOptions || op.SourceAccount == nil || op.SourceAccount.Address() != tempAddr {
+					continue
+				}
+				setOpts := op.Body.SetOptionsOp
+				if setOpts.MedThreshold != nil {
+					threshold = uint32(*setOpts.MedThreshold)
+				}
+				if setOpts.Signer != nil {
+					signers[setOpts.Signer.Key.Address()] = uint32(setOpts.Signer.Weight)
+				}
+			}
+		}
+		if threshold != 2 {
+			t.Errorf("got temp account threshold %d, want 2", threshold)
+		}
+		if signers[preauth] != 1 || signers[c.AccountID.Address()] != 1 {
+			t.Errorf("got preauth signer weight %d and custodian signer weight %d, want 1 and 1", signers[preauth], signers[c.AccountID.Address()])
+		}
+		if w := signers[exporter.Address()]; w < threshold {
+			t.Errorf("got exporter signer weight %d, below threshold %d", w, threshold)
+		}
+
+		// The custodian's checks expect the custodian signer.
+		accounts := make(map[string]equator.Account)
+		counting.loadAccount = loadAccountsFrom(accounts)
+		c.hclient = counting
+		account := tempAccount(tempAddr, exporter.Address(), xlm.Amount(funding).HorizonString())
+		account.Sequence = strconv.FormatInt(int64(seqnum), 10)
+		account.Signers[1].Key = preauth
+		accounts[tempAddr] = account
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := pegOut{
+			AssetXDR: lumenXDR,
+			TempAddr: tempAddr,
+			Seqnum:   int64(seqnum),
+			Exporter: exporter.Address(),
+			Amount:   amount,
+		}
+		reason, err := c.checkTempAccount(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(reason, "lacks custodian signer") {
+			t.Errorf("got failure %q for temp account without custodian signer, want one containing %q", reason, "lacks custodian signer")
+		}
+		account.Signers = append(account.Signers, equator.Signer{Key: c.AccountID.Address(), Weight: 1, Type: "ed25519_public_key"})
+		account.SubentryCount++
+		accounts[tempAddr] = account
+		reason, err = c.checkTempAccount(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason != "" {
+			t.Errorf("got failure %q for cosigned temp account, want none", reason)
+		}
+		merged, reason, err := c.checkTempAccountMerge(tempAddr, exporter.Address(), c.BaseFee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason != "" || merged != funding-pegOutTxFee(baseFee, true) {
+			t.Errorf("got merge failure %q and merge of %d, want none and %d", reason, merged, funding-pegOutTxFee(baseFee, true))
+		}
+
+		// The peg-out tx is the preauthorized one,
+		// removes the custodian's signer,
+		// and carries the custodian's signature.
+		var tempID, exporterID xdr.AccountId
+		err = tempID.SetAddress(tempAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = exporterID.SetAddress(exporter.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		counting.txs = nil
+		hash, _, err := c.pegOut(ctx, nil, exporterID, exporter.Address(), zioncoin.NativeAsset(), amount, nil, nil, tempID, seqnum, nil, c.BaseFee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(counting.txs) != 1 {
+			t.Fatalf("got %d peg-out txs submitted, want 1", len(counting.txs))
+		}
+		var env xdr.TransactionEnvelope
+		err = xdr.SafeUnmarshalBase64(counting.txs[0], &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawHash, err := hex.DecodeString(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantPreauth, err := strkey.Encode(strkey.VersionByteHashTx, rawHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wantPreauth != preauth {
+			t.Errorf("got peg-out tx with hash %s, want preauthorized %s", wantPreauth, preauth)
+		}
+		if fee := int64(env.Tx.Fee); fee != pegOutTxFee(baseFee, true) {
+			t.Errorf("got peg-out fee %d, want %d", fee, pegOutTxFee(baseFee, true))
+		}
+		var removesCustodian bool
+		for _, op := range env.Tx.Operations {
+			if op.Body.Type == xdr.OperationTypeSetOptions && op.Body.SetOptionsOp.Signer != nil && op.Body.SetOptionsOp.Signer.Key.Address() == c.AccountID.Address() && op.Body.SetOptionsOp.Signer.Weight == 0 {
+				removesCustodian = true
+			}
+		}
+		if !removesCustodian {
+			t.Error("peg-out tx does not remove the custodian's signer from the temp account")
+		}
+		custodianKP, err := keypair.Parse(c.seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hint := custodianKP.Hint()
+		var signed bool
+		for _, sig := range env.Signatures {
+			if sig.Hint == xdr.SignatureHint(hint) {
+				signed = true
+			}
+		}
+		if !signed {
+			t.Error("peg-out tx lacks the custodian's signature")
+		}
+	}, CosignPegOuts())
+}
+
+func TestBaseFee(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		if c.BaseFee != 3*baseFee {
+			t.Fatalf("got base fee %d, want %d", c.BaseFee, 3*baseFee)
+		}
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counting := &fakeClient{ClientInterface: c.hclient}
+		const amount = 10 * int64(xlm.Lumen)
+		tempAddr, seqnum, err := SubmitPreExportTxWithOptions(counting, exporter, c.AccountID.Address(), zioncoin.NativeAsset(), amount, PreExportOptions{BaseFee: c.BaseFee})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The pre-export txs pay the custodian's base fee,
+		// and preauthorize a peg-out tx paying it too.
+		var (
+			preauth string
+			funding int64
+		)
+		for _, txe := range counting.txs {
+			var env xdr.TransactionEnvelope
+			err = xdr.SafeUnmarshalBase64(txe, &env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := int64(len(env.Tx.Operations)) * c.BaseFee; int64(env.Tx.Fee) != want {
+				t.Errorf("got pre-export tx fee %d, want %d", env.Tx.Fee, want)
+			}
+			for _, op := range env.Tx.Operations {
+				if op.Body.SetOptionsOp != nil && op.Body.SetOptionsOp.Signer != nil && op.Body.SetOptionsOp.Signer.Key.Type == xdr.SignerKeyTypeSignerKeyTypePreAuthTx {
+					preauth = op.Body.SetOptionsOp.Signer.Key.Address()
+				}
+				if op.Body.Type == xdr.OperationTypeCreateAccount && op.Body.CreateAccountOp.Destination.Address() == tempAddr {
+					funding = int64(op.Body.CreateAccountOp.StartingBalance)
+				}
+			}
+		}
+		tx, err := buildPegOutTx(c.AccountID.Address(), exporter.Address(), exporter.Address(), tempAddr, c.network, zioncoin.NativeAsset(), amount, nil, nil, seqnum, nil, c.BaseFee, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fee := int64(tx.TX.Fee); fee != pegOutTxFee(c.BaseFee, false) {
+			t.Errorf("got peg-out tx fee %d, want %d", fee, pegOutTxFee(c.BaseFee, false))
+		}
+		hash, err := tx.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := strkey.Encode(strkey.VersionByteHashTx, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != preauth {
+			t.Errorf("peg-out tx at the custodian's base fee has hash %s, want preauth signer %s", got, preauth)
+		}
+		atDefault, err := ComputePegOutPreauthHash(PegOutParams{
+			Custodian: c.AccountID.Address(),
+			Exporter:  exporter.Address(),
+			TempAddr:  tempAddr,
+			Network:   c.network,
+			Asset:     zioncoin.NativeAsset(),
+			Amount:    amount,
+			Seqnum:    seqnum,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if atDefault == preauth {
+			t.Error("peg-out tx at the default base fee matches the preauth signer")
+		}
+
+		// The temp account is funded for the higher fee.
+		accounts := make(map[string]equator.Account)
+		hclient := &fakeClient{ClientInterface: c.hclient, loadAccount: loadAccountsFrom(accounts)}
+		c.hclient = hclient
+		accounts[tempAddr] = tempAccount(tempAddr, exporter.Address(), xlm.Amount(funding).HorizonString())
+		merged, reason, err := c.checkTempAccountMerge(tempAddr, exporter.Address(), c.BaseFee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason != "" || merged != funding-pegOutTxFee(c.BaseFee, false) {
+			t.Errorf("got merge failure %q and merge of %d, want none and %d", reason, merged, funding-pegOutTxFee(c.BaseFee, false))
+		}
+	}, BaseFee(3*baseFee))
+}
+
+func TestPegOutRecordedBaseFee(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The custodian's base fee was raised to 3x
+		// after the exports were pre-exported and recorded.
+		cases := []struct {
+			refFee, rowFee, wantFee int64
+		}{
+			{0, 0, 3 * baseFee},                     // recorded before fees were
+			{0, 2 * baseFee, 2 * baseFee},           // recorded at the custodian's old fee
+			{4 * baseFee, 2 * baseFee, 4 * baseFee}, // pre-exported with its own fee
+		}
+		// Temp account address to expected peg-out tx fee.
+		wantFee := make(map[string]int64)
+		for i, tt := range cases {
+			txid := []byte{byte(i)}
+			tempAddr := insertTestExport(t, db, txid, lumenXDR, 1000, exporter.Address())
+			var ref []byte
+			err = db.QueryRow("SELECT pegout_json FROM exports WHERE txid=$1", txid).Scan(&ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var p pegOut
+			err = json.Unmarshal(ref, &p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.BaseFee = tt.refFee
+			ref, err = json.Marshal(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.Exec("UPDATE exports SET pegout_json=$1, base_fee=$2 WHERE txid=$3", ref, tt.rowFee, txid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantFee[tempAddr] = pegOutTxFee(tt.wantFee, false)
+		}
+
+		pegouts := make(chan pegOut)
+		go c.pegOutFromExports(ctx, pegouts)
+		for i := 0; i < len(cases); {
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for peg-outs")
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			case p := <-pegouts:
+				if p.State != pegOutOK {
+					t.Errorf("export %x: got state %d, want %d", p.TxID, p.State, pegOutOK)
+				}
+				i++
+			}
+		}
+
+		streamCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		var cursor equator.Cursor
+		err = c.hclient.StreamTransactions(streamCtx, c.AccountID.Address(), &cursor, func(tx equator.Transaction) {
+			var env xdr.TransactionEnvelope
+			err := xdr.SafeUnmarshalBase64(tx.EnvelopeXdr, &env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			temp := env.Tx.SourceAccount.Address()
+			want, ok := wantFee[temp]
+			if !ok {
+				return
+			}
+			delete(wantFee, temp)
+			if int64(env.Tx.Fee) != want {
+				t.Errorf("got peg-out tx fee %d from %s, want %d", env.Tx.Fee, temp, want)
+			}
+			if len(wantFee) == 0 {
+				cancel()
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(wantFee) != 0 {
+			t.Errorf("missing %d peg-out tx(s)", len(wantFee))
+		}
+	}, BaseFee(3*baseFee))
+}
+
+func TestTempAccountMemo(t *testing.T) {
+	counting := &fakeClient{ClientInterface: mockequator.New()}
+	custodian, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempAddr, _, err := SubmitPreExportTxWithOptions(counting, exporter, custodian.Address(), zioncoin.NativeAsset(), 100, PreExportOptions{Memo: "deploy-7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counting.txs) != 2 {
+		t.Fatalf("got %d txs, want 2", len(counting.txs))
+	}
+
+	// Both the creation and the pre-export tx carry the memo.
+	created := false
+	for _, txe := range counting.txs {
+		var env xdr.TransactionEnvelope
+		err = xdr.SafeUnmarshalBase64(txe, &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Tx.Memo.Type != xdr.MemoTypeMemoText || *env.Tx.Memo.Text != "deploy-7" {
+			t.Errorf("got memo %+v, want text memo %q", env.Tx.Memo, "deploy-7")
+		}
+		for _, op := range env.Tx.Operations {
+			if op.Body.Type == xdr.OperationTypeCreateAccount && op.Body.CreateAccountOp.Destination.Address() == tempAddr {
+				created = true
+			}
+		}
+	}
+	if !created {
+		t.Error("found no tx creating the temp account")
+	}
+
+	_, _, err = SubmitPreExportTxWithOptions(counting, exporter, custodian.Address(), zioncoin.NativeAsset(), 100, PreExportOptions{Memo: "a memo too long to fit in a text memo"})
+	if err == nil {
+		t.Error("got no error for an overlong memo")
+	}
+	if len(counting.txs) != 2 {
+		t.Errorf("got %d txs after overlong memo, want still 2", len(counting.txs))
+	}
+}
@@ -0,0 +1,140 @@
+package slidechain
+
+import (
+	"sync"
+
+	"github.com/chain/txvm/errors"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/xdr"
+)
+
+// Default limits on the pre-exports in progress at once
+// (see TempAccountLimiter).
+const (
+	DefaultMaxTempAccounts            = 64
+	DefaultMaxTempAccountsPerExporter = 4
+)
+
+// ErrTempAccountLimit is the root of the error returned by SubmitPreExportTx
+// when another temp account would exceed a limit of its TempAccountLimiter.
+var ErrTempAccountLimit = errors.New("too many temp accounts being created")
+
+var defaultTempAccountLimiter = &TempAccountLimiter{
+	Max:            DefaultMaxTempAccounts,
+	MaxPerExporter: DefaultMaxTempAccountsPerExporter,
+}
+
+// TempAccountLimiter limits the pre-exports in progress at once,
+// in all and for each exporter,
+// since each creates and funds a temp account.
+// This keeps a flood of pre-exports
+// from draining the exporters' accounts or spamming the Horizon server.
+// The limits are soft:
+// a pre-export beyond one fails at once with ErrTempAccountLimit
+// rather than waiting, and can be retried later.
+// A zero limit is no limit.
+// A pre-export uses a limiter through PreExportOptions.Limiter.
+type TempAccountLimiter struct {
+	Max            int
+	MaxPerExporter int
+
+	// MaxOutstandingPerExporter, if positive,
+	// limits the temp accounts each exporter may have outstanding at once:
+	// created by a pre-export but not yet merged,
+	// by its peg-out or by TempAccounts.CancelPreExport.
+	// Unlike MaxPerExporter, it counts finished pre-exports,
+	// so an exporter cannot sink unbounded lumens into temp accounts
+	// whose exports were never completed or canceled.
+	// The limit requires the pre-exports to be tracked
+	// (see PreExportOptions.TempAccounts).
+	MaxOutstandingPerExporter int
+
+	// Protects total and exporters.
+	mu        sync.Mutex
+	total     int
+	exporters map[string]int
+}
+
+// submit makes the pre-export of exporter kp with preExport,
+// within l's limits,
+// recording its temp account in temps, if not nil.
+func (l *TempAccountLimiter) submit(hclient equator.ClientInterface, kp *keypair.Full, temps *TempAccounts, preExport func() (string, xdr.SequenceNumber, error)) (string, xdr.SequenceNumber, error) {
+	exporter := kp.Address()
+	err := l.acquire(exporter)
+	if err != nil {
+		return "", 0, err
+	}
+	defer l.release(exporter)
+	if l.MaxOutstandingPerExporter > 0 {
+		err = l.checkOutstanding(hclient, temps, exporter)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	tempAddr, seqnum, err := preExport()
+	if err != nil {
+		return "", 0, err
+	}
+	if temps != nil {
+		// Recorded before release,
+		// so that concurrent pre-exports always count it.
+		err = temps.record(tempAddr, exporter)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	return tempAddr, seqnum, nil
+}
+
+// checkOutstanding returns an error wrapping ErrTempAccountLimit
+// if exporter has MaxOutstandingPerExporter temp accounts
+// outstanding in temps or being created.
+func (l *TempAccountLimiter) checkOutstanding(hclient equator.ClientInterface, temps *TempAccounts, exporter string) error {
+	if temps == nil {
+		return errors.New("TempAccountLimiter.MaxOutstandingPerExporter requires PreExportOptions.TempAccounts")
+	}
+	outstanding, err := temps.outstanding(hclient, exporter)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	// Less one for the pre-export being checked.
+	creating := l.exporters[exporter] - 1
+	l.mu.Unlock()
+
+	if outstanding+creating >= l.MaxOutstandingPerExporter {
+		return errors.Wrapf(ErrTempAccountLimit, "exporter %s has %d temp accounts outstanding and %d being created; complete or cancel a pre-export first", exporter, outstanding, creating)
+	}
+	return nil
+}
+
+func (l *TempAccountLimiter) acquire(exporter string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.Max > 0 && l.total >= l.Max {
+		return errors.Wrapf(ErrTempAccountLimit, "%d pre-exports in progress", l.total)
+	}
+	if l.MaxPerExporter > 0 && l.exporters[exporter] >= l.MaxPerExporter {
+		return errors.Wrapf(ErrTempAccountLimit, "%d pre-exports in progress for exporter %s", l.exporters[exporter], exporter)
+	}
+	if l.exporters == nil {
+		l.exporters = make(map[string]int)
+	}
+	l.total++
+	l.exporters[exporter]++
+	return nil
+}
+
+func (l *TempAccountLimiter) release(exporter string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	l.exporters[exporter]--
+	if l.exporters[exporter] == 0 {
+		delete(l.exporters, exporter)
+	}
+}
@@ -0,0 +1,165 @@
+package slidechain
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interzioncoin/slingshot/slidechain/mockequator"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestTempAccountLimiter(t *testing.T) {
+	// Submissions wait until release is closed.
+	var (
+		started = make(chan struct{}, 16)
+		release = make(chan struct{})
+	)
+	hclient := &fakeClient{ClientInterface: mockequator.New()}
+	hclient.submitTransaction = func(txeBase64 string) (equator.TransactionSuccess, error) {
+		started <- struct{}{}
+		<-release
+		return hclient.ClientInterface.SubmitTransaction(txeBase64)
+	}
+	limiter := &TempAccountLimiter{Max: 3, MaxPerExporter: 2}
+	custodian, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporters := make(map[string]*keypair.Full)
+	for _, name := range []string{"a", "b", "c"} {
+		exporters[name], err = keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	preExport := func(name string) error {
+		_, _, err := SubmitPreExportTxWithOptions(hclient, exporters[name], custodian.Address(), zioncoin.NativeAsset(), 100, PreExportOptions{Limiter: limiter})
+		return err
+	}
+	errs := make(chan error, 3)
+	start := func(name string) {
+		go func() { errs <- preExport(name) }()
+		// Wait for its temp account creation to be under way.
+		<-started
+	}
+
+	start("a")
+	start("a")
+	err = preExport("a")
+	if errors.Root(err) != ErrTempAccountLimit {
+		t.Errorf("got error %v for a third pre-export by one exporter, want %v", err, ErrTempAccountLimit)
+	}
+	start("b")
+	err = preExport("c")
+	if errors.Root(err) != ErrTempAccountLimit {
+		t.Errorf("got error %v for a fourth pre-export in all, want %v", err, ErrTempAccountLimit)
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		err = <-errs
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Finished pre-exports free their places.
+	err = preExport("c")
+	if err != nil {
+		t.Errorf("pre-export after others finished: %s", err)
+	}
+}
+
+func TestTempAccountOutstandingLimit(t *testing.T) {
+	testdir, err := ioutil.TempDir("", "slidechaintest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testdir)
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s/tempdb", testdir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	custodian, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := make(map[string]bool)
+	mock := mockequator.New()
+	hclient := &fakeClient{ClientInterface: mock, loadAccount: loadTempAccounts(mock, exporter.Address(), merged)}
+	limiter := &TempAccountLimiter{MaxOutstandingPerExporter: 2}
+	temps := &TempAccounts{DB: db}
+	preExport := func(kp *keypair.Full) (string, error) {
+		tempAddr, _, err := SubmitPreExportTxWithOptions(hclient, kp, custodian.Address(), zioncoin.NativeAsset(), 100, PreExportOptions{Limiter: limiter, TempAccounts: temps})
+		return tempAddr, err
+	}
+
+	first, err := preExport(exporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := preExport(exporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = preExport(exporter)
+	if errors.Root(err) != ErrTempAccountLimit {
+		t.Errorf("got error %v for a third outstanding temp account, want %v", err, ErrTempAccountLimit)
+	}
+	// The limit is per exporter.
+	_, err = preExport(other)
+	if err != nil {
+		t.Errorf("pre-export by another exporter: %s", err)
+	}
+
+	// A temp account merged by its peg-out is no longer outstanding.
+	merged[first] = true
+	_, err = preExport(exporter)
+	if err != nil {
+		t.Fatalf("pre-export after a peg-out: %s", err)
+	}
+	_, err = preExport(exporter)
+	if errors.Root(err) != ErrTempAccountLimit {
+		t.Errorf("got error %v with two temp accounts outstanding again, want %v", err, ErrTempAccountLimit)
+	}
+
+	// Nor is one canceled through its TempAccounts.
+	err = temps.CancelPreExport(hclient, exporter, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = preExport(exporter)
+	if err != nil {
+		t.Errorf("pre-export after a cancellation: %s", err)
+	}
+
+	var n int
+	err = db.QueryRow("SELECT COUNT(*) FROM temp_accounts WHERE exporter=$1", exporter.Address()).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got %d temp accounts recorded for the exporter, want 2", n)
+	}
+
+	// Without tracking the limit cannot be kept.
+	_, _, err = SubmitPreExportTxWithOptions(hclient, exporter, custodian.Address(), zioncoin.NativeAsset(), 100, PreExportOptions{Limiter: &TempAccountLimiter{MaxOutstandingPerExporter: 1}})
+	if err == nil {
+		t.Error("got no error from an outstanding limit without TempAccounts")
+	}
+}
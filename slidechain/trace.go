@@ -0,0 +1,114 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	b "github.com/zioncoin/go/build"
+)
+
+// Tracer starts the spans with which the custodian traces each export
+// through its peg-out:
+//   - slidechain.export, recording the export (see watchExports),
+//     the root of the export's trace;
+//   - slidechain.pegout, submitting its peg-out tx (see pegOutFromExports);
+//   - slidechain.postpegout, retiring or refunding its funds on txvm (see watchPegOuts);
+//   - equator.submit, each submission to the equator server,
+//     as a child of the span submitting it.
+//
+// The export's span context is stored with it in the db,
+// so that the later, asynchronous spans are in its trace.
+// An adapter to an OpenTelemetry TracerProvider satisfies Tracer,
+// starting spans with remote parents from SpanContexts.
+type Tracer interface {
+	// Start starts a span named name
+	// as a child of parent, if it is valid,
+	// and otherwise of the span in ctx, if any.
+	// It returns ctx with the new span.
+	Start(ctx context.Context, name string, parent SpanContext) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SpanContext() SpanContext
+	SetAttribute(key, value string)
+
+	// End ends the span,
+	// recording err, if not nil, as its error.
+	End(err error)
+}
+
+// SpanContext identifies a span across processes and db rows.
+// The zero SpanContext is invalid, and identifies no span.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// IsValid reports whether sc identifies a span.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// String returns sc as a W3C traceparent header value,
+// or the empty string if sc is invalid.
+func (sc SpanContext) String() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("00-%x-%x-01", sc.TraceID[:], sc.SpanID[:])
+}
+
+// parseSpanContext parses a W3C traceparent header value,
+// returning the invalid SpanContext for an empty or malformed one.
+func parseSpanContext(s string) SpanContext {
+	var sc SpanContext
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || len(parts[1]) != 2*len(sc.TraceID) || len(parts[2]) != 2*len(sc.SpanID) {
+		return SpanContext{}
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}
+	}
+	return sc
+}
+
+// Tracing causes the custodian to trace exports through their peg-outs
+// with spans started by t (see Tracer).
+// By default the custodian traces nothing.
+func Tracing(t Tracer) Option {
+	return func(c *Custodian) {
+		c.tracer = t
+	}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SpanContext() SpanContext       { return SpanContext{} }
+func (noopSpan) SetAttribute(key, value string) {}
+func (noopSpan) End(err error)                  {}
+
+// startSpan starts a span with the custodian's tracer, if any (see Tracer.Start).
+func (c *Custodian) startSpan(ctx context.Context, name string, parent SpanContext) (context.Context, Span) {
+	if c.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return c.tracer.Start(ctx, name, parent)
+}
+
+// signAndSubmitTx signs the Zioncoin tx with the given hash with the custodian's seed
+// and submits it to the equator server,
+// in a child of the span in ctx.
+func (c *Custodian) signAndSubmitTx(ctx context.Context, tx *b.TransactionBuilder, hash string) error {
+	_, span := c.startSpan(ctx, "equator.submit", SpanContext{})
+	span.SetAttribute("zioncoin.tx", hash)
+	_, err := zioncoin.SignAndSubmitTx(c.hclient, tx, c.seed)
+	span.End(err)
+	return err
+}
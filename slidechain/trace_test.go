@@ -0,0 +1,193 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+)
+
+type recordedSpan struct {
+	name   string
+	parent SpanContext
+	sc     SpanContext
+	ended  bool
+}
+
+type recordedSpanKey struct{}
+
+// recordingTracer records the spans it starts,
+// numbering them in order.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, parent SpanContext) (context.Context, Span) {
+	if !parent.IsValid() {
+		if s, ok := ctx.Value(recordedSpanKey{}).(*recordedSpan); ok {
+			parent = s.sc
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := &recordedSpan{name: name, parent: parent}
+	n := uint64(len(t.spans) + 1)
+	if parent.IsValid() {
+		s.sc.TraceID = parent.TraceID
+	} else {
+		binary.BigEndian.PutUint64(s.sc.TraceID[8:], n)
+	}
+	binary.BigEndian.PutUint64(s.sc.SpanID[:], n)
+	t.spans = append(t.spans, s)
+	return context.WithValue(ctx, recordedSpanKey{}, s), &recordingSpan{t: t, s: s}
+}
+
+// named returns the spans named name.
+func (t *recordingTracer) named(name string) []recordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var spans []recordedSpan
+	for _, s := range t.spans {
+		if s.name == name {
+			spans = append(spans, *s)
+		}
+	}
+	return spans
+}
+
+type recordingSpan struct {
+	t *recordingTracer
+	s *recordedSpan
+}
+
+func (s *recordingSpan) SpanContext() SpanContext       { return s.s.sc }
+func (s *recordingSpan) SetAttribute(key, value string) {}
+
+func (s *recordingSpan) End(err error) {
+	s.t.mu.Lock()
+	s.s.ended = true
+	s.t.mu.Unlock()
+}
+
+func TestSpanContextString(t *testing.T) {
+	var sc SpanContext
+	if s := sc.String(); s != "" {
+		t.Errorf("got %q for invalid span context, want empty", s)
+	}
+	sc.TraceID[15], sc.SpanID[7] = 1, 2
+	const want = "00-00000000000000000000000000000001-0000000000000002-01"
+	if s := sc.String(); s != want {
+		t.Errorf("got %q, want %q", s, want)
+	}
+	if got := parseSpanContext(want); got != sc {
+		t.Errorf("parsed %q as %+v, want %+v", want, got, sc)
+	}
+	for _, s := range []string{"", "00-01-02-01", "00-" + want[3:35] + "-zzzzzzzzzzzzzzzz-01"} {
+		if got := parseSpanContext(s); got.IsValid() {
+			t.Errorf("parsed malformed %q as valid %+v", s, got)
+		}
+	}
+}
+
+func TestTracePegOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tracer := new(recordingTracer)
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		pegouts := make(chan pegOut)
+		go c.pegOutFromExports(ctx, pegouts)
+
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		asset := zioncoin.NativeAsset()
+		assetXDR, err := asset.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		const amount = 50
+		tempAddr, seqnum, err := SubmitPreExportTx(c.hclient, exporter, c.AccountID.Address(), asset, amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var zero32 [32]byte
+		info := pegOut{
+			AssetXDR: assetXDR,
+			TempAddr: tempAddr,
+			Seqnum:   int64(seqnum),
+			Exporter: exporter.Address(),
+			Amount:   amount,
+			Anchor:   zero32[:],
+			Pubkey:   zero32[:],
+		}
+		ref, err := json.Marshal(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.recordExport(ctx, []byte("traced"), ref, info, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.exports.Broadcast()
+
+		var p pegOut
+		select {
+		case <-ctx.Done():
+			t.Fatal("context timed out: no peg-out")
+		case p = <-pegouts:
+		}
+		// The export has no funds on txvm, so its post-peg-out fails,
+		// but is traced all the same.
+		postCtx, cancelPost := context.WithTimeout(ctx, 5*time.Second)
+		c.doPostPegOut(postCtx, p)
+		cancelPost()
+
+		exports := tracer.named("slidechain.export")
+		if len(exports) != 1 {
+			t.Fatalf("got %d export spans, want 1", len(exports))
+		}
+		export := exports[0]
+		if export.parent.IsValid() {
+			t.Errorf("export span has parent %s, want none", export.parent)
+		}
+		pegOutSpans := tracer.named("slidechain.pegout")
+		if len(pegOutSpans) != 1 || pegOutSpans[0].parent != export.sc {
+			t.Fatalf("got peg-out spans %+v, want one child of export span %s", pegOutSpans, export.sc)
+		}
+		pegOutSpan := pegOutSpans[0]
+		var submitted bool
+		for _, s := range tracer.named("equator.submit") {
+			if s.parent == pegOutSpan.sc {
+				submitted = true
+			}
+			if !s.ended {
+				t.Errorf("submit span %s not ended", s.sc)
+			}
+		}
+		if !submitted {
+			t.Errorf("got no submit span in peg-out span %s", pegOutSpan.sc)
+		}
+		posts := tracer.named("slidechain.postpegout")
+		if len(posts) != 1 || posts[0].parent != export.sc {
+			t.Errorf("got post-peg-out spans %+v, want one child of export span %s", posts, export.sc)
+		}
+		for _, s := range []recordedSpan{export, pegOutSpan} {
+			if !s.ended {
+				t.Errorf("%s span %s not ended", s.name, s.sc)
+			}
+		}
+	}, Tracing(tracer))
+}
@@ -0,0 +1,332 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/interzioncoin/slingshot/slidechain/net"
+	"github.com/zioncoin/go/xdr"
+)
+
+// DefaultTrancheInterval is the default interval between the partial payments
+// of a peg-out split into tranches: about one Zioncoin ledger.
+const DefaultTrancheInterval = 5 * time.Second
+
+// TrancheInterval sets the interval between the partial payments
+// of a peg-out split into tranches (by default, DefaultTrancheInterval).
+// At most one tranche of each peg-out is paid per interval.
+func TrancheInterval(d time.Duration) Option {
+	return func(c *Custodian) {
+		c.trancheInterval = d
+	}
+}
+
+type trancheState int
+
+const (
+	trancheNotYet trancheState = iota
+
+	// trancheSubmitted is recorded just before a tranche's payment is submitted.
+	// A tranche left in this state, e.g. by a crash,
+	// may or may not have been paid,
+	// so like a failed tranche it pauses its export's schedule.
+	trancheSubmitted
+
+	tranchePaid
+	trancheFailed
+)
+
+// A peg-out split into tranches (see FeePolicy.Split)
+// pays its first tranche with the preauthorized peg-out tx,
+// which consumes the temp account and so commits the export to pegging out.
+// Its export is then in state pegOutPartial,
+// and watchPegOuts calls payTranches to pay the rest,
+// recorded in the tranches table by scheduleTranches,
+// from the custodian's account.
+
+// scheduleTranches records the tranches of export txid
+// after the first (the peg-out tx's payment),
+// to be paid once the export is in state pegOutPartial.
+// Scheduling the same export again has no effect.
+func (c *Custodian) scheduleTranches(ctx context.Context, txid []byte, amounts []int64) error {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	for i, amount := range amounts {
+		_, err = dbtx.ExecContext(ctx, `INSERT OR IGNORE INTO tranches (export_txid, idx, amount) VALUES ($1, $2, $3)`, txid, i+1, amount)
+		if err != nil {
+			return errors.Wrapf(err, "scheduling tranche %d of export %x", i+1, txid)
+		}
+	}
+	return errors.Wrapf(dbtx.Commit(), "committing tranches of export %x", txid)
+}
+
+// trancheComponent is the component of the custodian's health
+// reporting exports whose tranches cannot be paid.
+const trancheComponent = "peg-out tranches"
+
+// trancheSchedule is the progress of an export's tranches.
+type trancheSchedule struct {
+	txid, ref  []byte
+	version    int64  // version of the export
+	zioncoinTx string // hash of the peg-out tx, which paid the first tranche
+	trace      string // span context of the export (see Tracer)
+	next       int    // index of the next tranche to pay, 0 if all are paid
+	amount     int64  // amount of the next tranche
+	paused     bool   // whether a tranche has failed or may not have been paid
+}
+
+// payTranches pays the next tranche of each export in state pegOutPartial
+// whose schedule is not paused,
+// and marks the exports with all tranches paid as pegged out.
+// It returns those exports, for post-peg-out.
+// It returns an error only if ctx is canceled.
+func (c *Custodian) payTranches(ctx context.Context) ([]pegOut, error) {
+	const q = `SELECT e.txid, e.pegout_json, e.version, e.zioncoin_tx, e.trace_parent, t.idx, t.amount, t.state FROM exports e JOIN tranches t ON t.export_txid = e.txid WHERE e.pegged_out = $1 AND e.custodian_id = $2 ORDER BY e.txid, t.idx`
+	var schedules []*trancheSchedule
+	err := c.retryDB(ctx, "reading tranches", func(ctx context.Context) error {
+		schedules = nil
+		return sqlutil.ForQueryRows(ctx, c.DB, q, pegOutPartial, c.label, func(txid, ref []byte, version int64, zioncoinTx, trace string, idx int, amount int64, state trancheState) {
+			if len(schedules) == 0 || string(schedules[len(schedules)-1].txid) != string(txid) {
+				schedules = append(schedules, &trancheSchedule{txid: txid, ref: ref, version: version, zioncoinTx: zioncoinTx, trace: trace})
+			}
+			s := schedules[len(schedules)-1]
+			switch state {
+			case trancheNotYet:
+				if s.next == 0 {
+					s.next, s.amount = idx, amount
+				}
+			case trancheSubmitted, trancheFailed:
+				s.paused = true
+			}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		settled     []pegOut
+		due         []tranchePayment
+		undecodable int
+	)
+	for _, s := range schedules {
+		if s.paused || c.submissionsHalted() {
+			continue
+		}
+		var p pegOut
+		err := decodeRefdata(s.ref, &p)
+		if err != nil {
+			// Needs an operator; the other exports' tranches are still paid.
+			log.Printf("decoding reference data of export %x: %s", s.txid, err)
+			undecodable++
+			continue
+		}
+		p.TxID = s.txid
+		p.Version = s.version
+		p.Trace = parseSpanContext(s.trace)
+		if s.next == 0 {
+			p.Version, p.State, err = c.recordExportOutcome(ctx, s.txid, s.version, pegOutPartial, pegOutOK, s.zioncoinTx)
+			if err != nil {
+				continue
+			}
+			log.Printf("all tranches of export %x paid", s.txid)
+			if p.State == pegOutOK || p.State == pegOutFail {
+				settled = append(settled, p)
+			}
+			continue
+		}
+		due = append(due, tranchePayment{p: p, idx: s.next, amount: s.amount})
+	}
+	if undecodable > 0 {
+		c.health.setUnhealthy(trancheComponent, fmt.Errorf("%d exports with tranches due have undecodable reference data", undecodable))
+	} else {
+		c.health.setHealthy(trancheComponent)
+	}
+	for size := c.pegOutBatchSize(); len(due) > 0; {
+		if c.submissionsHalted() {
+			break
+		}
+		n := size
+		if n > len(due) {
+			n = len(due)
+		}
+		err = c.payTrancheBatch(ctx, due[:n])
+		if err != nil {
+			return nil, err
+		}
+		due = due[n:]
+	}
+	return settled, nil
+}
+
+// A tranchePayment is the payment of tranche idx of peg-out p.
+type tranchePayment struct {
+	p      pegOut
+	idx    int
+	amount int64
+}
+
+// payTrancheBatch pays tranches in one Zioncoin tx
+// from the custodian's account (see MaxPegOutBatch),
+// recording the outcome of each in the tranches table.
+// The tranches succeed or fail together with the tx:
+// if it fails, each is marked failed,
+// pausing its export's schedule until ResumeTranches is called.
+// It returns an error only if ctx is canceled.
+func (c *Custodian) payTrancheBatch(ctx context.Context, tranches []tranchePayment) error {
+	for _, t := range tranches {
+		err := c.retryDB(ctx, "recording tranche submission", func(ctx context.Context) error {
+			return c.setTrancheState(ctx, t.p.TxID, t.idx, t.amount, trancheSubmitted, "", "")
+		})
+		if err != nil {
+			return err
+		}
+	}
+	var (
+		state  = tranchePaid
+		reason string
+	)
+	for _, t := range tranches {
+		log.Printf("paying tranche %d of export %x: %d to %s", t.idx, t.p.TxID, t.amount, t.p.Exporter)
+	}
+	hash, err := c.submitTranches(ctx, tranches)
+	if err != nil {
+		for _, t := range tranches {
+			log.Printf("paying tranche %d of export %x: %s; pausing its schedule", t.idx, t.p.TxID, err)
+		}
+		state, reason = trancheFailed, err.Error()
+	}
+	for _, t := range tranches {
+		err := c.retryDB(ctx, "recording tranche payment", func(ctx context.Context) error {
+			return c.setTrancheState(ctx, t.p.TxID, t.idx, t.amount, state, hash, reason)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// submitTranches pays each of tranches
+// of its peg-out's asset to its peg-out's exporter,
+// in one tx from the custodian's account,
+// in a slidechain.pegout span of each peg-out's trace.
+// It returns the hex-encoded hash of the Zioncoin tx.
+func (c *Custodian) submitTranches(ctx context.Context, tranches []tranchePayment) (string, error) {
+	payments := make([]batchPayment, 0, len(tranches))
+	for _, t := range tranches {
+		var asset xdr.Asset
+		err := xdr.SafeUnmarshal(t.p.AssetXDR, &asset)
+		if err != nil {
+			return "", errors.Wrapf(err, "unmarshaling asset from XDR %x", t.p.AssetXDR)
+		}
+		payments = append(payments, batchPayment{destination: t.p.Exporter, asset: asset, amount: t.amount})
+	}
+	tx, err := c.buildBatchPegOutTx(payments)
+	if err != nil {
+		return "", errors.Wrap(err, "building tranche tx")
+	}
+	hash, err := tx.HashHex()
+	if err != nil {
+		return "", errors.Wrap(err, "hashing tranche tx")
+	}
+	var spans []Span
+	submitCtx := ctx
+	for i, t := range tranches {
+		spanCtx, span := c.startSpan(ctx, "slidechain.pegout", t.p.Trace)
+		span.SetAttribute("slidechain.export", hex.EncodeToString(t.p.TxID))
+		if i == 0 {
+			submitCtx = spanCtx
+		}
+		spans = append(spans, span)
+	}
+	err = c.submitCustodianTx(submitCtx, tx, hash)
+	for _, span := range spans {
+		span.End(err)
+	}
+	return hash, errors.Wrap(err, "submitting tranche tx")
+}
+
+// setTrancheState records the state of tranche idx of export txid,
+// logging an event for a paid or failed tranche in the same db transaction.
+func (c *Custodian) setTrancheState(ctx context.Context, txid []byte, idx int, amount int64, state trancheState, zioncoinTx, reason string) error {
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	_, err = dbtx.ExecContext(ctx, `UPDATE tranches SET state=$1, zioncoin_tx=$2 WHERE export_txid=$3 AND idx=$4`, state, zioncoinTx, txid, idx)
+	if err != nil {
+		return errors.Wrapf(err, "updating tranche %d of export %x", idx, txid)
+	}
+	if state == tranchePaid || state == trancheFailed {
+		err = appendEvent(ctx, dbtx, Event{
+			Type:       EventTranche,
+			TxVMTxID:   txid,
+			ZioncoinTx: zioncoinTx,
+			Amount:     amount,
+			Reason:     reason,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return errors.Wrapf(dbtx.Commit(), "committing tranche %d of export %x", idx, txid)
+}
+
+// ResumeTranches resumes the schedule of export txid
+// after a tranche's payment failed,
+// retrying the failed tranche.
+// A tranche whose payment may or may not have happened,
+// because the custodian stopped while submitting it,
+// is retried too,
+// so the operator must first check that it was not paid.
+func (c *Custodian) ResumeTranches(ctx context.Context, txid []byte) error {
+	if c.observer {
+		return errObserver
+	}
+	result, err := c.DB.ExecContext(ctx, `UPDATE tranches SET state=$1, zioncoin_tx='' WHERE export_txid=$2 AND state IN ($3, $4)`, trancheNotYet, txid, trancheSubmitted, trancheFailed)
+	if err != nil {
+		return errors.Wrapf(err, "resuming tranches of export %x", txid)
+	}
+	numAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "checking rows affected by resuming tranches of export %x", txid)
+	}
+	if numAffected == 0 {
+		return fmt.Errorf("no paused tranches for export %x", txid)
+	}
+	log.Printf("resuming tranches of export %x", txid)
+	return nil
+}
+
+// ResumeTranchesHandler resumes the tranches of the export
+// given by the txid form value in response to a POST request.
+func (c *Custodian) ResumeTranchesHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	txid, err := hex.DecodeString(req.FormValue("txid"))
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "decoding txid: %s", err)
+		return
+	}
+	err = c.ResumeTranches(req.Context(), txid)
+	if err != nil {
+		net.Errorf(w, http.StatusNotFound, "%s", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
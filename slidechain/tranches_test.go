@@ -0,0 +1,373 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/xdr"
+)
+
+func TestFeePolicySplit(t *testing.T) {
+	cases := []struct {
+		policy FeePolicy
+		payout int64
+		want   []int64
+	}{
+		{FeePolicy{}, 100, []int64{100}},
+		{FeePolicy{Tranches: 1}, 100, []int64{100}},
+		{FeePolicy{Tranches: 2}, 100, []int64{50, 50}},
+		{FeePolicy{Tranches: 3}, 100, []int64{34, 33, 33}},
+		{FeePolicy{Tranches: 2, TrancheMin: 1000}, 999, []int64{999}},
+		{FeePolicy{Tranches: 2, TrancheMin: 1000}, 1000, []int64{500, 500}},
+		{FeePolicy{Tranches: 5}, 3, []int64{3}},
+		{FeePolicy{MaxPerTx: 100}, 100, []int64{100}},
+		{FeePolicy{MaxPerTx: 100}, 250, []int64{50, 100, 100}},
+		{FeePolicy{MaxPerTx: 100}, 300, []int64{100, 100, 100}},
+		{FeePolicy{Tranches: 2, MaxPerTx: 100}, 200, []int64{100, 100}},
+		{FeePolicy{Tranches: 2, MaxPerTx: 100}, 201, []int64{1, 100, 100}},
+	}
+	for _, c := range cases {
+		got := c.policy.Split(c.payout)
+		if len(got) != len(c.want) {
+			t.Errorf("%+v.Split(%d): got %v, want %v", c.policy, c.payout, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%+v.Split(%d): got %v, want %v", c.policy, c.payout, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestTranchedPegOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	fees := map[string]FeePolicy{"native": {Tranches: 2}}
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		c.hclient = hclient
+
+		txid := []byte("export")
+		insertTestExport(t, db, txid, lumenXDR, 1000, exporter.Address())
+
+		exportState := func() pegOutState {
+			var state pegOutState
+			err := db.QueryRow("SELECT pegged_out FROM exports WHERE txid=$1", txid).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return state
+		}
+		trancheState := func() trancheState {
+			var state trancheState
+			err := db.QueryRow("SELECT state FROM tranches WHERE export_txid=$1 AND idx=1", txid).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return state
+		}
+		lastPayment := func() int64 {
+			hclient.mu.Lock()
+			defer hclient.mu.Unlock()
+			var env xdr.TransactionEnvelope
+			err := xdr.SafeUnmarshalBase64(hclient.txs[len(hclient.txs)-1], &env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, op := range env.Tx.Operations {
+				if op.Body.Type == xdr.OperationTypePayment {
+					return int64(op.Body.PaymentOp.Amount)
+				}
+			}
+			t.Fatal("no payment in last submitted tx")
+			return 0
+		}
+
+		// The peg-out tx pays the first tranche.
+		pegOutCtx, cancelPegOuts := context.WithCancel(ctx)
+		pegouts := make(chan pegOut)
+		done := make(chan struct{})
+		go func() {
+			c.pegOutFromExports(pegOutCtx, pegouts)
+			close(done)
+		}()
+		for exportState() != pegOutPartial {
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for first tranche")
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			case p := <-pegouts:
+				t.Fatalf("got peg-out in state %d before all tranches were paid", p.State)
+			}
+		}
+		cancelPegOuts()
+		for range pegouts {
+		}
+		<-done
+		if paid := lastPayment(); paid != 500 {
+			t.Errorf("got first tranche of %d, want 500", paid)
+		}
+
+		// The second tranche fails, pausing the schedule.
+		atomic.StoreInt32(&hclient.fails, 1)
+		settled, err := c.payTranches(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(settled) != 0 || trancheState() != trancheFailed {
+			t.Fatalf("got %d settled exports and tranche state %d after failure, want 0 and %d", len(settled), trancheState(), trancheFailed)
+		}
+		submitted := atomic.LoadInt32(&hclient.submitted)
+		settled, err = c.payTranches(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := atomic.LoadInt32(&hclient.submitted); len(settled) != 0 || n != submitted {
+			t.Fatalf("paused schedule submitted %d txs and settled %d exports, want 0 and 0", n-submitted, len(settled))
+		}
+
+		// Once resumed, the second tranche is paid,
+		// and then the export is settled.
+		err = c.ResumeTranches(ctx, txid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settled, err = c.payTranches(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(settled) != 0 || trancheState() != tranchePaid {
+			t.Fatalf("got %d settled exports and tranche state %d after resuming, want 0 and %d", len(settled), trancheState(), tranchePaid)
+		}
+		if paid := lastPayment(); paid != 500 {
+			t.Errorf("got second tranche of %d, want 500", paid)
+		}
+		if exportState() != pegOutPartial {
+			t.Errorf("got export state %d before settling, want %d", exportState(), pegOutPartial)
+		}
+		settled, err = c.payTranches(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(settled) != 1 || settled[0].State != pegOutOK || exportState() != pegOutOK {
+			t.Errorf("got settled exports %+v and export state %d, want one export pegged out", settled, exportState())
+		}
+
+		events, err := c.ReadEvents(ctx, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var failed, paid int
+		for _, ev := range events {
+			if ev.Type != EventTranche {
+				continue
+			}
+			if ev.Reason != "" {
+				failed++
+			} else {
+				paid++
+			}
+		}
+		if failed != 1 || paid != 1 {
+			t.Errorf("got %d failed and %d paid tranche events, want 1 and 1", failed, paid)
+		}
+	}, PegOutFees(fees))
+}
+
+func TestCappedPegOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	fees := map[string]FeePolicy{"native": {MaxPerTx: 100}}
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		c.hclient = hclient
+
+		txid := []byte("capped")
+		insertTestExport(t, db, txid, lumenXDR, 250, exporter.Address())
+
+		// The peg-out tx pays the first payment.
+		pegOutCtx, cancelPegOuts := context.WithCancel(ctx)
+		pegouts := make(chan pegOut)
+		done := make(chan struct{})
+		go func() {
+			c.pegOutFromExports(pegOutCtx, pegouts)
+			close(done)
+		}()
+		for {
+			var state pegOutState
+			err := db.QueryRow("SELECT pegged_out FROM exports WHERE txid=$1", txid).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state == pegOutPartial {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for first payment")
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			case p := <-pegouts:
+				t.Fatalf("got peg-out in state %d before all payments were made", p.State)
+			}
+		}
+		cancelPegOuts()
+		for range pegouts {
+		}
+		<-done
+
+		// The remaining payments are paid one per call,
+		// and then the export is settled.
+		var settled []pegOut
+		for i := 0; i < 3 && len(settled) == 0; i++ {
+			settled, err = c.payTranches(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(settled) != 1 || settled[0].State != pegOutOK {
+			t.Fatalf("got settled exports %+v, want one export pegged out", settled)
+		}
+
+		hclient.mu.Lock()
+		defer hclient.mu.Unlock()
+		var (
+			payments []int64
+			total    int64
+		)
+		for _, txe := range hclient.txs {
+			var env xdr.TransactionEnvelope
+			err := xdr.SafeUnmarshalBase64(txe, &env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, op := range env.Tx.Operations {
+				if op.Body.Type == xdr.OperationTypePayment && op.Body.PaymentOp.Destination.Address() == exporter.Address() {
+					amount := int64(op.Body.PaymentOp.Amount)
+					payments = append(payments, amount)
+					total += amount
+				}
+			}
+		}
+		if len(payments) != 3 || total != 250 {
+			t.Errorf("got payments %v, want 3 summing to 250", payments)
+		}
+		for _, amount := range payments {
+			if amount > 100 {
+				t.Errorf("got payment of %d, above the cap of 100", amount)
+			}
+		}
+	}, PegOutFees(fees))
+}
+
+func TestTrancheBatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	fees := map[string]FeePolicy{"native": {Tranches: 2}}
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		c.hclient = hclient
+
+		txids := [][]byte{[]byte("a"), []byte("b")}
+		for _, txid := range txids {
+			exporter, err := keypair.Random()
+			if err != nil {
+				t.Fatal(err)
+			}
+			insertTestExport(t, db, txid, lumenXDR, 1000, exporter.Address())
+		}
+		partial := func() int {
+			var n int
+			err := db.QueryRow("SELECT COUNT(*) FROM exports WHERE pegged_out=$1", pegOutPartial).Scan(&n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+
+		// The peg-out txs pay the first tranches.
+		pegOutCtx, cancelPegOuts := context.WithCancel(ctx)
+		pegouts := make(chan pegOut)
+		done := make(chan struct{})
+		go func() {
+			c.pegOutFromExports(pegOutCtx, pegouts)
+			close(done)
+		}()
+		for partial() != len(txids) {
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for first tranches")
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			case p := <-pegouts:
+				t.Fatalf("got peg-out in state %d before all tranches were paid", p.State)
+			}
+		}
+		cancelPegOuts()
+		for range pegouts {
+		}
+		<-done
+
+		// Both second tranches are paid in one tx.
+		submitted := atomic.LoadInt32(&hclient.submitted)
+		_, err = c.payTranches(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := atomic.LoadInt32(&hclient.submitted); n != submitted+1 {
+			t.Fatalf("got %d txs paying second tranches, want 1", n-submitted)
+		}
+		hclient.mu.Lock()
+		txe := hclient.txs[len(hclient.txs)-1]
+		hclient.mu.Unlock()
+		var env xdr.TransactionEnvelope
+		err = xdr.SafeUnmarshalBase64(txe, &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(env.Tx.Operations) != 2 {
+			t.Errorf("got %d payments in tranche tx, want 2", len(env.Tx.Operations))
+		}
+		for _, txid := range txids {
+			var state trancheState
+			err := db.QueryRow("SELECT state FROM tranches WHERE export_txid=$1 AND idx=1", txid).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state != tranchePaid {
+				t.Errorf("got second tranche of export %s in state %d, want %d", txid, state, tranchePaid)
+			}
+		}
+	}, PegOutFees(fees), MaxPegOutBatch(2))
+}
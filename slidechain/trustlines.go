@@ -0,0 +1,98 @@
+package slidechain
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/zioncoin/go/xdr"
+)
+
+// checkPegOutAssets verifies that the custodian account is able to pay out
+// every asset it may be asked to peg out.
+//
+// The custodian pays out of the funds it received at peg-in,
+// not by issuing new funds,
+// so it need not control the issuer of a non-native asset.
+// It must however hold a trustline to that asset
+// (unless it is the issuer itself),
+// and its balance must cover the exports awaiting peg-out.
+//
+// Each problem found is logged.
+// The returned error summarizes the problems, if any.
+func (c *Custodian) checkPegOutAssets(ctx context.Context) error {
+	// Pending holds the amount of each asset, keyed by asset XDR,
+	// that exports are waiting to peg out.
+	pending := make(map[string]int64)
+
+	err := sqlutil.ForQueryRows(ctx, c.DB, `SELECT DISTINCT asset_xdr FROM pegs WHERE zioncoin_tx=1 AND custodian_id=$1`, c.label, func(assetXDR []byte) {
+		pending[string(assetXDR)] = 0
+	})
+	if err != nil {
+		return errors.Wrap(err, "querying pegged-in assets")
+	}
+	const q = `SELECT pegout_json FROM exports WHERE pegged_out IN ($1, $2, $3, $4) AND custodian_id=$5`
+	err = sqlutil.ForQueryRows(ctx, c.DB, q, pegOutNotYet, pegOutRetry, pegOutNoTrust, pegOutDust, c.label, func(ref []byte) error {
+		var p pegOut
+		err := decodeRefdata(ref, &p)
+		if err != nil {
+			return errors.Wrap(err, "unmarshaling reference data")
+		}
+		pending[string(p.AssetXDR)] += p.Amount
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "querying pending exports")
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	account, err := c.hclient.LoadAccount(c.AccountID.Address())
+	if err != nil {
+		return errors.Wrap(err, "loading custodian account")
+	}
+
+	var problems int
+	for assetXDR, want := range pending {
+		var asset xdr.Asset
+		err = xdr.SafeUnmarshal([]byte(assetXDR), &asset)
+		if err != nil {
+			return errors.Wrapf(err, "unmarshaling asset from XDR %x", assetXDR)
+		}
+		var typ, code, issuer string
+		err = asset.Extract(&typ, &code, &issuer)
+		if err != nil {
+			return errors.Wrapf(err, "extracting asset %s", asset.String())
+		}
+		if issuer == c.AccountID.Address() {
+			continue
+		}
+		found := false
+		for _, balance := range account.Balances {
+			if balance.Type != typ || balance.Code != code || balance.Issuer != issuer {
+				continue
+			}
+			found = true
+			have, err := c.spendable(balance)
+			if err != nil {
+				return errors.Wrapf(err, "custodian balance of %s", asset.String())
+			}
+			if have < want {
+				log.Printf("custodian balance %d of %s does not cover %d awaiting peg-out", have, asset.String(), want)
+				problems++
+			}
+			break
+		}
+		if !found {
+			log.Printf("custodian account has no trustline for %s, which it may be asked to peg out", asset.String())
+			problems++
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("custodian cannot pay out %d asset(s)", problems)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package slidechain
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/zioncoin/go/xdr"
+)
+
+// AwaitTrustlines causes the custodian to check,
+// just before pegging out an export of a non-native asset,
+// that the exporter holds a trustline to the asset.
+// If it does not,
+// the export awaits the trustline rather than failing,
+// is listed in the custodian's status,
+// and is checked again every recheck interval
+// until the exporter adds it
+// (or, if timeout is positive, until timeout after the export was recorded,
+// when the export fails and its funds are refunded).
+// Exports recorded before the custodian kept recording times never time out.
+// By default the peg-out tx is submitted regardless,
+// and fails if the exporter has no trustline.
+func AwaitTrustlines(recheck, timeout time.Duration) Option {
+	return func(c *Custodian) {
+		c.trustlineRecheck = recheck
+		c.trustlineTimeout = timeout
+	}
+}
+
+// AwaitingTrustline describes an export awaiting its exporter's trustline
+// (see AwaitTrustlines).
+type AwaitingTrustline struct {
+	TxID     string `json:"txid"`
+	Exporter string `json:"exporter"`
+	Asset    string `json:"asset"`
+	AssetXDR []byte `json:"asset_xdr"`
+	Amount   int64  `json:"amount"`
+}
+
+// checkExporterTrustline checks, just before peg-out,
+// that exporter can receive asset.
+// If it cannot, because it has no trustline to asset,
+// checkExporterTrustline returns a description of the problem.
+// It returns an error only when the check itself fails.
+// It checks nothing unless the custodian awaits trustlines.
+func (c *Custodian) checkExporterTrustline(exporter string, asset xdr.Asset) (string, error) {
+	if c.trustlineRecheck <= 0 || asset.Type == xdr.AssetTypeAssetTypeNative {
+		return "", nil
+	}
+	var typ, code, issuer string
+	err := asset.Extract(&typ, &code, &issuer)
+	if err != nil {
+		return "", errors.Wrapf(err, "extracting asset %s", asset.String())
+	}
+	if issuer == exporter {
+		return "", nil
+	}
+	account, err := c.hclient.LoadAccount(exporter)
+	if isNotFound(err) {
+		return fmt.Sprintf("exporter account %s does not exist", exporter), nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "loading exporter account %s", exporter)
+	}
+	for _, balance := range account.Balances {
+		if balance.Type == typ && balance.Code == code && balance.Issuer == issuer {
+			return "", nil
+		}
+	}
+	return fmt.Sprintf("exporter %s has no trustline to %s", exporter, asset.String()), nil
+}
+
+// trustlineTimedOut reports whether an export recorded at recordedMS
+// has awaited its exporter's trustline too long as of nowMS.
+func (c *Custodian) trustlineTimedOut(recordedMS, nowMS int64) bool {
+	return c.trustlineTimeout > 0 && recordedMS > 0 && nowMS-recordedMS >= int64(c.trustlineTimeout/time.Millisecond)
+}
+
+// wakeForTrustlines arranges to wake pegOutFromExports
+// after the recheck interval,
+// to check again for the trustlines that exports await.
+func (c *Custodian) wakeForTrustlines() {
+	if c.trustlineTimer != nil {
+		c.trustlineTimer.Stop()
+	}
+	c.trustlineTimer = time.AfterFunc(c.trustlineRecheck, c.exports.Broadcast)
+}
+
+// awaitingTrustlines lists the exports awaiting their exporters' trustlines.
+func (c *Custodian) awaitingTrustlines(ctx context.Context) ([]AwaitingTrustline, error) {
+	var awaiting []AwaitingTrustline
+	const q = `SELECT txid, pegout_json FROM exports WHERE pegged_out=$1 AND custodian_id=$2 ORDER BY txid`
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, pegOutNoTrust, c.label, func(txid, ref []byte) error {
+		var p pegOut
+		err := decodeRefdata(ref, &p)
+		if err != nil {
+			return errors.Wrapf(err, "unmarshaling refdata of export %x", txid)
+		}
+		a := AwaitingTrustline{
+			TxID:     hex.EncodeToString(txid),
+			Exporter: p.Exporter,
+			AssetXDR: p.AssetXDR,
+			Amount:   p.Amount,
+		}
+		var asset xdr.Asset
+		if xdr.SafeUnmarshal(p.AssetXDR, &asset) == nil {
+			a.Asset = asset.String()
+		}
+		awaiting = append(awaiting, a)
+		return nil
+	})
+	return awaiting, errors.Wrap(err, "reading exports awaiting trustlines")
+}
@@ -0,0 +1,114 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/xdr"
+)
+
+func TestAwaitTrustline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		usdXDR, err := makeAsset(xdr.AssetTypeAssetTypeCreditAlphanum4, "USD", importTestAccountID).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Serve the exporter's account without a USD trustline
+		// for its first three polls and with one after.
+		accounts := make(map[string]equator.Account)
+		var polls int32
+		hclient := &fakeClient{ClientInterface: c.hclient}
+		hclient.loadAccount = func(accountID string) (equator.Account, error) {
+			if accountID != exporter.Address() {
+				return loadAccountsFrom(accounts)(accountID)
+			}
+			var account equator.Account
+			account.AccountID = accountID
+			native := equator.Balance{Balance: "10.0000000"}
+			native.Type = "native"
+			account.Balances = []equator.Balance{native}
+			if atomic.AddInt32(&polls, 1) > 3 {
+				account = withTrustline(account)
+			}
+			return account, nil
+		}
+		c.hclient = hclient
+
+		temp := insertTestExport(t, db, []byte("untrusted"), usdXDR, 1000, exporter.Address())
+		accounts[temp] = tempAccount(temp, exporter.Address(), "2.5000000")
+
+		ctx, cancel := context.WithCancel(ctx)
+		pegouts := make(chan pegOut)
+		done := make(chan struct{})
+		go func() {
+			c.pegOutFromExports(ctx, pegouts)
+			close(done)
+		}()
+		defer func() {
+			cancel()
+			for range pegouts {
+			}
+			<-done
+		}()
+
+		// Wake pegOutFromExports until the export awaits its trustline.
+		for {
+			var state pegOutState
+			err = db.QueryRow("SELECT pegged_out FROM exports WHERE txid=$1", []byte("untrusted")).Scan(&state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state == pegOutNoTrust {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for export to await its trustline")
+			case p := <-pegouts:
+				t.Fatalf("got peg-out in state %d before trustline was added", p.State)
+			case <-time.After(50 * time.Millisecond):
+				c.exports.Broadcast()
+			}
+		}
+		awaiting, err := c.awaitingTrustlines(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(awaiting) != 1 || awaiting[0].TxID != "756e74727573746564" || awaiting[0].Exporter != exporter.Address() {
+			t.Errorf("got exports awaiting trustlines %+v, want export 756e74727573746564 of %s", awaiting, exporter.Address())
+		}
+
+		// Later polls, woken by the recheck timer alone, find the trustline.
+		var p pegOut
+		select {
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for peg-out")
+		case p = <-pegouts:
+		}
+		if string(p.TxID) != "untrusted" || p.State != pegOutOK {
+			t.Errorf("got peg-out of export %q in state %d, want untrusted in state %d", p.TxID, p.State, pegOutOK)
+		}
+		if n := atomic.LoadInt32(&polls); n <= 3 {
+			t.Errorf("got %d polls of exporter account, want more than 3", n)
+		}
+		awaiting, err = c.awaitingTrustlines(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(awaiting) != 0 {
+			t.Errorf("got exports awaiting trustlines %+v after peg-out, want none", awaiting)
+		}
+	}, AwaitTrustlines(100*time.Millisecond, 0))
+}
@@ -0,0 +1,95 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/txresult"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/zioncoin/go/xdr"
+)
+
+// OutputRef identifies an unspent txvm output to export from:
+// the value it holds and the single key that controls it.
+type OutputRef struct {
+	AssetID bc.Hash
+	Amount  int64
+	Anchor  []byte
+	Pubkey  ed25519.PublicKey
+}
+
+// OutputRefFromResult returns the OutputRef of an output
+// parsed from a tx by txresult,
+// such as the output of an import.
+// The output must hold a value controlled by a single key.
+func OutputRefFromResult(output *txresult.Output) (OutputRef, error) {
+	if output.Value == nil {
+		return OutputRef{}, errors.New("output holds no value")
+	}
+	if len(output.Pubkeys) != 1 {
+		return OutputRef{}, fmt.Errorf("output is controlled by %d keys, not 1", len(output.Pubkeys))
+	}
+	if output.Value.Amount > math.MaxInt64 {
+		return OutputRef{}, fmt.Errorf("output amount %d out of range", output.Value.Amount)
+	}
+	return OutputRef{
+		AssetID: output.Value.AssetID,
+		Amount:  int64(output.Value.Amount),
+		Anchor:  output.Value.Anchor,
+		Pubkey:  output.Pubkeys[0],
+	}, nil
+}
+
+// BuildExportTxFromUTXO is like BuildExportTxWithOptions,
+// but spends the output utxo,
+// from which it takes the input amount and anchor.
+// It checks that utxo holds asset and is controlled by prv
+// before building the tx.
+// When utxo holds more than exportAmt,
+// BuildExportTxFromUTXO also returns the OutputRef of the change
+// paid back to prv's key, or to opts.ChangePubkey;
+// otherwise the change is nil.
+func BuildExportTxFromUTXO(ctx context.Context, utxo OutputRef, asset xdr.Asset, exportAmt int64, tempAddr string, prv ed25519.PrivateKey, seqnum xdr.SequenceNumber, opts ExportOptions) (*bc.Tx, *OutputRef, error) {
+	if len(utxo.Anchor) != 32 {
+		return nil, nil, fmt.Errorf("output anchor has %d bytes, not 32", len(utxo.Anchor))
+	}
+	if opts.RetireAll {
+		exportAmt = utxo.Amount
+	}
+	if exportAmt <= 0 || exportAmt > utxo.Amount {
+		return nil, nil, fmt.Errorf("cannot export %d from output of %d", exportAmt, utxo.Amount)
+	}
+	assetXDR, err := asset.MarshalBinary()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "marshaling asset")
+	}
+	if assetID := bc.NewHash(txvm.AssetID(importIssuanceSeed[:], assetXDR)); assetID != utxo.AssetID {
+		return nil, nil, fmt.Errorf("output holds asset %x, not %s (asset %x)", utxo.AssetID.Bytes(), asset.String(), assetID.Bytes())
+	}
+	if pubkey := prv.Public().(ed25519.PublicKey); !bytes.Equal(pubkey, utxo.Pubkey) {
+		return nil, nil, fmt.Errorf("output is controlled by key %x, not the spending key %x", []byte(utxo.Pubkey), []byte(pubkey))
+	}
+	tx, changeAnchor, err := BuildExportTxWithOptions(ctx, asset, exportAmt, utxo.Amount, tempAddr, utxo.Anchor, prv, seqnum, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if changeAnchor == nil {
+		return tx, nil, nil
+	}
+	changePubkey := utxo.Pubkey
+	if len(opts.ChangePubkey) > 0 {
+		changePubkey = opts.ChangePubkey
+	}
+	change := &OutputRef{
+		AssetID: utxo.AssetID,
+		Amount:  utxo.Amount - exportAmt,
+		Anchor:  changeAnchor,
+		Pubkey:  changePubkey,
+	}
+	return tx, change, nil
+}
@@ -0,0 +1,158 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/crypto/ed25519"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/txresult"
+	"github.com/chain/txvm/protocol/txvm"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestBuildExportTxFromUTXO(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		c.S.blockInterval = 100 * time.Millisecond
+
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipPub, recipPrv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		body, err := json.Marshal(PrePegIn{
+			BcID:        c.InitBlockHash.Bytes(),
+			Amount:      10,
+			AssetXDR:    lumenXDR,
+			RecipPubkey: recipPub,
+			ExpMS:       expMS,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		c.DoPrePegIn(w, httptest.NewRequest("POST", "/prepegin", bytes.NewReader(body)).WithContext(ctx))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d from pre-peg-in: %s", w.Code, w.Body.String())
+		}
+		err = c.recordPegIn(ctx, "txid", "1", w.Body.Bytes(), "source", 10, lumenXDR)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		submit := func(tx *bc.Tx) {
+			r, err := c.S.submitTx(ctx, tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.S.waitOnTx(ctx, tx.ID, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		importTxBytes, err := c.buildImportTx(10, expMS, lumenXDR, recipPub, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var runlimit int64
+		importTx, err := bc.NewTx(importTxBytes, 3, math.MaxInt64, txvm.GetRunlimit(&runlimit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		importTx.Runlimit = math.MaxInt64 - runlimit
+		submit(importTx)
+
+		utxo, err := OutputRefFromResult(txresult.New(importTx).Outputs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if utxo.Amount != 10 || !bytes.Equal(utxo.Pubkey, recipPub) {
+			t.Fatalf("got output of %d controlled by %x, want 10 controlled by %x", utxo.Amount, []byte(utxo.Pubkey), []byte(recipPub))
+		}
+		tempKP, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Inconsistent exports are refused before building.
+		usd, err := zioncoin.NewAsset("USD", importTestAccountID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, otherPrv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shortAnchor := utxo
+		shortAnchor.Anchor = utxo.Anchor[:16]
+		bad := []struct {
+			name      string
+			utxo      OutputRef
+			prv       ed25519.PrivateKey
+			exportAmt int64
+		}{
+			{"other asset", utxo, recipPrv, 10},
+			{"other key", utxo, otherPrv, 10},
+			{"too much", utxo, recipPrv, 11},
+			{"nothing", utxo, recipPrv, 0},
+			{"short anchor", shortAnchor, recipPrv, 10},
+		}
+		for _, tt := range bad {
+			asset := zioncoin.NativeAsset()
+			if tt.name == "other asset" {
+				asset = usd
+			}
+			_, _, err := BuildExportTxFromUTXO(ctx, tt.utxo, asset, tt.exportAmt, tempKP.Address(), tt.prv, 1, ExportOptions{})
+			if err == nil {
+				t.Errorf("%s: built export", tt.name)
+			}
+		}
+
+		// The export spends the imported output, returning change.
+		exportTx, change, err := BuildExportTxFromUTXO(ctx, utxo, zioncoin.NativeAsset(), 6, tempKP.Address(), recipPrv, 1, ExportOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		submit(exportTx)
+		ref, err := InspectExportTx(exportTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p pegOut
+		err = json.Unmarshal(ref, &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Amount != 6 {
+			t.Errorf("got export of %d, want 6", p.Amount)
+		}
+		if change == nil || change.Amount != 4 || change.AssetID != utxo.AssetID {
+			t.Fatalf("got change %+v, want 4 of asset %x", change, utxo.AssetID.Bytes())
+		}
+
+		// The change is spent in turn, exporting all of it.
+		exportTx, change, err = BuildExportTxFromUTXO(ctx, *change, zioncoin.NativeAsset(), 4, tempKP.Address(), recipPrv, 1, ExportOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if change != nil {
+			t.Errorf("got change %+v from exporting the whole output", change)
+		}
+		submit(exportTx)
+	})
+}
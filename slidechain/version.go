@@ -0,0 +1,43 @@
+package slidechain
+
+import (
+	"context"
+
+	"github.com/chain/txvm/errors"
+)
+
+// Each change to an export's row increments its version,
+// and is made only if the row is still at the version its maker read.
+// This lets custodian loops, the reconciliation sweep,
+// and repair tools change the same export concurrently
+// without overwriting each other's changes:
+// the loser of a race sees errExportChanged (or a failed claim)
+// and re-reads the export rather than act on stale state.
+
+// errExportChanged is returned by updateExportState
+// when an export's row has changed since it was read.
+var errExportChanged = errors.New("export changed concurrently")
+
+// exportVersion returns the current version of export txid.
+func (c *Custodian) exportVersion(ctx context.Context, txid []byte) (int64, error) {
+	var version int64
+	err := c.DB.QueryRowContext(ctx, `SELECT version FROM exports WHERE txid=$1`, txid).Scan(&version)
+	return version, errors.Wrapf(err, "reading version of export %x", txid)
+}
+
+// claimExport increments the version of export txid
+// if it is still at version,
+// reporting whether it was.
+// A worker claims an export before acting on it on the Zioncoin network or on slidechain,
+// so that no other worker acts on the same version.
+func (c *Custodian) claimExport(ctx context.Context, txid []byte, version int64) (bool, error) {
+	result, err := c.DB.ExecContext(ctx, `UPDATE exports SET version=version+1 WHERE txid=$1 AND version=$2`, txid, version)
+	if err != nil {
+		return false, errors.Wrapf(err, "claiming export %x", txid)
+	}
+	numAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "checking rows affected by claiming export %x", txid)
+	}
+	return numAffected == 1, nil
+}
@@ -0,0 +1,129 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestExportVersion(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		txid := []byte("export")
+		insertTestExport(t, db, txid, lumenXDR, 100, exporter.Address())
+		exportRow := func() (pegOutState, int64) {
+			var (
+				state   pegOutState
+				version int64
+			)
+			err := db.QueryRow("SELECT pegged_out, version FROM exports WHERE txid=$1", txid).Scan(&state, &version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return state, version
+		}
+
+		// Of several workers claiming the same version, exactly one wins.
+		const workers = 8
+		var (
+			wg     sync.WaitGroup
+			mu     sync.Mutex
+			claims int
+		)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				claimed, err := c.claimExport(ctx, txid, 0)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if claimed {
+					mu.Lock()
+					claims++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if claims != 1 {
+			t.Fatalf("got %d of %d concurrent claims of one version, want 1", claims, workers)
+		}
+		if _, version := exportRow(); version != 1 {
+			t.Fatalf("got version %d after one claim, want 1", version)
+		}
+
+		// An update made with a stale version is lost, not applied.
+		err = c.updateExportState(ctx, txid, 0, pegOutRetry, "")
+		if errors.Root(err) != errExportChanged {
+			t.Fatalf("got error %v from stale update, want %v", err, errExportChanged)
+		}
+		if state, version := exportRow(); state != pegOutNotYet || version != 1 {
+			t.Fatalf("got state %d at version %d after stale update, want %d at version 1", state, version, pegOutNotYet)
+		}
+		err = c.updateExportState(ctx, txid, 1, pegOutRetry, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state, version := exportRow(); state != pegOutRetry || version != 2 {
+			t.Fatalf("got state %d at version %d after update, want %d at version 2", state, version, pegOutRetry)
+		}
+
+		// A post-peg-out of a stale read is deferred for a fresh one.
+		err = c.doPostPegOut(ctx, pegOut{TxID: txid, AssetXDR: lumenXDR, Exporter: exporter.Address(), Amount: 100, State: pegOutFail, Version: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state, version := exportRow(); state != pegOutRetry || version != 2 {
+			t.Fatalf("got state %d at version %d after stale post-peg-out, want %d at version 2", state, version, pegOutRetry)
+		}
+
+		// A state made stale by a concurrent change is not recorded over it.
+		_, err = c.setExportState(ctx, txid, 1, pegOutOK, "zioncointx")
+		if errors.Root(err) != errExportChanged {
+			t.Fatalf("got error %v from stale state, want %v", err, errExportChanged)
+		}
+		if state, version := exportRow(); state != pegOutRetry || version != 2 {
+			t.Fatalf("got state %d at version %d after stale state, want %d at version 2", state, version, pegOutRetry)
+		}
+
+		// The outcome of a submitted peg-out is recorded
+		// over a change that did not settle the export.
+		version, state, err := c.recordExportOutcome(ctx, txid, 1, pegOutNotYet, pegOutOK, "zioncointx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, gotVersion := exportRow(); got != pegOutOK || gotVersion != 3 || version != 3 || state != pegOutOK {
+			t.Errorf("got state %d at version %d (returned %d at version %d) after recording peg-out, want %d at version 3", got, gotVersion, state, version, pegOutOK)
+		}
+
+		// An outcome contradicting a concurrent settlement is left for an operator.
+		_, state, err = c.recordExportOutcome(ctx, txid, 1, pegOutNotYet, pegOutFail, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, gotVersion := exportRow(); got != pegOutOK || gotVersion != 3 || state != pegOutOK {
+			t.Errorf("got state %d at version %d (returned %d) after contradicting outcome, want %d at version 3", got, gotVersion, state, pegOutOK)
+		}
+		if problems := c.health.problems(); len(problems) != 1 {
+			t.Errorf("got health problems %v after contradicting outcome, want one", problems)
+		}
+	})
+}
@@ -4,16 +4,23 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
+	"encoding/base64"
+	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/crypto/ed25519"
 	"github.com/chain/txvm/errors"
 	"github.com/chain/txvm/protocol/bc"
+	"github.com/chain/txvm/protocol/txbuilder/standard"
 	"github.com/chain/txvm/protocol/txvm"
+	"github.com/chain/txvm/protocol/txvm/op"
 	i10rnet "github.com/interzioncoin/starlight/net"
+	"github.com/zioncoin/go/amount"
 	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/strkey"
 	"github.com/zioncoin/go/xdr"
 )
 
@@ -22,144 +29,683 @@ func (c *Custodian) watchPegIns(ctx context.Context) {
 	defer log.Println("watchPegIns exiting")
 	backoff := i10rnet.Backoff{Base: 100 * time.Millisecond}
 
-	var cur equator.Cursor
-	err := c.DB.QueryRow("SELECT cursor FROM custodian").Scan(&cur)
-	if err != nil && err != sql.ErrNoRows {
+	cur, err := c.pegInCursor(ctx)
+	if err != nil {
 		log.Fatal(err)
 	}
 
 	for {
-		err := c.hclient.StreamTransactions(ctx, c.AccountID.Address(), &cur, func(tx equator.Transaction) {
-			log.Printf("handling Zioncoin tx %s", tx.ID)
+		streamCtx, cancel := context.WithCancel(ctx)
+		c.cursorMu.Lock()
+		if c.streamGen != c.cursorGen {
+			// The cursor was moved by SetCursor.
+			cur, err = c.pegInCursor(ctx)
+			if err != nil {
+				log.Fatal(err)
+			}
+			c.streamGen = c.cursorGen
+		}
+		c.stopStream = cancel
+		c.cursorMu.Unlock()
 
-			var env xdr.TransactionEnvelope
-			err := xdr.SafeUnmarshalBase64(tx.EnvelopeXdr, &env)
+		if c.pegInSource == PegInsFromPayments {
+			err = c.streamPegInPayments(streamCtx, &cur)
+		} else {
+			err = c.streamPegInTxs(streamCtx, &cur)
+		}
+		c.cursorMu.Lock()
+		c.stopStream = nil
+		c.cursorMu.Unlock()
+		stopped := streamCtx.Err() != nil
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if stopped {
+			// Stopped by SetCursor, so restarted at once from the new cursor.
+			continue
+		}
+		if errors.Root(err) == errUnsupportedProtocol {
+			// The stream has moved past the unparsed tx,
+			// so it resumes from the last stored cursor.
+			log.Printf("halting peg-ins: %s", err)
+			cur, err = c.pegInCursor(ctx)
 			if err != nil {
-				log.Fatal("error unmarshaling Zioncoin tx: ", err)
+				log.Fatal(err)
 			}
+		} else if err != nil {
+			log.Printf("error streaming from equator: %s, retrying...", err)
+		}
+		ch := make(chan struct{})
+		go func() {
+			time.Sleep(backoff.Next())
+			close(ch)
+		}()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+		}
+	}
+}
 
-			if env.Tx.Memo.Type != xdr.MemoTypeMemoHash {
+// streamPegInTxs observes peg-ins by streaming the custodian account's transactions
+// and picking out payment operations to the custodian.
+// Transactions and operations from the custodian's own account,
+// such as tranche payments and the payments of peg-out transactions,
+// are never peg-ins, even if they pay the custodian.
+//
+// A tx the custodian cannot parse ends the stream with an error,
+// without moving the stored cursor past it.
+func (c *Custodian) streamPegInTxs(ctx context.Context, cur *equator.Cursor) error {
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var halted error
+	err := c.hclient.StreamTransactions(streamCtx, c.AccountID.Address(), cur, func(tx equator.Transaction) {
+		if halted != nil {
+			return
+		}
+		log.Printf("handling Zioncoin tx %s", tx.ID)
+		payments, err := c.pegInPayments(tx)
+		if err != nil {
+			halted = err
+			cancel()
+			return
+		}
+		if c.batchWrites && len(payments) > 0 {
+			c.recordPegIns(ctx, tx.ID, tx.PT, payments)
+			return
+		}
+		for _, p := range payments {
+			err := c.recordPegIn(ctx, tx.ID, tx.PT, p.nonceHash, p.source, p.amount, p.assetXDR)
+			if err != nil {
 				return
 			}
+		}
+	})
+	if halted != nil {
+		return halted
+	}
+	return err
+}
 
-			nonceHash := (*env.Tx.Memo.Hash)[:]
-			for _, op := range env.Tx.Operations {
-				if op.Body.Type != xdr.OperationTypePayment {
-					continue
-				}
-				payment := op.Body.PaymentOp
-				if !payment.Destination.Equals(c.AccountID) {
-					continue
-				}
+// pegInPayment is a payment to the custodian account
+// in a Zioncoin tx with a memo hash.
+type pegInPayment struct {
+	nonceHash []byte
+	source    string
+	amount    int64
+	assetXDR  []byte
+}
 
-				// This operation is a payment to the custodian's account - i.e., a peg.
-				// We update the db to note that we saw this entry on the Zioncoin network.
-				// We also populate the amount and asset_xdr with the values in the Zioncoin tx.
-				assetXDR, err := payment.Asset.MarshalBinary()
-				if err != nil {
-					log.Fatalf("marshaling asset xdr: %s", err)
-					return
-				}
-				resulted, err := c.DB.ExecContext(ctx, `UPDATE pegs SET amount=$1, asset_xdr=$2, zioncoin_tx=1 WHERE nonce_hash=$3 AND zioncoin_tx=0`, payment.Amount, assetXDR, nonceHash)
-				if err != nil {
-					log.Fatalf("updating zioncoin_tx=1 for hash %x: %s", nonceHash, err)
-				}
+// pegInPayments returns the payment operations to the custodian in tx
+// that may be peg-ins.
+// If tx cannot be parsed because the network has upgraded
+// past SupportedProtocolVersion,
+// the error's root is errUnsupportedProtocol.
+func (c *Custodian) pegInPayments(tx equator.Transaction) ([]pegInPayment, error) {
+	var env xdr.TransactionEnvelope
+	err := xdr.SafeUnmarshalBase64(tx.EnvelopeXdr, &env)
+	if err != nil {
+		version, perr := c.checkProtocol()
+		if perr != nil || version <= SupportedProtocolVersion {
+			log.Fatal("error unmarshaling Zioncoin tx: ", err)
+		}
+		return nil, errors.Wrapf(errUnsupportedProtocol, "unmarshaling Zioncoin tx %s under network protocol %d: %s", tx.ID, version, err)
+	}
 
-				// We confirm that only a single row was affected by the update query.
-				numAffected, err := resulted.RowsAffected()
-				if err != nil {
-					log.Fatalf("checking rows affected by update query for hash %x: %s", nonceHash, err)
-				}
-				if numAffected != 1 {
-					log.Fatalf("multiple rows affected by update query for hash %x", nonceHash)
-				}
+	if env.Tx.Memo.Type != xdr.MemoTypeMemoHash {
+		return nil, nil
+	}
+	if env.Tx.SourceAccount.Equals(c.AccountID) {
+		log.Printf("ignoring custodian's own Zioncoin tx %s", tx.ID)
+		return nil, nil
+	}
 
-				// We update the cursor to avoid double-processing a transaction.
-				_, err = c.DB.ExecContext(ctx, `UPDATE custodian SET cursor=$1 WHERE seed=$2`, tx.PT, c.seed)
-				if err != nil {
-					log.Fatalf("updating cursor: %s", err)
-					return
-				}
+	nonceHash := (*env.Tx.Memo.Hash)[:]
+	var payments []pegInPayment
+	for _, op := range env.Tx.Operations {
+		if op.Body.Type != xdr.OperationTypePayment {
+			continue
+		}
+		payment := op.Body.PaymentOp
+		if !payment.Destination.Equals(c.AccountID) {
+			continue
+		}
+		assetXDR, err := payment.Asset.MarshalBinary()
+		if err != nil {
+			log.Fatalf("marshaling asset xdr: %s", err)
+		}
+		source := env.Tx.SourceAccount
+		if op.SourceAccount != nil {
+			source = *op.SourceAccount
+		}
+		if source.Equals(c.AccountID) {
+			log.Printf("ignoring custodian's own payment in Zioncoin tx %s", tx.ID)
+			continue
+		}
+		payments = append(payments, pegInPayment{
+			nonceHash: nonceHash,
+			source:    source.Address(),
+			amount:    int64(payment.Amount),
+			assetXDR:  assetXDR,
+		})
+	}
+	return payments, nil
+}
 
-				// Wake up a goroutine that executes imports for not-yet-imported pegs.
-				log.Printf("broadcasting import for tx with nonce hash %x", nonceHash)
-				c.imports.Broadcast()
+// streamPegInPayments observes peg-ins by streaming the custodian account's payments,
+// which Horizon has already decomposed from their transactions.
+// It handles the same payments as streamPegInTxs.
+func (c *Custodian) streamPegInPayments(ctx context.Context, cur *equator.Cursor) error {
+	// A stored cursor with no operation index is from streamPegInTxs,
+	// which has handled every payment in that transaction.
+	var skipTx int64
+	if toid, err := strconv.ParseInt(string(*cur), 10, 64); err == nil && toid&toidOpMask == 0 {
+		skipTx = toid
+	}
+	return c.hclient.StreamPayments(ctx, c.AccountID.Address(), cur, func(payment equator.Payment) {
+		if payment.Type != "payment" || payment.To != c.AccountID.Address() {
+			return
+		}
+		if payment.From == c.AccountID.Address() {
+			log.Printf("ignoring custodian's own payment %s in tx %s", payment.PagingToken, payment.TransactionHash)
+			return
+		}
+		if skipTx != 0 {
+			if toid, err := strconv.ParseInt(payment.PagingToken, 10, 64); err == nil && toid&^toidOpMask == skipTx {
+				return
 			}
-		})
-		if err == context.Canceled {
+		}
+		log.Printf("handling Zioncoin payment %s in tx %s", payment.PagingToken, payment.TransactionHash)
+
+		err := c.loadMemo(ctx, &payment)
+		if err != nil {
+			return
+		}
+		if payment.Memo.Type != "hash" {
 			return
 		}
+		nonceHash, err := base64.StdEncoding.DecodeString(payment.Memo.Value)
+		if err != nil || len(nonceHash) != 32 {
+			return
+		}
+
+		var asset xdr.Asset
+		if payment.AssetType == "native" {
+			asset, err = xdr.NewAsset(xdr.AssetTypeAssetTypeNative, nil)
+		} else {
+			var issuer xdr.AccountId
+			err = issuer.SetAddress(payment.AssetIssuer)
+			if err == nil {
+				err = asset.SetCredit(payment.AssetCode, issuer)
+			}
+		}
 		if err != nil {
-			log.Printf("error streaming from equator: %s, retrying...", err)
+			log.Fatalf("parsing asset of Zioncoin payment %s: %s", payment.PagingToken, err)
 		}
-		ch := make(chan struct{})
-		go func() {
-			time.Sleep(backoff.Next())
-			close(ch)
-		}()
+		assetXDR, err := asset.MarshalBinary()
+		if err != nil {
+			log.Fatalf("marshaling asset xdr: %s", err)
+		}
+		amt, err := amount.ParseInt64(payment.Amount)
+		if err != nil {
+			log.Fatalf("parsing amount of Zioncoin payment %s: %s", payment.PagingToken, err)
+		}
+		c.recordPegIn(ctx, payment.TransactionHash, payment.PagingToken, nonceHash, payment.From, amt, assetXDR)
+	})
+}
+
+// loadMemo loads the memo of payment's transaction,
+// retrying with backoff until it succeeds or ctx is canceled,
+// in which case it returns ctx.Err().
+func (c *Custodian) loadMemo(ctx context.Context, payment *equator.Payment) error {
+	backoff := i10rnet.Backoff{Base: 100 * time.Millisecond}
+	for {
+		err := c.hclient.LoadMemo(payment)
+		if err == nil {
+			return nil
+		}
+		log.Printf("loading memo of Zioncoin tx %s: %s, retrying...", payment.TransactionHash, err)
 		select {
 		case <-ctx.Done():
-			return
-		case <-ch:
+			return ctx.Err()
+		case <-time.After(backoff.Next()):
+		}
+	}
+}
+
+// toidOpMask selects the operation index of a Horizon paging token
+// (a "total order ID" of ledger, transaction, and operation).
+const toidOpMask = 1<<12 - 1
+
+// recordPegIn records a payment to the custodian account
+// observed in Zioncoin tx txid,
+// then stores cursor as the point from which to resume streaming.
+// Both happen in one db transaction,
+// together with the event logging the payment.
+// It returns an error only if ctx is canceled.
+func (c *Custodian) recordPegIn(ctx context.Context, txid, cursor string, nonceHash []byte, source string, amount int64, assetXDR []byte) error {
+	return c.recordPegIns(ctx, txid, cursor, []pegInPayment{{
+		nonceHash: nonceHash,
+		source:    source,
+		amount:    amount,
+		assetXDR:  assetXDR,
+	}})
+}
+
+// recordPayment marks, as part of dbtx,
+// the unconsumed peg of custodian custodianID with the given nonce hash
+// as paid, or as awaiting confirmation, according to state
+// (see markPegPaid).
+// If there is no such peg, the payment is flagged instead.
+// It returns the number of pegs marked.
+func recordPayment(ctx context.Context, dbtx *sql.Tx, custodianID, txid string, ledger int32, state int, nonceHash []byte, source string, amount int64, assetXDR []byte) (int64, error) {
+	numAffected, err := markPegPaid(ctx, dbtx, custodianID, txid, ledger, state, nonceHash, source, amount, assetXDR)
+	if err != nil {
+		return 0, err
+	}
+	// No rows are affected when the memo hash matches no unconsumed peg,
+	// e.g. when a wallet retries a payment that was already processed.
+	// Such payments are flagged for manual refund rather than imported.
+	if numAffected == 0 {
+		return 0, flagPegIn(ctx, dbtx, custodianID, txid, nonceHash, source, amount, assetXDR, "")
+	}
+	return numAffected, nil
+}
+
+// markPegPaid marks, as part of dbtx,
+// the unconsumed peg of custodian custodianID with the given nonce hash
+// as paid, or as awaiting confirmation, according to state,
+// recording the amount and asset of the payment in Zioncoin tx txid,
+// the ledger of that tx (zero if unknown),
+// the account that paid it (for refunds, see ImportRefunds),
+// and the time it was recorded,
+// and numbering the peg in order of arrival.
+// It returns the number of pegs marked, which is 0 or 1.
+func markPegPaid(ctx context.Context, dbtx *sql.Tx, custodianID, txid string, ledger int32, state int, nonceHash []byte, source string, amount int64, assetXDR []byte) (int64, error) {
+	resulted, err := dbtx.ExecContext(ctx, `UPDATE pegs SET amount=$1, asset_xdr=$2, zioncoin_tx=$3, ledger=$4, paid_ms=$5, payer=$6, arrival=(SELECT COALESCE(MAX(arrival), 0) + 1 FROM pegs) WHERE nonce_hash=$7 AND zioncoin_tx=0 AND custodian_id=$8`, amount, assetXDR, state, ledger, int64(bc.Millis(time.Now())), source, nonceHash, custodianID)
+	if err != nil {
+		return 0, errors.Wrapf(err, "updating zioncoin_tx=%d for hash %x", state, nonceHash)
+	}
+	// We confirm that only a single row was affected by the update query.
+	numAffected, err := resulted.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "checking rows affected by update query")
+	}
+	if numAffected > 1 {
+		log.Fatalf("multiple rows affected by update query for hash %x", nonceHash)
+	}
+	if numAffected == 0 {
+		return 0, nil
+	}
+	return numAffected, appendEvent(ctx, dbtx, Event{
+		Type:       EventPegIn,
+		NonceHash:  nonceHash,
+		ZioncoinTx: txid,
+		Account:    source,
+		AssetXDR:   assetXDR,
+		Amount:     amount,
+	})
+}
+
+// flagPegIn records, as part of dbtx,
+// a payment to the account of custodian custodianID
+// whose memo hash does not correspond to an unconsumed peg of that custodian.
+// or that cannot be accepted for the given reason.
+// If reason is empty and the memo hash matches a peg that has already been paid,
+// the payment is a duplicate;
+// otherwise the memo hash is unknown.
+// Either way the payment is not imported,
+// and the record supports a manual refund to the sender.
+func flagPegIn(ctx context.Context, dbtx *sql.Tx, custodianID, txid string, nonceHash []byte, source string, amount int64, assetXDR []byte, reason string) error {
+	if reason == "" {
+		reason = "unknown"
+		var zioncoinTx int
+		err := dbtx.QueryRowContext(ctx, `SELECT zioncoin_tx FROM pegs WHERE nonce_hash=$1 AND custodian_id=$2`, nonceHash, custodianID).Scan(&zioncoinTx)
+		if err != nil && err != sql.ErrNoRows {
+			return errors.Wrapf(err, "looking up peg for hash %x", nonceHash)
+		}
+		if err == nil {
+			reason = "duplicate"
 		}
 	}
+	log.Printf("flagging %s peg-in payment in Zioncoin tx %s: %d of asset %x from %s with nonce hash %x", reason, txid, amount, assetXDR, source, nonceHash)
+	const q = `INSERT INTO flagged_pegs (txid, nonce_hash, source, amount, asset_xdr, reason) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := dbtx.ExecContext(ctx, q, txid, nonceHash, source, amount, assetXDR, reason)
+	if err != nil {
+		return errors.Wrapf(err, "recording flagged peg-in for hash %x", nonceHash)
+	}
+	return appendEvent(ctx, dbtx, Event{
+		Type:       EventPegInFlagged,
+		NonceHash:  nonceHash,
+		ZioncoinTx: txid,
+		Account:    source,
+		AssetXDR:   assetXDR,
+		Amount:     amount,
+		Reason:     reason,
+	})
+}
+
+// pegInCursor returns the Horizon cursor from which to stream peg-in transactions.
+// A cursor stored in the db takes precedence;
+// the configured start cursor is used only when none has been stored yet.
+func (c *Custodian) pegInCursor(ctx context.Context) (equator.Cursor, error) {
+	var cur equator.Cursor
+	err := c.DB.QueryRowContext(ctx, "SELECT cursor FROM custodian WHERE label=$1", c.label).Scan(&cur)
+	if err != nil && err != sql.ErrNoRows {
+		return "", errors.Wrap(err, "reading cursor from db")
+	}
+	if cur == "" {
+		cur = c.startCursor
+	}
+	return cur, nil
 }
 
 // Runs as a goroutine.
 func (c *Custodian) watchExports(ctx context.Context) {
 	defer log.Println("watchExports exiting")
 
-	c.RunPin(ctx, "watchExports", func(ctx context.Context, b *bc.Block) error {
+	c.runPin(ctx, "watchExports", func(ctx context.Context, b *bc.Block) error {
+		// The block's exports, when recorded together (see BatchWrites).
+		var batch []exportRecord
 		for _, tx := range b.Transactions {
-			// Check if the transaction has either expected length for an export tx.
-			// Confirm that its input, log, and output entries are as expected.
-			// If so, look for a specially formatted log ("L") entry
-			// that specifies the Zioncoin asset code to peg out and the Zioncoin recipient account ID.
-			if len(tx.Log) != 5 && len(tx.Log) != 7 {
+			isBurn, err := c.recordBurn(ctx, tx)
+			if err != nil {
+				return err
+			}
+			if isBurn {
 				continue
 			}
-			if tx.Log[0][0].(txvm.Bytes)[0] != txvm.InputCode {
+
+			exportRef, err := InspectExportTx(tx)
+			if err != nil {
 				continue
 			}
-			if tx.Log[1][0].(txvm.Bytes)[0] != txvm.LogCode {
+			var info pegOut
+			err = decodeRefdata(exportRef, &info)
+			if err != nil {
 				continue
 			}
-
-			outputIndex := len(tx.Log) - 2
-			if tx.Log[outputIndex][0].(txvm.Bytes)[0] != txvm.OutputCode {
+			if info.Custodian != "" && info.Custodian != c.AccountID.Address() {
+				// The export is for another custodian sharing the db.
 				continue
 			}
-
-			exportSeedLogItem := tx.Log[len(tx.Log)-3]
-			if exportSeedLogItem[0].(txvm.Bytes)[0] != txvm.LogCode {
+			if exportExpired(tx, b.TimestampMs) {
+				// Block builders refuse expired txs, but not every block need come from one.
+				reason := fmt.Sprintf("export expired before block %d", b.Height)
+				log.Printf("rejecting export tx %x: %s", tx.ID.Bytes(), reason)
+				err = c.recordExportFailure(ctx, tx.ID.Bytes(), exportRef, reason)
+				if err != nil {
+					return err
+				}
 				continue
 			}
-			if !bytes.Equal(exportSeedLogItem[1].(txvm.Bytes), exportContract1Seed[:]) {
+			if c.verifyExportSigs {
+				err = verifyExportSig(tx, info.Pubkey)
+				if err != nil {
+					log.Printf("rejecting export tx %x: %s", tx.ID.Bytes(), err)
+					continue
+				}
+			}
+			if reason := exportAccountReason(info); reason != "" {
+				log.Printf("rejecting export tx %x: %s", tx.ID.Bytes(), reason)
+				err = c.recordExportFailure(ctx, tx.ID.Bytes(), exportRef, reason)
+				if err != nil {
+					return err
+				}
 				continue
 			}
-
-			var info pegOut
-			exportRef := tx.Log[1][2].(txvm.Bytes)
-			err := json.Unmarshal(exportRef, &info)
+			if c.verifyTempAccounts {
+				reason, err := c.checkTempAccount(info)
+				if err != nil {
+					return errors.Wrapf(err, "checking temp account of export tx %x", tx.ID.Bytes())
+				}
+				if reason != "" {
+					log.Printf("rejecting export tx %x: %s", tx.ID.Bytes(), reason)
+					err = c.recordExportFailure(ctx, tx.ID.Bytes(), exportRef, reason)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			ok, err := c.checkExportPolicy(ctx, tx.ID.Bytes(), exportRef, info)
 			if err != nil {
+				return err
+			}
+			if !ok {
 				continue
 			}
-			exportedAssetBytes := txvm.AssetID(importIssuanceSeed[:], info.AssetXDR)
-
-			// Record the export in the db,
-			// then wake up a goroutine that executes peg-outs on the main chain.
-			const q = `INSERT INTO exports (txid, pegout_json) VALUES ($1, $2)`
-			_, err = c.DB.ExecContext(ctx, q, tx.ID.Bytes(), exportRef)
+			rec := exportRecord{
+				txid:          tx.ID.Bytes(),
+				ref:           exportRef,
+				info:          info,
+				payoutAfterMS: exportPayoutAfter(b.TimestampMs, info),
+				height:        b.Height,
+			}
+			if c.batchWrites {
+				// Recorded with the rest of the block's exports.
+				batch = append(batch, rec)
+				continue
+			}
+			err = c.recordExportBatch(ctx, []exportRecord{rec})
 			if err != nil {
-				return errors.Wrapf(err, "recording export tx %x", tx.ID.Bytes())
+				return err
 			}
+		}
+		if len(batch) > 0 {
+			return c.recordExportBatch(ctx, batch)
+		}
+		return nil
+	}, c.rewindExports)
+}
+
+// recordBurn records the burn logged by tx,
+// if it is a post-peg-out tx retiring exported funds,
+// and reports whether it is.
+// A retirement whose value does not match
+// the peg-out refdata logged with it (see checkRetirement)
+// is not recorded as a burn;
+// instead its mismatch is recorded as the failure reason of the export.
+func (c *Custodian) recordBurn(ctx context.Context, tx *bc.Tx) (bool, error) {
+	burn, ok := burnFromTx(tx)
+	if !ok {
+		return false, nil
+	}
+	if reason := checkRetirement(tx); reason != "" {
+		log.Printf("rejecting burn tx %x of export %x: %s", tx.ID.Bytes(), burn.ExportTxID, reason)
+		return true, c.recordFailureReason(ctx, burn.ExportTxID, reason)
+	}
+	const q = `INSERT OR IGNORE INTO burns (txid, export_txid, exporter, recipient, asset_xdr, amount, timestamp_ms) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err := c.DB.ExecContext(ctx, q, tx.ID.Bytes(), burn.ExportTxID, burn.Exporter, burn.Recipient, burn.AssetXDR, burn.Amount, burn.TimestampMS)
+	if err != nil {
+		return true, errors.Wrapf(err, "recording burn tx %x", tx.ID.Bytes())
+	}
+	log.Printf("recorded burn: %d of Zioncoin %x from export %x, pegged out to %s", burn.Amount, burn.AssetXDR, burn.ExportTxID, burn.Recipient)
+	return true, nil
+}
+
+// recordExport records export tx txid, with reference data ref,
+// to be pegged out no earlier than payoutAfterMS,
+// and logs an event for it in the same db transaction.
+// It does nothing if the export is already recorded.
+// Recording starts the export's trace (see Tracer),
+// whose span context is stored with it.
+func (c *Custodian) recordExport(ctx context.Context, txid, ref []byte, info pegOut, payoutAfterMS int64) error {
+	return c.recordExports(ctx, []exportRecord{{
+		txid:          txid,
+		ref:           ref,
+		info:          info,
+		payoutAfterMS: payoutAfterMS,
+	}})
+}
 
-			log.Printf("recorded export: %d of txvm asset %x (Zioncoin %x) for %s in tx %x", info.Amount, exportedAssetBytes, info.AssetXDR, info.Exporter, tx.ID.Bytes())
+// InspectExportTx reports whether tx is a slidechain export transaction,
+// as recognized by the custodian.
+// If it is, InspectExportTx returns the export's JSON reference data.
+// Otherwise it returns an error describing the first check that failed.
+func InspectExportTx(tx *bc.Tx) ([]byte, error) {
+	err := checkTxVersion(tx.Version)
+	if err != nil {
+		return nil, err
+	}
+	// An expiring export logs its timerange first (see BuildExportTx).
+	entries := tx.Log
+	if len(entries) > 0 && logItemCode(entries[0]) == txvm.TimerangeCode {
+		entries = entries[1:]
+	}
+	// Check if the transaction has either expected length for an export tx.
+	// Confirm that its input, log, and output entries are as expected.
+	// If so, look for a specially formatted log ("L") entry
+	// that specifies the Zioncoin asset code to peg out and the Zioncoin recipient account ID.
+	if len(entries) != 5 && len(entries) != 7 {
+		return nil, fmt.Errorf("got %d log entries, want 5 or 7", len(entries))
+	}
+	if code := logItemCode(entries[0]); code != txvm.InputCode {
+		return nil, fmt.Errorf("log entry 0 has code %q, want %q", code, txvm.InputCode)
+	}
+	if code := logItemCode(entries[1]); code != txvm.LogCode {
+		return nil, fmt.Errorf("log entry 1 has code %q, want %q", code, txvm.LogCode)
+	}
+
+	outputIndex := len(entries) - 2
+	if code := logItemCode(entries[outputIndex]); code != txvm.OutputCode {
+		return nil, fmt.Errorf("log entry %d has code %q, want %q", outputIndex, code, txvm.OutputCode)
+	}
 
-			c.exports.Broadcast()
+	exportSeedIndex := len(entries) - 3
+	exportSeedLogItem := entries[exportSeedIndex]
+	if code := logItemCode(exportSeedLogItem); code != txvm.LogCode {
+		return nil, fmt.Errorf("log entry %d has code %q, want %q", exportSeedIndex, code, txvm.LogCode)
+	}
+	if len(exportSeedLogItem) < 2 {
+		return nil, fmt.Errorf("log entry %d has no contract seed", exportSeedIndex)
+	}
+	if seed, ok := exportSeedLogItem[1].(txvm.Bytes); !ok || !bytes.Equal(seed, exportContract1Seed[:]) {
+		return nil, fmt.Errorf("log entry %d is not from the export contract (seed %x)", exportSeedIndex, exportContract1Seed[:])
+	}
+
+	if len(entries[1]) < 3 {
+		return nil, errors.New("log entry 1 has no reference data")
+	}
+	exportRef, ok := entries[1][2].(txvm.Bytes)
+	if !ok {
+		return nil, errors.New("log entry 1 reference data is not a string")
+	}
+	var info pegOut
+	err = decodeRefdata(exportRef, &info)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshaling reference data")
+	}
+	return exportRef, nil
+}
+
+// exportExpired reports whether export tx
+// has a timerange that ends before blockTimeMS (see BuildExportTx),
+// so that it was not valid in a block with that timestamp.
+func exportExpired(tx *bc.Tx, blockTimeMS uint64) bool {
+	for _, tr := range tx.Timeranges {
+		if tr.MaxMS > 0 && blockTimeMS > uint64(tr.MaxMS) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyExportSig re-runs the program of export tx
+// and checks that the signature on its input
+// is over standard.VerifyTxID(tx.ID) and validates against pubkey,
+// the exporter's pubkey from the export's reference data.
+func verifyExportSig(tx *bc.Tx, pubkey []byte) error {
+	if len(pubkey) != ed25519.PublicKeySize {
+		return fmt.Errorf("reference data pubkey has length %d, want %d", len(pubkey), ed25519.PublicKeySize)
+	}
+	var msgs, pubkeys, sigs [][]byte
+	captureSig := func(vm *txvm.VM) {
+		if vm.OpCode() != op.CheckSig || !bytes.Equal(vm.Seed(), standard.PayToMultisigSeed1[:]) || vm.StackLen() < 4 {
+			return
 		}
+		n := vm.StackLen()
+		msgs = append(msgs, stackBytes(vm, n-4))
+		pubkeys = append(pubkeys, stackBytes(vm, n-3))
+		sigs = append(sigs, stackBytes(vm, n-2))
+	}
+	vm, err := txvm.Validate(tx.Program, tx.Version, tx.Runlimit, txvm.BeforeStep(captureSig))
+	if err != nil {
+		return errors.Wrap(err, "validating export tx")
+	}
+	if vm.TxID != tx.ID.Byte32() {
+		return fmt.Errorf("export program has txid %x, want %x", vm.TxID[:], tx.ID.Bytes())
+	}
+	if len(sigs) != 1 {
+		return fmt.Errorf("got %d input signature checks, want 1", len(sigs))
+	}
+	if !bytes.Equal(pubkeys[0], pubkey) {
+		return fmt.Errorf("input signed by pubkey %x, want %x", pubkeys[0], pubkey)
+	}
+	if !bytes.HasPrefix(msgs[0], standard.VerifyTxID(tx.ID.Byte32())) {
+		return errors.New("input signature is not over the export txid")
+	}
+	if !ed25519.Verify(pubkey, msgs[0], sigs[0]) {
+		return errors.New("input signature does not verify")
+	}
+	return nil
+}
+
+// exportAccountReason returns why the pubkey in export refdata info,
+// the key that signed the export,
+// does not control the Zioncoin account that funded its temp account
+// (the Owner, or else the Exporter),
+// or the empty string if it does.
+// BuildExportTx derives both from the exporter's one key,
+// so a mismatch means the export would pay out
+// to an account its signer does not control.
+// It also rejects a recorded base fee below the network minimum,
+// with which the peg-out tx could never be applied.
+func exportAccountReason(info pegOut) string {
+	if info.BaseFee != 0 && info.BaseFee < minBaseFee {
+		return fmt.Sprintf("reference data base fee %d is below the network minimum of %d", info.BaseFee, minBaseFee)
+	}
+	if len(info.Pubkey) != ed25519.PublicKeySize {
+		return fmt.Sprintf("reference data pubkey has length %d, want %d", len(info.Pubkey), ed25519.PublicKeySize)
+	}
+	addr, err := strkey.Encode(strkey.VersionByteAccountID, info.Pubkey)
+	if err != nil {
+		return fmt.Sprintf("encoding reference data pubkey %x: %s", info.Pubkey, err)
+	}
+	if owner := info.owner(); addr != owner {
+		return fmt.Sprintf("export signed by pubkey %x (account %s), not by %s", info.Pubkey, addr, owner)
+	}
+	return ""
+}
+
+// stackBytes returns the string at position i of vm's current contract stack,
+// or nil if the item there is not a string.
+func stackBytes(vm *txvm.VM, i int) []byte {
+	item, ok := vm.StackItem(i).(txvm.Tuple)
+	if !ok || len(item) != 2 {
 		return nil
-	})
+	}
+	if code, ok := item[0].(txvm.Bytes); !ok || len(code) != 1 || code[0] != txvm.BytesCode {
+		return nil
+	}
+	b, _ := item[1].(txvm.Bytes)
+	return b
+}
+
+// logItemCode returns the code identifying the type of a tx log entry,
+// or zero if the entry is malformed.
+func logItemCode(item txvm.Tuple) byte {
+	if len(item) == 0 {
+		return 0
+	}
+	code, ok := item[0].(txvm.Bytes)
+	if !ok || len(code) == 0 {
+		return 0
+	}
+	return code[0]
 }
 
 // Runs as a goroutine.
@@ -168,40 +714,116 @@ func (c *Custodian) watchPegOuts(ctx context.Context, pegouts <-chan pegOut) {
 
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
+	trancheInterval := c.trancheInterval
+	if trancheInterval <= 0 {
+		trancheInterval = DefaultTrancheInterval
+	}
+	trancheTicker := time.NewTicker(trancheInterval)
+	defer trancheTicker.Stop()
+	var ledgers chan struct{}
+	if c.reconcileOnLedgers {
+		ledgers = make(chan struct{}, 1)
+		go c.watchLedgers(ctx, ledgers)
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			const q = `SELECT txid, pegout_json FROM exports WHERE pegged_out IN ($1, $2)`
-			var txids, refs [][]byte
-			err := sqlutil.ForQueryRows(ctx, c.DB, q, pegOutOK, pegOutFail, func(txid, ref []byte) {
-				txids = append(txids, txid)
-				refs = append(refs, ref)
-			})
+		case <-trancheTicker.C:
+			settled, err := c.payTranches(ctx)
 			if err != nil {
-				log.Fatalf("querying peg-outs: %s", err)
+				return
 			}
-			for i, txid := range txids {
-				var p pegOut
-				err = json.Unmarshal(refs[i], &p)
-				if err != nil {
-					log.Fatalf("unmarshaling reference: %s", err)
-				}
-				p.TxID = txid
-				err = c.doPostPegOut(ctx, p)
-				if err != nil {
-					log.Fatalf("doing post-peg-out: %s", err)
-				}
+			for _, p := range settled {
+				c.postPegOut(ctx, p)
 			}
+		case <-ticker.C:
+			// Peg-outs pending when confirmPegOuts missed their txs,
+			// or submitted asynchronously before a restart without AsyncPegOuts.
+			c.checkPendingPegOuts(ctx)
+			if c.ledgerStreamConnected() {
+				// Peg-outs are finished once per ledger instead.
+				continue
+			}
+			c.finishPegOuts(ctx)
+		case <-ledgers:
+			c.finishPegOuts(ctx)
 		case p, ok := <-pegouts:
 			if !ok {
-				log.Fatalf("peg-outs channel closed")
-			}
-			err := c.doPostPegOut(ctx, p)
-			if err != nil {
-				log.Fatalf("doing post-peg-out: %s", err)
+				// pegOutFromExports has exited.
+				log.Print("peg-outs channel closed")
+				return
 			}
+			c.postPegOut(ctx, p)
 		}
 	}
 }
+
+// postPegOutComponent is the component of the custodian's health
+// reporting failed post-peg-outs.
+const postPegOutComponent = "post-peg-outs"
+
+// postPegOut does the post-peg-out of export p, reporting whether it succeeded.
+// An export whose post-peg-out fails keeps its state,
+// so finishPegOuts retries it,
+// and the custodian reports itself unhealthy until a pass of finishPegOuts succeeds.
+func (c *Custodian) postPegOut(ctx context.Context, p pegOut) bool {
+	err := c.doPostPegOut(ctx, p)
+	if err == nil {
+		return true
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	log.Printf("doing post-peg-out of export %x, retrying later: %s", p.TxID, err)
+	c.health.setUnhealthy(postPegOutComponent, errors.Wrapf(err, "post-peg-out of export %x", p.TxID))
+	return false
+}
+
+// finishPegOuts does the post-peg-out of each export
+// whose peg-out has settled or failed.
+func (c *Custodian) finishPegOuts(ctx context.Context) {
+	const q = `SELECT txid, pegout_json, pegged_out, version, trace_parent FROM exports WHERE pegged_out IN ($1, $2) AND custodian_id=$3`
+	var (
+		txids, refs [][]byte
+		states      []pegOutState
+		versions    []int64
+		traces      []string
+	)
+	err := sqlutil.ForQueryRows(ctx, c.DB, q, pegOutOK, pegOutFail, c.label, func(txid, ref []byte, state pegOutState, version int64, trace string) {
+		txids = append(txids, txid)
+		refs = append(refs, ref)
+		states = append(states, state)
+		versions = append(versions, version)
+		traces = append(traces, trace)
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("querying peg-outs: %s", err)
+			c.health.setUnhealthy(postPegOutComponent, errors.Wrap(err, "querying peg-outs"))
+		}
+		return
+	}
+	var failed int
+	for i, txid := range txids {
+		var p pegOut
+		err = decodeRefdata(refs[i], &p)
+		if err != nil {
+			// Needs an operator; the other exports are still finished.
+			log.Printf("decoding reference data of export %x: %s", txid, err)
+			c.health.setUnhealthy(postPegOutComponent, errors.Wrapf(err, "decoding reference data of export %x", txid))
+			failed++
+			continue
+		}
+		p.TxID = txid
+		p.State = states[i]
+		p.Version = versions[i]
+		p.Trace = parseSpanContext(traces[i])
+		if !c.postPegOut(ctx, p) {
+			failed++
+		}
+	}
+	if failed == 0 && ctx.Err() == nil {
+		c.health.setHealthy(postPegOutComponent)
+	}
+}
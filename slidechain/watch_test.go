@@ -0,0 +1,436 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interzioncoin/slingshot/slidechain/mockequator"
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/interzioncoin/starlight/worizon/xlm"
+	b "github.com/zioncoin/go/build"
+	"github.com/zioncoin/go/clients/equator"
+	"github.com/zioncoin/go/keypair"
+	"github.com/zioncoin/go/network"
+	"github.com/zioncoin/go/xdr"
+)
+
+// withTestCustodian runs fn with a Custodian backed by a fresh db and a mock Horizon client.
+// The custodian account is created directly in the db, so no Zioncoin network access is needed.
+func withTestCustodian(ctx context.Context, t testing.TB, fn func(context.Context, *sql.DB, *Custodian), opts ...Option) {
+	testdir, err := ioutil.TempDir("", "slidechaintest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testdir)
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s/testdb", testdir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = setSchema(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO custodian (seed) VALUES ($1)", kp.Seed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]Option{RecoveryLog(filepath.Join(testdir, "recovery.log"))}, opts...)
+	c, err := newCustodian(ctx, db, mockequator.New(), DefaultBlockInterval, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn(ctx, db, c)
+}
+
+func TestPegInStartCursor(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		cur, err := c.pegInCursor(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cur != "12345" {
+			t.Errorf("got cursor %q on first run, want %q", cur, "12345")
+		}
+
+		_, err = db.Exec("UPDATE custodian SET cursor=$1 WHERE seed=$2", "67890", c.seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur, err = c.pegInCursor(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cur != "67890" {
+			t.Errorf("got cursor %q after cursor was stored, want %q", cur, "67890")
+		}
+	}, StartCursor("12345"))
+}
+
+func TestPegInStartLedger(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, _ *sql.DB, c *Custodian) {
+		cur, err := c.pegInCursor(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := equator.Cursor(fmt.Sprintf("%d", int64(1000)<<32))
+		if cur != want {
+			t.Errorf("got cursor %q, want %q", cur, want)
+		}
+	}, StartLedger(1000))
+}
+
+func TestDuplicatePegIn(t *testing.T) {
+	for _, src := range []PegInSource{PegInsFromTxs, PegInsFromPayments} {
+		t.Run(string(src), func(t *testing.T) {
+			testDuplicatePegIn(t, src)
+		})
+	}
+}
+
+func testDuplicatePegIn(t *testing.T, src PegInSource) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+		nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS)
+		err := c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, expMS, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kp, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		usd := makeAsset(xdr.AssetTypeAssetTypeCreditAlphanum4, "USD", importTestAccountID)
+		// Submit the same peg-in payment twice,
+		// the second time in a non-native asset.
+		for i := 1; i <= 2; i++ {
+			amount := b.PaymentMutator(b.NativeAmount{Amount: "10"})
+			if i == 2 {
+				amount = b.CreditAmount{Code: "USD", Issuer: importTestAccountID, Amount: "20"}
+			}
+			tx, err := b.Transaction(
+				b.Network{Passphrase: network.TestNetworkPassphrase},
+				b.SourceAccount{AddressOrSeed: kp.Address()},
+				b.Sequence{Sequence: uint64(i)},
+				b.MemoHash{Value: xdr.Hash(nonceHash)},
+				b.Payment(
+					b.Destination{AddressOrSeed: c.AccountID.Address()},
+					amount,
+				),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = zioncoin.SignAndSubmitTx(c.hclient, tx, kp.Seed())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		done := make(chan struct{})
+		go func() {
+			c.watchPegIns(ctx)
+			close(done)
+		}()
+		defer func() {
+			// Wait for watchPegIns to exit before the db is closed.
+			cancel()
+			<-done
+		}()
+
+		for {
+			var zioncoinTx, flagged int
+			err = db.QueryRow("SELECT zioncoin_tx FROM pegs WHERE nonce_hash=$1", nonceHash[:]).Scan(&zioncoinTx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.QueryRow("SELECT COUNT(*) FROM flagged_pegs WHERE nonce_hash=$1 AND reason='duplicate'", nonceHash[:]).Scan(&flagged)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if zioncoinTx == 1 && flagged == 1 {
+				break
+			}
+			if flagged > 1 {
+				t.Fatalf("got %d flagged payments, want 1", flagged)
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for duplicate peg-in to be flagged (zioncoin_tx=%d, flagged=%d)", zioncoinTx, flagged)
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		usdXDR, err := usd.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			amount   int64
+			assetXDR []byte
+		)
+		err = db.QueryRow("SELECT amount, asset_xdr FROM pegs WHERE nonce_hash=$1", nonceHash[:]).Scan(&amount, &assetXDR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if amount != int64(10*xlm.Lumen) || !bytes.Equal(assetXDR, lumenXDR) {
+			t.Errorf("got peg of %d of asset %x, want %d of %x", amount, assetXDR, int64(10*xlm.Lumen), lumenXDR)
+		}
+		var source string
+		err = db.QueryRow("SELECT source, amount, asset_xdr FROM flagged_pegs WHERE nonce_hash=$1", nonceHash[:]).Scan(&source, &amount, &assetXDR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if source != kp.Address() || amount != int64(20*xlm.Lumen) || !bytes.Equal(assetXDR, usdXDR) {
+			t.Errorf("got flagged payment of %d of asset %x from %s, want %d of %x from %s", amount, assetXDR, source, int64(20*xlm.Lumen), usdXDR, kp.Address())
+		}
+	}, PegIns(src))
+}
+
+func TestPegInPaymentsResumeFromTxCursor(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// The mock client's first transaction has paging token 1<<12,
+	// as stored by the transaction stream once it has handled that transaction.
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		kp, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var nonceHashes [][32]byte
+		for i := 1; i <= 2; i++ {
+			expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+			nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS+int64(i))
+			err := c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, expMS+int64(i), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonceHashes = append(nonceHashes, nonceHash)
+			tx, err := b.Transaction(
+				b.Network{Passphrase: network.TestNetworkPassphrase},
+				b.SourceAccount{AddressOrSeed: kp.Address()},
+				b.Sequence{Sequence: uint64(i)},
+				b.MemoHash{Value: xdr.Hash(nonceHash)},
+				b.Payment(
+					b.Destination{AddressOrSeed: c.AccountID.Address()},
+					b.NativeAmount{Amount: "10"},
+				),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = zioncoin.SignAndSubmitTx(c.hclient, tx, kp.Seed())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		done := make(chan struct{})
+		go func() {
+			c.watchPegIns(ctx)
+			close(done)
+		}()
+		defer func() {
+			// Wait for watchPegIns to exit before the db is closed.
+			cancel()
+			<-done
+		}()
+
+		for {
+			var zioncoinTx int
+			err = db.QueryRow("SELECT zioncoin_tx FROM pegs WHERE nonce_hash=$1", nonceHashes[1][:]).Scan(&zioncoinTx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if zioncoinTx == 1 {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for peg-in")
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		var zioncoinTx, flagged int
+		err = db.QueryRow("SELECT zioncoin_tx FROM pegs WHERE nonce_hash=$1", nonceHashes[0][:]).Scan(&zioncoinTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.QueryRow("SELECT COUNT(*) FROM flagged_pegs").Scan(&flagged)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if zioncoinTx != 0 || flagged != 0 {
+			t.Errorf("payment in transaction before the cursor was handled (zioncoin_tx=%d, flagged=%d)", zioncoinTx, flagged)
+		}
+	}, PegIns(PegInsFromPayments), StartCursor(fmt.Sprint(1<<12)))
+}
+
+func TestIgnoreCustodianPegIns(t *testing.T) {
+	for _, src := range []PegInSource{PegInsFromTxs, PegInsFromPayments} {
+		t.Run(string(src), func(t *testing.T) {
+			testIgnoreCustodianPegIns(t, src)
+		})
+	}
+}
+
+func testIgnoreCustodianPegIns(t *testing.T, src PegInSource) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		kp, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var nonceHashes [][32]byte
+		for i := int64(0); i < 2; i++ {
+			expMS := int64(bc.Millis(time.Now().Add(10 * time.Minute)))
+			nonceHash := uniqueNonceHash(c.InitBlockHash.Bytes(), expMS+i)
+			err := c.insertPegIn(ctx, nonceHash[:], testRecipPubKey, expMS+i, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonceHashes = append(nonceHashes, nonceHash)
+		}
+
+		// The custodian pays itself with the first peg's memo,
+		// both in its own tx and in an operation of another account's tx.
+		// Then the second peg is paid by its sender.
+		submit := func(txSource, opSource, seed string, seq uint64, nonceHash [32]byte) {
+			tx, err := b.Transaction(
+				b.Network{Passphrase: network.TestNetworkPassphrase},
+				b.SourceAccount{AddressOrSeed: txSource},
+				b.Sequence{Sequence: seq},
+				b.MemoHash{Value: xdr.Hash(nonceHash)},
+				b.Payment(
+					b.SourceAccount{AddressOrSeed: opSource},
+					b.Destination{AddressOrSeed: c.AccountID.Address()},
+					b.NativeAmount{Amount: "10"},
+				),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = zioncoin.SignAndSubmitTx(c.hclient, tx, seed)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		submit(c.AccountID.Address(), c.AccountID.Address(), c.seed, 1, nonceHashes[0])
+		submit(kp.Address(), c.AccountID.Address(), kp.Seed(), 1, nonceHashes[0])
+		submit(kp.Address(), kp.Address(), kp.Seed(), 2, nonceHashes[1])
+
+		done := make(chan struct{})
+		go func() {
+			c.watchPegIns(ctx)
+			close(done)
+		}()
+		defer func() {
+			// Wait for watchPegIns to exit before the db is closed.
+			cancel()
+			<-done
+		}()
+
+		for {
+			var zioncoinTx int
+			err = db.QueryRow("SELECT zioncoin_tx FROM pegs WHERE nonce_hash=$1", nonceHashes[1][:]).Scan(&zioncoinTx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if zioncoinTx == 1 {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for peg-in")
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		var zioncoinTx, flagged int
+		err = db.QueryRow("SELECT zioncoin_tx FROM pegs WHERE nonce_hash=$1", nonceHashes[0][:]).Scan(&zioncoinTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.QueryRow("SELECT COUNT(*) FROM flagged_pegs").Scan(&flagged)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if zioncoinTx != 0 || flagged != 0 {
+			t.Errorf("custodian's own payment handled as a peg-in (zioncoin_tx=%d, flagged=%d)", zioncoinTx, flagged)
+		}
+	}, PegIns(src))
+}
+
+func TestFinishPegOutsUndecodable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		// An export that cannot be finished leaves the custodian running but unhealthy.
+		txid := []byte("undecodable")
+		_, err := db.Exec("INSERT INTO exports (txid, pegout_json, pegged_out) VALUES ($1, $2, $3)", txid, []byte("garbage"), pegOutOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.finishPegOuts(ctx)
+		if problems := c.health.problems(); len(problems) != 1 || !strings.HasPrefix(problems[0], postPegOutComponent) {
+			t.Errorf("got health problems %v, want one for %s", problems, postPegOutComponent)
+		}
+		var state pegOutState
+		err = db.QueryRow("SELECT pegged_out FROM exports WHERE txid=$1", txid).Scan(&state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != pegOutOK {
+			t.Errorf("got state %d after failed post-peg-out, want %d", state, pegOutOK)
+		}
+
+		// The custodian recovers once the export is dealt with.
+		_, err = db.Exec("DELETE FROM exports WHERE txid=$1", txid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.finishPegOuts(ctx)
+		if problems := c.health.problems(); len(problems) != 0 {
+			t.Errorf("got health problems %v after the export was removed, want none", problems)
+		}
+	})
+}
@@ -0,0 +1,306 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/interzioncoin/slingshot/slidechain/net"
+	"github.com/zioncoin/go/xdr"
+)
+
+// WebhookSignatureHeader is the HTTP header carrying
+// the hex-encoded HMAC-SHA256 of a webhook request body,
+// keyed with the webhook's shared secret.
+const WebhookSignatureHeader = "X-Slidechain-Signature"
+
+const (
+	webhookTimeout    = 10 * time.Second
+	webhookBackoffMin = time.Second
+	webhookBackoffMax = time.Hour
+)
+
+// PegOutNotification is the payload of the webhook request
+// sent when a peg-out settles.
+type PegOutNotification struct {
+	ExportTxID string `json:"export_txid"`
+	ZioncoinTx string `json:"zioncoin_tx"`
+	Exporter   string `json:"exporter"`
+	Asset      string `json:"asset"`
+	AssetXDR   []byte `json:"asset_xdr"`
+
+	// ExportedAmount is the amount of Asset exported from slidechain.
+	// Of that, Fee is kept by the custodian (see FeePolicy)
+	// and PaidAmount is paid out.
+	ExportedAmount int64 `json:"exported_amount"`
+	Fee            int64 `json:"fee"`
+	PaidAmount     int64 `json:"paid_amount"`
+
+	// ConvertedAsset and ConvertedAmount, if set,
+	// are the asset and amount the payee received instead,
+	// bought with at most the paid amount (see ExportOptions.Conversion).
+	ConvertedAsset  string `json:"converted_asset,omitempty"`
+	ConvertedAmount int64  `json:"converted_amount,omitempty"`
+}
+
+// WebhookDelivery is the delivery status of a webhook notification.
+type WebhookDelivery struct {
+	ExportTxID  string          `json:"export_txid"`
+	Payload     json.RawMessage `json:"payload"`
+	Delivered   bool            `json:"delivered"`
+	DeliveredMS int64           `json:"delivered_ms,omitempty"`
+	Attempts    int64           `json:"attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+type webhook struct {
+	url    string
+	secret []byte
+	client *http.Client
+	ready  chan struct{}
+}
+
+// Webhook causes the custodian to POST a PegOutNotification to url
+// for each peg-out that settles,
+// signed with secret (see WebhookSignatureHeader).
+// Notifications are recorded in the db and delivered at least once,
+// retrying with backoff until the server responds with a 2xx status.
+func Webhook(url string, secret []byte) Option {
+	return func(c *Custodian) {
+		c.webhook = &webhook{
+			url:    url,
+			secret: secret,
+			client: &http.Client{Timeout: webhookTimeout},
+			ready:  make(chan struct{}, 1),
+		}
+	}
+}
+
+// queuePegOutNotification records the webhook notification for a settled peg-out
+// as part of dbtx.
+func queuePegOutNotification(ctx context.Context, dbtx *sql.Tx, p pegOut, zioncoinTx string) error {
+	var asset xdr.Asset
+	err := xdr.SafeUnmarshal(p.AssetXDR, &asset)
+	if err != nil {
+		return errors.Wrapf(err, "unmarshaling asset from XDR %x", p.AssetXDR)
+	}
+	var fee int64
+	err = dbtx.QueryRowContext(ctx, `SELECT amount FROM fees WHERE txid=$1`, p.TxID).Scan(&fee)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Wrapf(err, "reading fee of export %x", p.TxID)
+	}
+	n := PegOutNotification{
+		ExportTxID:     hex.EncodeToString(p.TxID),
+		ZioncoinTx:     zioncoinTx,
+		Exporter:       p.Exporter,
+		Asset:          asset.String(),
+		AssetXDR:       p.AssetXDR,
+		ExportedAmount: p.Amount,
+		Fee:            fee,
+		PaidAmount:     p.Amount - fee,
+	}
+	conv, err := p.conversion()
+	if err != nil {
+		return err
+	}
+	if conv != nil {
+		n.ConvertedAsset = conv.Asset.String()
+		n.ConvertedAmount = conv.Amount
+	}
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return errors.Wrap(err, "marshaling peg-out notification")
+	}
+	_, err = dbtx.ExecContext(ctx, `INSERT OR IGNORE INTO webhooks (export_txid, payload) VALUES ($1, $2)`, p.TxID, payload)
+	return errors.Wrapf(err, "queueing peg-out notification for export %x", p.TxID)
+}
+
+// notifyWebhooks wakes deliverWebhooks without blocking.
+func (c *Custodian) notifyWebhooks() {
+	if c.webhook == nil {
+		return
+	}
+	select {
+	case c.webhook.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Runs as a goroutine.
+// Failures are logged and retried;
+// they never stop the custodian.
+func (c *Custodian) deliverWebhooks(ctx context.Context) {
+	defer log.Print("deliverWebhooks exiting")
+
+	ticker := time.NewTicker(webhookBackoffMin)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.webhook.ready:
+		}
+
+		const q = `SELECT export_txid, payload, attempts FROM webhooks WHERE delivered_ms=0 AND next_attempt_ms<=$1`
+		var (
+			txids, payloads [][]byte
+			attempts        []int64
+		)
+		err := sqlutil.ForQueryRows(ctx, c.DB, q, int64(bc.Millis(time.Now())), func(txid, payload []byte, n int64) {
+			txids = append(txids, txid)
+			payloads = append(payloads, payload)
+			attempts = append(attempts, n)
+		})
+		if err != nil {
+			c.health.setUnhealthy("webhooks", errors.Wrap(err, "reading pending webhooks"))
+			continue
+		}
+		for i, txid := range txids {
+			if ctx.Err() != nil {
+				return
+			}
+			err = c.postWebhook(ctx, payloads[i])
+			now := time.Now()
+			if err == nil {
+				_, err = c.DB.ExecContext(ctx, `UPDATE webhooks SET delivered_ms=$1, attempts=attempts+1, last_error='' WHERE export_txid=$2`, int64(bc.Millis(now)), txid)
+				if err != nil {
+					c.health.setUnhealthy("webhooks", errors.Wrapf(err, "recording webhook delivery for export %x", txid))
+					continue
+				}
+				c.health.setHealthy("webhooks")
+				continue
+			}
+			log.Printf("delivering webhook for export %x (attempt %d): %s", txid, attempts[i]+1, err)
+			next := now.Add(webhookBackoff(attempts[i] + 1))
+			_, err = c.DB.ExecContext(ctx, `UPDATE webhooks SET attempts=attempts+1, next_attempt_ms=$1, last_error=$2 WHERE export_txid=$3`, int64(bc.Millis(next)), err.Error(), txid)
+			if err != nil {
+				c.health.setUnhealthy("webhooks", errors.Wrapf(err, "recording webhook failure for export %x", txid))
+			}
+		}
+	}
+}
+
+// webhookBackoff returns the delay before the next delivery attempt
+// of a webhook that has failed the given number of times.
+func webhookBackoff(failures int64) time.Duration {
+	d := webhookBackoffMin
+	for i := int64(1); i < failures && d < webhookBackoffMax; i++ {
+		d *= 2
+	}
+	if d > webhookBackoffMax {
+		d = webhookBackoffMax
+	}
+	return d
+}
+
+func (c *Custodian) postWebhook(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequest("POST", c.webhook.url, bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "building webhook request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(c.webhook.secret, payload))
+	resp, err := c.webhook.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "sending webhook request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("webhook responded with status %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// SignWebhook returns the hex-encoded HMAC-SHA256 of a webhook request body,
+// as sent in WebhookSignatureHeader.
+// Receivers should compare it against the header with hmac.Equal.
+func SignWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Webhooks responds with the delivery status of webhook notifications as JSON.
+// With the query parameter failed=1, it lists only undelivered notifications
+// that have been attempted at least once.
+func (c *Custodian) Webhooks(w http.ResponseWriter, req *http.Request) {
+	q := `SELECT export_txid, payload, delivered_ms, attempts, last_error FROM webhooks`
+	if req.FormValue("failed") == "1" {
+		q += ` WHERE delivered_ms=0 AND attempts>0`
+	}
+	deliveries := []WebhookDelivery{}
+	err := sqlutil.ForQueryRows(req.Context(), c.DB, q, func(txid, payload []byte, deliveredMS, attempts int64, lastError string) {
+		deliveries = append(deliveries, WebhookDelivery{
+			ExportTxID:  hex.EncodeToString(txid),
+			Payload:     payload,
+			Delivered:   deliveredMS != 0,
+			DeliveredMS: deliveredMS,
+			Attempts:    attempts,
+			LastError:   lastError,
+		})
+	})
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "reading webhooks: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(deliveries)
+	if err != nil {
+		net.Errorf(w, http.StatusInternalServerError, "sending response: %s", err)
+		return
+	}
+}
+
+// ReplayWebhook schedules the webhook notification for the export with the given txid
+// for immediate redelivery, whether or not it was delivered before.
+func (c *Custodian) ReplayWebhook(ctx context.Context, txid []byte) error {
+	result, err := c.DB.ExecContext(ctx, `UPDATE webhooks SET delivered_ms=0, next_attempt_ms=0 WHERE export_txid=$1`, txid)
+	if err != nil {
+		return errors.Wrapf(err, "replaying webhook for export %x", txid)
+	}
+	numAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "checking rows affected by webhook replay for export %x", txid)
+	}
+	if numAffected != 1 {
+		return fmt.Errorf("no webhook for export %x", txid)
+	}
+	c.notifyWebhooks()
+	return nil
+}
+
+// ReplayWebhookHandler handles POST requests to redeliver
+// the webhook notification for the export with the hex-encoded txid
+// given in the query parameter txid.
+func (c *Custodian) ReplayWebhookHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		net.Errorf(w, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	txid, err := hex.DecodeString(req.FormValue("txid"))
+	if err != nil {
+		net.Errorf(w, http.StatusBadRequest, "decoding txid: %s", err)
+		return
+	}
+	err = c.ReplayWebhook(req.Context(), txid)
+	if err != nil {
+		net.Errorf(w, http.StatusNotFound, "%s", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,166 @@
+package slidechain
+
+import (
+	"context"
+	"crypto/hmac"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestPegOutWebhook(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	secret := []byte("shared secret")
+	requests := make(chan PegOutNotification)
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		sig, err := hex.DecodeString(req.Header.Get(WebhookSignatureHeader))
+		if err != nil {
+			t.Error(err)
+		}
+		want, _ := hex.DecodeString(SignWebhook(secret, body))
+		if !hmac.Equal(sig, want) {
+			t.Errorf("webhook request has signature %x, want %x", sig, want)
+		}
+		calls++
+		if calls == 1 {
+			// The first delivery attempt fails and must be retried.
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var n PegOutNotification
+		err = json.Unmarshal(body, &n)
+		if err != nil {
+			t.Error(err)
+		}
+		select {
+		case requests <- n:
+		case <-ctx.Done():
+		}
+	}))
+	defer server.Close()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		txid := []byte("export")
+		insertTestExport(t, db, txid, lumenXDR, 100, exporter.Address())
+		_, err = db.Exec("UPDATE exports SET pegged_out=$1, zioncoin_tx=$2 WHERE txid=$3", pegOutOK, "zioncointx", txid)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			c.deliverWebhooks(ctx)
+			close(done)
+		}()
+		defer func() {
+			// Wait for deliverWebhooks to exit before the db is closed.
+			cancel()
+			<-done
+		}()
+
+		err = c.recordFee(ctx, txid, lumenXDR, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := pegOut{
+			TxID:     txid,
+			AssetXDR: lumenXDR,
+			Exporter: exporter.Address(),
+			Amount:   100,
+			State:    pegOutOK,
+		}
+		err = c.finishExport(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		err = db.QueryRow("SELECT COUNT(*) FROM exports").Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("got %d exports after finishing peg-out, want 0", n)
+		}
+
+		want := PegOutNotification{
+			ExportTxID:     hex.EncodeToString(txid),
+			ZioncoinTx:     "zioncointx",
+			Exporter:       exporter.Address(),
+			Asset:          "native",
+			AssetXDR:       lumenXDR,
+			ExportedAmount: 100,
+			Fee:            3,
+			PaidAmount:     97,
+		}
+		check := func(got PegOutNotification) {
+			if got.ExportTxID != want.ExportTxID || got.ZioncoinTx != want.ZioncoinTx || got.Exporter != want.Exporter || got.Asset != want.Asset || got.ExportedAmount != want.ExportedAmount || got.Fee != want.Fee || got.PaidAmount != want.PaidAmount {
+				t.Errorf("got notification %+v, want %+v", got, want)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for webhook delivery")
+		case got := <-requests:
+			check(got)
+		}
+
+		var deliveries []WebhookDelivery
+		for {
+			w := httptest.NewRecorder()
+			c.Webhooks(w, httptest.NewRequest("GET", "/webhooks", nil))
+			err = json.Unmarshal(w.Body.Bytes(), &deliveries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(deliveries) == 1 && deliveries[0].Delivered {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for delivery record, got %+v", deliveries)
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		if deliveries[0].Attempts != 2 {
+			t.Errorf("got %d delivery attempts, want 2", deliveries[0].Attempts)
+		}
+
+		err = c.ReplayWebhook(ctx, txid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for webhook redelivery")
+		case got := <-requests:
+			check(got)
+		}
+	}, Webhook(server.URL, secret))
+}
@@ -0,0 +1,184 @@
+package slidechain
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bobg/sqlutil"
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/zioncoin/go/keypair"
+)
+
+// AuditMode causes the custodian to witness each peg-out it submits
+// in an append-only log in its db.
+// Each entry attests to the peg-out's export txid, Zioncoin tx hash,
+// asset, amount, and destination,
+// and is chained to the entry before it by hash
+// and signed with the custodian account's key,
+// so that VerifyWitnessLog detects any later change to the log.
+func AuditMode() Option {
+	return func(c *Custodian) {
+		c.auditMode = true
+	}
+}
+
+// WitnessEntry is an entry in the custodian's witness log (see AuditMode).
+type WitnessEntry struct {
+	// Position numbers the custodian's entries from zero.
+	Position    int64  `json:"position"`
+	ExportTxID  []byte `json:"export_txid"`
+	ZioncoinTx  string `json:"zioncoin_tx"`
+	AssetXDR    []byte `json:"asset"`
+	Amount      int64  `json:"amount"`
+	Destination string `json:"destination"`
+	TimestampMS int64  `json:"timestamp_ms"`
+
+	// PrevHash is the Hash of the entry at the previous position,
+	// or empty for the first entry.
+	PrevHash []byte `json:"prev_hash"`
+
+	// Hash commits to the entry's other fields, including PrevHash,
+	// and Signature is the custodian account's signature of Hash.
+	Hash      []byte `json:"hash"`
+	Signature []byte `json:"signature"`
+}
+
+// witnessHash returns the hash of e's fields other than Hash and Signature.
+func witnessHash(e WitnessEntry) ([]byte, error) {
+	e.Hash, e.Signature = nil, nil
+	if len(e.PrevHash) == 0 {
+		// The db may return the first entry's PrevHash as nil or empty.
+		e.PrevHash = nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshaling witness entry")
+	}
+	h := sha256.New()
+	h.Write([]byte("slidechain witness"))
+	h.Write(data)
+	return h.Sum(nil), nil
+}
+
+// witnessPegOut appends an entry to the witness log,
+// if the custodian is in audit mode,
+// attesting that Zioncoin tx zioncoinTx pegs out export txid
+// by paying amount of the asset with XDR assetXDR to destination.
+func (c *Custodian) witnessPegOut(ctx context.Context, txid []byte, zioncoinTx string, assetXDR []byte, amount int64, destination string) error {
+	if !c.auditMode {
+		return nil
+	}
+	kp, err := keypair.Parse(c.seed)
+	if err != nil {
+		return errors.Wrap(err, "parsing custodian seed")
+	}
+	dbtx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning db transaction")
+	}
+	defer dbtx.Rollback()
+
+	e := WitnessEntry{
+		ExportTxID:  txid,
+		ZioncoinTx:  zioncoinTx,
+		AssetXDR:    assetXDR,
+		Amount:      amount,
+		Destination: destination,
+		TimestampMS: int64(bc.Millis(time.Now())),
+	}
+	const q = `SELECT position, hash FROM witness_log WHERE custodian_id=$1 ORDER BY position DESC LIMIT 1`
+	var position int64
+	err = dbtx.QueryRowContext(ctx, q, c.label).Scan(&position, &e.PrevHash)
+	if err == nil {
+		e.Position = position + 1
+	} else if err == sql.ErrNoRows {
+		e.PrevHash = []byte{}
+	} else {
+		return errors.Wrap(err, "reading witness log head")
+	}
+	e.Hash, err = witnessHash(e)
+	if err != nil {
+		return err
+	}
+	e.Signature, err = kp.Sign(e.Hash)
+	if err != nil {
+		return errors.Wrap(err, "signing witness entry")
+	}
+	// The primary key on (custodian_id, position) keeps the log from forking.
+	_, err = dbtx.ExecContext(ctx, `INSERT INTO witness_log (custodian_id, position, export_txid, zioncoin_tx, asset_xdr, amount, destination, timestamp_ms, prev_hash, hash, signature) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		c.label, e.Position, e.ExportTxID, e.ZioncoinTx, e.AssetXDR, e.Amount, e.Destination, e.TimestampMS, e.PrevHash, e.Hash, e.Signature)
+	if err != nil {
+		return errors.Wrapf(err, "witnessing peg-out of export %x", txid)
+	}
+	return errors.Wrapf(dbtx.Commit(), "committing witness of export %x", txid)
+}
+
+// VerifyWitnessLog checks the custodian's witness log (see AuditMode),
+// returning an error naming the first entry
+// that is out of place, does not chain to the entry before it,
+// does not match its hash,
+// or is not signed by the custodian account.
+// Removing entries from the end of the log goes undetected,
+// so auditors should also keep the latest Hash they have seen.
+func (c *Custodian) VerifyWitnessLog(ctx context.Context) error {
+	kp, err := keypair.Parse(c.AccountID.Address())
+	if err != nil {
+		return errors.Wrap(err, "parsing custodian account")
+	}
+	var (
+		want     int64
+		prevHash []byte
+		bad      error
+	)
+	const q = `SELECT position, export_txid, zioncoin_tx, asset_xdr, amount, destination, timestamp_ms, prev_hash, hash, signature FROM witness_log WHERE custodian_id=$1 ORDER BY position`
+	err = sqlutil.ForQueryRows(ctx, c.DB, q, c.label, func(position int64, txid []byte, zioncoinTx string, assetXDR []byte, amount int64, destination string, timestampMS int64, prev, hash, sig []byte) {
+		if bad != nil {
+			return
+		}
+		e := WitnessEntry{
+			Position:    position,
+			ExportTxID:  txid,
+			ZioncoinTx:  zioncoinTx,
+			AssetXDR:    assetXDR,
+			Amount:      amount,
+			Destination: destination,
+			TimestampMS: timestampMS,
+			PrevHash:    prev,
+			Hash:        hash,
+			Signature:   sig,
+		}
+		bad = verifyWitnessEntry(kp, e, want, prevHash)
+		want++
+		prevHash = hash
+	})
+	if err != nil {
+		return errors.Wrap(err, "reading witness log")
+	}
+	return bad
+}
+
+// verifyWitnessEntry checks that e is at position
+// and chains to prevHash, and checks its hash and signature.
+func verifyWitnessEntry(kp keypair.KP, e WitnessEntry, position int64, prevHash []byte) error {
+	if e.Position != position {
+		return fmt.Errorf("witness log has entry %d where %d belongs", e.Position, position)
+	}
+	if !bytes.Equal(e.PrevHash, prevHash) {
+		return fmt.Errorf("witness entry %d does not chain to the entry before it", e.Position)
+	}
+	hash, err := witnessHash(e)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, e.Hash) {
+		return fmt.Errorf("witness entry %d does not match its hash", e.Position)
+	}
+	err = kp.Verify(e.Hash, e.Signature)
+	return errors.Wrapf(err, "verifying signature of witness entry %d", e.Position)
+}
@@ -0,0 +1,143 @@
+package slidechain
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/interzioncoin/slingshot/slidechain/zioncoin"
+	"github.com/zioncoin/go/keypair"
+)
+
+func TestWitnessLog(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	withTestCustodian(ctx, t, func(ctx context.Context, db *sql.DB, c *Custodian) {
+		exporter, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lumenXDR, err := zioncoin.NativeAsset().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A peg-out submitted by pegOutFromExports is witnessed.
+		txid := []byte("pegged")
+		insertTestExport(t, db, txid, lumenXDR, 1000, exporter.Address())
+		pegouts := make(chan pegOut)
+		pegOutCtx, cancelPegOuts := context.WithCancel(ctx)
+		go c.pegOutFromExports(pegOutCtx, pegouts)
+		var p pegOut
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for peg-out")
+			case <-time.After(100 * time.Millisecond):
+				c.exports.Broadcast()
+			case p = <-pegouts:
+				break wait
+			}
+		}
+		cancelPegOuts()
+		var (
+			gotTx, zioncoinTx string
+			amount            int64
+		)
+		err = db.QueryRow("SELECT zioncoin_tx FROM exports WHERE txid=$1", txid).Scan(&zioncoinTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.QueryRow("SELECT zioncoin_tx, amount FROM witness_log WHERE export_txid=$1", txid).Scan(&gotTx, &amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.State != pegOutOK || gotTx != zioncoinTx || amount != 1000 {
+			t.Errorf("got witness of tx %s paying %d for peg-out in state %d, want tx %s paying 1000 in state %d", gotTx, amount, p.State, zioncoinTx, pegOutOK)
+		}
+
+		// witness replaces the log with entries 0, 1, and 2.
+		witness := func() {
+			_, err := db.Exec("DELETE FROM witness_log")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				err = c.witnessPegOut(ctx, []byte{byte(i)}, fmt.Sprintf("tx%d", i), lumenXDR, int64(100*(i+1)), exporter.Address())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		witness()
+		err = c.VerifyWitnessLog(ctx)
+		if err != nil {
+			t.Fatalf("verifying untampered log: %s", err)
+		}
+
+		forger, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases := []struct {
+			name    string
+			tamper  func()
+			wantErr string
+		}{
+			{"altered amount", func() {
+				_, err := db.Exec("UPDATE witness_log SET amount=amount+1 WHERE position=1")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}, "entry 1 does not match its hash"},
+			{"removed entry", func() {
+				_, err := db.Exec("DELETE FROM witness_log WHERE position=1")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}, "entry 2 where 1 belongs"},
+			{"broken chain", func() {
+				_, err := db.Exec("UPDATE witness_log SET prev_hash=x'00' WHERE position=2")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}, "entry 2 does not chain"},
+			{"forged entry", func() {
+				// The forger rehashes an altered entry, but cannot sign as the custodian.
+				var e WitnessEntry
+				err := db.QueryRow("SELECT position, export_txid, zioncoin_tx, asset_xdr, amount, destination, timestamp_ms, prev_hash FROM witness_log WHERE position=2").Scan(&e.Position, &e.ExportTxID, &e.ZioncoinTx, &e.AssetXDR, &e.Amount, &e.Destination, &e.TimestampMS, &e.PrevHash)
+				if err != nil {
+					t.Fatal(err)
+				}
+				e.Destination = forger.Address()
+				e.Hash, err = witnessHash(e)
+				if err != nil {
+					t.Fatal(err)
+				}
+				e.Signature, err = forger.Sign(e.Hash)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = db.Exec("UPDATE witness_log SET destination=$1, hash=$2, signature=$3 WHERE position=2", e.Destination, e.Hash, e.Signature)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}, "signature of witness entry 2"},
+		}
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				witness()
+				tt.tamper()
+				err := c.VerifyWitnessLog(ctx)
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want one mentioning %q", err, tt.wantErr)
+				}
+			})
+		}
+	}, AuditMode())
+}